@@ -0,0 +1,274 @@
+// Package apiv2 defines the JSON documents returned by version 2 of the
+// bendo REST API, the routes under /api/v2.
+//
+// These types are the API's schema, kept apart from the structures the
+// server uses internally, so the internal ones can change without changing
+// what clients see. Fields in these types may be added but are never
+// removed or renamed; anything else needs a new version of the API. Clients
+// may decode responses into them directly.
+//
+// Times are in RFC 3339 format, and checksums are hex encoded.
+package apiv2
+
+import (
+	"encoding/hex"
+	"time"
+
+	"github.com/ndlib/bendo/fragment"
+	"github.com/ndlib/bendo/items"
+	"github.com/ndlib/bendo/transaction"
+)
+
+// An Item is the response to GET /api/v2/item/:id.
+type Item struct {
+	ID          string    `json:"id"`
+	Blobs       []Blob    `json:"blobs"`    // sorted by id
+	Versions    []Version `json:"versions"` // sorted by id
+	Identifiers []string  `json:"identifiers"`
+}
+
+// A Blob is a single file of content in an item. Blobs are numbered from 1.
+type Blob struct {
+	ID       int       `json:"id"`
+	Created  time.Time `json:"created"`
+	Creator  string    `json:"creator"`
+	Size     int64     `json:"size"`
+	MD5      string    `json:"md5,omitempty"`
+	SHA256   string    `json:"sha256,omitempty"`
+	MimeType string    `json:"mime-type,omitempty"`
+
+	// Digests has any other checksums recorded for the blob, such as
+	// "sha512", in hex and keyed by algorithm name.
+	Digests map[string]string `json:"digests,omitempty"`
+
+	// These are only set for a blob which has been deleted.
+	Deleted    *time.Time `json:"deleted,omitempty"`
+	Deleter    string     `json:"deleter,omitempty"`
+	DeleteNote string     `json:"delete-note,omitempty"`
+}
+
+// A Version names the blobs of an item at one point in time. Versions are
+// numbered from 1.
+type Version struct {
+	ID      int       `json:"id"`
+	Created time.Time `json:"created"`
+	Creator string    `json:"creator"`
+	Note    string    `json:"note"`
+
+	// Slots maps each file name in the version to a blob id.
+	Slots map[string]int `json:"slots"`
+
+	// SlotMetadata holds extra metadata for some slots, such as a file's
+	// modification time, indexed by slot name and then by key.
+	SlotMetadata map[string]map[string]string `json:"slot-metadata,omitempty"`
+}
+
+// A Listing is the response to GET /api/v2/item/:id/@list/path. It gives the
+// files and directories inside one directory of a version, where the slot
+// names are taken as paths separated by "/".
+type Listing struct {
+	Item    string  `json:"item"`
+	Version int     `json:"version"`
+	Path    string  `json:"path"`    // the directory listed, "" for the top
+	Entries []Entry `json:"entries"` // sorted by name
+}
+
+// An Entry is a file or a directory in a Listing. Its name is relative to
+// the directory listed. Directories only have a name and a modification
+// time, the newest of the files inside them.
+type Entry struct {
+	Name     string    `json:"name"`
+	Dir      bool      `json:"dir,omitempty"`
+	Blob     int       `json:"blob,omitempty"`
+	Size     int64     `json:"size"`
+	MD5      string    `json:"md5,omitempty"`
+	SHA256   string    `json:"sha256,omitempty"`
+	MimeType string    `json:"mime-type,omitempty"`
+	Modified time.Time `json:"modified"`
+}
+
+// A Transaction is the response to GET /api/v2/transaction/:id.
+type Transaction struct {
+	ID       string     `json:"id"`
+	Item     string     `json:"item"`
+	Status   string     `json:"status"`            // one of the Status constants
+	Version  int        `json:"version,omitempty"` // the version made, once finished
+	Creator  string     `json:"creator"`
+	Started  time.Time  `json:"started"`
+	Modified time.Time  `json:"modified"`
+	Errors   []string   `json:"errors"`
+	Bytes    int64      `json:"bytes"` // the size of the files being added
+	Commands [][]string `json:"commands"`
+	Timing   Timing     `json:"timing"`
+}
+
+// The values of Transaction.Status.
+const (
+	StatusUnknown  = "unknown"
+	StatusOpen     = "open"
+	StatusWaiting  = "waiting"  // queued to be committed
+	StatusChecking = "checking" // uploaded files are being checksummed
+	StatusIngest   = "ingest"   // files are being written into bundles
+	StatusFinished = "finished"
+	StatusError    = "error"
+)
+
+// Timing is how many seconds each phase of committing a transaction took.
+// A phase which has not run is 0.
+type Timing struct {
+	Verify float64 `json:"verify"`
+	Ingest float64 `json:"ingest"`
+	Index  float64 `json:"index"`
+}
+
+// An Upload is the response to GET /api/v2/upload/:id/metadata.
+type Upload struct {
+	ID        string    `json:"id"`
+	Size      int64     `json:"size"`
+	Fragments int       `json:"fragments"`
+	Created   time.Time `json:"created"`
+	Modified  time.Time `json:"modified"`
+	Creator   string    `json:"creator"`
+	MD5       string    `json:"md5,omitempty"`    // the checksum given by the uploader
+	SHA256    string    `json:"sha256,omitempty"` // the checksum given by the uploader
+	MimeType  string    `json:"mime-type,omitempty"`
+	Extra     string    `json:"extra,omitempty"`
+}
+
+// NewItem returns the schema form of the given item and its external
+// identifiers.
+func NewItem(item *items.Item, identifiers []string) Item {
+	result := Item{
+		ID:          item.ID,
+		Blobs:       []Blob{},
+		Versions:    []Version{},
+		Identifiers: identifiers,
+	}
+	if result.Identifiers == nil {
+		result.Identifiers = []string{}
+	}
+	for _, b := range item.Blobs {
+		result.Blobs = append(result.Blobs, NewBlob(b))
+	}
+	for _, v := range item.Versions {
+		ver := Version{
+			ID:           int(v.ID),
+			Created:      v.SaveDate,
+			Creator:      v.Creator,
+			Note:         v.Note,
+			Slots:        make(map[string]int, len(v.Slots)),
+			SlotMetadata: v.SlotMeta,
+		}
+		for name, bid := range v.Slots {
+			ver.Slots[name] = int(bid)
+		}
+		result.Versions = append(result.Versions, ver)
+	}
+	return result
+}
+
+// NewBlob returns the schema form of the given blob.
+func NewBlob(b *items.Blob) Blob {
+	result := Blob{
+		ID:       int(b.ID),
+		Created:  b.SaveDate,
+		Creator:  b.Creator,
+		Size:     b.Size,
+		MD5:      hex.EncodeToString(b.MD5),
+		SHA256:   hex.EncodeToString(b.SHA256),
+		MimeType: b.MimeType,
+	}
+	for name, h := range b.Digests {
+		if result.Digests == nil {
+			result.Digests = make(map[string]string)
+		}
+		result.Digests[name] = hex.EncodeToString(h)
+	}
+	if !b.DeleteDate.IsZero() {
+		deleted := b.DeleteDate
+		result.Deleted = &deleted
+		result.Deleter = b.Deleter
+		result.DeleteNote = b.DeleteNote
+	}
+	return result
+}
+
+// NewEntry returns the listing entry for a file having the given name,
+// blob, and slot metadata. The modification time is the "mtime" slot
+// metadata if there is one, and otherwise when the blob was saved.
+func NewEntry(name string, b *items.Blob, meta map[string]string) Entry {
+	result := Entry{
+		Name:     name,
+		Blob:     int(b.ID),
+		Size:     b.Size,
+		MD5:      hex.EncodeToString(b.MD5),
+		SHA256:   hex.EncodeToString(b.SHA256),
+		MimeType: b.MimeType,
+		Modified: b.SaveDate,
+	}
+	if t, err := time.Parse(time.RFC3339Nano, meta["mtime"]); err == nil {
+		result.Modified = t
+	}
+	return result
+}
+
+// NewTransaction returns the schema form of the given transaction. The
+// caller should hold a read lock on tx.
+func NewTransaction(tx *transaction.Transaction) Transaction {
+	result := Transaction{
+		ID:       tx.ID,
+		Item:     tx.ItemID,
+		Status:   statusName(tx.Status),
+		Version:  tx.Version,
+		Creator:  tx.Creator,
+		Started:  tx.Started,
+		Modified: tx.Modified,
+		Errors:   append([]string{}, tx.Err...),
+		Bytes:    tx.Bytes,
+		Commands: [][]string{},
+		Timing: Timing{
+			Verify: tx.Timing.Verify.Seconds(),
+			Ingest: tx.Timing.Ingest.Seconds(),
+			Index:  tx.Timing.Index.Seconds(),
+		},
+	}
+	for _, cmd := range tx.Commands {
+		result.Commands = append(result.Commands, append([]string{}, cmd...))
+	}
+	return result
+}
+
+// statusName returns the schema name of a transaction status.
+func statusName(s transaction.Status) string {
+	switch s {
+	case transaction.StatusOpen:
+		return StatusOpen
+	case transaction.StatusWaiting:
+		return StatusWaiting
+	case transaction.StatusChecking:
+		return StatusChecking
+	case transaction.StatusIngest:
+		return StatusIngest
+	case transaction.StatusFinished:
+		return StatusFinished
+	case transaction.StatusError:
+		return StatusError
+	}
+	return StatusUnknown
+}
+
+// NewUpload returns the schema form of the given upload metadata.
+func NewUpload(stat fragment.Stat) Upload {
+	return Upload{
+		ID:        stat.ID,
+		Size:      stat.Size,
+		Fragments: stat.NFragments,
+		Created:   stat.Created,
+		Modified:  stat.Modified,
+		Creator:   stat.Creator,
+		MD5:       hex.EncodeToString(stat.MD5),
+		SHA256:    hex.EncodeToString(stat.SHA256),
+		MimeType:  stat.MimeType,
+		Extra:     stat.Extra,
+	}
+}
@@ -0,0 +1,78 @@
+package apiv2
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ndlib/bendo/items"
+	"github.com/ndlib/bendo/transaction"
+)
+
+func TestStatusName(t *testing.T) {
+	var table = []struct {
+		status transaction.Status
+		name   string
+	}{
+		{transaction.StatusOpen, StatusOpen},
+		{transaction.StatusWaiting, StatusWaiting},
+		{transaction.StatusChecking, StatusChecking},
+		{transaction.StatusIngest, StatusIngest},
+		{transaction.StatusFinished, StatusFinished},
+		{transaction.StatusError, StatusError},
+		{transaction.Status(100), StatusUnknown},
+	}
+	for _, tab := range table {
+		if got := statusName(tab.status); got != tab.name {
+			t.Errorf("%v: received %q, expected %q", tab.status, got, tab.name)
+		}
+	}
+}
+
+func TestNewItem(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	item := &items.Item{
+		ID: "abc",
+		Blobs: []*items.Blob{
+			{ID: 1, SaveDate: now, Size: 5, Bundle: 1, MD5: []byte{0xab, 0xcd}},
+			{ID: 2, SaveDate: now, DeleteDate: now, Deleter: "admin"},
+		},
+		Versions: []*items.Version{
+			{ID: 1, SaveDate: now, Slots: map[string]items.BlobID{"a": 1}},
+		},
+	}
+	b, err := json.Marshal(NewItem(item, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const expected = `{"id":"abc","blobs":[` +
+		`{"id":1,"created":"2020-01-02T03:04:05Z","creator":"","size":5,"md5":"abcd"},` +
+		`{"id":2,"created":"2020-01-02T03:04:05Z","creator":"","size":0,"deleted":"2020-01-02T03:04:05Z","deleter":"admin"}],` +
+		`"versions":[{"id":1,"created":"2020-01-02T03:04:05Z","creator":"","note":"","slots":{"a":1}}],` +
+		`"identifiers":[]}`
+	if string(b) != expected {
+		t.Errorf("Received %s\nexpected %s", b, expected)
+	}
+	if strings.Contains(string(b), "Bundle") {
+		t.Errorf("Internal fields are exposed")
+	}
+}
+
+func TestNewEntry(t *testing.T) {
+	saved := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	b := &items.Blob{ID: 3, SaveDate: saved, Size: 5, SHA256: []byte{0x01}}
+	e := NewEntry("a.txt", b, nil)
+	if e.Blob != 3 || e.Size != 5 || e.SHA256 != "01" || !e.Modified.Equal(saved) {
+		t.Errorf("Received %+v", e)
+	}
+	mtime := time.Date(2016, 11, 17, 10, 0, 0, 500, time.UTC)
+	e = NewEntry("a.txt", b, map[string]string{"mtime": mtime.Format(time.RFC3339Nano)})
+	if !e.Modified.Equal(mtime) {
+		t.Errorf("Received modified %v, expected %v", e.Modified, mtime)
+	}
+	e = NewEntry("a.txt", b, map[string]string{"mtime": "yesterday"})
+	if !e.Modified.Equal(saved) {
+		t.Errorf("Received modified %v, expected %v", e.Modified, saved)
+	}
+}
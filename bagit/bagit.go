@@ -1,7 +1,8 @@
 // Package bagit implements the enough of the BagIt specification to save and
 // read the BagIt files used by Bendo. It creates zip files which do
-// not use compression. It only supports MD5 and SHA256 checksums for
-// the manifest file.
+// not use compression, or tar files, and reads either. It always computes MD5 and SHA256 checksums for
+// the manifest files, and can compute more, such as SHA512, with
+// Writer.SetDigests.
 //
 // Specific items not implemented from the BagIt specification are fetch files
 // and holely bags. It also doesn't preserve the order of the tags
@@ -41,6 +42,10 @@ type Checksum struct {
 	SHA1   []byte
 	SHA256 []byte
 	SHA512 []byte
+
+	// Digests holds checksums for any other algorithms registered with
+	// util.RegisterDigest, keyed by name.
+	Digests map[string][]byte
 }
 
 const (
@@ -1,7 +1,6 @@
 package bagit
 
 import (
-	"archive/zip"
 	"bufio"
 	"encoding/hex"
 	"errors"
@@ -11,7 +10,7 @@ import (
 	"github.com/ndlib/bendo/util"
 )
 
-// Reader allows for reading an existing Bag file (in ZIP format).
+// Reader allows for reading an existing Bag file (in ZIP or tar format).
 //
 // A Reader does not validate checksums or load tags until asked to do so.
 // Use Verify() to hash and verify all the manifests.
@@ -19,34 +18,95 @@ import (
 // tag files are ignored. Since tags are stored in a map, the order of the tags
 // is not preserved.
 type Reader struct {
-	z *zip.Reader
-	t Bag
+	files []entry
+	t     Bag
 }
 
-// NewReader creates a bag reader which wraps r. It expects a ZIP datastream,
-// and uses size to locate the zip manifest block, which is at the end.
+// NewReader creates a bag reader which wraps r. It accepts either a ZIP or a
+// tar datastream, telling them apart by the tar header at the start. For a
+// ZIP it uses size to locate the zip manifest block, which is at the end.
 //
 // Closing a reader does not close the wrapped ReaderAt.
 func NewReader(r io.ReaderAt, size int64) (*Reader, error) {
-	in, err := zip.NewReader(r, size)
+	var files []entry
+	var err error
+	if isTar(r, size) {
+		files, err = tarEntries(r, size)
+	} else {
+		files, err = zipEntries(r, size)
+	}
 	if err != nil {
 		return nil, err
 	}
+	return newReader(files), nil
+}
+
+// A Directory lists where each file is in the serialization of a bag. It
+// lets a bag be opened again without reading the zip directory or the tar
+// headers, which can be slow when the bag is on tape or in the cloud.
+type Directory []DirEntry
+
+// A DirEntry gives the name of a file in a bag, including the bag
+// directory, and where its contents are in the bag's serialization.
+type DirEntry struct {
+	Name   string
+	Offset int64
+	Size   int64
+}
+
+// Directory returns the list of the files in the bag and where they are,
+// which can be given to NewDirectoryReader to open the bag again. It
+// returns nil if some file in the bag is stored compressed, since then
+// the directory alone is not enough to read it.
+func (r *Reader) Directory() Directory {
+	result := make(Directory, 0, len(r.files))
+	for _, f := range r.files {
+		if f.offset < 0 {
+			return nil
+		}
+		result = append(result, DirEntry{Name: f.name, Offset: f.offset, Size: f.size})
+	}
+	return result
+}
+
+// NewDirectoryReader creates a bag reader which wraps r, using a directory
+// previously returned by Directory for the same bag instead of reading the
+// bag's own. Nothing is read from r until a file is opened.
+//
+// Closing a reader does not close the wrapped ReaderAt.
+func NewDirectoryReader(r io.ReaderAt, dir Directory) *Reader {
+	files := make([]entry, len(dir))
+	for i, d := range dir {
+		section := io.NewSectionReader(r, d.Offset, d.Size)
+		files[i] = entry{
+			name: d.Name,
+			open: func() (io.ReadCloser, error) {
+				return io.NopCloser(io.NewSectionReader(section, 0, section.Size())), nil
+			},
+			offset: d.Offset,
+			size:   d.Size,
+		}
+	}
+	return newReader(files)
+}
+
+// newReader creates a bag reader for the given files.
+func newReader(files []entry) *Reader {
 	result := &Reader{
-		z: in,
-		t: New(),
+		files: files,
+		t:     New(),
 	}
 	// are there any files inside the zip?
-	if len(in.File) > 0 {
+	if len(files) > 0 {
 		// according to bagit spec, EVERYTHING in the zip
 		// should be inside the same directory, so take the first
 		// file inside and figure out its top-most directory name.
-		paths := strings.SplitN(in.File[0].Name, "/", 2)
+		paths := strings.SplitN(files[0].name, "/", 2)
 		if len(paths) == 2 {
 			result.t.dirname = paths[0] + "/"
 		}
 	}
-	return result, nil
+	return result
 }
 
 func (c *Checksum) setmd5(b []byte)    { c.MD5 = b }
@@ -54,6 +114,16 @@ func (c *Checksum) setsha1(b []byte)   { c.SHA1 = b }
 func (c *Checksum) setsha256(b []byte) { c.SHA256 = b }
 func (c *Checksum) setsha512(b []byte) { c.SHA512 = b }
 
+// setdigest returns a function setting the named digest.
+func setdigest(name string) chksumSetter {
+	return func(c *Checksum, b []byte) {
+		if c.Digests == nil {
+			c.Digests = make(map[string][]byte)
+		}
+		c.Digests[name] = b
+	}
+}
+
 // Open returns a reader for the file having the given name.
 // Note, that inside the bag, the file is searched for from the path
 // "<bag name>/data/<name>".
@@ -67,14 +137,37 @@ var (
 	ErrNotFound = errors.New("stream not found")
 )
 
+// ErrCompressed means a file was asked for by Extent which is not stored
+// uncompressed, and so must be read with Open.
+var ErrCompressed = errors.New("stream is compressed")
+
+// Extent returns where the contents of the file having the given name are
+// in the bag's serialization, as an offset and a length, so they can be read
+// directly from the underlying ReaderAt. As with Open, the file is looked for
+// inside the data directory. It returns ErrCompressed if the file is not
+// stored uncompressed.
+func (r *Reader) Extent(name string) (int64, int64, error) {
+	xname := r.t.dirname + "data/" + name
+	for _, f := range r.files {
+		if f.name != xname {
+			continue
+		}
+		if f.offset < 0 {
+			return 0, 0, ErrCompressed
+		}
+		return f.offset, f.size, nil
+	}
+	return 0, 0, ErrNotFound
+}
+
 // open will open any file, not necessarily one inside the data directory.
 func (r *Reader) open(name string) (io.ReadCloser, error) {
 	xname := r.t.dirname + name
-	for _, f := range r.z.File {
-		if f.Name != xname {
+	for _, f := range r.files {
+		if f.name != xname {
 			continue
 		}
-		return f.Open()
+		return f.open()
 	}
 	return nil, ErrNotFound
 }
@@ -156,8 +249,8 @@ func (r *Reader) Checksum(name string) *Checksum {
 func (r *Reader) Files() []string {
 	var result []string
 	var prefix = r.t.dirname + "data/"
-	for _, f := range r.z.File {
-		name := f.Name
+	for _, f := range r.files {
+		name := f.name
 		xname := strings.TrimPrefix(name, prefix)
 		if len(name) != len(xname) {
 			result = append(result, xname)
@@ -208,12 +301,12 @@ func (r *Reader) Verify() error {
 	// We need to do some pathname manipulation since the zip directory
 	// names have the form "bagname/data/blah/blah" but the manifest
 	// has names of the form "data/blah/blah".
-	for _, f := range r.z.File {
-		if !strings.HasPrefix(f.Name, dataprefix) {
+	for _, f := range r.files {
+		if !strings.HasPrefix(f.name, dataprefix) {
 			continue
 		}
 		npayload++
-		xname := strings.TrimPrefix(f.Name, r.t.dirname)
+		xname := strings.TrimPrefix(f.name, r.t.dirname)
 		if r.t.manifest[xname] == nil {
 			return BagError{Err: ErrExtraFile, File: xname}
 		}
@@ -238,8 +331,8 @@ func (r *Reader) Verify() error {
 	// Do all the checksums match?
 	// Since t.manifest includes both payload and data files, we will
 	// verify more than nmanifest files here.
-	for _, f := range r.z.File {
-		xname := strings.TrimPrefix(f.Name, r.t.dirname)
+	for _, f := range r.files {
+		xname := strings.TrimPrefix(f.name, r.t.dirname)
 		checksum := r.t.manifest[xname]
 		if checksum == nil {
 			// this file is not in the manifest. We don't care
@@ -247,7 +340,7 @@ func (r *Reader) Verify() error {
 			// files are accounted for.
 			continue
 		}
-		in, err := f.Open()
+		in, err := f.open()
 		if err != nil {
 			return err
 		}
@@ -277,6 +370,15 @@ func (r *Reader) loadManifests() error {
 		{"manifest-sha512.txt", (*Checksum).setsha512},
 		{"tagmanifest-md5.txt", (*Checksum).setmd5},
 	}
+	for _, name := range util.DigestNames() {
+		if isFixedDigest(name) {
+			continue
+		}
+		filelist = append(filelist, struct {
+			filename string
+			setfunc  chksumSetter
+		}{"manifest-" + name + ".txt", setdigest(name)})
+	}
 	for _, entry := range filelist {
 		err := r.loadManifestFile(entry.filename, entry.setfunc)
 		if err != nil && err != ErrNotFound {
@@ -2,6 +2,7 @@ package bagit
 
 import (
 	"archive/zip"
+	"bytes"
 	"encoding/hex"
 	"io"
 	"testing"
@@ -262,3 +263,88 @@ func TestChecksum(t *testing.T) {
 
 	f2.Close()
 }
+
+func TestExtent(t *testing.T) {
+	for _, format := range []string{"zip", "tar"} {
+		var buf bytes.Buffer
+		var w *Writer
+		if format == "zip" {
+			w = NewWriter(&buf, "extent")
+		} else {
+			w = NewTarWriter(&buf, "extent")
+		}
+		out, _ := w.CreateSize("hello", 11)
+		out.Write([]byte("hello there"))
+		out, _ = w.CreateSize("other", 5)
+		out.Write([]byte("other"))
+		w.Close()
+
+		data := buf.Bytes()
+		r, err := NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"hello", "other"} {
+			offset, size, err := r.Extent(name)
+			if err != nil {
+				t.Fatalf("%s %s: %s", format, name, err)
+			}
+			in, _ := r.Open(name)
+			expected, _ := io.ReadAll(in)
+			in.Close()
+			if got := data[offset : offset+size]; !bytes.Equal(got, expected) {
+				t.Errorf("%s %s: extent has %q, expected %q", format, name, got, expected)
+			}
+		}
+		_, _, err = r.Extent("missing")
+		if err != ErrNotFound {
+			t.Errorf("%s: Extent of missing file gave %v", format, err)
+		}
+	}
+}
+
+func TestDirectoryReader(t *testing.T) {
+	for _, format := range []string{"zip", "tar"} {
+		var buf bytes.Buffer
+		var w *Writer
+		if format == "zip" {
+			w = NewWriter(&buf, "dir")
+		} else {
+			w = NewTarWriter(&buf, "dir")
+		}
+		out, _ := w.CreateSize("hello", 11)
+		out.Write([]byte("hello there"))
+		w.SetTag("Source", "somewhere")
+		w.Close()
+
+		data := buf.Bytes()
+		r, err := NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := r.Directory()
+		if dir == nil {
+			t.Fatalf("%s: Directory() == nil", format)
+		}
+
+		r = NewDirectoryReader(bytes.NewReader(data), dir)
+		if files := r.Files(); len(files) != 1 || files[0] != "hello" {
+			t.Errorf("%s: Files() == %v, expected [hello]", format, files)
+		}
+		in, err := r.Open("hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(in)
+		in.Close()
+		if string(got) != "hello there" {
+			t.Errorf("%s: read %q, expected %q", format, got, "hello there")
+		}
+		if tag := r.Tags()["Source"]; tag != "somewhere" {
+			t.Errorf("%s: Source tag is %q", format, tag)
+		}
+		if err := r.Verify(); err != nil {
+			t.Errorf("%s: Verify() == %s", format, err)
+		}
+	}
+}
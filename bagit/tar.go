@@ -0,0 +1,271 @@
+package bagit
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"time"
+)
+
+// An archive is the serialization a bag is written in, either zip or tar.
+type archive interface {
+	// create starts a new file in the archive. The size is the length of
+	// the file, or -1 if it is not known.
+	create(name string, modtime time.Time, size int64) (io.Writer, error)
+	Close() error
+}
+
+// zipArchive writes a bag as a zip file. The files are not compressed.
+type zipArchive struct {
+	z   *zip.Writer
+	pos *position // the file the zip is written to
+}
+
+func (a zipArchive) create(name string, modtime time.Time, size int64) (io.Writer, error) {
+	header := zip.FileHeader{
+		Name:   name,
+		Method: zip.Store,
+	}
+	header.SetModTime(modtime)
+	w, err := a.z.CreateHeader(&header)
+	if err == nil {
+		// push the header out so the position is where the contents begin
+		err = a.z.Flush()
+		a.pos.mark(name)
+	}
+	return w, err
+}
+
+func (a zipArchive) Close() error {
+	return a.z.Close()
+}
+
+// tarArchive writes a bag as a tar file. Since a tar header gives the length
+// of the file following it, a file of unknown size is spooled until the next
+// file is started, first in memory and then in a temporary file if it grows
+// larger than maxSpoolMemory. A file of known size is written directly.
+type tarArchive struct {
+	t      *tar.Writer
+	pos    *position // the file the tar is written to
+	spool  *spool    // the current file if its size is not known, or nil
+	remain int64     // bytes not yet written to the current file of known size
+}
+
+// maxSpoolMemory is the largest file of unknown size a tar bag keeps in
+// memory.
+const maxSpoolMemory = 1 << 20
+
+func newTarArchive(pos *position) *tarArchive {
+	return &tarArchive{t: tar.NewWriter(pos), pos: pos}
+}
+
+func (a *tarArchive) create(name string, modtime time.Time, size int64) (io.Writer, error) {
+	err := a.finish()
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 {
+		a.spool = &spool{name: name, modtime: modtime}
+		return a.spool, nil
+	}
+	err = a.t.WriteHeader(tarHeader(name, modtime, size))
+	if err != nil {
+		return nil, err
+	}
+	a.pos.mark(name)
+	a.remain = size
+	return tarFile{a}, nil
+}
+
+// finish completes the current file. A spooled file is written out, and a
+// file shorter than the size it was created with is padded with zeros,
+// since its header cannot be changed.
+func (a *tarArchive) finish() error {
+	if a.spool != nil {
+		s := a.spool
+		a.spool = nil
+		defer s.Close()
+		err := a.t.WriteHeader(tarHeader(s.name, s.modtime, s.size))
+		if err != nil {
+			return err
+		}
+		a.pos.mark(s.name)
+		return s.copyTo(a.t)
+	}
+	if a.remain > 0 {
+		_, err := io.CopyN(a.t, zeros{}, a.remain)
+		a.remain = 0
+		return err
+	}
+	return nil
+}
+
+func (a *tarArchive) Close() error {
+	err := a.finish()
+	if err != nil {
+		return err
+	}
+	return a.t.Close()
+}
+
+func tarHeader(name string, modtime time.Time, size int64) *tar.Header {
+	return &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  modtime,
+	}
+}
+
+// tarFile writes the contents of a file of known size to a tar bag.
+type tarFile struct {
+	a *tarArchive
+}
+
+func (f tarFile) Write(p []byte) (int, error) {
+	n, err := f.a.t.Write(p)
+	f.a.remain -= int64(n)
+	return n, err
+}
+
+// zeros is a reader returning an endless run of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// A spool holds a file of unknown size until it is written to a tar bag.
+type spool struct {
+	name    string
+	modtime time.Time
+	size    int64
+	buf     bytes.Buffer
+	f       *os.File // nil until the spool is larger than maxSpoolMemory
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	if s.f == nil && s.buf.Len()+len(p) > maxSpoolMemory {
+		f, err := os.CreateTemp("", "bagit-spool-")
+		if err != nil {
+			return 0, err
+		}
+		s.f = f
+		_, err = s.buf.WriteTo(f)
+		if err != nil {
+			return 0, err
+		}
+	}
+	var n int
+	var err error
+	if s.f != nil {
+		n, err = s.f.Write(p)
+	} else {
+		n, err = s.buf.Write(p)
+	}
+	s.size += int64(n)
+	return n, err
+}
+
+// copyTo writes the contents of the spool to w.
+func (s *spool) copyTo(w io.Writer) error {
+	if s.f == nil {
+		_, err := s.buf.WriteTo(w)
+		return err
+	}
+	_, err := s.f.Seek(0, io.SeekStart)
+	if err == nil {
+		_, err = io.Copy(w, s.f)
+	}
+	return err
+}
+
+// Close removes the temporary file, if any.
+func (s *spool) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	s.f.Close()
+	return os.Remove(s.f.Name())
+}
+
+// An entry is a file inside the serialization of a bag.
+type entry struct {
+	name string
+	open func() (io.ReadCloser, error)
+	// the position and length of the file's contents in the serialization,
+	// if they are stored uncompressed. offset is -1 otherwise.
+	offset int64
+	size   int64
+}
+
+// isTar returns true if r appears to hold a tar file rather than a zip
+// file. Every tar format bags are written in has "ustar" in its first
+// header.
+func isTar(r io.ReaderAt, size int64) bool {
+	if size < 512 {
+		return false
+	}
+	var magic [5]byte
+	_, err := r.ReadAt(magic[:], 257)
+	return err == nil && string(magic[:]) == "ustar"
+}
+
+// zipEntries returns the files in the zip file r.
+func zipEntries(r io.ReaderAt, size int64) ([]entry, error) {
+	in, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	var result []entry
+	for _, f := range in.File {
+		e := entry{name: f.Name, open: f.Open, offset: -1}
+		if f.Method == zip.Store {
+			if offset, err := f.DataOffset(); err == nil {
+				e.offset = offset
+				e.size = int64(f.CompressedSize64)
+			}
+		}
+		result = append(result, e)
+	}
+	return result, nil
+}
+
+// tarEntries returns the files in the tar file r. The headers are read
+// when the bag is opened to index where each file begins, skipping over
+// the file contents, so a file may then be read without reading the ones
+// before it.
+func tarEntries(r io.ReaderAt, size int64) ([]entry, error) {
+	sr := io.NewSectionReader(r, 0, size)
+	tr := tar.NewReader(sr)
+	var result []entry
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		// the reader is now at the start of this file's contents
+		offset, _ := sr.Seek(0, io.SeekCurrent)
+		section := io.NewSectionReader(r, offset, hdr.Size)
+		result = append(result, entry{
+			name: hdr.Name,
+			open: func() (io.ReadCloser, error) {
+				return io.NopCloser(io.NewSectionReader(section, 0, section.Size())), nil
+			},
+			offset: offset,
+			size:   hdr.Size,
+		})
+	}
+	return result, nil
+}
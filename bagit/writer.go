@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
 	"time"
 
@@ -14,23 +15,44 @@ import (
 // Writer allows for writing a new bag file. When it is closed, all the
 // relevant tag files and manifests will be written out.
 type Writer struct {
-	z        *zip.Writer      // the underlying zip writer
-	t        Bag              // our bag structure to track the files
-	checksum *Checksum        // pointer to current checksum
-	hw       *util.HashWriter // current hash writer
-	ns       int              // number of "streams" (i.e. payload files)
-	sz       int64            // size of the payload files, in bytes
+	a        archive           // the underlying zip or tar writer
+	t        Bag               // our bag structure to track the files
+	checksum *Checksum         // pointer to current checksum
+	hw       *util.HashWriter  // current hash writer
+	ns       int               // number of "streams" (i.e. payload files)
+	sz       int64             // size of the payload files, in bytes
+	modtime  time.Time         // time to give every file. zero means use now.
+	digests  []string          // extra checksums to compute, see SetDigests
+	pos      *position         // where each file's contents begin
+	sizes    map[string]*int64 // the length of each payload file
 }
 
-// NewWriter creates a new bag writer which will serialize itself to the
-// provided io.Writer. Use name to set the directory name the bag will
-// unserialize into, as required by the spec.
+// NewWriter creates a new bag writer which will serialize itself as a zip
+// file to the provided io.Writer. Use name to set the directory name the bag
+// will unserialize into, as required by the spec.
 func NewWriter(w io.Writer, name string) *Writer {
+	pos := newPosition(w)
+	return newWriter(zipArchive{z: zip.NewWriter(pos), pos: pos}, pos, name)
+}
+
+// NewTarWriter is like NewWriter, but serializes the bag as a tar file.
+// Tar files can be read from tape by more tools than zip files, since
+// they do not need to be read from the end. Files should be created with
+// CreateSize when their size is known, since otherwise they are held in a
+// temporary file until the next file is started.
+func NewTarWriter(w io.Writer, name string) *Writer {
+	pos := newPosition(w)
+	return newWriter(newTarArchive(pos), pos, name)
+}
+
+func newWriter(a archive, pos *position, name string) *Writer {
 	t := New()
 	t.dirname = name + "/"
 	return &Writer{
-		z: zip.NewWriter(w),
-		t: t,
+		a:     a,
+		t:     t,
+		pos:   pos,
+		sizes: make(map[string]*int64),
 	}
 }
 
@@ -38,7 +60,7 @@ func NewWriter(w io.Writer, name string) *Writer {
 // not close the original io.Writer provided to NewWriter().
 func (w *Writer) Close() error {
 	w.t.tags["Payload-Oxum"] = fmt.Sprintf("%d.%d", w.sz, w.ns)
-	w.t.tags["Bagging-Date"] = time.Now().Format("2006-01-02")
+	w.t.tags["Bagging-Date"] = w.now().Format("2006-01-02")
 	w.t.tags["Bag-Size"] = humansize(w.sz)
 
 	// If Close() is called after a write error, then this first
@@ -48,7 +70,7 @@ func (w *Writer) Close() error {
 		return err
 	}
 	w.writeManifests()
-	return w.z.Close()
+	return w.a.Close()
 }
 
 // SetTag adds the given tag to this bag, and sets it to be equal to content.
@@ -58,19 +80,73 @@ func (w *Writer) SetTag(tag, content string) {
 	w.t.tags[tag] = content
 }
 
+// SetModTime sets the modification time recorded for every file in the bag,
+// as well as the Bagging-Date tag. If it is never set the current time is
+// used. Together with the tags, this is all the variable information in a
+// bag, so two bags with the same mod time, tags, and files written in the
+// same order will be byte-for-byte identical.
+func (w *Writer) SetModTime(t time.Time) {
+	w.modtime = t.UTC()
+}
+
+// SetDigests makes the writer compute the named checksums, in addition to
+// MD5 and SHA256, for every file created afterwards, and write a manifest for
+// each. The names must have been registered with util.RegisterDigest; other
+// names are ignored.
+func (w *Writer) SetDigests(names []string) {
+	w.digests = names
+}
+
+// now returns the time to use for the files in this bag.
+func (w *Writer) now() time.Time {
+	if w.modtime.IsZero() {
+		return time.Now()
+	}
+	return w.modtime
+}
+
 // Create a new file inside this bag. The file will be put inside the "data/"
 // directory.
 func (w *Writer) Create(name string) (io.Writer, error) {
+	return w.CreateSize(name, -1)
+}
+
+// CreateSize is like Create, but is given the size of the file, or -1 if
+// it is not known. A tar bag uses the size to write the file directly,
+// and a file shorter than its size is padded with zeros. Writing more than
+// the size is an error. Zip bags ignore the size.
+func (w *Writer) CreateSize(name string, size int64) (io.Writer, error) {
 	w.ns++
-	out, err := w.create("data/" + name)
+	out, err := w.create("data/"+name, size)
+	n := new(int64)
+	w.sizes["data/"+name] = n
 	return &countWriter{
 		w:     out,
 		count: &w.sz,
+		file:  n,
 	}, err
 }
 
+// Extent returns where the contents of the payload file having the given
+// name are in the bag's serialization, as an offset and a length, the same
+// as Reader.Extent gives once the bag is written. The offset is -1 if it is
+// not known yet, which happens for a file of unknown size in a tar bag until
+// the next file is started or the bag is closed. It returns ErrNotFound if no
+// such file has been created.
+func (w *Writer) Extent(name string) (int64, int64, error) {
+	n, ok := w.sizes["data/"+name]
+	if !ok {
+		return 0, 0, ErrNotFound
+	}
+	offset, ok := w.pos.offsets[w.t.dirname+"data/"+name]
+	if !ok {
+		offset = -1
+	}
+	return offset, *n, nil
+}
+
 // create is for internal use. It allows non-payload files to be written.
-func (w *Writer) create(name string) (io.Writer, error) {
+func (w *Writer) create(name string, size int64) (io.Writer, error) {
 	// save checksums in case there is an active writer
 	_ = w.Checksum()
 
@@ -78,14 +154,12 @@ func (w *Writer) create(name string) (io.Writer, error) {
 	w.t.manifest[name] = ck
 	w.checksum = ck
 
-	header := zip.FileHeader{
-		Name:   w.t.dirname + name,
-		Method: zip.Store,
-	}
-	header.SetModTime(time.Now())
-	out, err := w.z.CreateHeader(&header)
+	out, err := w.a.create(w.t.dirname+name, w.now(), size)
 
 	w.hw = util.NewHashWriter(out)
+	for _, name := range w.digests {
+		w.hw.AddDigest(name)
+	}
 
 	return w.hw, err
 }
@@ -96,13 +170,38 @@ func (w *Writer) Checksum() *Checksum {
 	if w.hw != nil && w.checksum != nil {
 		w.checksum.MD5, _ = w.hw.CheckMD5(nil)
 		w.checksum.SHA256, _ = w.hw.CheckSHA256(nil)
+		for name, h := range w.hw.Digests() {
+			switch name {
+			case "sha1":
+				w.checksum.SHA1 = h
+			case "sha512":
+				w.checksum.SHA512 = h
+			default:
+				if w.checksum.Digests == nil {
+					w.checksum.Digests = make(map[string][]byte)
+				}
+				w.checksum.Digests[name] = h
+			}
+		}
 	}
 	return w.checksum
 }
 
+// Manifest returns the checksums of every file written to the bag so far,
+// keyed by their path inside the bag, e.g. "data/blob/1" or "bag-info.txt".
+// After Close it includes the tag and manifest files.
+func (w *Writer) Manifest() map[string]Checksum {
+	_ = w.Checksum()
+	result := make(map[string]Checksum, len(w.t.manifest))
+	for name, ck := range w.t.manifest {
+		result[name] = *ck
+	}
+	return result
+}
+
 func (w *Writer) writeTags() error {
 	// first write bag-it marker file
-	out, err := w.create("bagit.txt")
+	out, err := w.create("bagit.txt", -1)
 	if err != nil {
 		return err
 	}
@@ -110,12 +209,18 @@ func (w *Writer) writeTags() error {
 	fmt.Fprintf(out, "Tag-File-Character-Encoding: UTF-8\n")
 
 	// now write tags file
-	out, err = w.create("bag-info.txt")
+	out, err = w.create("bag-info.txt", -1)
 	if err != nil {
 		return err
 	}
-	for k, v := range w.t.tags {
-		fmt.Fprintf(out, "%s: %s\n", k, v)
+	// sort the tags so the file is the same each time
+	var tags []string
+	for k := range w.t.tags {
+		tags = append(tags, k)
+	}
+	sort.Strings(tags)
+	for _, k := range tags {
+		fmt.Fprintf(out, "%s: %s\n", k, w.t.tags[k])
 	}
 	return nil
 }
@@ -128,6 +233,13 @@ func (w *Writer) writeManifests() {
 	w.manifest(false, "sha1", Checksum.sha1)
 	w.manifest(false, "sha256", Checksum.sha256)
 	w.manifest(false, "sha512", Checksum.sha512)
+	for _, name := range w.digests {
+		if isFixedDigest(name) {
+			continue
+		}
+		name := name
+		w.manifest(false, name, func(c Checksum) []byte { return c.Digests[name] })
+	}
 
 	// do the tagmanifest
 	w.manifest(true, "md5", Checksum.md5)
@@ -139,9 +251,25 @@ func (c Checksum) sha1() []byte   { return c.SHA1 }
 func (c Checksum) sha256() []byte { return c.SHA256 }
 func (c Checksum) sha512() []byte { return c.SHA512 }
 
+// isFixedDigest returns true if the named checksum has its own field in
+// Checksum, rather than being kept in Digests.
+func isFixedDigest(name string) bool {
+	switch name {
+	case "md5", "sha1", "sha256", "sha512":
+		return true
+	}
+	return false
+}
+
 func (w *Writer) manifest(istag bool, name string, hash func(Checksum) []byte) {
 	var out io.Writer
-	for fname, checksum := range w.t.manifest {
+	var fnames []string
+	for fname := range w.t.manifest {
+		fnames = append(fnames, fname)
+	}
+	sort.Strings(fnames)
+	for _, fname := range fnames {
+		checksum := w.t.manifest[fname]
 		// tag manifests only include files NOT having the prefix "data/"
 		if istag && strings.HasPrefix(fname, "data/") {
 			continue
@@ -162,7 +290,7 @@ func (w *Writer) manifest(istag bool, name string, hash func(Checksum) []byte) {
 			} else {
 				mname = "manifest-" + name + ".txt"
 			}
-			out, _ = w.create(mname)
+			out, _ = w.create(mname, -1)
 		}
 		// The 2 spaces is to be identical to the GNU md5sum output.
 		// Although md5sum outputs " *" to mark binary mode, that
@@ -171,18 +299,45 @@ func (w *Writer) manifest(istag bool, name string, hash func(Checksum) []byte) {
 	}
 }
 
-// countWriter is an io.Writer that counts the number of bytes written to it.
+// countWriter is an io.Writer that counts the number of bytes written to it,
+// both in total and for the one file.
 type countWriter struct {
 	w     io.Writer
 	count *int64
+	file  *int64
 }
 
 func (w *countWriter) Write(p []byte) (int, error) {
 	n, err := w.w.Write(p)
 	*w.count += int64(n)
+	*w.file += int64(n)
+	return n, err
+}
+
+// A position counts the bytes written through it to the serialization of a
+// bag, and remembers where the contents of each file begin.
+type position struct {
+	w       io.Writer
+	n       int64
+	offsets map[string]int64
+}
+
+func newPosition(w io.Writer) *position {
+	return &position{w: w, offsets: make(map[string]int64)}
+}
+
+func (p *position) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.n += int64(n)
 	return n, err
 }
 
+// mark records that the contents of the named file begin at the current
+// position.
+func (p *position) mark(name string) {
+	p.offsets[name] = p.n
+}
+
 // Metric constants for humansize. Lowercased so as to be unexported.
 const (
 	kb int64 = 1000
@@ -1,10 +1,15 @@
 package bagit
 
 import (
+	"archive/tar"
 	"bytes"
+	"crypto/sha512"
+	"io"
 	"testing"
+	"time"
 
 	"github.com/ndlib/bendo/store"
+	"github.com/ndlib/bendo/util"
 )
 
 func TestHumansize(t *testing.T) {
@@ -100,3 +105,173 @@ func TestRoundtrip(t *testing.T) {
 
 	f2.Close()
 }
+
+func TestDigests(t *testing.T) {
+	// stand in for an algorithm which is not built in
+	util.RegisterDigest("sha384", sha512.New384)
+	var buf bytes.Buffer
+	w := NewWriter(&buf, "digests")
+	w.SetDigests([]string{"sha512", "sha384"})
+	out, _ := w.Create("hello")
+	out.Write([]byte("hello there"))
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum512 := sha512.Sum512([]byte("hello there"))
+	sum384 := sha512.Sum384([]byte("hello there"))
+	checksum := r.Checksum("hello")
+	if checksum == nil || !bytes.Equal(checksum.SHA512, sum512[:]) ||
+		!bytes.Equal(checksum.Digests["sha384"], sum384[:]) {
+		t.Errorf("Received checksum %v", checksum)
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	modtime := time.Date(2016, 11, 17, 10, 0, 0, 0, time.UTC)
+	var bags [2]bytes.Buffer
+	for i := range bags {
+		w := NewWriter(&bags[i], "zzz-test-bag")
+		w.SetModTime(modtime)
+		w.SetTag("Contact-Name", "Nobody")
+		w.SetTag("External-Identifier", "zzz")
+		for _, name := range []string{"a", "b", "c"} {
+			out, err := w.Create(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out.Write([]byte("hello " + name))
+		}
+		err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(bags[0].Bytes(), bags[1].Bytes()) {
+		t.Errorf("Bags differ")
+	}
+}
+
+func TestTarRoundtrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewTarWriter(&buf, "zzz-tar-bag")
+	w.SetTag("Contact-Name", "Nobody")
+	// one file of known size, and one too big to spool in memory
+	big := bytes.Repeat([]byte("0123456789"), maxSpoolMemory/5)
+	out, err := w.CreateSize("hello", 11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Write([]byte("hello there"))
+	out, err = w.Create("big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Write(big)
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// it should be a real tar file
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != "zzz-tar-bag/data/hello" || hdr.Size != 11 {
+		t.Fatalf("Received header %v, %v", hdr, err)
+	}
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Tags()["Contact-Name"] != "Nobody" {
+		t.Errorf("Read tags %v", r.Tags())
+	}
+	for name, expected := range map[string][]byte{"hello": []byte("hello there"), "big": big} {
+		in, err := r.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(in)
+		in.Close()
+		if !bytes.Equal(data, expected) {
+			t.Errorf("%s: read %d bytes, expected %d", name, len(data), len(expected))
+		}
+	}
+	err = r.Verify()
+	if err != nil {
+		t.Errorf("Verify returned %s", err)
+	}
+	filelist := r.Files()
+	if len(filelist) != 2 {
+		t.Errorf("File list is %v", filelist)
+	}
+}
+
+func TestTarShortFile(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewTarWriter(&buf, "short")
+	out, _ := w.CreateSize("a", 10)
+	out.Write([]byte("abc"))
+	_, err := out.Write([]byte("defghijklmnop"))
+	if err == nil {
+		t.Errorf("Expected an error writing past the size")
+	}
+	out, _ = w.CreateSize("b", 20)
+	out.Write([]byte("abc"))
+	out, _ = w.CreateSize("c", 5)
+	out.Write([]byte("hello"))
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the files after the short one are still readable
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := r.Open("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(in)
+	if string(data) != "hello" {
+		t.Errorf("Read %q, expected %q", data, "hello")
+	}
+}
+
+func TestWriterExtent(t *testing.T) {
+	for _, tarbag := range []bool{false, true} {
+		var buf bytes.Buffer
+		w := NewWriter(&buf, "extent")
+		if tarbag {
+			w = NewTarWriter(&buf, "extent")
+		}
+		out, _ := w.CreateSize("known", 5)
+		out.Write([]byte("hello"))
+		out, _ = w.Create("unknown")
+		out.Write([]byte("goodbye"))
+		w.Close()
+
+		r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"known", "unknown"} {
+			offset, size, err := w.Extent(name)
+			roffset, rsize, rerr := r.Extent(name)
+			if err != nil || rerr != nil || offset != roffset || size != rsize {
+				t.Errorf("tar %v %s: Writer.Extent() == %d, %d, %v, Reader.Extent() == %d, %d, %v",
+					tarbag, name, offset, size, err, roffset, rsize, rerr)
+			}
+		}
+		if _, _, err := w.Extent("missing"); err != ErrNotFound {
+			t.Errorf("tar %v: Extent() returned %v, expected ErrNotFound", tarbag, err)
+		}
+	}
+}
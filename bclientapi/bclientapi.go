@@ -1,10 +1,12 @@
 package bclientapi
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"sync"
 	"time"
 
@@ -24,11 +26,57 @@ type Connection struct {
 	// An API key to use when interacting with the server.
 	Token string
 
-	// use this to make http requests. It is configured with a timeout.
-	client *http.Client
+	// If not nil, Throttle limits the number of simultaneous requests
+	// and backs off when the server responds with 429 or 503 status codes.
+	Throttle *Throttle
+
+	// MaxIdleConnsPerHost is the number of idle keep-alive connections
+	// to keep open to the server. If 0, defaults to
+	// DefaultMaxIdleConnsPerHost.
+	MaxIdleConnsPerHost int
+
+	// TLSConfig, if not nil, is used when connecting to https servers.
+	TLSConfig *tls.Config
+
+	// CAFile names a PEM file of certificate authorities to trust in
+	// addition to the system ones.
+	CAFile string
+
+	// Proxy returns the proxy to use for a given request. If nil, the
+	// proxy is taken from the HTTP_PROXY, HTTPS_PROXY, and NO_PROXY
+	// environment variables.
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// DialTimeout limits how long to wait for a network connection to the
+	// server. If 0, defaults to DefaultDialTimeout.
+	DialTimeout time.Duration
+
+	// ResponseHeaderTimeout limits how long to wait for the server to
+	// start responding after a request has been sent. If 0, defaults to
+	// DefaultResponseHeaderTimeout.
+	ResponseHeaderTimeout time.Duration
+
+	// IdleTimeout limits how long to wait for more data while reading a
+	// response body. There is no limit on the total time a download may
+	// take. If 0, defaults to DefaultIdleTimeout.
+	IdleTimeout time.Duration
+
+	// MaintenanceWait limits how long a request waits for the server to
+	// leave a maintenance window before failing with a MaintenanceError.
+	// If 0, defaults to DefaultMaintenanceWait. If negative, requests
+	// fail right away.
+	MaintenanceWait time.Duration
+
+	// use this to make http requests.
+	// The transport settings above are only read when it is created,
+	// which is the first time the connection is used.
+	client     *http.Client
+	clientErr  error
+	clientOnce sync.Once
 
 	// keep a list of unused buffers so we can amortize allocation cost.
 	chunkpool *sync.Pool
+	poolOnce  sync.Once
 }
 
 type FileInfo struct {
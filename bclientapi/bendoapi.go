@@ -2,13 +2,15 @@ package bclientapi
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"time"
+	"strconv"
+	"strings"
 
 	"github.com/antonholmquist/jason"
 
@@ -23,6 +25,7 @@ var (
 	ErrReadFailed       = errors.New("Read Failed")
 	ErrChecksumMismatch = errors.New("Checksum mismatch")
 	ErrServerError      = errors.New("Server Error")
+	ErrQuotaExceeded    = errors.New("Upload quota exceeded")
 )
 
 func (c *Connection) ItemInfo(item string) (*jason.Object, error) {
@@ -72,19 +75,86 @@ func (c *Connection) Download(w io.Writer, item string, filename string) error {
 	return err
 }
 
-// do performs an http request using our client with a timeout. The
-// timeout is arbitrary, and is just there so we don't hang indefinitely
-// should the server never close the connection.
+// do performs an http request using our client. Rather than one overall
+// deadline, which would kill long downloads, the request fails if connecting,
+// waiting for the response headers, or waiting for the next piece of the
+// response body takes too long. If the connection has a Throttle, requests
+// the server asks us to slow down on are retried after backing off.
+// Requests refused during a server maintenance window are retried after the
+// window ends.
 func (c *Connection) do(req *http.Request) (*http.Response, error) {
 	if c.Token != "" {
 		req.Header.Add("X-Api-Key", c.Token)
 	}
-	if c.client == nil {
-		c.client = &http.Client{
-			Timeout: 10 * time.Minute, // arbitrary
+	c.clientOnce.Do(func() {
+		var t *http.Transport
+		t, c.clientErr = c.transport()
+		c.client = &http.Client{Transport: t}
+	})
+	if c.clientErr != nil {
+		return nil, c.clientErr
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	req = req.WithContext(ctx)
+	resp, err := c.doMaintenance(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	idle := c.IdleTimeout
+	if idle == 0 {
+		idle = DefaultIdleTimeout
+	}
+	resp.Body = newIdleTimeoutBody(resp.Body, idle, cancel)
+	return resp, nil
+}
+
+// doThrottled sends the request, using the throttle if there is one.
+func (c *Connection) doThrottled(req *http.Request) (*http.Response, error) {
+	if c.Throttle == nil {
+		return c.client.Do(req)
+	}
+	for i := 0; ; i++ {
+		c.Throttle.acquire()
+		resp, err := c.client.Do(req)
+		if err != nil {
+			c.Throttle.release(false, 0)
+			return resp, err
+		}
+		if !isThrottled(resp) || i >= maxThrottleRetries || !canResend(req) {
+			// hold our place until the caller finishes reading the body
+			resp.Body = &releaseOnClose{ReadCloser: resp.Body, t: c.Throttle}
+			return resp, err
+		}
+		backoff := retryAfter(resp, i)
+		resp.Body.Close()
+		log.Printf("Received HTTP status %d for %s %s, backing off %v",
+			resp.StatusCode, req.Method, req.URL, backoff)
+		c.Throttle.release(true, backoff)
+		err = rewindBody(req)
+		if err != nil {
+			return nil, err
 		}
 	}
-	return c.client.Do(req)
+}
+
+// canResend returns true if the request can be sent again, which is so
+// unless it has a body which cannot be read from the beginning again. A
+// request resent with the rest of a body which was already read would send
+// an empty or partial upload.
+func canResend(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// rewindBody resets the body of the request, if there is one, so it can be
+// sent again. Check canResend first.
+func rewindBody(req *http.Request) error {
+	if req.GetBody == nil {
+		return nil
+	}
+	var err error
+	req.Body, err = req.GetBody()
+	return err
 }
 
 // Not well named - sets a POST /item/:id/transaction
@@ -101,6 +171,13 @@ func (c *Connection) CreateTransaction(item string, cmdlist []byte) (string, err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusRequestEntityTooLarge {
+		msg, _ := io.ReadAll(resp.Body)
+		e := &TxTooLargeError{Message: strings.TrimSpace(string(msg))}
+		e.MaxBytes, _ = strconv.ParseInt(resp.Header.Get("X-Max-Transaction-Bytes"), 10, 64)
+		e.MaxFiles, _ = strconv.Atoi(resp.Header.Get("X-Max-Transaction-Files"))
+		return "", e
+	}
 	if resp.StatusCode != 202 {
 		log.Printf("Received HTTP status %d for POST %s", resp.StatusCode, path)
 		return "", ErrUnexpectedResp
@@ -111,6 +188,19 @@ func (c *Connection) CreateTransaction(item string, cmdlist []byte) (string, err
 	return transaction, nil
 }
 
+// A TxTooLargeError is returned by CreateTransaction when the server refuses
+// a transaction for adding too many files or bytes. The limits are zero if
+// there is none.
+type TxTooLargeError struct {
+	MaxBytes int64
+	MaxFiles int
+	Message  string // explanation from the server
+}
+
+func (e *TxTooLargeError) Error() string {
+	return "transaction too large: " + e.Message
+}
+
 type TransactionInfo struct {
 	Status transaction.Status
 	Errors []string
@@ -133,6 +223,29 @@ func (c *Connection) TransactionStatus(txid string) (TransactionInfo, error) {
 	return result, err
 }
 
+// UploadCapacity is how much more may be uploaded to the server.
+type UploadCapacity struct {
+	FreeBytes int64 // free space in the upload area, or -1 if not known
+	Quota     int64 // the user's upload quota, or 0 if there is none
+	Used      int64 // bytes the user has in the upload area
+	Remaining int64 // bytes left in the user's quota, or -1 if there is none
+}
+
+// UploadCapacity returns how much more the user of this connection may
+// upload. Servers which do not report it return ErrNotFound.
+func (c *Connection) UploadCapacity() (UploadCapacity, error) {
+	var result UploadCapacity
+	v, err := c.doJasonGet("/upload/capacity")
+	if err != nil {
+		return result, err
+	}
+	result.FreeBytes, _ = v.GetInt64("FreeBytes")
+	result.Quota, _ = v.GetInt64("Quota")
+	result.Used, _ = v.GetInt64("Used")
+	result.Remaining, _ = v.GetInt64("Remaining")
+	return result, nil
+}
+
 func (c *Connection) doJasonGet(path string) (*jason.Object, error) {
 	path = c.HostURL + path
 
@@ -142,7 +255,11 @@ func (c *Connection) doJasonGet(path string) (*jason.Object, error) {
 		return nil, err
 	}
 
-	req.Header.Set("Accept-Encoding", "application/json")
+	// ask for JSON with a parameter rather than with the Accept-Encoding
+	// header, so the transport can ask for a compressed response.
+	q := req.URL.Query()
+	q.Set("format", "json")
+	req.URL.RawQuery = q.Encode()
 	resp, err := c.do(req)
 
 	if err != nil {
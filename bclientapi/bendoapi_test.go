@@ -0,0 +1,84 @@
+package bclientapi
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCreateTransactionTooLarge(t *testing.T) {
+	eserver, remote := NewLocalBendoServer()
+	defer remote.Close()
+	eserver.Reset([]Play{{
+		When:   0,
+		Status: 413,
+		Body:   "too many files\n",
+		Header: map[string]string{
+			"X-Max-Transaction-Bytes": "1000",
+			"X-Max-Transaction-Files": "5",
+		},
+	}})
+	conn := &Connection{HostURL: remote.URL}
+	_, err := conn.CreateTransaction("abc", []byte(`[["add", "abc-1"]]`))
+	e, ok := err.(*TxTooLargeError)
+	if !ok {
+		t.Fatalf("Received %v, expected a TxTooLargeError", err)
+	}
+	if e.MaxBytes != 1000 || e.MaxFiles != 5 || e.Message != "too many files" {
+		t.Errorf("Received %#v", e)
+	}
+}
+
+func TestMaintenanceWait(t *testing.T) {
+	eserver, remote := NewLocalBendoServer()
+	defer remote.Close()
+	maintenance := Play{
+		When:   0,
+		Status: 503,
+		Body:   `{"Scheduled": true, "Active": true, "End": "2020-01-02T03:04:05Z", "Reason": "new tapes"}`,
+		Header: map[string]string{
+			"Retry-After":         "0",
+			"X-Bendo-Maintenance": "true",
+		},
+	}
+	eserver.Reset([]Play{maintenance})
+	conn := &Connection{HostURL: remote.URL, Throttle: NewThrottle(4)}
+	// the request is retried once the window ends, and the item doesn't exist
+	_, err := conn.ItemInfo("no-such-item")
+	if err != ErrNotFound {
+		t.Error("Received", err, "expected", ErrNotFound)
+	}
+	// waiting for maintenance is not throttling
+	if n := conn.Throttle.Limit(); n != 4 {
+		t.Error("Received limit", n, "expected 4")
+	}
+
+	// a connection which does not wait gets an error
+	eserver.Reset([]Play{maintenance})
+	conn = &Connection{HostURL: remote.URL, MaintenanceWait: -1}
+	_, err = conn.ItemInfo("no-such-item")
+	e, ok := err.(*MaintenanceError)
+	if !ok {
+		t.Fatalf("Received %v, expected a MaintenanceError", err)
+	}
+	if e.Reason != "new tapes" || e.End.Year() != 2020 {
+		t.Errorf("Received %#v", e)
+	}
+}
+
+func TestUploadCapacity(t *testing.T) {
+	_, remote := NewLocalBendoServer()
+	defer remote.Close()
+	conn := &Connection{HostURL: remote.URL, ChunkSize: 10}
+	err := conn.Upload("cap1", strings.NewReader("0123456789abcdef"), FileInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conn.UploadCapacity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := UploadCapacity{FreeBytes: -1, Quota: 0, Used: 16, Remaining: -1}
+	if c != expected {
+		t.Errorf("Received %+v, expected %+v", c, expected)
+	}
+}
@@ -15,7 +15,8 @@ import (
 // the temporary name of `uploadname`. It uses the provided FileInfo to do this.
 // If MD5 is not provided in the FileInfo, it will be calculated before doing
 // the transfer. If the file has already been uploaded or only uploaded partially,
-// we will resume the transfer where it was left off.
+// we will resume the transfer where it was left off. Use UploadSession to
+// keep a record of the transfer that can be resumed by another process.
 func (c *Connection) upload(uploadname string, r io.ReadSeeker, info FileInfo) error {
 	if len(info.MD5) == 0 {
 		// Since no md5 sum was suppled, calculate it. Need to do this before
@@ -36,37 +37,18 @@ func (c *Connection) upload(uploadname string, r io.ReadSeeker, info FileInfo) e
 		info.Size = size
 	}
 
-	// if there is an error, we assume the file just hasn't been uploaded yet
-	remoteinfo, _ := c.getUploadInfo(uploadname)
-	if len(remoteinfo.MD5) > 0 && !bytes.Equal(remoteinfo.MD5, info.MD5) {
-		// the prior upload was for something different?
-		// should delete and upload from beginning.
-		// TODO(dbrower): delete and upload from beginning
-		return ErrUnexpectedResp
-	}
-	if info.Size > 0 && remoteinfo.Size == info.Size {
-		// it is already uploaded
-		return nil
-	}
-	// start upload where we left off, in case we were interrupted
-	_, err := r.Seek(remoteinfo.Size, io.SeekStart)
-	if err != nil {
-		return err
-	}
-
-	// special case zero length files.
-	if info.Size == 0 {
-		emptyMD5 := []byte{
-			0xd4, 0x1d, 0x8c, 0xd9, 0x8f, 0x00, 0xb2, 0x04, 0xe9, 0x80, 0x09, 0x98, 0xec, 0xf8, 0x42, 0x7e,
-		}
-		err = c.upload0(uploadname, nil, emptyMD5, info)
-		return err
-	}
+	return c.UploadSession(NewUploadSession(uploadname, info, ""), r)
+}
 
-	// upload the file in chunks
+// getChunk returns a buffer of size ChunkSize from the chunk pool, or
+// allocates one if the pool is empty.
+func (c *Connection) getChunk() []byte {
 	var chunk []byte
-	if c.chunkpool == nil {
+	c.poolOnce.Do(func() {
 		c.chunkpool = &sync.Pool{}
+	})
+	if c.ChunkSize == 0 {
+		c.ChunkSize = 10 * (1 << 20) // default is 10 MB
 	}
 	if b := c.chunkpool.Get(); b != nil {
 		chunk = b.([]byte)
@@ -76,36 +58,9 @@ func (c *Connection) upload(uploadname string, r io.ReadSeeker, info FileInfo) e
 		}
 	}
 	if chunk == nil {
-		if c.ChunkSize == 0 {
-			c.ChunkSize = 10 * (1 << 20) // default is 10 MB
-		}
 		chunk = make([]byte, c.ChunkSize)
 	}
-	defer c.chunkpool.Put(chunk)
-bigloop:
-	for {
-		n, err := r.Read(chunk)
-		if err != nil && err != io.EOF {
-			return err
-		}
-		if n == 0 {
-			// nothing more to read?
-			return nil
-		}
-
-		chunkMD5 := md5.Sum(chunk[:n])
-
-		// try to upload a chunk at most 5 times
-		for i := 0; i < 5; i++ {
-			err = c.upload0(uploadname, chunk[:n], chunkMD5[:], info)
-			if err == nil {
-				continue bigloop
-			}
-			// otherwise there was some kind of error. Try again.
-		}
-		// too many retries
-		return err
-	}
+	return chunk
 }
 
 // upload0 sends a single fragment of a file to the server.
@@ -132,6 +87,8 @@ func (c *Connection) upload0(uploadname string, chunk []byte, chunkmd5sum []byte
 		return nil
 	case 412:
 		return ErrChecksumMismatch
+	case 507:
+		return ErrQuotaExceeded
 	default:
 		message := make([]byte, 512)
 		resp.Body.Read(message)
@@ -0,0 +1,79 @@
+package bclientapi
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// DefaultMaintenanceWait is the longest a request waits for a server
+// maintenance window to end if the connection does not give its own limit.
+const DefaultMaintenanceWait = 4 * time.Hour
+
+// A MaintenanceError is returned when the server refuses a request because
+// it is in a maintenance window, and the window would end after the
+// connection's MaintenanceWait.
+type MaintenanceError struct {
+	End    time.Time // when the server expects the maintenance to finish
+	Reason string    // explanation from the server
+}
+
+func (e *MaintenanceError) Error() string {
+	msg := "server in maintenance until " + e.End.Format(time.RFC3339)
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	return msg
+}
+
+// isMaintenance returns true if the response is the server refusing a
+// request during a maintenance window.
+func isMaintenance(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusServiceUnavailable &&
+		resp.Header.Get("X-Bendo-Maintenance") != ""
+}
+
+// readMaintenance returns the maintenance window described by the body of
+// a maintenance response. The body is closed.
+func readMaintenance(resp *http.Response) *MaintenanceError {
+	defer resp.Body.Close()
+	var e MaintenanceError
+	json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&e)
+	return &e
+}
+
+// doMaintenance sends the request. If the server is in a maintenance
+// window the request is retried once the window is over, so long as the
+// total time waiting is less than the connection's MaintenanceWait.
+func (c *Connection) doMaintenance(req *http.Request) (*http.Response, error) {
+	limit := c.MaintenanceWait
+	if limit == 0 {
+		limit = DefaultMaintenanceWait
+	}
+	var waited time.Duration
+	for {
+		resp, err := c.doThrottled(req)
+		if err != nil || !isMaintenance(resp) {
+			return resp, err
+		}
+		wait := retryAfter(resp, 0)
+		e := readMaintenance(resp)
+		if limit < 0 || waited+wait > limit || !canResend(req) {
+			return nil, e
+		}
+		log.Printf("Server in maintenance for %s %s (%s), waiting %v",
+			req.Method, req.URL, e.Reason, wait)
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+		waited += wait
+		err = rewindBody(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
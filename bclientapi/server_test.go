@@ -26,6 +26,7 @@ type Play struct {
 	When   int
 	Status int
 	Body   string
+	Header map[string]string // optional headers to add to the response
 }
 
 func (s *ErrorServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -41,6 +42,9 @@ func (s *ErrorServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			continue
 		}
 		s.m.Unlock()
+		for k, v := range p.Header {
+			w.Header().Set(k, v)
+		}
 		w.WriteHeader(p.Status)
 		w.Write([]byte(p.Body))
 		return
@@ -0,0 +1,224 @@
+package bclientapi
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// An UploadSession tracks the progress of uploading a single file to the
+// server. It can be saved to disk after every chunk, so that an upload
+// interrupted by a crash or reboot can be resumed by a new process. The
+// server is always asked how much it has received before resuming, so a
+// session file that is out of date is not a problem.
+type UploadSession struct {
+	FileID    string       // the upload name on the server
+	Source    string       // the local file being uploaded, if known
+	Size      int64        // total size of the file
+	MD5       []byte       // md5 hash of the entire file
+	Mimetype  string       // mime type of the file
+	ChunkSize int          // size of each chunk sent
+	Sent      int64        // number of bytes the server has acknowledged
+	Chunks    []ChunkState // the chunks sent so far
+	Started   time.Time
+	Updated   time.Time
+
+	// where to save this session after every chunk. If empty, the
+	// session is not saved.
+	path string
+	m    sync.Mutex
+}
+
+// ChunkState records a single chunk the server has acknowledged.
+type ChunkState struct {
+	Offset int64
+	Size   int
+	MD5    []byte
+}
+
+// NewUploadSession starts a new session for uploading a file of the given size
+// and checksum to the server under the name fileid. If path is not empty,
+// the session is saved to that file as the upload progresses.
+func NewUploadSession(fileid string, info FileInfo, path string) *UploadSession {
+	return &UploadSession{
+		FileID:   fileid,
+		Size:     info.Size,
+		MD5:      info.MD5,
+		Mimetype: info.Mimetype,
+		Started:  time.Now(),
+		path:     path,
+	}
+}
+
+// LoadUploadSession reads an upload session previously saved to the given
+// file. The session will continue to be saved to the same file.
+func LoadUploadSession(path string) (*UploadSession, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := &UploadSession{path: path}
+	err = json.NewDecoder(f).Decode(s)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Save writes the session to its file, if it has one. The file is replaced
+// atomically so a crash while saving will not corrupt an earlier copy.
+func (s *UploadSession) Save() error {
+	if s.path == "" {
+		return nil
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.Updated = time.Now()
+	dir := filepath.Dir(s.path)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".session")
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(f).Encode(s)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
+
+// Remove deletes the session's file. It is not an error if there is no file.
+func (s *UploadSession) Remove() error {
+	if s.path == "" {
+		return nil
+	}
+	err := os.Remove(s.path)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return err
+}
+
+// Done returns true if the entire file has been sent.
+func (s *UploadSession) Done() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.Sent >= s.Size
+}
+
+// resumeAt makes the session continue from the given offset, discarding
+// any chunks past it.
+func (s *UploadSession) resumeAt(offset int64) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.Sent = offset
+	for i, c := range s.Chunks {
+		if c.Offset+int64(c.Size) > offset {
+			s.Chunks = s.Chunks[:i]
+			break
+		}
+	}
+}
+
+// addChunk records a chunk as having been received by the server.
+func (s *UploadSession) addChunk(size int, md5sum []byte) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.Chunks = append(s.Chunks, ChunkState{
+		Offset: s.Sent,
+		Size:   size,
+		MD5:    md5sum,
+	})
+	s.Sent += int64(size)
+}
+
+// UploadSession sends the rest of the file described by the session to the
+// server, reading it from r. It picks up from wherever the server says the
+// upload stopped. The session is updated, and saved if it has a file, after
+// every chunk.
+func (c *Connection) UploadSession(s *UploadSession, r io.ReadSeeker) error {
+	info := FileInfo{Size: s.Size, MD5: s.MD5, Mimetype: s.Mimetype}
+
+	// if there is an error, we assume the file just hasn't been uploaded yet
+	remoteinfo, _ := c.getUploadInfo(s.FileID)
+	if len(remoteinfo.MD5) > 0 && !bytes.Equal(remoteinfo.MD5, info.MD5) {
+		// the prior upload was for something different?
+		// should delete and upload from beginning.
+		// TODO(dbrower): delete and upload from beginning
+		return ErrUnexpectedResp
+	}
+	// the server is the authority on how much has been uploaded
+	s.resumeAt(remoteinfo.Size)
+	if info.Size > 0 && s.Done() {
+		// it is already uploaded
+		return s.Save()
+	}
+	// start upload where we left off, in case we were interrupted
+	_, err := r.Seek(remoteinfo.Size, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	// special case zero length files. They are sent as a single empty
+	// chunk, unless the server already has the file.
+	if info.Size == 0 {
+		if len(remoteinfo.MD5) > 0 {
+			return s.Save()
+		}
+		emptyMD5 := md5.Sum(nil)
+		err = c.upload0(s.FileID, nil, emptyMD5[:], info)
+		if err != nil {
+			return err
+		}
+		s.addChunk(0, emptyMD5[:])
+		return s.Save()
+	}
+
+	// upload the file in chunks
+	chunk := c.getChunk()
+	defer c.chunkpool.Put(chunk)
+	s.ChunkSize = len(chunk)
+bigloop:
+	for {
+		n, err := r.Read(chunk)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n == 0 {
+			// nothing more to read?
+			return nil
+		}
+
+		chunkMD5 := md5.Sum(chunk[:n])
+
+		// try to upload a chunk at most 5 times
+		for i := 0; i < 5; i++ {
+			err = c.upload0(s.FileID, chunk[:n], chunkMD5[:], info)
+			if err == nil {
+				s.addChunk(n, chunkMD5[:])
+				err = s.Save()
+				if err != nil {
+					return err
+				}
+				continue bigloop
+			}
+			// otherwise there was some kind of error. Try again.
+		}
+		// too many retries
+		return err
+	}
+}
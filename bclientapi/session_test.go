@@ -0,0 +1,93 @@
+package bclientapi
+
+import (
+	"bytes"
+	"crypto/md5"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUploadSessionResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bclientapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sessionfile := filepath.Join(dir, "session.json")
+
+	data := "0123456789abcdefghijklmnopqrstuvwxyz"
+	md5 := []byte{0xe9, 0xb1, 0x71, 0x3d, 0xb6, 0x20, 0xf1, 0xe3, 0xa1, 0x4b, 0x68, 0x12, 0xde, 0x52, 0x3f, 0x4b}
+	info := FileInfo{Size: int64(len(data)), MD5: md5}
+
+	eserver, remote := NewLocalBendoServer()
+	// call 0 is the metadata lookup, call 1 is the first chunk.
+	// make every try of the second chunk fail.
+	var plays []Play
+	for i := 2; i < 7; i++ {
+		plays = append(plays, Play{When: i, Status: 500})
+	}
+	eserver.Reset(plays)
+	conn := &Connection{HostURL: remote.URL, ChunkSize: 10}
+	s := NewUploadSession("session-12345", info, sessionfile)
+	err = conn.UploadSession(s, bytes.NewReader([]byte(data)))
+	if err == nil {
+		t.Fatal("Expected an error, received nil")
+	}
+
+	// now pretend to be a new process
+	s, err = LoadUploadSession(sessionfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Sent != 10 || len(s.Chunks) != 1 || s.FileID != "session-12345" {
+		t.Errorf("Received session %#v", s)
+	}
+	conn = &Connection{HostURL: remote.URL, ChunkSize: 10}
+	err = conn.UploadSession(s, bytes.NewReader([]byte(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Done() || len(s.Chunks) != 4 {
+		t.Errorf("Received session %#v", s)
+	}
+	remoteinfo, err := conn.getUploadInfo("session-12345")
+	if err != nil || remoteinfo.Size != int64(len(data)) {
+		t.Error("Received", remoteinfo, err)
+	}
+	err = s.Remove()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUploadSessionEmpty(t *testing.T) {
+	emptyMD5 := md5.Sum(nil)
+	info := FileInfo{Size: 0, MD5: emptyMD5[:]}
+
+	eserver, remote := NewLocalBendoServer()
+	eserver.Reset(nil)
+	conn := &Connection{HostURL: remote.URL}
+	s := NewUploadSession("session-empty", info, "")
+	err := conn.UploadSession(s, bytes.NewReader(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Done() || len(s.Chunks) != 1 {
+		t.Errorf("Received session %#v", s)
+	}
+	// uploading again should not add another fragment
+	s = NewUploadSession("session-empty", info, "")
+	err = conn.UploadSession(s, bytes.NewReader(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Chunks) != 0 {
+		t.Errorf("Received session %#v", s)
+	}
+	remoteinfo, err := conn.getUploadInfo("session-empty")
+	if err != nil || remoteinfo.Size != 0 || !bytes.Equal(remoteinfo.MD5, emptyMD5[:]) {
+		t.Error("Received", remoteinfo, err)
+	}
+}
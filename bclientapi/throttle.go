@@ -0,0 +1,138 @@
+package bclientapi
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A Throttle limits the number of simultaneous requests a Connection makes to
+// the server, and adapts that limit to how busy the server says it is. When
+// the server responds with 429 Too Many Requests, or with 503 Service
+// Unavailable and a Retry-After header, the limit is halved and no new
+// requests are started until the Retry-After time has passed. Each run of
+// successful requests raises the limit by one, up to the maximum given to
+// NewThrottle. A Throttle may be shared between many goroutines.
+type Throttle struct {
+	m        sync.Mutex
+	c        *sync.Cond
+	max      int       // the limit is never raised above this
+	limit    int       // current number of requests allowed at once
+	inflight int       // number of requests in progress
+	ok       int       // successes since limit last changed
+	resume   time.Time // no new requests may start before this time
+}
+
+// NewThrottle returns a Throttle allowing at most max simultaneous requests.
+func NewThrottle(max int) *Throttle {
+	if max < 1 {
+		max = 1
+	}
+	t := &Throttle{max: max, limit: max}
+	t.c = sync.NewCond(&t.m)
+	return t
+}
+
+// Limit returns the current number of simultaneous requests allowed.
+func (t *Throttle) Limit() int {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.limit
+}
+
+// acquire blocks until a new request may be started.
+func (t *Throttle) acquire() {
+	t.m.Lock()
+	for {
+		if d := time.Until(t.resume); d > 0 {
+			t.m.Unlock()
+			time.Sleep(d)
+			t.m.Lock()
+			continue
+		}
+		if t.inflight < t.limit {
+			break
+		}
+		t.c.Wait()
+	}
+	t.inflight++
+	t.m.Unlock()
+}
+
+// release marks a request as finished. If the server asked us to slow down,
+// throttled should be true and backoff the amount of time to wait before
+// starting any new requests.
+func (t *Throttle) release(throttled bool, backoff time.Duration) {
+	t.m.Lock()
+	t.inflight--
+	if throttled {
+		t.limit /= 2
+		if t.limit < 1 {
+			t.limit = 1
+		}
+		t.ok = 0
+		if when := time.Now().Add(backoff); when.After(t.resume) {
+			t.resume = when
+		}
+	} else if t.limit < t.max {
+		t.ok++
+		if t.ok >= t.limit {
+			t.limit++
+			t.ok = 0
+		}
+	}
+	t.m.Unlock()
+	t.c.Broadcast()
+}
+
+// the number of times a request is retried after the server asks us to slow
+// down before the response is passed back to the caller.
+const maxThrottleRetries = 10
+
+// isThrottled returns true if the response indicates the server wants us to
+// slow down. A 503 without a Retry-After header is treated as an ordinary
+// error, since bendo also uses it to mean the tape system is unavailable.
+// Maintenance windows are handled by doMaintenance instead.
+func isThrottled(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusServiceUnavailable:
+		return resp.Header.Get("Retry-After") != "" && !isMaintenance(resp)
+	}
+	return false
+}
+
+// retryAfter returns how long to wait before retrying, using the Retry-After
+// header if there is one. Otherwise the delay doubles with each attempt.
+func retryAfter(resp *http.Response, attempt int) time.Duration {
+	v := resp.Header.Get("Retry-After")
+	if v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			return time.Duration(n) * time.Second
+		}
+		if when, err := http.ParseTime(v); err == nil {
+			return time.Until(when)
+		}
+	}
+	d := 500 * time.Millisecond << uint(attempt)
+	if d > time.Minute {
+		d = time.Minute
+	}
+	return d
+}
+
+// releaseOnClose wraps a response body and releases its place in the
+// throttle when the body is closed.
+type releaseOnClose struct {
+	io.ReadCloser
+	t    *Throttle
+	once sync.Once
+}
+
+func (r *releaseOnClose) Close() error {
+	r.once.Do(func() { r.t.release(false, 0) })
+	return r.ReadCloser.Close()
+}
@@ -0,0 +1,116 @@
+package bclientapi
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestThrottleRetry(t *testing.T) {
+	eserver, remote := NewLocalBendoServer()
+	eserver.Reset([]Play{
+		Play{When: 0, Status: 429, Header: map[string]string{"Retry-After": "0"}},
+		Play{When: 1, Status: 503, Header: map[string]string{"Retry-After": "0"}},
+	})
+	conn := &Connection{
+		HostURL:  remote.URL,
+		Throttle: NewThrottle(4),
+	}
+	// the item doesn't exist, so after the retries we should get a 404
+	_, err := conn.ItemInfo("no-such-item")
+	if err != ErrNotFound {
+		t.Error("Received", err, "expected", ErrNotFound)
+	}
+	// limit was halved twice, and then raised by the final success
+	if n := conn.Throttle.Limit(); n != 2 {
+		t.Error("Received limit", n, "expected 2")
+	}
+
+	// a 503 without Retry-After is not retried
+	eserver.Reset([]Play{Play{When: 0, Status: 503}})
+	_, err = conn.ItemInfo("no-such-item")
+	if err == nil || err == ErrNotFound {
+		t.Error("Received", err, "expected a status 503 error")
+	}
+}
+
+func TestThrottleLimit(t *testing.T) {
+	th := NewThrottle(3)
+	th.acquire()
+	th.release(true, 50*time.Millisecond)
+	if n := th.Limit(); n != 1 {
+		t.Error("Received limit", n, "expected 1")
+	}
+	start := time.Now()
+	th.acquire()
+	if time.Since(start) < 40*time.Millisecond {
+		t.Error("acquire did not wait for backoff")
+	}
+	th.release(false, 0)
+	// one success raises limit from 1 to 2, two more raise it to 3
+	for i := 0; i < 5; i++ {
+		th.acquire()
+		th.release(false, 0)
+	}
+	if n := th.Limit(); n != 3 {
+		t.Error("Received limit", n, "expected 3")
+	}
+}
+
+func TestThrottleResendBody(t *testing.T) {
+	var m sync.Mutex
+	var bodies []string
+	received := func() []string {
+		m.Lock()
+		defer m.Unlock()
+		return append([]string(nil), bodies...)
+	}
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		m.Lock()
+		bodies = append(bodies, string(body))
+		first := len(bodies) == 1
+		m.Unlock()
+		if first {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(429)
+		}
+	}))
+	defer remote.Close()
+	conn := &Connection{HostURL: remote.URL, Throttle: NewThrottle(4)}
+	const content = "the whole chunk"
+
+	// a body which can be rewound is sent in full again
+	req, _ := http.NewRequest("POST", remote.URL, bytes.NewReader([]byte(content)))
+	resp, err := conn.do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	got := received()
+	if resp.StatusCode != 200 || len(got) != 2 || got[1] != content {
+		t.Errorf("Received status %d and bodies %q, expected 200 and %q twice",
+			resp.StatusCode, got, content)
+	}
+
+	// one which cannot is not resent, and the 429 is returned
+	m.Lock()
+	bodies = nil
+	m.Unlock()
+	req, _ = http.NewRequest("POST", remote.URL, io.NopCloser(strings.NewReader(content)))
+	resp, err = conn.do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	got = received()
+	if resp.StatusCode != 429 || len(got) != 1 {
+		t.Errorf("Received status %d and bodies %q, expected 429 and one request",
+			resp.StatusCode, got)
+	}
+}
@@ -0,0 +1,159 @@
+package bclientapi
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMaxIdleConnsPerHost is the number of idle keep-alive connections
+// kept open to the server if a Connection does not specify one. The standard
+// library default of 2 is too small for the parallel uploads bclient does.
+const DefaultMaxIdleConnsPerHost = 8
+
+// The default timeouts used if a Connection does not specify them.
+const (
+	DefaultDialTimeout = 30 * time.Second
+
+	// The server may need to read from tape before it can respond, so
+	// this is generous.
+	DefaultResponseHeaderTimeout = 10 * time.Minute
+
+	DefaultIdleTimeout = 2 * time.Minute
+)
+
+// ErrIdleTimeout means no data was received on a response body for longer
+// than the idle timeout.
+var ErrIdleTimeout = errors.New("timeout waiting for response body")
+
+// sharedTransport is used by every Connection that does not need any
+// transport customization, so they all share one pool of keep-alive
+// connections.
+var sharedTransport = newTransport(DefaultMaxIdleConnsPerHost,
+	DefaultDialTimeout,
+	DefaultResponseHeaderTimeout)
+
+// newTransport returns an http.Transport with our default settings.
+func newTransport(maxidle int, dial time.Duration, header time.Duration) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   dial,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   maxidle,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: header,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// ErrBadCAFile means the CA bundle did not contain any PEM certificates.
+var ErrBadCAFile = errors.New("no certificates found in CA file")
+
+// transport returns the http transport this connection should use. The shared
+// transport is returned unless one of the transport fields has been set.
+func (c *Connection) transport() (*http.Transport, error) {
+	if c.MaxIdleConnsPerHost == 0 &&
+		c.TLSConfig == nil &&
+		c.CAFile == "" &&
+		c.Proxy == nil &&
+		c.DialTimeout == 0 &&
+		c.ResponseHeaderTimeout == 0 {
+		return sharedTransport, nil
+	}
+	maxidle := c.MaxIdleConnsPerHost
+	if maxidle == 0 {
+		maxidle = DefaultMaxIdleConnsPerHost
+	}
+	dial := c.DialTimeout
+	if dial == 0 {
+		dial = DefaultDialTimeout
+	}
+	header := c.ResponseHeaderTimeout
+	if header == 0 {
+		header = DefaultResponseHeaderTimeout
+	}
+	t := newTransport(maxidle, dial, header)
+	if c.Proxy != nil {
+		t.Proxy = c.Proxy
+	}
+	var tlsconfig *tls.Config
+	if c.TLSConfig != nil {
+		tlsconfig = c.TLSConfig.Clone()
+	}
+	if c.CAFile != "" {
+		pool, err := LoadCAFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		if tlsconfig == nil {
+			tlsconfig = &tls.Config{}
+		}
+		tlsconfig.RootCAs = pool
+	}
+	t.TLSClientConfig = tlsconfig
+	return t, nil
+}
+
+// LoadCAFile returns a certificate pool containing the system certificate
+// authorities and those in the given PEM encoded file.
+func LoadCAFile(fname string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, ErrBadCAFile
+	}
+	return pool, nil
+}
+
+// idleTimeoutBody wraps a response body and cancels the request if no data
+// arrives for longer than the idle timeout.
+type idleTimeoutBody struct {
+	io.ReadCloser
+	idle    time.Duration
+	timer   *time.Timer
+	cancel  context.CancelFunc
+	expired int32 // set to 1 by the timer, accessed atomically
+}
+
+func newIdleTimeoutBody(rc io.ReadCloser, idle time.Duration, cancel context.CancelFunc) *idleTimeoutBody {
+	b := &idleTimeoutBody{ReadCloser: rc, idle: idle, cancel: cancel}
+	b.timer = time.AfterFunc(idle, func() {
+		atomic.StoreInt32(&b.expired, 1)
+		cancel()
+	})
+	return b
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && atomic.LoadInt32(&b.expired) == 1 {
+		return n, ErrIdleTimeout
+	}
+	b.timer.Reset(b.idle)
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,91 @@
+package bclientapi
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTransport(t *testing.T) {
+	c := &Connection{}
+	tr, err := c.transport()
+	if err != nil || tr != sharedTransport {
+		t.Error("Expected shared transport, received", tr, err)
+	}
+
+	proxy, _ := url.Parse("http://proxy.example.edu:3128")
+	c = &Connection{Proxy: http.ProxyURL(proxy), MaxIdleConnsPerHost: 3}
+	tr, err = c.transport()
+	if err != nil || tr == sharedTransport {
+		t.Fatal("Expected new transport, received", tr, err)
+	}
+	if tr.MaxIdleConnsPerHost != 3 {
+		t.Error("Received MaxIdleConnsPerHost", tr.MaxIdleConnsPerHost, "expected 3")
+	}
+	req, _ := http.NewRequest("GET", "http://bendo.example.edu/", nil)
+	u, _ := tr.Proxy(req)
+	if u == nil || u.Host != "proxy.example.edu:3128" {
+		t.Error("Received proxy", u)
+	}
+}
+
+func TestBadCAFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "bclientapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("not a certificate")
+	f.Close()
+
+	c := &Connection{HostURL: "https://bendo.example.edu", CAFile: f.Name()}
+	_, err = c.ItemInfo("abc")
+	if err != ErrBadCAFile {
+		t.Error("Received", err, "expected", ErrBadCAFile)
+	}
+}
+
+// trickleHandler writes a byte every 50ms for n times, and then, if stall is
+// set, waits 500ms before finishing.
+type trickleHandler struct {
+	n     int
+	stall bool
+}
+
+func (h trickleHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for i := 0; i < h.n; i++ {
+		w.Write([]byte("x"))
+		w.(http.Flusher).Flush()
+		time.Sleep(50 * time.Millisecond)
+	}
+	if h.stall {
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	var table = []struct {
+		h   trickleHandler
+		err error
+	}{
+		// slow but steady downloads take longer than the idle timeout
+		{trickleHandler{n: 8}, nil},
+		{trickleHandler{n: 2, stall: true}, ErrIdleTimeout},
+	}
+	for _, tab := range table {
+		remote := httptest.NewServer(tab.h)
+		c := &Connection{
+			HostURL:     remote.URL,
+			IdleTimeout: 200 * time.Millisecond,
+		}
+		err := c.Download(ioutil.Discard, "item", "file")
+		if err != tab.err {
+			t.Error("For", tab.h, "received", err, "expected", tab.err)
+		}
+		remote.Close()
+	}
+}
@@ -5,34 +5,28 @@
 // information is kept only in memory. On startup the items in the store are
 // enumerated and taken to populate the cache list in an undetermined order.
 //
-// The only cache implemented in here uses an LRU item replacement policy. It
-// would be nice for it to use an ARC or 2Q policy instead.
+// The store-backed caches use either an LRU or a time-based item replacement
+// policy. It would be nice to have an ARC or 2Q policy too. There is also a
+// cache kept in a Redis server, for small blobs, and a Tiered cache which
+// keeps small blobs in a fast cache in front of a slower one. All of them
+// satisfy the cache.Cache interface.
 package blobcache
 
 import (
 	"container/list"
 	"errors"
 	"io"
+	"sort"
 	"sync"
 
+	"github.com/ndlib/bendo/cache"
 	"github.com/ndlib/bendo/store"
 )
 
 // T is the basic blob cache interface.
-type T interface {
-	// Is the given key in the cache?
-	Contains(key string) bool
-	// Get content associated with a key from the cache.
-	Get(key string) (store.ReadAtCloser, int64, error)
-	// Add content into the cache
-	Put(key string) (io.WriteCloser, error)
-	// Remove an entry from the cache
-	Delete(key string) error
-	// The amount currently stored in the cache
-	Size() int64
-	// The maximum size of the cache in bytes. (0 if there is no max size)
-	MaxSize() int64
-}
+//
+// Deprecated: use cache.Cache, which this is an alias for.
+type T = cache.Cache
 
 // A StoreLRU implements a cache using the least recently used (LRU) eviction
 // policy and using a store as the storage backend.
@@ -75,10 +69,28 @@ func NewLRU(s store.Store, maxSize int64) *StoreLRU {
 }
 
 // Scan enumerates the items in the given store and enters them into the LRU
-// cache (if they aren't in it already).
+// cache (if they aren't in it already). Entries whose content is no longer
+// in the store are removed, so Scan may be called again to catch up with
+// changes made to the store directly.
 func (t *StoreLRU) Scan() {
+	// only entries indexed before the store is listed can be missing from
+	// the listing, so remember which those are.
+	indexed := make(map[string]bool)
+	t.m.RLock()
+	for e := t.lru.Front(); e != nil; e = e.Next() {
+		indexed[e.Value.(entry).key] = true
+	}
+	t.m.RUnlock()
 	for key := range t.s.List() {
-		if t.Contains(key) {
+		if indexed[key] {
+			delete(indexed, key)
+			continue
+		}
+		// skip entries being written, which are added when finished
+		t.m.RLock()
+		_, pending := t.pending[key]
+		t.m.RUnlock()
+		if pending || t.Contains(key) {
 			continue
 		}
 		rc, size, err := t.s.Open(key)
@@ -94,6 +106,38 @@ func (t *StoreLRU) Scan() {
 		}
 		t.linkEntry(entry{key: key, size: size})
 	}
+	// what is left in indexed is gone from the store
+	if len(indexed) == 0 {
+		return
+	}
+	t.m.Lock()
+	defer t.m.Unlock()
+	for e := t.lru.Front(); e != nil; {
+		next := e.Next()
+		entry := e.Value.(entry)
+		if indexed[entry.key] {
+			t.lru.Remove(e)
+			t.size -= entry.size
+		}
+		e = next
+	}
+}
+
+// Entries returns the entries in the cache, with those being written first
+// and then from the most recently used to the least.
+func (t *StoreLRU) Entries() []cache.Entry {
+	t.m.RLock()
+	defer t.m.RUnlock()
+	var result []cache.Entry
+	for key := range t.pending {
+		result = append(result, cache.Entry{Key: key, Pinned: true})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	for e := t.lru.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(entry)
+		result = append(result, cache.Entry{Key: entry.key, Size: entry.size})
+	}
+	return result
 }
 
 // Contains returns true if the given item is in the cache. It does not
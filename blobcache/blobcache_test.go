@@ -116,6 +116,37 @@ func TestScanLRU(t *testing.T) {
 	}
 }
 
+func TestRescanLRU(t *testing.T) {
+	mem := store.NewMemory()
+	c := NewLRU(mem, 100)
+	for _, key := range []string{"a", "b"} {
+		w, _ := c.Put(key)
+		w.Write([]byte("12345"))
+		w.Close()
+	}
+	w, _ := c.Put("pending")
+
+	// change the store behind the cache's back
+	mem.Delete("a")
+	w2, _ := mem.Create("c")
+	w2.Write([]byte("1234567"))
+	w2.Close()
+
+	c.Scan()
+	entries := c.Entries()
+	var keys []string
+	for _, e := range entries {
+		keys = append(keys, e.Key)
+	}
+	if fmt.Sprint(keys) != "[pending c b]" || !entries[0].Pinned || entries[1].Size != 7 {
+		t.Errorf("Received entries %v", entries)
+	}
+	if c.Size() != 12 {
+		t.Errorf("Received size %d, expected 12", c.Size())
+	}
+	w.Close()
+}
+
 func TestDeleteLRU(t *testing.T) {
 	cache := NewLRU(store.NewMemory(), 100)
 	key := "1234"
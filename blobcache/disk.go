@@ -0,0 +1,18 @@
+package blobcache
+
+import (
+	"os"
+
+	"github.com/ndlib/bendo/store"
+)
+
+// NewDisk creates an LRU cache which keeps its contents in files under the
+// given directory, creating the directory if needed. Entries left from a
+// previous run are reused once Scan() is called.
+func NewDisk(dir string, maxSize int64) (*StoreLRU, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return NewLRU(store.NewFileSystem(dir), maxSize), nil
+}
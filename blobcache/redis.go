@@ -0,0 +1,236 @@
+package blobcache
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ndlib/bendo/store"
+)
+
+// A Redis cache keeps blobs as string values in a Redis server. It is meant
+// for small blobs, since each entry is held in memory while it is being read
+// or written. Eviction is left to the Redis server, so it should be run with
+// a maxmemory setting and an allkeys eviction policy.
+//
+// Only the commands GET, SET, DEL, EXISTS, and INFO are used, so anything
+// speaking the Redis protocol should work.
+type Redis struct {
+	addr    string
+	prefix  string // prepended to every key
+	maxSize int64
+
+	m    sync.Mutex // protects conn and r
+	conn net.Conn   // nil if not connected
+	r    *bufio.Reader
+}
+
+// redisTimeout bounds how long any one command may take.
+const redisTimeout = 10 * time.Second
+
+// NewRedis creates a cache using the Redis server at the given address
+// ("host:port"). The prefix is prepended to every key so one Redis server
+// can be shared. The maxSize should match the memory given to Redis, and
+// limits the size of any one entry to maxSize. It is not checked against
+// the actual memory used. A maxSize of 0 means there is no limit.
+func NewRedis(addr string, prefix string, maxSize int64) *Redis {
+	return &Redis{
+		addr:    addr,
+		prefix:  prefix,
+		maxSize: maxSize,
+	}
+}
+
+// Contains returns true if the given key is in the cache.
+func (rc *Redis) Contains(key string) bool {
+	v, err := rc.do("EXISTS", rc.prefix+key)
+	n, _ := v.(int64)
+	return err == nil && n > 0
+}
+
+// Get returns the content for the given key. If the key is not in the cache
+// nil is returned for the ReadAtCloser.
+func (rc *Redis) Get(key string) (store.ReadAtCloser, int64, error) {
+	v, err := rc.do("GET", rc.prefix+key)
+	if err != nil {
+		return nil, 0, err
+	}
+	b, _ := v.([]byte)
+	if b == nil {
+		return nil, 0, nil
+	}
+	return bytesReadAtCloser{bytes.NewReader(b)}, int64(len(b)), nil
+}
+
+// Put returns a WriteCloser which buffers its input and saves it under the
+// given key when closed. If the content grows larger than the maximum size
+// the writes return ErrCacheFull and nothing is saved.
+func (rc *Redis) Put(key string) (io.WriteCloser, error) {
+	return &redisWriter{parent: rc, key: key}, nil
+}
+
+// Delete removes an item from the cache. It is not an error to remove a key
+// which is not present.
+func (rc *Redis) Delete(key string) error {
+	_, err := rc.do("DEL", rc.prefix+key)
+	return err
+}
+
+// Size returns the memory in bytes the Redis server reports using. It
+// returns 0 if the server cannot be reached.
+func (rc *Redis) Size() int64 {
+	v, err := rc.do("INFO", "memory")
+	b, _ := v.([]byte)
+	if err != nil || b == nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, "used_memory:") {
+			n, _ := strconv.ParseInt(strings.TrimSpace(line[12:]), 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+// MaxSize returns the maximum size of this cache in bytes.
+func (rc *Redis) MaxSize() int64 {
+	return rc.maxSize
+}
+
+// redisWriter collects the content of a new entry until it is closed.
+type redisWriter struct {
+	parent *Redis
+	key    string
+	buf    bytes.Buffer
+	failed bool // true to discard the entry on Close
+}
+
+func (w *redisWriter) Write(p []byte) (int, error) {
+	max := w.parent.maxSize
+	if max > 0 && int64(w.buf.Len()+len(p)) > max {
+		w.failed = true
+		return 0, ErrCacheFull
+	}
+	return w.buf.Write(p)
+}
+
+func (w *redisWriter) Close() error {
+	if w.failed {
+		return nil
+	}
+	_, err := w.parent.do("SET", w.parent.prefix+w.key, w.buf.String())
+	return err
+}
+
+type bytesReadAtCloser struct {
+	*bytes.Reader
+}
+
+func (bytesReadAtCloser) Close() error { return nil }
+
+// ErrRedisProtocol means the server sent a reply we could not parse.
+var ErrRedisProtocol = errors.New("redis: unexpected reply")
+
+// do sends the given command to the server and returns the reply. Replies
+// are returned as a string (status), an int64 (integer), a []byte (bulk
+// string, nil if missing), or a []interface{} (array). Error replies are
+// returned as errors. The connection is dropped on any network error and
+// redialed on the next command.
+func (rc *Redis) do(args ...string) (interface{}, error) {
+	rc.m.Lock()
+	defer rc.m.Unlock()
+
+	if rc.conn == nil {
+		conn, err := net.DialTimeout("tcp", rc.addr, redisTimeout)
+		if err != nil {
+			return nil, err
+		}
+		rc.conn = conn
+		rc.r = bufio.NewReader(conn)
+	}
+	rc.conn.SetDeadline(time.Now().Add(redisTimeout))
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := rc.conn.Write(buf.Bytes())
+	var v interface{}
+	if err == nil {
+		v, err = readReply(rc.r)
+	}
+	if _, ok := err.(redisError); err != nil && !ok {
+		rc.conn.Close()
+		rc.conn = nil
+		rc.r = nil
+	}
+	return v, err
+}
+
+// redisError is an error reply sent by the server.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// readReply reads one reply in the Redis serialization protocol.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, ErrRedisProtocol
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, ErrRedisProtocol
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, ErrRedisProtocol
+		}
+		if n < 0 {
+			return []byte(nil), nil
+		}
+		b := make([]byte, n+2) // include trailing \r\n
+		_, err = io.ReadFull(r, b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, ErrRedisProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		result := make([]interface{}, n)
+		for i := range result {
+			result[i], err = readReply(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	}
+	return nil, ErrRedisProtocol
+}
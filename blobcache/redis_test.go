@@ -0,0 +1,168 @@
+package blobcache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/ndlib/bendo/cache"
+)
+
+var _ cache.Cache = &Redis{}
+
+// fakeRedis is a minimal in-memory server speaking enough of the Redis
+// protocol to exercise the Redis cache.
+type fakeRedis struct {
+	l    net.Listener
+	m    sync.Mutex
+	data map[string]string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{l: l, data: make(map[string]string)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		v, err := readReply(r)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range v.([]interface{}) {
+			args = append(args, string(arg.([]byte)))
+		}
+		f.m.Lock()
+		switch args[0] {
+		case "GET":
+			s, ok := f.data[args[1]]
+			if ok {
+				fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(s), s)
+			} else {
+				fmt.Fprintf(conn, "$-1\r\n")
+			}
+		case "SET":
+			f.data[args[1]] = args[2]
+			fmt.Fprintf(conn, "+OK\r\n")
+		case "DEL", "EXISTS":
+			_, ok := f.data[args[1]]
+			if args[0] == "DEL" {
+				delete(f.data, args[1])
+			}
+			if ok {
+				fmt.Fprintf(conn, ":1\r\n")
+			} else {
+				fmt.Fprintf(conn, ":0\r\n")
+			}
+		case "INFO":
+			s := "# Memory\r\nused_memory:1234\r\n"
+			fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(s), s)
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command\r\n")
+		}
+		f.m.Unlock()
+	}
+}
+
+func TestRedis(t *testing.T) {
+	f := newFakeRedis(t)
+	defer f.l.Close()
+	rc := NewRedis(f.l.Addr().String(), "bendo:", 100)
+
+	r, _, err := rc.Get("hello")
+	if r != nil || err != nil {
+		t.Fatalf("Get on empty cache returned %v, %v", r, err)
+	}
+	w, err := rc.Put("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("hello world"))
+	if rc.Contains("hello") {
+		t.Error("entry visible before Close")
+	}
+	w.Close()
+	if _, ok := f.data["bendo:hello"]; !ok {
+		t.Error("key not prefixed in redis")
+	}
+	r, size, err := rc.Get("hello")
+	if err != nil || r == nil {
+		t.Fatalf("Get returned %v, %v", r, err)
+	}
+	content, _ := ioutil.ReadAll(io.NewSectionReader(r, 0, size))
+	if size != 11 || string(content) != "hello world" {
+		t.Errorf("Get returned %d, %q", size, content)
+	}
+	r.Close()
+	if rc.Size() != 1234 {
+		t.Errorf("Size() = %d, expected 1234", rc.Size())
+	}
+	err = rc.Delete("hello")
+	if err != nil {
+		t.Error(err)
+	}
+	if rc.Contains("hello") {
+		t.Error("entry still present after Delete")
+	}
+}
+
+func TestTooLargeItemRedis(t *testing.T) {
+	f := newFakeRedis(t)
+	defer f.l.Close()
+	rc := NewRedis(f.l.Addr().String(), "", 100)
+
+	w, _ := rc.Put("qwerty")
+	for i := 0; i < 10; i++ {
+		_, err := w.Write([]byte("hello world"))
+		if err != nil {
+			if err != ErrCacheFull {
+				t.Errorf("Received %s, expected ErrCacheFull", err)
+			}
+			break
+		}
+	}
+	w.Close()
+	if rc.Contains("qwerty") {
+		t.Error("Too large item was saved")
+	}
+}
+
+func TestRedisReconnect(t *testing.T) {
+	f := newFakeRedis(t)
+	rc := NewRedis(f.l.Addr().String(), "", 0)
+	if rc.Contains("a") {
+		t.Error("Contains on empty cache returned true")
+	}
+	// close the connection out from under the cache
+	rc.conn.Close()
+	err := rc.Delete("a")
+	if err == nil {
+		t.Error("expected error on closed connection")
+	}
+	// the next command should redial
+	err = rc.Delete("a")
+	if err != nil {
+		t.Error(err)
+	}
+	f.l.Close()
+}
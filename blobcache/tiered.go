@@ -0,0 +1,171 @@
+package blobcache
+
+import (
+	"expvar"
+	"io"
+
+	"github.com/ndlib/bendo/cache"
+	"github.com/ndlib/bendo/store"
+)
+
+// A Tiered cache keeps copies of small blobs in a fast cache, usually in
+// memory, in front of a larger and slower one, usually on disk. Every entry
+// is in the slow tier. Entries no larger than the limit are also copied into
+// the fast tier when they are added, and again whenever they are read from
+// the slow tier after the fast tier has evicted them. Since the slow tier
+// always has a copy, entries evicted from the fast tier are only demoted,
+// not lost.
+//
+// The size and maximum size are those of the slow tier, which holds
+// everything.
+type Tiered struct {
+	fast  cache.Cache
+	slow  cache.Cache
+	limit int64 // largest entry kept in the fast tier
+}
+
+var (
+	xTierFastHit = expvar.NewInt("cache.tier.fast.hit")
+	xTierSlowHit = expvar.NewInt("cache.tier.slow.hit")
+	xTierMiss    = expvar.NewInt("cache.tier.miss")
+	xTierPromote = expvar.NewInt("cache.tier.promote")
+)
+
+// NewTiered creates a cache keeping entries of at most limit bytes in fast,
+// in front of slow. The fast cache should not be shared with anything else.
+func NewTiered(fast, slow cache.Cache, limit int64) *Tiered {
+	return &Tiered{
+		fast:  fast,
+		slow:  slow,
+		limit: limit,
+	}
+}
+
+// Contains returns true if the given key is in either tier.
+func (t *Tiered) Contains(key string) bool {
+	return t.fast.Contains(key) || t.slow.Contains(key)
+}
+
+// Get returns the content for the given key, from the fast tier if it is
+// there. Small entries read from the slow tier are promoted into the fast
+// tier.
+func (t *Tiered) Get(key string) (store.ReadAtCloser, int64, error) {
+	r, n, err := t.fast.Get(key)
+	if err == nil && r != nil {
+		xTierFastHit.Add(1)
+		return r, n, nil
+	}
+	r, n, err = t.slow.Get(key)
+	if err != nil || r == nil {
+		xTierMiss.Add(1)
+		return r, n, err
+	}
+	xTierSlowHit.Add(1)
+	if n <= t.limit {
+		buf := make([]byte, n)
+		_, err = r.ReadAt(buf, 0)
+		if err == nil || err == io.EOF {
+			t.promote(key, buf)
+		}
+	}
+	return r, n, nil
+}
+
+// promote copies the given content into the fast tier. Errors are ignored,
+// since the content is still in the slow tier.
+func (t *Tiered) promote(key string, content []byte) {
+	w, err := t.fast.Put(key)
+	if err != nil {
+		return // e.g. another promotion of the same key is in progress
+	}
+	_, err = w.Write(content)
+	if err != nil {
+		w.Close()
+		t.fast.Delete(key)
+		return
+	}
+	if w.Close() == nil {
+		xTierPromote.Add(1)
+	}
+}
+
+// Put returns a writer which adds the content to the slow tier, and also to
+// the fast tier if it is no larger than the limit.
+func (t *Tiered) Put(key string) (io.WriteCloser, error) {
+	w, err := t.slow.Put(key)
+	if err != nil {
+		return nil, err
+	}
+	// remove any stale copy
+	t.fast.Delete(key)
+	return &tieredWriter{parent: t, key: key, w: w}, nil
+}
+
+// Delete removes the given key from both tiers.
+func (t *Tiered) Delete(key string) error {
+	err := t.fast.Delete(key)
+	err2 := t.slow.Delete(key)
+	if err == nil {
+		err = err2
+	}
+	return err
+}
+
+// Size returns the size of the slow tier.
+func (t *Tiered) Size() int64 {
+	return t.slow.Size()
+}
+
+// MaxSize returns the maximum size of the slow tier.
+func (t *Tiered) MaxSize() int64 {
+	return t.slow.MaxSize()
+}
+
+// Scan indexes the existing contents of both tiers, if they need it.
+func (t *Tiered) Scan() {
+	if c, ok := t.fast.(cache.Scanner); ok {
+		c.Scan()
+	}
+	if c, ok := t.slow.(cache.Scanner); ok {
+		c.Scan()
+	}
+}
+
+// Entries lists the entries of the slow tier, which holds everything. It
+// returns nil if the slow tier cannot list its entries.
+func (t *Tiered) Entries() []cache.Entry {
+	if c, ok := t.slow.(cache.Lister); ok {
+		return c.Entries()
+	}
+	return nil
+}
+
+// tieredWriter writes an entry into the slow tier, keeping a copy of it
+// while it is small enough for the fast tier.
+type tieredWriter struct {
+	parent *Tiered
+	key    string
+	w      io.WriteCloser // the slow tier writer
+	buf    []byte
+	skip   bool // true if the entry is not to go into the fast tier
+}
+
+func (tw *tieredWriter) Write(p []byte) (int, error) {
+	n, err := tw.w.Write(p)
+	if err != nil || int64(len(tw.buf)+n) > tw.parent.limit {
+		tw.skip = true
+		tw.buf = nil
+	}
+	if !tw.skip {
+		tw.buf = append(tw.buf, p[:n]...)
+	}
+	return n, err
+}
+
+func (tw *tieredWriter) Close() error {
+	err := tw.w.Close()
+	if err == nil && !tw.skip {
+		tw.parent.promote(tw.key, tw.buf)
+	}
+	return err
+}
@@ -0,0 +1,66 @@
+package blobcache
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/ndlib/bendo/store"
+)
+
+func TestTiered(t *testing.T) {
+	fast := NewLRU(store.NewMemory(), 100)
+	slow := NewLRU(store.NewMemory(), 1000)
+	c := NewTiered(fast, slow, 10)
+
+	for key, content := range map[string]string{"small": "tiny", "big": strings.Repeat("x", 50)} {
+		w, err := c.Put(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, content)
+		w.Close()
+		if !slow.Contains(key) {
+			t.Errorf("%s not in slow tier", key)
+		}
+	}
+	if !fast.Contains("small") || fast.Contains("big") {
+		t.Errorf("Only small should be in the fast tier")
+	}
+	if c.Size() != 54 {
+		t.Errorf("Size() == %d, expected 54", c.Size())
+	}
+
+	// demote the small entry, and read it again to promote it
+	fast.Delete("small")
+	checkTieredGet(t, c, "small", "tiny")
+	if !fast.Contains("small") {
+		t.Errorf("small was not promoted")
+	}
+	checkTieredGet(t, c, "small", "tiny")
+	checkTieredGet(t, c, "big", strings.Repeat("x", 50))
+	if fast.Contains("big") {
+		t.Errorf("big was promoted")
+	}
+
+	c.Delete("small")
+	if c.Contains("small") || fast.Contains("small") || slow.Contains("small") {
+		t.Errorf("small was not deleted from both tiers")
+	}
+	r, _, err := c.Get("small")
+	if r != nil || err != nil {
+		t.Errorf("Get() == %v, %v, expected a miss", r, err)
+	}
+}
+
+func checkTieredGet(t *testing.T, c *Tiered, key, expected string) {
+	r, n, err := c.Get(key)
+	if err != nil || r == nil {
+		t.Fatalf("Get(%q) == %v, %v", key, r, err)
+	}
+	defer r.Close()
+	buf, _ := io.ReadAll(io.NewSectionReader(r, 0, n))
+	if string(buf) != expected {
+		t.Errorf("Get(%q) == %q, expected %q", key, buf, expected)
+	}
+}
@@ -10,6 +10,7 @@ import (
 
 	raven "github.com/getsentry/raven-go"
 
+	"github.com/ndlib/bendo/cache"
 	"github.com/ndlib/bendo/store"
 )
 
@@ -332,10 +333,27 @@ func (te *TimeBased) readIndexFile() {
 }
 
 // scan the files currently in the cache and add them if they are not already
-// in our index. The added items are given the default expiry time.
+// in our index. The added items are given the default expiry time. Items in
+// the index whose files are gone are removed.
 func (te *TimeBased) scanstore() {
+	// only items indexed before the store is listed can be missing from
+	// the listing, so remember which those are.
+	indexed := make(map[string]bool)
+	te.m.RLock()
+	for key := range te.items {
+		indexed[key] = true
+	}
+	te.m.RUnlock()
 	for key := range te.s.List() {
-		if key == indexFilename || te.Contains(key) {
+		if indexed[key] {
+			delete(indexed, key)
+			continue
+		}
+		// skip entries being written, which are added when finished
+		te.m.RLock()
+		_, pending := te.pending[key]
+		te.m.RUnlock()
+		if pending || key == indexFilename || te.Contains(key) {
 			continue
 		}
 		rac, size, err := te.s.Open(key)
@@ -345,6 +363,41 @@ func (te *TimeBased) scanstore() {
 		rac.Close()
 		te.addEntry(timeEntry{Key: key, Size: size})
 	}
+	// what is left in indexed is gone from the store. The expireList is
+	// left alone, since expireKeys skips keys no longer in the index.
+	te.m.Lock()
+	defer te.m.Unlock()
+	for key := range indexed {
+		if item, ok := te.items[key]; ok {
+			te.size -= item.Size
+			delete(te.items, key)
+		}
+	}
+}
+
+// Entries returns the entries in the cache, with those being written first
+// and then from the latest to expire to the soonest.
+func (te *TimeBased) Entries() []cache.Entry {
+	te.m.RLock()
+	defer te.m.RUnlock()
+	var result []cache.Entry
+	for key := range te.pending {
+		result = append(result, cache.Entry{Key: key, Pinned: true})
+	}
+	for _, item := range te.items {
+		result = append(result, cache.Entry{Key: item.Key, Size: item.Size, Expires: item.Expires})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Pinned != b.Pinned {
+			return a.Pinned
+		}
+		if !a.Expires.Equal(b.Expires) {
+			return a.Expires.After(b.Expires)
+		}
+		return a.Key < b.Key
+	})
+	return result
 }
 
 // Scan will scan the backing store for items and also try to load previous
@@ -26,6 +26,32 @@ func TestEvictionTB(t *testing.T) {
 	}
 }
 
+func TestRescanTB(t *testing.T) {
+	mem := store.NewMemory()
+	c := NewTime(mem, time.Hour)
+	defer c.Stop()
+	for _, key := range []string{"a", "b"} {
+		w, _ := c.Put(key)
+		w.Write([]byte("12345"))
+		w.Close()
+	}
+
+	// change the store behind the cache's back
+	mem.Delete("a")
+	w, _ := mem.Create("c")
+	w.Write([]byte("1234567"))
+	w.Close()
+
+	c.Scan()
+	entries := c.Entries()
+	if len(entries) != 2 || entries[0].Key != "c" || entries[1].Key != "b" || entries[0].Expires.IsZero() {
+		t.Errorf("Received entries %v", entries)
+	}
+	if c.Size() != 12 {
+		t.Errorf("Received size %d, expected 12", c.Size())
+	}
+}
+
 func TestExpireListTB(t *testing.T) {
 	cache := NewTime(store.NewMemory(), time.Second)
 	defer cache.Stop()
@@ -0,0 +1,76 @@
+// Package cache defines the contract between the bendo server and the layer
+// used to cache blob content recalled from the item store.
+//
+// The server only needs a place to keep copies of smallish blobs so repeated
+// requests do not go back to tape. Any type satisfying Cache can be assigned
+// to the server's Cache field. The package blobcache contains the
+// implementations that ship with bendo: in-memory or disk-backed LRU and
+// time-based caches, an adapter for Redis, and a cache stacking a small fast
+// tier in front of a larger one.
+package cache
+
+import (
+	"io"
+	"time"
+
+	"github.com/ndlib/bendo/store"
+)
+
+// Cache is the interface a blob cache must satisfy. Keys are opaque strings
+// chosen by the server. Implementations must be safe to use from more than
+// one goroutine.
+type Cache interface {
+	// Contains returns true if the given key is in the cache. It is only
+	// a hint, since the entry may be evicted before it is read.
+	Contains(key string) bool
+
+	// Get returns the content for a key and its length. A miss is not an
+	// error: Get returns a nil ReadAtCloser and a nil error. The caller
+	// must close the returned ReadAtCloser.
+	Get(key string) (store.ReadAtCloser, int64, error)
+
+	// Put returns a writer which adds content to the cache under the
+	// given key. The entry should not be visible to Get until the writer
+	// is closed without error. If a write fails the entry should be
+	// discarded when the writer is closed.
+	Put(key string) (io.WriteCloser, error)
+
+	// Delete removes an entry from the cache. It is not an error to
+	// delete a key which is not present.
+	Delete(key string) error
+
+	// Size returns the number of bytes currently in the cache.
+	Size() int64
+
+	// MaxSize returns the largest number of bytes the cache will hold, or
+	// 0 if there is no limit. The server will only try to cache blobs
+	// smaller than one eighth of this size.
+	MaxSize() int64
+}
+
+// A Scanner is a Cache which needs to index its existing contents when the
+// server starts. The server calls Scan in a background goroutine. Scan may
+// be called again later to bring the index up to date after the cached
+// content was changed by hand. Entries added since the last scan are
+// indexed, and entries whose content has gone are dropped.
+type Scanner interface {
+	Scan()
+}
+
+// A Lister is a Cache which can list the entries in its index.
+type Lister interface {
+	// Entries returns every entry in the cache, including those still
+	// being written, in the order the cache would keep them longest.
+	Entries() []Entry
+}
+
+// An Entry describes one key in a cache.
+type Entry struct {
+	Key     string
+	Size    int64     // zero for a pinned entry, whose size is not known yet
+	Expires time.Time // zero unless the cache expires entries by time
+
+	// Pinned entries are being written by a Put. They are not counted in
+	// the cache's Size and cannot be evicted until the write finishes.
+	Pinned bool
+}
@@ -0,0 +1,318 @@
+"""A thin client for the bendo REST API.
+
+This module only uses the Python standard library. It speaks the version 2
+API (see architecture/api.md in the bendo repository), and takes care of the
+parts which are easy to get wrong: uploading large files in chunks with a
+checksum for each chunk, building transaction command lists, and waiting for
+a transaction to finish.
+
+    client = bendo.Client("https://bendo.example.edu", token="...")
+    fileid = client.upload_file("scan-001.tif")
+    tx = client.start_transaction("abc123", [
+        bendo.add(fileid),
+        bendo.slot("scans/001.tif", fileid),
+        bendo.note("first scan"),
+    ])
+    info = client.wait_transaction(tx)
+"""
+
+import hashlib
+import http.client
+import io
+import json
+import os
+import time
+import urllib.parse
+
+__all__ = [
+    "Client",
+    "BendoError",
+    "TransactionError",
+    "add",
+    "slot",
+    "note",
+    "delete",
+    "mimetype",
+    "slotmeta",
+    "callback",
+    "DEFAULT_CHUNK_SIZE",
+]
+
+# The size of each request used to upload a file. Chunks larger than this
+# risk timing out behind proxies.
+DEFAULT_CHUNK_SIZE = 100 * 1024 * 1024
+
+API_PREFIX = "/api/v2"
+
+
+class BendoError(Exception):
+    """An unexpected response from the server.
+
+    status is the HTTP status code and body is the text of the response.
+    """
+
+    def __init__(self, method, path, status, body):
+        self.method = method
+        self.path = path
+        self.status = status
+        self.body = body
+        super().__init__("%s %s: %d %s" % (method, path, status, body.strip()))
+
+
+class TransactionError(Exception):
+    """A transaction which finished with an error.
+
+    info is the transaction record returned by the server, and errors is the
+    list of error messages in it.
+    """
+
+    def __init__(self, info):
+        self.info = info
+        self.errors = info.get("errors") or []
+        super().__init__(
+            "transaction %s failed: %s" % (info.get("id"), "; ".join(self.errors))
+        )
+
+
+# Helpers to build the commands in a transaction.
+
+
+def add(fileid):
+    """Add the uploaded file as a new blob."""
+    return ["add", fileid]
+
+
+def slot(name, blob):
+    """Point the slot at a blob id or at a file added in this transaction."""
+    return ["slot", name, str(blob)]
+
+
+def note(text):
+    """Set the note for the new version."""
+    return ["note", text]
+
+
+def delete(blobid):
+    """Delete a blob. This needs the Admin role."""
+    return ["delete", str(blobid)]
+
+
+def mimetype(blob, mime):
+    """Set the mime type of a blob."""
+    return ["mimetype", str(blob), mime]
+
+
+def slotmeta(name, key, value):
+    """Set a piece of metadata on a slot. An empty value removes the key."""
+    return ["slotmeta", name, key, value]
+
+
+def callback(url):
+    """Ask the server to POST to url once the transaction finishes."""
+    return ["callback", url]
+
+
+class Client:
+    """A connection to a bendo server.
+
+    url is the base URL of the server, and token is the API key to send with
+    each request, if any.
+    """
+
+    def __init__(self, url, token=None, chunk_size=DEFAULT_CHUNK_SIZE, timeout=60):
+        u = urllib.parse.urlsplit(url)
+        self.scheme = u.scheme
+        self.netloc = u.netloc
+        self.base = u.path.rstrip("/")
+        self.token = token
+        self.chunk_size = chunk_size
+        self.timeout = timeout
+
+    def _request(self, method, path, body=None, headers=None, expect=(200,)):
+        """Send a request and return its status, headers, and body.
+
+        A status not in expect raises BendoError. http.client is used rather
+        than urllib since urllib gives every POST a Content-Type, which the
+        server would take as the mime type of an uploaded file.
+        """
+        if self.scheme == "https":
+            conn = http.client.HTTPSConnection(self.netloc, timeout=self.timeout)
+        else:
+            conn = http.client.HTTPConnection(self.netloc, timeout=self.timeout)
+        h = dict(headers or {})
+        if self.token:
+            h["X-Api-Key"] = self.token
+        if body is None and method in ("POST", "PUT"):
+            body = b""
+        try:
+            conn.request(method, self.base + path, body=body, headers=h)
+            resp = conn.getresponse()
+            data = resp.read()
+        finally:
+            conn.close()
+        if resp.status not in expect:
+            raise BendoError(method, path, resp.status, data.decode("utf-8", "replace"))
+        return resp.status, resp.headers, data
+
+    def _json(self, method, path, body=None, expect=(200,)):
+        headers = {}
+        if body is not None:
+            body = json.dumps(body).encode("utf-8")
+            headers["Content-Type"] = "application/json"
+        _, _, data = self._request(method, path, body, headers, expect)
+        return json.loads(data.decode("utf-8"))
+
+    # Items
+
+    def item(self, itemid):
+        """Return the metadata record of an item."""
+        return self._json("GET", API_PREFIX + "/item/" + _quote(itemid))
+
+    def exists(self, itemid):
+        """Return True if the item exists."""
+        status, _, _ = self._request(
+            "GET", API_PREFIX + "/item/" + _quote(itemid), expect=(200, 404)
+        )
+        return status == 200
+
+    def get(self, itemid, slot_or_blob, version=None):
+        """Return the content of a slot, as bytes.
+
+        slot_or_blob is a slot path, or "@blob/<n>" to read blob n directly.
+        version is the version to look the slot up in, the latest if None.
+        """
+        path = "/item/%s/%s" % (_quote(itemid), _quote(slot_or_blob))
+        if version is not None:
+            path = "/item/%s/@%d/%s" % (_quote(itemid), version, _quote(slot_or_blob))
+        _, _, data = self._request("GET", API_PREFIX + path)
+        return data
+
+    def mint(self):
+        """Mint a new item identifier. The item is not reserved."""
+        _, _, data = self._request("POST", API_PREFIX + "/items", expect=(200, 201))
+        return data.decode("utf-8").strip()
+
+    # Uploads
+
+    def upload(self, f, fileid=None, mime=None, append=False):
+        """Upload the file-like object f in chunks, returning its file id.
+
+        Each chunk is sent with its MD5 and SHA-256 so the server can check
+        it, and the checksums of the whole file are sent with the last one.
+        If fileid is None the server chooses one. The server appends to a
+        file id which already exists, so an interrupted upload may be
+        continued by seeking f to the size reported by upload_info and
+        passing its id with append set. The whole file checksums are not
+        sent then, since only part of the file is read.
+        """
+        md5 = hashlib.md5()
+        sha256 = hashlib.sha256()
+        chunk = f.read(self.chunk_size)
+        while True:
+            following = f.read(self.chunk_size) if chunk else b""
+            md5.update(chunk)
+            sha256.update(chunk)
+            headers = {
+                "X-Upload-Md5": hashlib.md5(chunk).hexdigest(),
+                "X-Upload-Sha256": hashlib.sha256(chunk).hexdigest(),
+            }
+            if not following and not append:
+                # last chunk, so send the hashes for the whole file
+                headers["X-Content-MD5"] = md5.hexdigest()
+                headers["X-Content-SHA256"] = sha256.hexdigest()
+            if not following and mime:
+                headers["Content-Type"] = mime
+            path = API_PREFIX + "/upload"
+            if fileid is not None:
+                path += "/" + _quote(fileid)
+            _, respheaders, _ = self._request("POST", path, chunk, headers)
+            if fileid is None:
+                fileid = respheaders["Location"].rstrip("/").split("/")[-1]
+            if not following:
+                return fileid
+            chunk = following
+
+    def upload_file(self, filename, fileid=None, mime=None):
+        """Upload the named file, returning its file id."""
+        with open(filename, "rb") as f:
+            return self.upload(f, fileid=fileid, mime=mime)
+
+    def upload_bytes(self, data, fileid=None, mime=None, append=False):
+        """Upload a bytes object, returning its file id."""
+        return self.upload(io.BytesIO(data), fileid=fileid, mime=mime, append=append)
+
+    def upload_info(self, fileid):
+        """Return the metadata of an uploaded file."""
+        return self._json("GET", API_PREFIX + "/upload/%s/metadata" % _quote(fileid))
+
+    def delete_upload(self, fileid):
+        """Remove an uploaded file which was not used in a transaction."""
+        self._request("DELETE", API_PREFIX + "/upload/" + _quote(fileid))
+
+    # Transactions
+
+    def start_transaction(self, itemid, commands):
+        """Start a transaction on an item, returning the transaction id.
+
+        commands is a list of commands, such as those made by add and slot.
+        """
+        body = json.dumps(commands).encode("utf-8")
+        _, headers, _ = self._request(
+            "POST",
+            API_PREFIX + "/item/%s/transaction" % _quote(itemid),
+            body,
+            {"Content-Type": "application/json"},
+            expect=(202,),
+        )
+        return headers["Location"].rstrip("/").split("/")[-1]
+
+    def transaction(self, txid):
+        """Return the status record of a transaction."""
+        return self._json("GET", API_PREFIX + "/transaction/" + _quote(txid))
+
+    def wait_transaction(self, txid, poll=1.0, timeout=None):
+        """Wait for a transaction to finish and return its status record.
+
+        A transaction which ends with an error raises TransactionError.
+        If timeout seconds pass first, TimeoutError is raised.
+        """
+        deadline = None if timeout is None else time.monotonic() + timeout
+        while True:
+            info = self.transaction(txid)
+            if info["status"] == "finished":
+                return info
+            if info["status"] == "error":
+                raise TransactionError(info)
+            if deadline is not None and time.monotonic() > deadline:
+                raise TimeoutError("transaction %s still %s" % (txid, info["status"]))
+            time.sleep(poll)
+
+    def add_files(self, itemid, files, note_text=None, poll=1.0, timeout=None):
+        """Upload files and add them to an item in one transaction.
+
+        files maps each slot name to a local file name. The finished
+        transaction record is returned.
+        """
+        commands = []
+        for name, filename in files.items():
+            fileid = self.upload_file(filename)
+            commands.append(add(fileid))
+            commands.append(slot(name, fileid))
+        if note_text:
+            commands.append(note(note_text))
+        txid = self.start_transaction(itemid, commands)
+        return self.wait_transaction(txid, poll=poll, timeout=timeout)
+
+
+def _quote(s):
+    return urllib.parse.quote(str(s), safe="/@")
+
+
+if __name__ == "__main__":
+    import sys
+
+    if len(sys.argv) < 4:
+        sys.exit("usage: bendo.py <server url> <item> <slot>=<file>...")
+    c = Client(sys.argv[1], token=os.environ.get("BENDO_TOKEN"))
+    files = dict(arg.split("=", 1) for arg in sys.argv[3:])
+    print(json.dumps(c.add_files(sys.argv[2], files), indent=2))
@@ -0,0 +1,112 @@
+"""Contract tests for the Python client.
+
+These run against a live bendo server given by the BENDO_URL environment
+variable, with the API key in BENDO_TOKEN if the server needs one. The Go
+test TestPythonClient in the server package starts a test server and runs
+them against it. They are skipped if BENDO_URL is not set.
+"""
+
+import hashlib
+import os
+import unittest
+
+import bendo
+
+URL = os.environ.get("BENDO_URL")
+
+
+@unittest.skipUnless(URL, "BENDO_URL is not set")
+class ClientTest(unittest.TestCase):
+    def setUp(self):
+        # a tiny chunk size so every upload is sent in several requests
+        self.client = bendo.Client(URL, token=os.environ.get("BENDO_TOKEN"), chunk_size=7)
+
+    def test_chunked_upload(self):
+        data = b"a file uploaded in many small chunks"
+        fileid = self.client.upload_bytes(data, mime="text/plain")
+        info = self.client.upload_info(fileid)
+        self.assertEqual(info["id"], fileid)
+        self.assertEqual(info["size"], len(data))
+        self.assertEqual(info["fragments"], (len(data) + 6) // 7)
+        self.assertEqual(info["md5"], hashlib.md5(data).hexdigest())
+        self.assertEqual(info["sha256"], hashlib.sha256(data).hexdigest())
+        self.assertEqual(info["mime-type"], "text/plain")
+        self.client.delete_upload(fileid)
+
+    def test_chunked_upload_named(self):
+        data = b"0123456789" * 5
+        fileid = self.client.upload_bytes(data, fileid="py-named-upload")
+        self.assertEqual(fileid, "py-named-upload")
+        self.assertEqual(self.client.upload_info(fileid)["size"], len(data))
+        self.client.delete_upload(fileid)
+
+    def test_resume_upload(self):
+        data = b"the first part, then the second part"
+        fileid = self.client.upload_bytes(data[:15])
+        size = self.client.upload_info(fileid)["size"]
+        self.client.upload_bytes(data[size:], fileid=fileid, append=True)
+        self.assertEqual(self.client.upload_info(fileid)["size"], len(data))
+        self.client.delete_upload(fileid)
+
+    def test_empty_upload(self):
+        fileid = self.client.upload_bytes(b"")
+        info = self.client.upload_info(fileid)
+        self.assertEqual(info["size"], 0)
+        self.assertEqual(info["sha256"], hashlib.sha256(b"").hexdigest())
+        self.client.delete_upload(fileid)
+
+    def test_checksum_mismatch(self):
+        with self.assertRaises(bendo.BendoError) as cm:
+            self.client._request(
+                "POST",
+                bendo.API_PREFIX + "/upload",
+                b"hello",
+                {"X-Upload-Md5": hashlib.md5(b"goodbye").hexdigest()},
+            )
+        self.assertEqual(cm.exception.status, 412)
+
+    def test_transaction(self):
+        itemid = self.client.mint()
+        self.assertFalse(self.client.exists(itemid))
+        first = b"first version of a file"
+        fileid = self.client.upload_bytes(first)
+        txid = self.client.start_transaction(
+            itemid,
+            [bendo.add(fileid), bendo.slot("dir/file.txt", fileid), bendo.note("python")],
+        )
+        info = self.client.wait_transaction(txid, poll=0.05, timeout=30)
+        self.assertEqual(info["item"], itemid)
+        self.assertEqual(info["version"], 1)
+        self.assertTrue(self.client.exists(itemid))
+        self.assertEqual(self.client.get(itemid, "dir/file.txt"), first)
+
+        second = b"second version of the file"
+        fileid = self.client.upload_bytes(second)
+        txid = self.client.start_transaction(
+            itemid, [bendo.add(fileid), bendo.slot("dir/file.txt", fileid)]
+        )
+        self.client.wait_transaction(txid, poll=0.05, timeout=30)
+        self.assertEqual(self.client.get(itemid, "dir/file.txt"), second)
+        self.assertEqual(self.client.get(itemid, "dir/file.txt", version=1), first)
+        self.assertEqual(self.client.get(itemid, "@blob/1"), first)
+
+        item = self.client.item(itemid)
+        self.assertEqual(len(item["versions"]), 2)
+        self.assertEqual(item["versions"][0]["note"], "python")
+        self.assertEqual(item["blobs"][1]["sha256"], hashlib.sha256(second).hexdigest())
+
+    def test_transaction_error(self):
+        itemid = self.client.mint()
+        txid = self.client.start_transaction(itemid, [bendo.add("no-such-upload")])
+        with self.assertRaises(bendo.TransactionError) as cm:
+            self.client.wait_transaction(txid, poll=0.05, timeout=30)
+        self.assertTrue(cm.exception.errors)
+
+    def test_missing_item(self):
+        with self.assertRaises(bendo.BendoError) as cm:
+            self.client.item("py-no-such-item")
+        self.assertEqual(cm.exception.status, 404)
+
+
+if __name__ == "__main__":
+    unittest.main()
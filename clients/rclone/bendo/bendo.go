@@ -0,0 +1,557 @@
+// Package bendo provides an rclone backend for a Bendo server.
+//
+// The top of the remote lists the items in the server, and each item is a
+// directory holding the files of its newest version. Slot names are taken as
+// paths separated by "/". Files are read by blob number, so a read always
+// returns the content that was listed, even if the item has changed since.
+// Writing a file PUTs it to its slot, which saves a new version of the item;
+// removing a file saves a version without it. Nothing is ever deleted from
+// the item's history, and items themselves cannot be removed.
+//
+// Files are written with a single request, which the server only accepts up
+// to its small transaction size. Larger files should be added with bclient.
+//
+// This package is meant to be placed in rclone's backend directory and
+// imported from backend/all.
+package bendo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/config/configmap"
+	"github.com/rclone/rclone/fs/config/configstruct"
+	"github.com/rclone/rclone/fs/fshttp"
+	"github.com/rclone/rclone/fs/hash"
+	"github.com/rclone/rclone/lib/rest"
+)
+
+const (
+	apiPrefix    = "/api/v2"
+	itemPageSize = 1000
+	pollInterval = time.Second
+)
+
+func init() {
+	fs.Register(&fs.RegInfo{
+		Name:        "bendo",
+		Description: "Bendo preservation store",
+		NewFs:       NewFs,
+		Options: []fs.Option{{
+			Name:     "url",
+			Help:     "URL of the Bendo server, e.g. https://bendo.example.edu",
+			Required: true,
+		}, {
+			Name:      "token",
+			Help:      "API key. Reading public content needs none, writing needs the Writer role.",
+			Sensitive: true,
+		}},
+	})
+}
+
+// Options defines the configuration for this backend.
+type Options struct {
+	URL   string `config:"url"`
+	Token string `config:"token"`
+}
+
+// Fs is a Bendo server, or an item or directory inside one.
+type Fs struct {
+	name     string
+	root     string // "", an item id, or an item id followed by a path
+	opt      Options
+	features *fs.Features
+	srv      *rest.Client
+}
+
+// Object is a file in an item.
+type Object struct {
+	fs       *Fs
+	remote   string
+	blob     int
+	size     int64
+	md5      string
+	sha256   string
+	mimeType string
+	modTime  time.Time
+}
+
+// listing is the response to GET /item/:id/@list/path.
+type listing struct {
+	Item    string  `json:"item"`
+	Version int     `json:"version"`
+	Path    string  `json:"path"`
+	Entries []entry `json:"entries"`
+}
+
+// entry is a file or directory in a listing.
+type entry struct {
+	Name     string    `json:"name"`
+	Dir      bool      `json:"dir"`
+	Blob     int       `json:"blob"`
+	Size     int64     `json:"size"`
+	MD5      string    `json:"md5"`
+	SHA256   string    `json:"sha256"`
+	MimeType string    `json:"mime-type"`
+	Modified time.Time `json:"modified"`
+}
+
+// itemInfo is an entry in the response to GET /items.
+type itemInfo struct {
+	ID       string
+	Modified time.Time
+}
+
+// transaction is the response to GET /transaction/:id.
+type transaction struct {
+	ID     string   `json:"id"`
+	Status string   `json:"status"`
+	Errors []string `json:"errors"`
+}
+
+// apiError is an error response from the server.
+type apiError struct {
+	Status  int
+	Message string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("bendo: %d %s", e.Status, e.Message)
+}
+
+// errorHandler turns an error response into an apiError.
+func errorHandler(resp *http.Response) error {
+	body, _ := rest.ReadBody(resp)
+	return &apiError{Status: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+}
+
+// isStatus returns true if err is an error response with the given status.
+func isStatus(err error, status int) bool {
+	var e *apiError
+	return errors.As(err, &e) && e.Status == status
+}
+
+// NewFs makes an Fs from the path, which is an item id optionally followed
+// by a path inside the item.
+func NewFs(ctx context.Context, name, root string, m configmap.Mapper) (fs.Fs, error) {
+	opt := new(Options)
+	err := configstruct.Set(m, opt)
+	if err != nil {
+		return nil, err
+	}
+	if opt.URL == "" {
+		return nil, errors.New("bendo: url is required")
+	}
+	root = strings.Trim(root, "/")
+	srv := rest.NewClient(fshttp.NewClient(ctx)).
+		SetRoot(strings.TrimSuffix(opt.URL, "/") + apiPrefix).
+		SetErrorHandler(errorHandler)
+	if opt.Token != "" {
+		srv.SetHeader("X-Api-Key", opt.Token)
+	}
+	f := &Fs{
+		name: name,
+		root: root,
+		opt:  *opt,
+		srv:  srv,
+	}
+	f.features = (&fs.Features{
+		ReadMimeType:  true,
+		WriteMimeType: true,
+	}).Fill(ctx, f)
+
+	// the root may name a file, if it is inside an item
+	if strings.Contains(root, "/") {
+		dir, leaf := path.Split(root)
+		parent := *f
+		parent.root = strings.TrimSuffix(dir, "/")
+		_, err := parent.NewObject(ctx, leaf)
+		if err == nil {
+			return &parent, fs.ErrorIsFile
+		}
+	}
+	return f, nil
+}
+
+// Name of the remote (as passed into NewFs)
+func (f *Fs) Name() string {
+	return f.name
+}
+
+// Root of the remote (as passed into NewFs)
+func (f *Fs) Root() string {
+	return f.root
+}
+
+// String converts this Fs to a string
+func (f *Fs) String() string {
+	return fmt.Sprintf("bendo %s/%s", f.opt.URL, f.root)
+}
+
+// Features returns the optional features of this Fs
+func (f *Fs) Features() *fs.Features {
+	return f.features
+}
+
+// Precision of the modification times. They are kept as slot metadata in
+// RFC 3339 format, which keeps nanoseconds.
+func (f *Fs) Precision() time.Duration {
+	return time.Nanosecond
+}
+
+// Hashes returns the hashes the server keeps for every file.
+func (f *Fs) Hashes() hash.Set {
+	return hash.NewHashSet(hash.MD5, hash.SHA256)
+}
+
+// split returns the item id and the path inside the item of the given remote.
+func (f *Fs) split(remote string) (item, slot string) {
+	item, slot, _ = strings.Cut(path.Join(f.root, remote), "/")
+	return item, slot
+}
+
+// slotPath returns the URL path of the given slot of an item, relative to
+// the API root.
+func slotPath(item, slot string) string {
+	return "/item/" + url.PathEscape(item) + "/" + rest.URLPathEscape(slot)
+}
+
+// List the objects and directories in dir into entries.
+func (f *Fs) List(ctx context.Context, dir string) (fs.DirEntries, error) {
+	item, sub := f.split(dir)
+	if item == "" {
+		return f.listItems(ctx)
+	}
+	l, err := f.listDir(ctx, item, sub)
+	if err != nil {
+		return nil, err
+	}
+	var entries fs.DirEntries
+	for _, e := range l.Entries {
+		remote := path.Join(dir, e.Name)
+		if e.Dir {
+			entries = append(entries, fs.NewDir(remote, e.Modified))
+			continue
+		}
+		entries = append(entries, f.newObject(remote, e))
+	}
+	return entries, nil
+}
+
+// listItems returns every item in the server as a directory, in order by
+// id.
+func (f *Fs) listItems(ctx context.Context) (fs.DirEntries, error) {
+	var entries fs.DirEntries
+	for n := 0; ; n += itemPageSize {
+		opts := rest.Opts{
+			Method: "GET",
+			Path:   "/items",
+			Parameters: url.Values{
+				"s": {"name"},
+				"p": {strconv.Itoa(itemPageSize)},
+				"n": {strconv.Itoa(n)},
+			},
+		}
+		var page []itemInfo
+		_, err := f.srv.CallJSON(ctx, &opts, nil, &page)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page {
+			entries = append(entries, fs.NewDir(item.ID, item.Modified))
+		}
+		if len(page) < itemPageSize {
+			return entries, nil
+		}
+	}
+}
+
+// listDir returns the listing of the directory dir in the newest version of
+// the given item.
+func (f *Fs) listDir(ctx context.Context, item, dir string) (*listing, error) {
+	opts := rest.Opts{
+		Method: "GET",
+		Path:   slotPath(item, path.Join("@list", dir)),
+	}
+	var l listing
+	_, err := f.srv.CallJSON(ctx, &opts, nil, &l)
+	if isStatus(err, http.StatusNotFound) || isStatus(err, http.StatusGone) {
+		return nil, fs.ErrorDirNotFound
+	}
+	return &l, err
+}
+
+func (f *Fs) newObject(remote string, e entry) *Object {
+	return &Object{
+		fs:       f,
+		remote:   remote,
+		blob:     e.Blob,
+		size:     e.Size,
+		md5:      e.MD5,
+		sha256:   e.SHA256,
+		mimeType: e.MimeType,
+		modTime:  e.Modified,
+	}
+}
+
+// NewObject finds the Object at remote. If it can't be found it returns the
+// error fs.ErrorObjectNotFound.
+func (f *Fs) NewObject(ctx context.Context, remote string) (fs.Object, error) {
+	item, slot := f.split(remote)
+	if slot == "" {
+		if item == "" {
+			return nil, fs.ErrorObjectNotFound
+		}
+		return nil, fs.ErrorIsDir
+	}
+	dir, leaf := path.Split(slot)
+	l, err := f.listDir(ctx, item, dir)
+	if err == fs.ErrorDirNotFound {
+		return nil, fs.ErrorObjectNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	for _, e := range l.Entries {
+		if e.Name != leaf {
+			continue
+		}
+		if e.Dir {
+			return nil, fs.ErrorIsDir
+		}
+		return f.newObject(remote, e), nil
+	}
+	return nil, fs.ErrorObjectNotFound
+}
+
+// Put the object into the remote, making a new version of its item.
+func (f *Fs) Put(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) (fs.Object, error) {
+	o := &Object{fs: f, remote: src.Remote()}
+	return o, o.Update(ctx, in, src, options...)
+}
+
+// Mkdir does nothing. Directories exist when there are files in them, and
+// an item exists once a file is put in it.
+func (f *Fs) Mkdir(ctx context.Context, dir string) error {
+	return nil
+}
+
+// Rmdir checks the directory is empty. Since directories only exist when
+// there are files in them, there is nothing else to do.
+func (f *Fs) Rmdir(ctx context.Context, dir string) error {
+	entries, err := f.List(ctx, dir)
+	if err == fs.ErrorDirNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fs.ErrorDirectoryNotEmpty
+	}
+	return nil
+}
+
+// runTransaction starts a transaction on the item with the given commands
+// and waits for it to finish.
+func (f *Fs) runTransaction(ctx context.Context, item string, commands [][]string) error {
+	opts := rest.Opts{
+		Method:     "POST",
+		Path:       "/item/" + url.PathEscape(item) + "/transaction",
+		NoResponse: true,
+	}
+	resp, err := f.srv.CallJSON(ctx, &opts, commands, nil)
+	if err != nil {
+		return err
+	}
+	return f.waitTransaction(ctx, resp.Header.Get("Location"))
+}
+
+// waitTransaction polls the transaction at the given location, a path on
+// the server, until it finishes. It returns an error if the transaction
+// failed.
+func (f *Fs) waitTransaction(ctx context.Context, location string) error {
+	opts := rest.Opts{
+		Method:  "GET",
+		RootURL: strings.TrimSuffix(f.opt.URL, "/") + location,
+	}
+	for {
+		var tx transaction
+		_, err := f.srv.CallJSON(ctx, &opts, nil, &tx)
+		if err != nil {
+			return err
+		}
+		switch tx.Status {
+		case "finished":
+			return nil
+		case "error":
+			return fmt.Errorf("bendo: transaction %s failed: %s", tx.ID, strings.Join(tx.Errors, "; "))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// Fs returns the parent Fs
+func (o *Object) Fs() fs.Info {
+	return o.fs
+}
+
+// String returns a description of the Object
+func (o *Object) String() string {
+	if o == nil {
+		return "<nil>"
+	}
+	return o.remote
+}
+
+// Remote returns the remote path
+func (o *Object) Remote() string {
+	return o.remote
+}
+
+// Hash returns the MD5 or SHA-256 of the object
+func (o *Object) Hash(ctx context.Context, t hash.Type) (string, error) {
+	switch t {
+	case hash.MD5:
+		return o.md5, nil
+	case hash.SHA256:
+		return o.sha256, nil
+	}
+	return "", hash.ErrUnsupported
+}
+
+// Size returns the size of the object in bytes
+func (o *Object) Size() int64 {
+	return o.size
+}
+
+// ModTime returns the modification time of the object
+func (o *Object) ModTime(ctx context.Context) time.Time {
+	return o.modTime
+}
+
+// MimeType returns the mime type the server has for the object
+func (o *Object) MimeType(ctx context.Context) string {
+	return o.mimeType
+}
+
+// SetModTime sets the modification time of the object, which saves a new
+// version of its item.
+func (o *Object) SetModTime(ctx context.Context, modTime time.Time) error {
+	item, slot := o.fs.split(o.remote)
+	mtime := modTime.UTC().Format(time.RFC3339Nano)
+	err := o.fs.runTransaction(ctx, item, [][]string{{"slotmeta", slot, "mtime", mtime}})
+	if err == nil {
+		o.modTime = modTime
+	}
+	return err
+}
+
+// Storable returns true, since every object can be stored
+func (o *Object) Storable() bool {
+	return true
+}
+
+// Open an object for reading. The blob the object was listed with is read,
+// so the content does not change if the item has been updated since.
+func (o *Object) Open(ctx context.Context, options ...fs.OpenOption) (io.ReadCloser, error) {
+	item, slot := o.fs.split(o.remote)
+	p := slotPath(item, slot)
+	if o.blob != 0 {
+		p = slotPath(item, fmt.Sprintf("@blob/%d", o.blob))
+	}
+	opts := rest.Opts{
+		Method:  "GET",
+		Path:    p,
+		Options: options,
+	}
+	resp, err := o.fs.srv.Call(ctx, &opts)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Update the object with the contents of the io.Reader, modTime and size.
+// The file is sent in one request, with its MD5 if the source has one so the
+// server can check it.
+func (o *Object) Update(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) error {
+	item, slot := o.fs.split(o.remote)
+	if item == "" || slot == "" {
+		return errors.New("bendo: files must be inside an item")
+	}
+	opts := rest.Opts{
+		Method:      "PUT",
+		Path:        slotPath(item, slot),
+		Body:        in,
+		ContentType: fs.MimeType(ctx, src),
+		Parameters: url.Values{
+			"mtime": {src.ModTime(ctx).UTC().Format(time.RFC3339Nano)},
+		},
+		ExtraHeaders: map[string]string{},
+		Options:      options,
+	}
+	if size := src.Size(); size >= 0 {
+		opts.ContentLength = &size
+	}
+	if sum, err := src.Hash(ctx, hash.MD5); err == nil && sum != "" {
+		opts.ExtraHeaders["X-Upload-Md5"] = sum
+	}
+	resp, err := o.fs.srv.Call(ctx, &opts)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusAccepted {
+		// the server gave up waiting for the transaction
+		err = o.fs.waitTransaction(ctx, resp.Header.Get("Location"))
+		if err != nil {
+			return err
+		}
+		return o.refresh(ctx)
+	}
+	var e entry
+	err = json.NewDecoder(resp.Body).Decode(&e)
+	if err != nil {
+		// the slot was changed again before we could see it
+		return o.refresh(ctx)
+	}
+	*o = *o.fs.newObject(o.remote, e)
+	return nil
+}
+
+// refresh reloads the object's metadata from the server.
+func (o *Object) refresh(ctx context.Context) error {
+	obj, err := o.fs.NewObject(ctx, o.remote)
+	if err != nil {
+		return err
+	}
+	*o = *obj.(*Object)
+	return nil
+}
+
+// Remove the object from the newest version of its item. It is kept in the
+// earlier versions.
+func (o *Object) Remove(ctx context.Context) error {
+	item, slot := o.fs.split(o.remote)
+	return o.fs.runTransaction(ctx, item, [][]string{{"slot", slot, "0"}})
+}
+
+// Check the interfaces are satisfied
+var (
+	_ fs.Fs        = (*Fs)(nil)
+	_ fs.Object    = (*Object)(nil)
+	_ fs.MimeTyper = (*Object)(nil)
+)
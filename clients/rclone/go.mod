@@ -0,0 +1,5 @@
+module github.com/ndlib/bendo/clients/rclone
+
+go 1.21
+
+require github.com/rclone/rclone v1.68.2
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// doBag adds the payload of a BagIt bag to the given item, in one new
+// version. The bag is either a zip file or a directory, which is first
+// zipped into a temporary file. The server checks the bag against its
+// manifests before anything is written, and if the bag is invalid every
+// problem found is printed.
+func doBag(item string, source string) int {
+	fi, err := os.Stat(source)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	name := source
+	if fi.IsDir() {
+		if _, err := os.Stat(filepath.Join(source, "bagit.txt")); err != nil {
+			fmt.Printf("Error: %s is not a bag: no bagit.txt\n", source)
+			return 1
+		}
+		fmt.Println("Zipping", source)
+		tmp, err := os.CreateTemp("", "bclient-bag-*.zip")
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		name = tmp.Name()
+		defer os.Remove(name)
+		err = zipBagDir(tmp, source)
+		err2 := tmp.Close()
+		if err == nil {
+			err = err2
+		}
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer f.Close()
+	h := md5.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	sum := h.Sum(nil)
+
+	conn := newConnection()
+	remotekey := item + "-bag-" + hex.EncodeToString(sum)
+	fmt.Println("Uploading", source)
+	err = uploadWithSession(conn, remotekey, f, size, Action{
+		What:     ANewBlob,
+		Source:   source,
+		MD5:      sum,
+		MimeType: "application/zip",
+	})
+	if err != nil {
+		fmt.Println("error:", err)
+		return 1
+	}
+
+	cmdlist, _ := json.Marshal([][]string{{"bag", remotekey}})
+	transaction, err := conn.CreateTransaction(item, cmdlist)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if *verbose {
+		fmt.Printf("\n Transaction id is %s\n", transaction)
+	}
+	if *wait {
+		err = conn.WaitTransaction(path.Base(transaction))
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	}
+	return 0
+}
+
+// zipBagDir writes the bag in the directory dir to w as a zip file, with the
+// bag at the top of the zip file. The files are stored uncompressed, since
+// most content is compressed already. Symbolic links to files are followed.
+func zipBagDir(w io.Writer, dir string) error {
+	zw := zip.NewWriter(w)
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		src, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		fw, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     filepath.ToSlash(rel),
+			Method:   zip.Store,
+			Modified: fi.ModTime(),
+		})
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(fw, src)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestZipBagDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bclientbag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"bagit.txt":        "BagIt-Version: 1.0\n",
+		"manifest-md5.txt": "5d41402abc4b2a76b9719d911017c592  data/sub/a.txt\n",
+		"data/sub/a.txt":   "hello",
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(p), 0755)
+		err = ioutil.WriteFile(p, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	err = zipBagDir(&buf, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != len(files) {
+		t.Errorf("Received %d files, expected %d", len(zr.File), len(files))
+	}
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := ioutil.ReadAll(r)
+		r.Close()
+		if string(content) != files[f.Name] {
+			t.Errorf("%s: received %q, expected %q", f.Name, content, files[f.Name])
+		}
+	}
+}
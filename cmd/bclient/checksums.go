@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ReadChecksumFile reads a checksum manifest in the format written by
+// md5sum or sha256sum, such as one supplied by a digitization vendor, and
+// returns the checksums in it keyed by absolute path. File names are taken
+// to be relative to the directory holding the manifest. The BSD style
+// "SHA256 (name) = hash" lines are also understood. The kind of checksum
+// on each line is decided by its length.
+func ReadChecksumFile(manifest string) (map[string]File, error) {
+	manifest, err := filepath.Abs(manifest)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(manifest)
+	r, err := os.Open(manifest)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	result := make(map[string]File)
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		sum, name, ok := parseChecksumLine(line)
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: cannot parse line", manifest, lineno)
+		}
+		h, err := hex.DecodeString(sum)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", manifest, lineno, err)
+		}
+		abspath := filepath.Join(dir, filepath.FromSlash(name))
+		f := result[abspath]
+		f.AbsPath = abspath
+		switch len(h) {
+		case md5.Size:
+			f.MD5 = h
+		case sha256.Size:
+			f.SHA256 = h
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown checksum length", manifest, lineno)
+		}
+		result[abspath] = f
+	}
+	return result, scanner.Err()
+}
+
+// parseChecksumLine splits a manifest line into the hex checksum and the
+// file name.
+func parseChecksumLine(line string) (sum string, name string, ok bool) {
+	// names with backslashes or newlines are escaped and the line is
+	// marked with a leading backslash
+	escaped := strings.HasPrefix(line, "\\")
+	if escaped {
+		line = line[1:]
+	}
+	if i := strings.Index(line, " ("); i > 0 && !strings.ContainsAny(line[:i], " *") {
+		// BSD style: "MD5 (name) = hash"
+		j := strings.LastIndex(line, ") = ")
+		if j < i {
+			return "", "", false
+		}
+		sum, name = line[j+4:], line[i+2:j]
+	} else {
+		// GNU style: "hash  name" or "hash *name" for binary mode
+		i := strings.IndexByte(line, ' ')
+		if i <= 0 || i+2 > len(line) {
+			return "", "", false
+		}
+		sum, name = line[:i], line[i+2:]
+	}
+	if escaped {
+		name = strings.NewReplacer(`\\`, `\`, `\n`, "\n").Replace(name)
+	}
+	return sum, name, name != ""
+}
+
+// SpotCheck recomputes the checksums of up to n randomly chosen files from
+// the manifest which are also in the file list, and returns the names of
+// those which do not match the manifest.
+func SpotCheck(local *FileList, known map[string]File, n int) ([]string, error) {
+	var candidates []string
+	for name, f := range local.Files {
+		if _, ok := known[f.AbsPath]; ok && f.AbsPath != "" {
+			candidates = append(candidates, name)
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+	var bad []string
+	for _, name := range candidates {
+		f := local.Files[name]
+		want := known[f.AbsPath]
+		var h hash.Hash
+		var expected []byte
+		if len(want.MD5) > 0 {
+			h, expected = md5.New(), want.MD5
+		} else {
+			h, expected = sha256.New(), want.SHA256
+		}
+		err := hashFile(f.AbsPath, h)
+		if err != nil {
+			return bad, err
+		}
+		if !bytes.Equal(h.Sum(nil), expected) {
+			bad = append(bad, name)
+		}
+	}
+	return bad, nil
+}
+
+// hashFile copies the contents of the file at abspath into h.
+func hashFile(abspath string, h hash.Hash) error {
+	r, err := os.Open(abspath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(h, r)
+	return err
+}
+
+// FillMissingMD5 gives an MD5 checksum to every file in the local list
+// which only has a SHA256, since uploads are tracked by their MD5. A file
+// having the same SHA256 as one on the server is given the server's MD5.
+// The others are read to compute it.
+func FillMissingMD5(local *FileList, remote *FileList) {
+	bysha := make(map[string][]byte)
+	if remote != nil {
+		for _, f := range remote.Files {
+			if len(f.SHA256) > 0 && len(f.MD5) > 0 {
+				bysha[hex.EncodeToString(f.SHA256)] = f.MD5
+			}
+		}
+	}
+
+	var tohash []string
+	for name, f := range local.Files {
+		if len(f.MD5) > 0 || len(f.SHA256) == 0 {
+			continue
+		}
+		if m, ok := bysha[hex.EncodeToString(f.SHA256)]; ok {
+			f.MD5 = m
+			local.Files[name] = f
+		} else if f.AbsPath != "" {
+			tohash = append(tohash, f.AbsPath)
+		}
+	}
+	if len(tohash) == 0 {
+		return
+	}
+
+	var wg sync.WaitGroup
+	var wgend sync.WaitGroup
+	in := make(chan string)
+	out := make(chan File)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			ChecksumLocalFiles(local.Root, nil, in, out)
+			wg.Done()
+		}()
+	}
+	wgend.Add(1)
+	go func() { local.AddFiles(out); wgend.Done() }()
+	for _, abspath := range tohash {
+		in <- abspath
+	}
+	close(in)
+	wg.Wait()
+	close(out)
+	wgend.Wait()
+}
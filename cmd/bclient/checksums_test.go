@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseChecksumLine(t *testing.T) {
+	var table = []struct {
+		line, sum, name string
+		ok              bool
+	}{
+		{"0123abcd  a/b.tif", "0123abcd", "a/b.tif", true},
+		{"0123abcd *a/b.tif", "0123abcd", "a/b.tif", true},
+		{"0123abcd  scan (1).tif", "0123abcd", "scan (1).tif", true},
+		{"SHA256 (a/b (2).tif) = 0123abcd", "0123abcd", "a/b (2).tif", true},
+		{`\0123abcd  a\\b\nc`, "0123abcd", "a\\b\nc", true},
+		{"0123abcd", "", "", false},
+		{"MD5 (a.tif", "", "", false},
+	}
+	for _, tab := range table {
+		sum, name, ok := parseChecksumLine(tab.line)
+		if ok != tab.ok || (ok && (sum != tab.sum || name != tab.name)) {
+			t.Errorf("%q: received (%q, %q, %v)", tab.line, sum, name, ok)
+		}
+	}
+}
+
+func TestChecksumManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bclient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	contents := map[string]string{"a": "hello a", "b": "hello b", "c": "hello c"}
+	for name, s := range contents {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(s), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	md5a := md5.Sum([]byte("hello a"))
+	shab := sha256.Sum256([]byte("hello b"))
+	manifest := hex.EncodeToString(md5a[:]) + "  a\n" +
+		hex.EncodeToString(shab[:]) + " *b\n"
+	err = ioutil.WriteFile(filepath.Join(dir, "manifest"), []byte(manifest), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	known, err := ReadChecksumFile(filepath.Join(dir, "manifest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(known) != 2 || len(known[filepath.Join(dir, "a")].MD5) == 0 || len(known[filepath.Join(dir, "b")].SHA256) == 0 {
+		t.Fatalf("Received %v", known)
+	}
+
+	// files in the manifest are not read
+	in := make(chan string, 3)
+	out := make(chan File, 3)
+	for name := range contents {
+		in <- filepath.Join(dir, name)
+	}
+	close(in)
+	ChecksumLocalFiles(dir, known, in, out)
+	close(out)
+	local := New(dir)
+	local.AddFiles(out)
+	if len(local.Files["b"].MD5) != 0 || len(local.Files["c"].MD5) == 0 {
+		t.Errorf("Received %v", local.Files)
+	}
+
+	bad, err := SpotCheck(local, known, 10)
+	if err != nil || len(bad) != 0 {
+		t.Errorf("Received %v, %v", bad, err)
+	}
+	// a vendor mistake is caught
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("changed"), 0644)
+	bad, err = SpotCheck(local, known, 10)
+	if err != nil || len(bad) != 1 || bad[0] != "a" {
+		t.Errorf("Received %v, %v", bad, err)
+	}
+
+	// the missing MD5 is computed
+	FillMissingMD5(local, nil)
+	md5b := md5.Sum([]byte("hello b"))
+	if hex.EncodeToString(local.Files["b"].MD5) != hex.EncodeToString(md5b[:]) {
+		t.Errorf("Received %v", local.Files["b"])
+	}
+
+	// or taken from a server file with the same SHA256
+	f := local.Files["b"]
+	f.MD5 = nil
+	local.Files["b"] = f
+	remote := New(dir)
+	remote.Files["elsewhere/b"] = File{MD5: []byte{1, 2, 3}, SHA256: shab[:]}
+	FillMissingMD5(local, remote)
+	if hex.EncodeToString(local.Files["b"].MD5) != "010203" {
+		t.Errorf("Received %v", local.Files["b"])
+	}
+}
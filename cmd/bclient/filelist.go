@@ -8,9 +8,11 @@ import (
 	"encoding/hex"
 	"fmt"
 	"os"
-	"path"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/antonholmquist/jason"
 )
@@ -43,7 +45,10 @@ type File struct {
 	MD5      []byte
 	SHA256   []byte
 	MimeType string
-	BlobID   int64 // 0 if nothing has been assigned yet
+	BlobID   int64  // 0 if nothing has been assigned yet
+	Content  []byte // (local only) content to upload instead of reading AbsPath
+	ModTime  time.Time
+	Mode     os.FileMode // permission bits, or 0 if not recorded
 }
 
 // Create an empty FileList
@@ -89,6 +94,15 @@ func (fl *FileList) AddFiles(c <-chan File) {
 		if f.BlobID != 0 {
 			info.BlobID = f.BlobID
 		}
+		if f.Content != nil {
+			info.Content = f.Content
+		}
+		if !f.ModTime.IsZero() {
+			info.ModTime = f.ModTime
+		}
+		if f.Mode != 0 {
+			info.Mode = f.Mode
+		}
 		fl.Files[f.Name] = info
 	}
 }
@@ -125,6 +139,7 @@ func (f *FileList) BuildListFromJSON(json *jason.Object) {
 	// only care about the file mappings in the newest version
 	version := versionArray[len(versionArray)-1]
 	slotMap, _ := version.GetObject("Slots")
+	slotMeta, _ := version.GetObject("SlotMeta")
 
 	for key, value := range slotMap.Map() {
 		blobID, _ := value.Int64()
@@ -134,7 +149,18 @@ func (f *FileList) BuildListFromJSON(json *jason.Object) {
 		info := f.Files[key]
 		info.BlobID = blobID
 		info.MD5 = DecodedMD5
+		shaSum, _ := blobArray[blobID-1].GetString("SHA256")
+		info.SHA256, _ = base64.StdEncoding.DecodeString(shaSum)
 		info.MimeType, _ = blobArray[blobID-1].GetString("MimeType")
+		if slotMeta != nil {
+			if v, err := slotMeta.GetString(key, "mtime"); err == nil {
+				info.ModTime, _ = time.Parse(time.RFC3339Nano, v)
+			}
+			if v, err := slotMeta.GetString(key, "mode"); err == nil {
+				mode, _ := strconv.ParseUint(v, 0, 32)
+				info.Mode = os.FileMode(mode)
+			}
+		}
 		f.Files[key] = info
 
 		f.Blobs[key] = blobID
@@ -212,10 +238,10 @@ func MakeStubFromJSON(json *jason.Object, item string, pathPrefix string) {
 	slotMap, _ := versionArray[thisVersion-1].GetObject("Slots")
 
 	for key, _ := range slotMap.Map() {
-		targetFile := path.Join(pathPrefix, key)
+		targetFile := LocalPath(pathPrefix, key)
 
 		// create target directory, return on error
-		targetDir, _ := path.Split(targetFile)
+		targetDir := filepath.Dir(targetFile)
 
 		err := os.MkdirAll(targetDir, 0755)
 
@@ -6,6 +6,8 @@ package main
 import (
 	"encoding/hex"
 	"fmt"
+	"path/filepath"
+	"strings"
 
 	"github.com/antonholmquist/jason"
 )
@@ -70,3 +72,21 @@ func (ld *ListData) BuildLocalFromFiles(files []string) {
 func (ld *ListData) QueueFiles(fileQueue chan string) {
 	ld.Local.AddToSendQueue(fileQueue)
 }
+
+// SlotName returns the slot name to use for the local file abspath, which is
+// inside the directory root. Slot names always use forward slashes, no
+// matter the local path separator.
+func SlotName(root string, abspath string) string {
+	rel, err := filepath.Rel(root, abspath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		rel = strings.TrimPrefix(abspath, root)
+	}
+	return strings.TrimPrefix(filepath.ToSlash(rel), "/")
+}
+
+// LocalPath returns the local file path to use for the given slot name,
+// placing it inside the directory prefix. The path is made absolute if that is
+// needed for the operating system to accept long paths.
+func LocalPath(prefix string, slot string) string {
+	return longPath(filepath.Join(prefix, filepath.FromSlash(slot)))
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ndlib/bendo/bclientapi"
+)
+
+// A Job records the work of a multi-file upload or get, and how much of it
+// has been done, so an interrupted job can be continued with
+// `bclient resume`.
+//
+// A job is kept in a job file. The first line is the JSON encoded Job and
+// each following line is a JSON encoded jobEvent, appended as the work
+// progresses. Appending keeps the cost of recording progress small even for
+// jobs of many thousands of files.
+type Job struct {
+	Action  string // either "upload" or "get"
+	Item    string
+	Server  string
+	Root    string // the local directory files are uploaded from or saved into
+	Started time.Time
+
+	Todo  []Action `json:",omitempty"` // (upload only) the changes to make
+	Files []File   `json:",omitempty"` // (get only) the files to download
+
+	// the progress made, rebuilt from the events when a job is loaded
+	uploaded     map[string]bool // file ids which have been uploaded
+	fetched      map[string]bool // names of files which have been downloaded
+	transactions []string        // transactions which have been started
+	split        *bclientapi.TxTooLargeError
+
+	m    sync.Mutex
+	path string
+	f    *os.File
+}
+
+// A jobEvent records a single piece of progress in a job file. Exactly one
+// field is set.
+type jobEvent struct {
+	Uploaded    string                      `json:",omitempty"`
+	Fetched     string                      `json:",omitempty"`
+	Transaction string                      `json:",omitempty"`
+	Split       *bclientapi.TxTooLargeError `json:",omitempty"`
+}
+
+// CreateJob writes a new job file for j at path, replacing any file already
+// there.
+func CreateJob(path string, j *Job) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if j.Started.IsZero() {
+		j.Started = time.Now()
+	}
+	j.path = path
+	j.f = f
+	j.reset()
+	err = json.NewEncoder(f).Encode(j)
+	if err != nil {
+		f.Close()
+	}
+	return err
+}
+
+// LoadJob reads the job file at path. Progress made by the job will
+// continue to be recorded in it.
+func LoadJob(path string) (*Job, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	j := &Job{path: path, f: f}
+	j.reset()
+	// lines may be very long, so don't use a Scanner
+	r := bufio.NewReader(f)
+	line, err := r.ReadBytes('\n')
+	if err == nil || (err == io.EOF && len(line) > 0) {
+		err = json.Unmarshal(line, j)
+	}
+	var partial bool
+	for err == nil {
+		line, err = r.ReadBytes('\n')
+		if len(line) == 0 {
+			continue
+		}
+		var e jobEvent
+		if json.Unmarshal(line, &e) != nil {
+			// a partial line left by a crash. Ignore it.
+			partial = line[len(line)-1] != '\n'
+			continue
+		}
+		j.apply(e)
+	}
+	if err == io.EOF && partial {
+		// end the partial line so new events are not appended to it
+		_, err = f.Write([]byte{'\n'})
+	}
+	if err != nil && err != io.EOF {
+		f.Close()
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return j, nil
+}
+
+func (j *Job) reset() {
+	j.uploaded = make(map[string]bool)
+	j.fetched = make(map[string]bool)
+	j.transactions = nil
+	j.split = nil
+}
+
+func (j *Job) apply(e jobEvent) {
+	switch {
+	case e.Uploaded != "":
+		j.uploaded[e.Uploaded] = true
+	case e.Fetched != "":
+		j.fetched[e.Fetched] = true
+	case e.Transaction != "":
+		j.transactions = append(j.transactions, e.Transaction)
+	case e.Split != nil:
+		j.split = e.Split
+	}
+}
+
+// record notes the given progress and appends it to the job file.
+func (j *Job) record(e jobEvent) error {
+	j.m.Lock()
+	defer j.m.Unlock()
+	j.apply(e)
+	return json.NewEncoder(j.f).Encode(e)
+}
+
+// Uploaded returns true if the file with the given upload id has been
+// uploaded.
+func (j *Job) Uploaded(fileid string) bool {
+	j.m.Lock()
+	defer j.m.Unlock()
+	return j.uploaded[fileid]
+}
+
+// Fetched returns true if the file with the given name has been downloaded.
+func (j *Job) Fetched(name string) bool {
+	j.m.Lock()
+	defer j.m.Unlock()
+	return j.fetched[name]
+}
+
+// Path returns the path to the job file.
+func (j *Job) Path() string {
+	return j.path
+}
+
+// Close closes the job file, leaving it in place so the job can be resumed.
+func (j *Job) Close() error {
+	return j.f.Close()
+}
+
+// Finish closes and removes the job file, since the job is complete.
+func (j *Job) Finish() error {
+	j.f.Close()
+	return os.Remove(j.path)
+}
+
+// jobPath returns the path of the job file to use for the given action on
+// item.
+func jobPath(action string, item string) string {
+	if *jobfile != "" {
+		return *jobfile
+	}
+	return filepath.Join(sessionDir(), "job-"+action+"-"+item+".jsonl")
+}
+
+// jobFailed closes the job file and explains how to resume the job.
+func jobFailed(j *Job) int {
+	j.Close()
+	fmt.Printf("The job has been saved. Run 'bclient resume %s' to continue it.\n", j.Path())
+	return 1
+}
+
+// doResume continues the job in the given job file. The server and root
+// directory are taken from the job; other flags are from the command line.
+func doResume(path string) int {
+	job, err := LoadJob(path)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	*server = job.Server
+	*fileroot = job.Root
+	conn := newConnection()
+	conn.Throttle = bclientapi.NewThrottle(*numuploaders)
+
+	fmt.Println("Resuming", job.Action, "of item", job.Item, "started", job.Started.Format(time.RFC3339))
+	switch job.Action {
+	case "upload":
+		return runUploadJob(conn, job)
+	case "get":
+		return runGetJob(conn, job)
+	}
+	fmt.Println("Unknown job action", job.Action)
+	job.Close()
+	return 1
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ndlib/bendo/bclientapi"
+)
+
+func TestJobFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bclient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sessions", "job.jsonl")
+
+	job := &Job{
+		Action: "upload",
+		Item:   "abc",
+		Server: "http://localhost:14000",
+		Root:   dir,
+		Todo: []Action{
+			{What: ANewBlob, Source: "a", MD5: []byte{1, 2}},
+			{What: AUpdateFile, Name: "a", MD5: []byte{1, 2}},
+		},
+	}
+	err = CreateJob(path, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.record(jobEvent{Uploaded: "abc-0102"})
+	job.record(jobEvent{Split: &bclientapi.TxTooLargeError{MaxFiles: 1}})
+	job.record(jobEvent{Transaction: "/transaction/0001"})
+	job.Close()
+
+	// simulate a crash in the middle of writing an event
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"Fetch`)
+	f.Close()
+
+	job, err = LoadJob(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Action != "upload" || job.Item != "abc" || len(job.Todo) != 2 || job.Todo[1].Name != "a" {
+		t.Errorf("Received %#v", job)
+	}
+	if !job.Uploaded("abc-0102") || job.Uploaded("abc-0304") {
+		t.Errorf("Received uploaded %v", job.uploaded)
+	}
+	if job.split == nil || job.split.MaxFiles != 1 {
+		t.Errorf("Received split %v", job.split)
+	}
+	if len(job.transactions) != 1 || job.transactions[0] != "/transaction/0001" {
+		t.Errorf("Received transactions %v", job.transactions)
+	}
+
+	// progress is recorded after the partial line
+	job.record(jobEvent{Transaction: "/transaction/0002"})
+	job.Close()
+	job, err = LoadJob(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(job.transactions) != 2 {
+		t.Errorf("Received transactions %v", job.transactions)
+	}
+
+	err = job.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Job file not removed: %v", err)
+	}
+}
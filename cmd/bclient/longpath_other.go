@@ -0,0 +1,9 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+// longPath returns p. Only Windows needs special handling for long paths.
+func longPath(p string) string {
+	return p
+}
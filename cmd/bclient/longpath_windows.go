@@ -0,0 +1,24 @@
+package main
+
+import (
+	"path/filepath"
+)
+
+// maxShortPath is the longest path Windows accepts without the extended
+// length prefix. Directories are limited to 12 fewer characters than files.
+const maxShortPath = 248
+
+// longPath returns a version of p that can be used even if it is longer than
+// the Windows MAX_PATH limit. The os package adds the \\?\ (or \\?\UNC\)
+// prefix to absolute paths that need it, so it is enough to make long paths
+// absolute.
+func longPath(p string) string {
+	if len(p) < maxShortPath || filepath.IsAbs(p) {
+		return p
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return p
+	}
+	return abs
+}
@@ -5,11 +5,15 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
-	"path"
+	"path/filepath"
 	"runtime"
 	"runtime/pprof"
+	"sort"
 	"sync"
 
 	"github.com/ndlib/bendo/bclientapi"
@@ -30,6 +34,15 @@ var (
 	stub         = flag.Bool("stub", false, "Get Item Information, construct stub number")
 	numuploaders = flag.Int("ul", 2, "Number Uploaders")
 	wait         = flag.Bool("wait", true, "Wait for Upload Transaction to complte before exiting")
+	proxy        = flag.String("proxy", "", "HTTP proxy to use (defaults to HTTP_PROXY environment variable)")
+	cafile       = flag.String("cafile", "", "PEM file of extra certificate authorities to trust")
+	recordmode   = flag.Bool("mode", false, "record file permission bits when uploading")
+	symlinks     = flag.String("symlinks", "follow", "what to do with symbolic links: follow, skip, or record")
+	emptydirs    = flag.String("emptydirs", "skip", "what to do with empty directories: skip or keep")
+	sessiondir   = flag.String("sessiondir", "", "directory to keep upload progress in (defaults to <root>/.bclient-sessions)")
+	manifest     = flag.String("manifest", "", "md5sum or sha256sum file to take checksums from instead of reading files")
+	spotcheck    = flag.Int("spotcheck", 0, "number of files to check against the -manifest checksums")
+	jobfile      = flag.String("jobfile", "", "file to record the progress of an upload or get in (defaults to one in the session directory)")
 
 	Usage = `
 Usage:
@@ -41,15 +54,25 @@ Available actions:
     bclient [<flags>] get <item> [file]               get item's files. If none are specified, get them all
     bclient [<flags>] ls <item id> [file]             show details about item's files.
     bclient [<flags>] upload  <item id> <files>       upload a file or directory into an exiting item, or create a new one.
+    bclient [<flags>] bag <item id> <bag>             add the payload of a BagIt bag, a zip file or a directory, to an item.
+                                                      The bag is checked against its manifests first, and each problem printed.
     bclient [<flags>] version <item id>               display item versioning information
+    bclient [<flags>] resume <job file>               continue an interrupted upload or get
 
     General Flags:
 
     -root (defaults to current directory)  location to get or put files
     -server   (defaults to http://localhost:14000) server_name:port of bendo server
     -numuploaders (defaults to 2) number of concurrent upload/download threads
+                  (fewer are used while the server asks clients to slow down)
     -version ( defaults to latest version: ls & get actions) desired version number
     -token   ( no default ) API Authentication Token to be passed to the Bendo server
+    -proxy   ( defaults to HTTP_PROXY environment variable) URL of HTTP proxy to use
+    -cafile  ( no default ) PEM file of extra certificate authorities to trust
+    -jobfile ( defaults to job-<action>-<item>.jsonl in the session directory) where to record
+             the progress of an upload or get. It is removed once the job finishes. If the job
+             is interrupted, run 'bclient resume <job file>' to continue it. The server and
+             root directory are taken from the job file.
 
     upload Flags:
 
@@ -58,6 +81,19 @@ Available actions:
     -numuploaders ( defaults to 2) number of upload threads
     -v            ( defaults to false) Provide verbose upload information for troubleshooting
     -wait         ( defaults to true)  Wait for Upload Transaction to complte before exiting
+    -mode         ( defaults to false) record file permission bits as well as modification times
+    -symlinks     ( defaults to follow) upload what symbolic links point to (follow), ignore them (skip),
+                  or upload the link target as a file with mime type inode/symlink (record)
+    -emptydirs    ( defaults to skip) ignore empty directories (skip), or keep them by uploading
+                  an empty .bclient-keep file into each one (keep)
+    -sessiondir   ( defaults to <root>/.bclient-sessions) where to keep the progress of uploads,
+                  so interrupted uploads can be resumed by running bclient again
+    -manifest     ( no default ) a checksum file in the format written by md5sum or sha256sum,
+                  e.g. one from a digitization vendor. Files listed in it are not read to find
+                  their checksums. Names are relative to the directory holding the manifest.
+                  Files with only a SHA256 are still read if they are not already on the server.
+    -spotcheck    ( defaults to 0) number of randomly chosen files to read and compare against
+                  the -manifest checksums before uploading. Any mismatch stops the upload.
 
     ls Flags:	  
 
@@ -108,6 +144,12 @@ func main() {
 			os.Exit(1)
 		}
 		code = doUpload(args[1], args[2])
+	case "bag":
+		if len(args) != 3 {
+			fmt.Println("Usage: bclient <flags> bag <item> <bag>")
+			os.Exit(1)
+		}
+		code = doBag(args[1], args[2])
 	case "ls":
 		if len(args) != 2 {
 			fmt.Println("Usage: bclient <flags> ls <item> ")
@@ -120,6 +162,12 @@ func main() {
 		} else {
 			code = doGet(args[1], args[2:])
 		}
+	case "resume":
+		if len(args) != 2 {
+			fmt.Println("Usage: bclient <flags> resume <job file>")
+			os.Exit(1)
+		}
+		code = doResume(args[1])
 	case "history":
 		if len(args) != 2 {
 			fmt.Println("Usage: bclient <flags> history <item> ")
@@ -150,23 +198,39 @@ func main() {
 	os.Exit(code)
 }
 
+// newConnection returns a connection to the bendo server configured from the
+// command line flags.
+func newConnection() *bclientapi.Connection {
+	conn := &bclientapi.Connection{
+		HostURL:   *server,
+		ChunkSize: *chunksize,
+		Token:     *token,
+		CAFile:    *cafile,
+	}
+	if *proxy != "" {
+		u, err := url.Parse(*proxy)
+		if err != nil {
+			log.Fatalln("bad proxy:", err)
+		}
+		conn.Proxy = http.ProxyURL(u)
+	}
+	return conn
+}
+
 //  doGet , given only an item, returns all the files in that item.
 //  Given one or more files in the item, it returns only them
 
 func doGet(item string, files []string) int {
-	filesToGet := make(chan string)
-	var getFileDone sync.WaitGroup
-
-	// if file or dir exists in target path named after the item, give error mesg and exit
-	pathPrefix := path.Join(*fileroot, item)
+	root, err := filepath.Abs(*fileroot)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
 
 	// set up communication to the bendo server, and init local and remote filelists
 
-	conn := &bclientapi.Connection{
-		HostURL:   *server,
-		ChunkSize: *chunksize,
-		Token:     *token,
-	}
+	conn := newConnection()
+	conn.Throttle = bclientapi.NewThrottle(*numuploaders)
 	fileLists := NewLists(*fileroot)
 
 	// Fetch Item Info from bclientapi
@@ -194,44 +258,88 @@ func doGet(item string, files []string) int {
 
 	// At this point, the local list contains files, verified to exist on server
 
-	// set up our barrier, that will wait for all the file chunks to be uploaded
+	job := &Job{
+		Action: "get",
+		Item:   item,
+		Server: *server,
+		Root:   root,
+	}
+	for _, info := range fileLists.Local.Files {
+		job.Files = append(job.Files, info)
+	}
+	sort.Slice(job.Files, func(i, j int) bool {
+		return job.Files[i].Name < job.Files[j].Name
+	})
+	err = CreateJob(jobPath("get", item), job)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return runGetJob(conn, job)
+}
+
+// runGetJob downloads the files in job into a directory named after the
+// item, skipping those the job records as already downloaded.
+func runGetJob(conn *bclientapi.Connection, job *Job) int {
+	filesToGet := make(chan File)
+	var getFileDone sync.WaitGroup
+	pathPrefix := filepath.Join(job.Root, job.Item)
+
+	// set up our barrier, that will wait for all the files to be downloaded
 	getFileDone.Add(*numuploaders)
 
 	errorChan := make(chan error, 1)
 
-	//Spin off desire number of upload workers
+	//Spin off desire number of download workers
 	for cnt := int(0); cnt < *numuploaders; cnt++ {
 		go func() {
 			defer getFileDone.Done()
-			for filename := range filesToGet {
-				err := download(conn, item, filename, pathPrefix)
+			for info := range filesToGet {
+				filename := info.Name
+				err := download(conn, job.Item, filename, pathPrefix)
+				if err == nil && info.MimeType == SymlinkMimeType {
+					err = restoreSymlink(LocalPath(pathPrefix, filename))
+				} else if err == nil {
+					err = restoreFileInfo(LocalPath(pathPrefix, filename), info)
+				}
+				if err == nil {
+					err = job.record(jobEvent{Fetched: filename})
+				}
 				if err != nil {
-					errorChan <- err
-					return
+					select {
+					case errorChan <- err:
+					default:
+					}
 				}
 			}
 		}()
 	}
 
-	fileLists.QueueFiles(filesToGet)
+	for _, info := range job.Files {
+		if !job.Fetched(info.Name) {
+			filesToGet <- info
+		}
+	}
+	close(filesToGet)
 
 	getFileDone.Wait()
 
-	// If a file upload failed, return an error to main
+	// If a file download failed, return an error to main
 	select {
 	case <-errorChan:
-		return 1
+		return jobFailed(job)
 	default:
 	}
 
+	job.Finish()
 	return 0
 }
 
 // download copies an (item, filename) pair to the local filesystem at pathPrefix+filename
-// filename can contain '/' characters.
+// filename can contain '/' characters, which are converted to the local path separator.
 func download(conn *bclientapi.Connection, item string, filename string, pathPrefix string) error {
-	targetFilename := path.Join(pathPrefix, filename)
-	targetDir, _ := path.Split(targetFilename)
+	targetFilename := LocalPath(pathPrefix, filename)
+	targetDir := filepath.Dir(targetFilename)
 
 	err := os.MkdirAll(targetDir, 0755)
 	if err != nil {
@@ -250,11 +358,40 @@ func download(conn *bclientapi.Connection, item string, filename string, pathPre
 	return err
 }
 
+// restoreSymlink replaces the downloaded file at target, which holds the
+// contents of a recorded symbolic link, with the link itself.
+func restoreSymlink(target string) error {
+	linkto, err := ioutil.ReadFile(target)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(target)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(string(linkto), target)
+}
+
+// restoreFileInfo sets the modification time and permissions of the
+// downloaded file at target to those recorded when it was uploaded, if any.
+func restoreFileInfo(target string, info File) error {
+	if info.Mode != 0 {
+		err := os.Chmod(target, info.Mode)
+		if err != nil {
+			return err
+		}
+	}
+	if !info.ModTime.IsZero() {
+		return os.Chtimes(target, info.ModTime, info.ModTime)
+	}
+	return nil
+}
+
 // doGetStub builds an empty skeleton of an item, with zero length files
 
 func doGetStub(item string) int {
 	// if file or dir exists in target path named after the item, give error mesg and exit
-	pathPrefix := path.Join(*fileroot, item)
+	pathPrefix := filepath.Join(*fileroot, item)
 
 	_, err := os.Stat(pathPrefix)
 
@@ -266,11 +403,7 @@ func doGetStub(item string) int {
 
 	// fetch info about this item from the bendo server
 
-	conn := &bclientapi.Connection{
-		HostURL:   *server,
-		ChunkSize: *chunksize,
-		Token:     *token,
-	}
+	conn := newConnection()
 
 	// Fetch Item Info from bclientapi
 	json, err := conn.ItemInfo(item)
@@ -291,11 +424,7 @@ func doGetStub(item string) int {
 }
 
 func doHistory(item string) int {
-	conn := &bclientapi.Connection{
-		HostURL:   *server,
-		ChunkSize: *chunksize,
-		Token:     *token,
-	}
+	conn := newConnection()
 
 	// Fetch Item Info from bclientapi
 	json, err := conn.ItemInfo(item)
@@ -315,11 +444,7 @@ func doHistory(item string) int {
 }
 
 func doLs(item string) int {
-	conn := &bclientapi.Connection{
-		HostURL:   *server,
-		ChunkSize: *chunksize,
-		Token:     *token,
-	}
+	conn := newConnection()
 
 	// Fetch Item Info from bclientapi
 	json, err := conn.ItemInfo(item)
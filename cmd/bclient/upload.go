@@ -14,31 +14,62 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/ndlib/bendo/bclientapi"
 )
 
 // doUpload will upload the directory/file passed in to the given item.
 func doUpload(item string, file string) int {
-	root := *fileroot
-	if root[len(root)-1] != '/' {
-		root = root + "/"
+	// use an absolute root so walked paths are absolute. This lets
+	// Windows open paths longer than MAX_PATH.
+	root, err := filepath.Abs(*fileroot)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if !os.IsPathSeparator(root[len(root)-1]) {
+		root = root + string(filepath.Separator)
 	}
 
-	conn := &bclientapi.Connection{
-		HostURL:   *server,
-		ChunkSize: *chunksize,
-		Token:     *token,
+	switch *symlinks {
+	case "follow", "skip", "record":
+	default:
+		fmt.Println("-symlinks must be one of follow, skip, or record")
+		return 1
 	}
+	switch *emptydirs {
+	case "skip", "keep":
+	default:
+		fmt.Println("-emptydirs must be one of skip or keep")
+		return 1
+	}
+
+	var known map[string]File
+	if *manifest != "" {
+		known, err = ReadChecksumFile(*manifest)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		fmt.Println("Using", len(known), "checksums from", *manifest)
+	}
+
+	conn := newConnection()
+	conn.Throttle = bclientapi.NewThrottle(*numuploaders)
 	var localfiles *FileList
 	var remotefiles *FileList
 
-	fmt.Println("Scanning", path.Join(root, file))
+	fmt.Println("Scanning", filepath.Join(root, filepath.FromSlash(file)))
 
 	var wg sync.WaitGroup
 	wg.Add(1)
+	var skipped []SkippedEntry
 	go func() {
-		localfiles, _ = LoadLocalTree(root, file)
+		localfiles, skipped, _ = LoadLocalTree(root, file, ScanPolicy{
+			Symlinks:  *symlinks,
+			EmptyDirs: *emptydirs,
+		}, known)
 		wg.Done()
 	}()
 
@@ -60,6 +91,32 @@ func doUpload(item string, file string) int {
 		return 1
 	}
 
+	if len(skipped) > 0 {
+		fmt.Println("Skipping", len(skipped), "entries:")
+		for _, e := range skipped {
+			fmt.Printf("    %s (%s)\n", e.Path, e.Reason)
+		}
+	}
+
+	if known != nil {
+		if *spotcheck > 0 {
+			fmt.Println("Spot checking", *spotcheck, "files against the manifest")
+			bad, err := SpotCheck(localfiles, known, *spotcheck)
+			if err != nil {
+				fmt.Println(err)
+				return 1
+			}
+			if len(bad) > 0 {
+				fmt.Println("These files do not match the manifest:")
+				for _, name := range bad {
+					fmt.Println("    " + name)
+				}
+				return 1
+			}
+		}
+		FillMissingMD5(localfiles, remotefiles)
+	}
+
 	// This compares the local list with the remote list (if the item already exists)
 	// and eliminates any unneeded duplicates
 	fmt.Println("Resolving differences")
@@ -75,20 +132,46 @@ func doUpload(item string, file string) int {
 			fmt.Println(a)
 		}
 	}
+
+	job := &Job{
+		Action: "upload",
+		Item:   item,
+		Server: *server,
+		Root:   root,
+		Todo:   todo,
+	}
+	err = CreateJob(jobPath("upload", item), job)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return runUploadJob(conn, job)
+}
+
+// runUploadJob uploads the new blobs in job and then starts the
+// transactions to make the changes, skipping any work the job records as
+// already done.
+func runUploadJob(conn *bclientapi.Connection, job *Job) int {
+	// Make sure the server has room before spending hours uploading
+	err := checkCapacity(conn, job)
+	if err != nil {
+		fmt.Println("error:", err)
+		return jobFailed(job)
+	}
+
 	// Upload Any blobs
 	fmt.Println("Uploading files")
-	err = UploadBlobs(conn, item, todo)
+	err = UploadBlobs(conn, job)
 	if err != nil {
 		fmt.Println("error:", err)
-		return 1
+		return jobFailed(job)
 	}
 
 	// chunks uploaded- submit transaction to add FileIDs to item
-	transaction, err := PostTransaction(item, conn, todo)
-
+	transaction, err := postJobTransactions(conn, job)
 	if err != nil {
 		fmt.Println(err)
-		return 1
+		return jobFailed(job)
 	}
 
 	if *verbose {
@@ -100,14 +183,60 @@ func doUpload(item string, file string) int {
 		err = conn.WaitTransaction(txid)
 		if err != nil {
 			fmt.Println(err)
-			return 1
+			return jobFailed(job)
 		}
 	}
 
+	job.Finish()
 	return 0
 }
 
-func LoadLocalTree(root string, start string) (*FileList, error) {
+// checkCapacity returns an error if the blobs job still has to upload will
+// not fit in either the server's upload area or the user's upload quota.
+// Servers which do not report their capacity are assumed to have room.
+func checkCapacity(conn *bclientapi.Connection, job *Job) error {
+	var need int64
+	for _, t := range job.Todo {
+		if t.What != ANewBlob || job.Uploaded(job.Item+"-"+hex.EncodeToString(t.MD5)) {
+			continue
+		}
+		if t.Content != nil {
+			need += int64(len(t.Content))
+			continue
+		}
+		fi, err := os.Stat(t.Source)
+		if err != nil {
+			return err
+		}
+		need += fi.Size()
+	}
+	if need == 0 {
+		return nil
+	}
+	c, err := conn.UploadCapacity()
+	if err != nil {
+		if *verbose {
+			fmt.Println("Could not get upload capacity:", err)
+		}
+		return nil
+	}
+	if *verbose {
+		fmt.Printf("Need %d bytes; server has %d free, %d left in quota\n", need, c.FreeBytes, c.Remaining)
+	}
+	if c.FreeBytes >= 0 && need > c.FreeBytes {
+		return fmt.Errorf("upload needs %d bytes but the server only has %d bytes free", need, c.FreeBytes)
+	}
+	if c.Remaining >= 0 && need > c.Remaining {
+		return fmt.Errorf("upload needs %d bytes but only %d bytes are left in your upload quota of %d", need, c.Remaining, c.Quota)
+	}
+	return nil
+}
+
+// LoadLocalTree scans the files under start, which is relative to root, and
+// returns a list of them along with their checksums. Files in known, which
+// is keyed by absolute path, are not read and are given the checksums there.
+// Entries that were not included are also returned.
+func LoadLocalTree(root string, start string, policy ScanPolicy, known map[string]File) (*FileList, []SkippedEntry, error) {
 	// Since the pipeline does a fan-in, we need one wait group to
 	// wait for everything in the fan, and a second to wait for
 	// the goroutine that puts everything into the FileList.
@@ -117,14 +246,33 @@ func LoadLocalTree(root string, start string) (*FileList, error) {
 	local := New(root)
 	checksumchan := make(chan string)
 	manifestchan := make(chan string)
+	specialchan := make(chan File)
 	filechan := make(chan File)
+	var skipped []SkippedEntry
 
 	// Source
 	wg.Add(1)
 	go func() {
-		ScanFilesystem(path.Join(root, start), checksumchan, manifestchan)
+		skipped = ScanFilesystem(filepath.Join(root, filepath.FromSlash(start)),
+			policy,
+			checksumchan,
+			manifestchan,
+			specialchan)
 		close(checksumchan)
 		close(manifestchan)
+		close(specialchan)
+		wg.Done()
+	}()
+
+	// entries with content not from a regular file
+	wg.Add(1)
+	go func() {
+		for f := range specialchan {
+			md5Sum := md5.Sum(f.Content)
+			f.Name = SlotName(root, f.AbsPath)
+			f.MD5 = md5Sum[:]
+			filechan <- f
+		}
 		wg.Done()
 	}()
 
@@ -132,7 +280,7 @@ func LoadLocalTree(root string, start string) (*FileList, error) {
 	for i := 0; i < 3; i++ {
 		wg.Add(1)
 		go func() {
-			ChecksumLocalFiles(root, checksumchan, filechan)
+			ChecksumLocalFiles(root, known, checksumchan, filechan)
 			wg.Done()
 		}()
 	}
@@ -156,31 +304,91 @@ func LoadLocalTree(root string, start string) (*FileList, error) {
 	wg.Wait()
 	close(filechan)
 	wgend.Wait()
-	return local, nil
+	return local, skipped, nil
+}
+
+// A ScanPolicy says what ScanFilesystem should do with directory entries
+// that are not regular files.
+type ScanPolicy struct {
+	// Symlinks is one of "follow" (upload what the link points to),
+	// "skip", or "record" (upload the link target as the file content with
+	// the mime type SymlinkMimeType).
+	Symlinks string
+
+	// EmptyDirs is either "skip" or "keep". Empty directories are kept by
+	// uploading an empty placeholder file named KeepFile into them.
+	EmptyDirs string
+}
+
+// SymlinkMimeType is the mime type used for recorded symbolic links.
+const SymlinkMimeType = "inode/symlink"
+
+// KeepFile is the name of the placeholder file used to keep empty directories.
+const KeepFile = ".bclient-keep"
+
+// A SkippedEntry is a directory entry that was not uploaded, and why.
+type SkippedEntry struct {
+	Path   string
+	Reason string
 }
 
 // ScanFilesystem will start at the directory (or file) `file`, treating
 // the path in `root` as the initial segment to strip.
-// Directories beginning with a dot are discarded. Otherwise
+// Files and directories beginning with a dot are discarded. Otherwise
 // the file names (with the prefix `root` removed) are sent out `c` and
-// directories are recursed into.
-func ScanFilesystem(startpath string, c chan<- string, manifests chan<- string) {
-	filepath.Walk(startpath, func(abspath string, info os.FileInfo, err error) error {
+// directories are recursed into. Symbolic links and empty directories are
+// handled according to policy. Those needing special content are sent
+// out `special`. Sockets, devices, and named pipes are always skipped. The
+// entries that were skipped are returned.
+func ScanFilesystem(startpath string, policy ScanPolicy, c chan<- string, manifests chan<- string, special chan<- File) []SkippedEntry {
+	var skipped []SkippedEntry
+	// the real paths of directories we followed links into, to prevent loops
+	followed := make(map[string]bool)
+
+	var walkfn filepath.WalkFunc
+	walkfn = func(abspath string, info os.FileInfo, err error) error {
 		if err != nil {
 			fmt.Println(err)
 			return err
 		}
-		filename := path.Base(abspath)
+		filename := filepath.Base(abspath)
 
 		// skip files and directories beginning with a dot
 		if strings.HasPrefix(filename, ".") {
+			skipped = append(skipped, SkippedEntry{abspath, "hidden"})
 			if info.IsDir() {
 				return filepath.SkipDir
 			}
 			return nil
 		}
-		if info.IsDir() {
+		mode := info.Mode()
+		switch {
+		case mode&os.ModeSymlink != 0:
+			return scanSymlink(abspath, policy, c, special, followed, walkfn, &skipped)
+		case mode&os.ModeSocket != 0:
+			skipped = append(skipped, SkippedEntry{abspath, "socket"})
+			return nil
+		case mode&os.ModeNamedPipe != 0:
+			skipped = append(skipped, SkippedEntry{abspath, "named pipe"})
+			return nil
+		case mode&os.ModeDevice != 0:
+			skipped = append(skipped, SkippedEntry{abspath, "device"})
+			return nil
+		case info.IsDir():
 			// recurse into directories, but don't send them down the channel
+			if isEmptyDir(abspath) {
+				if policy.EmptyDirs == "keep" {
+					special <- File{
+						AbsPath: filepath.Join(abspath, KeepFile),
+						Content: []byte{},
+					}
+				} else {
+					skipped = append(skipped, SkippedEntry{abspath, "empty directory"})
+				}
+			}
+			return nil
+		case !mode.IsRegular():
+			skipped = append(skipped, SkippedEntry{abspath, "not a regular file"})
 			return nil
 		}
 		if filename == "bclient-manifest" {
@@ -189,14 +397,109 @@ func ScanFilesystem(startpath string, c chan<- string, manifests chan<- string)
 			c <- abspath
 		}
 		return nil
-	})
+	}
+	filepath.Walk(startpath, walkfn)
+	return skipped
 }
 
-// Checksum local files
-func ChecksumLocalFiles(root string, in <-chan string, out chan<- File) {
+// scanSymlink handles the symbolic link at abspath according to policy.
+func scanSymlink(abspath string,
+	policy ScanPolicy,
+	c chan<- string,
+	special chan<- File,
+	followed map[string]bool,
+	walkfn filepath.WalkFunc,
+	skipped *[]SkippedEntry) error {
+
+	switch policy.Symlinks {
+	case "record":
+		target, err := os.Readlink(abspath)
+		if err != nil {
+			*skipped = append(*skipped, SkippedEntry{abspath, err.Error()})
+			return nil
+		}
+		special <- File{
+			AbsPath:  abspath,
+			Content:  []byte(target),
+			MimeType: SymlinkMimeType,
+		}
+		return nil
+	case "follow":
+		info, err := os.Stat(abspath)
+		if err != nil {
+			*skipped = append(*skipped, SkippedEntry{abspath, "broken symlink"})
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			c <- abspath
+			return nil
+		}
+		if !info.IsDir() {
+			*skipped = append(*skipped, SkippedEntry{abspath, "symlink to special file"})
+			return nil
+		}
+		realpath, err := filepath.EvalSymlinks(abspath)
+		if err != nil || followed[realpath] || isAncestor(realpath, filepath.Dir(abspath)) {
+			*skipped = append(*skipped, SkippedEntry{abspath, "symlink loop"})
+			return nil
+		}
+		followed[realpath] = true
+		// the trailing separator makes Walk resolve the link
+		return filepath.Walk(abspath+string(filepath.Separator), walkfn)
+	}
+	*skipped = append(*skipped, SkippedEntry{abspath, "symlink"})
+	return nil
+}
+
+// isAncestor returns true if the directory dir, which has had all symbolic
+// links resolved, is the same as or contains the directory path.
+func isAncestor(dir string, path string) bool {
+	realpath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false
+	}
+	return realpath == dir || strings.HasPrefix(realpath, dir+string(filepath.Separator))
+}
+
+// isEmptyDir returns true if the given directory has no entries.
+func isEmptyDir(abspath string) bool {
+	f, err := os.Open(abspath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	_, err = f.Readdirnames(1)
+	return err == io.EOF
+}
+
+// ChecksumLocalFiles reads absolute paths from in and sends the file, with
+// its MD5 checksum, down out. Files in known, which is keyed by absolute
+// path, are given the checksums there instead of being read.
+func ChecksumLocalFiles(root string, known map[string]File, in <-chan string, out chan<- File) {
 	md5w := md5.New()
 
 	for abspath := range in {
+		relname := SlotName(root, abspath)
+		if k, ok := known[abspath]; ok {
+			fi, err := os.Stat(abspath)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			f := File{
+				Name:    relname,
+				AbsPath: abspath,
+				MD5:     k.MD5,
+				SHA256:  k.SHA256,
+				ModTime: fi.ModTime(),
+			}
+			if *recordmode {
+				f.Mode = fi.Mode().Perm()
+			}
+			out <- f
+			continue
+		}
+
 		// Open the local file
 		r, err := os.Open(abspath)
 		if err != nil {
@@ -207,16 +510,25 @@ func ChecksumLocalFiles(root string, in <-chan string, out chan<- File) {
 		md5w.Reset()
 		// Copy from the Reader into the Writer (this will compute the CheckSums)
 		io.Copy(md5w, r)
+		var modtime time.Time
+		var mode os.FileMode
+		if fi, err := r.Stat(); err == nil {
+			modtime = fi.ModTime()
+			if *recordmode {
+				mode = fi.Mode().Perm()
+			}
+		}
 		r.Close()
 
 		// Get the Checksums
 		md5Sum := md5w.Sum(nil)
 
-		relname := strings.TrimPrefix(abspath, root)
 		out <- File{
 			Name:    relname,
 			AbsPath: abspath,
 			MD5:     md5Sum[:],
+			ModTime: modtime,
+			Mode:    mode,
 		}
 	}
 }
@@ -244,9 +556,9 @@ func ParseManifest(root string, manifest string, out chan<- File) error {
 		}
 		md5, _ := hex.DecodeString(pieces[1])
 		sha256, _ := hex.DecodeString(pieces[2])
-		abspath := path.Join(dir, pieces[0])
+		abspath := filepath.Join(dir, filepath.FromSlash(pieces[0]))
 		// TODO?(dbrower): make sure file exists?
-		relname := strings.TrimPrefix(abspath, root)
+		relname := SlotName(root, abspath)
 		out <- File{
 			Name:     relname,
 			MD5:      md5,
@@ -264,16 +576,22 @@ const (
 	ANewBlob
 	AUpdateMimeType
 	AUpdateFile
+	AUpdateMeta
 )
 
 type Action struct {
 	What ActionKind
 	// the exact fields used depends on What.
 	Source   string // absolute path of file to upload
+	Content  []byte // if not nil, upload this instead of reading Source
 	MD5      []byte // checksum of Source
 	MimeType string // new mime type
 	BlobID   int64  // for blobs already on server
 	Name     string // the name for the file on server
+
+	// file metadata to record with the slot, if not zero
+	ModTime time.Time
+	Mode    os.FileMode
 }
 
 func (a Action) String() string {
@@ -291,6 +609,11 @@ func (a Action) String() string {
 			a.Name,
 			a.BlobID,
 			a.MD5)
+	case AUpdateMeta:
+		return fmt.Sprintf("<Action AUpdateMeta, Name=%s, ModTime=%s, Mode=%#o>",
+			a.Name,
+			a.ModTime.Format(time.RFC3339Nano),
+			a.Mode)
 	}
 	return fmt.Sprintf("<Action AUnknown>")
 }
@@ -317,6 +640,16 @@ func ResolveLocalBlobs(local, remote *FileList) []Action {
 						MimeType: localinfo.MimeType,
 					})
 				}
+				// See if the file metadata needs to be updated.
+				if (!localinfo.ModTime.IsZero() && !localinfo.ModTime.Equal(remoteinfo.ModTime)) ||
+					(localinfo.Mode != 0 && localinfo.Mode != remoteinfo.Mode) {
+					todo = append(todo, Action{
+						What:    AUpdateMeta,
+						Name:    localfile,
+						ModTime: localinfo.ModTime,
+						Mode:    localinfo.Mode,
+					})
+				}
 				continue
 			}
 
@@ -324,9 +657,11 @@ func ResolveLocalBlobs(local, remote *FileList) []Action {
 			id := remote.Blobs[hexMD5]
 			if id > 0 {
 				todo = append(todo, Action{
-					What:   AUpdateFile,
-					Name:   localfile,
-					BlobID: id,
+					What:    AUpdateFile,
+					Name:    localfile,
+					BlobID:  id,
+					ModTime: localinfo.ModTime,
+					Mode:    localinfo.Mode,
 				})
 				// TODO(dbrower): check mime-type and also update that, if needed
 				continue
@@ -340,6 +675,7 @@ func ResolveLocalBlobs(local, remote *FileList) []Action {
 			todo = append(todo, Action{
 				What:     ANewBlob,
 				Source:   localinfo.AbsPath,
+				Content:  localinfo.Content,
 				MD5:      localinfo.MD5,
 				MimeType: localinfo.MimeType,
 			})
@@ -347,19 +683,23 @@ func ResolveLocalBlobs(local, remote *FileList) []Action {
 		// TODO(dbrower): if there is a matching blob, see if it needs a mime type
 		// now update this file entry to point to the uploaded blob
 		todo = append(todo, Action{
-			What: AUpdateFile,
-			MD5:  localinfo.MD5,
-			Name: localfile,
+			What:    AUpdateFile,
+			MD5:     localinfo.MD5,
+			Name:    localfile,
+			ModTime: localinfo.ModTime,
+			Mode:    localinfo.Mode,
 		})
 	}
 
 	return todo
 }
 
-// UploadBlobs will go through a FileList and send any new blobs to the server
-// given by Connection. The first error is returned.
-func UploadBlobs(conn *bclientapi.Connection, item string, todo []Action) error {
+// UploadBlobs sends the new blobs in the job to the server given by
+// Connection. Blobs the job records as uploaded are skipped, and each blob
+// sent is recorded in the job. The first error is returned.
+func UploadBlobs(conn *bclientapi.Connection, job *Job) error {
 	var wg sync.WaitGroup
+	item := job.Item
 
 	c := make(chan Action)
 	errorchan := make(chan error, 1)
@@ -373,13 +713,27 @@ func UploadBlobs(conn *bclientapi.Connection, item string, todo []Action) error
 				if *verbose {
 					fmt.Println("Uploading", t.Source)
 				}
-				f, err := os.Open(t.Source)
+				remotekey := item + "-" + hex.EncodeToString(t.MD5)
+				var err error
+				if t.Content != nil {
+					r := bytes.NewReader(t.Content)
+					err = uploadWithSession(conn, remotekey, r, r.Size(), t)
+				} else {
+					var f *os.File
+					var fi os.FileInfo
+					f, err = os.Open(t.Source)
+					if err == nil {
+						fi, err = f.Stat()
+					}
+					if err == nil {
+						err = uploadWithSession(conn, remotekey, f, fi.Size(), t)
+					}
+					if f != nil {
+						f.Close()
+					}
+				}
 				if err == nil {
-					remotekey := item + "-" + hex.EncodeToString(t.MD5)
-					err = conn.Upload(remotekey, f, bclientapi.FileInfo{
-						MD5:      t.MD5,
-						Mimetype: t.MimeType})
-					f.Close()
+					err = job.record(jobEvent{Uploaded: remotekey})
 				}
 				if err != nil {
 					fmt.Printf("Error uploading %s, %s\n", t.Source, err)
@@ -394,8 +748,8 @@ func UploadBlobs(conn *bclientapi.Connection, item string, todo []Action) error
 
 	var err error
 loop:
-	for _, t := range todo {
-		if t.What != ANewBlob {
+	for _, t := range job.Todo {
+		if t.What != ANewBlob || job.Uploaded(item+"-"+hex.EncodeToString(t.MD5)) {
 			continue
 		}
 		select {
@@ -418,12 +772,183 @@ loop:
 	return err
 }
 
+// uploadWithSession copies r to the server under the name remotekey. A
+// session file is kept in the session directory while the upload is in
+// progress, so an upload interrupted by a crash or reboot is resumed by the
+// next run instead of starting over.
+func uploadWithSession(conn *bclientapi.Connection, remotekey string, r io.ReadSeeker, size int64, t Action) error {
+	sessionpath := filepath.Join(sessionDir(), remotekey+".json")
+	s, err := bclientapi.LoadUploadSession(sessionpath)
+	if err != nil || !bytes.Equal(s.MD5, t.MD5) {
+		s = bclientapi.NewUploadSession(remotekey, bclientapi.FileInfo{
+			Size:     size,
+			MD5:      t.MD5,
+			Mimetype: t.MimeType,
+		}, sessionpath)
+		s.Source = t.Source
+	} else if *verbose {
+		fmt.Println("Resuming", t.Source, "at byte", s.Sent)
+	}
+	err = conn.UploadSession(s, r)
+	if err == nil {
+		err = s.Remove()
+	}
+	return err
+}
+
+// sessionDir returns the directory to keep upload session files in.
+func sessionDir() string {
+	if *sessiondir != "" {
+		return *sessiondir
+	}
+	return filepath.Join(*fileroot, ".bclient-sessions")
+}
+
+// slotMetaCommands returns the transaction commands to record the file
+// metadata in the action for its slot.
+func slotMetaCommands(t Action) [][]string {
+	var cmdlist [][]string
+	if !t.ModTime.IsZero() {
+		cmdlist = append(cmdlist, []string{"slotmeta", t.Name, "mtime", t.ModTime.UTC().Format(time.RFC3339Nano)})
+	}
+	if t.Mode != 0 {
+		cmdlist = append(cmdlist, []string{"slotmeta", t.Name, "mode", fmt.Sprintf("%#o", t.Mode)})
+	}
+	return cmdlist
+}
+
 func PostTransaction(item string, conn *bclientapi.Connection, todo []Action) (string, error) {
 	cmdlist := MakeTransactionCommands(item, todo)
 	buf, _ := json.Marshal(cmdlist)
 	return conn.CreateTransaction(item, buf)
 }
 
+// postJobTransactions submits the changes in the job to the server, and
+// returns the path of the last transaction started. If the server refuses
+// the transaction for being too large, the changes are split into several.
+// Transactions the job records as started are not submitted again.
+func postJobTransactions(conn *bclientapi.Connection, job *Job) (string, error) {
+	if job.split == nil {
+		if len(job.transactions) > 0 {
+			return job.transactions[0], nil
+		}
+		transaction, err := PostTransaction(job.Item, conn, job.Todo)
+		if err == nil {
+			err = job.record(jobEvent{Transaction: transaction})
+			return transaction, err
+		}
+		limits, ok := err.(*bclientapi.TxTooLargeError)
+		if !ok {
+			return "", err
+		}
+		fmt.Println(limits)
+		err = job.record(jobEvent{Split: limits})
+		if err != nil {
+			return "", err
+		}
+	}
+	return postSplitTransactions(conn, job)
+}
+
+// postSplitTransactions submits the changes in the job as a series of
+// transactions which each stay inside the limits given by the server. The
+// server only allows one open transaction on an item, so each transaction
+// but the last is waited on. The path of the last transaction is returned.
+func postSplitTransactions(conn *bclientapi.Connection, job *Job) (string, error) {
+	limits := job.split
+	batches := splitActions(job.Todo, limits.MaxFiles, limits.MaxBytes)
+	fmt.Println("Splitting into", len(batches), "transactions")
+	var transaction string
+	for i, batch := range batches {
+		if i < len(job.transactions) {
+			// started by an earlier run
+			transaction = job.transactions[i]
+			continue
+		}
+		if i > 0 {
+			err := conn.WaitTransaction(path.Base(transaction))
+			if err != nil {
+				return "", err
+			}
+		}
+		var err error
+		transaction, err = PostTransaction(job.Item, conn, batch)
+		if err == nil {
+			err = job.record(jobEvent{Transaction: transaction})
+		}
+		if err != nil {
+			return "", err
+		}
+		if *verbose {
+			fmt.Printf("\n Transaction %d of %d is %s\n", i+1, len(batches), transaction)
+		}
+	}
+	return transaction, nil
+}
+
+// splitActions divides todo into batches which each add at most maxFiles
+// new blobs totaling at most maxBytes. A limit of zero means no limit. Each
+// new blob is kept in the same batch as the file updates which refer to it.
+// A blob larger than maxBytes is put in a batch by itself.
+func splitActions(todo []Action, maxFiles int, maxBytes int64) [][]Action {
+	// gather each new blob with the updates that point to it
+	groups := make(map[string][]Action)
+	var order []string
+	var batch []Action // actions not tied to a new blob go in the first batch
+	for _, t := range todo {
+		if t.What == ANewBlob || (t.What == AUpdateFile && t.BlobID <= 0) {
+			key := hex.EncodeToString(t.MD5)
+			if _, ok := groups[key]; !ok {
+				order = append(order, key)
+			}
+			groups[key] = append(groups[key], t)
+			continue
+		}
+		batch = append(batch, t)
+	}
+
+	var batches [][]Action
+	var nfiles int
+	var nbytes int64
+	for _, key := range order {
+		var n int
+		var size int64
+		for _, t := range groups[key] {
+			if t.What == ANewBlob {
+				n++
+				size += actionSize(t)
+			}
+		}
+		if nfiles > 0 &&
+			((maxFiles > 0 && nfiles+n > maxFiles) ||
+				(maxBytes > 0 && nbytes+size > maxBytes)) {
+			batches = append(batches, batch)
+			batch = nil
+			nfiles = 0
+			nbytes = 0
+		}
+		batch = append(batch, groups[key]...)
+		nfiles += n
+		nbytes += size
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// actionSize returns the number of bytes a new blob action will upload.
+func actionSize(t Action) int64 {
+	if t.Content != nil {
+		return int64(len(t.Content))
+	}
+	fi, err := os.Stat(t.Source)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
 // MakeTransactionCommands turns an Action list into a list of transaction
 // commands to send to the bendo server.
 func MakeTransactionCommands(item string, todo []Action) [][]string {
@@ -446,6 +971,9 @@ func MakeTransactionCommands(item string, todo []Action) [][]string {
 				fileID = item + "-" + hex.EncodeToString(t.MD5)
 			}
 			cmdlist = append(cmdlist, []string{"slot", t.Name, fileID})
+			cmdlist = append(cmdlist, slotMetaCommands(t)...)
+		case AUpdateMeta:
+			cmdlist = append(cmdlist, slotMetaCommands(t)...)
 		}
 	}
 	return cmdlist
@@ -2,9 +2,13 @@ package main
 
 import (
 	"encoding/hex"
+	"io/ioutil"
+	"os"
 	"path"
+	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestChecksum(t *testing.T) {
@@ -22,7 +26,7 @@ func TestChecksum(t *testing.T) {
 
 	wg.Add(1)
 	go func() {
-		ChecksumLocalFiles("./", in, out)
+		ChecksumLocalFiles("./", nil, in, out)
 		close(out)
 		wg.Done()
 	}()
@@ -84,3 +88,158 @@ func TestParseManifest(t *testing.T) {
 		}
 	}
 }
+
+func TestSlotName(t *testing.T) {
+	var table = []struct {
+		root    string
+		abspath string
+		slot    string
+	}{
+		{"/data/", "/data/a/b.txt", "a/b.txt"},
+		{"/data", "/data/a/b.txt", "a/b.txt"},
+		{"./", "testdata/a", "testdata/a"},
+		{"/data/", "/elsewhere/c", "elsewhere/c"},
+	}
+	for _, row := range table {
+		slot := SlotName(filepath.FromSlash(row.root), filepath.FromSlash(row.abspath))
+		if slot != row.slot {
+			t.Errorf("SlotName(%q, %q) = %q, expected %q", row.root, row.abspath, slot, row.slot)
+		}
+	}
+}
+
+func TestLocalPath(t *testing.T) {
+	p := LocalPath("item", "a/b/c.txt")
+	if p != filepath.Join("item", "a", "b", "c.txt") {
+		t.Errorf("Received %q", p)
+	}
+}
+
+// scanTree runs ScanFilesystem on dir with the given policy and returns what
+// was sent down each channel.
+func scanTree(dir string, policy ScanPolicy) (files []string, special []File, skipped []SkippedEntry) {
+	c := make(chan string, 100)
+	manifests := make(chan string, 100)
+	specialchan := make(chan File, 100)
+	skipped = ScanFilesystem(dir, policy, c, manifests, specialchan)
+	close(c)
+	close(specialchan)
+	for f := range c {
+		files = append(files, filepath.Base(f))
+	}
+	for f := range specialchan {
+		special = append(special, f)
+	}
+	return
+}
+
+func TestScanPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bclient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, ".hidden"), []byte("hello"), 0644)
+	os.Mkdir(filepath.Join(dir, "empty"), 0755)
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "sub", "b.txt"), []byte("hello"), 0644)
+	err = os.Symlink("a.txt", filepath.Join(dir, "link"))
+	if err != nil {
+		t.Skip("cannot make symlinks:", err)
+	}
+	os.Symlink("..", filepath.Join(dir, "sub", "loop"))
+
+	files, special, skipped := scanTree(dir, ScanPolicy{Symlinks: "skip", EmptyDirs: "skip"})
+	if len(files) != 2 || len(special) != 0 || len(skipped) != 4 {
+		t.Error("skip: received", files, special, skipped)
+	}
+
+	files, special, skipped = scanTree(dir, ScanPolicy{Symlinks: "follow", EmptyDirs: "keep"})
+	if len(files) != 3 || len(special) != 1 || len(skipped) != 2 {
+		t.Error("follow: received", files, special, skipped)
+	}
+
+	files, special, skipped = scanTree(dir, ScanPolicy{Symlinks: "record", EmptyDirs: "skip"})
+	if len(files) != 2 || len(special) != 2 {
+		t.Error("record: received", files, special, skipped)
+	}
+	for _, f := range special {
+		switch filepath.Base(f.AbsPath) {
+		case "link":
+			if string(f.Content) != "a.txt" || f.MimeType != SymlinkMimeType {
+				t.Error("record: received", f)
+			}
+		case "loop":
+		default:
+			t.Error("record: received", f)
+		}
+	}
+}
+
+func TestResolveFileMeta(t *testing.T) {
+	mtime := time.Date(2016, 11, 17, 10, 0, 0, 0, time.UTC)
+	md5 := []byte{1, 2, 3, 4}
+	local := New("")
+	local.Files["a"] = File{Name: "a", MD5: md5, ModTime: mtime, Mode: 0640}
+	local.Files["b"] = File{Name: "b", MD5: md5, ModTime: mtime}
+	remote := New("")
+	remote.Files["a"] = File{Name: "a", MD5: md5, ModTime: mtime, Mode: 0640}
+	remote.Files["b"] = File{Name: "b", MD5: md5}
+
+	todo := ResolveLocalBlobs(local, remote)
+	if len(todo) != 1 || todo[0].What != AUpdateMeta || todo[0].Name != "b" {
+		t.Fatal("Received", todo)
+	}
+	cmds := MakeTransactionCommands("item", todo)
+	if len(cmds) != 1 || cmds[0][0] != "slotmeta" || cmds[0][3] != "2016-11-17T10:00:00Z" {
+		t.Error("Received", cmds)
+	}
+}
+
+func TestSplitActions(t *testing.T) {
+	blob := func(md5 byte, content string) Action {
+		return Action{What: ANewBlob, MD5: []byte{md5}, Content: []byte(content)}
+	}
+	file := func(md5 byte, name string) Action {
+		return Action{What: AUpdateFile, MD5: []byte{md5}, Name: name}
+	}
+	todo := []Action{
+		blob(1, "aaaa"),
+		file(1, "a"),
+		blob(2, "bbbb"),
+		file(2, "b"),
+		file(1, "a-copy"),
+		blob(3, "cccccccccc"),
+		file(3, "c"),
+		{What: AUpdateFile, Name: "old", BlobID: 4},
+	}
+	var tests = []struct {
+		maxFiles int
+		maxBytes int64
+		expect   []int // number of actions in each batch
+	}{
+		{0, 0, []int{8}},
+		{1, 0, []int{4, 2, 2}},
+		{2, 0, []int{6, 2}},
+		{0, 8, []int{6, 2}},
+		{0, 5, []int{4, 2, 2}}, // blob 3 is over the limit by itself
+	}
+	for _, test := range tests {
+		batches := splitActions(todo, test.maxFiles, test.maxBytes)
+		var sizes []int
+		for _, b := range batches {
+			sizes = append(sizes, len(b))
+		}
+		if len(sizes) != len(test.expect) {
+			t.Errorf("%d files, %d bytes: received %v, expected %v", test.maxFiles, test.maxBytes, sizes, test.expect)
+			continue
+		}
+		for i := range sizes {
+			if sizes[i] != test.expect[i] {
+				t.Errorf("%d files, %d bytes: received %v, expected %v", test.maxFiles, test.maxBytes, sizes, test.expect)
+				break
+			}
+		}
+	}
+}
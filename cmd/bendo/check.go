@@ -0,0 +1,389 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/ndlib/bendo/items"
+	"github.com/ndlib/bendo/server"
+	"github.com/ndlib/bendo/store"
+)
+
+// checkConfig validates config without starting anything, and returns a
+// list of every problem found. The stores are checked to be usable, the
+// token file parsed, and the database schema version compared against the
+// one this bendo expects.
+func checkConfig(config *bendoConfig) []error {
+	var problems []error
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	// settings which only need to parse
+	var durations = []struct{ name, value string }{
+		{"CacheTimeout", config.CacheTimeout},
+		{"CacheWait", config.CacheWait},
+		{"MaxCacheWait", config.MaxCacheWait},
+		{"MetadataTTL", config.MetadataTTL},
+		{"CheckEvery", config.CheckEvery},
+		{"DBLifetime", config.DBLifetime},
+		{"DBTimeout", config.DBTimeout},
+		{"DBSlowQuery", config.DBSlowQuery},
+		{"StoreRetain", config.StoreRetain},
+		{"StorageCheck", config.StorageCheck},
+		{"UploadExpire", config.UploadExpire},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(d.value); err != nil {
+			add("%s: %s", d.name, err)
+		}
+	}
+	if config.V1Sunset != "" {
+		if _, err := time.Parse("2006-01-02", config.V1Sunset); err != nil {
+			add("V1Sunset: %s", err)
+		}
+	}
+	for user, lane := range config.TxLanes {
+		if lane != server.LaneSmall && lane != server.LaneLarge {
+			add("TxLanes: unknown lane %q for %s", lane, user)
+		}
+	}
+	for user, urls := range config.TxCallbacks {
+		for _, u := range urls {
+			if v, err := url.Parse(u); err != nil || (v.Scheme != "http" && v.Scheme != "https") {
+				add("TxCallbacks: bad url %q for %s", u, user)
+			}
+		}
+	}
+	for name, tmpl := range config.TxTemplates {
+		if len(tmpl) == 0 {
+			add("TxTemplates: %s has no commands", name)
+		}
+		for _, cmd := range tmpl {
+			if len(cmd) == 0 {
+				add("TxTemplates: %s has an empty command", name)
+			}
+		}
+	}
+	for user, limit := range config.RateLimits {
+		if limit.Rate < 0 || limit.Burst < 0 || limit.Recalls < 0 {
+			add("RateLimits: negative limit for %s", user)
+		}
+	}
+	for user, quota := range config.UploadQuotas {
+		if quota < 0 {
+			add("UploadQuotas: negative quota for %s", user)
+		}
+	}
+	for user, quota := range config.TransferQuotas {
+		if quota.Upload < 0 || quota.Download < 0 || quota.Days < 0 {
+			add("TransferQuotas: negative quota for %s", user)
+		}
+	}
+	for _, alert := range config.StorageAlerts {
+		if alert.Bytes <= 0 {
+			add("StorageAlerts: no quota for prefix %q", alert.Prefix)
+		}
+		for _, level := range alert.Levels {
+			if level <= 0 {
+				add("StorageAlerts: bad level %d for prefix %q", level, alert.Prefix)
+			}
+		}
+	}
+	for _, u := range config.StorageAlertURLs {
+		if v, err := url.Parse(u); err != nil || (v.Scheme != "http" && v.Scheme != "https") {
+			add("StorageAlertURLs: bad url %q", u)
+		}
+	}
+	if config.StorageGrowth < 0 {
+		add("StorageGrowth: negative days")
+	}
+	names := make(map[string]bool)
+	for _, e := range config.Exports {
+		if e.Name == "" || names[e.Name] {
+			add("Exports: missing or repeated name %q", e.Name)
+		}
+		names[e.Name] = true
+		if e.Institution == "" {
+			add("Exports: no institution for %s", e.Name)
+		}
+		if e.Access != "Consortia" && e.Access != "Institution" && e.Access != "Restricted" {
+			add("Exports: unknown access %q for %s", e.Access, e.Name)
+		}
+		if e.Dest == "" {
+			add("Exports: no destination for %s", e.Name)
+		}
+		if e.Every != "" {
+			if d, err := time.ParseDuration(e.Every); err != nil || d <= 0 {
+				add("Exports: bad interval %q for %s", e.Every, e.Name)
+			}
+		}
+		if e.NotifyURL != "" {
+			if v, err := url.Parse(e.NotifyURL); err != nil || (v.Scheme != "http" && v.Scheme != "https") {
+				add("Exports: bad url %q for %s", e.NotifyURL, e.Name)
+			}
+		}
+	}
+	if config.CacheMemory < 0 || config.CacheMemoryBlob < 0 {
+		add("CacheMemory: negative size")
+	}
+	if config.CacheWarmCount < 0 {
+		add("CacheWarmCount: negative count")
+	}
+	if config.CacheWarmBytes < 0 {
+		add("CacheWarmBytes: negative size")
+	}
+	if config.CacheCopyBuffer < 0 {
+		add("CacheCopyBuffer: negative size")
+	}
+	if config.ClientCopyBuffer < 0 {
+		add("ClientCopyBuffer: negative size")
+	}
+	if config.HashCPU < 0 || config.HashCPU > 1 {
+		add("HashCPU: %g is not between 0 and 1", config.HashCPU)
+	}
+	for name, st := range config.Stores {
+		if st.Location == "" {
+			add("Stores: no location for %s", name)
+		}
+	}
+	var storeNames = []struct{ name, value string }{
+		{"ItemStore", config.ItemStore},
+		{"UploadStore", config.UploadStore},
+		{"TxStore", config.TxStore},
+	}
+	for _, ref := range storeNames {
+		if _, ok := config.Stores[ref.value]; ref.value != "" && !ok {
+			add("%s: no store named %q", ref.name, ref.value)
+		}
+	}
+	for name, c := range config.Caches {
+		if _, ok := config.Stores[c.Store]; (c.Store != "" || c.Redis == "") && !ok {
+			add("Caches: no store named %q for %s", c.Store, name)
+		}
+		if c.Size < 0 {
+			add("Caches: negative size for %s", name)
+		}
+		if c.Timeout != "" {
+			if _, err := time.ParseDuration(c.Timeout); err != nil {
+				add("Caches: bad timeout %q for %s", c.Timeout, name)
+			}
+		}
+	}
+	if _, ok := config.Caches[config.Cache]; config.Cache != "" && !ok {
+		add("Cache: no cache named %q", config.Cache)
+	}
+	routes := make(map[string]bool)
+	for _, name := range server.RouteNames() {
+		routes[name] = true
+	}
+	for name, role := range config.RouteRoles {
+		if !routes[name] {
+			add("RouteRoles: unknown route %q", name)
+		}
+		if _, ok := parseRole(role); !ok {
+			add("RouteRoles: unknown role %q for %s", role, name)
+		}
+	}
+	if config.Minter != "" {
+		if _, err := server.NewMinter(config.Minter, config.MinterPrefix); err != nil {
+			add("Minter: %s", err)
+		}
+	}
+
+	// files
+	if config.Tokenfile != "" {
+		if _, err := server.NewListValidatorFile(config.Tokenfile); err != nil {
+			add("Tokenfile: %s", err)
+		}
+	}
+	if config.LDAP.URL != "" {
+		if _, err := newLDAPValidator(config.LDAP); err != nil {
+			add("LDAP: %s", err)
+		}
+	}
+	if (config.TLSCert == "") != (config.TLSKey == "") {
+		add("TLSCert and TLSKey must be given together")
+	} else if config.TLSCert != "" {
+		if _, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey); err != nil {
+			add("TLSCert: %s", err)
+		}
+	}
+	if len(config.ACMEHosts) > 0 && config.TLSCert != "" {
+		add("ACMEHosts cannot be used with TLSCert")
+	}
+
+	// stores
+	if err := checkStoreDir(config.itemLocation()); err != nil {
+		add("StoreDir: %s", err)
+	}
+	if config.StoreRetain != "" {
+		if err := checkStoreLock(config.itemLocation(), config.StoreLock); err != nil {
+			add("StoreLock: %s", err)
+		}
+	}
+	if err := checkStoreLayout(config); err != nil {
+		add("StoreLayout: %s", err)
+	}
+	if _, err := items.ParseBundleFormat(config.StoreFormat); err != nil {
+		add("StoreFormat: %s", err)
+	}
+	if _, err := items.ParseParityScheme(config.StoreParity); err != nil {
+		add("StoreParity: %s", err)
+	}
+	if config.StoreSegment < 0 {
+		add("StoreSegment: negative size")
+	}
+	if config.StoreBundleSize < 0 || config.StoreBundleMin < 0 {
+		add("StoreBundleSize: negative size or count")
+	}
+	if config.StoreRangeSize < 0 || config.StoreRangeReads < 0 {
+		add("StoreRangeReads: negative size or count")
+	}
+	if config.StoreMasterKey != "" {
+		if _, err := items.NewMasterKeyFile(config.StoreMasterKey); err != nil {
+			add("StoreMasterKey: %s", err)
+		}
+	}
+	cache, cacheLocation := config.blobCache()
+	if cache.Redis != "" {
+		cacheLocation = ""
+	}
+	var working = []struct{ sub, location string }{
+		{"blobcache", cacheLocation},
+		{"transaction", config.location(config.TxStore, config.CacheDir)},
+		{"upload", config.location(config.UploadStore, config.CacheDir)},
+	}
+	for _, w := range working {
+		if w.location == "" {
+			continue
+		}
+		if err := checkWritable(parselocation(w.location, w.sub)); err != nil {
+			add("CacheDir %s: %s", w.sub, err)
+		}
+	}
+
+	// database
+	if config.Mysql != "" {
+		opts := server.DBOptions{}
+		opts.Timeout, _ = time.ParseDuration(config.DBTimeout)
+		if err := server.CheckMysqlSchema(config.Mysql, opts); err != nil {
+			add("Mysql: %s", err)
+		}
+	} else if config.CacheDir != "" {
+		path := qlPath(config)
+		if _, err := os.Stat(path); err == nil {
+			if err := server.CheckQlSchema(path); err != nil {
+				add("database %s: %s", path, err)
+			}
+		}
+	}
+	return problems
+}
+
+// checkStoreDir makes sure the preservation store can be reached. Local
+// directories must be writable. Remote stores are only listed,
+// since writing a test file to tape would leave it there.
+func checkStoreDir(location string) error {
+	u, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+	s := parselocation(location, "")
+	if s == nil {
+		return fmt.Errorf("cannot use location %s", location)
+	}
+	if u.Scheme == "" || u.Scheme == "file" {
+		f, err := os.CreateTemp(u.Path, ".bendo-check-")
+		if err != nil {
+			return err
+		}
+		f.Close()
+		return os.Remove(f.Name())
+	}
+	_, err = s.ListPrefix("bendo-check")
+	return err
+}
+
+// checkStoreLock makes sure the preservation store can lock bundles with the
+// given mode.
+func checkStoreLock(location string, mode string) error {
+	switch parselocation(location, "").(type) {
+	case *store.S3:
+		if mode != "GOVERNANCE" && mode != "COMPLIANCE" {
+			return fmt.Errorf("S3 lock mode must be GOVERNANCE or COMPLIANCE, not %q", mode)
+		}
+	case store.Locker:
+	default:
+		return fmt.Errorf("cannot lock bundles in %s", location)
+	}
+	return nil
+}
+
+// checkStoreLayout makes sure the configured layout exists and can be used
+// with the preservation store. Layouts other than the flat one make keys
+// with slashes, which a directory cannot hold, and which a copy-on-write
+// store cannot request from its target.
+func checkStoreLayout(config *bendoConfig) error {
+	layout, err := items.ParseLayout(config.StoreLayout)
+	if err != nil {
+		return err
+	}
+	if _, ok := layout.(items.FlatLayout); ok {
+		return nil
+	}
+	if _, ok := parselocation(config.itemLocation(), "").(*store.FileSystem); ok {
+		return fmt.Errorf("a directory only supports the flat layout")
+	}
+	if config.CowHost != "" {
+		return fmt.Errorf("CowHost needs the flat layout")
+	}
+	return nil
+}
+
+// checkWritable makes sure a file can be written to, read from, and
+// deleted from the store s.
+func checkWritable(s store.Store) error {
+	if s == nil {
+		return fmt.Errorf("cannot use location")
+	}
+	const key = "bendo-check"
+	s.Delete(key) // in case an earlier check was interrupted
+	w, err := s.Create(key)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "check")
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		s.Delete(key)
+		return err
+	}
+	r, _, err := s.Open(key)
+	if err != nil {
+		return err
+	}
+	r.Close()
+	return s.Delete(key)
+}
+
+// reportProblems writes the problems found by checkConfig to w.
+func reportProblems(w io.Writer, problems []error) {
+	if len(problems) == 0 {
+		fmt.Fprintln(w, "Configuration OK")
+		return
+	}
+	fmt.Fprintf(w, "Found %d configuration problems:\n", len(problems))
+	for _, p := range problems {
+		fmt.Fprintln(w, "  -", p)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ndlib/bendo/server"
+)
+
+func TestCheckConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bendocheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	good := &bendoConfig{
+		StoreDir:    filepath.Join(dir, "store"),
+		StoreRetain: "24h",
+		CacheDir:    filepath.Join(dir, "cache"),
+	}
+	problems := checkConfig(good)
+	if len(problems) != 0 {
+		t.Errorf("Received problems %v for a good configuration", problems)
+	}
+
+	bad := &bendoConfig{
+		StoreDir:        filepath.Join(dir, "store"),
+		CacheTimeout:    "ten minutes",
+		CacheWait:       "a minute",
+		TxLanes:         map[string]string{"loader": "fast"},
+		TxCallbacks:     map[string][]string{"loader": {"ftp://example.org/"}},
+		TxTemplates:     map[string][][]string{"nothing": {}},
+		RateLimits:      map[string]server.RateLimit{"harvester": {Rate: -1}},
+		UploadQuotas:    map[string]int64{"*": -1},
+		UploadExpire:    "fortnightly",
+		TransferQuotas:  map[string]server.TransferQuota{"*": {Days: -1}},
+		StorageAlerts:   []server.StorageAlert{{Prefix: "und:"}},
+		StorageCheck:    "hourly",
+		Exports:         []exportConfig{{Name: "aptrust", Institution: "nd.edu", Access: "Everyone", Dest: "s3:/receiving"}},
+		CacheCopyBuffer: -1,
+		CacheWarmCount:  -1,
+		CacheMemory:     -1,
+		HashCPU:         1.5,
+		Stores:          map[string]storeConfig{"tape": {}},
+		Caches:          map[string]cacheConfig{"disk": {Store: "nowhere", Size: 100}},
+		RouteRoles:      map[string]string{"GET /nowhere": "read"},
+		Tokenfile:       filepath.Join(dir, "no-such-tokens"),
+		LDAP:            ldapConfig{URL: "ldap.example.org"},
+		TLSCert:         filepath.Join(dir, "cert.pem"),
+		ACMEHosts:       []string{"bendo.example.org"},
+		Minter:          "unknown",
+		StoreRetain:     "forever",
+		StoreLayout:     "pairtree",
+		StoreFormat:     "rar",
+		StoreParity:     "lots",
+		StoreSegment:    -1,
+		StoreBundleSize: -1,
+		StoreRangeReads: -1,
+		StoreMasterKey:  filepath.Join(dir, "no-such-key"),
+	}
+	problems = checkConfig(bad)
+	var expected = []string{"CacheTimeout", "CacheWait", "StoreRetain", "StoreLayout", "StoreFormat", "StoreParity", "StoreSegment", "StoreBundleSize", "StoreRangeReads", "StoreMasterKey", "TxLanes", "TxCallbacks", "TxTemplates", "RateLimits", "UploadQuotas", "UploadExpire", "TransferQuotas", "StorageAlerts", "StorageCheck", "Exports", "CacheCopyBuffer", "CacheWarmCount", "CacheMemory", "HashCPU", "Stores", "Caches", "RouteRoles", "Tokenfile", "LDAP", "TLSCert", "ACMEHosts", "Minter"}
+	if len(problems) != len(expected) {
+		t.Errorf("Received problems %v, expected %d", problems, len(expected))
+	}
+	for _, name := range expected {
+		found := false
+		for _, p := range problems {
+			if strings.HasPrefix(p.Error(), name) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("No problem reported for %s", name)
+		}
+	}
+}
+
+func TestPrintMigrationPlan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bendoplan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	config := &bendoConfig{CacheDir: dir}
+	err = printMigrationPlan(&buf, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "Database schema would be migrated from version 0") ||
+		!strings.Contains(buf.String(), "CREATE TABLE") {
+		t.Errorf("Received %q", buf.String())
+	}
+}
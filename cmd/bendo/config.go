@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/ndlib/bendo/server"
+)
+
+// location returns the location of the store with the given name, or
+// fallback if no name is given. The names are checked by checkConfig.
+func (config *bendoConfig) location(name string, fallback string) string {
+	if name == "" {
+		return fallback
+	}
+	return config.Stores[name].Location
+}
+
+// itemLocation returns the location of the preservation store.
+func (config *bendoConfig) itemLocation() string {
+	return config.location(config.ItemStore, config.StoreDir)
+}
+
+// blobCache returns the settings of the blob cache and the location it is
+// kept in. They come from the cache named by Cache, if given, and otherwise
+// from the CacheDir, CacheRedis, CacheSize, and CacheTimeout options.
+func (config *bendoConfig) blobCache() (cacheConfig, string) {
+	if config.Cache != "" {
+		c := config.Caches[config.Cache]
+		return c, config.location(c.Store, "")
+	}
+	c := cacheConfig{
+		Redis:   config.CacheRedis,
+		Size:    config.CacheSize,
+		Timeout: config.CacheTimeout,
+	}
+	return c, config.CacheDir
+}
+
+// parseRole decodes the role given for a route in RouteRoles. It is one of
+// the names accepted by server.AtoRole, or "none" to let anyone use the
+// route. The second return value is false if the name is not known.
+func parseRole(s string) (server.Role, bool) {
+	if strings.EqualFold(s, "none") {
+		return server.RoleUnknown, true
+	}
+	role := server.AtoRole(s)
+	return role, role != server.RoleUnknown
+}
+
+// redacted replaces each secret in the configuration returned by
+// /admin/config.
+const redacted = "REDACTED"
+
+// redactConfig returns a copy of config with the passwords and tokens in it
+// replaced, so it may be shown to administrators. The config itself is not
+// changed.
+func redactConfig(config *bendoConfig) *bendoConfig {
+	c := *config
+	c.StoreDir = redactURL(c.StoreDir)
+	c.CacheDir = redactURL(c.CacheDir)
+	c.CacheRedis = redactURL(c.CacheRedis)
+	c.Mysql = redactDSN(c.Mysql)
+	if c.CowToken != "" {
+		c.CowToken = redacted
+	}
+	if c.LDAP.BindPassword != "" {
+		c.LDAP.BindPassword = redacted
+	}
+	if c.Stores != nil {
+		c.Stores = make(map[string]storeConfig)
+		for name, v := range config.Stores {
+			v.Location = redactURL(v.Location)
+			c.Stores[name] = v
+		}
+	}
+	if c.Caches != nil {
+		c.Caches = make(map[string]cacheConfig)
+		for name, v := range config.Caches {
+			v.Redis = redactURL(v.Redis)
+			c.Caches[name] = v
+		}
+	}
+	c.Exports = nil
+	for _, e := range config.Exports {
+		e.Dest = redactURL(e.Dest)
+		e.NotifyURL = redactURL(e.NotifyURL)
+		c.Exports = append(c.Exports, e)
+	}
+	return &c
+}
+
+// redactURL replaces the password in the user information of the URL s, if
+// there is one. Other strings are returned unchanged.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	if _, ok := u.User.Password(); !ok {
+		return s
+	}
+	u.User = url.UserPassword(u.User.Username(), redacted)
+	return u.String()
+}
+
+// redactDSN replaces the password in a MySQL data source name, which has the
+// form "user:password@protocol(address)/dbname?options".
+func redactDSN(dsn string) string {
+	slash := strings.LastIndex(dsn, "/")
+	if slash == -1 {
+		return dsn
+	}
+	at := strings.LastIndex(dsn[:slash], "@")
+	if at == -1 {
+		return dsn
+	}
+	colon := strings.Index(dsn[:at], ":")
+	if colon == -1 {
+		return dsn
+	}
+	return dsn[:colon+1] + redacted + dsn[at:]
+}
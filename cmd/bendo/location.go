@@ -43,6 +43,30 @@ func splitBucketPrefix(location string, addition string) (bucket, prefix string)
 	return
 }
 
+// s3config makes the AWS configuration for an "s3:" location. If a host is
+// given, it is used as the endpoint, which allows S3-compatible services such
+// as MinIO. Custom endpoints use path-style bucket addressing. SSL is disabled
+// for localhost, or if the query parameter "ssl=false" is given. The query
+// parameter "region" sets the region, which defaults to "us-east-1" for
+// custom endpoints.
+func s3config(u *url.URL) *aws.Config {
+	conf := &aws.Config{}
+	q := u.Query()
+	if u.Host != "" {
+		conf.Endpoint = aws.String(u.Host)
+		conf.Region = aws.String("us-east-1")
+		conf.S3ForcePathStyle = aws.Bool(true)
+		// disable SSL for local development
+		if strings.Contains(u.Host, "localhost") || q.Get("ssl") == "false" {
+			conf.DisableSSL = aws.Bool(true)
+		}
+	}
+	if region := q.Get("region"); region != "" {
+		conf.Region = aws.String(region)
+	}
+	return conf
+}
+
 // parselocation will create an approprate store based on "location".
 // In case of an error, nil is returned.
 // If location is empty, a memory store is returned.
@@ -59,16 +83,7 @@ func parselocation(location string, addition string) store.Store {
 		os.MkdirAll(path, 0755)
 		return store.NewFileSystem(path)
 	case "s3":
-		conf := &aws.Config{}
-		if u.Host != "" {
-			conf.Endpoint = aws.String(u.Host)
-			conf.Region = aws.String("us-east-1")
-			// disable SSL for local development
-			if strings.Contains(u.Host, "localhost") {
-				conf.DisableSSL = aws.Bool(true)
-				conf.S3ForcePathStyle = aws.Bool(true)
-			}
-		}
+		conf := s3config(u)
 		bucket, prefix := splitBucketPrefix(u.Path, addition)
 		if bucket == "" {
 			log.Println("Error parsing location, no bucket name", location)
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"net/url"
 	"os"
 	"testing"
 
+	"github.com/aws/aws-sdk-go/aws"
+
 	"github.com/ndlib/bendo/store"
 )
 
@@ -113,3 +116,31 @@ func init() {
 		os.Setenv("DS3_SECRET_KEY", "192.168.1.70:8008")
 	}
 }
+
+func TestS3Config(t *testing.T) {
+	var table = []struct {
+		location  string
+		endpoint  string
+		region    string
+		pathstyle bool
+		nossl     bool
+	}{
+		{"s3:/bucket", "", "", false, false},
+		{"s3:/bucket?region=us-west-2", "", "us-west-2", false, false},
+		{"s3://localhost:9000/bucket", "localhost:9000", "us-east-1", true, true},
+		{"s3://minio.example.org/bucket", "minio.example.org", "us-east-1", true, false},
+		{"s3://minio.example.org/bucket?ssl=false&region=local", "minio.example.org", "local", true, true},
+	}
+	for _, row := range table {
+		u, _ := url.Parse(row.location)
+		conf := s3config(u)
+		if aws.StringValue(conf.Endpoint) != row.endpoint ||
+			aws.StringValue(conf.Region) != row.region ||
+			aws.BoolValue(conf.S3ForcePathStyle) != row.pathstyle ||
+			aws.BoolValue(conf.DisableSSL) != row.nossl {
+			t.Errorf("%s: received %s %s %v %v", row.location,
+				aws.StringValue(conf.Endpoint), aws.StringValue(conf.Region),
+				aws.BoolValue(conf.S3ForcePathStyle), aws.BoolValue(conf.DisableSSL))
+		}
+	}
+}
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sort"
+	"strings"
 	"syscall"
 	"time"
 
@@ -24,16 +31,133 @@ import (
 //Config info needed for Bendo
 
 type bendoConfig struct {
-	StoreDir     string
-	Tokenfile    string
-	CacheDir     string
-	CacheSize    int64
-	CacheTimeout string
-	PortNumber   string
-	PProfPort    string
-	Mysql        string
-	CowHost      string
-	CowToken     string
+	StoreDir         string
+	StoreLock        string
+	StoreRetain      string
+	StoreLayout      string
+	StoreFormat      string
+	StoreParity      string
+	StoreSegment     int64
+	StoreBundleSize  int64
+	StoreBundleFit   bool
+	StoreBundleMin   int
+	StoreMasterKey   string
+	StoreRangeSize   int64
+	StoreRangeReads  int
+	StoreVerifyReads bool
+	StoreDedup       bool
+	Stores           map[string]storeConfig
+	ItemStore        string
+	UploadStore      string
+	TxStore          string
+	Caches           map[string]cacheConfig
+	Cache            string
+	RouteRoles       map[string]string
+	Tokenfile        string
+	LDAP             ldapConfig
+	CacheDir         string
+	CacheSize        int64
+	CacheTimeout     string
+	CacheRedis       string
+	CacheMemory      int64
+	CacheMemoryBlob  int64
+	CacheWait        string
+	MaxCacheWait     string
+	MetadataTTL      string
+	CheckEvery       string
+	CheckSample      int
+	CheckReindex     bool
+	DisableV1        bool
+	V1Sunset         string
+	MaxTxBytes       int64
+	MaxTxFiles       int
+	SmallTxBytes     int64
+	SmallTxFiles     int
+	TxLanes          map[string]string
+	TxCallbacks      map[string][]string
+	TxTemplates      map[string][][]string
+	RateLimits       map[string]server.RateLimit
+	UploadQuotas     map[string]int64
+	UploadExpire     string
+	TransferQuotas   map[string]server.TransferQuota
+	StorageAlerts    []server.StorageAlert
+	StorageAlertURLs []string
+	StorageCheck     string
+	StorageGrowth    int
+	Exports          []exportConfig
+	CacheWarmCount   int
+	CacheWarmBytes   int64
+	CacheCopyBuffer  int
+	ClientCopyBuffer int
+	FastCopy         bool
+	HashCPU          float64
+	PortNumber       string
+	PProfPort        string
+	TLSCert          string
+	TLSKey           string
+	RedirectPort     string
+	ACMEHosts        []string
+	ACMECache        string
+	ACMEEmail        string
+	Mysql            string
+	DBMaxOpen        int
+	DBMaxIdle        int
+	DBLifetime       string
+	DBTimeout        string
+	DBSlowQuery      string
+	CowHost          string
+	CowToken         string
+	Minter           string
+	MinterPrefix     string
+}
+
+// ldapConfig describes an LDAP directory to check user names and passwords
+// against. It is used if URL is set.
+type ldapConfig struct {
+	URL            string
+	StartTLS       bool
+	CAFile         string
+	BindDN         string
+	BindPassword   string
+	BaseDN         string
+	UserAttribute  string
+	GroupAttribute string
+	Groups         map[string]string
+	CacheTime      string
+}
+
+// storeConfig describes a named store. Location is like StoreDir. A store
+// is used by naming it in ItemStore, UploadStore, TxStore, or the Store of a
+// cache, so one location may serve several purposes, and a deployment may
+// spread them over several.
+type storeConfig struct {
+	Location string
+}
+
+// cacheConfig describes a named blob cache. Either Redis is set, or the
+// cache is kept in the named Store. As with the CacheSize and CacheTimeout
+// options, Size is in MB and a Timeout chooses the time-based strategy.
+type cacheConfig struct {
+	Store   string
+	Redis   string
+	Size    int64
+	Timeout string
+}
+
+// exportConfig describes an external preservation service which the items
+// in a collection are sent to. See server.ExportTarget. Dest is a location
+// like StoreDir, usually the service's receiving bucket, and Every is how
+// often to look for items to send, daily by default.
+type exportConfig struct {
+	Name         string
+	Prefix       string
+	Institution  string
+	Organization string
+	Access       string
+	Storage      string
+	Dest         string
+	NotifyURL    string
+	Every        string
 }
 
 func main() {
@@ -42,34 +166,169 @@ func main() {
 	// Start with the Default values
 	config := &bendoConfig{
 		StoreDir:     ".",
+		StoreLock:    "",
+		StoreRetain:  "",
+		StoreLayout:  "",
+		StoreFormat:  "",
+		StoreParity:  "",
+		StoreDedup:   false,
 		Tokenfile:    "",
 		CacheDir:     "",
 		CacheSize:    100,
 		CacheTimeout: "",
+		CacheRedis:   "",
+		CacheWait:    "",
+		MaxCacheWait: "",
+		MetadataTTL:  "",
+		CheckEvery:   "",
+		CheckSample:  100,
+		CheckReindex: false,
+		DisableV1:    false,
+		V1Sunset:     "",
+		MaxTxBytes:   0,
+		MaxTxFiles:   0,
+		SmallTxBytes: 100000000,
+		SmallTxFiles: 10,
+		TxLanes:      nil,
+		TxCallbacks:  nil,
+		TxTemplates:  nil,
+		RateLimits:   nil,
+		UploadQuotas: nil,
+		UploadExpire: "",
 		PortNumber:   "14000",
 		PProfPort:    "14001",
+		TLSCert:      "",
+		TLSKey:       "",
+		RedirectPort: "",
+		ACMEHosts:    nil,
+		ACMECache:    "",
+		ACMEEmail:    "",
 		Mysql:        "",
+		DBMaxOpen:    0,
+		DBMaxIdle:    0,
+		DBLifetime:   "",
+		DBTimeout:    "",
+		DBSlowQuery:  "",
 		CowHost:      "",
 		CowToken:     "",
+		Minter:       "",
+		MinterPrefix: "",
 	}
 
 	var configFile = flag.String("config-file", "", "Configuration File")
+	var storeDir = flag.String("store", "", "Location of the preservation store. Overrides StoreDir in the configuration file")
+	var tlsCert = flag.String("tls-cert", "", "PEM certificate file to serve HTTPS with. Overrides TLSCert in the configuration file")
+	var tlsKey = flag.String("tls-key", "", "PEM private key file for the certificate. Overrides TLSKey in the configuration file")
+	var redirectPort = flag.String("redirect-port", "", "Port to redirect plain HTTP requests to HTTPS from. Overrides RedirectPort in the configuration file")
+	var logLevel = flag.String("loglevel", "info", "Least level of log messages to print: debug, info, warn, or error")
+	var logFormat = flag.String("logformat", "text", "Format of log messages: text or json")
+	var checkOnly = flag.Bool("check-config", false, "Check the configuration, report any problems, and exit")
+	var migrateDryRun = flag.Bool("migrate-dry-run", false, "Print the database schema migrations that would be applied, and exit")
+	var migrateLayout = flag.String("migrate-layout", "", "Move every item in the preservation store from the given layout to StoreLayout, and exit")
+	var repairItem = flag.String("repair-item", "", "Rebuild any damaged bundles of the given item from their parity files, and exit")
+	var recoverItem = flag.String("recover-item", "", "Rebuild the metadata of the given item from the bundles in the store after a crashed save, and exit")
+	var recoverDryRun = flag.Bool("recover-dry-run", false, "With -recover-item, only report what would be fixed")
 	flag.Parse()
+	handler, err := newLogHandler(os.Stderr, *logLevel, *logFormat)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	// this also sends anything written with the log package through handler
+	slog.SetDefault(slog.New(handler))
 	// If config file name is provided, try to open & decode it
 	if *configFile != "" {
 		log.Printf("Using config file %s\n", *configFile)
 		if _, err := toml.DecodeFile(*configFile, config); err != nil {
-			log.Println(err)
-			return
+			log.Fatalln(err)
+		}
+	}
+	if *storeDir != "" {
+		config.StoreDir = *storeDir
+	}
+	if *tlsCert != "" {
+		config.TLSCert = *tlsCert
+	}
+	if *tlsKey != "" {
+		config.TLSKey = *tlsKey
+	}
+	if *redirectPort != "" {
+		config.RedirectPort = *redirectPort
+	}
+
+	// find every configuration problem now, rather than one at a time
+	// when they are first used.
+	problems := checkConfig(config)
+	if *checkOnly {
+		reportProblems(os.Stdout, problems)
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	if len(problems) > 0 {
+		reportProblems(os.Stderr, problems)
+		log.Fatalln("Refusing to start")
+	}
+	if *migrateDryRun {
+		err := printMigrationPlan(os.Stdout, config)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	if *migrateLayout != "" {
+		from, err := items.ParseLayout(*migrateLayout)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		to, _ := items.ParseLayout(config.StoreLayout)
+		err = migrateItems(os.Stdout, parselocation(config.itemLocation(), ""), from, to)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	if *repairItem != "" {
+		s := items.New(parselocation(config.itemLocation(), ""))
+		layout, _ := items.ParseLayout(config.StoreLayout)
+		s.SetLayout(layout)
+		err := repairBundles(os.Stdout, s, *repairItem)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	if *recoverItem != "" {
+		s := items.New(parselocation(config.itemLocation(), ""))
+		layout, _ := items.ParseLayout(config.StoreLayout)
+		s.SetLayout(layout)
+		format, _ := items.ParseBundleFormat(config.StoreFormat)
+		s.SetBundleFormat(format)
+		err := recoverBundles(os.Stdout, s, *recoverItem, *recoverDryRun)
+		if err != nil {
+			log.Fatalln(err)
 		}
+		return
 	}
 
 	log.Println("==========")
 	log.Println("Starting Bendo Server version", server.Version)
 	log.Println("StoreDir =", config.StoreDir)
+	log.Println("ItemStore =", config.ItemStore)
+	log.Println("StoreLayout =", config.StoreLayout)
+	log.Println("StoreFormat =", config.StoreFormat)
+	log.Println("StoreParity =", config.StoreParity)
+	log.Println("StoreSegment =", config.StoreSegment)
+	log.Println("StoreBundleSize =", config.StoreBundleSize)
+	log.Println("StoreMasterKey =", config.StoreMasterKey)
+	log.Println("StoreRangeSize =", config.StoreRangeSize)
+	log.Println("StoreRangeReads =", config.StoreRangeReads)
+	log.Println("StoreVerifyReads =", config.StoreVerifyReads)
 	log.Println("CacheDir =", config.CacheDir)
 	log.Println("CacheSize =", config.CacheSize)
 	log.Println("CacheTimeout =", config.CacheTimeout)
+	log.Println("CacheRedis =", config.CacheRedis)
+	log.Println("CacheMemory =", config.CacheMemory)
 
 	// use the config values to set up the server
 	var s = &server.RESTServer{
@@ -77,6 +336,38 @@ func main() {
 		Validator:  nil,
 		PortNumber: config.PortNumber,
 		PProfPort:  config.PProfPort,
+		DisableV1:  config.DisableV1,
+		MaxTxBytes: config.MaxTxBytes,
+		MaxTxFiles: config.MaxTxFiles,
+
+		SmallTxBytes: config.SmallTxBytes,
+		SmallTxFiles: config.SmallTxFiles,
+		TxLanes:      config.TxLanes,
+		TxCallbacks:  config.TxCallbacks,
+		TxTemplates:  config.TxTemplates,
+		RateLimits:   config.RateLimits,
+		UploadQuotas: config.UploadQuotas,
+
+		TransferQuotas: config.TransferQuotas,
+
+		CacheCopyBuffer:  config.CacheCopyBuffer,
+		ClientCopyBuffer: config.ClientCopyBuffer,
+		FastCopy:         config.FastCopy,
+		HashCPU:          config.HashCPU,
+
+		TLSCertFile:  config.TLSCert,
+		TLSKeyFile:   config.TLSKey,
+		RedirectPort: config.RedirectPort,
+		ACMEHosts:    config.ACMEHosts,
+		ACMECacheDir: acmeCachePath(config),
+		ACMEEmail:    config.ACMEEmail,
+	}
+	if config.V1Sunset != "" {
+		var err error
+		s.V1Sunset, err = time.Parse("2006-01-02", config.V1Sunset)
+		if err != nil {
+			log.Fatalln("V1Sunset:", err)
+		}
 	}
 
 	// Use the config settings to update s.
@@ -88,19 +379,44 @@ func main() {
 	setupTransactionStore(config, s)
 	setupUploadStore(config, s)
 	setupDatabase(config, s)
+	setupMinter(config, s)
+	setupConsistency(config, s)
+	setupStorageAlerts(config, s)
+	setupExports(config, s)
+	setupRouteRoles(config, s)
+	s.Config = redactConfig(config)
 
 	// install signal handlers
 	sig := make(chan os.Signal, 5)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 	go signalHandler(sig, s)
 
-	err := s.Run()
+	err = s.Run()
 	if err != nil {
 		log.Println(err)
 	}
 	log.Println("Exiting")
 }
 
+// newLogHandler returns a log handler writing to w which drops messages
+// below the given level. The format is either "text" or "json".
+func newLogHandler(w io.Writer, level string, format string) (slog.Handler, error) {
+	var opts slog.HandlerOptions
+	var lvl slog.Level
+	err := lvl.UnmarshalText([]byte(level))
+	if err != nil {
+		return nil, err
+	}
+	opts.Level = lvl
+	switch format {
+	case "text":
+		return slog.NewTextHandler(w, &opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, &opts), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", format)
+}
+
 func signalHandler(sig <-chan os.Signal, svr *server.RESTServer) {
 	for s := range sig {
 		log.Println("---Received signal", s)
@@ -111,13 +427,112 @@ func signalHandler(sig <-chan os.Signal, svr *server.RESTServer) {
 	}
 }
 
+// setupMinter uses config to mutate s to add an item id minter, if one
+// is configured. It will panic on error.
+func setupMinter(config *bendoConfig, s *server.RESTServer) {
+	if config.Minter == "" {
+		return
+	}
+	log.Printf("Using %s minter with prefix %q", config.Minter, config.MinterPrefix)
+	minter, err := server.NewMinter(config.Minter, config.MinterPrefix)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	// keep the sequence in the database so it survives restarts
+	if sm, ok := minter.(*server.SequentialMinter); ok {
+		sm.DB = s.Mints
+	}
+	s.Minter = minter
+}
+
+// setupConsistency uses config to mutate s to enable the background
+// database consistency checker, if one is configured.
+func setupConsistency(config *bendoConfig, s *server.RESTServer) {
+	interval, _ := time.ParseDuration(config.CheckEvery)
+	if interval == 0 {
+		return
+	}
+	log.Printf("Checking consistency of %d items every %s", config.CheckSample, interval)
+	s.ConsistencyInterval = interval
+	s.ConsistencySample = config.CheckSample
+	s.ConsistencyReindex = config.CheckReindex
+}
+
+// setupStorageAlerts uses config to mutate s to check the size of the item
+// store against the storage alerts, if any are configured.
+func setupStorageAlerts(config *bendoConfig, s *server.RESTServer) {
+	if len(config.StorageAlerts) == 0 {
+		return
+	}
+	interval := time.Hour
+	if config.StorageCheck != "" {
+		interval, _ = time.ParseDuration(config.StorageCheck)
+	}
+	log.Printf("Checking %d storage alerts every %s", len(config.StorageAlerts), interval)
+	s.StorageAlerts = config.StorageAlerts
+	s.StorageAlertURLs = config.StorageAlertURLs
+	s.StorageCheckInterval = interval
+	s.StorageGrowthDays = config.StorageGrowth
+}
+
+// setupExports uses config to mutate s to send items to the configured
+// export targets, if any.
+func setupExports(config *bendoConfig, s *server.RESTServer) {
+	for _, e := range config.Exports {
+		interval := 24 * time.Hour
+		if e.Every != "" {
+			interval, _ = time.ParseDuration(e.Every)
+		}
+		dest := parselocation(e.Dest, "")
+		if dest == nil {
+			log.Fatalln("Exports: no location for", e.Name)
+		}
+		log.Printf("Exporting items beginning with %q to %s every %s", e.Prefix, e.Name, interval)
+		s.ExportTargets = append(s.ExportTargets, server.ExportTarget{
+			Name:         e.Name,
+			Prefix:       e.Prefix,
+			Institution:  e.Institution,
+			Organization: e.Organization,
+			Access:       e.Access,
+			Storage:      e.Storage,
+			Dest:         dest,
+			NotifyURL:    e.NotifyURL,
+			Interval:     interval,
+		})
+	}
+}
+
+// setupRouteRoles uses config to mutate s to change the roles needed to use
+// the given routes.
+func setupRouteRoles(config *bendoConfig, s *server.RESTServer) {
+	if len(config.RouteRoles) == 0 {
+		return
+	}
+	s.RouteRoles = make(map[string]server.Role)
+	for name, v := range config.RouteRoles {
+		role, _ := parseRole(v) // checked by checkConfig
+		log.Printf("Route %s needs role %s", name, role)
+		s.RouteRoles[name] = role
+	}
+}
+
 // setupItemStore uses config to mutate s to add the item store.
 // It will panic on error.
 func setupItemStore(config *bendoConfig, s *server.RESTServer) {
-	itemstore := parselocation(config.StoreDir, "")
+	itemstore := parselocation(config.itemLocation(), "")
 	if itemstore == nil {
 		log.Fatalln("no storage location")
 	}
+	if config.StoreRetain != "" {
+		policy := store.LockPolicy{Mode: config.StoreLock}
+		policy.Period, _ = time.ParseDuration(config.StoreRetain)
+		locker, ok := itemstore.(store.Locker)
+		if !ok {
+			log.Fatalln("StoreDir does not support locking")
+		}
+		log.Printf("Locking new bundles for %s, mode %q", policy.Period, policy.Mode)
+		locker.SetLockPolicy(policy)
+	}
 	if config.CowHost != "" {
 		log.Printf("Using COW with target %s", config.CowHost)
 		itemstore = store.NewCOW(itemstore, config.CowHost, config.CowToken)
@@ -127,7 +542,35 @@ func setupItemStore(config *bendoConfig, s *server.RESTServer) {
 		// the target bendo over time)
 		s.DisableFixity = true
 	}
-	s.Items = items.New(itemstore)
+	s.Items = items.New(store.NewMetered(itemstore, "tape"))
+	layout, _ := items.ParseLayout(config.StoreLayout) // checked by checkConfig
+	s.Items.SetLayout(layout)
+	format, _ := items.ParseBundleFormat(config.StoreFormat) // checked by checkConfig
+	s.Items.SetBundleFormat(format)
+	parity, _ := items.ParseParityScheme(config.StoreParity) // checked by checkConfig
+	s.Items.SetParity(parity)
+	s.Items.SetSegmentSize(config.StoreSegment * 1000000) // config is in MB
+	s.Items.SetBundlePolicy(items.SizePolicy{
+		Size:     config.StoreBundleSize * 1000000, // config is in MB
+		Fit:      config.StoreBundleFit,
+		MinCount: config.StoreBundleMin,
+	})
+	s.Items.SetVerifyReads(config.StoreVerifyReads)
+	if config.StoreRangeReads > 1 {
+		size := config.StoreRangeSize * 1000000 // config is in MB
+		if size <= 0 {
+			size = 16 * 1000000
+		}
+		s.Items.SetParallelReads(size, config.StoreRangeReads)
+	}
+	if config.StoreMasterKey != "" {
+		master, err := items.NewMasterKeyFile(config.StoreMasterKey)
+		if err != nil {
+			log.Fatalln("StoreMasterKey:", err)
+		}
+		log.Println("Encrypting new blobs")
+		s.Items.SetEncryption(master)
+	}
 }
 
 // setupTokens configures the token verification. It will panic on error.
@@ -139,23 +582,75 @@ func setupTokens(config *bendoConfig, s *server.RESTServer) {
 		if err != nil {
 			log.Fatalln(err)
 		}
-	} else {
+	} else if config.LDAP.URL == "" {
 		log.Printf("No user token file specified")
 		s.Validator = server.NobodyValidator{}
 	}
+	if config.LDAP.URL != "" {
+		log.Printf("Using LDAP directory %s\n", config.LDAP.URL)
+		v, err := newLDAPValidator(config.LDAP)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		// API keys from the token file are still accepted
+		v.Fallback = s.Validator
+		s.Validator = v
+	}
+}
+
+// newLDAPValidator makes the validator described by config.
+func newLDAPValidator(config ldapConfig) (*server.LDAPValidator, error) {
+	v, err := server.NewLDAPValidator(config.URL, config.BaseDN, config.Groups)
+	if err != nil {
+		return nil, err
+	}
+	v.StartTLS = config.StartTLS
+	v.BindDN = config.BindDN
+	v.BindPassword = config.BindPassword
+	if config.UserAttribute != "" {
+		v.UserAttribute = config.UserAttribute
+	}
+	if config.GroupAttribute != "" {
+		v.GroupAttribute = config.GroupAttribute
+	}
+	if config.CacheTime != "" {
+		v.CacheTime, err = time.ParseDuration(config.CacheTime)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", config.CAFile)
+		}
+		v.TLSConfig = &tls.Config{RootCAs: pool}
+	}
+	return v, nil
 }
 
 func setupCache(config *bendoConfig, s *server.RESTServer) {
-	timeout, _ := time.ParseDuration(config.CacheTimeout)
-	size := config.CacheSize * 1000000 // config is in MB
-	if config.CacheDir == "" || size == 0 {
+	cache, location := config.blobCache()
+	timeout, _ := time.ParseDuration(cache.Timeout)
+	s.CacheWait, _ = time.ParseDuration(config.CacheWait)
+	s.MaxCacheWait, _ = time.ParseDuration(config.MaxCacheWait)
+	size := cache.Size * 1000000 // config is in MB
+	if cache.Redis != "" {
+		log.Println("Using redis cache at", cache.Redis)
+		s.Cache = blobcache.NewRedis(cache.Redis, "bendo:blob:", size)
+	} else if location == "" || size == 0 {
 		log.Println("Not using blob cache")
 		s.Cache = blobcache.EmptyCache{}
 	} else {
-		v := parselocation(config.CacheDir, "blobcache")
+		v := parselocation(location, "blobcache")
 		if v == nil {
 			log.Fatalln("no location for cache")
 		}
+		v = store.NewMetered(v, "cache")
 		if timeout != 0 {
 			log.Println("Using time-based cache strategy")
 			s.Cache = blobcache.NewTime(v, timeout)
@@ -163,17 +658,33 @@ func setupCache(config *bendoConfig, s *server.RESTServer) {
 			log.Println("Using size-based cache strategy")
 			s.Cache = blobcache.NewLRU(v, size)
 		}
+		if config.CacheMemory > 0 {
+			memsize := config.CacheMemory * 1000000 // config is in MB
+			limit := config.CacheMemoryBlob
+			if limit == 0 {
+				limit = memsize / 8
+			}
+			log.Println("Using memory cache tier for blobs up to", limit, "bytes")
+			s.Cache = blobcache.NewTiered(blobcache.NewLRU(store.NewMemory(), memsize), s.Cache, limit)
+		}
+	}
+	// the warm list needs a local directory to be saved in
+	if _, ok := parselocation(config.CacheDir, "").(*store.FileSystem); ok {
+		s.WarmFile = filepath.Join(config.CacheDir, "warmlist.json")
+		s.WarmCount = config.CacheWarmCount
+		s.WarmBytes = config.CacheWarmBytes * 1000000 // config is in MB
 	}
 }
 
 func setupTransactionStore(config *bendoConfig, s *server.RESTServer) {
-	v := parselocation(config.CacheDir, "transaction")
+	v := parselocation(config.location(config.TxStore, config.CacheDir), "transaction")
 	s.TxStore = transaction.New(v)
 }
 
 func setupUploadStore(config *bendoConfig, s *server.RESTServer) {
-	v := parselocation(config.CacheDir, "upload")
-	s.FileStore = fragment.New(v)
+	v := parselocation(config.location(config.UploadStore, config.CacheDir), "upload")
+	s.FileStore = fragment.New(store.NewMetered(v, "fragment"))
+	s.UploadExpire, _ = time.ParseDuration(config.UploadExpire)
 }
 
 func setupDatabase(config *bendoConfig, s *server.RESTServer) {
@@ -181,21 +692,33 @@ func setupDatabase(config *bendoConfig, s *server.RESTServer) {
 		server.FixityDB
 		items.ItemCache
 		server.BlobDB
+		server.IdentifierDB
+		server.AccessDB
+		server.UsageDB
+		server.TombstoneDB
+		server.TokenDB
+		server.AuditDB
+		server.EventDB
+		server.MintDB
 	}
 	var err error
 	if config.Mysql != "" {
 		log.Printf("Using MySQL")
-		db, err = server.NewMysqlCache(config.Mysql)
+		var opts = server.DBOptions{
+			MaxOpenConns: config.DBMaxOpen,
+			MaxIdleConns: config.DBMaxIdle,
+		}
+		opts.ConnMaxLifetime, _ = time.ParseDuration(config.DBLifetime)
+		opts.Timeout, _ = time.ParseDuration(config.DBTimeout)
+		opts.SlowQuery, _ = time.ParseDuration(config.DBSlowQuery)
+		db, err = server.NewMysqlCacheOptions(config.Mysql, opts)
 	} else {
-		var path string
 		// this gets wonky if the cacheDir is an s3: path. but it still works!
 		// (it makes a file system directory named "s3:")
 		if config.CacheDir != "" {
 			os.MkdirAll(config.CacheDir, 0755)
-			path = filepath.Join(config.CacheDir, "bendo.ql")
-		} else {
-			path = "memory"
 		}
+		path := qlPath(config)
 		log.Println("Using internal database at", path)
 		db, err = server.NewQlCache(path)
 	}
@@ -203,6 +726,157 @@ func setupDatabase(config *bendoConfig, s *server.RESTServer) {
 		log.Fatalln("problem setting up database")
 	}
 	s.BlobDB = db
+	ttl, _ := time.ParseDuration(config.MetadataTTL)
+	if ttl > 0 {
+		log.Println("Caching blob metadata for", ttl)
+		s.BlobDB = server.NewBlobDBCache(db, ttl, 100000)
+	}
 	s.FixityDatabase = db
+	s.Identifiers = db
+	s.Access = db
+	s.Usage = db
+	s.Tombstones = db
+	s.Audit = db
+	s.Events = db
+	s.Mints = db
+	// tokens made through the API are checked before the token file
+	s.Tokens = db
+	s.Validator = &server.TokenDBValidator{DB: db, Fallback: s.Validator}
 	s.Items.SetCache(db)
+	if config.StoreDedup {
+		log.Println("Deduplicating blobs across items")
+		s.Items.SetBlobFinder(db)
+	}
+	// check references even with dedup off, since ones made earlier remain
+	s.Items.SetRefFinder(db)
+}
+
+// qlPath returns the file to keep the internal database in.
+func qlPath(config *bendoConfig) string {
+	if config.CacheDir == "" {
+		return "memory"
+	}
+	return filepath.Join(config.CacheDir, "bendo.ql")
+}
+
+// acmeCachePath returns the directory to keep ACME certificates in, or ""
+// to not keep them.
+func acmeCachePath(config *bendoConfig) string {
+	if config.ACMECache != "" || config.CacheDir == "" {
+		return config.ACMECache
+	}
+	return filepath.Join(config.CacheDir, "acme")
+}
+
+// printMigrationPlan writes the schema migrations opening the configured
+// database would apply, without applying them.
+func printMigrationPlan(w io.Writer, config *bendoConfig) error {
+	var plan server.MigrationPlan
+	var err error
+	if config.Mysql != "" {
+		opts := server.DBOptions{}
+		opts.Timeout, _ = time.ParseDuration(config.DBTimeout)
+		plan, err = server.PlanMysqlMigrations(config.Mysql, opts)
+	} else if config.CacheDir == "" {
+		fmt.Fprintln(w, "No CacheDir or Mysql given, so the database is created new each time")
+		return nil
+	} else {
+		plan, err = server.PlanQlMigrations(qlPath(config))
+	}
+	if err != nil {
+		return err
+	}
+	if plan.From == plan.To {
+		fmt.Fprintf(w, "Database schema is up to date at version %d\n", plan.To)
+		return nil
+	}
+	fmt.Fprintf(w, "Database schema would be migrated from version %d to %d:\n", plan.From, plan.To)
+	for _, s := range plan.Statements {
+		s = strings.TrimSuffix(strings.TrimSpace(s), ";")
+		fmt.Fprintf(w, "\n%s;\n", s)
+	}
+	return nil
+}
+
+// repairBundles rebuilds any damaged bundles of the given item in s from
+// their parity files, writing what was done to w.
+func repairBundles(w io.Writer, s *items.Store, id string) error {
+	repaired, err := s.RepairItem(id)
+	var bundles []int
+	for n := range repaired {
+		bundles = append(bundles, n)
+	}
+	sort.Ints(bundles)
+	for _, n := range bundles {
+		fmt.Fprintf(w, "%s bundle %d: rebuilt %d blocks\n", id, n, repaired[n])
+	}
+	if err == nil && len(bundles) == 0 {
+		fmt.Fprintf(w, "%s: no damaged bundles found\n", id)
+	}
+	return err
+}
+
+// recoverBundles rebuilds the metadata of the given item in s from its
+// bundles, writing what was found to w. Nothing is changed if dryrun is set.
+func recoverBundles(w io.Writer, s *items.Store, id string, dryrun bool) error {
+	result, err := s.Recover(id, dryrun)
+	if result != nil {
+		fmt.Fprintf(w, "%s: readable bundles %v, unreadable bundles %v\n", id, result.Bundles, result.Unreadable)
+		fmt.Fprintf(w, "%s: item-info.json in bundle %d records max bundle %d\n", id, result.InfoBundle, result.Recorded)
+		for _, bid := range result.Moved {
+			fmt.Fprintf(w, "%s blob %d: found in bundle %d\n", id, bid, result.Blobs[bid])
+		}
+		for _, bid := range result.Lost {
+			fmt.Fprintf(w, "%s blob %d: lost\n", id, bid)
+		}
+		switch {
+		case result.Fixed:
+			fmt.Fprintf(w, "%s: saved corrected item-info.json in bundle %d\n", id, result.MaxBundle)
+		case err != nil:
+		case dryrun:
+			fmt.Fprintf(w, "%s: dry run, nothing changed\n", id)
+		default:
+			fmt.Fprintf(w, "%s: nothing to fix\n", id)
+		}
+	}
+	return err
+}
+
+// migrateItems moves the bundles of every item in the store s from the
+// layout from to the layout to, writing its progress to w. An item which
+// cannot be moved is reported and skipped. Since each item is only deleted
+// from its old place once it has been copied, this may be run again to
+// finish an interrupted migration. The server should not be running.
+func migrateItems(w io.Writer, s store.Store, from, to items.Layout) error {
+	if s == nil {
+		return fmt.Errorf("no storage location")
+	}
+	old := items.New(s)
+	old.SetLayout(from)
+	target := items.New(s)
+	target.SetLayout(to)
+	// the walk lists everything first, so the items moved are not seen
+	// again under the new layout
+	var moved, failed int
+	_, err := old.Walk("", func(item items.WalkItem) error {
+		err := target.MigrateItem(item.ID, from)
+		if err != nil {
+			fmt.Fprintf(w, "%s: %s\n", item.ID, err)
+			failed++
+			return nil
+		}
+		moved++
+		if moved%1000 == 0 {
+			fmt.Fprintf(w, "Moved %d items so far\n", moved)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Moved %d items\n", moved)
+	if failed > 0 {
+		return fmt.Errorf("%d items could not be moved", failed)
+	}
+	return nil
 }
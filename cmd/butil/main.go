@@ -37,6 +37,8 @@ Possible commands:
 
     set <item id> <file/directory list>
 
+    export <item id> <target directory>
+
     identify-missing-blobs
 
     fix-missing-blobs <item id list>
@@ -69,6 +71,8 @@ func main() {
 		doadd(r, args[1], args[2:], true)
 	case "delete":
 		dodelete(r, args[1], args[2:])
+	case "export":
+		doexport(r, args[1], args[2])
 	case "identify-missing-blobs":
 		doidentifymissingblobs(r)
 	case "fix-missing-blobs":
@@ -166,6 +170,15 @@ func dolist(r *items.Store) {
 	}
 }
 
+// doexport writes a reproducible copy of the item into the storage directory
+// target. Exporting the same item twice gives byte-identical bundles.
+func doexport(r *items.Store, id string, target string) {
+	err := r.Export(id, store.NewFileSystem(target))
+	if err != nil {
+		fmt.Printf("%s: Error %s\n", id, err.Error())
+	}
+}
+
 // add all the files to this item. Directories are automatically recursed into.
 // Files and directories which begin with a dot are skipped.
 func doadd(r *items.Store, id string, files []string, isset bool) {
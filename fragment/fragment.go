@@ -3,12 +3,17 @@
 // to tape as a single unit. Files are intended to be uploaded as consecutive
 // pieces, of arbitrary size. If a fragment upload does not complete or has
 // and error, that fragment is deleted, and the upload can try again.
+// Pieces may also be given the offset in the file where they go, in which
+// case they may be uploaded in any order, or at the same time, and are put
+// back in order when the file is read.
 package fragment
 
 import (
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"sort"
 	"sync"
 	"time"
 
@@ -22,8 +27,14 @@ import (
 type Store struct {
 	mstore JSONStore    // for the metadata
 	fstore store.Store  // for the file fragments
+	base   store.Store  // the store holding both
 	m      sync.RWMutex // protects everything below
 	files  map[string]*file
+	done   chan struct{} // closed to stop the janitor, nil if none is running
+
+	qm    sync.Mutex                 // protects everything below
+	quota func(creator string) int64 // nil if there are no quotas
+	used  map[string]int64           // bytes held by each creator
 }
 
 const (
@@ -45,9 +56,24 @@ type FileEntry interface {
 	// Return a writer which will append a new block to this file.
 	Append() (io.WriteCloser, error)
 
-	// Open the file for reading from the very beginning
+	// AppendAt returns a writer which will add a new block to this file
+	// beginning at the given offset. Blocks may be written in any order,
+	// and more than one may be written at the same time. A block replaces
+	// any block already at the same offset, so a failed block may be sent
+	// again. Closing the writer returns ErrOverlap, and the block is
+	// discarded, if it overlaps any other block. If md5 or sha256 are
+	// given and the block does not match them, it is discarded and Close
+	// returns ErrChecksum.
+	AppendAt(offset int64, md5, sha256 []byte) (io.WriteCloser, error)
+
+	// Open the file for reading from the very beginning. Reading a file
+	// which has a gap between its blocks returns ErrGap.
 	Open() io.ReadCloser
 
+	// OpenAt opens the file for reading at any offset, for formats such
+	// as zip files which are not read in order.
+	OpenAt() store.ReadAtCloser
+
 	// Stat returns information about this file
 	Stat() Stat
 
@@ -80,7 +106,8 @@ type FileEntry interface {
 // Stat contains the metadata for a file entry.
 type Stat struct {
 	ID         string
-	Size       int64
+	Size       int64 // the total size of the blocks written
+	Length     int64 // the end of the last block, the same as Size unless blocks are missing
 	NFragments int
 	Created    time.Time
 	Modified   time.Time
@@ -98,7 +125,7 @@ type file struct {
 	ID       string       // name in the parent.fstore
 	Size     int64        // sum of all the children sizes
 	N        int          // the id number to use for the next fragment
-	Children []*fragment  // Children ids, in the order to read them.
+	Children []*fragment  // Children ids, in the order they were written.
 	Created  time.Time    // time this record was created
 	Modified time.Time    // last time this record was modified
 	Creator  string       // the "user" (aka API key) who created this file
@@ -106,22 +133,67 @@ type file struct {
 	SHA256   []byte       // expected hash for entire file
 	MimeType string       // the mime type of the file
 	Extra    string       // arbitrary user defined content
+	pending  int64        // bytes in fragments being written
+	deleted  bool         // true once the file has been deleted
 }
 
 // An individual fragment of a file
 type fragment struct {
-	ID   string // the id of this fragment in the fstore
-	Size int64  // the size of this fragment in bytes
+	ID     string // the id of this fragment in the fstore
+	Size   int64  // the size of this fragment in bytes
+	Offset int64  // where this fragment begins in the file
+	MD5    []byte // the hash of the fragment when written. nil for fragments written before these were kept
+	SHA256 []byte
+}
+
+var (
+	// ErrChecksum means the content of a fragment read back does not have
+	// the size or checksums it had when it was written, or that a fragment
+	// being written does not have the checksums it was expected to have.
+	ErrChecksum = errors.New("fragment does not match its size or checksums")
+
+	// ErrOverlap means a fragment written at an offset overlaps another
+	// fragment of the file.
+	ErrOverlap = errors.New("fragment overlaps another fragment")
+
+	// ErrGap means a file is missing the content at some offset, because
+	// the fragment which covers it has not been written.
+	ErrGap = errors.New("file is missing a fragment")
+)
+
+// A FragmentError is an error reading a particular fragment of a file.
+type FragmentError struct {
+	File     string // the id of the file
+	Fragment string // the id of the fragment in the store
+	Err      error
 }
 
+func (e *FragmentError) Error() string {
+	return fmt.Sprintf("file %s fragment %s: %s", e.File, e.Fragment, e.Err)
+}
+
+func (e *FragmentError) Unwrap() error { return e.Err }
+
 // New creates a new fragment store wrapping a store.Store. Call Load() before
 // using the store.
 func New(s store.Store) *Store {
 	return &Store{
 		mstore: NewJSON(store.NewWithPrefix(s, fileKeyPrefix)),
 		fstore: store.NewWithPrefix(s, fragmentKeyPrefix),
+		base:   s,
 		files:  make(map[string]*file),
+		used:   make(map[string]int64),
+	}
+}
+
+// FreeSpace returns the number of bytes which may still be written to the
+// underlying store. It returns store.ErrNotSupported if the underlying
+// store cannot tell.
+func (s *Store) FreeSpace() (int64, error) {
+	if fs, ok := s.base.(store.FreeSpacer); ok {
+		return fs.FreeSpace()
 	}
+	return 0, store.ErrNotSupported
 }
 
 // Load initializes the in-memory indexing and caches for the stored file
@@ -142,7 +214,9 @@ func (s *Store) Load() error {
 			return err
 		}
 		f.parent = s
+		f.fixOffsets()
 		s.files[f.ID] = f
+		s.charge(f.Creator, f.Size)
 	}
 	return nil
 }
@@ -205,6 +279,11 @@ func (s *Store) Delete(id string) error {
 		return nil
 	}
 
+	f.m.Lock()
+	f.release(f.Size + f.pending)
+	f.deleted = true
+	f.m.Unlock()
+
 	// don't need the lock for the following
 	err := s.mstore.Delete(f.ID)
 	for _, child := range f.Children {
@@ -216,12 +295,79 @@ func (s *Store) Delete(id string) error {
 	return err
 }
 
+// Expire deletes every file which has not been modified since cutoff, except
+// those in keep. It returns the ids of the files deleted. An error deleting
+// one file does not stop the others from being deleted; the first error is
+// returned.
+func (s *Store) Expire(cutoff time.Time, keep map[string]bool) ([]string, error) {
+	var deleted []string
+	var err error
+	for _, id := range s.List() {
+		f := s.Lookup(id)
+		if f == nil || keep[id] || f.Stat().Modified.After(cutoff) {
+			continue
+		}
+		err2 := s.Delete(id)
+		if err2 != nil {
+			slog.Error("fragment expire", "file", id, "error", err2)
+			if err == nil {
+				err = err2
+			}
+			continue
+		}
+		deleted = append(deleted, id)
+	}
+	return deleted, err
+}
+
+// StartJanitor starts a goroutine which, every interval, deletes the files
+// which have not been modified for maxAge, so abandoned uploads do not
+// accumulate. Before each pass it calls inUse to get the ids of files which
+// must be kept however old they are, such as those a transaction refers to.
+// inUse may be nil. Call StopJanitor to stop the goroutine. Only one janitor
+// may be running at a time.
+func (s *Store) StartJanitor(maxAge, interval time.Duration, inUse func() map[string]bool) {
+	done := make(chan struct{})
+	s.m.Lock()
+	s.done = done
+	s.m.Unlock()
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(interval):
+			}
+			var keep map[string]bool
+			if inUse != nil {
+				keep = inUse()
+			}
+			deleted, _ := s.Expire(time.Now().Add(-maxAge), keep)
+			for _, id := range deleted {
+				slog.Info("fragment janitor: removed file", "file", id)
+			}
+		}
+	}()
+}
+
+// StopJanitor stops the goroutine started by StartJanitor. A pass which is
+// running is finished first. It does nothing if no janitor is running.
+func (s *Store) StopJanitor() {
+	s.m.Lock()
+	if s.done != nil {
+		close(s.done)
+		s.done = nil
+	}
+	s.m.Unlock()
+}
+
 func (f *file) Stat() Stat {
 	f.m.RLock()
 	defer f.m.RUnlock()
 	return Stat{
 		ID:         f.ID,
 		Size:       f.Size,
+		Length:     f.end(),
 		NFragments: len(f.Children),
 		Created:    f.Created,
 		Modified:   f.Modified,
@@ -243,80 +389,335 @@ func (f *file) Append() (io.WriteCloser, error) {
 	if err != nil {
 		return nil, err
 	}
-	frag := &fragment{ID: fragkey}
-	return &fragwriter{frag: frag, parent: f, w: w}, nil
+	frag := &fragment{ID: fragkey, Offset: -1}
+	return &fragwriter{frag: frag, parent: f, w: w, hw: util.NewHashWriterPlain()}, nil
+}
+
+// AppendAt opens a writer for a block of the file beginning at offset.
+func (f *file) AppendAt(offset int64, md5, sha256 []byte) (io.WriteCloser, error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("fragment: negative offset %d", offset)
+	}
+	w, err := f.Append()
+	if err != nil {
+		return nil, err
+	}
+	fw := w.(*fragwriter)
+	fw.frag.Offset = offset
+	fw.md5 = md5
+	fw.sha256 = sha256
+	return fw, nil
+}
+
+// end returns the offset just past the last fragment of the file.
+// must hold a lock on f to call this
+func (f *file) end() int64 {
+	var end int64
+	for _, frag := range f.Children {
+		if e := frag.Offset + frag.Size; e > end {
+			end = e
+		}
+	}
+	return end
+}
+
+// fixOffsets gives each fragment of a file saved before fragments had
+// offsets the offset following the one before it. These files have every
+// offset zero. Files written since then can only have more than one fragment
+// at offset zero if all but one are empty, and for them this changes nothing
+// which matters.
+func (f *file) fixOffsets() {
+	for _, frag := range f.Children {
+		if frag.Offset != 0 {
+			return
+		}
+	}
+	var offset int64
+	for _, frag := range f.Children {
+		frag.Offset = offset
+		offset += frag.Size
+	}
+}
+
+// add puts the fragment written by a fragwriter into the file. Fragments
+// written by Append go at the end of the file. Fragments written by AppendAt
+// replace any fragments at the same offset, and are refused if they overlap
+// any other. The fragments replaced are returned so they can be deleted.
+// must hold a write lock on f to call this
+func (f *file) add(frag *fragment) ([]*fragment, error) {
+	if frag.Offset < 0 {
+		frag.Offset = f.end()
+		f.Children = append(f.Children, frag)
+		f.Size += frag.Size
+		return nil, nil
+	}
+	var replaced []*fragment
+	var kept []*fragment
+	end := frag.Offset + frag.Size
+	for _, c := range f.Children {
+		if c.Offset == frag.Offset {
+			replaced = append(replaced, c)
+			continue
+		}
+		if c.Offset < end && frag.Offset < c.Offset+c.Size {
+			return nil, ErrOverlap
+		}
+		kept = append(kept, c)
+	}
+	f.Children = append(kept, frag)
+	f.Size += frag.Size
+	for _, c := range replaced {
+		f.Size -= c.Size
+	}
+	return replaced, nil
+}
+
+// ordered returns a copy of the fragments of the file in the order they are
+// to be read, or ErrGap if there is a part of the file no fragment covers.
+// must hold a lock on f to call this
+func (f *file) ordered() ([]fragment, error) {
+	var list = make([]fragment, len(f.Children))
+	for i := range f.Children {
+		list[i] = *f.Children[i]
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Offset < list[j].Offset })
+	var offset int64
+	for _, frag := range list {
+		if frag.Offset > offset {
+			return nil, &FragmentError{File: f.ID, Fragment: frag.ID, Err: ErrGap}
+		}
+		offset += frag.Size
+	}
+	return list, nil
 }
 
 // A fragwriter is used to write a fragment that will be appended to a file
 type fragwriter struct {
 	w    io.WriteCloser
 	size int64
+	hw   *util.HashWriter // the checksums of what has been written
+	err  error            // the first error writing, if any
+	// the checksums the fragment is expected to have, if given
+	md5    []byte
+	sha256 []byte
 	// must hold lock in parent to access these
 	parent *file
 	frag   *fragment // make it easy to update when we are closed
 }
 
+// Write counts what is written against the quota of the file's creator
+// before writing it. Once a write fails nothing more is written, and the
+// fragment is discarded when the writer is closed.
 func (fw *fragwriter) Write(p []byte) (int, error) {
+	if fw.err != nil {
+		return 0, fw.err
+	}
+	fw.parent.m.Lock()
+	err := fw.parent.reserve(int64(len(p)))
+	fw.parent.m.Unlock()
+	if err != nil {
+		fw.err = err
+		return 0, err
+	}
 	n, err := fw.w.Write(p)
+	fw.hw.Write(p[:n])
 	fw.size += int64(n)
+	if n < len(p) {
+		fw.parent.m.Lock()
+		fw.parent.pending -= int64(len(p) - n)
+		fw.parent.release(int64(len(p) - n))
+		fw.parent.m.Unlock()
+	}
+	if err != nil {
+		fw.err = err
+	}
 	return n, err
 }
 
 func (fw *fragwriter) Close() error {
 	err := fw.w.Close()
 	if err == nil {
-		fw.parent.m.Lock()
-		fw.parent.Size += fw.size
-		fw.frag.Size = fw.size
-		fw.parent.Children = append(fw.parent.Children, fw.frag)
-		err = fw.parent.save()
+		err = fw.err
+	}
+	var ok bool
+	fw.frag.Size = fw.size
+	fw.frag.MD5, ok = fw.hw.CheckMD5(fw.md5)
+	if ok {
+		fw.frag.SHA256, ok = fw.hw.CheckSHA256(fw.sha256)
+	}
+	if err == nil && !ok {
+		err = ErrChecksum
+	}
+	fstore := fw.parent.parent.fstore
+	fw.parent.m.Lock()
+	fw.parent.pending -= fw.size
+	if err != nil {
+		fw.parent.release(fw.size)
 		fw.parent.m.Unlock()
+		fstore.Delete(fw.frag.ID)
+		return err
+	}
+	replaced, err := fw.parent.add(fw.frag)
+	if err == ErrOverlap {
+		fw.parent.release(fw.size)
+		fw.parent.m.Unlock()
+		fstore.Delete(fw.frag.ID)
+		return err
+	}
+	for _, c := range replaced {
+		fw.parent.release(c.Size)
+	}
+	err = fw.parent.save()
+	fw.parent.m.Unlock()
+	for _, c := range replaced {
+		fstore.Delete(c.ID)
 	}
 	return err
 }
 
-// Open a file for reading from the beginning.
+// Open a file for reading from the beginning. Each fragment is checked
+// against the size and checksums it had when it was written as it is read,
+// and a mismatch is reported, as a *FragmentError wrapping ErrChecksum, when
+// the end of the fragment is reached, before any of the next one is read.
 func (f *file) Open() io.ReadCloser {
 	f.m.RLock()
 	defer f.m.RUnlock()
-	var list = make([]string, len(f.Children))
-	for i := range f.Children {
-		list[i] = f.Children[i].ID
-	}
+	list, err := f.ordered()
 	return &fragreader{
-		s:    f.parent.fstore,
-		keys: list,
+		s:     f.parent.fstore,
+		id:    f.ID,
+		frags: list,
+		err:   err,
 	}
 }
 
-// fragreader provides an io.Reader which will span a list of keys.
+// OpenAt opens the file for reading at any offset.
+func (f *file) OpenAt() store.ReadAtCloser {
+	f.m.RLock()
+	defer f.m.RUnlock()
+	list, err := f.ordered()
+	return &fragreaderAt{
+		s:     f.parent.fstore,
+		frags: list,
+		err:   err,
+	}
+}
+
+// fragreaderAt provides an io.ReaderAt which spans a list of fragments. Like
+// fragreader, at most one fragment is open at a time.
+type fragreaderAt struct {
+	s     store.Store
+	frags []fragment
+	err   error              // returned by every read, if the file has a gap
+	m     sync.Mutex         // protects everything below
+	r     store.ReadAtCloser // nil if no reader is open
+	n     int                // the index of the fragment r reads
+}
+
+func (fr *fragreaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if fr.err != nil {
+		return 0, fr.err
+	}
+	fr.m.Lock()
+	defer fr.m.Unlock()
+	var total int
+	// find the fragment holding off
+	var start int64
+	i := 0
+	for ; i < len(fr.frags) && off >= start+fr.frags[i].Size; i++ {
+		start += fr.frags[i].Size
+	}
+	for len(p) > 0 && i < len(fr.frags) {
+		if fr.r == nil || fr.n != i {
+			if fr.r != nil {
+				fr.r.Close()
+			}
+			var err error
+			fr.r, _, err = fr.s.Open(fr.frags[i].ID)
+			if err != nil {
+				fr.r = nil
+				return total, err
+			}
+			fr.n = i
+		}
+		want := p
+		if remain := start + fr.frags[i].Size - off; int64(len(want)) > remain {
+			want = want[:remain]
+		}
+		n, err := fr.r.ReadAt(want, off-start)
+		total += n
+		off += int64(n)
+		p = p[n:]
+		if err != nil && err != io.EOF {
+			return total, err
+		}
+		if n < len(want) {
+			return total, io.ErrUnexpectedEOF
+		}
+		start += fr.frags[i].Size
+		i++
+	}
+	if len(p) > 0 {
+		return total, io.EOF
+	}
+	return total, nil
+}
+
+func (fr *fragreaderAt) Close() error {
+	fr.m.Lock()
+	defer fr.m.Unlock()
+	if fr.r != nil {
+		err := fr.r.Close()
+		fr.r = nil
+		return err
+	}
+	return nil
+}
+
+// fragreader provides an io.Reader which will span a list of fragments.
 // Each fragment is opened and closed in turn, so there is at most one
 // file descriptor open at any time.
 type fragreader struct {
-	s      store.Store        // the store containing the keys
-	keys   []string           // next one to open is at index 0
+	s      store.Store        // the store containing the fragments
+	id     string             // the file being read
+	frags  []fragment         // next one to open is at index 0
+	err    error              // returned by every read, if the file has a gap
+	cur    fragment           // the fragment r reads
 	r      store.ReadAtCloser // nil if no reader is open
 	offset int64              // offset into r to read from next
+	hw     *util.HashWriter   // the checksums of what has been read from r
 }
 
 func (fr *fragreader) Read(p []byte) (int, error) {
-	for len(fr.keys) > 0 || fr.r != nil {
+	if fr.err != nil {
+		return 0, fr.err
+	}
+	for len(fr.frags) > 0 || fr.r != nil {
 		var err error
 		if fr.r == nil {
 			// open a new reader
-			fr.r, _, err = fr.s.Open(fr.keys[0])
+			fr.cur = fr.frags[0]
+			fr.r, _, err = fr.s.Open(fr.cur.ID)
 			if err != nil {
-				return 0, err
+				return 0, &FragmentError{File: fr.id, Fragment: fr.cur.ID, Err: err}
 			}
 			fr.offset = 0
-			fr.keys = fr.keys[1:]
+			fr.hw = util.NewHashWriterPlain()
+			fr.frags = fr.frags[1:]
 		}
 		n, err := fr.r.ReadAt(p, fr.offset)
 		fr.offset += int64(n)
+		fr.hw.Write(p[:n])
+		if fr.offset > fr.cur.Size {
+			return n, fr.mismatch()
+		}
 		if err == io.EOF {
 			// need to check rest of list before sending EOF
 			err = fr.r.Close()
 			fr.r = nil
+			if !fr.verified() {
+				return n, fr.mismatch()
+			}
 		}
 		if n > 0 || err != nil {
 			return n, err
@@ -325,6 +726,26 @@ func (fr *fragreader) Read(p []byte) (int, error) {
 	return 0, io.EOF
 }
 
+// verified returns true if everything in the current fragment has been read
+// and it has the size and checksums recorded for it. Fragments written
+// before checksums were kept only have their size checked.
+func (fr *fragreader) verified() bool {
+	if fr.offset != fr.cur.Size {
+		return false
+	}
+	_, ok := fr.hw.CheckMD5(fr.cur.MD5)
+	if ok {
+		_, ok = fr.hw.CheckSHA256(fr.cur.SHA256)
+	}
+	return ok
+}
+
+// mismatch returns the error for a current fragment which does not match its
+// size or checksums.
+func (fr *fragreader) mismatch() error {
+	return &FragmentError{File: fr.id, Fragment: fr.cur.ID, Err: ErrChecksum}
+}
+
 func (fr *fragreader) Close() error {
 	if fr.r != nil {
 		return fr.r.Close()
@@ -335,12 +756,15 @@ func (fr *fragreader) Close() error {
 // Remove the last fragment from this file. This is everything written during
 // using the Writer gotten from the most recent call to Append.
 // If called more than once, it will keep removing previous Append'ed blocks,
-// until the file is empty.
+// until the file is empty. Rolling back an empty file does nothing.
 // Returns an error if there was a problem deleting the most recent fragment.
 func (f *file) Rollback() error {
 	f.m.Lock()
 	defer f.m.Unlock()
 	n := len(f.Children) - 1
+	if n < 0 {
+		return nil
+	}
 	frag := f.Children[n]
 	err := f.parent.fstore.Delete(frag.ID)
 	if err != nil {
@@ -348,6 +772,7 @@ func (f *file) Rollback() error {
 	}
 	f.Children = f.Children[:n]
 	f.Size -= frag.Size
+	f.release(frag.Size)
 	return f.save()
 }
 
@@ -361,7 +786,7 @@ func (f *file) save() error {
 func (f *file) saveAndLog() {
 	err := f.save()
 	if err != nil {
-		log.Println(f.ID, err)
+		slog.Error("saving file", "file", f.ID, "error", err)
 	}
 }
 
@@ -374,15 +799,19 @@ func (f *file) Verify() (bool, error) {
 	result, err := util.VerifyStreamHash(r, f.MD5, f.SHA256)
 	err2 := r.Close()
 	if err2 != nil {
-		log.Println(f.ID, err2)
+		slog.Error("closing file", "file", f.ID, "error", err2)
 	}
 	return result, err
 }
 
+// SetCreator also moves the bytes in the file from the quota of its old
+// creator to that of the new one, even if that puts them over their quota.
 func (f *file) SetCreator(name string) {
 	f.m.Lock()
 	defer f.m.Unlock()
+	f.release(f.Size + f.pending)
 	f.Creator = name
+	f.release(-(f.Size + f.pending))
 	f.saveAndLog()
 }
 
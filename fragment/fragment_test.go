@@ -1,9 +1,14 @@
 package fragment
 
 import (
+	"errors"
+	"io"
 	"io/ioutil"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/ndlib/bendo/store"
 )
@@ -17,6 +22,9 @@ func TestFileWriting(t *testing.T) {
 		{"b", "two ^writes"},
 		{"c", "a write|and ^append"},
 		{"d", "quite a number| of appends| in a row^maybe some^extra|writes for good measure"},
+		{"e", ""},
+		{"f", "||"},
+		{"g", "empty||appends"},
 	}
 	memory := store.NewMemory()
 	registry := New(memory)
@@ -100,6 +108,25 @@ func readAndCheck(t *testing.T, f FileEntry, expected string) {
 	if err != nil {
 		t.Errorf("Received error %s", err.Error())
 	}
+
+	// read it again from every offset using OpenAt
+	ra := f.OpenAt()
+	for off := 0; off < len(expected); off++ {
+		buf := make([]byte, len(expected)-off)
+		n, err := ra.ReadAt(buf, int64(off))
+		if err != nil || string(buf[:n]) != expected[off:] {
+			t.Errorf("ReadAt(%d) = %q, %v, expected %q", off, buf[:n], err, expected[off:])
+		}
+	}
+	buf := make([]byte, 5)
+	_, err = ra.ReadAt(buf, fstat.Size)
+	if err != io.EOF {
+		t.Errorf("ReadAt past the end received %v, expected EOF", err)
+	}
+	err = ra.Close()
+	if err != nil {
+		t.Errorf("Received error %s", err.Error())
+	}
 }
 
 func TestRollback(t *testing.T) {
@@ -133,6 +160,23 @@ func TestRollback(t *testing.T) {
 	}
 }
 
+func TestRollbackEmpty(t *testing.T) {
+	// rolling back a file with no fragments should be harmless
+	registry := New(store.NewMemory())
+	f := registry.New("empty")
+	err := f.Rollback()
+	if err != nil {
+		t.Errorf("received %s, expected nil", err.Error())
+	}
+	insertString(t, f, "")
+	f.Rollback()
+	err = f.Rollback()
+	if err != nil {
+		t.Errorf("received %s, expected nil", err.Error())
+	}
+	readAndCheck(t, f, "")
+}
+
 func TestLargeFile(t *testing.T) {
 	memory := store.NewMemory()
 	registry := New(memory)
@@ -172,3 +216,224 @@ func TestLookupUnknown(t *testing.T) {
 		t.Errorf("Lookup returned %#v, expected nil", f)
 	}
 }
+
+func TestExpire(t *testing.T) {
+	memory := store.NewMemory()
+	registry := New(memory)
+	registry.Load()
+	old := time.Now().Add(-time.Hour)
+	for _, id := range []string{"new", "old", "kept"} {
+		f := registry.New(id)
+		insertString(t, f, "content for "+id)
+		if id != "new" {
+			f.(*file).Modified = old
+		}
+	}
+	deleted, err := registry.Expire(time.Now().Add(-time.Minute), map[string]bool{"kept": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0] != "old" {
+		t.Errorf("Expire() deleted %v, expected [old]", deleted)
+	}
+	list := registry.List()
+	sort.Strings(list)
+	if strings.Join(list, " ") != "kept new" {
+		t.Errorf("Received files %v, expected [kept new]", list)
+	}
+
+	// the janitor removes kept once it is no longer in use
+	registry.StartJanitor(time.Minute, time.Millisecond, nil)
+	defer registry.StopJanitor()
+	for i := 0; i < 100 && registry.Lookup("kept") != nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if registry.Lookup("kept") != nil || registry.Lookup("new") == nil {
+		t.Errorf("Received files %v, expected [new]", registry.List())
+	}
+}
+
+func TestCorruptFragment(t *testing.T) {
+	registry := New(store.NewMemory())
+	f := registry.New("corrupt")
+	insertString(t, f, "first fragment|second fragment|third fragment")
+	// replace the middle fragment with something the same size
+	key := f.(*file).Children[1].ID
+	registry.fstore.Delete(key)
+	w, err := registry.fstore.Create(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "SECOND FRAGMENT")
+	w.Close()
+
+	_, err = ioutil.ReadAll(f.Open())
+	var ferr *FragmentError
+	if !errors.As(err, &ferr) || !errors.Is(err, ErrChecksum) {
+		t.Fatalf("Received %v, expected a checksum error", err)
+	}
+	if ferr.Fragment != key {
+		t.Errorf("Received fragment %s, expected %s", ferr.Fragment, key)
+	}
+
+	// a fragment which is shorter than when written is also caught
+	registry.fstore.Delete(key)
+	w, _ = registry.fstore.Create(key)
+	io.WriteString(w, "second")
+	w.Close()
+	_, err = ioutil.ReadAll(f.Open())
+	if !errors.Is(err, ErrChecksum) {
+		t.Errorf("Received %v, expected a checksum error", err)
+	}
+}
+
+func appendAt(f FileEntry, offset int64, text string, md5 []byte) error {
+	w, err := f.AppendAt(offset, md5, nil)
+	if err != nil {
+		return err
+	}
+	io.WriteString(w, text)
+	return w.Close()
+}
+
+func TestAppendAt(t *testing.T) {
+	memory := store.NewMemory()
+	registry := New(memory)
+	f := registry.New("chunks")
+	chunks := []string{"0123", "4567", "89ab", "cd"}
+	// write them concurrently, and the last one first
+	var wg sync.WaitGroup
+	for i := len(chunks) - 1; i >= 0; i-- {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := appendAt(f, int64(4*i), chunks[i], nil)
+			if err != nil {
+				t.Errorf("chunk %d: received %v", i, err)
+			}
+		}(i)
+		if i == len(chunks)-1 {
+			wg.Wait()
+		}
+	}
+	wg.Wait()
+	readAndCheck(t, f, "0123456789abcd")
+
+	// a chunk sent again replaces the first one
+	err := appendAt(f, 4, "4567", nil)
+	if err != nil {
+		t.Errorf("resending chunk: received %v", err)
+	}
+	if n := f.Stat().NFragments; n != 4 {
+		t.Errorf("Received %d fragments, expected 4", n)
+	}
+	// but one overlapping another is refused
+	err = appendAt(f, 6, "xxxx", nil)
+	if err != ErrOverlap {
+		t.Errorf("overlapping chunk: received %v, expected %v", err, ErrOverlap)
+	}
+	// as is one which does not match its checksum
+	err = appendAt(f, 14, "ef", []byte("not the md5 of anything"))
+	if err != ErrChecksum {
+		t.Errorf("bad chunk: received %v, expected %v", err, ErrChecksum)
+	}
+	keys, _ := memory.ListPrefix(fragmentKeyPrefix)
+	if len(keys) != 4 {
+		t.Errorf("Received fragments %v, expected 4", keys)
+	}
+
+	// the order survives a reload
+	registry = New(memory)
+	registry.Load()
+	f = registry.Lookup("chunks")
+	readAndCheck(t, f, "0123456789abcd")
+
+	// a file missing a chunk cannot be read
+	g := registry.New("gap")
+	appendAt(g, 0, "0123", nil)
+	appendAt(g, 8, "89ab", nil)
+	if stat := g.Stat(); stat.Size != 8 || stat.Length != 12 {
+		t.Errorf("Received size %d length %d, expected 8 and 12", stat.Size, stat.Length)
+	}
+	_, err = ioutil.ReadAll(g.Open())
+	if !errors.Is(err, ErrGap) {
+		t.Errorf("Received %v, expected %v", err, ErrGap)
+	}
+	appendAt(g, 4, "4567", nil)
+	readAndCheck(t, g, "0123456789ab")
+	// Append adds to the end
+	insertString(t, g, "cd")
+	readAndCheck(t, g, "0123456789abcd")
+}
+
+func TestLegacyOffsets(t *testing.T) {
+	// files saved before fragments had offsets are read in the order
+	// their fragments were written
+	memory := store.NewMemory()
+	registry := New(memory)
+	f := registry.New("legacy")
+	insertString(t, f, "first|second||third")
+	for _, c := range f.(*file).Children {
+		c.Offset = 0
+	}
+	f.(*file).save()
+	registry = New(memory)
+	registry.Load()
+	readAndCheck(t, registry.Lookup("legacy"), "firstsecondthird")
+}
+
+func TestQuota(t *testing.T) {
+	memory := store.NewMemory()
+	registry := New(memory)
+	registry.SetQuota(func(creator string) int64 {
+		if creator == "alice" {
+			return 10
+		}
+		return 0
+	})
+	a := registry.New("a")
+	a.SetCreator("alice")
+	insertString(t, a, "123456|")
+	b := registry.New("b")
+	b.SetCreator("alice")
+	w, _ := b.Append()
+	_, err := io.WriteString(w, "12345")
+	if !errors.Is(err, ErrQuota) {
+		t.Errorf("Received %v, expected %v", err, ErrQuota)
+	}
+	err = w.Close()
+	if !errors.Is(err, ErrQuota) {
+		t.Errorf("Close received %v, expected %v", err, ErrQuota)
+	}
+	if n := b.Stat().NFragments; n != 0 {
+		t.Errorf("Received %d fragments, expected 0", n)
+	}
+	insertString(t, b, "1234")
+	if n := registry.Used("alice"); n != 10 {
+		t.Errorf("Used alice = %d, expected 10", n)
+	}
+	// other creators have no limit
+	c := registry.New("c")
+	c.SetCreator("bob")
+	insertString(t, c, "123456789012")
+
+	// usage is recovered on reload, and freed by deleting files
+	registry = New(memory)
+	registry.Load()
+	if n := registry.Used("alice"); n != 10 {
+		t.Errorf("Used alice = %d, expected 10", n)
+	}
+	registry.Lookup("b").Rollback()
+	registry.Delete("a")
+	if n := registry.Used("alice"); n != 0 {
+		t.Errorf("Used alice = %d, expected 0", n)
+	}
+	// changing the creator moves the usage
+	registry.Lookup("c").SetCreator("alice")
+	if n := registry.Used("alice"); n != 12 {
+		t.Errorf("Used alice = %d, expected 12", n)
+	}
+	if n := registry.Used("bob"); n != 0 {
+		t.Errorf("Used bob = %d, expected 0", n)
+	}
+}
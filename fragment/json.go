@@ -2,7 +2,7 @@ package fragment
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
 
 	"github.com/ndlib/bendo/store"
 )
@@ -32,7 +32,7 @@ func (js JSONStore) Open(key string, value interface{}) error {
 	if err == nil {
 		err = err2
 	} else {
-		log.Println(key, err2)
+		slog.Error("JSONStore open", "key", key, "error", err2)
 	}
 	return err
 }
@@ -60,7 +60,7 @@ func (js JSONStore) Save(key string, value interface{}) error {
 	if err == nil {
 		err = err2
 	} else {
-		log.Println(key, err2)
+		slog.Error("JSONStore save", "key", key, "error", err2)
 	}
 	return err
 }
@@ -0,0 +1,80 @@
+package fragment
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrQuota means a write to a file was refused because it would put the
+// creator of the file over their quota.
+var ErrQuota = errors.New("upload quota exceeded")
+
+// SetQuota sets the most bytes the files of each creator may hold in total.
+// quota is called with the name of a creator, and returns their limit, or 0
+// if they have none. A nil quota removes every limit. Bytes count against a
+// quota as they are written, so a write which would go over the limit fails
+// with an error wrapping ErrQuota, and the fragment being written is
+// discarded when it is closed. Files which are already over a quota, such as
+// when it is lowered, are left alone. It is intended to be used during
+// initialization.
+func (s *Store) SetQuota(quota func(creator string) int64) {
+	s.qm.Lock()
+	s.quota = quota
+	s.qm.Unlock()
+}
+
+// Used returns the total size of the files of the given creator, including
+// fragments which are still being written.
+func (s *Store) Used(creator string) int64 {
+	s.qm.Lock()
+	defer s.qm.Unlock()
+	return s.used[creator]
+}
+
+// charge adds n bytes, which may be negative, to the usage of creator.
+func (s *Store) charge(creator string, n int64) {
+	s.qm.Lock()
+	defer s.qm.Unlock()
+	s.used[creator] += n
+	if s.used[creator] <= 0 {
+		delete(s.used, creator)
+	}
+}
+
+// reserve adds n bytes to the usage of creator, unless that would put them
+// over their quota.
+func (s *Store) reserve(creator string, n int64) error {
+	s.qm.Lock()
+	defer s.qm.Unlock()
+	used := s.used[creator]
+	if s.quota != nil {
+		limit := s.quota(creator)
+		if limit > 0 && used+n > limit {
+			return fmt.Errorf("%w: %q has %d bytes uploaded of a limit of %d", ErrQuota, creator, used, limit)
+		}
+	}
+	s.used[creator] = used + n
+	return nil
+}
+
+// reserve counts n more bytes being written to the file against its
+// creator's quota.
+// must hold a write lock on f to call this
+func (f *file) reserve(n int64) error {
+	if !f.deleted {
+		err := f.parent.reserve(f.Creator, n)
+		if err != nil {
+			return err
+		}
+	}
+	f.pending += n
+	return nil
+}
+
+// release removes n bytes from the usage of the file's creator.
+// must hold a write lock on f to call this
+func (f *file) release(n int64) {
+	if !f.deleted {
+		f.parent.charge(f.Creator, -n)
+	}
+}
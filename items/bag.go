@@ -0,0 +1,328 @@
+package items
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrNoVersion occurs when a version is requested which the item does not
+// have.
+var ErrNoVersion = errors.New("no such version")
+
+// FindVersion returns the version of the item having the given id, or the
+// most recent version if vid is 0. It returns nil if there is no such
+// version.
+func (item Item) FindVersion(vid VersionID) *Version {
+	if len(item.Versions) == 0 {
+		return nil
+	}
+	if vid == 0 {
+		return item.Versions[len(item.Versions)-1]
+	}
+	for _, v := range item.Versions {
+		if v.ID == vid {
+			return v
+		}
+	}
+	return nil
+}
+
+// WriteBag writes version vid of the item id in this store to w as a BagIt
+// bag, reading the blobs from the store. See WriteBag.
+func (s *Store) WriteBag(w io.Writer, id string, vid VersionID) error {
+	return s.WriteBagOptions(w, id, vid, BagOptions{})
+}
+
+// WriteBagOptions is like WriteBag, but serializes the bag as opts says.
+func (s *Store) WriteBagOptions(w io.Writer, id string, vid VersionID, opts BagOptions) error {
+	item, err := s.Item(id)
+	if err != nil {
+		return err
+	}
+	return WriteBagOptions(w, item, vid, func(blob *Blob) (io.ReadCloser, error) {
+		r, _, err := s.Blob(id, blob.ID)
+		return r, err
+	}, opts)
+}
+
+// BagOptions change how a bag is serialized, so it can be made in the form
+// an external preservation service expects.
+type BagOptions struct {
+	// Name is the name of the directory holding the bag. By default it
+	// is the item id with any "/" changed to "_".
+	Name string
+
+	// Tar makes the bag be serialized as a tar file instead of a zip
+	// file.
+	Tar bool
+
+	// Info lists more lines to add to bag-info.txt, each in the form
+	// "Label: value".
+	Info []string
+
+	// Tags are more tag files to add to the bag, such as the
+	// aptrust-info.txt required by APTrust. They are listed in the tag
+	// manifest with the others.
+	Tags []BagTag
+}
+
+// A BagTag is a tag file in a bag.
+type BagTag struct {
+	Name string
+	Body []byte
+}
+
+// WriteBag writes version vid of item to w as a BagIt bag, as described in
+// RFC 8493. The most recent version is used if vid is 0. The bag is
+// serialized as a zip file holding a single directory named by the item id.
+// Each slot in the version is a payload file under "data/", read using
+// open, and the MD5 and SHA-256 manifests are made from the checksums
+// stored for each blob. The checksums are also computed as the content is
+// copied, and a mismatch is an error. Files whose blob has been deleted are
+// left out of the payload and listed in bag-info.txt instead.
+//
+// Since the bag is streamed, an error after something has been written
+// leaves w holding an incomplete zip file.
+func WriteBag(w io.Writer, item *Item, vid VersionID, open func(blob *Blob) (io.ReadCloser, error)) error {
+	return WriteBagOptions(w, item, vid, open, BagOptions{})
+}
+
+// WriteBagOptions is like WriteBag, but serializes the bag as opts says.
+func WriteBagOptions(w io.Writer, item *Item, vid VersionID, open func(blob *Blob) (io.ReadCloser, error), opts BagOptions) error {
+	ver := item.FindVersion(vid)
+	if ver == nil {
+		return ErrNoVersion
+	}
+	var slots []string
+	for slot := range ver.Slots {
+		slots = append(slots, slot)
+	}
+	sort.Strings(slots)
+
+	root := opts.Name
+	if root == "" {
+		root = strings.ReplaceAll(item.ID, "/", "_")
+	}
+	root += "/"
+	var bw bagArchive = zipBag{zip.NewWriter(w)}
+	if opts.Tar {
+		bw = tarBag{tar.NewWriter(w)}
+	}
+	var md5manifest, sha256manifest bytes.Buffer
+	var deleted []string
+	var oxum int64
+	var nfiles int
+	for _, slot := range slots {
+		blob := item.blobByID(ver.Slots[slot])
+		if blob == nil || (blob.Bundle == 0 && blob.RefItem == "") {
+			deleted = append(deleted, slot)
+			continue
+		}
+		// keep slot names such as "../a" inside the payload directory
+		name := "data/" + path.Clean("/" + slot)[1:]
+		md5sum, sha256sum, err := writeBagFile(bw, root+name, item.ID, blob, open)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&md5manifest, "%s  %s\n", hex.EncodeToString(md5sum), bagEscape(name))
+		fmt.Fprintf(&sha256manifest, "%s  %s\n", hex.EncodeToString(sha256sum), bagEscape(name))
+		oxum += blob.Size
+		nfiles++
+	}
+
+	var info bytes.Buffer
+	fmt.Fprintf(&info, "Bagging-Date: %s\n", time.Now().Format("2006-01-02"))
+	fmt.Fprintf(&info, "External-Identifier: %s\n", item.ID)
+	fmt.Fprintf(&info, "Payload-Oxum: %d.%d\n", oxum, nfiles)
+	fmt.Fprintf(&info, "Bendo-Version: %d\n", ver.ID)
+	fmt.Fprintf(&info, "Bendo-Version-Date: %s\n", ver.SaveDate.Format(time.RFC3339))
+	fmt.Fprintf(&info, "Bendo-Version-Creator: %s\n", ver.Creator)
+	if ver.Note != "" {
+		fmt.Fprintf(&info, "Bendo-Version-Note: %s\n", bagInfoValue(ver.Note))
+	}
+	for _, slot := range deleted {
+		fmt.Fprintf(&info, "Bendo-Deleted-File: %s\n", bagInfoValue(slot))
+	}
+	for _, line := range opts.Info {
+		fmt.Fprintf(&info, "%s\n", bagInfoValue(line))
+	}
+
+	// the tag files, in the order they are written. bagit.txt must be
+	// first.
+	tags := []BagTag{
+		{"bagit.txt", []byte("BagIt-Version: 1.0\nTag-File-Character-Encoding: UTF-8\n")},
+		{"bag-info.txt", info.Bytes()},
+	}
+	tags = append(tags, opts.Tags...)
+	tags = append(tags,
+		BagTag{"manifest-md5.txt", md5manifest.Bytes()},
+		BagTag{"manifest-sha256.txt", sha256manifest.Bytes()},
+	)
+	var tagmanifest bytes.Buffer
+	for _, tag := range tags {
+		err := writeBagTag(bw, root+tag.Name, ver.SaveDate, tag.Body)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(tag.Body)
+		fmt.Fprintf(&tagmanifest, "%s  %s\n", hex.EncodeToString(sum[:]), bagEscape(tag.Name))
+	}
+	err := writeBagTag(bw, root+"tagmanifest-sha256.txt", ver.SaveDate, tagmanifest.Bytes())
+	if err != nil {
+		return err
+	}
+	return bw.Close()
+}
+
+// WriteArchive writes the files in version vid of item to w as a zip file,
+// or as a tar file if format is TarFormat, without the metadata files of a
+// bag. The most recent version is used if vid is 0. The archive holds a
+// single directory named by the item id, with each slot in the version a
+// file under its slot name, read using open. As with WriteBag, the content
+// is checked against the stored checksums as it is copied, files whose blob
+// has been deleted are left out, and an error after something has been
+// written leaves w holding an incomplete archive.
+func WriteArchive(w io.Writer, item *Item, vid VersionID, format BundleFormat, open func(blob *Blob) (io.ReadCloser, error)) error {
+	ver := item.FindVersion(vid)
+	if ver == nil {
+		return ErrNoVersion
+	}
+	var slots []string
+	for slot := range ver.Slots {
+		slots = append(slots, slot)
+	}
+	sort.Strings(slots)
+
+	root := strings.ReplaceAll(item.ID, "/", "_") + "/"
+	var bw bagArchive = zipBag{zip.NewWriter(w)}
+	if format == TarFormat {
+		bw = tarBag{tar.NewWriter(w)}
+	}
+	for _, slot := range slots {
+		blob := item.blobByID(ver.Slots[slot])
+		if blob == nil || (blob.Bundle == 0 && blob.RefItem == "") {
+			continue
+		}
+		name := path.Clean("/" + slot)[1:]
+		_, _, err := writeBagFile(bw, root+name, item.ID, blob, open)
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Close()
+}
+
+// A bagArchive is the file a bag is serialized into.
+type bagArchive interface {
+	// Create starts a file of the given size in the archive. Tag files
+	// are compressed, if the format allows it, but payload files are
+	// not, since most content is compressed already.
+	Create(name string, modtime time.Time, size int64, tag bool) (io.Writer, error)
+	Close() error
+}
+
+type zipBag struct {
+	zw *zip.Writer
+}
+
+func (z zipBag) Create(name string, modtime time.Time, size int64, tag bool) (io.Writer, error) {
+	method := zip.Store
+	if tag {
+		method = zip.Deflate
+	}
+	return z.zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   method,
+		Modified: modtime,
+	})
+}
+
+func (z zipBag) Close() error {
+	return z.zw.Close()
+}
+
+type tarBag struct {
+	tw *tar.Writer
+}
+
+func (t tarBag) Create(name string, modtime time.Time, size int64, tag bool) (io.Writer, error) {
+	err := t.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  modtime,
+		Format:   tar.FormatPAX,
+	})
+	return t.tw, err
+}
+
+func (t tarBag) Close() error {
+	return t.tw.Close()
+}
+
+// writeBagFile copies the content of blob into the archive under the given
+// name, and returns its MD5 and SHA-256 checksums.
+func writeBagFile(bw bagArchive, name, id string, blob *Blob, open func(blob *Blob) (io.ReadCloser, error)) ([]byte, []byte, error) {
+	r, err := open(blob)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+	fw, err := bw.Create(name, blob.SaveDate, blob.Size, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	md5w := md5.New()
+	sha256w := sha256.New()
+	// a tar file cannot hold more than the size given in the header, so
+	// any extra content is only counted
+	n, err := io.Copy(io.MultiWriter(fw, md5w, sha256w), io.LimitReader(r, blob.Size))
+	if err != nil {
+		return nil, nil, err
+	}
+	extra, _ := io.CopyN(io.Discard, r, 1)
+	n += extra
+	md5sum := md5w.Sum(nil)
+	sha256sum := sha256w.Sum(nil)
+	if n != blob.Size ||
+		(len(blob.MD5) > 0 && !bytes.Equal(blob.MD5, md5sum)) ||
+		(len(blob.SHA256) > 0 && !bytes.Equal(blob.SHA256, sha256sum)) {
+		return nil, nil, fmt.Errorf("item %s blob %d: content does not match its stored size or checksums", id, blob.ID)
+	}
+	return md5sum, sha256sum, nil
+}
+
+// writeBagTag writes a tag file into the archive.
+func writeBagTag(bw bagArchive, name string, modtime time.Time, body []byte) error {
+	fw, err := bw.Create(name, modtime, int64(len(body)), true)
+	if err != nil {
+		return err
+	}
+	_, err = fw.Write(body)
+	return err
+}
+
+// bagEscape percent-encodes the characters in a file path which may not
+// appear as-is in a manifest.
+func bagEscape(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// bagInfoValue returns s made suitable for a bag-info.txt value, which may
+// continue onto later lines only if they are indented.
+func bagInfoValue(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	return strings.ReplaceAll(s, "\n", "\n  ")
+}
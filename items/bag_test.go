@@ -0,0 +1,191 @@
+package items
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ndlib/bendo/store"
+)
+
+func TestWriteBag(t *testing.T) {
+	s := New(store.NewMemory())
+	w, err := s.Open("bag", "nobody")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	w.SetSlot("a.txt", writedata(t, w, "hello"))
+	w.SetSlot("dir/b.txt", writedata(t, w, "delete me"))
+	w.SetNote("first\nversion")
+	w.Close()
+	w, _ = s.Open("bag", "nobody")
+	w.SetSlot("../c.txt", writedata(t, w, "goodbye"))
+	w.DeleteBlob(2)
+	w.Close()
+
+	var buf bytes.Buffer
+	err = s.WriteBag(&buf, "bag", 1)
+	if err != nil {
+		t.Fatalf("WriteBag() == %s, expected nil", err.Error())
+	}
+	files := readBag(t, buf.Bytes())
+	var table = []struct {
+		name     string
+		contains string
+	}{
+		{"bag/bagit.txt", "BagIt-Version: 1.0\n"},
+		{"bag/data/a.txt", "hello"},
+		{"bag/manifest-md5.txt", "5d41402abc4b2a76b9719d911017c592  data/a.txt\n"},
+		{"bag/manifest-sha256.txt", "  data/a.txt\n"},
+		{"bag/bag-info.txt", "Payload-Oxum: 5.1\n"},
+		{"bag/bag-info.txt", "Bendo-Version: 1\n"},
+		{"bag/bag-info.txt", "Bendo-Version-Note: first\n  version\n"},
+		{"bag/bag-info.txt", "Bendo-Deleted-File: dir/b.txt\n"},
+		{"bag/tagmanifest-sha256.txt", "  manifest-md5.txt\n"},
+	}
+	for _, tab := range table {
+		if !strings.Contains(files[tab.name], tab.contains) {
+			t.Errorf("%s: received %q, expected it to contain %q", tab.name, files[tab.name], tab.contains)
+		}
+	}
+	if len(files) != 6 {
+		t.Errorf("Received %d files, expected 6", len(files))
+	}
+
+	// the newest version
+	buf.Reset()
+	err = s.WriteBag(&buf, "bag", 0)
+	if err != nil {
+		t.Fatalf("WriteBag() == %s, expected nil", err.Error())
+	}
+	files = readBag(t, buf.Bytes())
+	if files["bag/data/c.txt"] != "goodbye" {
+		t.Errorf("Received files %v", files)
+	}
+
+	err = s.WriteBag(&buf, "bag", 3)
+	if err != ErrNoVersion {
+		t.Errorf("WriteBag() == %v, expected %v", err, ErrNoVersion)
+	}
+}
+
+func TestWriteBagOptions(t *testing.T) {
+	s := New(store.NewMemory())
+	w, _ := s.Open("bag", "nobody")
+	w.SetSlot("a.txt", writedata(t, w, "hello"))
+	w.Close()
+
+	var buf bytes.Buffer
+	err := s.WriteBagOptions(&buf, "bag", 0, BagOptions{
+		Name: "nd.bag",
+		Tar:  true,
+		Info: []string{"Source-Organization: Notre Dame"},
+		Tags: []BagTag{{"aptrust-info.txt", []byte("Title: bag\nAccess: Institution\n")}},
+	})
+	if err != nil {
+		t.Fatalf("WriteBagOptions() == %s, expected nil", err.Error())
+	}
+	tr := tar.NewReader(&buf)
+	files := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		content, _ := ioutil.ReadAll(tr)
+		files[hdr.Name] = string(content)
+	}
+	var table = []struct {
+		name     string
+		contains string
+	}{
+		{"nd.bag/data/a.txt", "hello"},
+		{"nd.bag/bag-info.txt", "Source-Organization: Notre Dame\n"},
+		{"nd.bag/aptrust-info.txt", "Access: Institution\n"},
+		{"nd.bag/tagmanifest-sha256.txt", "  aptrust-info.txt\n"},
+	}
+	for _, tab := range table {
+		if !strings.Contains(files[tab.name], tab.contains) {
+			t.Errorf("%s: received %q, expected it to contain %q", tab.name, files[tab.name], tab.contains)
+		}
+	}
+	if len(files) != 7 {
+		t.Errorf("Received %d files, expected 7", len(files))
+	}
+}
+
+func TestWriteArchive(t *testing.T) {
+	s := New(store.NewMemory())
+	w, _ := s.Open("archive", "nobody")
+	w.SetSlot("a.txt", writedata(t, w, "hello"))
+	w.SetSlot("dir/b.txt", writedata(t, w, "delete me"))
+	w.SetSlot("../c.txt", writedata(t, w, "goodbye"))
+	w.Close()
+	w, _ = s.Open("archive", "nobody")
+	w.DeleteBlob(2)
+	w.Close()
+	item, _ := s.Item("archive")
+	open := func(blob *Blob) (io.ReadCloser, error) {
+		r, _, err := s.Blob("archive", blob.ID)
+		return r, err
+	}
+
+	var buf bytes.Buffer
+	err := WriteArchive(&buf, item, 0, ZipFormat, open)
+	if err != nil {
+		t.Fatalf("WriteArchive() == %s, expected nil", err.Error())
+	}
+	files := readBag(t, buf.Bytes())
+	expected := map[string]string{"archive/a.txt": "hello", "archive/c.txt": "goodbye"}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("Received %v, expected %v", files, expected)
+	}
+
+	buf.Reset()
+	err = WriteArchive(&buf, item, 1, TarFormat, open)
+	if err != nil {
+		t.Fatalf("WriteArchive() == %s, expected nil", err.Error())
+	}
+	tr := tar.NewReader(&buf)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, hdr.Name)
+	}
+	// the deleted blob is left out of the version it was in
+	if !reflect.DeepEqual(names, []string{"archive/c.txt", "archive/a.txt"}) {
+		t.Errorf("Received %v", names)
+	}
+
+	err = WriteArchive(&buf, item, 3, ZipFormat, open)
+	if err != ErrNoVersion {
+		t.Errorf("WriteArchive() == %v, expected %v", err, ErrNoVersion)
+	}
+}
+
+// readBag returns the files in the zip file b, indexed by name.
+func readBag(t *testing.T, b []byte) map[string]string {
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	result := make(map[string]string)
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatalf("Unexpected error %s", err.Error())
+		}
+		content, _ := ioutil.ReadAll(r)
+		r.Close()
+		result[f.Name] = string(content)
+	}
+	return result
+}
@@ -2,11 +2,13 @@ package items
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ndlib/bendo/store"
 )
@@ -19,21 +21,45 @@ that to save the item-info.json file when needed.
 It is not goroutine safe. Make sure to call Close when finished.
 */
 type BundleWriter struct {
-	store store.Store
-	item  *Item
-	zw    *Zipwriter // target bundle file. nil if nothing is open.
-	size  int64      // amount written to current bundle
-	n     int        // 1 + current bundle id
+	store  store.Store
+	layout Layout
+	format BundleFormat
+	item   *Item
+	zw     *Zipwriter // target bundle file. nil if nothing is open.
+	size   int64      // amount written to current bundle
+	count  int        // number of streams written to current bundle
+	n      int        // 1 + current bundle id
+
+	modtime time.Time       // fixed time for bundle contents. zero means use now.
+	digests []string        // extra checksums to compute for each blob
+	parity  ParityScheme    // parity to write for each bundle
+	policy  BundlePolicy    // when to start a new bundle, nil for the default
+	ctx     context.Context // stops the copying of content once done, nil for never
 }
 
 // NewBundler starts a new bundle writer for the given item. More than one bundle
 // file may be written. The advancement to a new bundle file happens either when
-// the current one grows larger than IdealBundleSize, or when Next() is called.
+// the bundle policy says so, by default once the current one grows larger
+// than IdealBundleSize, or when Next() is called.
 func NewBundler(s store.Store, item *Item) *BundleWriter {
+	return NewLayoutBundler(s, FlatLayout{}, item)
+}
+
+// NewLayoutBundler is like NewBundler, but names the bundle files using the
+// given layout.
+func NewLayoutBundler(s store.Store, layout Layout, item *Item) *BundleWriter {
+	return NewFormatBundler(s, layout, ZipFormat, item)
+}
+
+// NewFormatBundler is like NewLayoutBundler, but writes the bundle files in
+// the given format.
+func NewFormatBundler(s store.Store, layout Layout, format BundleFormat, item *Item) *BundleWriter {
 	bw := &BundleWriter{
-		store: s,
-		item:  item,
-		n:     item.MaxBundle + 1,
+		store:  s,
+		layout: layout,
+		format: format,
+		item:   item,
+		n:      item.MaxBundle + 1,
 	}
 	// force us to open a blob file.
 	bw.Next() // ignore error. next call to WriteBlob will retrigger it
@@ -55,16 +81,64 @@ func (bw *BundleWriter) Next() error {
 	if err != nil {
 		return err
 	}
-	bw.zw, err = OpenZipWriter(bw.store, bw.item.ID, bw.n)
+	key := formatKey(bw.layout.Key(bw.item.ID, bw.n), bw.format)
+	bw.zw, err = openZipWriter(bw.store, bw.item.ID, key, bw.format)
+	if err == nil {
+		err = bw.zw.SetParity(bw.parity)
+	}
 	if err != nil {
 		return err
 	}
+	if !bw.modtime.IsZero() {
+		bw.zw.SetModTime(bw.modtime)
+	}
+	bw.zw.SetDigests(bw.digests)
 	bw.zw.SetTag("Bendo-Identifier", bw.item.ID)
 	bw.zw.SetTag("Bendo-Bundle-Sequence", fmt.Sprintf("%d", bw.n))
 	bw.zw.SetTag("External-Identifier",
 		strings.TrimSuffix(sugar(bw.item.ID, bw.n), ".zip"))
 	bw.n++
 	bw.size = 0
+	bw.count = 0
+	return nil
+}
+
+// SetModTime makes every bundle written from now on use the given time for
+// its file times and bagging date, instead of the current time. With a fixed
+// time, writing the same blobs in the same order gives byte-identical
+// bundles.
+func (bw *BundleWriter) SetModTime(t time.Time) {
+	bw.modtime = t
+	if bw.zw != nil {
+		bw.zw.SetModTime(t)
+	}
+}
+
+// SetContext makes bw stop copying content into bundles once ctx is done.
+// Writes in progress then return the context's error.
+func (bw *BundleWriter) SetContext(ctx context.Context) {
+	bw.ctx = ctx
+}
+
+// SetDigests makes every blob written from now on also have the named
+// checksums computed, in addition to MD5 and SHA256. They are returned in
+// the WrittenDigests of the Results, and saved in the bundle manifests.
+func (bw *BundleWriter) SetDigests(names []string) {
+	bw.digests = names
+	if bw.zw != nil {
+		bw.zw.SetDigests(names)
+	}
+}
+
+// SetParity makes every bundle have a parity file written alongside it
+// using the given scheme. The bundle currently open is changed too, unless
+// something has already been written to it, in which case an error is
+// returned and the scheme only applies to the following bundles.
+func (bw *BundleWriter) SetParity(p ParityScheme) error {
+	bw.parity = p
+	if bw.zw != nil {
+		return bw.zw.SetParity(p)
+	}
 	return nil
 }
 
@@ -89,50 +163,71 @@ const (
 
 	// IdealBundleSize is a cutoff, and new bundle files will be started
 	// once the current one grows past this. (only checked when starting
-	// as new blob.)
+	// as new blob.) It is the size used by the default SizePolicy.
 	IdealBundleSize = 500 * MB
 )
 
 // Results is used to return info from BundleWriter.WriteBlob().
 // Both WrittenMD5 and WrittenSHA256 are empty if nothing was written.
+// WrittenDigests has the checksums asked for with SetDigests, if any.
 type Results struct {
-	BytesWritten  int64
-	Bundle        int
-	WrittenMD5    []byte
-	WrittenSHA256 []byte
+	BytesWritten   int64
+	Bundle         int
+	WrittenMD5     []byte
+	WrittenSHA256  []byte
+	WrittenDigests map[string][]byte
 }
 
 // WriteBlob writes the given blob into the bundle.
 //
-// WriteBlob first sees if it needs to start a new bundle file based on the
-// number of bytes already written into the current bundle. At the end of the
+// WriteBlob first asks the bundle policy whether it needs to start a new
+// bundle file, based on what is already written into the current bundle. At the end of the
 // call, CurrentBundle() returns the bundle the blob was written into.
 //
 // If WrittenMD5 is empty, then the file was not created in the bundle.
+// The Results are of the bytes written, which for an encrypted blob are
+// the encrypted content; r must give the encrypted content.
 //
 // The *Blob is not modified and no validation of the write is performed.
 // Use ValidateWriteBlob() to do validation of the returned Results with the
 // expected values in the *Blob.
 func (bw *BundleWriter) WriteBlob(blob *Blob, r io.Reader) (Results, error) {
+	// a size of 0 may mean the size is not known
+	size := int64(-1)
+	if blob.Size > 0 {
+		size = blob.storedSize()
+	}
+	return bw.writeStream(fmt.Sprintf("blob/%d", blob.ID), size, r)
+}
+
+// writeStream copies r into the stream name in the bundle, first starting a
+// new bundle file if the current one is full. The size is -1 if it is not
+// known.
+func (bw *BundleWriter) writeStream(name string, size int64, r io.Reader) (Results, error) {
 	var result Results
-	if bw.size >= IdealBundleSize || bw.zw == nil {
+	if bw.zw == nil || bw.startNew(size) {
 		if err := bw.Next(); err != nil {
 			return result, err
 		}
 	}
-	w, err := bw.zw.MakeStream(fmt.Sprintf("blob/%d", blob.ID))
+	w, err := bw.zw.MakeSizedStream(name, size)
 	if err != nil {
 		return result, err
 	}
+	if bw.ctx != nil {
+		r = contextReader{bw.ctx, r}
+	}
 	// if there was an error on the copy, return it after first filling out
 	// the metadata
-	size, err := io.Copy(w, r)
-	bw.size += size
-	result.BytesWritten = size
+	n, err := io.Copy(w, r)
+	bw.size += n
+	bw.count++
+	result.BytesWritten = n
 	result.Bundle = bw.n - 1
 	checksums := bw.zw.Checksum()
 	result.WrittenMD5 = checksums.MD5[:]
 	result.WrittenSHA256 = checksums.SHA256[:]
+	result.WrittenDigests = namedDigests(checksums)
 	return result, err
 }
 
@@ -168,21 +263,40 @@ func ValidateWriteBlob(itemID string, blob *Blob, result Results) error {
 	return nil
 }
 
+// validateCopy checks that the stored content of blob was copied unchanged.
+// Encrypted blobs are copied without being decrypted, so they are checked
+// against the checksums of their encrypted content.
+func validateCopy(itemID string, blob *Blob, result Results) error {
+	if !blob.Encrypted {
+		return ValidateWriteBlob(itemID, blob, result)
+	}
+	if n := blob.storedSize(); n != result.BytesWritten {
+		return fmt.Errorf("commit (%s blob %d), copied %d encrypted bytes, expected %d",
+			itemID,
+			blob.ID,
+			result.BytesWritten,
+			n)
+	}
+	err := testhash(result.WrittenMD5, blob.StoredMD5, itemID)
+	if err == nil {
+		err = testhash(result.WrittenSHA256, blob.StoredSHA256, itemID)
+	}
+	return err
+}
+
 // CopyBundleExcept copies all the blobs in the bundle src, except for those in
-// the list, into the current place in the bundle writer.
+// the list, into the current place in the bundle writer. The segments of
+// segmented blobs are copied one at a time.
 func (bw *BundleWriter) CopyBundleExcept(src int, except []BlobID) error {
-	r, err := OpenBundle(bw.store, sugar(bw.item.ID, src))
+	r, err := openBundleN(bw.store, bw.layout, bw.format, bw.item.ID, src)
 	if err != nil {
 		return err
 	}
 	defer r.Close()
-	var badnames = make([]string, 1+len(except))
-	badnames[0] = "item-info.json"
-	for i, id := range except {
-		badnames[i+1] = fmt.Sprintf("blob/%d", id)
-	}
 	for _, fname := range r.Files() {
-		if contains(badnames, fname) {
+		id, segment := parseBlobName(fname)
+		if id == 0 || containsID(except, id) {
+			// item-info.json is written when the bundle is closed
 			continue
 		}
 		var rc io.ReadCloser
@@ -190,18 +304,12 @@ func (bw *BundleWriter) CopyBundleExcept(src int, except []BlobID) error {
 		if err != nil {
 			return err
 		}
-		blob := bw.item.blobByID(extractBlobID(fname))
-		result, err := bw.WriteBlob(blob, rc)
-		if err != nil {
-			goto close
-		}
-		err = ValidateWriteBlob(bw.item.ID, blob, result)
-		if err != nil {
-			goto close
+		blob := bw.item.blobByID(id)
+		if segment > 0 {
+			err = bw.copySegment(blob, segment, rc)
+		} else {
+			err = bw.copyBlob(blob, rc)
 		}
-		// only update the bundle if the blob was sucessfully copied.
-		blob.Bundle = result.Bundle
-	close:
 		rc.Close()
 		if err != nil {
 			return err
@@ -210,6 +318,21 @@ func (bw *BundleWriter) CopyBundleExcept(src int, except []BlobID) error {
 	return nil
 }
 
+// copyBlob copies the content of blob from r, checking it against the size
+// and checksums of blob.
+func (bw *BundleWriter) copyBlob(blob *Blob, r io.Reader) error {
+	result, err := bw.WriteBlob(blob, r)
+	if err == nil {
+		err = validateCopy(bw.item.ID, blob, result)
+	}
+	if err != nil {
+		return err
+	}
+	// only update the bundle if the blob was sucessfully copied.
+	blob.Bundle = result.Bundle
+	return nil
+}
+
 func contains(lst []string, s string) bool {
 	for i := range lst {
 		if lst[i] == s {
@@ -219,15 +342,42 @@ func contains(lst []string, s string) bool {
 	return false
 }
 
+// containsID returns true if id is in the list.
+func containsID(lst []BlobID, id BlobID) bool {
+	for i := range lst {
+		if lst[i] == id {
+			return true
+		}
+	}
+	return false
+}
+
 // from "blob/xxx" return xxx as a BlobID
 func extractBlobID(s string) BlobID {
+	id, _ := parseBlobName(s)
+	return id
+}
+
+// parseBlobName returns the blob id and segment number of the bundle stream
+// named s, either "blob/xxx" or "blob/xxx.n" for segment n of a segmented
+// blob. The segment is 0 for a blob which is not segmented, and the id is 0
+// if s does not name a blob.
+func parseBlobName(s string) (BlobID, int) {
 	sa := strings.SplitN(s, "/", 2)
 	if len(sa) != 2 || sa[0] != "blob" {
-		return BlobID(0)
+		return BlobID(0), 0
+	}
+	name, segment := sa[1], 0
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		n, err := strconv.Atoi(name[i+1:])
+		if err != nil || n <= 0 {
+			return BlobID(0), 0
+		}
+		name, segment = name[:i], n
 	}
-	id, err := strconv.ParseInt(sa[1], 10, 0)
+	id, err := strconv.ParseInt(name, 10, 0)
 	if err != nil {
-		id = 0
+		return BlobID(0), 0
 	}
-	return BlobID(id)
+	return BlobID(id), segment
 }
@@ -1,6 +1,8 @@
 package items
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"strings"
 	"testing"
 
@@ -63,3 +65,45 @@ func TestOpenAtCreation(t *testing.T) {
 		t.Fatalf("Expected bundle 12345-0001.zip to exist")
 	}
 }
+
+func TestBundleSidecar(t *testing.T) {
+	ms := store.NewMemory()
+	item := &Item{ID: "12345"}
+	bw := NewBundler(ms, item)
+	blob := &Blob{ID: 1}
+	item.Blobs = append(item.Blobs, blob)
+	_, err := bw.WriteBlob(blob, strings.NewReader("Hello There"))
+	if err != nil {
+		t.Fatalf("WriteBlob() == %s, expected nil", err.Error())
+	}
+	err = bw.Close()
+	if err != nil {
+		t.Fatalf("Close() == %s, expected nil", err.Error())
+	}
+	bundle := readkey(t, ms, "12345-0001.zip")
+	sidecar := string(readkey(t, ms, "12345-0001.zip"+SidecarExt))
+	lines := strings.Split(strings.TrimSpace(sidecar), "\n")
+	wholesum := sha256.Sum256(bundle)
+	if lines[0] != hex.EncodeToString(wholesum[:])+"  12345-0001.zip" {
+		t.Errorf("Received first line %q", lines[0])
+	}
+	blobsum := sha256.Sum256([]byte("Hello There"))
+	if !contains(lines, hex.EncodeToString(blobsum[:])+"  data/blob/1") {
+		t.Errorf("Received sidecar %q, missing data/blob/1", sidecar)
+	}
+	if !strings.Contains(sidecar, "  data/item-info.json\n") {
+		t.Errorf("Received sidecar %q, missing data/item-info.json", sidecar)
+	}
+
+	// the sidecar should not look like another bundle or item
+	if n := New(ms).findMaxBundle("12345"); n != 1 {
+		t.Errorf("findMaxBundle() == %d, expected 1", n)
+	}
+	err = New(ms).Delete("12345")
+	if err != nil {
+		t.Fatalf("Delete() == %s, expected nil", err.Error())
+	}
+	if keys, _ := ms.ListPrefix(""); len(keys) != 0 {
+		t.Errorf("Received keys %v after delete, expected none", keys)
+	}
+}
@@ -0,0 +1,130 @@
+package items
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ContentsExt is the extension added to a bundle's key to give the key of
+// its contents sidecar. The sidecar is a small JSON file, a BundleContents,
+// listing every file in the bundle with where it is in the bundle file and
+// its checksum, so a bundle can be inventoried, and any blob in it read and
+// checked with a single range read, without reading the item's metadata or
+// the directory of the bundle.
+const ContentsExt = ".contents"
+
+// BundleContents lists the files in one bundle.
+type BundleContents struct {
+	Item   string        // the item the bundle belongs to
+	Key    string        // the key of the bundle in the store
+	Size   int64         // the size of the bundle file
+	SHA256 string        // the checksum of the bundle file, in hex. Empty if unknown
+	Files  []BundleEntry // the payload files in the bundle, in the order written
+}
+
+// A BundleEntry describes one payload file in a bundle.
+type BundleEntry struct {
+	Name    string // the name inside the bundle, e.g. "blob/3" or "item-info.json"
+	Blob    BlobID `json:",omitempty"` // the blob the file holds, if any
+	Segment int    `json:",omitempty"` // the segment of the blob, if it is segmented
+	Offset  int64  // where the content begins in the bundle file, -1 if unknown
+	Size    int64  // the length of the content
+	SHA256  string // the checksum of the content, in hex
+}
+
+// writeContents saves the contents sidecar for this bundle. It should only
+// be called after the bundle has been closed.
+func (zw *Zipwriter) writeContents() error {
+	c := &BundleContents{
+		Item:   zw.id,
+		Key:    zw.key,
+		Size:   zw.size,
+		SHA256: hex.EncodeToString(zw.sum.Sum(nil)),
+	}
+	for name, ck := range zw.Manifest() {
+		name = strings.TrimPrefix(name, "data/")
+		offset, size, err := zw.Extent(name)
+		if err != nil {
+			continue // a tag file
+		}
+		c.Files = append(c.Files, newBundleEntry(name, offset, size, ck.SHA256))
+	}
+	sort.Slice(c.Files, func(i, j int) bool { return c.Files[i].Offset < c.Files[j].Offset })
+	w, err := zw.s.Create(zw.key + ContentsExt)
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(w).Encode(c)
+	err2 := w.Close()
+	if err == nil {
+		err = err2
+	}
+	return err
+}
+
+// newBundleEntry returns the entry for the bundle file with the given
+// name, working out the blob and segment it holds from the name.
+func newBundleEntry(name string, offset, size int64, sha256 []byte) BundleEntry {
+	e := BundleEntry{
+		Name:   name,
+		Offset: offset,
+		Size:   size,
+		SHA256: hex.EncodeToString(sha256),
+	}
+	if rest := strings.TrimPrefix(name, "blob/"); rest != name {
+		bid, seg, _ := strings.Cut(rest, ".")
+		b, _ := strconv.Atoi(bid)
+		e.Blob = BlobID(b)
+		e.Segment, _ = strconv.Atoi(seg)
+	}
+	return e
+}
+
+// BundleContents returns the list of files in bundle n of the given item,
+// read from its contents sidecar. Bundles written before the sidecars were
+// added have none, and for them the list is made by reading the directory
+// and manifest of the bundle itself, and the checksum of the whole bundle
+// is left empty.
+func (s *Store) BundleContents(id string, n int) (*BundleContents, error) {
+	if s.useStore == false {
+		return nil, ErrNoStore
+	}
+	key := s.findBundleKey(id, n)
+	r, size, err := s.S.Open(key + ContentsExt)
+	if err == nil {
+		defer r.Close()
+		c := new(BundleContents)
+		err = json.NewDecoder(io.NewSectionReader(r, 0, size)).Decode(c)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	br, err := s.openCachedBundle(id, n)
+	if err != nil {
+		return nil, err
+	}
+	defer br.Close()
+	c := &BundleContents{Item: id, Key: br.key}
+	if f, size, err := s.S.Open(br.key); err == nil {
+		f.Close()
+		c.Size = size
+	}
+	for _, name := range br.Files() {
+		offset, size, err := br.Extent(name)
+		if err != nil {
+			offset = -1
+		}
+		var sum []byte
+		if ck := br.Checksum(name); ck != nil {
+			sum = ck.SHA256
+		}
+		c.Files = append(c.Files, newBundleEntry(name, offset, size, sum))
+	}
+	sort.Slice(c.Files, func(i, j int) bool { return c.Files[i].Offset < c.Files[j].Offset })
+	return c, nil
+}
@@ -0,0 +1,67 @@
+package items
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"reflect"
+	"testing"
+
+	"github.com/ndlib/bendo/store"
+)
+
+func TestBundleContents(t *testing.T) {
+	ms := store.NewMemory()
+	s := New(ms)
+	w, err := s.Open("contents", "nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writedata(t, w, "Hello There")
+	writedata(t, w, "General Kenobi")
+	w.Close()
+
+	c, err := s.BundleContents("contents", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle := readkey(t, ms, "contents-0001.zip")
+	wholesum := sha256.Sum256(bundle)
+	if c.Item != "contents" || c.Key != "contents-0001.zip" ||
+		c.Size != int64(len(bundle)) || c.SHA256 != hex.EncodeToString(wholesum[:]) {
+		t.Errorf("Received %+v", c)
+	}
+	var blobs []BlobID
+	for _, e := range c.Files {
+		if e.Blob == 0 {
+			continue
+		}
+		blobs = append(blobs, e.Blob)
+		// each blob should be readable straight from the bundle file
+		if e.Offset < 0 || e.Offset+e.Size > int64(len(bundle)) {
+			t.Errorf("Received entry %+v outside bundle", e)
+			continue
+		}
+		sum := sha256.Sum256(bundle[e.Offset : e.Offset+e.Size])
+		if e.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("Entry %+v does not match the bundle content", e)
+		}
+	}
+	if !reflect.DeepEqual(blobs, []BlobID{1, 2}) {
+		t.Errorf("Received blobs %v, expected [1 2]", blobs)
+	}
+
+	// bundles without a contents sidecar are listed from the bundle itself
+	ms.Delete("contents-0001.zip" + ContentsExt)
+	c2, err := s.BundleContents("contents", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SHA256 = ""
+	if !reflect.DeepEqual(c, c2) {
+		t.Errorf("Received %+v, expected %+v", c2, c)
+	}
+
+	if _, err := s.BundleContents("contents", 2); err == nil {
+		t.Errorf("BundleContents() succeeded for a missing bundle")
+	}
+}
@@ -0,0 +1,39 @@
+package items
+
+import (
+	"context"
+	"io"
+)
+
+// A contextReader reads from r until ctx is done, and then returns the
+// context's error. The context is checked before each read, so a read
+// already waiting on the store is not interrupted, but no more are started.
+// This lets a long tape read stop soon after the client asking for it goes
+// away.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// A contextReadCloser is a contextReader which also closes the underlying
+// reader.
+type contextReadCloser struct {
+	contextReader
+	io.Closer
+}
+
+// withContext returns rc wrapped so it stops reading once ctx is done. It
+// returns rc itself if ctx can never be done.
+func withContext(ctx context.Context, rc io.ReadCloser) io.ReadCloser {
+	if ctx.Done() == nil {
+		return rc
+	}
+	return contextReadCloser{contextReader{ctx, rc}, rc}
+}
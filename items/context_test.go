@@ -0,0 +1,68 @@
+package items
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/ndlib/bendo/store"
+)
+
+func TestBlobContext(t *testing.T) {
+	ms := store.NewMemory()
+	s := New(ms)
+	w, err := s.Open("ctx", "nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writedata(t, w, "hello there")
+	w.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rc, size, err := s.BlobContext(ctx, "ctx", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(rc, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("Read %q, %v, expected hello", buf, err)
+	}
+	cancel()
+	if _, err := io.ReadAll(rc); !errors.Is(err, context.Canceled) {
+		t.Errorf("Read after cancel returned %v, expected context.Canceled", err)
+	}
+	rc.Close()
+	if size != 11 {
+		t.Errorf("Received size %d, expected 11", size)
+	}
+
+	// nothing is loaded with a cancelled context
+	if _, err := New(ms).ItemContext(ctx, "ctx"); !errors.Is(err, context.Canceled) {
+		t.Errorf("ItemContext() returned %v, expected context.Canceled", err)
+	}
+	if _, _, err := New(ms).BlobContext(ctx, "ctx", 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("BlobContext() returned %v, expected context.Canceled", err)
+	}
+}
+
+func TestOpenContext(t *testing.T) {
+	s := New(store.NewMemory())
+	ctx, cancel := context.WithCancel(context.Background())
+	w, err := s.OpenContext(ctx, "ctx", "nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	data := "never saved"
+	m := md5.Sum([]byte(data))
+	h := sha256.Sum256([]byte(data))
+	_, err = w.WriteBlob(strings.NewReader(data), int64(len(data)), m[:], h[:])
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("WriteBlob() returned %v, expected context.Canceled", err)
+	}
+	w.Close()
+}
@@ -0,0 +1,343 @@
+package items
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ErrNoKey occurs when an encrypted blob is read, or a blob is written into
+// an item having a data key, but the store has no KeyWrapper to unwrap it.
+var ErrNoKey = errors.New("blob is encrypted and there is no master key")
+
+// ErrDecrypt occurs when encrypted content cannot be authenticated, either
+// because it was changed or truncated or because the wrong key was used.
+var ErrDecrypt = errors.New("encrypted content failed authentication")
+
+// A KeyWrapper encrypts and decrypts the data keys of items using a master
+// key which it holds. Only the wrapped data keys are saved, in each item's
+// metadata, so the content of an encrypted item cannot be read without the
+// master key. An implementation may keep the master key in a key management
+// service and call out to it.
+type KeyWrapper interface {
+	WrapKey(key []byte) ([]byte, error)
+	UnwrapKey(wrapped []byte) ([]byte, error)
+}
+
+// NewMasterKey returns a KeyWrapper which wraps data keys with AES-GCM using
+// the given master key, which must be 16, 24, or 32 bytes long.
+func NewMasterKey(key []byte) (KeyWrapper, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return masterKey{aead: aead}, nil
+}
+
+// NewMasterKeyFile returns a KeyWrapper using the master key in the named
+// file, which holds the key in hexadecimal. Surrounding whitespace is
+// ignored.
+func NewMasterKeyFile(name string) (KeyWrapper, error) {
+	text, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(text)))
+	if err != nil {
+		return nil, fmt.Errorf("master key in %s: %w", name, err)
+	}
+	return NewMasterKey(key)
+}
+
+type masterKey struct {
+	aead cipher.AEAD
+}
+
+func (m masterKey) WrapKey(key []byte) ([]byte, error) {
+	nonce := make([]byte, m.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return m.aead.Seal(nonce, nonce, key, nil), nil
+}
+
+func (m masterKey) UnwrapKey(wrapped []byte) ([]byte, error) {
+	n := m.aead.NonceSize()
+	if len(wrapped) < n {
+		return nil, ErrDecrypt
+	}
+	key, err := m.aead.Open(nil, wrapped[:n], wrapped[n:], nil)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return key, nil
+}
+
+// SetEncryption makes blobs written from now on be encrypted, using a data
+// key for each item wrapped by kw. Items without a data key are given one
+// when a blob is first written to them. Passing nil, the default, stores new
+// blobs unencrypted. Blobs already saved are read however they were written,
+// but encrypted ones can only be read while a KeyWrapper able to unwrap their
+// item's data key is set. Repacking, renaming, and exporting copy encrypted
+// blobs without decrypting them. It is intended to be used during
+// initialization.
+func (s *Store) SetEncryption(kw KeyWrapper) {
+	s.keys = kw
+}
+
+// dataKeySize is the length of the AES keys made for items.
+const dataKeySize = 32
+
+// itemCipher returns the cipher made from the data key of item. If the item
+// has no data key and create is true, one is made, wrapped, and saved in the
+// item. Otherwise nil is returned if the item has no data key.
+func (s *Store) itemCipher(item *Item, create bool) (cipher.AEAD, error) {
+	if len(item.DataKey) == 0 && !create {
+		return nil, nil
+	}
+	if s.keys == nil {
+		return nil, ErrNoKey
+	}
+	if len(item.DataKey) == 0 {
+		key := make([]byte, dataKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		wrapped, err := s.keys.WrapKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("wrapping data key of %s: %w", item.ID, err)
+		}
+		item.DataKey = wrapped
+		return newAEAD(key)
+	}
+	key, err := s.keys.UnwrapKey(item.DataKey)
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping data key of %s: %w", item.ID, err)
+	}
+	return newAEAD(key)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+/*
+Encrypted blob content is divided into chunks of cryptChunk bytes, the last
+one possibly shorter, or empty if the content is, and each chunk is sealed separately
+with AES-GCM so the content can be streamed. The stream begins with a
+header of a format byte, currently 1, and 7 random bytes. The nonce for each
+chunk is the 7 random bytes, the chunk number as 4 bytes big-endian, and a
+byte which is 1 for the last chunk and 0 otherwise, so chunks cannot be
+reordered and the content cannot be truncated without being detected.
+*/
+
+const (
+	cryptFormat   = 1
+	cryptChunk    = 64 * 1024
+	cryptHeader   = 8
+	cryptOverhead = 16 // the GCM tag added to each chunk
+)
+
+// encryptedSize returns the size of the encrypted stream made from n bytes.
+func encryptedSize(n int64) int64 {
+	chunks := (n + cryptChunk - 1) / cryptChunk
+	if chunks == 0 {
+		chunks = 1
+	}
+	return cryptHeader + n + chunks*cryptOverhead
+}
+
+// storedSize returns the number of bytes of the blob's content stored in
+// its bundles, which is more than its size if it is encrypted. Even empty
+// content has a header and a tag when encrypted.
+func (b *Blob) storedSize() int64 {
+	if b.Encrypted {
+		return encryptedSize(b.Size)
+	}
+	return b.Size
+}
+
+// chunkNonce makes the nonce of chunk n of a stream having the given header.
+func chunkNonce(nonce []byte, header []byte, n uint32, last bool) {
+	copy(nonce, header[1:cryptHeader])
+	binary.BigEndian.PutUint32(nonce[7:], n)
+	nonce[11] = 0
+	if last {
+		nonce[11] = 1
+	}
+}
+
+// An encrypter is an io.Reader giving the encrypted content of the reader
+// it wraps. It also counts the bytes read from it.
+type encrypter struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	header []byte
+	nonce  []byte
+	chunk  uint32
+	buf    []byte // plaintext read but not yet sealed
+	have   int    // number of bytes in buf
+	out    []byte // sealed bytes not yet returned
+	sealed []byte
+	done   bool
+	err    error
+	n      int64 // plaintext bytes read
+}
+
+func newEncrypter(aead cipher.AEAD, r io.Reader) (*encrypter, error) {
+	header := make([]byte, cryptHeader)
+	header[0] = cryptFormat
+	if _, err := rand.Read(header[1:]); err != nil {
+		return nil, err
+	}
+	return &encrypter{
+		r:      r,
+		aead:   aead,
+		header: header,
+		nonce:  make([]byte, aead.NonceSize()),
+		buf:    make([]byte, cryptChunk+1),
+		out:    header,
+		sealed: make([]byte, 0, cryptChunk+cryptOverhead),
+	}, nil
+}
+
+func (e *encrypter) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if e.err != nil {
+			return 0, e.err
+		}
+		e.fill()
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+// fill seals the next chunk. One byte more than a chunk is read, so the last
+// chunk is known when it is sealed.
+func (e *encrypter) fill() {
+	m, err := io.ReadFull(e.r, e.buf[e.have:])
+	e.have += m
+	e.n += int64(m)
+	last := err == io.EOF || err == io.ErrUnexpectedEOF
+	if err != nil && !last {
+		e.err = err
+		return
+	}
+	size := e.have
+	if size > cryptChunk {
+		size = cryptChunk
+	}
+	chunkNonce(e.nonce, e.header, e.chunk, last)
+	e.out = e.aead.Seal(e.sealed[:0], e.nonce, e.buf[:size], nil)
+	e.chunk++
+	if last {
+		e.done = true
+		return
+	}
+	if e.chunk == 0 {
+		e.err = errors.New("encrypted content is too long")
+		return
+	}
+	e.buf[0] = e.buf[cryptChunk]
+	e.have = 1
+}
+
+// A decrypter is an io.ReadCloser giving the decrypted content of an
+// encrypted stream. An error is returned as soon as a chunk fails
+// authentication, and before any of its content is returned.
+type decrypter struct {
+	rc     io.ReadCloser
+	aead   cipher.AEAD
+	header []byte
+	nonce  []byte
+	chunk  uint32
+	buf    []byte // ciphertext read but not yet opened
+	have   int
+	out    []byte // opened bytes not yet returned
+	opened []byte
+	done   bool
+	err    error
+}
+
+func newDecrypter(aead cipher.AEAD, rc io.ReadCloser) *decrypter {
+	return &decrypter{
+		rc:     rc,
+		aead:   aead,
+		nonce:  make([]byte, aead.NonceSize()),
+		buf:    make([]byte, cryptChunk+cryptOverhead+1),
+		opened: make([]byte, 0, cryptChunk),
+	}
+}
+
+func (d *decrypter) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if d.err != nil {
+			return 0, d.err
+		}
+		d.fill()
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+func (d *decrypter) fill() {
+	if d.header == nil {
+		header := make([]byte, cryptHeader)
+		_, err := io.ReadFull(d.rc, header)
+		if err == io.EOF || err == io.ErrUnexpectedEOF || (err == nil && header[0] != cryptFormat) {
+			err = ErrDecrypt
+		}
+		if err != nil {
+			d.err = err
+			return
+		}
+		d.header = header
+	}
+	m, err := io.ReadFull(d.rc, d.buf[d.have:])
+	d.have += m
+	last := err == io.EOF || err == io.ErrUnexpectedEOF
+	if err != nil && !last {
+		d.err = err
+		return
+	}
+	size := d.have
+	if size > cryptChunk+cryptOverhead {
+		size = cryptChunk + cryptOverhead
+	}
+	chunkNonce(d.nonce, d.header, d.chunk, last)
+	d.out, err = d.aead.Open(d.opened[:0], d.nonce, d.buf[:size], nil)
+	if err != nil {
+		d.err = ErrDecrypt
+		return
+	}
+	d.chunk++
+	if last {
+		d.done = true
+		return
+	}
+	d.buf[0] = d.buf[cryptChunk+cryptOverhead]
+	d.have = 1
+}
+
+func (d *decrypter) Close() error {
+	return d.rc.Close()
+}
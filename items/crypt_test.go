@@ -0,0 +1,135 @@
+package items
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/ndlib/bendo/store"
+)
+
+func TestEncryptStream(t *testing.T) {
+	aead, err := newAEAD(bytes.Repeat([]byte{7}, dataKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sizes = []int{0, 1, cryptChunk - 1, cryptChunk, cryptChunk + 1, 3*cryptChunk + 5}
+	for _, size := range sizes {
+		plain := make([]byte, size)
+		for i := range plain {
+			plain[i] = byte(i * 31)
+		}
+		enc, err := newEncrypter(aead, bytes.NewReader(plain))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sealed, err := io.ReadAll(enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(sealed)) != encryptedSize(int64(size)) || enc.n != int64(size) {
+			t.Errorf("size %d: encrypted %d bytes from %d, expected %d", size, len(sealed), enc.n, encryptedSize(int64(size)))
+		}
+		got, err := io.ReadAll(newDecrypter(aead, io.NopCloser(bytes.NewReader(sealed))))
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("size %d: decrypted %d bytes, %v", size, len(got), err)
+		}
+
+		// changed and truncated content is found
+		changed := append([]byte(nil), sealed...)
+		changed[len(changed)/2] ^= 1
+		_, err = io.ReadAll(newDecrypter(aead, io.NopCloser(bytes.NewReader(changed))))
+		if err != ErrDecrypt {
+			t.Errorf("size %d: changed content gave %v", size, err)
+		}
+		if size > cryptChunk {
+			short := sealed[:cryptHeader+cryptChunk+cryptOverhead]
+			_, err = io.ReadAll(newDecrypter(aead, io.NopCloser(bytes.NewReader(short))))
+			if err != ErrDecrypt {
+				t.Errorf("size %d: truncated content gave %v", size, err)
+			}
+		}
+	}
+}
+
+func TestEncryptedItem(t *testing.T) {
+	master, _ := NewMasterKey(bytes.Repeat([]byte{1}, 32))
+	ms := store.NewMemory()
+	s := New(ms)
+	s.SetEncryption(master)
+	s.SetSegmentSize(100)
+	w, _ := s.Open("secret", "nobody")
+	small := writedata(t, w, "hello world")
+	big := string(bytes.Repeat([]byte("0123456789"), 20))
+	large := writedata(t, w, big)
+	another := writedata(t, w, "another")
+	empty := writedata(t, w, "")
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s = New(ms)
+	s.SetEncryption(master)
+	checkRead(t, s, "secret", small, []byte("hello world"))
+	checkRead(t, s, "secret", large, []byte(big))
+	item, _ := s.Item("secret")
+	if len(item.DataKey) == 0 || !item.blobByID(small).Encrypted || len(item.blobByID(large).Segments) != 3 {
+		t.Errorf("Received item %+v", item)
+	}
+	_, problems, err := s.Validate("secret")
+	if err != nil || len(problems) != 0 {
+		t.Errorf("Validate() == %v, %v", problems, err)
+	}
+	// the bundle does not hold the content
+	rc, err := s.openBundleStream("secret", 1, "blob/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := io.ReadAll(rc)
+	rc.Close()
+	if bytes.Contains(stored, []byte("hello")) {
+		t.Errorf("Blob is stored unencrypted")
+	}
+
+	// deleting, repacking, and exporting copy the encrypted content
+	w, _ = s.Open("secret", "nobody")
+	w.DeleteBlob(another)
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Repack("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := store.NewMemory()
+	err = s.Export("secret", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, x := range []store.Store{ms, dest} {
+		s = New(x)
+		s.SetEncryption(master)
+		checkRead(t, s, "secret", small, []byte("hello world"))
+		checkRead(t, s, "secret", large, []byte(big))
+		checkRead(t, s, "secret", empty, nil)
+		_, problems, err = s.Validate("secret")
+		if err != nil || len(problems) != 0 {
+			t.Errorf("Validate() == %v, %v", problems, err)
+		}
+	}
+
+	// the content cannot be read without the master key
+	s = New(ms)
+	_, _, err = s.Blob("secret", small)
+	if err != ErrNoKey {
+		t.Errorf("Blob() without a key gave %v", err)
+	}
+	other, _ := NewMasterKey(bytes.Repeat([]byte{2}, 32))
+	s.SetEncryption(other)
+	_, _, err = s.Blob("secret", small)
+	if err == nil {
+		t.Errorf("Blob() with the wrong key gave no error")
+	}
+}
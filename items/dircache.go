@@ -0,0 +1,168 @@
+package items
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/ndlib/bendo/bagit"
+)
+
+// A DirectoryCache holds the directories of bundles, so a bundle read again
+// does not need its zip directory or tar headers read from the store each
+// time. Entries are keyed by the bundle's key in the store, and carry the
+// size of the bundle file, so a directory is not used for a bundle which has
+// since been replaced by a different one. Implementations must be safe to
+// use from more than one goroutine.
+type DirectoryCache interface {
+	// Lookup returns the directory saved for the bundle with the given
+	// key and size, or nil if there is none.
+	Lookup(key string, size int64) bagit.Directory
+
+	Set(key string, size int64, dir bagit.Directory)
+
+	// Delete removes any directory saved for the given key. It is not an
+	// error if there is none.
+	Delete(key string)
+}
+
+// DefaultDirectoryCacheSize is the number of bundle directories a Store
+// keeps, unless changed with SetDirectoryCache.
+const DefaultDirectoryCacheSize = 1000
+
+// SetDirectoryCache sets where the directories of bundles read from the
+// store are kept. A nil cache reads the directory every time a bundle is
+// opened. It is intended to be used during initialization.
+func (s *Store) SetDirectoryCache(c DirectoryCache) {
+	s.dirs = c
+}
+
+// openBundle opens the bundle with the given key, like OpenBundle, but uses
+// the directory in the store's directory cache if there is one, and saves
+// the directory there otherwise.
+func (s *Store) openBundle(key string) (*BagreaderCloser, error) {
+	if s.dirs == nil {
+		return OpenBundle(s.S, key)
+	}
+	stream, size, err := s.S.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	if dir := s.dirs.Lookup(key, size); dir != nil {
+		return &BagreaderCloser{
+			Reader: bagit.NewDirectoryReader(stream, dir),
+			f:      stream,
+			key:    key,
+		}, nil
+	}
+	r, err := bagit.NewReader(stream, size)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	if dir := r.Directory(); dir != nil {
+		s.dirs.Set(key, size, dir)
+	}
+	return &BagreaderCloser{
+		Reader: r,
+		f:      stream,
+		key:    key,
+	}, nil
+}
+
+// openCachedBundle opens bundle n of the given item, whichever format it
+// was saved in, using the directory cache.
+func (s *Store) openCachedBundle(id string, n int) (*BagreaderCloser, error) {
+	key := s.layout.Key(id, n)
+	r, err := s.openBundle(formatKey(key, s.format))
+	if err != nil {
+		var err2 error
+		r, err2 = s.openBundle(formatKey(key, s.format.other()))
+		if err2 == nil {
+			err = nil
+		}
+	}
+	return r, err
+}
+
+// deleteBundle removes the bundle with the given key and the files kept
+// alongside it, and forgets its directory. Missing sidecars are not an
+// error.
+func (s *Store) deleteBundle(key string) error {
+	s.forgetDirectory(key)
+	err := s.S.Delete(key)
+	deleteSidecars(s.S, key)
+	return err
+}
+
+// forgetDirectory removes any cached directory for the bundle with the given
+// key, which is about to be deleted or replaced.
+func (s *Store) forgetDirectory(key string) {
+	if s.dirs != nil {
+		s.dirs.Delete(key)
+	}
+}
+
+// NewDirectoryCache returns a DirectoryCache which keeps the directories of
+// the n bundles used most recently in memory.
+func NewDirectoryCache(n int) DirectoryCache {
+	return &lruDirCache{
+		max:     n,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+type lruDirCache struct {
+	m       sync.Mutex
+	max     int
+	entries map[string]*list.Element // values are *dirEntry
+	order   *list.List               // most recently used first
+}
+
+type dirEntry struct {
+	key  string
+	size int64
+	dir  bagit.Directory
+}
+
+func (c *lruDirCache) Lookup(key string, size int64) bagit.Directory {
+	c.m.Lock()
+	defer c.m.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	d := e.Value.(*dirEntry)
+	if d.size != size {
+		c.order.Remove(e)
+		delete(c.entries, key)
+		return nil
+	}
+	c.order.MoveToFront(e)
+	return d.dir
+}
+
+func (c *lruDirCache) Set(key string, size int64, dir bagit.Directory) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value = &dirEntry{key: key, size: size, dir: dir}
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&dirEntry{key: key, size: size, dir: dir})
+	for c.order.Len() > c.max {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.entries, e.Value.(*dirEntry).key)
+	}
+}
+
+func (c *lruDirCache) Delete(key string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.order.Remove(e)
+		delete(c.entries, key)
+	}
+}
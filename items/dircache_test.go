@@ -0,0 +1,83 @@
+package items
+
+import (
+	"io"
+	"testing"
+
+	"github.com/ndlib/bendo/bagit"
+	"github.com/ndlib/bendo/store"
+)
+
+func TestDirectoryCache(t *testing.T) {
+	ms := store.NewMemory()
+	s := New(ms)
+	dirs := NewDirectoryCache(10)
+	s.SetDirectoryCache(dirs)
+	w, err := s.Open("dir", "nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writedata(t, w, "hello")
+	w.Close()
+
+	readblob := func(s *Store) (string, error) {
+		rc, _, err := s.Blob("dir", 1)
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+		b, err := io.ReadAll(rc)
+		return string(b), err
+	}
+	if got, err := readblob(s); err != nil || got != "hello" {
+		t.Fatalf("Blob() == %q, %v, expected hello", got, err)
+	}
+	bundle := readkey(t, ms, "dir-0001.zip")
+	if dirs.Lookup("dir-0001.zip", int64(len(bundle))) == nil {
+		t.Fatalf("Expected the directory of dir-0001.zip to be cached")
+	}
+
+	// wreck the zip directory at the end of the bundle, keeping its size.
+	// The cached directory should still find the blob.
+	for i := len(bundle) - 22; i < len(bundle); i++ {
+		bundle[i] = 0
+	}
+	f, _ := ms.Create("dir-0001.zip")
+	f.Write(bundle)
+	f.Close()
+	if got, err := readblob(s); err != nil || got != "hello" {
+		t.Errorf("Blob() == %q, %v, expected hello from the cached directory", got, err)
+	}
+	if _, err := readblob(New(ms)); err == nil {
+		t.Errorf("Blob() succeeded without a cached directory")
+	}
+
+	err = s.Delete("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dirs.Lookup("dir-0001.zip", int64(len(bundle))) != nil {
+		t.Errorf("Directory of dir-0001.zip is still cached after delete")
+	}
+}
+
+func TestDirectoryCacheEvict(t *testing.T) {
+	c := NewDirectoryCache(2)
+	dir := bagit.Directory{{Name: "a/data/blob/1", Offset: 10, Size: 5}}
+	c.Set("one", 100, dir)
+	c.Set("two", 100, dir)
+	c.Lookup("one", 100) // make two the least recently used
+	c.Set("three", 100, dir)
+	if c.Lookup("two", 100) != nil {
+		t.Errorf("Expected two to be evicted")
+	}
+	if c.Lookup("one", 100) == nil || c.Lookup("three", 100) == nil {
+		t.Errorf("Expected one and three to be kept")
+	}
+	if c.Lookup("one", 101) != nil {
+		t.Errorf("Lookup with a different size succeeded")
+	}
+	if c.Lookup("one", 100) != nil {
+		t.Errorf("Expected one to be dropped after a size mismatch")
+	}
+}
@@ -0,0 +1,118 @@
+package items
+
+import (
+	"io"
+	"time"
+
+	"github.com/ndlib/bendo/store"
+	"github.com/ndlib/bendo/util"
+)
+
+// Export writes a copy of the item id into the store dest. Every blob which
+// has not been deleted is copied, in order of blob id, into new bundles
+// starting with bundle 1. The bundles are written deterministically, using
+// the save date of the item's most recent version for every timestamp, so
+// exporting the same item twice gives byte-identical bundles. Blobs which
+// refer to blobs in other items, from deduplication, are given a copy of the
+// content referred to, so the export does not depend on any other item. That
+// content is encrypted anew if the item is encrypted, so those bundles are
+// not identical from one export to the next. The item in this store is not
+// changed.
+func (s *Store) Export(id string, dest store.Store) error {
+	item, err := s.Item(id)
+	if err != nil {
+		return err
+	}
+	// work on a copy since the bundle numbers will change
+	exp := &Item{
+		ID:       item.ID,
+		Versions: item.Versions,
+		DataKey:  item.DataKey,
+	}
+	for _, blob := range item.Blobs {
+		b := *blob
+		b.Segments = append([]Segment(nil), blob.Segments...)
+		exp.Blobs = append(exp.Blobs, &b)
+	}
+	var modtime time.Time
+	if n := len(item.Versions); n > 0 {
+		modtime = item.Versions[n-1].SaveDate
+	}
+	bw := NewBundler(dest, exp)
+	bw.SetModTime(modtime)
+	for _, blob := range exp.Blobs {
+		if blob.RefItem != "" {
+			err = s.exportRef(bw, blob)
+		} else if blob.Bundle == 0 {
+			// blob has been deleted
+			continue
+		} else {
+			err = s.exportBlob(bw, blob)
+		}
+		if err != nil {
+			bw.Close()
+			return err
+		}
+		exp.MaxBundle = bw.CurrentBundle()
+	}
+	exp.MaxBundle = bw.CurrentBundle()
+	return bw.Close()
+}
+
+// exportBlob copies the given blob from this store into the bundle writer.
+// Segmented blobs are copied one segment at a time.
+func (s *Store) exportBlob(bw *BundleWriter, blob *Blob) error {
+	_, err := s.repackBlob(bw, bw.item.ID, blob)
+	return err
+}
+
+// exportRef copies the content a reference refers to into the bundle writer,
+// making blob an ordinary blob of the exported item. The content is
+// encrypted if the exported item has a data key. Since the content is
+// written again rather than copied, it is checked against the checksums of
+// the blob.
+func (s *Store) exportRef(bw *BundleWriter, blob *Blob) error {
+	rc, _, err := s.Blob(bw.item.ID, blob.ID)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	blob.RefItem = ""
+	blob.RefBlob = 0
+	aead, err := s.itemCipher(bw.item, false)
+	if err != nil {
+		return err
+	}
+	var r io.Reader = rc
+	var enc *encrypter
+	var plain *util.HashWriter
+	if aead != nil {
+		// the bundle writer is given the encrypted content, so the
+		// content is checksummed separately as it is read
+		plain = util.NewHashWriterPlain()
+		enc, err = newEncrypter(aead, io.TeeReader(rc, plain))
+		if err != nil {
+			return err
+		}
+		blob.Encrypted = true
+		r = enc
+	}
+	var result Results
+	if s.segment > 0 && blob.Size > s.segment {
+		result, blob.Segments, err = bw.WriteSegments(blob, r, s.segment)
+	} else {
+		result, err = bw.WriteBlob(blob, r)
+	}
+	if err != nil {
+		return err
+	}
+	blob.Bundle = result.Bundle
+	if enc != nil {
+		blob.StoredMD5 = result.WrittenMD5
+		blob.StoredSHA256 = result.WrittenSHA256
+		result.BytesWritten = enc.n
+		result.WrittenMD5, _ = plain.CheckMD5(nil)
+		result.WrittenSHA256, _ = plain.CheckSHA256(nil)
+	}
+	return ValidateWriteBlob(bw.item.ID, blob, result)
+}
@@ -0,0 +1,119 @@
+package items
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"testing"
+
+	"github.com/ndlib/bendo/store"
+)
+
+func TestExport(t *testing.T) {
+	ms := store.NewMemory()
+	s := New(ms)
+	w, err := s.Open("exp", "nobody")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	w.SetSlot("a", writedata(t, w, "hello"))
+	w.SetSlot("b", writedata(t, w, "delete me"))
+	w.Close()
+	w, _ = s.Open("exp", "nobody")
+	w.SetSlot("c", writedata(t, w, "goodbye"))
+	w.DeleteBlob(2)
+	w.Close()
+
+	var exports [2]store.Store
+	for i := range exports {
+		exports[i] = store.NewMemory()
+		err = s.Export("exp", exports[i])
+		if err != nil {
+			t.Fatalf("Export() == %s, expected nil", err.Error())
+		}
+	}
+	b1 := readkey(t, exports[0], "exp-0001.zip")
+	b2 := readkey(t, exports[1], "exp-0001.zip")
+	if !bytes.Equal(b1, b2) {
+		t.Errorf("Exported bundles differ")
+	}
+	// one bundle and its sidecars
+	if keys, _ := exports[0].ListPrefix(""); len(keys) != 3 {
+		t.Errorf("Received bundles %v, expected one", keys)
+	}
+
+	// the export should be a readable item
+	item, err := New(exports[0]).Item("exp")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	if len(item.Versions) != 2 || len(item.Blobs) != 3 || item.MaxBundle != 1 {
+		t.Errorf("Received %#v", item)
+	}
+	r, _, err := New(exports[0]).Blob("exp", 3)
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	content, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(content) != "goodbye" {
+		t.Errorf("Received %q, expected %q", content, "goodbye")
+	}
+}
+
+func TestExportReference(t *testing.T) {
+	master, _ := NewMasterKey(bytes.Repeat([]byte{1}, 32))
+	for _, key := range []KeyWrapper{nil, master} {
+		s := New(store.NewMemory())
+		if key != nil {
+			s.SetEncryption(key)
+		}
+		w, _ := s.Open("first", "nobody")
+		bid := writedata(t, w, "license text")
+		w.Close()
+		hash := sha256.Sum256([]byte("license text"))
+		s.SetBlobFinder(oneBlobFinder{item: "first", bid: bid, sha256: hash[:]})
+		w, _ = s.Open("second", "nobody")
+		bid2 := writedata(t, w, "license text")
+		// a blob of its own gives the item a data key when encrypting
+		writedata(t, w, "readme")
+		w.Close()
+		if blob, _ := s.BlobInfo("second", bid2); blob.RefItem != "first" {
+			t.Fatalf("Received %+v, expected a reference", blob)
+		}
+
+		// the export holds the content even though "first" is not exported
+		dest := store.NewMemory()
+		err := s.Export("second", dest)
+		if err != nil {
+			t.Fatalf("Export() == %s, expected nil", err.Error())
+		}
+		s = New(dest)
+		if key != nil {
+			s.SetEncryption(key)
+		}
+		blob, _ := s.BlobInfo("second", bid2)
+		if blob.RefItem != "" || blob.Bundle == 0 || blob.Encrypted != (key != nil) {
+			t.Errorf("Received %+v, expected a blob with content", blob)
+		}
+		checkRead(t, s, "second", bid2, []byte("license text"))
+		_, problems, err := s.Validate("second")
+		if err != nil || len(problems) != 0 {
+			t.Errorf("Validate() == %v, %v", problems, err)
+		}
+	}
+}
+
+func readkey(t *testing.T, s store.Store, key string) []byte {
+	r, size, err := s.Open(key)
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	defer r.Close()
+	buf := make([]byte, size)
+	_, err = r.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	return buf
+}
@@ -0,0 +1,135 @@
+package items
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ndlib/bendo/store"
+)
+
+// A BundleFormat is how bundle files are serialized. Bundles are BagIt bags
+// in either format, and a store reads bundles of both formats no matter
+// which one it writes, so the format may be changed at any time. The
+// extension of a bundle's key gives its format, e.g. "abc123-0001.tar".
+type BundleFormat int
+
+const (
+	// ZipFormat saves bundles as zip files. It is the default.
+	ZipFormat BundleFormat = iota
+
+	// TarFormat saves bundles as tar files, which tape systems can
+	// stream more efficiently, and which can be read without first
+	// reading the directory at the end. Blobs of unknown size are held
+	// in a temporary file while they are written.
+	TarFormat
+)
+
+// ParseBundleFormat returns the format with the given name, either "zip" or
+// "tar". The empty string is the zip format.
+func ParseBundleFormat(name string) (BundleFormat, error) {
+	switch name {
+	case "", "zip":
+		return ZipFormat, nil
+	case "tar":
+		return TarFormat, nil
+	}
+	return ZipFormat, fmt.Errorf("unknown bundle format %q", name)
+}
+
+func (f BundleFormat) String() string {
+	if f == TarFormat {
+		return "tar"
+	}
+	return "zip"
+}
+
+// ext returns the extension of bundle keys in this format.
+func (f BundleFormat) ext() string {
+	return "." + f.String()
+}
+
+// other returns the format which is not f.
+func (f BundleFormat) other() BundleFormat {
+	if f == TarFormat {
+		return ZipFormat
+	}
+	return TarFormat
+}
+
+// formatKey changes the extension of a key made by a Layout to the one for
+// the given format. Layouts always make keys ending in ".zip".
+func formatKey(key string, f BundleFormat) string {
+	return strings.TrimSuffix(key, ".zip") + f.ext()
+}
+
+// keyFormat returns the format of the bundle having the given key.
+func keyFormat(key string) BundleFormat {
+	if strings.HasSuffix(key, ".tar") {
+		return TarFormat
+	}
+	return ZipFormat
+}
+
+// SetBundleFormat sets the format new bundles are written in. Bundles
+// already saved in the other format are still read. It is intended to be
+// used during initialization, like SetLayout.
+func (s *Store) SetBundleFormat(f BundleFormat) {
+	s.format = f
+}
+
+// BundleFormat returns the format new bundles are written in.
+func (s *Store) BundleFormat() BundleFormat {
+	return s.format
+}
+
+// bundleKey returns the key a new bundle n of the given item is written
+// under.
+func (s *Store) bundleKey(id string, n int) string {
+	return formatKey(s.layout.Key(id, n), s.format)
+}
+
+// openBundleN opens bundle n of the given item, whichever format it was
+// saved in. The key for the store's format is tried first. If neither key
+// can be opened, the error from the first is returned.
+func openBundleN(s store.Store, layout Layout, f BundleFormat, id string, n int) (*BagreaderCloser, error) {
+	key := layout.Key(id, n)
+	r, err := OpenBundle(s, formatKey(key, f))
+	if err != nil {
+		var err2 error
+		r, err2 = OpenBundle(s, formatKey(key, f.other()))
+		if err2 == nil {
+			err = nil
+		}
+	}
+	return r, err
+}
+
+// openBundleStream returns the contents of the stream sname inside bundle n
+// of the given item, whichever format the bundle was saved in.
+func (s *Store) openBundleStream(id string, n int, sname string) (io.ReadCloser, error) {
+	r, err := s.openCachedBundle(id, n)
+	if err != nil {
+		return nil, err
+	}
+	return openStream(r, sname)
+}
+
+// findBundleKey returns the key bundle n of the given item was saved under,
+// checking for the key of the store's format first. The key for the
+// store's format is returned if neither exists.
+func (s *Store) findBundleKey(id string, n int) string {
+	key := s.bundleKey(id, n)
+	r, _, err := s.S.Open(key)
+	if err == nil {
+		r.Close()
+		return key
+	}
+	other := formatKey(s.layout.Key(id, n), s.format.other())
+	r, _, err = s.S.Open(other)
+	if err == nil {
+		r.Close()
+		return other
+	}
+	return key
+}
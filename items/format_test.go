@@ -0,0 +1,102 @@
+package items
+
+import (
+	"archive/tar"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/ndlib/bendo/store"
+)
+
+func TestParseBundleFormat(t *testing.T) {
+	var table = []struct {
+		name   string
+		format BundleFormat
+		ok     bool
+	}{
+		{"", ZipFormat, true},
+		{"zip", ZipFormat, true},
+		{"tar", TarFormat, true},
+		{"rar", ZipFormat, false},
+	}
+	for _, tab := range table {
+		f, err := ParseBundleFormat(tab.name)
+		if f != tab.format || (err == nil) != tab.ok {
+			t.Errorf("%q: received %v, %v", tab.name, f, err)
+		}
+	}
+}
+
+func TestTarBundles(t *testing.T) {
+	ms := store.NewMemory()
+	s := New(ms)
+	s.SetBundleFormat(TarFormat)
+	w, err := s.Open("abc", "nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := writedata(t, w, "hello")
+	// a blob of unknown size
+	second, err := w.WriteBlob(strings.NewReader("size not given"), 0, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetSlot("first", first)
+	w.SetSlot("second", second)
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the bundle should be a tar file
+	rac, size, err := ms.Open("abc-0001.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(io.NewSectionReader(rac, 0, size))
+	hdr, err := tr.Next()
+	if err != nil || !strings.HasPrefix(hdr.Name, "abc/data/blob/") {
+		t.Errorf("Received header %v, %v", hdr, err)
+	}
+	rac.Close()
+
+	// switch to zip, and make a new version which deletes a blob, so the
+	// tar bundle is rewritten as a zip bundle
+	s.SetBundleFormat(ZipFormat)
+	w, err = s.Open("abc", "nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	third := writedata(t, w, "third")
+	w.SetSlot("third", third)
+	w.DeleteBlob(second)
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, _ := ms.ListPrefix("abc-")
+	for _, key := range keys {
+		if strings.HasSuffix(key, ".tar") {
+			t.Errorf("Found %s, expected the tar bundle to be deleted", key)
+		}
+	}
+
+	// a fresh store reads both formats
+	s = New(ms)
+	checkRead(t, s, "abc", first, []byte("hello"))
+	checkRead(t, s, "abc", third, []byte("third"))
+	_, problems, err := s.Validate("abc")
+	if err != nil || len(problems) > 0 {
+		t.Errorf("Validate returned %v, %v", problems, err)
+	}
+}
+
+func TestTarDesugar(t *testing.T) {
+	for _, key := range []string{"abc-0012.zip", "abc-0012.tar"} {
+		id, n := FlatLayout{}.Parse(key)
+		if id != "abc" || n != 12 {
+			t.Errorf("%s: received %q, %d", key, id, n)
+		}
+	}
+}
@@ -1,10 +1,12 @@
 package items
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -15,19 +17,73 @@ import (
 // A Store holds a collection of items
 type Store struct {
 	cache    ItemCache
-	S        store.Store // the underlying bundle store
-	useStore bool        // true - use bundlestore: false - use only itemCache
+	S        store.Store    // the underlying bundle store
+	layout   Layout         // how bundles are named in S
+	useStore bool           // true - use bundlestore: false - use only itemCache
+	digests  []string       // checksums recorded for new blobs besides MD5 and SHA256
+	parity   ParityScheme   // parity written for new bundles
+	format   BundleFormat   // format new bundles are written in
+	finder   BlobFinder     // finds duplicate blobs in other items, may be nil
+	refs     RefFinder      // finds blobs in other items referring to ours, may be nil
+	segment  int64          // blobs larger than this are split into segments, 0 for never
+	keys     KeyWrapper     // wraps the data keys of items, nil to not encrypt
+	rangeLen int64          // the length of each range read in parallel
+	readers  int            // the number of ranges read at once, 0 or 1 for none
+	verify   bool           // check blob content against its checksums as it is read
+	policy   BundlePolicy   // when to start new bundles, nil for the default
+	dirs     DirectoryCache // directories of bundles read, nil for none
 }
 
+// DefaultDigests are the checksums recorded for new blobs in addition to
+// MD5 and SHA256, unless changed with SetDigests.
+var DefaultDigests = []string{"sha512"}
+
 // New creates a new item store which writes its bundles to the given store.Store.
 func New(s store.Store) *Store {
-	return &Store{S: s, cache: Nullcache, useStore: true}
+	return &Store{S: s, cache: Nullcache, layout: FlatLayout{}, useStore: true, digests: DefaultDigests,
+		dirs: NewDirectoryCache(DefaultDirectoryCacheSize)}
 }
 
 // NewWithCache creates a new item store which caches the item metadata in the
 // given cache. (Should be deprecated??)
 func NewWithCache(s store.Store, cache ItemCache) *Store {
-	return &Store{S: s, cache: cache, useStore: true}
+	return &Store{S: s, cache: cache, layout: FlatLayout{}, useStore: true, digests: DefaultDigests,
+		dirs: NewDirectoryCache(DefaultDirectoryCacheSize)}
+}
+
+// SetLayout sets how bundles are named in the underlying store. It is
+// intended to be used during initialization, like SetCache. Items saved
+// with a different layout will not be found; use MigrateItem to move them.
+func (s *Store) SetLayout(layout Layout) {
+	s.layout = layout
+}
+
+// Layout returns how bundles are named in the underlying store.
+func (s *Store) Layout() Layout {
+	return s.layout
+}
+
+// SetDigests sets the checksums recorded for new blobs in addition to MD5
+// and SHA256. The names are those registered with util.RegisterDigest, such
+// as "sha512"; unknown names are ignored. Blobs already saved keep the
+// checksums they have. It is intended to be used during initialization.
+func (s *Store) SetDigests(names []string) {
+	s.digests = names
+}
+
+// A BlobFinder locates a blob stored in some item having the given size and
+// SHA-256 hash. It returns an item id of "" if there is no such blob. It is
+// used to store duplicate content only once, by making a reference to the
+// blob already stored instead of writing a new copy.
+type BlobFinder interface {
+	FindBlobByHash(size int64, sha256 []byte) (string, BlobID, error)
+}
+
+// SetBlobFinder sets how blobs duplicating ones in other items are found.
+// If it is nil, which is the default, blobs are only deduplicated within
+// an item. It is intended to be used during initialization.
+func (s *Store) SetBlobFinder(f BlobFinder) {
+	s.finder = f
 }
 
 // SetCache will set the metadata cache used. It is intended to be used during
@@ -50,7 +106,7 @@ func (s *Store) List() <-chan string {
 		items := make(map[string]struct{})
 		c := s.S.List()
 		for key := range c {
-			id, _ := desugar(key)
+			id, _ := s.layout.Parse(key)
 			if id == "" {
 				continue
 			}
@@ -70,10 +126,11 @@ func sugar(id string, n int) string {
 	return fmt.Sprintf("%s-%04d.zip", id, n)
 }
 
-// Extract an item id and a bundle number from a string key.
+// Extract an item id and a bundle number from a string key, which may be
+// for a bundle in either format.
 // Returns an id of "" if the key could not be decoded.
 func desugar(s string) (id string, n int) {
-	s = strings.TrimSuffix(s, ".zip")
+	s = strings.TrimSuffix(s, keyFormat(s).ext())
 	j := strings.LastIndex(s, "-")
 	if j == -1 {
 		return "", 0
@@ -101,6 +158,12 @@ var (
 // Item loads and return an item's metadata info. This will block until the
 // item is loaded.
 func (s *Store) Item(id string) (*Item, error) {
+	return s.ItemContext(context.Background(), id)
+}
+
+// ItemContext is like Item, but stops reading the item's metadata from the
+// store, returning the context's error, once ctx is done.
+func (s *Store) ItemContext(ctx context.Context, id string) (*Item, error) {
 	result := s.cache.Lookup(id)
 	if result != nil && len(result.Versions) > 0 {
 		return result, nil // a complete item record
@@ -110,42 +173,92 @@ func (s *Store) Item(id string) (*Item, error) {
 		return result, ErrNoStore
 	}
 
-	result, err := s.itemload(id)
+	result, err := s.itemload(ctx, id)
 	if err == nil {
 		s.cache.Set(id, result)
 	}
 	return result, err
 }
 
+// ItemFromStore loads an item's metadata directly from the store, skipping
+// the cache. The cache is not updated. Use it to compare a cached copy
+// against the one in the store.
+func (s *Store) ItemFromStore(id string) (*Item, error) {
+	if s.useStore == false {
+		return nil, ErrNoStore
+	}
+	return s.itemload(context.Background(), id)
+}
+
 // load an item into memory from the store
-func (s *Store) itemload(id string) (*Item, error) {
+func (s *Store) itemload(ctx context.Context, id string) (*Item, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	n := s.findMaxBundle(id)
 	if n == 0 {
 		return nil, ErrNoItem
 	}
-	rc, err := OpenBundleStream(s.S, sugar(id, n), "item-info.json")
+	rc, err := s.openBundleStream(id, n, "item-info.json")
 	if err != nil {
 		return nil, err
 	}
 	defer rc.Close()
-	item, err := readItemInfo(rc)
+	item, err := readItemInfo(withContext(ctx, rc))
 	if err == nil {
 		item.MaxBundle = n
 	}
 	return item, err
 }
 
+// Delete removes every bundle file, and their sidecar and parity files, for the
+// given item from the store, and removes the item from the cache. The item is gone for good; this is not
+// the same as deleting blobs in a new version. Returns ErrNoItem if the item
+// has no bundles in the store, and a *ReferenceError, leaving the item alone,
+// if blobs in other items refer to its blobs.
+func (s *Store) Delete(id string) error {
+	if s.useStore == false {
+		return ErrNoStore
+	}
+	err := s.CheckReferences(id, nil)
+	if err != nil {
+		return err
+	}
+	bundles, err := s.S.ListPrefix(s.layout.Prefix(id))
+	if err != nil {
+		return err
+	}
+	var found bool
+	for _, b := range bundles {
+		slug, _ := s.layout.Parse(trimBundleExt(b))
+		if slug != id {
+			continue
+		}
+		found = true
+		s.forgetDirectory(b)
+		err = s.S.Delete(b)
+		if err != nil {
+			return err
+		}
+	}
+	s.cache.Delete(id)
+	if !found {
+		return ErrNoItem
+	}
+	return nil
+}
+
 // Find the maximum bundle for the given id.
 // Returns 0 if the item does not exist in the store.
 func (s *Store) findMaxBundle(id string) int {
-	bundles, err := s.S.ListPrefix(id)
+	bundles, err := s.S.ListPrefix(s.layout.Prefix(id))
 	if err != nil {
-		log.Println(id, ":", err)
+		slog.Error("findMaxBundle", "item", id, "error", err)
 		return 0
 	}
 	var max int
 	for _, b := range bundles {
-		slug, n := desugar(b)
+		slug, n := s.layout.Parse(b)
 		if slug == id && n > max {
 			max = n
 		}
@@ -156,20 +269,70 @@ func (s *Store) findMaxBundle(id string) int {
 // Blob returns an io.ReadCloser containing the given blob's contents and
 // the blob's size.
 // It will block until the item and blob are loaded from the backing store.
+// The contents of a blob referring to another item are read from that item.
+// The contents are checked against the blob's checksums as they are read if
+// SetVerifyReads is on.
 //
 // TODO: perhaps this should be moved to be a method on an Item*
 func (s *Store) Blob(id string, bid BlobID) (io.ReadCloser, int64, error) {
-	b, err := s.BlobInfo(id, bid)
+	return s.BlobContext(context.Background(), id, bid)
+}
+
+// BlobContext is like Blob, but the returned reader stops reading from the
+// store, returning the context's error, once ctx is done. Use it so a blob
+// being recalled from tape for a client is not read after the client has
+// gone.
+func (s *Store) BlobContext(ctx context.Context, id string, bid BlobID) (io.ReadCloser, int64, error) {
+	b, err := s.blobInfo(ctx, id, bid)
 	if err != nil {
 		return nil, 0, err
 	}
+	if b.RefItem != "" {
+		// references are never made to other references, so only
+		// one step is needed
+		id, bid = b.RefItem, b.RefBlob
+		b, err = s.blobInfo(ctx, id, bid)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
 	if b.Bundle == 0 {
 		// blob has been deleted
 		return nil, 0, ErrDeleted
 	}
-	sname := fmt.Sprintf("blob/%d", bid)
-	stream, err := OpenBundleStream(s.S, sugar(id, b.Bundle), sname)
-	return stream, b.Size, err
+	var stream io.ReadCloser
+	if len(b.Segments) > 0 {
+		sr := &segmentReader{s: s, id: id, bid: bid, seg: b.Segments}
+		// open the first segment now so a missing bundle is reported here
+		err = sr.next()
+		stream = sr
+	} else {
+		sname := fmt.Sprintf("blob/%d", bid)
+		stream, err = s.openBlobStream(id, b.Bundle, sname)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if b.Encrypted {
+		item, err := s.ItemContext(ctx, id)
+		if err != nil {
+			stream.Close()
+			return nil, 0, err
+		}
+		aead, err := s.itemCipher(item, false)
+		if err == nil && aead == nil {
+			err = fmt.Errorf("blob (%s,%d) is encrypted and the item has no data key", id, bid)
+		}
+		if err != nil {
+			stream.Close()
+			return nil, 0, err
+		}
+		stream = newDecrypter(aead, stream)
+	}
+	if s.verify {
+		stream = newVerifyReader(stream, id, b)
+	}
+	return withContext(ctx, stream), b.Size, nil
 }
 
 type NoBlobError struct {
@@ -186,7 +349,12 @@ func (err NoBlobError) Error() string {
 // from tape. Unlike Blob(), though, it will not return an error if the blob is
 // deleted.
 func (s *Store) BlobInfo(id string, bid BlobID) (*Blob, error) {
-	item, err := s.Item(id)
+	return s.blobInfo(context.Background(), id, bid)
+}
+
+// blobInfo is BlobInfo, loading the item with the given context.
+func (s *Store) blobInfo(ctx context.Context, id string, bid BlobID) (*Blob, error) {
+	item, err := s.ItemContext(ctx, id)
 	if err != nil {
 		return nil, err
 	}
@@ -263,6 +431,44 @@ func (item Item) BlobByExtendedSlot(slot string) BlobID {
 	return item.BlobByVersionSlot(vid, slot)
 }
 
+// Successor returns the blob which replaced the given blob, and the slot it
+// was replaced in. That is the blob held in the most recent version of the
+// item by a slot which held the given blob in the last version to contain it.
+// Deleted blobs do not count as successors. It returns 0 if there is no
+// such blob, such as when the given blob is still in the most recent version
+// or its slots have since been removed.
+func (item Item) Successor(bid BlobID) (BlobID, string) {
+	if len(item.Versions) == 0 {
+		return 0, ""
+	}
+	newest := item.Versions[len(item.Versions)-1]
+	for i := len(item.Versions) - 1; i >= 0; i-- {
+		// check the slots in order so the answer does not change
+		// from call to call
+		var slots []string
+		for slot, b := range item.Versions[i].Slots {
+			if b == bid {
+				slots = append(slots, slot)
+			}
+		}
+		if len(slots) == 0 {
+			continue
+		}
+		sort.Strings(slots)
+		for _, slot := range slots {
+			next := newest.Slots[slot]
+			if next == 0 || next == bid {
+				continue
+			}
+			if b := item.blobByID(next); b != nil && (b.Bundle != 0 || b.RefItem != "") {
+				return next, slot
+			}
+		}
+		return 0, ""
+	}
+	return 0, ""
+}
+
 // used to implement a no-op cache
 type cache struct{}
 
@@ -271,6 +477,7 @@ var Nullcache cache
 
 func (c cache) Lookup(id string) *Item    { return nil }
 func (c cache) Set(id string, item *Item) {}
+func (c cache) Delete(id string)          {}
 
 // NewMemoryCache returns an empty ItemCache that keeps everything in memory
 // and never evicts anything. It is probably only useful in tests.
@@ -302,3 +509,9 @@ func (c *memoryCache) Set(id string, item *Item) {
 	c.memory[id] = item
 	c.m.Unlock()
 }
+
+func (c *memoryCache) Delete(id string) {
+	c.m.Lock()
+	delete(c.memory, id)
+	c.m.Unlock()
+}
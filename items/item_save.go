@@ -23,6 +23,9 @@ func readItemInfo(rc io.Reader) (*Item, error) {
 		ID:        fromTape.ItemID,
 		MaxBundle: fromTape.MaxBundle,
 	}
+	if fromTape.DataKey != "" {
+		result.DataKey, _ = hex.DecodeString(fromTape.DataKey)
+	}
 	for _, ver := range fromTape.Versions {
 		v := &Version{
 			ID:       VersionID(ver.VersionID),
@@ -30,6 +33,8 @@ func readItemInfo(rc io.Reader) (*Item, error) {
 			Creator:  ver.Creator,
 			Note:     ver.Note,
 			Slots:    ver.Slots,
+			SlotMeta: ver.SlotMeta,
+			Meta:     ver.Meta,
 		}
 		result.Versions = append(result.Versions, v)
 	}
@@ -41,12 +46,32 @@ func readItemInfo(rc io.Reader) (*Item, error) {
 			Size:       blob.ByteCount,
 			MimeType:   blob.MimeType,
 			Bundle:     blob.Bundle,
+			RefItem:    blob.RefItem,
+			RefBlob:    BlobID(blob.RefBlob),
 			DeleteDate: blob.DeleteDate,
 			Deleter:    blob.Deleter,
 			DeleteNote: blob.DeleteNote,
+			Encrypted:  blob.Encrypted,
+			Meta:       blob.Meta,
 		}
 		b.MD5, _ = hex.DecodeString(blob.MD5)
 		b.SHA256, _ = hex.DecodeString(blob.SHA256)
+		if blob.Encrypted {
+			b.StoredMD5, _ = hex.DecodeString(blob.StoredMD5)
+			b.StoredSHA256, _ = hex.DecodeString(blob.StoredSHA256)
+		}
+		for name, h := range blob.Digests {
+			if b.Digests == nil {
+				b.Digests = make(map[string][]byte)
+			}
+			b.Digests[name], _ = hex.DecodeString(h)
+		}
+		for _, seg := range blob.Segments {
+			sg := Segment{Bundle: seg.Bundle, Size: seg.ByteCount}
+			sg.MD5, _ = hex.DecodeString(seg.MD5)
+			sg.SHA256, _ = hex.DecodeString(seg.SHA256)
+			b.Segments = append(b.Segments, sg)
+		}
 		result.Blobs = append(result.Blobs, b)
 	}
 	return result, nil
@@ -56,6 +81,7 @@ func writeItemInfo(w io.Writer, item *Item) error {
 	itemStore := itemOnTape{
 		ItemID:    item.ID,
 		MaxBundle: item.MaxBundle,
+		DataKey:   hex.EncodeToString(item.DataKey),
 	}
 	var byteCount int64
 	for _, b := range item.Blobs {
@@ -63,6 +89,8 @@ func writeItemInfo(w io.Writer, item *Item) error {
 		bTape := blobTape{
 			BlobID:     int(b.ID),
 			Bundle:     b.Bundle,
+			RefItem:    b.RefItem,
+			RefBlob:    int(b.RefBlob),
 			ByteCount:  b.Size,
 			MD5:        hex.EncodeToString(b.MD5),
 			SHA256:     hex.EncodeToString(b.SHA256),
@@ -72,6 +100,26 @@ func writeItemInfo(w io.Writer, item *Item) error {
 			DeleteDate: b.DeleteDate,
 			Deleter:    b.Deleter,
 			DeleteNote: b.DeleteNote,
+			Meta:       b.Meta,
+		}
+		if b.Encrypted {
+			bTape.Encrypted = true
+			bTape.StoredMD5 = hex.EncodeToString(b.StoredMD5)
+			bTape.StoredSHA256 = hex.EncodeToString(b.StoredSHA256)
+		}
+		for name, h := range b.Digests {
+			if bTape.Digests == nil {
+				bTape.Digests = make(map[string]string)
+			}
+			bTape.Digests[name] = hex.EncodeToString(h)
+		}
+		for _, seg := range b.Segments {
+			bTape.Segments = append(bTape.Segments, segmentTape{
+				Bundle:    seg.Bundle,
+				ByteCount: seg.Size,
+				MD5:       hex.EncodeToString(seg.MD5),
+				SHA256:    hex.EncodeToString(seg.SHA256),
+			})
 		}
 		itemStore.Blobs = append(itemStore.Blobs, bTape)
 	}
@@ -81,6 +129,8 @@ func writeItemInfo(w io.Writer, item *Item) error {
 			SaveDate:  v.SaveDate,
 			Creator:   v.Creator,
 			Slots:     v.Slots,
+			SlotMeta:  v.SlotMeta,
+			Meta:      v.Meta,
 			Note:      v.Note,
 		}
 		itemStore.Versions = append(itemStore.Versions, vTape)
@@ -97,6 +147,7 @@ type itemOnTape struct {
 	ItemID    string
 	ByteCount int64
 	MaxBundle int
+	DataKey   string `json:",omitempty"` // hex wrapped data key, if any blob is encrypted
 	Versions  []versionTape
 	Blobs     []blobTape
 }
@@ -107,18 +158,35 @@ type versionTape struct {
 	Creator   string
 	Note      string
 	Slots     map[string]BlobID
+	SlotMeta  map[string]map[string]string `json:",omitempty"`
+	Meta      map[string]string            `json:",omitempty"`
 }
 
 type blobTape struct {
-	BlobID     int
-	Bundle     int
-	ByteCount  int64
-	MD5        string
-	SHA256     string
-	MimeType   string
-	SaveDate   time.Time
-	Creator    string
-	DeleteDate time.Time
-	Deleter    string
-	DeleteNote string
+	BlobID       int
+	Bundle       int
+	RefItem      string `json:",omitempty"` // item holding the content of a reference
+	RefBlob      int    `json:",omitempty"`
+	ByteCount    int64
+	MD5          string
+	SHA256       string
+	Digests      map[string]string `json:",omitempty"` // hex checksums keyed by algorithm
+	Segments     []segmentTape     `json:",omitempty"` // set iff the content is split into segments
+	Encrypted    bool              `json:",omitempty"`
+	StoredMD5    string            `json:",omitempty"` // hex checksums of the encrypted stream
+	StoredSHA256 string            `json:",omitempty"`
+	MimeType     string
+	Meta         map[string]string `json:",omitempty"`
+	SaveDate     time.Time
+	Creator      string
+	DeleteDate   time.Time
+	Deleter      string
+	DeleteNote   string
+}
+
+type segmentTape struct {
+	Bundle    int
+	ByteCount int64
+	MD5       string
+	SHA256    string
 }
@@ -64,6 +64,8 @@ func TestExtractBlobId(t *testing.T) {
 		{"abc/6", 0},
 		{"blob/3/5", 0},
 		{"blob/cdef", 0},
+		{"blob/12.3", 12},
+		{"blob/12.x", 0},
 	}
 	for _, test := range table {
 		b := extractBlobID(test.input)
@@ -2,6 +2,8 @@ package items
 
 import (
 	"testing"
+
+	"github.com/ndlib/bendo/store"
 )
 
 func TestBlobByExtendedSlot(t *testing.T) {
@@ -45,3 +47,74 @@ func TestBlobByExtendedSlot(t *testing.T) {
 	}
 
 }
+
+func TestSuccessor(t *testing.T) {
+	m := Item{
+		Blobs: []*Blob{
+			&Blob{ID: 1}, &Blob{ID: 2, Bundle: 1}, &Blob{ID: 3},
+			&Blob{ID: 4, Bundle: 2}, &Blob{ID: 5}, &Blob{ID: 6, Bundle: 3},
+		},
+		Versions: []*Version{
+			&Version{
+				ID:    1,
+				Slots: map[string]BlobID{"a": 1, "b": 2, "c": 3, "e": 5},
+			},
+			&Version{
+				ID:    2,
+				Slots: map[string]BlobID{"b": 2, "c": 4, "e": 5},
+			},
+			&Version{
+				ID:    3,
+				Slots: map[string]BlobID{"b": 2, "c": 4, "e": 6},
+			},
+		},
+	}
+	table := []struct {
+		input BlobID
+		blob  BlobID
+		slot  string
+	}{
+		{1, 0, ""}, // slot removed
+		{2, 0, ""}, // still current
+		{3, 4, "c"},
+		{5, 6, "e"},
+		{7, 0, ""},
+	}
+	for _, tab := range table {
+		bid, slot := m.Successor(tab.input)
+		if bid != tab.blob || slot != tab.slot {
+			t.Errorf("Successor(%d) == %d, %q, expected %d, %q", tab.input, bid, slot, tab.blob, tab.slot)
+		}
+	}
+}
+
+func TestDeleteItem(t *testing.T) {
+	ms := store.NewMemory()
+	s := NewWithCache(ms, NewMemoryCache())
+	for _, id := range []string{"abc", "abc-1"} {
+		w, err := s.Open(id, "nobody")
+		if err != nil {
+			t.Fatal(err)
+		}
+		writedata(t, w, "hello "+id)
+		w.Close()
+	}
+	if _, err := s.Item("abc"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := s.Delete("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Item("abc"); err != ErrNoItem {
+		t.Errorf("Received %v, expected ErrNoItem", err)
+	}
+	// items sharing a prefix are not touched
+	if _, err := s.Item("abc-1"); err != nil {
+		t.Errorf("Received %v for abc-1", err)
+	}
+	if err := s.Delete("abc"); err != ErrNoItem {
+		t.Errorf("Received %v, expected ErrNoItem", err)
+	}
+}
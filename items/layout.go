@@ -0,0 +1,284 @@
+package items
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/ndlib/bendo/store"
+)
+
+// A Layout decides the key each bundle of an item is saved under in the
+// underlying store. The flat layout, which is the default, puts every bundle
+// in one namespace. The others divide the bundles into directories, so a
+// store holding millions of items does not list them all in one place. Keys
+// made by those layouts contain slashes, so they need a store whose keys may
+// contain one, such as S3. (The FileSystem store already divides its files
+// into directories by key prefix.)
+type Layout interface {
+	// Key returns the key bundle n of the given item is saved under.
+	Key(id string, n int) string
+
+	// Parse is the inverse of Key. It returns an id of "" if the key was
+	// not made by this layout.
+	Parse(key string) (id string, n int)
+
+	// Prefix returns a prefix shared by the keys of every bundle of the
+	// given item. Keys of other items may also have it.
+	Prefix(id string) string
+}
+
+// ParseLayout returns the layout with the given name, one of "flat",
+// "pairtree", or "hashed". The empty string is the flat layout.
+func ParseLayout(name string) (Layout, error) {
+	switch name {
+	case "", "flat":
+		return FlatLayout{}, nil
+	case "pairtree":
+		return PairtreeLayout{}, nil
+	case "hashed":
+		return HashedLayout{}, nil
+	}
+	return nil, fmt.Errorf("unknown layout %q", name)
+}
+
+// FlatLayout saves bundle n of an item under the key "<id>-<n>.zip", with n
+// padded to four digits, e.g. "abc123-0001.zip".
+type FlatLayout struct{}
+
+// Key returns the key for the given bundle.
+func (FlatLayout) Key(id string, n int) string { return sugar(id, n) }
+
+// Parse returns the item id and bundle number of the given key. Keys
+// containing a slash belong to the other layouts and are not accepted.
+func (FlatLayout) Parse(key string) (string, int) {
+	if strings.Contains(key, "/") {
+		return "", 0
+	}
+	return desugar(key)
+}
+
+// Prefix returns the id itself.
+func (FlatLayout) Prefix(id string) string { return id }
+
+// PairtreeLayout saves bundles in the directory given by the pairtree
+// encoding of the item's id, as described at
+// https://datatracker.ietf.org/doc/html/draft-kunze-pairtree-01. The id is
+// cleaned, split into pairs of characters for the directory names, and the
+// cleaned id is also used to name the bundle, e.g. the first bundle of item
+// "ark:/13030/xt12" is "ar/k+/=1/30/30/=x/t1/2/ark+=13030=xt12-0001.zip".
+type PairtreeLayout struct{}
+
+// Key returns the key for the given bundle.
+func (PairtreeLayout) Key(id string, n int) string {
+	clean := pairtreeClean(id)
+	return pairtreePath(clean) + "/" + sugar(clean, n)
+}
+
+// Parse returns the item id and bundle number of the given key.
+func (PairtreeLayout) Parse(key string) (string, int) {
+	j := strings.LastIndex(key, "/")
+	if j == -1 {
+		return "", 0
+	}
+	clean, n := desugar(key[j+1:])
+	if clean == "" || key[:j] != pairtreePath(clean) {
+		return "", 0
+	}
+	id, ok := pairtreeUnclean(clean)
+	if !ok {
+		return "", 0
+	}
+	return id, n
+}
+
+// Prefix returns the directory of the item followed by its cleaned id.
+func (PairtreeLayout) Prefix(id string) string {
+	clean := pairtreeClean(id)
+	return pairtreePath(clean) + "/" + clean
+}
+
+// pairtreeClean encodes an id the way the pairtree specification requires.
+// Characters which are not visible ASCII, or which have a special meaning,
+// are replaced by a caret and their hex value. Then '/', ':', and '.' are
+// replaced by '=', '+', and ',' respectively.
+func pairtreeClean(id string) string {
+	var b strings.Builder
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		switch {
+		case c < 0x21 || c > 0x7e || strings.IndexByte(`"*+,<=>?\^|`, c) != -1:
+			fmt.Fprintf(&b, "^%02x", c)
+		case c == '/':
+			b.WriteByte('=')
+		case c == ':':
+			b.WriteByte('+')
+		case c == '.':
+			b.WriteByte(',')
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// pairtreeUnclean reverses pairtreeClean. It returns false if s is not a
+// valid cleaned id.
+func pairtreeUnclean(s string) (string, bool) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '^':
+			if i+2 >= len(s) {
+				return "", false
+			}
+			v, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", false
+			}
+			b.WriteByte(byte(v))
+			i += 2
+		case '=':
+			b.WriteByte('/')
+		case '+':
+			b.WriteByte(':')
+		case ',':
+			b.WriteByte('.')
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), true
+}
+
+// pairtreePath splits a cleaned id into directories of two characters each.
+// The last one has a single character if the id has an odd length.
+func pairtreePath(clean string) string {
+	var parts []string
+	for len(clean) > 2 {
+		parts = append(parts, clean[:2])
+		clean = clean[2:]
+	}
+	parts = append(parts, clean)
+	return strings.Join(parts, "/")
+}
+
+// HashedLayout saves bundles in two levels of directories named by the
+// first four hex digits of the MD5 hash of the item's id, with the bundle
+// named as in the flat layout, e.g. "e9/9a/abc123-0001.zip". Unlike the
+// other layouts, items are spread evenly even when their ids share a long
+// common prefix.
+type HashedLayout struct{}
+
+// Key returns the key for the given bundle.
+func (HashedLayout) Key(id string, n int) string {
+	return hashedDir(id) + sugar(id, n)
+}
+
+// Parse returns the item id and bundle number of the given key.
+func (HashedLayout) Parse(key string) (string, int) {
+	if len(key) < 6 {
+		return "", 0
+	}
+	id, n := desugar(key[6:])
+	if id == "" || key[:6] != hashedDir(id) {
+		return "", 0
+	}
+	return id, n
+}
+
+// Prefix returns the directory of the item followed by its id.
+func (HashedLayout) Prefix(id string) string {
+	return hashedDir(id) + id
+}
+
+// hashedDir returns the directory the given item is kept in by the hashed
+// layout, including a trailing slash.
+func hashedDir(id string) string {
+	h := md5.Sum([]byte(id))
+	x := hex.EncodeToString(h[:2])
+	return x[0:2] + "/" + x[2:4] + "/"
+}
+
+// MigrateItem moves the bundles of the given item, and their checksum
+// sidecars, from the keys given by the layout from to the keys given by this
+// store's layout. Every file is copied before any are deleted. A file which
+// is already at its new key with the same size is not copied again, so an
+// interrupted migration may be restarted. Returns ErrNoItem if the item has
+// no bundles under the old layout.
+func (s *Store) MigrateItem(id string, from Layout) error {
+	if s.useStore == false {
+		return ErrNoStore
+	}
+	keys, err := s.S.ListPrefix(from.Prefix(id))
+	if err != nil {
+		return err
+	}
+	var moved []string
+	for _, key := range keys {
+		bundle := trimBundleExt(key)
+		slug, n := from.Parse(bundle)
+		if slug != id {
+			continue
+		}
+		target := formatKey(s.layout.Key(id, n), keyFormat(bundle)) + key[len(bundle):]
+		if target == key {
+			continue
+		}
+		err = copyKey(s.S, key, target)
+		if err != nil {
+			return err
+		}
+		moved = append(moved, key)
+	}
+	if len(moved) == 0 {
+		if s.findMaxBundle(id) > 0 {
+			return nil // already migrated
+		}
+		return ErrNoItem
+	}
+	for _, key := range moved {
+		s.forgetDirectory(key)
+		err = s.S.Delete(key)
+		if err != nil {
+			return err
+		}
+	}
+	s.cache.Delete(id)
+	return nil
+}
+
+// copyKey copies the contents of key src in s to the new key dst.
+func copyKey(s store.Store, src, dst string) error {
+	r, size, err := s.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := s.Create(dst)
+	if err == store.ErrKeyExists {
+		var existing store.ReadAtCloser
+		var n int64
+		existing, n, err = s.Open(dst)
+		if err != nil {
+			return err
+		}
+		existing.Close()
+		if n == size {
+			return nil
+		}
+		return fmt.Errorf("%s already exists with a different size", dst)
+	} else if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, io.NewSectionReader(r, 0, size))
+	if err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
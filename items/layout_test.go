@@ -0,0 +1,125 @@
+package items
+
+import (
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/ndlib/bendo/store"
+)
+
+func TestLayouts(t *testing.T) {
+	var table = []struct {
+		layout Layout
+		id     string
+		key    string
+	}{
+		{FlatLayout{}, "abc123", "abc123-0002.zip"},
+		{PairtreeLayout{}, "abc123", "ab/c1/23/abc123-0002.zip"},
+		{PairtreeLayout{}, "abcde", "ab/cd/e/abcde-0002.zip"},
+		{PairtreeLayout{}, "ark:/13030/xt12", "ar/k+/=1/30/30/=x/t1/2/ark+=13030=xt12-0002.zip"},
+		{PairtreeLayout{}, "a b^c", "a^/20/b^/5e/c/a^20b^5ec-0002.zip"},
+		{HashedLayout{}, "abc123", "e9/9a/abc123-0002.zip"},
+	}
+	for _, tab := range table {
+		key := tab.layout.Key(tab.id, 2)
+		if key != tab.key {
+			t.Errorf("%T %q: received %q, expected %q", tab.layout, tab.id, key, tab.key)
+		}
+		id, n := tab.layout.Parse(key)
+		if id != tab.id || n != 2 {
+			t.Errorf("%T %q: parsed %q, %d", tab.layout, key, id, n)
+		}
+		if !strings.HasPrefix(key, tab.layout.Prefix(tab.id)) {
+			t.Errorf("%T %q: key does not begin with %q", tab.layout, key, tab.layout.Prefix(tab.id))
+		}
+	}
+
+	// keys from another layout or another item are not accepted
+	var bad = []struct {
+		layout Layout
+		key    string
+	}{
+		{PairtreeLayout{}, "abc123-0002.zip"},
+		{PairtreeLayout{}, "ab/c1/abc123-0002.zip"},
+		{PairtreeLayout{}, "ab/c1/23/abc123-0002.zip" + SidecarExt},
+		{FlatLayout{}, "ab/c1/23/abc123-0002.zip"},
+		{HashedLayout{}, "abc123-0002.zip"},
+		{HashedLayout{}, "00/00/abc123-0002.zip"},
+	}
+	for _, tab := range bad {
+		if id, _ := tab.layout.Parse(tab.key); id != "" {
+			t.Errorf("%T %q: parsed %q, expected nothing", tab.layout, tab.key, id)
+		}
+	}
+}
+
+func TestParseLayout(t *testing.T) {
+	for _, name := range []string{"", "flat", "pairtree", "hashed"} {
+		if _, err := ParseLayout(name); err != nil {
+			t.Errorf("%q: %s", name, err)
+		}
+	}
+	if _, err := ParseLayout("tree"); err == nil {
+		t.Errorf("Expected an error")
+	}
+}
+
+func TestMigrateItem(t *testing.T) {
+	ms := store.NewMemory()
+	s := New(ms)
+	for _, id := range []string{"one", "two"} {
+		w, err := s.Open(id, "nobody")
+		if err != nil {
+			t.Fatalf("Unexpected error %s", err.Error())
+		}
+		w.SetSlot("a", writedata(t, w, "hello "+id))
+		w.Close()
+	}
+
+	s.SetLayout(PairtreeLayout{})
+	if _, err := s.Item("one"); err != ErrNoItem {
+		t.Errorf("Received %v, expected ErrNoItem", err)
+	}
+	var ids []string
+	for id := range New(ms).List() {
+		ids = append(ids, id)
+	}
+	for _, id := range ids {
+		err := s.MigrateItem(id, FlatLayout{})
+		if err != nil {
+			t.Errorf("%s: %s", id, err)
+		}
+	}
+	keys, _ := ms.ListPrefix("")
+	sort.Strings(keys)
+	expected := "on/e/one-0001.zip on/e/one-0001.zip.contents on/e/one-0001.zip.sha256 tw/o/two-0001.zip tw/o/two-0001.zip.contents tw/o/two-0001.zip.sha256"
+	if strings.Join(keys, " ") != expected {
+		t.Errorf("Received %v, expected %s", keys, expected)
+	}
+	r, _, err := s.Blob("two", 1)
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	content, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(content) != "hello two" {
+		t.Errorf("Received %q", content)
+	}
+	// new versions use the new layout
+	w, _ := s.Open("two", "nobody")
+	w.SetSlot("b", writedata(t, w, "again"))
+	w.Close()
+	if _, _, err := ms.Open("tw/o/two-0002.zip"); err != nil {
+		t.Errorf("Unexpected error %s", err.Error())
+	}
+
+	// migrating again does nothing
+	if err := s.MigrateItem("one", FlatLayout{}); err != nil {
+		t.Errorf("Received %v", err)
+	}
+	if err := s.MigrateItem("three", FlatLayout{}); err != ErrNoItem {
+		t.Errorf("Received %v, expected ErrNoItem", err)
+	}
+}
@@ -0,0 +1,88 @@
+package items
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MergedFromKey is the slot metadata key under which Merge records where
+// each merged slot came from, as "item/@version/slot".
+const MergedFromKey = "merged-from"
+
+// Merge adds the content of the item id to the version being written, for
+// consolidating an item which was ingested twice. Every blob of the other
+// item which has not been deleted is copied into this item, so that every
+// version of the other item is kept and it may be deleted afterwards. Blobs
+// whose checksums match one already in this item are not copied again, as
+// with WriteBlob, and blobs are never made references to the other item.
+// The slots of the newest version of the other item are added to this
+// version, inside the directory dir if it is not empty, keeping their slot
+// metadata. Each also has the key MergedFromKey giving its origin.
+//
+// It is an error if a slot would replace one in this version having
+// different content. In that case nothing is copied.
+func (wr *Writer) Merge(id string, dir string) error {
+	if id == wr.item.ID {
+		return fmt.Errorf("cannot merge item %s into itself", id)
+	}
+	src, err := wr.store.Item(id)
+	if err != nil {
+		return err
+	}
+	if len(src.Versions) == 0 {
+		return ErrNoItem
+	}
+	ver := src.Versions[len(src.Versions)-1]
+	dir = strings.TrimSuffix(dir, "/")
+	slotName := func(slot string) string {
+		if dir == "" {
+			return slot
+		}
+		return dir + "/" + slot
+	}
+	// check for conflicts before anything is copied
+	for slot, bid := range ver.Slots {
+		existing := wr.version.Slots[slotName(slot)]
+		if existing == 0 {
+			continue
+		}
+		a, b := wr.item.blobByID(existing), src.blobByID(bid)
+		if a == nil || b == nil || a.Size != b.Size || string(a.SHA256) != string(b.SHA256) {
+			return fmt.Errorf("slot %s is already used", slotName(slot))
+		}
+	}
+
+	wr.noref = id
+	defer func() { wr.noref = "" }()
+	newids := make(map[BlobID]BlobID)
+	for _, blob := range src.Blobs {
+		if blob.Bundle == 0 && blob.RefItem == "" {
+			continue // deleted
+		}
+		rc, _, err := wr.store.Blob(id, blob.ID)
+		if err != nil {
+			return fmt.Errorf("merging blob %d of %s: %w", blob.ID, id, err)
+		}
+		bid, err := wr.WriteBlob(rc, blob.Size, blob.MD5, blob.SHA256)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("merging blob %d of %s: %w", blob.ID, id, err)
+		}
+		if blob.MimeType != "" {
+			wr.SetMimeType(bid, blob.MimeType)
+		}
+		newids[blob.ID] = bid
+	}
+	for slot, bid := range ver.Slots {
+		if newids[bid] == 0 {
+			continue // the blob was deleted
+		}
+		name := slotName(slot)
+		wr.SetSlot(name, newids[bid])
+		for key, value := range ver.SlotMeta[slot] {
+			wr.SetSlotMeta(name, key, value)
+		}
+		wr.SetSlotMeta(name, MergedFromKey, fmt.Sprintf("%s/@%d/%s", id, ver.ID, slot))
+	}
+	return nil
+}
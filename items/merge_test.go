@@ -0,0 +1,94 @@
+package items
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/ndlib/bendo/store"
+)
+
+func TestMerge(t *testing.T) {
+	ms := store.NewMemory()
+	s := New(ms)
+	w, _ := s.Open("keep", "nobody")
+	bid := writedata(t, w, "shared")
+	w.SetSlot("shared.txt", bid)
+	bid = writedata(t, w, "mine")
+	w.SetSlot("a.txt", bid)
+	w.Close()
+
+	w, _ = s.Open("dup", "nobody")
+	bid = writedata(t, w, "shared")
+	w.SetSlot("shared.txt", bid)
+	bid = writedata(t, w, "theirs")
+	w.SetSlot("a.txt", bid)
+	w.SetSlotMeta("a.txt", "mtime", "2020-01-02T03:04:05Z")
+	old := writedata(t, w, "only in version 1")
+	w.SetSlot("old.txt", old)
+	w.Close()
+	w, _ = s.Open("dup", "nobody")
+	w.SetSlot("old.txt", 0)
+	w.Close()
+
+	// even with a finder, the merged blobs must not refer to "dup"
+	hash := sha256.Sum256([]byte("theirs"))
+	s.SetBlobFinder(oneBlobFinder{item: "dup", bid: 2, sha256: hash[:]})
+
+	// a.txt has different content in each
+	w, _ = s.Open("keep", "nobody")
+	err := w.Merge("dup", "")
+	if err == nil {
+		t.Errorf("Merge() succeeded, expected a conflict")
+	}
+	err = w.Merge("keep", "x")
+	if err == nil {
+		t.Errorf("Merge() into itself succeeded")
+	}
+	err = w.Merge("nosuchitem", "x")
+	if err != ErrNoItem {
+		t.Errorf("Merge() == %v, expected %v", err, ErrNoItem)
+	}
+	err = w.Merge("dup", "dup/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s = New(ms)
+	item, err := s.Item("keep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ver := item.Versions[len(item.Versions)-1]
+	if len(ver.Slots) != 4 || ver.Slots["dup/a.txt"] == 0 || ver.Slots["dup/old.txt"] != 0 {
+		t.Errorf("Received slots %v", ver.Slots)
+	}
+	// the shared content is not copied again
+	if ver.Slots["dup/shared.txt"] != ver.Slots["shared.txt"] {
+		t.Errorf("Received slots %v", ver.Slots)
+	}
+	meta := ver.SlotMeta["dup/a.txt"]
+	if meta["mtime"] != "2020-01-02T03:04:05Z" || meta[MergedFromKey] != "dup/@2/a.txt" {
+		t.Errorf("Received metadata %v", meta)
+	}
+	// every blob is kept, including the one only in the old version
+	if len(item.Blobs) != 4 {
+		t.Errorf("Received %d blobs, expected 4", len(item.Blobs))
+	}
+	for _, blob := range item.Blobs {
+		if blob.RefItem != "" {
+			t.Errorf("Blob %d refers to %s", blob.ID, blob.RefItem)
+		}
+	}
+
+	// the merged item may now go away
+	err = s.Delete("dup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRead(t, s, "keep", ver.Slots["dup/a.txt"], []byte("theirs"))
+	checkRead(t, s, "keep", 4, []byte("only in version 1"))
+}
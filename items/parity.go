@@ -0,0 +1,447 @@
+package items
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/ndlib/bendo/store"
+)
+
+// ParityExt is the extension added to a bundle's key to give the key of its
+// parity file. The parity file lets a bundle damaged by bit rot be rebuilt
+// without a second copy, using RepairBundle.
+//
+// The bundle is divided into blocks of ParityBlockSize bytes, and the blocks
+// are grouped into stripes of Data blocks each. For every stripe, Parity
+// Reed-Solomon parity blocks are computed, so up to Parity damaged blocks in
+// each stripe can be rebuilt. The parity file holds the parity blocks of each
+// stripe in order, followed by a JSON index giving the layout and the SHA256
+// of every data and parity block, followed by the length of the index as an
+// 8 byte big-endian integer. The blocks at the end of the bundle are padded
+// with zeros to make a full stripe, but the padding is not stored.
+const ParityExt = ".parity"
+
+// ParityBlockSize is the size of the blocks bundles are divided into to
+// compute parity.
+const ParityBlockSize = 1 << 20
+
+// A ParityScheme gives how much parity is written for each bundle. The zero
+// value means no parity files are written.
+type ParityScheme struct {
+	Data   int // number of data blocks in a stripe
+	Parity int // number of parity blocks for each stripe
+}
+
+// ParseParityScheme parses a parity scheme written as "data+parity", e.g.
+// "10+2" stores 2 parity blocks for every 10 blocks of a bundle, at a 20%
+// overhead. The empty string and "none" mean no parity.
+func ParseParityScheme(s string) (ParityScheme, error) {
+	if s == "" || s == "none" {
+		return ParityScheme{}, nil
+	}
+	var p ParityScheme
+	d, m, ok := strings.Cut(s, "+")
+	var err error
+	if ok {
+		p.Data, err = strconv.Atoi(d)
+	}
+	if err == nil && ok {
+		p.Parity, err = strconv.Atoi(m)
+	}
+	if !ok || err != nil {
+		return ParityScheme{}, fmt.Errorf("parity scheme %q is not of the form data+parity", s)
+	}
+	if p.Data <= 0 || p.Parity <= 0 || p.Data+p.Parity > 256 {
+		return ParityScheme{}, fmt.Errorf("parity scheme %q needs positive counts totaling at most 256", s)
+	}
+	return p, nil
+}
+
+// IsZero is true if the scheme writes no parity.
+func (p ParityScheme) IsZero() bool {
+	return p.Data == 0 || p.Parity == 0
+}
+
+func (p ParityScheme) String() string {
+	if p.IsZero() {
+		return "none"
+	}
+	return fmt.Sprintf("%d+%d", p.Data, p.Parity)
+}
+
+// parityIndex is the index saved at the end of a parity file.
+type parityIndex struct {
+	Version      int
+	BlockSize    int
+	Data         int
+	Parity       int
+	Size         int64    // size of the bundle
+	Blocks       []string // hex SHA256 of each data block
+	ParityBlocks []string // hex SHA256 of each parity block, in file order
+}
+
+// blockLen returns the length of data block b.
+func (idx *parityIndex) blockLen(b int) int {
+	n := idx.Size - int64(b)*int64(idx.BlockSize)
+	if n > int64(idx.BlockSize) {
+		return idx.BlockSize
+	}
+	return int(n)
+}
+
+// parityOffset returns the offset of parity block j of stripe s in the
+// parity file. Every stripe before the last has full size blocks.
+func (idx *parityIndex) parityOffset(s, j int) int64 {
+	L := idx.blockLen(s * idx.Data)
+	return int64(s)*int64(idx.Parity)*int64(idx.BlockSize) + int64(j)*int64(L)
+}
+
+// A parityWriter computes the parity of everything written to it, saving
+// the parity blocks to w a stripe at a time.
+type parityWriter struct {
+	w     io.WriteCloser
+	code  *rsCode
+	index parityIndex
+	buf   []byte // the current stripe
+}
+
+func newParityWriter(w io.WriteCloser, p ParityScheme) (*parityWriter, error) {
+	code, err := newRSCode(p.Data, p.Parity)
+	if err != nil {
+		return nil, err
+	}
+	return &parityWriter{
+		w:    w,
+		code: code,
+		index: parityIndex{
+			Version:   1,
+			BlockSize: ParityBlockSize,
+			Data:      p.Data,
+			Parity:    p.Parity,
+		},
+		buf: make([]byte, 0, p.Data*ParityBlockSize),
+	}, nil
+}
+
+func (pw *parityWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		k := cap(pw.buf) - len(pw.buf)
+		if k > len(p) {
+			k = len(p)
+		}
+		pw.buf = append(pw.buf, p[:k]...)
+		p = p[k:]
+		n += k
+		if len(pw.buf) == cap(pw.buf) {
+			if err := pw.flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flush computes and writes the parity for the current stripe.
+func (pw *parityWriter) flush() error {
+	if len(pw.buf) == 0 {
+		return nil
+	}
+	bs := pw.index.BlockSize
+	L := len(pw.buf)
+	if L > bs {
+		L = bs
+	}
+	data := make([][]byte, pw.code.k)
+	for i := range data {
+		start := i * bs
+		end := start + bs
+		if end > len(pw.buf) {
+			end = len(pw.buf)
+		}
+		if start < end {
+			block := pw.buf[start:end]
+			pw.index.Blocks = append(pw.index.Blocks, sha256hex(block))
+			data[i] = block
+		}
+		if len(data[i]) < L {
+			data[i] = append(make([]byte, 0, L), data[i]...)
+			data[i] = data[i][:L]
+		}
+	}
+	parity := make([][]byte, pw.code.m)
+	for j := range parity {
+		parity[j] = make([]byte, L)
+	}
+	pw.code.Encode(data, parity)
+	for _, p := range parity {
+		pw.index.ParityBlocks = append(pw.index.ParityBlocks, sha256hex(p))
+		if _, err := pw.w.Write(p); err != nil {
+			return err
+		}
+	}
+	pw.index.Size += int64(len(pw.buf))
+	pw.buf = pw.buf[:0]
+	return nil
+}
+
+// Close writes the parity for any partial stripe and the index, and then
+// closes the underlying writer.
+func (pw *parityWriter) Close() error {
+	err := pw.flush()
+	if err == nil {
+		err = writeParityIndex(pw.w, &pw.index)
+	}
+	err2 := pw.w.Close()
+	if err == nil {
+		err = err2
+	}
+	return err
+}
+
+func writeParityIndex(w io.Writer, idx *parityIndex) error {
+	buf, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	buf = binary.BigEndian.AppendUint64(buf, uint64(len(buf)))
+	_, err = w.Write(buf)
+	return err
+}
+
+func readParityIndex(r io.ReaderAt, size int64) (*parityIndex, error) {
+	var footer [8]byte
+	if size < 8 {
+		return nil, ErrBadParity
+	}
+	_, err := r.ReadAt(footer[:], size-8)
+	if err != nil {
+		return nil, err
+	}
+	n := int64(binary.BigEndian.Uint64(footer[:]))
+	if n <= 0 || n > size-8 {
+		return nil, ErrBadParity
+	}
+	buf := make([]byte, n)
+	_, err = r.ReadAt(buf, size-8-n)
+	if err != nil {
+		return nil, err
+	}
+	idx := new(parityIndex)
+	err = json.Unmarshal(buf, idx)
+	if err != nil || idx.Version != 1 || idx.BlockSize <= 0 || idx.Data <= 0 || idx.Parity <= 0 {
+		return nil, ErrBadParity
+	}
+	nblocks := int((idx.Size + int64(idx.BlockSize) - 1) / int64(idx.BlockSize))
+	nstripes := (nblocks + idx.Data - 1) / idx.Data
+	if len(idx.Blocks) != nblocks || len(idx.ParityBlocks) != nstripes*idx.Parity {
+		return nil, ErrBadParity
+	}
+	return idx, nil
+}
+
+func sha256hex(p []byte) string {
+	h := sha256.Sum256(p)
+	return hex.EncodeToString(h[:])
+}
+
+var (
+	// ErrNoParity means the bundle does not have a parity file.
+	ErrNoParity = errors.New("bundle has no parity file")
+
+	// ErrBadParity means the index of a parity file cannot be read.
+	ErrBadParity = errors.New("parity file is damaged")
+)
+
+// SetParity sets how much parity is written for new bundles. Bundles
+// already written keep the parity they have. It is intended to be used
+// during initialization.
+func (s *Store) SetParity(p ParityScheme) {
+	s.parity = p
+}
+
+// RepairBundle checks bundle n of the given item against its parity file,
+// and rebuilds the bundle if any of its blocks are damaged. It returns the
+// number of blocks rebuilt, which is 0 if the bundle is undamaged. The
+// rebuilt bundle is checked against the parity index and the checksum
+// sidecar before it replaces the damaged one. If a stripe has more damaged
+// blocks than can be rebuilt, an error wrapping ErrTooFewShards is returned
+// and the bundle is left as it was. Returns ErrNoParity if the bundle was
+// saved without parity.
+func (s *Store) RepairBundle(id string, n int) (int, error) {
+	if s.useStore == false {
+		return 0, ErrNoStore
+	}
+	key := s.findBundleKey(id, n)
+	pr, psize, err := s.S.Open(key + ParityExt)
+	if err != nil {
+		return 0, ErrNoParity
+	}
+	defer pr.Close()
+	idx, err := readParityIndex(pr, psize)
+	if err != nil {
+		return 0, err
+	}
+	br, size, err := s.S.Open(key)
+	if err != nil {
+		return 0, err
+	}
+	defer br.Close()
+
+	// find the damaged blocks
+	bad := make(map[int]bool)
+	for b := range idx.Blocks {
+		if _, ok := readBlock(br, idx, b); !ok {
+			bad[b] = true
+		}
+	}
+	if len(bad) == 0 && size == idx.Size {
+		return 0, nil
+	}
+
+	tmp := key + ".repair"
+	s.S.Delete(tmp) // left over from an earlier try?
+	w, err := s.S.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	sum := sha256.New()
+	err = rebuildBundle(io.MultiWriter(w, sum), br, pr, idx, bad)
+	err2 := w.Close()
+	if err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = checkSidecar(s.S, key, sum.Sum(nil))
+	}
+	if err != nil {
+		s.S.Delete(tmp)
+		return 0, fmt.Errorf("repairing %s: %w", key, err)
+	}
+	s.forgetDirectory(key)
+	err = s.S.Delete(key)
+	if err == nil {
+		err = copyKey(s.S, tmp, key)
+	}
+	if err != nil {
+		// keep tmp, since it may be the only good copy now
+		return 0, fmt.Errorf("repairing %s: %w", key, err)
+	}
+	s.S.Delete(tmp)
+	return len(bad), nil
+}
+
+// RepairItem runs RepairBundle on every bundle of the given item which has
+// a parity file. It returns the number of blocks rebuilt in each bundle
+// which was damaged. Every bundle is tried even if some cannot be repaired;
+// in that case the first error is returned.
+func (s *Store) RepairItem(id string) (map[int]int, error) {
+	if s.useStore == false {
+		return nil, ErrNoStore
+	}
+	result := make(map[int]int)
+	var firsterr error
+	for n := 1; n <= s.findMaxBundle(id); n++ {
+		count, err := s.RepairBundle(id, n)
+		if err == ErrNoParity {
+			continue
+		} else if err != nil && firsterr == nil {
+			firsterr = err
+		}
+		if count > 0 {
+			result[n] = count
+		}
+	}
+	return result, firsterr
+}
+
+// readBlock returns data block b of the bundle, and whether it matches the
+// checksum in the index.
+func readBlock(r io.ReaderAt, idx *parityIndex, b int) ([]byte, bool) {
+	buf := make([]byte, idx.blockLen(b))
+	n, _ := r.ReadAt(buf, int64(b)*int64(idx.BlockSize))
+	return buf, n == len(buf) && sha256hex(buf) == idx.Blocks[b]
+}
+
+// rebuildBundle writes the bundle to w, reconstructing the damaged blocks
+// in bad from the parity file pr.
+func rebuildBundle(w io.Writer, br, pr io.ReaderAt, idx *parityIndex, bad map[int]bool) error {
+	code, err := newRSCode(idx.Data, idx.Parity)
+	if err != nil {
+		return err
+	}
+	nstripes := len(idx.ParityBlocks) / idx.Parity
+	for st := 0; st < nstripes; st++ {
+		L := idx.blockLen(st * idx.Data)
+		shards := make([][]byte, idx.Data+idx.Parity)
+		present := make([]bool, len(shards))
+		var damaged bool
+		for i := 0; i < idx.Data; i++ {
+			b := st*idx.Data + i
+			shards[i] = make([]byte, L)
+			present[i] = true // blocks past the end are all zero
+			if b < len(idx.Blocks) {
+				block, ok := readBlock(br, idx, b)
+				copy(shards[i], block)
+				present[i] = ok
+				damaged = damaged || !ok
+			}
+		}
+		if damaged {
+			for j := 0; j < idx.Parity; j++ {
+				p := make([]byte, L)
+				n, _ := pr.ReadAt(p, idx.parityOffset(st, j))
+				shards[idx.Data+j] = p
+				present[idx.Data+j] = n == L && sha256hex(p) == idx.ParityBlocks[st*idx.Parity+j]
+			}
+			err = code.Reconstruct(shards, present)
+			if err != nil {
+				return fmt.Errorf("stripe %d: %w", st, err)
+			}
+		}
+		for i := 0; i < idx.Data; i++ {
+			b := st*idx.Data + i
+			if b >= len(idx.Blocks) {
+				break
+			}
+			block := shards[i][:idx.blockLen(b)]
+			if bad[b] && sha256hex(block) != idx.Blocks[b] {
+				return fmt.Errorf("block %d: rebuilt block has wrong checksum", b)
+			}
+			if _, err := w.Write(block); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkSidecar compares sum against the bundle checksum in the sidecar for
+// the given bundle key, if there is a sidecar.
+func checkSidecar(s store.Store, key string, sum []byte) error {
+	r, size, err := s.Open(key + SidecarExt)
+	if err != nil {
+		return nil // bundles written before sidecars were added
+	}
+	defer r.Close()
+	buf := make([]byte, 64)
+	if size < 64 {
+		return nil
+	}
+	_, err = r.ReadAt(buf, 0)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(buf, []byte(hex.EncodeToString(sum))) {
+		return errors.New("rebuilt bundle does not match its checksum sidecar")
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package items
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/ndlib/bendo/store"
+)
+
+func TestReedSolomon(t *testing.T) {
+	code, err := newRSCode(5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rnd := rand.New(rand.NewSource(1))
+	shards := make([][]byte, 8)
+	for i := range shards {
+		shards[i] = make([]byte, 100)
+		if i < 5 {
+			rnd.Read(shards[i])
+		}
+	}
+	code.Encode(shards[:5], shards[5:])
+	var want [][]byte
+	for _, s := range shards[:5] {
+		want = append(want, append([]byte(nil), s...))
+	}
+	var tests = [][]int{{0}, {4}, {0, 1, 2}, {1, 3, 6}, {2, 5, 7}}
+	for _, lost := range tests {
+		present := []bool{true, true, true, true, true, true, true, true}
+		for _, i := range lost {
+			present[i] = false
+			for j := range shards[i] {
+				shards[i][j] = 0xff
+			}
+		}
+		err = code.Reconstruct(shards, present)
+		if err != nil {
+			t.Errorf("Reconstruct %v: %s", lost, err)
+		}
+		for i := range want {
+			if !bytes.Equal(shards[i], want[i]) {
+				t.Errorf("Reconstruct %v: shard %d differs", lost, i)
+			}
+		}
+		// put back any parity shards
+		code.Encode(shards[:5], shards[5:])
+	}
+	present := []bool{false, false, false, false, true, true, true, true}
+	err = code.Reconstruct(shards, present)
+	if err != ErrTooFewShards {
+		t.Errorf("Reconstruct() == %v, expected %v", err, ErrTooFewShards)
+	}
+}
+
+func TestParseParityScheme(t *testing.T) {
+	var tests = []struct {
+		s    string
+		want ParityScheme
+		ok   bool
+	}{
+		{"", ParityScheme{}, true},
+		{"none", ParityScheme{}, true},
+		{"10+2", ParityScheme{10, 2}, true},
+		{"10", ParityScheme{}, false},
+		{"0+2", ParityScheme{}, false},
+		{"250+10", ParityScheme{}, false},
+		{"a+b", ParityScheme{}, false},
+	}
+	for _, test := range tests {
+		p, err := ParseParityScheme(test.s)
+		if p != test.want || (err == nil) != test.ok {
+			t.Errorf("ParseParityScheme(%q) == %v, %v", test.s, p, err)
+		}
+	}
+}
+
+func TestRepairBundle(t *testing.T) {
+	ms := store.NewMemory()
+	s := New(ms)
+	s.SetParity(ParityScheme{Data: 4, Parity: 2})
+	w, err := s.Open("parity", "nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// enough for two stripes, the second one partial
+	data := make([]byte, 5*ParityBlockSize+1234)
+	rand.New(rand.NewSource(2)).Read(data)
+	md5sum := md5.Sum(data)
+	sha256sum := sha256.Sum256(data)
+	_, err = w.WriteBlob(bytes.NewReader(data), int64(len(data)), md5sum[:], sha256sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := s.layout.Key("parity", 1)
+	original := readkey(t, ms, key)
+
+	n, err := s.RepairBundle("parity", 1)
+	if n != 0 || err != nil {
+		t.Errorf("RepairBundle() == %d, %v, expected 0, nil", n, err)
+	}
+
+	// one block in each stripe
+	damageKey(t, ms, key, 10, 2*ParityBlockSize+10, 5*ParityBlockSize+10)
+	n, err = s.RepairBundle("parity", 1)
+	if n != 3 || err != nil {
+		t.Errorf("RepairBundle() == %d, %v, expected 3, nil", n, err)
+	}
+	if !bytes.Equal(readkey(t, ms, key), original) {
+		t.Errorf("Repaired bundle differs from original")
+	}
+	_, problems, err := s.Validate("parity")
+	if err != nil || len(problems) != 0 {
+		t.Errorf("Validate() == %v, %v", problems, err)
+	}
+
+	// too many blocks in the first stripe
+	damageKey(t, ms, key, 10, ParityBlockSize+10, 2*ParityBlockSize+10)
+	damaged := readkey(t, ms, key)
+	n, err = s.RepairBundle("parity", 1)
+	if !errors.Is(err, ErrTooFewShards) {
+		t.Errorf("RepairBundle() == %d, %v, expected %v", n, err, ErrTooFewShards)
+	}
+	if !bytes.Equal(readkey(t, ms, key), damaged) {
+		t.Errorf("Unrepairable bundle was changed")
+	}
+
+	// a truncated bundle
+	writeKey(t, ms, key, original[:len(original)-100])
+	repaired, err := s.RepairItem("parity")
+	if repaired[1] != 1 || err != nil {
+		t.Errorf("RepairItem() == %v, %v, expected 1 block", repaired, err)
+	}
+	if !bytes.Equal(readkey(t, ms, key), original) {
+		t.Errorf("Repaired bundle differs from original")
+	}
+
+	// bundles without parity
+	s.SetParity(ParityScheme{})
+	w, _ = s.Open("parity", "nobody")
+	writedata(t, w, "no parity")
+	w.Close()
+	_, err = s.RepairBundle("parity", 2)
+	if err != ErrNoParity {
+		t.Errorf("RepairBundle() == %v, expected %v", err, ErrNoParity)
+	}
+
+	err = s.Delete("parity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := ms.ListPrefix("parity"); len(keys) != 0 {
+		t.Errorf("Keys %v remain after Delete", keys)
+	}
+}
+
+func writeKey(t *testing.T, s store.Store, key string, buf []byte) {
+	s.Delete(key)
+	w, err := s.Create(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(buf)
+	w.Close()
+}
+
+// damageKey flips the bytes at the given offsets of key.
+func damageKey(t *testing.T, s store.Store, key string, offsets ...int) {
+	buf := readkey(t, s, key)
+	for _, off := range offsets {
+		buf[off] ^= 0xff
+	}
+	writeKey(t, s, key, buf)
+}
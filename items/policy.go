@@ -0,0 +1,75 @@
+package items
+
+// A BundlePolicy decides when a BundleWriter closes the bundle it is writing
+// and starts a new one, so sites can pack bundles to suit their tape block
+// sizes.
+type BundlePolicy interface {
+	// StartNew is called before each blob or segment is written into a
+	// bundle which already holds something. size is the number of bytes
+	// and count the number of blobs and segments already in the bundle,
+	// and next is the size of the one about to be written, or -1 if it
+	// is not known. A new bundle is started if it returns true.
+	StartNew(size int64, count int, next int64) bool
+}
+
+// A SizePolicy starts a new bundle once the current one has grown to Size
+// bytes. It is the default policy, with a Size of IdealBundleSize.
+type SizePolicy struct {
+	// Size is the size bundles are kept to. Zero means IdealBundleSize.
+	Size int64
+
+	// Fit starts a new bundle before a blob or segment which would take
+	// the current bundle past Size, instead of after, so a bundle is only
+	// larger than Size when it holds a single thing larger than Size.
+	// Things whose size is not known are written as if Fit were not set.
+	Fit bool
+
+	// MinCount is the fewest blobs and segments a bundle holds before a
+	// new one is started, however large they are, so a large blob does
+	// not leave a small bundle behind it.
+	MinCount int
+}
+
+// StartNew returns whether to start a new bundle before writing next bytes
+// into a bundle holding size bytes in count blobs and segments.
+func (p SizePolicy) StartNew(size int64, count int, next int64) bool {
+	limit := p.Size
+	if limit <= 0 {
+		limit = IdealBundleSize
+	}
+	if count < p.MinCount {
+		return false
+	}
+	if p.Fit && next > 0 {
+		return size+next > limit
+	}
+	return size >= limit
+}
+
+// SetBundlePolicy sets when new bundles are started as items are saved,
+// repacked, and renamed. A nil policy is the default SizePolicy. Bundles
+// already saved are not changed until the item is repacked. It is intended
+// to be used during initialization.
+func (s *Store) SetBundlePolicy(p BundlePolicy) {
+	s.policy = p
+}
+
+// SetPolicy sets when bw starts new bundles. A nil policy is the default
+// SizePolicy.
+func (bw *BundleWriter) SetPolicy(p BundlePolicy) {
+	bw.policy = p
+}
+
+// startNew returns whether bw should close the current bundle before
+// writing a stream of the given size, -1 if unknown.
+func (bw *BundleWriter) startNew(next int64) bool {
+	if bw.count == 0 {
+		// never leave a bundle empty
+		return false
+	}
+	p := bw.policy
+	if p == nil {
+		p = SizePolicy{}
+	}
+	return p.StartNew(bw.size, bw.count, next)
+}
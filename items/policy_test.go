@@ -0,0 +1,68 @@
+package items
+
+import (
+	"testing"
+
+	"github.com/ndlib/bendo/store"
+)
+
+func TestSizePolicy(t *testing.T) {
+	var table = []struct {
+		policy      SizePolicy
+		size        int64
+		count       int
+		next        int64
+		expectedNew bool
+	}{
+		{SizePolicy{}, IdealBundleSize - 1, 1, IdealBundleSize, false},
+		{SizePolicy{}, IdealBundleSize, 1, 1, true},
+		{SizePolicy{Size: 10}, 9, 1, 5, false},
+		{SizePolicy{Size: 10, Fit: true}, 9, 1, 5, true},
+		{SizePolicy{Size: 10, Fit: true}, 5, 1, 5, false},
+		{SizePolicy{Size: 10, Fit: true}, 9, 1, -1, false},
+		{SizePolicy{Size: 10, MinCount: 3}, 20, 2, 5, false},
+		{SizePolicy{Size: 10, MinCount: 3}, 20, 3, 5, true},
+	}
+	for _, tab := range table {
+		result := tab.policy.StartNew(tab.size, tab.count, tab.next)
+		if result != tab.expectedNew {
+			t.Errorf("%+v.StartNew(%d, %d, %d) == %v, expected %v",
+				tab.policy, tab.size, tab.count, tab.next, result, tab.expectedNew)
+		}
+	}
+}
+
+func TestBundlePolicy(t *testing.T) {
+	var table = []struct {
+		policy   BundlePolicy
+		expected int
+	}{
+		{nil, 1},
+		{SizePolicy{Size: 10}, 2},
+		{SizePolicy{Size: 10, Fit: true}, 3},
+		{SizePolicy{Size: 10, Fit: true, MinCount: 2}, 2},
+	}
+	for _, tab := range table {
+		s := New(store.NewMemory())
+		s.SetBundlePolicy(tab.policy)
+		w, err := s.Open("policy", "nobody")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, content := range []string{"first", "second", "third"} {
+			writedata(t, w, content)
+		}
+		w.Close()
+		item, _ := s.Item("policy")
+		if item.MaxBundle != tab.expected {
+			t.Errorf("%+v: received %d bundles, expected %d", tab.policy, item.MaxBundle, tab.expected)
+		}
+		var blobs []*Blob
+		for _, blob := range item.Blobs {
+			blobs = append(blobs, blob)
+		}
+		if n := packedBundles(blobs, tab.policy); n != tab.expected {
+			t.Errorf("%+v: packedBundles() == %d, expected %d", tab.policy, n, tab.expected)
+		}
+	}
+}
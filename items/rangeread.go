@@ -0,0 +1,161 @@
+package items
+
+import (
+	"io"
+
+	"github.com/ndlib/bendo/store"
+)
+
+// SetParallelReads makes blobs longer than size bytes be read using n
+// ranges of size bytes fetched at once, when the underlying store can read
+// ranges efficiently, such as S3. The ranges are returned in order, so this
+// only changes how quickly a large blob is recalled from a store with a high
+// latency per request. At most n ranges are held in memory for each blob
+// being read. An n of 0 or 1, the default, reads each blob sequentially.
+// Only blobs stored uncompressed can be read in parallel, which every blob
+// written by a BundleWriter is. It is intended to be used during
+// initialization.
+func (s *Store) SetParallelReads(size int64, n int) {
+	s.rangeLen = size
+	s.readers = n
+}
+
+// openBlobStream is like openBundleStream, but reads streams longer than
+// the range length in parallel if the store supports it.
+func (s *Store) openBlobStream(id string, n int, sname string) (io.ReadCloser, error) {
+	if s.readers <= 1 || s.rangeLen <= 0 || !store.CanReadRanges(s.S) {
+		return s.openBundleStream(id, n, sname)
+	}
+	r, err := s.openCachedBundle(id, n)
+	if err != nil {
+		return nil, err
+	}
+	offset, size, err := r.Extent(sname)
+	if err != nil || size <= s.rangeLen {
+		// let openStream report any error
+		return openStream(r, sname)
+	}
+	r.Close()
+	return newRangeReader(s.S, r.key, offset, size, s.rangeLen, s.readers), nil
+}
+
+// A rangeReader reads a part of a key in a store by fetching ranges of it
+// in parallel, and returning them in order. Each of its workers opens the
+// key itself, since a ReadAtCloser may not be safe to use from more than one
+// goroutine.
+type rangeReader struct {
+	jobs    chan rangeJob
+	pending []chan rangeResult // the ranges being fetched, in order
+	next    int64              // the offset of the next range to fetch
+	end     int64              // the offset of the end of the part
+	length  int64              // the length of each range
+	workers int
+	started int
+	s       store.Store
+	key     string
+	cur     []byte // the part of the current range not yet returned
+	err     error
+	closed  bool
+}
+
+type rangeJob struct {
+	offset int64
+	buf    []byte
+	result chan<- rangeResult
+}
+
+type rangeResult struct {
+	data []byte
+	err  error
+}
+
+func newRangeReader(s store.Store, key string, offset, size, length int64, workers int) *rangeReader {
+	return &rangeReader{
+		jobs:    make(chan rangeJob),
+		next:    offset,
+		end:     offset + size,
+		length:  length,
+		workers: workers,
+		s:       s,
+		key:     key,
+	}
+}
+
+// worker fetches the ranges sent to it until the jobs channel is closed.
+func (r *rangeReader) worker() {
+	var rac store.ReadAtCloser
+	var err error
+	for job := range r.jobs {
+		if rac == nil && err == nil {
+			rac, _, err = r.s.Open(r.key)
+		}
+		if err != nil {
+			job.result <- rangeResult{err: err}
+			continue
+		}
+		n, err2 := rac.ReadAt(job.buf, job.offset)
+		if n == len(job.buf) {
+			err2 = nil
+		} else if err2 == nil || err2 == io.EOF {
+			err2 = io.ErrUnexpectedEOF
+		}
+		job.result <- rangeResult{data: job.buf[:n], err: err2}
+	}
+	if rac != nil {
+		rac.Close()
+	}
+}
+
+// schedule starts fetching ranges until there are as many being fetched as
+// there are workers.
+func (r *rangeReader) schedule() {
+	for len(r.pending) < r.workers && r.next < r.end {
+		if r.started < r.workers {
+			r.started++
+			go r.worker()
+		}
+		n := r.length
+		if r.end-r.next < n {
+			n = r.end - r.next
+		}
+		// the result is buffered so a worker never waits for the reader
+		result := make(chan rangeResult, 1)
+		r.jobs <- rangeJob{offset: r.next, buf: make([]byte, n), result: result}
+		r.pending = append(r.pending, result)
+		r.next += n
+	}
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	for len(r.cur) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.schedule()
+		if len(r.pending) == 0 {
+			return 0, io.EOF
+		}
+		result := <-r.pending[0]
+		r.pending = r.pending[1:]
+		r.cur, r.err = result.data, result.err
+		if r.err != nil {
+			// do not return a partial range
+			r.cur = nil
+		}
+	}
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
+
+// Close stops the workers once they finish the ranges they are fetching.
+func (r *rangeReader) Close() error {
+	if !r.closed {
+		r.closed = true
+		close(r.jobs)
+	}
+	if r.err == nil {
+		r.err = io.ErrClosedPipe
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package items
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/ndlib/bendo/store"
+)
+
+func TestParallelReads(t *testing.T) {
+	for _, format := range []BundleFormat{ZipFormat, TarFormat} {
+		ms := store.NewMemory()
+		s := New(ms)
+		s.SetBundleFormat(format)
+		s.SetParallelReads(7, 3)
+		var content []string
+		var bids []BlobID
+		w, _ := s.Open("ranges", "nobody")
+		for _, size := range []int{0, 5, 7, 8, 21, 100} {
+			var b bytes.Buffer
+			for i := 0; b.Len() < size; i++ {
+				fmt.Fprintf(&b, "%d,", i)
+			}
+			content = append(content, b.String()[:size])
+			bids = append(bids, writedata(t, w, content[len(content)-1]))
+		}
+		err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, bid := range bids {
+			if bid != 0 {
+				checkRead(t, s, "ranges", bid, []byte(content[i]))
+			}
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package items
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// A Recovery describes what Recover found in the bundles of an item.
+type Recovery struct {
+	Bundles    []int          // the bundles which could be read
+	Unreadable []int          // the bundles which could not be read, such as ones never finished
+	InfoBundle int            // the newest bundle with a readable item-info.json
+	Recorded   int            // the MaxBundle saved in that item-info.json
+	MaxBundle  int            // the item's MaxBundle after recovery
+	Blobs      map[BlobID]int // the bundle holding the content of each blob found
+	Moved      []BlobID       // blobs found in a different bundle than recorded
+	Lost       []BlobID       // blobs whose content is in no readable bundle
+	Fixed      bool           // whether a corrected item-info.json was saved
+}
+
+// RecoverNote is the delete note given to blobs Recover finds to be lost.
+const RecoverNote = "content lost in an unfinished save"
+
+// Recover rebuilds the metadata of the given item from the bundles in the
+// store, for items whose item-info.json was written by a save which crashed
+// before every bundle it refers to was finished. Every bundle of the item is
+// opened and listed. The newest bundle which has a readable item-info.json
+// gives the item's metadata, and each blob in it is looked for in the
+// bundles which could be read. Blobs whose content is in another bundle than
+// recorded are moved there, and blobs whose content is nowhere are marked as
+// deleted with RecoverNote, so reading them reports that they are gone.
+//
+// Unless dryrun is set, if anything needed correcting, or the newest bundle
+// cannot be read, a new bundle is written holding only the corrected
+// item-info.json, numbered after every existing bundle so it is the one
+// loaded from now on. Unreadable bundles are left in place, since they may
+// be repairable, but nothing refers to them.
+//
+// Like Open, this does no locking, and the item must not be changed while
+// it is being recovered.
+func (s *Store) Recover(id string, dryrun bool) (*Recovery, error) {
+	if s.useStore == false {
+		return nil, ErrNoStore
+	}
+	keys, err := s.S.ListPrefix(s.layout.Prefix(id))
+	if err != nil {
+		return nil, err
+	}
+	numbers := make(map[int]bool)
+	for _, key := range keys {
+		slug, n := s.layout.Parse(trimBundleExt(key))
+		if slug == id && n > 0 {
+			numbers[n] = true
+		}
+	}
+	if len(numbers) == 0 {
+		return nil, ErrNoItem
+	}
+	var last int
+	result := &Recovery{Blobs: make(map[BlobID]int)}
+	contents := make(map[int]map[string]bool) // stream names in each readable bundle
+	for n := range numbers {
+		if n > last {
+			last = n
+		}
+		r, err := openBundleN(s.S, s.layout, s.format, id, n)
+		if err != nil {
+			result.Unreadable = append(result.Unreadable, n)
+			continue
+		}
+		names := make(map[string]bool)
+		for _, name := range r.Files() {
+			names[name] = true
+		}
+		r.Close()
+		contents[n] = names
+		result.Bundles = append(result.Bundles, n)
+	}
+	sort.Ints(result.Bundles)
+	sort.Ints(result.Unreadable)
+
+	var item *Item
+	for i := len(result.Bundles) - 1; i >= 0 && item == nil; i-- {
+		n := result.Bundles[i]
+		if !contents[n]["item-info.json"] {
+			continue
+		}
+		rc, err := s.openBundleStream(id, n, "item-info.json")
+		if err != nil {
+			continue
+		}
+		item, err = readItemInfo(rc)
+		rc.Close()
+		if err == nil {
+			result.InfoBundle = n
+		}
+	}
+	if item == nil {
+		return result, fmt.Errorf("recover %s: no bundle has a readable item-info.json", id)
+	}
+	result.Recorded = item.MaxBundle
+	result.MaxBundle = result.InfoBundle
+
+	// find is where the stream with the given name is, preferring the
+	// bundle n. It is 0 if it is in no readable bundle.
+	find := func(n int, name string) int {
+		if contents[n][name] {
+			return n
+		}
+		for i := len(result.Bundles) - 1; i >= 0; i-- {
+			if contents[result.Bundles[i]][name] {
+				return result.Bundles[i]
+			}
+		}
+		return 0
+	}
+	now := time.Now()
+	for _, blob := range item.Blobs {
+		if blob.Bundle == 0 || blob.RefItem != "" {
+			continue
+		}
+		var found int
+		if len(blob.Segments) == 0 {
+			found = find(blob.Bundle, fmt.Sprintf("blob/%d", blob.ID))
+			if found != 0 && found != blob.Bundle {
+				blob.Bundle = found
+				result.Moved = append(result.Moved, blob.ID)
+			}
+		} else {
+			moved := false
+			found = blob.Bundle
+			for i := range blob.Segments {
+				seg := &blob.Segments[i]
+				n := find(seg.Bundle, segmentName(blob.ID, i+1))
+				if n == 0 {
+					found = 0
+					break
+				}
+				if n != seg.Bundle {
+					seg.Bundle = n
+					moved = true
+				}
+			}
+			if found != 0 {
+				blob.Bundle = blob.Segments[0].Bundle
+				if moved {
+					result.Moved = append(result.Moved, blob.ID)
+				}
+			}
+		}
+		if found == 0 {
+			blob.Bundle = 0
+			blob.DeleteDate = now
+			blob.Deleter = "recover"
+			blob.DeleteNote = RecoverNote
+			result.Lost = append(result.Lost, blob.ID)
+			continue
+		}
+		result.Blobs[blob.ID] = blob.Bundle
+	}
+
+	if len(result.Moved) == 0 && len(result.Lost) == 0 &&
+		result.Recorded == result.InfoBundle && result.InfoBundle == last {
+		return result, nil
+	}
+	if dryrun {
+		return result, nil
+	}
+	// start a new bundle after every existing one, even unreadable ones
+	item.MaxBundle = last
+	bw := NewFormatBundler(s.S, s.layout, s.format, item)
+	bw.SetDigests(s.digests)
+	err = bw.SetParity(s.parity)
+	if err == nil && bw.zw == nil {
+		// the bundle could not be started, so try again to get the error
+		err = bw.Next()
+	}
+	item.MaxBundle = bw.CurrentBundle()
+	err2 := bw.Close()
+	if err == nil {
+		err = err2
+	}
+	if err != nil {
+		key := s.bundleKey(id, item.MaxBundle)
+		s.deleteBundle(key)
+		return result, fmt.Errorf("recover %s: %w", id, err)
+	}
+	s.cache.Set(id, item)
+	result.MaxBundle = item.MaxBundle
+	result.Fixed = true
+	return result, nil
+}
@@ -0,0 +1,92 @@
+package items
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ndlib/bendo/store"
+)
+
+func TestRecover(t *testing.T) {
+	ms := store.NewMemory()
+	s := New(ms)
+	w, err := s.Open("crash", "nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writedata(t, w, "hello")
+	w.Close()
+
+	// imitate a save which wrote its item-info.json into bundle 2 but
+	// crashed before finishing bundle 3, which holds blob 2
+	item, err := s.ItemFromStore("crash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	item.Blobs = append(item.Blobs, &Blob{ID: 2, Size: 5, Bundle: 3})
+	bw := NewBundler(ms, item)
+	item.MaxBundle = 3
+	bw.Close()
+	f, _ := ms.Create("crash-0003.zip")
+	f.Write([]byte("PK\x03\x04 unfinished"))
+	f.Close()
+
+	s = New(ms)
+	if _, err := s.Item("crash"); err == nil {
+		t.Fatalf("Item() succeeded, expected an error from bundle 3")
+	}
+	result, err := s.Recover("crash", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Recovery{
+		Bundles:    []int{1, 2},
+		Unreadable: []int{3},
+		InfoBundle: 2,
+		Recorded:   3,
+		MaxBundle:  2,
+		Blobs:      map[BlobID]int{1: 1},
+		Lost:       []BlobID{2},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Recover() == %+v, expected %+v", result, expected)
+	}
+	if _, err := s.Item("crash"); err == nil {
+		t.Errorf("Item() succeeded after a dry run")
+	}
+
+	result, err = s.Recover("crash", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Fixed || result.MaxBundle != 4 {
+		t.Errorf("Recover() == %+v, expected a fix in bundle 4", result)
+	}
+
+	// read it back without the cached item
+	s = New(ms)
+	item, err = s.Item("crash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.MaxBundle != 4 {
+		t.Errorf("Received max bundle %d, expected 4", item.MaxBundle)
+	}
+	if b := item.blobByID(2); b == nil || b.Bundle != 0 || b.DeleteNote != RecoverNote {
+		t.Errorf("Received blob 2 %+v, expected it deleted", b)
+	}
+	rc, _, err := s.Blob("crash", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+
+	result, err = s.Recover("crash", false)
+	if err != nil || result.Fixed || result.MaxBundle != 4 {
+		t.Errorf("Recover() == %+v, %v, expected nothing to fix", result, err)
+	}
+
+	if _, err := s.Recover("nothing", true); err != ErrNoItem {
+		t.Errorf("Recover() returned %v, expected ErrNoItem", err)
+	}
+}
@@ -0,0 +1,194 @@
+package items
+
+import (
+	"errors"
+)
+
+// This file has a small systematic Reed-Solomon erasure code over GF(2^8),
+// used to make the parity files for bundles. The k data shards are kept as
+// they are, and m parity shards are made from them using a Cauchy matrix.
+// Since every square submatrix of a Cauchy matrix is invertible, any k of the
+// k+m shards are enough to recover the data shards.
+
+// gfExp and gfLog are the exponent and logarithm tables for GF(2^8) using
+// the generator 2 and the polynomial x^8 + x^4 + x^3 + x^2 + 1. gfExp is
+// doubled so the sum of two logarithms does not need reducing.
+var (
+	gfExp [510]byte
+	gfLog [256]int
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfExp[i+255] = byte(x)
+		gfLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a]+gfLog[b]]
+}
+
+func gfInv(a byte) byte {
+	// a must not be 0
+	return gfExp[255-gfLog[a]]
+}
+
+// gfMulAdd sets out[i] ^= c * in[i] for each byte of in.
+func gfMulAdd(c byte, in, out []byte) {
+	if c == 0 {
+		return
+	}
+	var table [256]byte
+	lc := gfLog[c]
+	for i := 1; i < 256; i++ {
+		table[i] = gfExp[gfLog[i]+lc]
+	}
+	for i, b := range in {
+		out[i] ^= table[b]
+	}
+}
+
+var (
+	// ErrTooManyShards means the number of data and parity shards asked for
+	// is larger than the code supports.
+	ErrTooManyShards = errors.New("reed-solomon: too many shards")
+
+	// ErrTooFewShards means there are not enough good shards left to
+	// reconstruct the data.
+	ErrTooFewShards = errors.New("reed-solomon: too few shards to reconstruct")
+)
+
+// A rsCode encodes k data shards into m parity shards.
+type rsCode struct {
+	k, m   int
+	matrix [][]byte // the m by k parity rows of the encoding matrix
+}
+
+// newRSCode returns a code with k data shards and m parity shards.
+func newRSCode(k, m int) (*rsCode, error) {
+	if k <= 0 || m <= 0 || k+m > 256 {
+		return nil, ErrTooManyShards
+	}
+	code := &rsCode{k: k, m: m, matrix: make([][]byte, m)}
+	for j := range code.matrix {
+		row := make([]byte, k)
+		for i := range row {
+			// x_j = k+j and y_i = i are distinct, so x_j + y_i != 0
+			row[i] = gfInv(byte(k+j) ^ byte(i))
+		}
+		code.matrix[j] = row
+	}
+	return code, nil
+}
+
+// row returns row r of the full (k+m) by k encoding matrix, which is the
+// identity matrix followed by the parity rows.
+func (code *rsCode) row(r int) []byte {
+	if r >= code.k {
+		return code.matrix[r-code.k]
+	}
+	row := make([]byte, code.k)
+	row[r] = 1
+	return row
+}
+
+// Encode fills in the parity shards from the data shards. All the shards
+// must be the same length.
+func (code *rsCode) Encode(data, parity [][]byte) {
+	for j, p := range parity {
+		for i := range p {
+			p[i] = 0
+		}
+		for i, d := range data {
+			gfMulAdd(code.matrix[j][i], d, p)
+		}
+	}
+}
+
+// Reconstruct rebuilds the missing data shards. shards has the k data shards
+// followed by the m parity shards, all the same length, and present tells
+// which of them are good. The contents of missing data shards are replaced;
+// parity shards are never changed.
+func (code *rsCode) Reconstruct(shards [][]byte, present []bool) error {
+	var missing []int
+	for i := 0; i < code.k; i++ {
+		if !present[i] {
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	// choose k good shards
+	var rows []int
+	for r := 0; r < code.k+code.m && len(rows) < code.k; r++ {
+		if present[r] {
+			rows = append(rows, r)
+		}
+	}
+	if len(rows) < code.k {
+		return ErrTooFewShards
+	}
+	sub := make([][]byte, code.k)
+	for i, r := range rows {
+		sub[i] = append([]byte(nil), code.row(r)...)
+	}
+	inv, err := gfInvert(sub)
+	if err != nil {
+		return err
+	}
+	// data shard i is row i of the inverse applied to the chosen shards
+	for _, i := range missing {
+		out := make([]byte, len(shards[i]))
+		for c, r := range rows {
+			gfMulAdd(inv[i][c], shards[r], out)
+		}
+		copy(shards[i], out)
+	}
+	return nil
+}
+
+// gfInvert returns the inverse of the square matrix m, which is overwritten.
+func gfInvert(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	inv := make([][]byte, n)
+	for i := range inv {
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && m[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("reed-solomon: singular matrix")
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+		c := gfInv(m[col][col])
+		for i := 0; i < n; i++ {
+			m[col][i] = gfMul(m[col][i], c)
+			inv[col][i] = gfMul(inv[col][i], c)
+		}
+		for r := 0; r < n; r++ {
+			if r == col || m[r][col] == 0 {
+				continue
+			}
+			c := m[r][col]
+			gfMulAdd(c, m[col], m[r])
+			gfMulAdd(c, inv[col], inv[r])
+		}
+	}
+	return inv, nil
+}
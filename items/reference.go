@@ -0,0 +1,96 @@
+package items
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrReferenced means blobs could not be removed because blobs in other
+// items refer to them. The error returned will be a *ReferenceError.
+var ErrReferenced = errors.New("blob is referenced by other items")
+
+// A Reference is a blob in one item which refers to a blob in another.
+type Reference struct {
+	Item    string // the item holding the reference
+	Blob    BlobID // the referring blob
+	RefBlob BlobID // the blob referred to
+}
+
+// A RefFinder lists the blobs in other items which refer to blobs in
+// the given item. Deleted references should not be returned.
+type RefFinder interface {
+	FindReferences(id string) ([]Reference, error)
+}
+
+// SetRefFinder sets how references to the blobs of an item are found.
+// With one, blobs other items refer to are not purged, and items holding
+// them are not deleted or renamed, since the references would stop working.
+// If it is nil, which is the default, nothing is checked. It is intended to
+// be used during initialization.
+func (s *Store) SetRefFinder(f RefFinder) {
+	s.refs = f
+}
+
+// A ReferenceError lists the references to the blobs of an item which were
+// to be removed.
+type ReferenceError struct {
+	Item string      // the item whose blobs are referred to
+	Refs []Reference // the references found
+}
+
+func (e *ReferenceError) Error() string {
+	return fmt.Sprintf("%s: %s is referenced by %s", ErrReferenced, e.Item, strings.Join(e.Items(), ", "))
+}
+
+func (e *ReferenceError) Unwrap() error {
+	return ErrReferenced
+}
+
+// Items returns the ids of the items holding the references, sorted and
+// without duplicates.
+func (e *ReferenceError) Items() []string {
+	var result []string
+	seen := make(map[string]bool)
+	for _, ref := range e.Refs {
+		if !seen[ref.Item] {
+			seen[ref.Item] = true
+			result = append(result, ref.Item)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// referenced returns the ids of the blobs referred to.
+func (e *ReferenceError) referenced() map[BlobID]bool {
+	result := make(map[BlobID]bool)
+	for _, ref := range e.Refs {
+		result[ref.RefBlob] = true
+	}
+	return result
+}
+
+// CheckReferences returns a *ReferenceError if blobs in other items refer to
+// any of the given blobs of item id, or to any of its blobs if bids is nil.
+// Nothing is checked if there is no RefFinder.
+func (s *Store) CheckReferences(id string, bids []BlobID) error {
+	if s.refs == nil {
+		return nil
+	}
+	refs, err := s.refs.FindReferences(id)
+	if err != nil {
+		return err
+	}
+	var found []Reference
+	for _, ref := range refs {
+		if ref.Item != id && (bids == nil || containsID(bids, ref.RefBlob)) {
+			found = append(found, ref)
+		}
+	}
+	if len(found) == 0 {
+		return nil
+	}
+	return &ReferenceError{Item: id, Refs: found}
+}
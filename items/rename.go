@@ -0,0 +1,97 @@
+package items
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrItemExists occurs when an item is renamed to an id which already has
+// bundles in the store.
+var ErrItemExists = errors.New("item already exists")
+
+// Rename moves the item from to the new id to, keeping its versions, blobs,
+// and checksums. Every bundle names the item it belongs to in its bag
+// metadata, so the bundles cannot simply be given new keys; instead the
+// blobs are copied into new bundles saved under the new id, their checksums
+// being checked as they are copied, as in Repack. The old bundles, with
+// their sidecar and parity files, are deleted only after everything has
+// been copied, and nothing is deleted if there is an error. Returns
+// ErrItemExists if the new id is already in use. It returns the number of
+// bytes copied.
+//
+// A *ReferenceError is returned, and nothing is changed, if blobs in other
+// items refer to blobs in this one, since the references would no longer be
+// readable. Like Open, this does no locking, and neither item may be changed
+// while the rename is in progress.
+func (s *Store) Rename(from, to string) (int64, error) {
+	if s.useStore == false {
+		return 0, ErrNoStore
+	}
+	if from == to || s.findMaxBundle(to) > 0 {
+		return 0, ErrItemExists
+	}
+	item, err := s.ItemFromStore(from)
+	if err != nil {
+		return 0, err
+	}
+	err = s.CheckReferences(from, nil)
+	if err != nil {
+		return 0, err
+	}
+	keys, err := s.S.ListPrefix(s.layout.Prefix(from))
+	if err != nil {
+		return 0, err
+	}
+	var old []string
+	for _, key := range keys {
+		slug, _ := s.layout.Parse(trimBundleExt(key))
+		if slug == from {
+			old = append(old, key)
+		}
+	}
+
+	var blobs []*Blob
+	for _, blob := range item.Blobs {
+		if blob.Bundle != 0 {
+			blobs = append(blobs, blob)
+		}
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].ID < blobs[j].ID })
+
+	item.ID = to
+	item.MaxBundle = 0
+	bw := NewFormatBundler(s.S, s.layout, s.format, item)
+	bw.SetDigests(s.digests)
+	bw.SetPolicy(s.policy)
+	err = bw.SetParity(s.parity)
+	var total int64
+	for i := 0; err == nil && i < len(blobs); i++ {
+		var n int64
+		n, err = s.repackBlob(bw, from, blobs[i])
+		total += n
+	}
+	item.MaxBundle = bw.CurrentBundle()
+	err2 := bw.Close()
+	if err == nil {
+		err = err2
+	}
+	if err != nil {
+		// remove the partial new bundles, leaving the item as it was
+		for n := 1; n <= item.MaxBundle; n++ {
+			key := s.bundleKey(to, n)
+			s.deleteBundle(key)
+		}
+		return total, fmt.Errorf("rename %s to %s: %w", from, to, err)
+	}
+	s.cache.Delete(from)
+	s.cache.Set(to, item)
+	for _, key := range old {
+		s.forgetDirectory(key)
+		err = s.S.Delete(key)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,65 @@
+package items
+
+import (
+	"testing"
+
+	"github.com/ndlib/bendo/store"
+)
+
+func TestRename(t *testing.T) {
+	ms := store.NewMemory()
+	s := New(ms)
+	for i, content := range []string{"one", "two", "three"} {
+		w, err := s.Open("oldname", "nobody")
+		if err != nil {
+			t.Fatal(err)
+		}
+		bid := writedata(t, w, content)
+		w.SetSlot(content, bid)
+		if i == 2 {
+			w.DeleteBlob(2)
+		}
+		w.Close()
+	}
+	w, _ := s.Open("taken", "nobody")
+	writedata(t, w, "other")
+	w.Close()
+
+	_, err := s.Rename("oldname", "taken")
+	if err != ErrItemExists {
+		t.Errorf("Rename() == %v, expected %v", err, ErrItemExists)
+	}
+	_, err = s.Rename("nosuchitem", "newname")
+	if err != ErrNoItem {
+		t.Errorf("Rename() == %v, expected %v", err, ErrNoItem)
+	}
+
+	n, err := s.Rename("oldname", "newname")
+	if err != nil || n != 8 {
+		t.Fatalf("Rename() == %d, %v, expected 8 bytes", n, err)
+	}
+	keys, _ := ms.ListPrefix("oldname")
+	if len(keys) != 0 {
+		t.Errorf("Received keys %v, expected the old bundles to be deleted", keys)
+	}
+
+	// read everything back, without the cached item
+	s = New(ms)
+	_, err = s.Item("oldname")
+	if err != ErrNoItem {
+		t.Errorf("Item() == %v, expected %v", err, ErrNoItem)
+	}
+	item, err := s.Item("newname")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.ID != "newname" || len(item.Versions) != 3 || item.Versions[2].Slots["three"] != 3 {
+		t.Errorf("Received %+v", item)
+	}
+	checkRead(t, s, "newname", 1, []byte("one"))
+	checkRead(t, s, "newname", 3, []byte("three"))
+	_, problems, err := s.Validate("newname")
+	if err != nil || len(problems) != 0 {
+		t.Errorf("Validate() == %v, %v", problems, err)
+	}
+}
@@ -0,0 +1,147 @@
+package items
+
+import (
+	"fmt"
+	"sort"
+)
+
+// RepackResult describes what Repack did to an item.
+type RepackResult struct {
+	Before int   // number of bundles before
+	After  int   // number of bundles after
+	Bytes  int64 // amount of blob content copied
+}
+
+// Repack rewrites the given item into the fewest bundles which will hold
+// its blobs, each bundle being started when the store's bundle policy says
+// so, as when saving. This recovers the space left behind after
+// years of purges and small versions. The blobs keep their ids and
+// checksums, which are checked as each blob is copied; only the bundle each
+// blob is in changes. The new bundles are numbered after the old ones, and
+// the old ones, with their sidecar and parity files, are deleted only after
+// every blob has been copied. An item already in as few bundles as possible
+// is left alone.
+//
+// Like Open, this does no locking, and the item must not be changed while
+// it is being repacked.
+func (s *Store) Repack(id string) (RepackResult, error) {
+	var result RepackResult
+	if s.useStore == false {
+		return result, ErrNoStore
+	}
+	// work on a fresh copy so the cached item is untouched if there is an error
+	item, err := s.ItemFromStore(id)
+	if err != nil {
+		return result, err
+	}
+	keys, err := s.S.ListPrefix(s.layout.Prefix(id))
+	if err != nil {
+		return result, err
+	}
+	var old []string
+	bundles := make(map[int]bool)
+	for _, key := range keys {
+		slug, n := s.layout.Parse(trimBundleExt(key))
+		if slug != id || n > item.MaxBundle {
+			continue
+		}
+		old = append(old, key)
+		bundles[n] = true
+	}
+	result.Before = len(bundles)
+	result.After = len(bundles)
+
+	var blobs []*Blob
+	for _, blob := range item.Blobs {
+		if blob.Bundle != 0 {
+			blobs = append(blobs, blob)
+		}
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].ID < blobs[j].ID })
+	if len(bundles) <= packedBundles(blobs, s.policy) {
+		return result, nil
+	}
+
+	bw := NewFormatBundler(s.S, s.layout, s.format, item)
+	bw.SetDigests(s.digests)
+	bw.SetPolicy(s.policy)
+	first := bw.CurrentBundle()
+	err = bw.SetParity(s.parity)
+	for i := 0; err == nil && i < len(blobs); i++ {
+		var n int64
+		n, err = s.repackBlob(bw, id, blobs[i])
+		result.Bytes += n
+	}
+	item.MaxBundle = bw.CurrentBundle()
+	err2 := bw.Close()
+	if err == nil {
+		err = err2
+	}
+	if err != nil {
+		// remove the partial new bundles, leaving the item as it was
+		for n := first; n <= item.MaxBundle; n++ {
+			key := s.bundleKey(id, n)
+			s.deleteBundle(key)
+		}
+		return result, fmt.Errorf("repack %s: %w", id, err)
+	}
+	s.cache.Set(id, item)
+	result.After = item.MaxBundle - first + 1
+	for _, key := range old {
+		s.forgetDirectory(key)
+		err = s.S.Delete(key)
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// repackBlob copies the given blob from its bundle in the item id into bw,
+// and updates the bundle it is in. It returns the number of bytes copied.
+func (s *Store) repackBlob(bw *BundleWriter, id string, blob *Blob) (int64, error) {
+	if len(blob.Segments) > 0 {
+		return s.repackSegments(bw, id, blob)
+	}
+	rc, err := s.openBundleStream(id, blob.Bundle, fmt.Sprintf("blob/%d", blob.ID))
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	written, err := bw.WriteBlob(blob, rc)
+	if err == nil {
+		err = validateCopy(id, blob, written)
+	}
+	if err != nil {
+		return 0, err
+	}
+	blob.Bundle = written.Bundle
+	return written.BytesWritten, nil
+}
+
+// packedBundles returns the number of bundles a BundleWriter using the
+// given policy makes when writing the given blobs, in order, into new
+// bundles.
+func packedBundles(blobs []*Blob, policy BundlePolicy) int {
+	bw := &BundleWriter{policy: policy}
+	n := 1
+	add := func(size int64) {
+		if bw.startNew(size) {
+			n++
+			bw.size = 0
+			bw.count = 0
+		}
+		bw.size += size
+		bw.count++
+	}
+	for _, blob := range blobs {
+		if len(blob.Segments) == 0 {
+			add(blob.storedSize())
+			continue
+		}
+		for _, seg := range blob.Segments {
+			add(seg.Size)
+		}
+	}
+	return n
+}
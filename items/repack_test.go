@@ -0,0 +1,83 @@
+package items
+
+import (
+	"io"
+	"testing"
+
+	"github.com/ndlib/bendo/store"
+)
+
+func TestRepack(t *testing.T) {
+	ms := store.NewMemory()
+	s := New(ms)
+	contents := []string{"one", "two", "three", "four"}
+	for i, content := range contents {
+		w, err := s.Open("repack", "nobody")
+		if err != nil {
+			t.Fatal(err)
+		}
+		writedata(t, w, content)
+		if i == 3 {
+			w.DeleteBlob(2)
+		}
+		w.Close()
+	}
+
+	result, err := s.Repack("repack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// bundle 2 was already removed when blob 2 was purged
+	if result.Before != 3 || result.After != 1 || result.Bytes != 12 {
+		t.Errorf("Repack() == %+v, expected 3 bundles to 1 with 12 bytes", result)
+	}
+	keys, _ := ms.ListPrefix("repack")
+	if len(keys) != 3 {
+		t.Errorf("Received keys %v, expected one bundle and its sidecars", keys)
+	}
+
+	// read everything back, without the cached item
+	s = New(ms)
+	item, err := s.Item("repack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(item.Versions) != 4 || item.MaxBundle != 5 {
+		t.Errorf("Received %d versions and max bundle %d, expected 4 and 5", len(item.Versions), item.MaxBundle)
+	}
+	for i, content := range contents {
+		bid := BlobID(i + 1)
+		rc, _, err := s.Blob("repack", bid)
+		if bid == 2 {
+			if err == nil {
+				rc.Close()
+				t.Errorf("Deleted blob 2 is readable")
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Blob %d: %s", bid, err)
+			continue
+		}
+		buf, _ := io.ReadAll(rc)
+		rc.Close()
+		if string(buf) != content {
+			t.Errorf("Blob %d is %q, expected %q", bid, buf, content)
+		}
+	}
+	_, problems, err := s.Validate("repack")
+	if err != nil || len(problems) != 0 {
+		t.Errorf("Validate() == %v, %v", problems, err)
+	}
+
+	// nothing more to do
+	result, err = s.Repack("repack")
+	if err != nil || result.Before != 1 || result.After != 1 || result.Bytes != 0 {
+		t.Errorf("Repack() == %+v, %v, expected nothing done", result, err)
+	}
+
+	_, err = s.Repack("nosuchitem")
+	if err != ErrNoItem {
+		t.Errorf("Repack() == %v, expected %v", err, ErrNoItem)
+	}
+}
@@ -0,0 +1,211 @@
+package items
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/ndlib/bendo/util"
+)
+
+// SetSegmentSize makes blobs larger than n bytes be split into segments of n
+// bytes, the last one being shorter, when they are written. Each segment is
+// its own bundle stream with its own checksums, so a very large blob does
+// not make one enormous zip member, and since with the default bundle policy
+// a new bundle is started once the current one is larger than
+// IdealBundleSize, a segment size at least as large puts each segment in its
+// own bundle. Zero, the default, never splits blobs. Blobs whose size is not
+// known when they are written are never split. Blobs already saved are read
+// however they were written. It is intended to be used during
+// initialization, like SetLayout.
+func (s *Store) SetSegmentSize(n int64) {
+	s.segment = n
+}
+
+// SegmentSize returns the size blobs are split into segments of, or 0 if
+// they are not split.
+func (s *Store) SegmentSize() int64 {
+	return s.segment
+}
+
+// segmentName returns the name of the bundle stream holding segment n of
+// the given blob. Segments are numbered from 1.
+func segmentName(id BlobID, n int) string {
+	return fmt.Sprintf("blob/%d.%d", id, n)
+}
+
+// WriteSegments is like WriteBlob, but splits the content of blob into
+// segments of at most segsize bytes, each written as its own stream. The
+// blob's Size must be given. If the blob is encrypted, r gives the encrypted
+// content, and it is that which is split and checksummed. Whenever the
+// current bundle is full a new one is started between segments. The Results
+// have the checksums of the entire blob and the bundle of the first segment,
+// and the segments written are returned. An error is returned if a segment
+// is short.
+//
+// As with WriteBlob, the *Blob is not modified, and the Results should be
+// checked with ValidateWriteBlob.
+func (bw *BundleWriter) WriteSegments(blob *Blob, r io.Reader, segsize int64) (Results, []Segment, error) {
+	var result Results
+	var segments []Segment
+	hw := util.NewHashWriterPlain()
+	for _, name := range bw.digests {
+		hw.AddDigest(name)
+	}
+	tr := io.TeeReader(r, hw)
+	var err error
+	for n, left := 1, blob.storedSize(); left > 0; n++ {
+		size := segsize
+		if left < size {
+			size = left
+		}
+		var written Results
+		written, err = bw.writeStream(segmentName(blob.ID, n), size, io.LimitReader(tr, size))
+		if len(written.WrittenMD5) == 0 {
+			break
+		}
+		segments = append(segments, Segment{
+			Bundle: written.Bundle,
+			Size:   written.BytesWritten,
+			MD5:    written.WrittenMD5,
+			SHA256: written.WrittenSHA256,
+		})
+		result.BytesWritten += written.BytesWritten
+		if err == nil && written.BytesWritten < size {
+			err = fmt.Errorf("blob %d segment %d: %w", blob.ID, n, io.ErrUnexpectedEOF)
+		}
+		if err != nil {
+			break
+		}
+		left -= size
+	}
+	if len(segments) == 0 {
+		return result, nil, err
+	}
+	if err == nil {
+		// anything more than the expected size makes the validation fail
+		var extra int64
+		extra, err = io.Copy(hw, r)
+		result.BytesWritten += extra
+	}
+	result.Bundle = segments[0].Bundle
+	result.WrittenMD5, _ = hw.CheckMD5(nil)
+	result.WrittenSHA256, _ = hw.CheckSHA256(nil)
+	result.WrittenDigests = hw.Digests()
+	return result, segments, err
+}
+
+// copySegment copies segment n of blob from r, checking it against the size
+// and checksums recorded for the segment.
+func (bw *BundleWriter) copySegment(blob *Blob, n int, r io.Reader) error {
+	if n > len(blob.Segments) {
+		return fmt.Errorf("blob %d has no segment %d", blob.ID, n)
+	}
+	seg := &blob.Segments[n-1]
+	result, err := bw.writeStream(segmentName(blob.ID, n), seg.Size, r)
+	if err == nil {
+		err = validateSegment(bw.item.ID, blob.ID, n, *seg, result)
+	}
+	if err != nil {
+		return err
+	}
+	seg.Bundle = result.Bundle
+	if n == 1 {
+		blob.Bundle = result.Bundle
+	}
+	return nil
+}
+
+// validateSegment checks that the written segment n has the size and
+// hashes expected.
+func validateSegment(itemID string, id BlobID, n int, seg Segment, result Results) error {
+	if seg.Size != result.BytesWritten {
+		return fmt.Errorf("commit (%s blob %d segment %d), copied %d bytes, expected %d",
+			itemID, id, n, result.BytesWritten, seg.Size)
+	}
+	err := testhash(result.WrittenMD5, seg.MD5, itemID)
+	if err == nil {
+		err = testhash(result.WrittenSHA256, seg.SHA256, itemID)
+	}
+	return err
+}
+
+// repackSegments copies every segment of the given blob in the item id into
+// bw, and returns the number of bytes copied.
+func (s *Store) repackSegments(bw *BundleWriter, id string, blob *Blob) (int64, error) {
+	var total int64
+	for i, seg := range blob.Segments {
+		rc, err := s.openBundleStream(id, seg.Bundle, segmentName(blob.ID, i+1))
+		if err != nil {
+			return total, err
+		}
+		err = bw.copySegment(blob, i+1, rc)
+		rc.Close()
+		if err != nil {
+			return total, err
+		}
+		total += seg.Size
+	}
+	return total, nil
+}
+
+// A segmentReader reads the segments of a blob one after the other, only
+// opening each bundle once it is reached. The MD5 checksum of each segment
+// is checked as it is read, and an error is returned at the end of a segment
+// which does not match.
+type segmentReader struct {
+	s   *Store
+	id  string // the item storing the blob
+	bid BlobID
+	seg []Segment
+	n   int              // the number of segments opened
+	rc  io.ReadCloser    // the segment being read, or nil
+	hw  *util.HashWriter // the checksum of the segment being read
+}
+
+// next opens the next segment.
+func (sr *segmentReader) next() error {
+	seg := sr.seg[sr.n]
+	rc, err := sr.s.openBlobStream(sr.id, seg.Bundle, segmentName(sr.bid, sr.n+1))
+	if err != nil {
+		return err
+	}
+	sr.n++
+	sr.rc = rc
+	sr.hw = util.NewMD5Writer(io.Discard)
+	return nil
+}
+
+func (sr *segmentReader) Read(p []byte) (int, error) {
+	for {
+		if sr.rc == nil {
+			if sr.n >= len(sr.seg) {
+				return 0, io.EOF
+			}
+			if err := sr.next(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := sr.rc.Read(p)
+		sr.hw.Write(p[:n])
+		if err == io.EOF {
+			sr.rc.Close()
+			sr.rc = nil
+			if _, ok := sr.hw.CheckMD5(sr.seg[sr.n-1].MD5); !ok {
+				return n, fmt.Errorf("blob (%s,%d) segment %d has MD5 mismatch", sr.id, sr.bid, sr.n)
+			}
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (sr *segmentReader) Close() error {
+	if sr.rc == nil {
+		return nil
+	}
+	err := sr.rc.Close()
+	sr.rc = nil
+	return err
+}
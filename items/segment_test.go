@@ -0,0 +1,125 @@
+package items
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/ndlib/bendo/store"
+)
+
+func TestSegments(t *testing.T) {
+	ms := store.NewMemory()
+	s := New(ms)
+	s.SetSegmentSize(10)
+	big := "0123456789abcdefghijklmnopqrstuvwxyz" // 36 bytes, 4 segments
+	w, _ := s.Open("seg", "nobody")
+	small := writedata(t, w, "small")
+	bid := writedata(t, w, big)
+	// unknown sizes are never split
+	unknown, err := w.WriteBlob(strings.NewReader(big+big), 0, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetSlot("big", bid)
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// read everything back, without the cached item
+	s = New(ms)
+	item, err := s.Item("seg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := item.blobByID(bid)
+	if len(blob.Segments) != 4 || blob.Segments[3].Size != 6 || blob.Bundle != blob.Segments[0].Bundle {
+		t.Errorf("Received segments %+v", blob.Segments)
+	}
+	if len(item.blobByID(small).Segments) != 0 || len(item.blobByID(unknown).Segments) != 0 {
+		t.Errorf("Unexpected segments for blobs %d or %d", small, unknown)
+	}
+	checkRead(t, s, "seg", bid, []byte(big))
+	checkRead(t, s, "seg", unknown, []byte(big+big))
+	_, problems, err := s.Validate("seg")
+	if err != nil || len(problems) != 0 {
+		t.Errorf("Validate() == %v, %v", problems, err)
+	}
+
+	// deleting another blob copies the segments into a new bundle
+	w, _ = s.Open("seg", "nobody")
+	w.DeleteBlob(small)
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = New(ms)
+	checkRead(t, s, "seg", bid, []byte(big))
+	_, problems, err = s.Validate("seg")
+	if err != nil || len(problems) != 0 {
+		t.Errorf("Validate() == %v, %v", problems, err)
+	}
+
+	// so do export and repack
+	dest := store.NewMemory()
+	err = s.Export("seg", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRead(t, New(dest), "seg", bid, []byte(big))
+	w, _ = s.Open("seg", "nobody")
+	writedata(t, w, "another version")
+	w.Close()
+	_, err = s.Repack("seg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = New(ms)
+	checkRead(t, s, "seg", bid, []byte(big))
+
+	// and deleting the segmented blob removes every segment
+	w, _ = s.Open("seg", "nobody")
+	w.DeleteBlob(bid)
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = New(ms)
+	item, _ = s.Item("seg")
+	if blob := item.blobByID(bid); blob.Bundle != 0 || len(blob.Segments) != 0 {
+		t.Errorf("Received %+v", blob)
+	}
+	_, problems, err = s.Validate("seg")
+	if err != nil || len(problems) != 0 {
+		t.Errorf("Validate() == %v, %v", problems, err)
+	}
+}
+
+func TestSegmentChecksum(t *testing.T) {
+	ms := store.NewMemory()
+	s := New(ms)
+	s.SetSegmentSize(4)
+	w, _ := s.Open("segsum", "nobody")
+	bid := writedata(t, w, "abcdefghij")
+	w.Close()
+
+	// a wrong segment checksum is found both when reading and validating
+	s = NewWithCache(ms, NewMemoryCache())
+	item, _ := s.Item("segsum")
+	item.blobByID(bid).Segments[1].MD5 = bytes.Repeat([]byte{0}, 16)
+	r, _, err := s.Blob("segsum", bid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	_, err = buf.ReadFrom(r)
+	r.Close()
+	if err == nil || buf.String() != "abcdefgh" {
+		t.Errorf("Read %q, %v, expected an MD5 mismatch", buf.String(), err)
+	}
+	_, problems, _ := s.Validate("segsum")
+	if len(problems) != 1 || !strings.Contains(problems[0], "segment 2 has MD5 mismatch") {
+		t.Errorf("Validate() == %v", problems)
+	}
+}
@@ -18,17 +18,57 @@ type Blob struct {
 	Size     int64 // logical size of associated content (i.e. before compression)
 
 	// following valid if blob is NOT deleted
-	Bundle   int    // which bundle file this blob is stored in, 0 if deleted
+	Bundle   int    // which bundle file this blob is stored in, 0 if deleted or a reference
 	MD5      []byte // unused if deleted
 	SHA256   []byte // unused if deleted
 	MimeType string // either empty or the mime type of this blob
 
+	// Meta holds user-defined metadata for the blob, such as its original
+	// path or a rights statement. Unlike slot metadata, it belongs to the
+	// blob itself and so is the same in every version.
+	Meta map[string]string `json:",omitempty"`
+
+	// Digests holds any other checksums recorded for this blob, such as
+	// "sha512", keyed by algorithm name. Which ones are recorded depends
+	// on the Store's digests when the blob was saved.
+	Digests map[string][]byte `json:",omitempty"`
+
+	// Segments is set if the content is split across several bundle
+	// streams because it is larger than the Store's segment size. Each
+	// segment has its own size and checksums, and may be in a different
+	// bundle. Bundle is then the bundle of the first segment.
+	Segments []Segment `json:",omitempty"`
+
+	// Encrypted is set if the content is stored encrypted with the item's
+	// data key. The size and checksums above are then those of the
+	// content, and StoredMD5 and StoredSHA256 are those of the encrypted
+	// stream kept in the bundle. The checksums of any segments are also of
+	// the encrypted stream.
+	Encrypted    bool   `json:",omitempty"`
+	StoredMD5    []byte `json:",omitempty"`
+	StoredSHA256 []byte `json:",omitempty"`
+
+	// following valid if blob is a reference to a blob stored in another
+	// item. A reference has no bundle of its own; its content is read
+	// from the other blob.
+	RefItem string `json:",omitempty"` // empty iff not a reference
+	RefBlob BlobID `json:",omitempty"`
+
 	// following valid if blob is deleted
 	DeleteDate time.Time // zero iff not deleted
 	Deleter    string    // empty iff not deleted
 	DeleteNote string    // optional note for deletion event
 }
 
+// A Segment is one piece of a segmented blob, stored in the bundle stream
+// "blob/<id>.<n>" where n counts the segments from 1.
+type Segment struct {
+	Bundle int // which bundle file this segment is stored in
+	Size   int64
+	MD5    []byte
+	SHA256 []byte
+}
+
 // Version contains the metadata on a single item version.
 type Version struct {
 	ID       VersionID
@@ -36,6 +76,15 @@ type Version struct {
 	Creator  string
 	Note     string
 	Slots    map[string]BlobID
+
+	// SlotMeta holds extra metadata for slots, such as a file's
+	// modification time. It is indexed by slot name and then by key.
+	SlotMeta map[string]map[string]string `json:",omitempty"`
+
+	// Meta holds metadata about the version as a whole, such as the
+	// bag-info.txt fields of a bag it was ingested from. Unlike slot
+	// metadata, it is not copied into later versions.
+	Meta map[string]string `json:",omitempty"`
 }
 
 // An Item contains the information for a single item.
@@ -44,6 +93,11 @@ type Item struct {
 	MaxBundle int        // largest bundle id used by this item
 	Blobs     []*Blob    // list of blobs, sorted by id
 	Versions  []*Version // list of versions, sorted by id
+
+	// DataKey is the key the item's encrypted blobs are encrypted with,
+	// itself encrypted by the store's KeyWrapper. It is empty if no blob
+	// has been encrypted.
+	DataKey []byte `json:",omitempty"`
 }
 
 // An ItemCache defines the methods a Store will use to interact with a cache.
@@ -53,4 +107,8 @@ type ItemCache interface {
 	Lookup(id string) *Item
 
 	Set(id string, item *Item)
+
+	// remove any record for the given id. It is not an error if there
+	// is nothing cached for it.
+	Delete(id string)
 }
@@ -3,6 +3,7 @@ package items
 import (
 	"bytes"
 	"fmt"
+	"time"
 
 	"github.com/ndlib/bendo/bagit"
 	"github.com/ndlib/bendo/store"
@@ -22,16 +23,26 @@ import (
 // * There are no extra files in a bundle
 // * All required metadata fields are present for each blob
 // * All required metadata fields are present for each version
+// * Each bundle is locked, if the store locks new keys
 //
 // This is a method on the Store instead of an Item since it needs access
 // to the underlying bundle files.
 func (s *Store) Validate(id string) (nb int64, problems []string, err error) {
 	// First verify each bundle file
-	var bundleNames []string
-	bundleNames, err = s.S.ListPrefix(id)
+	var keys, bundleNames []string
+	keys, err = s.S.ListPrefix(s.layout.Prefix(id))
 	if err != nil {
 		return
 	}
+	// skip checksum sidecars and the bundles of other items sharing
+	// this prefix
+	var bundleKeys = make(map[int]string)
+	for _, key := range keys {
+		if slug, n := s.layout.Parse(key); slug == id {
+			bundleNames = append(bundleNames, key)
+			bundleKeys[n] = key
+		}
+	}
 
 	// can we prefetch all the bundle files?
 	if x, ok := s.S.(store.Stager); ok {
@@ -74,7 +85,7 @@ func (s *Store) Validate(id string) (nb int64, problems []string, err error) {
 		return
 	}
 	// validate blob metadata
-	var bundleblobmap = make(map[string][]*Blob)
+	var bundleblobmap = make(map[string][]bundleMember)
 	for _, blob := range item.Blobs {
 		if blob.SaveDate.IsZero() {
 			problems = append(problems, fmt.Sprintf("Blob (%s,%d) has a zero save date", id, blob.ID))
@@ -84,7 +95,14 @@ func (s *Store) Validate(id string) (nb int64, problems []string, err error) {
 			if blob.Size < 0 {
 				problems = append(problems, fmt.Sprintf("Blob (%s,%d) has negative size", id, blob.ID))
 			}
-			if blob.Bundle <= 0 {
+			if blob.RefItem != "" {
+				if blob.Bundle != 0 {
+					problems = append(problems, fmt.Sprintf("Blob (%s,%d) is a reference and has non-zero bundle ID", id, blob.ID))
+				}
+				if blob.RefBlob <= 0 {
+					problems = append(problems, fmt.Sprintf("Blob (%s,%d) is a reference with non-positive blob ID", id, blob.ID))
+				}
+			} else if blob.Bundle <= 0 {
 				problems = append(problems, fmt.Sprintf("Blob (%s,%d) has non-positive bundle ID", id, blob.ID))
 			}
 			if len(blob.MD5) != 16 {
@@ -99,9 +117,39 @@ func (s *Store) Validate(id string) (nb int64, problems []string, err error) {
 			if blob.DeleteNote != "" {
 				problems = append(problems, fmt.Sprintf("Blob (%s,%d) has a delete note", id, blob.ID))
 			}
-			// now verify these hashes match what is stored in the manifest
-			bundlename := sugar(id, blob.Bundle)
-			bundleblobmap[bundlename] = append(bundleblobmap[bundlename], blob)
+			if blob.Encrypted && len(item.DataKey) == 0 {
+				problems = append(problems, fmt.Sprintf("Blob (%s,%d) is encrypted and the item has no data key", id, blob.ID))
+			}
+			// now verify these hashes match what is stored in the manifest.
+			// a reference is checked with the item storing its content.
+			if blob.RefItem != "" {
+				continue
+			}
+			bundlename := func(n int) string {
+				if name, ok := bundleKeys[n]; ok {
+					return name
+				}
+				return s.bundleKey(id, n)
+			}
+			if len(blob.Segments) == 0 {
+				name := bundlename(blob.Bundle)
+				bundleblobmap[name] = append(bundleblobmap[name], bundleMember{blob: blob})
+				continue
+			}
+			// each segment is checked against the manifest of its bundle
+			var total int64
+			for i, seg := range blob.Segments {
+				total += seg.Size
+				if seg.Bundle <= 0 {
+					problems = append(problems, fmt.Sprintf("Blob (%s,%d) segment %d has non-positive bundle ID", id, blob.ID, i+1))
+					continue
+				}
+				name := bundlename(seg.Bundle)
+				bundleblobmap[name] = append(bundleblobmap[name], bundleMember{blob: blob, segment: i + 1})
+			}
+			if total != blob.storedSize() {
+				problems = append(problems, fmt.Sprintf("Blob (%s,%d) has segments totaling %d bytes, expected %d", id, blob.ID, total, blob.storedSize()))
+			}
 		} else {
 			// blob is deleted
 			if blob.Bundle != 0 {
@@ -122,14 +170,43 @@ func (s *Store) Validate(id string) (nb int64, problems []string, err error) {
 		if err != nil {
 			return
 		}
-		for _, blob := range bloblist {
+		for _, m := range bloblist {
+			blob := m.blob
+			if m.segment > 0 {
+				seg := blob.Segments[m.segment-1]
+				checksum := bag.Checksum(segmentName(blob.ID, m.segment))
+				if !bytes.Equal(seg.MD5, checksum.MD5) {
+					problems = append(problems, fmt.Sprintf("Blob (%s,%d) segment %d has MD5 mismatch", id, blob.ID, m.segment))
+				}
+				if !bytes.Equal(seg.SHA256, checksum.SHA256) {
+					problems = append(problems, fmt.Sprintf("Blob (%s,%d) segment %d has SHA-256 mismatch", id, blob.ID, m.segment))
+				}
+				continue
+			}
 			checksum := bag.Checksum(fmt.Sprintf("blob/%d", blob.ID))
+			if blob.Encrypted {
+				// the bundle has the checksums of the encrypted content
+				if !bytes.Equal(blob.StoredMD5, checksum.MD5) {
+					problems = append(problems, fmt.Sprintf("Blob (%s,%d) has encrypted MD5 mismatch", id, blob.ID))
+				}
+				if !bytes.Equal(blob.StoredSHA256, checksum.SHA256) {
+					problems = append(problems, fmt.Sprintf("Blob (%s,%d) has encrypted SHA-256 mismatch", id, blob.ID))
+				}
+				continue
+			}
 			if !bytes.Equal(blob.MD5, checksum.MD5) {
 				problems = append(problems, fmt.Sprintf("Blob (%s,%d) has MD5 mismatch", id, blob.ID))
 			}
 			if !bytes.Equal(blob.SHA256, checksum.SHA256) {
 				problems = append(problems, fmt.Sprintf("Blob (%s,%d) has SHA-256 mismatch", id, blob.ID))
 			}
+			// other checksums are only compared if the bundle has them
+			bundled := namedDigests(checksum)
+			for name, h := range blob.Digests {
+				if b, ok := bundled[name]; ok && !bytes.Equal(h, b) {
+					problems = append(problems, fmt.Sprintf("Blob (%s,%d) has %s mismatch", id, blob.ID, name))
+				}
+			}
 		}
 		err = bag.Close()
 		if err != nil {
@@ -137,10 +214,42 @@ func (s *Store) Validate(id string) (nb int64, problems []string, err error) {
 		}
 	}
 
+	problems = append(problems, s.validateLocks(bundleNames)...)
+
 	// TODO(dbrower): validate version metadata
 	return
 }
 
+// A bundleMember is a blob, or one segment of a blob, to check against the
+// manifest of the bundle it is in.
+type bundleMember struct {
+	blob    *Blob
+	segment int // the segment number, or 0 if the blob is not segmented
+}
+
+// validateLocks returns a problem for each bundle which is not locked, if
+// the store has a lock policy. Since the policy only applies to keys written
+// after it was set, older bundles may also be reported.
+func (s *Store) validateLocks(bundleNames []string) []string {
+	locker, ok := s.S.(store.Locker)
+	if !ok || !locker.Locking().Enabled() {
+		return nil
+	}
+	var problems []string
+	for _, name := range bundleNames {
+		info, err := locker.LockStatus(name)
+		switch {
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("Bundle %s lock status unknown: %s", name, err))
+		case !info.Locked && !info.Until.IsZero():
+			problems = append(problems, fmt.Sprintf("Bundle %s lock expired %s", name, info.Until.Format(time.RFC3339)))
+		case !info.Locked:
+			problems = append(problems, fmt.Sprintf("Bundle %s is not locked", name))
+		}
+	}
+	return problems
+}
+
 // validateItemMetadata checks that the metadata for an item are consistent
 // and matches the bag checksums as stored.
 func (s *Store) validateItemMetadata() {
@@ -1,7 +1,10 @@
 package items
 
 import (
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/ndlib/bendo/store"
 )
@@ -79,3 +82,35 @@ func createBundledItem(t *testing.T, s *Store, name string, data []itemData) err
 	}
 	return w.Close()
 }
+
+func TestValidateLocks(t *testing.T) {
+	root, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(root)
+	fs := store.NewFileSystem(root)
+	s := New(fs)
+
+	w, _ := s.Open("unlocked", "nobody")
+	w.SetSlot("a", writedata(t, w, "hello"))
+	w.Close()
+	fs.SetLockPolicy(store.LockPolicy{Period: time.Hour})
+	w, _ = s.Open("locked", "nobody")
+	w.SetSlot("a", writedata(t, w, "hello"))
+	w.Close()
+
+	var table = []struct {
+		id       string
+		problems int
+	}{
+		{"unlocked", 1},
+		{"locked", 0},
+	}
+	for _, tab := range table {
+		_, problems, err := s.Validate(tab.id)
+		if err != nil {
+			t.Fatalf("Validate(%s) == %s, expected nil", tab.id, err)
+		}
+		if len(problems) != tab.problems {
+			t.Errorf("Validate(%s) problems %v, expected %d", tab.id, problems, tab.problems)
+		}
+	}
+}
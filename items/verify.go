@@ -0,0 +1,69 @@
+package items
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ndlib/bendo/util"
+)
+
+// ErrBadContent occurs when the content of a blob read from its bundle does
+// not have the size or checksums recorded for it.
+var ErrBadContent = errors.New("content does not match its size or checksums")
+
+// SetVerifyReads makes the content of every blob read with Blob be checked
+// against the blob's size and MD5 and SHA-256 checksums as it is read. A
+// blob longer than its size is reported as soon as the extra content is
+// read, and any other mismatch is reported at the end of the content in
+// place of io.EOF. Either way the error wraps ErrBadContent, so a reader
+// copying the blob, such as into a cache, sees the error and can discard
+// what it copied. Checksumming takes some time, so the default is to not
+// verify reads. It is intended to be used during initialization.
+func (s *Store) SetVerifyReads(verify bool) {
+	s.verify = verify
+}
+
+// A verifyReader checks the content read from it against the size and
+// checksums of a blob.
+type verifyReader struct {
+	io.ReadCloser
+	id   string // the item holding the blob
+	blob *Blob
+	hw   *util.HashWriter
+	n    int64 // bytes read so far
+}
+
+func newVerifyReader(rc io.ReadCloser, id string, blob *Blob) *verifyReader {
+	return &verifyReader{
+		ReadCloser: rc,
+		id:         id,
+		blob:       blob,
+		hw:         util.NewHashWriterPlain(),
+	}
+}
+
+func (v *verifyReader) Read(p []byte) (int, error) {
+	n, err := v.ReadCloser.Read(p)
+	v.hw.Write(p[:n])
+	v.n += int64(n)
+	if v.n > v.blob.Size {
+		return n, v.mismatch("size")
+	}
+	if err == io.EOF {
+		if v.n != v.blob.Size {
+			return n, v.mismatch("size")
+		}
+		if _, ok := v.hw.CheckMD5(v.blob.MD5); !ok {
+			return n, v.mismatch("MD5")
+		}
+		if _, ok := v.hw.CheckSHA256(v.blob.SHA256); !ok {
+			return n, v.mismatch("SHA-256")
+		}
+	}
+	return n, err
+}
+
+func (v *verifyReader) mismatch(what string) error {
+	return fmt.Errorf("blob (%s,%d) %s mismatch: %w", v.id, v.blob.ID, what, ErrBadContent)
+}
@@ -0,0 +1,37 @@
+package items
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/ndlib/bendo/store"
+)
+
+func TestVerifyReads(t *testing.T) {
+	s := NewWithCache(store.NewMemory(), NewMemoryCache())
+	s.SetVerifyReads(true)
+	w, _ := s.Open("verify", "nobody")
+	good := writedata(t, w, "good content")
+	badsum := writedata(t, w, "changed checksum")
+	badsize := writedata(t, w, "changed size")
+	w.Close()
+
+	checkRead(t, s, "verify", good, []byte("good content"))
+
+	// change the recorded checksum and size, as if the content had changed
+	item, _ := s.Item("verify")
+	item.blobByID(badsum).SHA256[0] ^= 1
+	item.blobByID(badsize).Size -= 2
+	for _, bid := range []BlobID{badsum, badsize} {
+		rc, _, err := s.Blob("verify", bid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.ReadAll(rc)
+		rc.Close()
+		if !errors.Is(err, ErrBadContent) {
+			t.Errorf("Blob %d: read gave %v, expected ErrBadContent", bid, err)
+		}
+	}
+}
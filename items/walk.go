@@ -0,0 +1,88 @@
+package items
+
+import (
+	"encoding/base64"
+	"errors"
+	"sort"
+)
+
+// A WalkItem is an item found by Walk, with the numbers of the bundles it
+// has in the store in increasing order.
+type WalkItem struct {
+	ID      string
+	Bundles []int
+}
+
+var (
+	// ErrStopWalk can be returned by the function given to Walk to end
+	// the walk early. The item it was returned for counts as visited,
+	// and Walk returns no error.
+	ErrStopWalk = errors.New("stop walk")
+
+	// ErrBadBookmark means a bookmark given to Walk was not one it made.
+	ErrBadBookmark = errors.New("bad walk bookmark")
+)
+
+// Walk calls fn for each item in the store, in order of item id, starting
+// after the item marked by bookmark, or with the first item if bookmark is
+// empty. The underlying store is listed once when the walk starts, so the
+// items and bundles given are as they were then: items added during the walk
+// are not visited, and items deleted may still be.
+//
+// The walk stops if fn returns an error, and Walk returns it along with a
+// bookmark marking the items visited before it, so a later Walk given the
+// bookmark starts again with the item which failed. If fn returns
+// ErrStopWalk the bookmark also covers the item it was returned for, and the
+// error returned is nil. Bookmarks are opaque strings which may be saved and
+// used by another process. The bookmark returned when every item has been
+// visited is empty, so walking again starts over from the beginning.
+func (s *Store) Walk(bookmark string, fn func(item WalkItem) error) (string, error) {
+	if s.useStore == false {
+		return bookmark, ErrNoStore
+	}
+	after, err := parseBookmark(bookmark)
+	if err != nil {
+		return bookmark, err
+	}
+	bundles := make(map[string][]int)
+	for key := range s.S.List() {
+		id, n := s.layout.Parse(key)
+		if id == "" || id <= after {
+			continue
+		}
+		bundles[id] = append(bundles[id], n)
+	}
+	ids := make([]string, 0, len(bundles))
+	for id := range bundles {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		b := bundles[id]
+		sort.Ints(b)
+		err := fn(WalkItem{ID: id, Bundles: b})
+		if err == ErrStopWalk {
+			return makeBookmark(id), nil
+		} else if err != nil {
+			return bookmark, err
+		}
+		bookmark = makeBookmark(id)
+	}
+	return "", nil
+}
+
+// makeBookmark returns a bookmark for a walk which has visited every item
+// up to and including id.
+func makeBookmark(id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(id))
+}
+
+// parseBookmark returns the id of the last item visited by the walk the
+// bookmark was made for, or "" for an empty bookmark.
+func parseBookmark(bookmark string) (string, error) {
+	id, err := base64.RawURLEncoding.DecodeString(bookmark)
+	if err != nil {
+		return "", ErrBadBookmark
+	}
+	return string(id), nil
+}
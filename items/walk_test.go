@@ -0,0 +1,76 @@
+package items
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/ndlib/bendo/store"
+)
+
+func TestWalk(t *testing.T) {
+	ms := store.NewMemory()
+	s := New(ms)
+	for _, id := range []string{"c", "a", "b"} {
+		w, err := s.Open(id, "nobody")
+		if err != nil {
+			t.Fatal(err)
+		}
+		writedata(t, w, "hello "+id)
+		w.Close()
+	}
+	// give b a second bundle
+	w, _ := s.Open("b", "nobody")
+	writedata(t, w, "again")
+	w.Close()
+
+	var visited []WalkItem
+	visit := func(item WalkItem) error {
+		visited = append(visited, item)
+		return nil
+	}
+	bookmark, err := s.Walk("", visit)
+	if err != nil || bookmark != "" {
+		t.Fatalf("Walk() == %q, %v, expected no bookmark", bookmark, err)
+	}
+	expected := []WalkItem{
+		{ID: "a", Bundles: []int{1}},
+		{ID: "b", Bundles: []int{1, 2}},
+		{ID: "c", Bundles: []int{1}},
+	}
+	if !reflect.DeepEqual(visited, expected) {
+		t.Errorf("Visited %v, expected %v", visited, expected)
+	}
+
+	// stop after the first item, then resume
+	visited = nil
+	bookmark, err = s.Walk("", func(item WalkItem) error {
+		visit(item)
+		return ErrStopWalk
+	})
+	if err != nil || len(visited) != 1 {
+		t.Fatalf("Walk() == %q, %v, visited %v", bookmark, err, visited)
+	}
+	// an error leaves the failed item to be walked again
+	failed := errors.New("failed")
+	bookmark, err = s.Walk(bookmark, func(item WalkItem) error {
+		if item.ID == "c" {
+			return failed
+		}
+		return visit(item)
+	})
+	if err != failed {
+		t.Fatalf("Walk() returned %v, expected %v", err, failed)
+	}
+	bookmark, err = s.Walk(bookmark, visit)
+	if err != nil || bookmark != "" {
+		t.Fatalf("Walk() == %q, %v, expected no bookmark", bookmark, err)
+	}
+	if !reflect.DeepEqual(visited, expected) {
+		t.Errorf("Visited %v, expected %v", visited, expected)
+	}
+
+	if _, err := s.Walk("not a bookmark!", visit); err != ErrBadBookmark {
+		t.Errorf("Walk() returned %v, expected ErrBadBookmark", err)
+	}
+}
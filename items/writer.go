@@ -2,21 +2,31 @@ package items
 
 import (
 	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/sha256"
 	"io"
+	"log/slog"
 	"sort"
 	"time"
+
+	"github.com/ndlib/bendo/util"
 )
 
 // A Writer implements an io.Writer with extra methods to save a new
 // version of an Item.
 type Writer struct {
-	store   *Store        // need for cache.Set() and Deletes
-	item    *Item         // item we are writing out
-	bw      *BundleWriter //
-	bnext   BlobID        // the next available blob id
-	del     []BlobID      // list of blobs to delete at Close
-	version Version       // version info for this write
-	bdel    []int         // bundle files to delete. generated from del
+	store   *Store            // need for cache.Set() and Deletes
+	item    *Item             // item we are writing out
+	bw      *BundleWriter     //
+	bnext   BlobID            // the next available blob id
+	del     []BlobID          // list of blobs to delete at Close
+	why     map[BlobID]string // reasons given for deleting blobs, if any
+	version Version           // version info for this write
+	bdel    []int             // bundle files to delete. generated from del
+	noref   string            // an item new blobs may not reference, see Merge
+	aead    cipher.AEAD       // encrypts new blobs, made when first needed
 }
 
 // Open opens the item id for writing. This will add a single new version to the
@@ -28,6 +38,14 @@ type Writer struct {
 // It is an error for more than one goroutine to open the same item at a time.
 // This does not perform any locking itself.
 func (s *Store) Open(id string, creator string) (*Writer, error) {
+	return s.OpenContext(context.Background(), id, creator)
+}
+
+// OpenContext is like Open, but once ctx is done the writer stops copying
+// blob content into bundles, and writes fail with the context's error. An
+// item whose save is stopped this way is left as it was, the same as if any
+// other error happened while writing it.
+func (s *Store) OpenContext(ctx context.Context, id string, creator string) (*Writer, error) {
 	wr := &Writer{
 		store: s,
 		version: Version{
@@ -38,7 +56,7 @@ func (s *Store) Open(id string, creator string) (*Writer, error) {
 			Creator:  creator,
 		},
 	}
-	item, err := s.Item(id)
+	item, err := s.ItemContext(ctx, id)
 	if err == ErrNoItem {
 		// this is a new item
 		item = &Item{ID: id}
@@ -55,13 +73,27 @@ func (s *Store) Open(id string, creator string) (*Writer, error) {
 		for k, v := range prev.Slots {
 			wr.version.Slots[k] = v
 		}
+		for k, meta := range prev.SlotMeta {
+			for key, value := range meta {
+				wr.SetSlotMeta(k, key, value)
+			}
+		}
+	}
+	wr.bw = NewFormatBundler(s.S, s.layout, s.format, item)
+	wr.bw.SetDigests(s.digests)
+	wr.bw.SetPolicy(s.policy)
+	wr.bw.SetContext(ctx)
+	err = wr.bw.SetParity(s.parity)
+	if err != nil {
+		return nil, err
 	}
-	wr.bw = NewBundler(s.S, item)
 	return wr, nil
 }
 
 // Close closes the given Writer. The final metadata is written out, and any
-// blobs marked for deletion are extracted and removed.
+// blobs marked for deletion are extracted and removed. Blobs which blobs in
+// other items refer to are not removed, and a *ReferenceError listing the
+// references is returned once the rest of the version is saved.
 func (wr *Writer) Close() error {
 	// Update item metadata
 	wr.version.SaveDate = time.Now()
@@ -83,7 +115,8 @@ func (wr *Writer) Close() error {
 	// delete bundles which contain purged items
 	// TODO(dbrower): figure out a policy on whether to do this deletion
 	for _, bundleid := range wr.bdel {
-		err = wr.store.S.Delete(sugar(wr.item.ID, bundleid))
+		key := wr.store.findBundleKey(wr.item.ID, bundleid)
+		err = wr.store.deleteBundle(key)
 		if err != nil {
 			return err
 		}
@@ -93,18 +126,47 @@ func (wr *Writer) Close() error {
 }
 
 func (wr *Writer) doDeletes() error {
+	// blobs other items refer to are kept, and the error listing the
+	// references is returned once the other blobs are deleted.
+	var referenced map[BlobID]bool
+	referr := wr.store.CheckReferences(wr.item.ID, wr.del)
+	if rerr, ok := referr.(*ReferenceError); ok {
+		referenced = rerr.referenced()
+	} else if referr != nil {
+		return referr
+	}
 	// gather up which bundles need to be rewritten
 	// and update blob metadata
 	var bundles = make(map[int][]BlobID)
 	for _, id := range wr.del {
+		if referenced[id] {
+			continue
+		}
 		blob := wr.item.blobByID(id)
+		if blob != nil && blob.RefItem != "" {
+			// a reference has no content in this item to remove
+			blob.DeleteDate = time.Now()
+			blob.Deleter = wr.version.Creator
+			blob.DeleteNote = wr.deleteNote(id)
+			blob.RefItem = ""
+			blob.RefBlob = 0
+			blob.Size = 0
+			blob.MimeType = ""
+			continue
+		}
 		if blob != nil && blob.Bundle != 0 {
 			bundles[blob.Bundle] = append(bundles[blob.Bundle], id)
+			for _, seg := range blob.Segments {
+				if seg.Bundle != blob.Bundle && !containsID(bundles[seg.Bundle], id) {
+					bundles[seg.Bundle] = append(bundles[seg.Bundle], id)
+				}
+			}
 
 			blob.DeleteDate = time.Now()
 			blob.Deleter = wr.version.Creator
-			blob.DeleteNote = wr.version.Note
+			blob.DeleteNote = wr.deleteNote(id)
 			blob.Bundle = 0
+			blob.Segments = nil
 			blob.Size = 0
 			blob.MimeType = ""
 		}
@@ -117,7 +179,7 @@ func (wr *Writer) doDeletes() error {
 		}
 		wr.bdel = append(wr.bdel, bundleid)
 	}
-	return nil
+	return referr
 }
 
 // WriteBlob signifies the intent to copy the given io.Reader into this item.
@@ -125,6 +187,10 @@ func (wr *Writer) doDeletes() error {
 // already a blob with them in this item. If there is, that blob id is returned
 // and r is not read at all.
 //
+// If the Store has a BlobFinder and the size and SHA-256 hash are provided,
+// another item holding a blob with them is looked for next. If one is found,
+// a new blob referring to it is added to this item, and again r is not read.
+//
 // If such a blob is not already in the item, WriteBlob will copy the io.Reader
 // into the item as a new blob. The hashes and size are compared with the data
 // read from r and an error is triggered if there is a difference.
@@ -143,13 +209,23 @@ func (wr *Writer) WriteBlob(r io.Reader, size int64, md5, sha256 []byte) (BlobID
 		return bid, nil
 	}
 
-	// lazily set up the blob counter
-	if wr.bnext == 0 {
-		wr.bnext = 1 // blob ids are 1 based
-		blen := len(wr.item.Blobs)
-		if blen > 0 {
-			wr.bnext = wr.item.Blobs[blen-1].ID + 1
+	wr.setupBlobCounter()
+	if ref := wr.findOtherBlob(size, md5, sha256); ref != nil {
+		blob := &Blob{
+			ID:       wr.bnext,
+			SaveDate: time.Now(),
+			Creator:  wr.version.Creator,
+			Size:     ref.Size,
+			MD5:      ref.MD5,
+			SHA256:   ref.SHA256,
+			Digests:  ref.Digests,
+			RefItem:  ref.item,
+			RefBlob:  ref.ID,
 		}
+		wr.bnext++
+		wr.item.Blobs = append(wr.item.Blobs, blob)
+		sort.Stable(byID(wr.item.Blobs))
+		return blob.ID, nil
 	}
 	// write the blob before appending the blob info to our blob list.
 	// If there are any errors, we don't add the blob information.
@@ -165,16 +241,52 @@ func (wr *Writer) WriteBlob(r io.Reader, size int64, md5, sha256 []byte) (BlobID
 		MD5:    md5,
 		SHA256: sha256,
 	}
+	// If encrypting, the bundle writer is given the encrypted content, so
+	// the content is checksummed separately as it is read.
+	var enc *encrypter
+	var plain *util.HashWriter
+	var err error
+	if wr.store.keys != nil {
+		if wr.aead == nil {
+			wr.aead, err = wr.store.itemCipher(wr.item, true)
+			if err != nil {
+				return 0, err
+			}
+		}
+		plain = util.NewHashWriterPlain()
+		for _, name := range wr.store.digests {
+			plain.AddDigest(name)
+		}
+		enc, err = newEncrypter(wr.aead, io.TeeReader(r, plain))
+		if err != nil {
+			return 0, err
+		}
+		blob.Encrypted = true
+		r = enc
+	}
 	// This is delicate because of error recovery.
 	// If the blob file was created in the bundle then we will reserve this
 	// blobID and add it to the blob list. Otherwise, we will reuse the blob
 	// id for the next one.
-	result, err := wr.bw.WriteBlob(blob, r)
+	var result Results
+	if wr.store.segment > 0 && size > wr.store.segment {
+		result, blob.Segments, err = wr.bw.WriteSegments(blob, r, wr.store.segment)
+	} else {
+		result, err = wr.bw.WriteBlob(blob, r)
+	}
 	if err != nil && len(result.WrittenMD5) == 0 {
 		// blob was never opened in the target bundle, so return an error
 		// and don't increase the blob ID
 		return 0, err
 	}
+	if enc != nil {
+		blob.StoredMD5 = result.WrittenMD5
+		blob.StoredSHA256 = result.WrittenSHA256
+		result.BytesWritten = enc.n
+		result.WrittenMD5, _ = plain.CheckMD5(nil)
+		result.WrittenSHA256, _ = plain.CheckSHA256(nil)
+		result.WrittenDigests = plain.Digests()
+	}
 	// whether or not there was an error, update the blob info to be saved
 	wr.bnext++ // prevent duplicate blob names inside this bundle
 	blob.Bundle = result.Bundle
@@ -192,6 +304,7 @@ func (wr *Writer) WriteBlob(r io.Reader, size int64, md5, sha256 []byte) (BlobID
 	if len(blob.SHA256) == 0 {
 		blob.SHA256 = result.WrittenSHA256[:]
 	}
+	blob.Digests = result.WrittenDigests
 	// return error from WriteBlob(), if one
 	if err != nil {
 		return 0, err
@@ -212,15 +325,22 @@ func (wr *Writer) WriteBlob(r io.Reader, size int64, md5, sha256 []byte) (BlobID
 
 // If a blob exists in the associated item having the same size and
 // hash values, return the blob's id. Otherwise return zero.
-// It is okay if size is 0 or if one or both hashes are empty.
+// It is okay if size is 0 or if one or both hashes are empty. A size of 0 is
+// taken to mean the size is unknown unless the hashes are those of empty
+// content.
 // This function is conservative, and it is possible it may return 0 even
 // though there is a matching blob.
 func (wr *Writer) findBlobByHash(size int64, md5, sha256 []byte) BlobID {
-	if size == 0 || (len(md5) == 0 && len(sha256) == 0) {
+	if len(md5) == 0 && len(sha256) == 0 {
+		return 0
+	}
+	if size == 0 && !isEmptyHash(md5, sha256) {
 		return 0
 	}
 	for _, blob := range wr.item.Blobs {
-		if blob.Size == size &&
+		// deleted blobs have a size of 0, so skip them
+		if (blob.Bundle != 0 || blob.RefItem != "") &&
+			blob.Size == size &&
 			(len(md5) == 0 || bytes.Equal(md5, blob.MD5)) &&
 			(len(sha256) == 0 || bytes.Equal(sha256, blob.SHA256)) {
 			return blob.ID
@@ -229,12 +349,81 @@ func (wr *Writer) findBlobByHash(size int64, md5, sha256 []byte) BlobID {
 	return 0
 }
 
+// setupBlobCounter lazily sets up the blob counter.
+func (wr *Writer) setupBlobCounter() {
+	if wr.bnext == 0 {
+		wr.bnext = 1 // blob ids are 1 based
+		blen := len(wr.item.Blobs)
+		if blen > 0 {
+			wr.bnext = wr.item.Blobs[blen-1].ID + 1
+		}
+	}
+}
+
+// A storedBlob is a blob together with the id of the item storing it.
+type storedBlob struct {
+	*Blob
+	item string
+}
+
+// findOtherBlob uses the store's BlobFinder to look for a blob in another
+// item having the given size and hashes. It returns nil if there is no
+// finder, if the size or SHA-256 hash is not known, or if no such blob is
+// stored. Errors from the finder are logged and otherwise treated as the
+// blob not being found, since the content can always be written again.
+func (wr *Writer) findOtherBlob(size int64, md5, sha256 []byte) *storedBlob {
+	// empty blobs cost nothing to store, so do not bother with them
+	if wr.store.finder == nil || size == 0 || len(sha256) == 0 {
+		return nil
+	}
+	id, bid, err := wr.store.finder.FindBlobByHash(size, sha256)
+	if err != nil {
+		slog.Error("finding duplicate blob", "item", wr.item.ID, "error", err)
+		return nil
+	}
+	if id == "" || id == wr.item.ID || id == wr.noref {
+		return nil
+	}
+	// the finder may be out of date, so make sure the blob is still there
+	blob, err := wr.store.BlobInfo(id, bid)
+	if err != nil {
+		slog.Error("finding duplicate blob", "item", wr.item.ID, "ref", id, "blob", bid, "error", err)
+		return nil
+	}
+	if blob.Bundle == 0 ||
+		blob.Size != size ||
+		!bytes.Equal(sha256, blob.SHA256) ||
+		(len(md5) > 0 && !bytes.Equal(md5, blob.MD5)) {
+		return nil
+	}
+	return &storedBlob{Blob: blob, item: id}
+}
+
+var (
+	emptyMD5    = md5.Sum(nil)
+	emptySHA256 = sha256.Sum256(nil)
+)
+
+// isEmptyHash returns true if the given hashes are those of a zero-length
+// stream. Hashes which are not provided are ignored, but at least one must
+// be given.
+func isEmptyHash(md5, sha256 []byte) bool {
+	if len(md5) == 0 && len(sha256) == 0 {
+		return false
+	}
+	return (len(md5) == 0 || bytes.Equal(md5, emptyMD5[:])) &&
+		(len(sha256) == 0 || bytes.Equal(sha256, emptySHA256[:]))
+}
+
 type byID []*Blob
 
 func (p byID) Len() int           { return len(p) }
 func (p byID) Less(i, j int) bool { return p[i].ID < p[j].ID }
 func (p byID) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 
+// VersionID returns the id of the version being written.
+func (wr *Writer) VersionID() VersionID { return wr.version.ID }
+
 // SetNote sets the note metadata field for this version.
 func (wr *Writer) SetNote(s string) { wr.version.Note = s }
 
@@ -243,7 +432,12 @@ func (wr *Writer) SetCreator(s string) { wr.version.Creator = s }
 
 // SetSlot adds a slot mapping for this version. To explicitly remove a slot,
 // set it  to 0. The slot mapping is initialized to that of the previous version.
+// Any metadata for the slot is removed if the slot is changed to a different
+// blob.
 func (wr *Writer) SetSlot(s string, id BlobID) {
+	if wr.version.Slots[s] != id {
+		delete(wr.version.SlotMeta, s)
+	}
 	if id == 0 {
 		delete(wr.version.Slots, s)
 	} else {
@@ -251,23 +445,78 @@ func (wr *Writer) SetSlot(s string, id BlobID) {
 	}
 }
 
+// SetSlotMeta sets a metadata key for the given slot in this version. Setting
+// a key to the empty string removes it. Metadata is copied from the previous
+// version for slots that are not changed.
+func (wr *Writer) SetSlotMeta(s string, key string, value string) {
+	if value == "" {
+		delete(wr.version.SlotMeta[s], key)
+		if len(wr.version.SlotMeta[s]) == 0 {
+			delete(wr.version.SlotMeta, s)
+		}
+		return
+	}
+	if wr.version.SlotMeta == nil {
+		wr.version.SlotMeta = make(map[string]map[string]string)
+	}
+	if wr.version.SlotMeta[s] == nil {
+		wr.version.SlotMeta[s] = make(map[string]string)
+	}
+	wr.version.SlotMeta[s][key] = value
+}
+
+// SetVersionMeta sets a metadata key for this version. Setting a key to the
+// empty string removes it.
+func (wr *Writer) SetVersionMeta(key string, value string) {
+	if value == "" {
+		delete(wr.version.Meta, key)
+		return
+	}
+	if wr.version.Meta == nil {
+		wr.version.Meta = make(map[string]string)
+	}
+	wr.version.Meta[key] = value
+}
+
 // ClearSlots will remove all the slot information for the current version.
 // Any slot entries made before calling this will be lost (but the blobs will
 // still be around!).
 func (wr *Writer) ClearSlots() {
 	wr.version.Slots = make(map[string]BlobID)
+	wr.version.SlotMeta = nil
 }
 
 // SetMimeType sets the mime type for the given blob. Nothing is changed if no
 // blob has the given id or if the blob has been deleted.
 func (wr *Writer) SetMimeType(id BlobID, mimetype string) {
 	blob := wr.item.blobByID(id)
-	if blob == nil || blob.Bundle == 0 {
+	if blob == nil || (blob.Bundle == 0 && blob.RefItem == "") {
 		return
 	}
 	blob.MimeType = mimetype
 }
 
+// SetBlobMeta sets a metadata key for the given blob. Setting a key to the
+// empty string removes it. Nothing is changed if no blob has the given id or
+// if the blob has been deleted.
+func (wr *Writer) SetBlobMeta(id BlobID, key string, value string) {
+	blob := wr.item.blobByID(id)
+	if blob == nil || (blob.Bundle == 0 && blob.RefItem == "") {
+		return
+	}
+	if value == "" {
+		delete(blob.Meta, key)
+		if len(blob.Meta) == 0 {
+			blob.Meta = nil
+		}
+		return
+	}
+	if blob.Meta == nil {
+		blob.Meta = make(map[string]string)
+	}
+	blob.Meta[key] = value
+}
+
 // DeleteBlob marks the given blob for removal from the underlying storage.
 // Blobs will be removed when Close() is called. Removal may take a while since
 // every other blob in the bundle the blob is stored in will be copied into a
@@ -280,3 +529,21 @@ func (wr *Writer) DeleteBlob(bid BlobID) {
 	// deal with deduplication of blob ids in Close()
 	wr.del = append(wr.del, bid)
 }
+
+// DeleteBlobReason is like DeleteBlob, but records why the blob was deleted
+// in its DeleteNote, in place of the version's note.
+func (wr *Writer) DeleteBlobReason(bid BlobID, reason string) {
+	wr.DeleteBlob(bid)
+	if wr.why == nil {
+		wr.why = make(map[BlobID]string)
+	}
+	wr.why[bid] = reason
+}
+
+// deleteNote returns the reason for deleting the blob bid.
+func (wr *Writer) deleteNote(bid BlobID) string {
+	if reason, ok := wr.why[bid]; ok {
+		return reason
+	}
+	return wr.version.Note
+}
@@ -4,8 +4,10 @@ import (
 	"archive/zip"
 	"crypto/md5"
 	"crypto/sha256"
+	"crypto/sha512"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"strconv"
 	"strings"
 	"testing"
@@ -68,6 +70,42 @@ func TestWriteBlob(t *testing.T) {
 	})
 }
 
+func TestWriteDigests(t *testing.T) {
+	ms := store.NewMemory()
+	s := New(ms)
+	w, err := s.Open("digests", "nobody")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	bid := writedata(t, w, "hello")
+	w.Close()
+
+	// read the item back from the store
+	s = New(ms)
+	item, err := s.Item("digests")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	sum := sha512.Sum512([]byte("hello"))
+	if h := item.Blobs[bid-1].Digests["sha512"]; string(h) != string(sum[:]) {
+		t.Errorf("Received sha512 %x, expected %x", h, sum)
+	}
+	_, problems, err := s.Validate("digests")
+	if err != nil || len(problems) != 0 {
+		t.Errorf("Validate() == %v, %v", problems, err)
+	}
+
+	// stop recording them
+	s.SetDigests(nil)
+	w, _ = s.Open("digests", "nobody")
+	bid = writedata(t, w, "goodbye")
+	w.Close()
+	item, _ = s.Item("digests")
+	if d := item.Blobs[bid-1].Digests; d != nil {
+		t.Errorf("Received digests %v, expected none", d)
+	}
+}
+
 func TestWriteDuplicate(t *testing.T) {
 	ms := store.NewMemory()
 	s := New(ms)
@@ -115,6 +153,300 @@ func TestWriteDuplicate(t *testing.T) {
 	}
 }
 
+// oneBlobFinder is a BlobFinder which knows about a single blob.
+type oneBlobFinder struct {
+	item   string
+	bid    BlobID
+	sha256 []byte
+}
+
+func (f oneBlobFinder) FindBlobByHash(size int64, sha256 []byte) (string, BlobID, error) {
+	if string(sha256) != string(f.sha256) {
+		return "", 0, nil
+	}
+	return f.item, f.bid, nil
+}
+
+func TestWriteDuplicateOtherItem(t *testing.T) {
+	ms := store.NewMemory()
+	s := New(ms)
+	w, err := s.Open("first", "nobody")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	bid := writedata(t, w, "license text")
+	w.SetSlot("LICENSE", bid)
+	w.Close()
+
+	hash := sha256.Sum256([]byte("license text"))
+	s.SetBlobFinder(oneBlobFinder{item: "first", bid: bid, sha256: hash[:]})
+	w, err = s.Open("second", "nobody")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	writedata(t, w, "something else")
+	bid2 := writedata(t, w, "license text")
+	w.SetSlot("LICENSE", bid2)
+	w.SetMimeType(bid2, "text/plain")
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("Got %s, expected nil", err.Error())
+	}
+
+	blob, err := s.BlobInfo("second", bid2)
+	if err != nil {
+		t.Fatalf("Got %s, expected nil", err.Error())
+	}
+	if blob.RefItem != "first" || blob.RefBlob != bid || blob.Bundle != 0 {
+		t.Errorf("Got reference (%q, %d) in bundle %d, expected (%q, %d)", blob.RefItem, blob.RefBlob, blob.Bundle, "first", bid)
+	}
+	if blob.MimeType != "text/plain" {
+		t.Errorf("Got mime type %q, expected text/plain", blob.MimeType)
+	}
+	// the content should only be stored in the first item
+	item, _ := s.Item("second")
+	for n := 1; n <= item.MaxBundle; n++ {
+		rc, err := OpenBundleStream(ms, s.layout.Key("second", n), fmt.Sprintf("blob/%d", bid2))
+		if err == nil {
+			rc.Close()
+			t.Errorf("Found blob %d in bundle %d", bid2, n)
+		}
+	}
+	r, size, err := s.Blob("second", bid2)
+	if err != nil {
+		t.Fatalf("Got %s, expected nil", err.Error())
+	}
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(data) != "license text" || size != int64(len(data)) {
+		t.Errorf("Got %q with size %d, expected %q", data, size, "license text")
+	}
+	_, problems, err := s.Validate("second")
+	if err != nil || len(problems) > 0 {
+		t.Errorf("Validate returned %v, %v", problems, err)
+	}
+
+	// deleting the reference leaves the first item alone
+	w, err = s.Open("second", "nobody")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	w.SetSlot("LICENSE", 0)
+	w.DeleteBlob(bid2)
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("Got %s, expected nil", err.Error())
+	}
+	_, _, err = s.Blob("second", bid2)
+	if err != ErrDeleted {
+		t.Errorf("Got %v, expected %v", err, ErrDeleted)
+	}
+	r, _, err = s.Blob("first", bid)
+	if err != nil {
+		t.Fatalf("Got %s, expected nil", err.Error())
+	}
+	r.Close()
+}
+
+// scanRefFinder is a RefFinder which reads each of a list of items. The
+// item asked about is skipped, since it may be open for writing.
+type scanRefFinder struct {
+	s   *Store
+	ids []string
+}
+
+func (f scanRefFinder) FindReferences(id string) ([]Reference, error) {
+	var result []Reference
+	for _, other := range f.ids {
+		if other == id {
+			continue
+		}
+		item, err := f.s.Item(other)
+		if err == ErrNoItem {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, blob := range item.Blobs {
+			if blob.RefItem == id {
+				result = append(result, Reference{Item: other, Blob: blob.ID, RefBlob: blob.RefBlob})
+			}
+		}
+	}
+	return result, nil
+}
+
+func TestReferencedBlob(t *testing.T) {
+	s := New(store.NewMemory())
+	w, err := s.Open("first", "nobody")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	bid := writedata(t, w, "license text")
+	other := writedata(t, w, "something else")
+	w.Close()
+
+	hash := sha256.Sum256([]byte("license text"))
+	s.SetBlobFinder(oneBlobFinder{item: "first", bid: bid, sha256: hash[:]})
+	s.SetRefFinder(scanRefFinder{s: s, ids: []string{"first", "second"}})
+	w, err = s.Open("second", "nobody")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	bid2 := writedata(t, w, "license text")
+	w.Close()
+	readback := func() {
+		t.Helper()
+		r, _, err := s.Blob("second", bid2)
+		if err != nil {
+			t.Fatalf("Got %s, expected nil", err.Error())
+		}
+		data, _ := ioutil.ReadAll(r)
+		r.Close()
+		if string(data) != "license text" {
+			t.Errorf("Got %q, expected %q", data, "license text")
+		}
+	}
+	readback()
+
+	// purging the referenced blob is refused, but the other is purged
+	w, err = s.Open("first", "nobody")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	w.DeleteBlob(bid)
+	w.DeleteBlob(other)
+	err = w.Close()
+	var rerr *ReferenceError
+	if !errors.As(err, &rerr) || !errors.Is(err, ErrReferenced) ||
+		strings.Join(rerr.Items(), " ") != "second" {
+		t.Fatalf("Got %v, expected a reference from second", err)
+	}
+	if _, _, err = s.Blob("first", other); err != ErrDeleted {
+		t.Errorf("Got %v, expected %v", err, ErrDeleted)
+	}
+	readback()
+
+	// so are deleting and renaming the item
+	if err = s.Delete("first"); !errors.Is(err, ErrReferenced) {
+		t.Errorf("Delete got %v, expected %v", err, ErrReferenced)
+	}
+	if _, err = s.Rename("first", "third"); !errors.Is(err, ErrReferenced) {
+		t.Errorf("Rename got %v, expected %v", err, ErrReferenced)
+	}
+	readback()
+
+	// once the reference is deleted the item can be deleted
+	w, err = s.Open("second", "nobody")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	w.DeleteBlob(bid2)
+	w.Close()
+	if err = s.Delete("first"); err != nil {
+		t.Errorf("Delete got %v, expected nil", err)
+	}
+}
+
+func TestDeleteBlobReason(t *testing.T) {
+	ms := store.NewMemory()
+	s := New(ms)
+	w, err := s.Open("purge", "nobody")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	bid1 := writedata(t, w, "first")
+	bid2 := writedata(t, w, "second")
+	w.Close()
+
+	w, err = s.Open("purge", "auditor")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	w.SetNote("cleanup")
+	w.DeleteBlob(bid1)
+	w.DeleteBlobReason(bid2, "withdrawn by donor")
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("Got %s, expected nil", err.Error())
+	}
+	item, err := s.Item("purge")
+	if err != nil {
+		t.Fatalf("Got %s, expected nil", err.Error())
+	}
+	for _, tc := range []struct {
+		bid  BlobID
+		note string
+	}{
+		{bid1, "cleanup"},
+		{bid2, "withdrawn by donor"},
+	} {
+		blob := item.blobByID(tc.bid)
+		if blob.DeleteDate.IsZero() || blob.Deleter != "auditor" || blob.DeleteNote != tc.note {
+			t.Errorf("Blob %d has tombstone %v, %q, %q, expected note %q",
+				tc.bid, blob.DeleteDate, blob.Deleter, blob.DeleteNote, tc.note)
+		}
+	}
+}
+
+func TestWriteEmpty(t *testing.T) {
+	ms := store.NewMemory()
+	s := New(ms)
+	w, err := s.Open("empty", "nobody")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	bid := writedata(t, w, "")
+	w.SetSlot("empty", bid)
+
+	// zero length blobs should be deduplicated like any other blob
+	bid2 := writedata(t, w, "")
+	if bid != bid2 {
+		t.Errorf("Received %d and expected %d for the blob id", bid2, bid)
+	}
+	// but not if we don't know the hashes
+	bid2, err = w.WriteBlob(strings.NewReader(""), 0, nil, nil)
+	if err != nil {
+		t.Fatalf("Got %s, expected nil", err.Error())
+	}
+	if bid == bid2 {
+		t.Errorf("Received %d and expected something different", bid2)
+	}
+	// a size of 0 means unknown when the hashes are not of empty content
+	bid2 = writedata(t, w, "hello")
+	hash := md5.Sum([]byte("hello"))
+	bid3, err := w.WriteBlob(strings.NewReader("hello"), 0, hash[:], nil)
+	if err != nil {
+		t.Fatalf("Got %s, expected nil", err.Error())
+	}
+	if bid3 == bid2 {
+		t.Errorf("Received %d and expected something different", bid3)
+	}
+	w.Close()
+
+	// make sure the empty blob can be read back
+	r, size, err := s.Blob("empty", bid)
+	if err != nil {
+		t.Fatalf("Got %s, expected nil", err.Error())
+	}
+	content, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || size != 0 || len(content) != 0 {
+		t.Errorf("Received %d, %q, %v, expected empty blob", size, content, err)
+	}
+
+	// deleted blobs should not be reused
+	w, _ = s.Open("empty", "nobody")
+	w.DeleteBlob(bid)
+	w.Close()
+	w, _ = s.Open("empty", "nobody")
+	bid2 = writedata(t, w, "")
+	if bid == bid2 {
+		t.Errorf("Received deleted blob id %d", bid2)
+	}
+	w.Close()
+}
+
 func TestOpenCorrupt(t *testing.T) {
 	ms := store.NewMemory()
 	s := New(ms)
@@ -282,3 +614,55 @@ func checkslots(t *testing.T, s *Store, id string, table []slotTriple) {
 		}
 	}
 }
+
+func TestSlotMeta(t *testing.T) {
+	ms := store.NewMemory()
+	s := New(ms)
+	w, err := s.Open("meta", "nobody")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	bid := writedata(t, w, "hello")
+	bid2 := writedata(t, w, "goodbye")
+	w.SetSlot("a", bid)
+	w.SetSlot("b", bid)
+	w.SetSlotMeta("a", "mtime", "2016-11-17T10:00:00Z")
+	w.SetSlotMeta("b", "mtime", "2016-11-18T10:00:00Z")
+	w.SetVersionMeta("batch", "7")
+	w.SetBlobMeta(bid, "rights", "CC-BY")
+	w.SetBlobMeta(bid, "path", "/scans/hello.txt")
+	w.Close()
+
+	// metadata is carried over for unchanged slots, and removed for
+	// changed ones
+	w, _ = s.Open("meta", "nobody")
+	w.SetSlot("b", bid2)
+	w.SetBlobMeta(bid, "path", "")
+	w.SetBlobMeta(bid2, "rights", "in copyright")
+	w.Close()
+
+	// make sure it survives a round trip through storage
+	s = New(ms)
+	item, err := s.Item("meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := item.Versions[1]
+	if v.SlotMeta["a"]["mtime"] != "2016-11-17T10:00:00Z" {
+		t.Error("Received", v.SlotMeta, "expected mtime for a")
+	}
+	if _, ok := v.SlotMeta["b"]; ok {
+		t.Error("Received", v.SlotMeta, "expected no metadata for b")
+	}
+	// version metadata is not carried over
+	if item.Versions[0].Meta["batch"] != "7" || len(v.Meta) != 0 {
+		t.Error("Received", item.Versions[0].Meta, v.Meta)
+	}
+	// blob metadata belongs to the blob
+	if m := item.blobByID(bid).Meta; len(m) != 1 || m["rights"] != "CC-BY" {
+		t.Error("Received", m, "for blob", bid)
+	}
+	if m := item.blobByID(bid2).Meta; len(m) != 1 || m["rights"] != "in copyright" {
+		t.Error("Received", m, "for blob", bid2)
+	}
+}
@@ -1,8 +1,13 @@
 package items
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"hash"
 	"io"
+	"sort"
 	"strings"
 
 	"github.com/ndlib/bendo/bagit"
@@ -16,6 +21,7 @@ import (
 type BagreaderCloser struct {
 	f             io.Closer // the underlying file
 	*bagit.Reader           // the zip reader
+	key           string    // the key of the bundle in its store
 }
 
 // Close flushes the reader and closes the underlying io.Closer.
@@ -24,7 +30,7 @@ func (bg *BagreaderCloser) Close() error {
 }
 
 // OpenBundle opens the provided key in the given store, and wraps it in a
-// bagit reader.
+// bagit reader. The bundle may be in either the zip or the tar format.
 func OpenBundle(s store.Store, key string) (*BagreaderCloser, error) {
 	stream, size, err := s.Open(key)
 	if err != nil {
@@ -36,6 +42,7 @@ func OpenBundle(s store.Store, key string) (*BagreaderCloser, error) {
 		result = &BagreaderCloser{
 			Reader: r,
 			f:      stream,
+			key:    key,
 		}
 	} else {
 		stream.Close()
@@ -66,6 +73,12 @@ func OpenBundleStream(s store.Store, key, sname string) (io.ReadCloser, error) {
 	if err != nil {
 		return nil, err
 	}
+	return openStream(r, sname)
+}
+
+// openStream returns the contents of the stream sname inside the open
+// bundle r. Closing the result closes r.
+func openStream(r *BagreaderCloser, sname string) (io.ReadCloser, error) {
 	var result *parentReadCloser
 	rc, err := r.Open(sname)
 	if err == nil {
@@ -83,24 +96,101 @@ func OpenBundleStream(s store.Store, key, sname string) (io.ReadCloser, error) {
 }
 
 // A Zipwriter wraps the zip.Writer object to track the underlying file stream
-// holding the zip file's complete contents.
+// holding the zip file's complete contents. Despite the name, it also writes
+// bundles in the tar format.
 // Some utility methods are added to make our life easier.
 type Zipwriter struct {
 	f             io.WriteCloser // the underlying bundle file, nil if no file is currently open
 	*bagit.Writer                // the zip interface over the bundle file
+
+	s      store.Store   // where to save the checksum and contents sidecars
+	id     string        // the item the bundle belongs to
+	key    string        // the key of the bundle file
+	sum    hash.Hash     // SHA256 of everything written to f
+	size   int64         // amount written to f
+	parity *parityWriter // nil if no parity file is written
 }
 
+// SidecarExt is the extension added to a bundle's key to give the key of its
+// checksum sidecar file. The sidecar has the SHA256 of the whole bundle file
+// followed by the SHA256 of each file inside it, in the format used by
+// sha256sum, so the bundles can be checked without reading the zip files.
+// e.g.
+//
+//	4c2a...  12345-0001.zip
+//	9f86...  bag-info.txt
+//	2cf2...  data/blob/1
+const SidecarExt = ".sha256"
+
 // OpenZipWriter creates a new bundle in the given store using the given id and
 // bundle number. It returns a zip writer which is then saved into the store.
 func OpenZipWriter(s store.Store, id string, n int) (*Zipwriter, error) {
-	f, err := s.Create(sugar(id, n))
+	return openZipWriter(s, id, sugar(id, n), ZipFormat)
+}
+
+// openZipWriter creates a new bundle for the given item in the store under
+// the given key, in the given format.
+func openZipWriter(s store.Store, id string, key string, format BundleFormat) (*Zipwriter, error) {
+	f, err := s.Create(key)
 	if err != nil {
 		return nil, err
 	}
-	return &Zipwriter{
-		f:      f,
-		Writer: bagit.NewWriter(f, strings.TrimSuffix(id, ".zip")),
-	}, nil
+	zw := &Zipwriter{
+		f:   f,
+		s:   s,
+		id:  id,
+		key: key,
+		sum: sha256.New(),
+	}
+	if format == TarFormat {
+		zw.Writer = bagit.NewTarWriter(zipOutput{zw}, id)
+	} else {
+		zw.Writer = bagit.NewWriter(zipOutput{zw}, strings.TrimSuffix(id, ".zip"))
+	}
+	return zw, nil
+}
+
+// zipOutput passes everything written to the bundle on to the file, the
+// checksum, and the parity, if any.
+type zipOutput struct {
+	zw *Zipwriter
+}
+
+func (z zipOutput) Write(p []byte) (int, error) {
+	n, err := z.zw.f.Write(p)
+	z.zw.sum.Write(p[:n])
+	z.zw.size += int64(n)
+	if err == nil && z.zw.parity != nil {
+		_, err = z.zw.parity.Write(p)
+	}
+	return n, err
+}
+
+// SetParity makes a parity file using the given scheme be written
+// alongside the bundle. It must be called before anything is written to
+// the bundle.
+func (zw *Zipwriter) SetParity(p ParityScheme) error {
+	if zw.size > 0 {
+		return errors.New("parity must be set before the bundle is written")
+	}
+	if zw.parity != nil {
+		zw.parity.w.Close()
+		zw.s.Delete(zw.key + ParityExt)
+		zw.parity = nil
+	}
+	if p.IsZero() {
+		return nil
+	}
+	w, err := zw.s.Create(zw.key + ParityExt)
+	if err != nil {
+		return err
+	}
+	zw.parity, err = newParityWriter(w, p)
+	if err != nil {
+		w.Close()
+		zw.s.Delete(zw.key + ParityExt)
+	}
+	return err
 }
 
 // Close writes out the zip directory information and then closes the underlying
@@ -110,9 +200,65 @@ func (zw *Zipwriter) Close() error {
 	if err == nil {
 		err = zw.f.Close()
 	}
+	if err == nil && zw.parity != nil {
+		err = zw.parity.Close()
+	}
+	if err == nil {
+		err = zw.writeSidecar()
+	}
+	if err == nil {
+		err = zw.writeContents()
+	}
 	return err
 }
 
+// bundleExts are the extensions of the files kept alongside a bundle.
+var bundleExts = []string{SidecarExt, ParityExt, ContentsExt}
+
+// trimBundleExt removes the sidecar, parity, or contents extension from a
+// key, giving the key of the bundle the file belongs to.
+func trimBundleExt(key string) string {
+	for _, ext := range bundleExts {
+		if strings.HasSuffix(key, ext) {
+			return strings.TrimSuffix(key, ext)
+		}
+	}
+	return key
+}
+
+// deleteSidecars removes the files kept alongside the bundle having the
+// given key. Bundles written before each kind was added do not have it, and
+// not every bundle has parity, so errors are ignored.
+func deleteSidecars(s store.Store, key string) {
+	for _, ext := range bundleExts {
+		s.Delete(key + ext)
+	}
+}
+
+// writeSidecar saves the checksum sidecar for this bundle. It should only be
+// called after the bundle has been closed.
+func (zw *Zipwriter) writeSidecar() error {
+	w, err := zw.s.Create(zw.key + SidecarExt)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s  %s\n", hex.EncodeToString(zw.sum.Sum(nil)), zw.key)
+	manifest := zw.Manifest()
+	var names []string
+	for name := range manifest {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		h := manifest[name].SHA256
+		if len(h) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "%s  %s\n", hex.EncodeToString(h), name)
+	}
+	return w.Close()
+}
+
 // MakeStream returns a writer which saves a file with the given name
 // inside this zip file. The writer does not need to be closed when finished.
 // Only one stream can be active at a time, and call MakeStream again to start
@@ -120,3 +266,32 @@ func (zw *Zipwriter) Close() error {
 func (zw *Zipwriter) MakeStream(name string) (io.Writer, error) {
 	return zw.Create(name)
 }
+
+// MakeSizedStream is like MakeStream, but is given the size of the stream,
+// or -1 if it is not known. Tar bundles need the size to write the stream
+// without holding it in a temporary file.
+func (zw *Zipwriter) MakeSizedStream(name string, size int64) (io.Writer, error) {
+	return zw.CreateSize(name, size)
+}
+
+// namedDigests returns the checksums in c other than MD5 and SHA256, keyed
+// by algorithm name, or nil if there are none.
+func namedDigests(c *bagit.Checksum) map[string][]byte {
+	if c == nil {
+		return nil
+	}
+	result := make(map[string][]byte)
+	if len(c.SHA1) > 0 {
+		result["sha1"] = c.SHA1
+	}
+	if len(c.SHA512) > 0 {
+		result["sha512"] = c.SHA512
+	}
+	for name, h := range c.Digests {
+		result[name] = h
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
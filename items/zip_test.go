@@ -0,0 +1,313 @@
+package items
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ndlib/bendo/store"
+)
+
+// The Zip64 tests write bundles larger than 4 GB, which is where the zip
+// format runs out of 32 bit sizes and offsets. The content is a single
+// repeated byte, and it is kept in an rleStore so the bundles take almost
+// no memory.
+
+const over4GB = 1<<32 + 1000
+
+func TestZip64Blob(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping 4 GB zip test in short mode")
+	}
+	ms := newRLEStore()
+	s := New(ms)
+	w, err := s.Open("big", "nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	small := writedata(t, w, "a small file before the large one")
+	bid, err := w.WriteBlob(&repeatReader{b: 'x', n: over4GB}, over4GB, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetSlot("small", small)
+	w.SetSlot("large", bid)
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the bundle, and the tag files and manifests placed after the large
+	// blob, must all be readable
+	size := ms.size(sugar("big", 1))
+	if size <= over4GB {
+		t.Errorf("Bundle has size %d, expected more than %d", size, over4GB)
+	}
+	bundle, err := OpenBundle(ms, sugar("big", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := bundle.Checksum("blob/2")
+	if c == nil || len(c.SHA256) == 0 {
+		t.Errorf("Received checksum %v for the large blob", c)
+	}
+	bundle.Close()
+
+	// reload the item from the store and read back both blobs
+	s = New(ms)
+	item, err := s.Item("big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := item.blobByID(bid)
+	if b == nil || b.Size != over4GB {
+		t.Fatalf("Received blob %v, expected size %d", b, over4GB)
+	}
+	checkRead(t, s, "big", small, []byte("a small file before the large one"))
+	r, _, err := s.Blob("big", bid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(&repeatChecker{b: 'x'}, r)
+	r.Close()
+	if err != nil {
+		t.Error(err)
+	}
+	if n != over4GB {
+		t.Errorf("Read %d bytes, expected %d", n, over4GB)
+	}
+}
+
+func TestZip64ManyBlobs(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping 4 GB zip test in short mode")
+	}
+	// a bundle over 4 GB made of blobs each under 4 GB, so only the
+	// offsets of the later files need Zip64
+	ms := newRLEStore()
+	zw, err := OpenZipWriter(ms, "many", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const blobSize = 1 << 30
+	for i := 0; i < 5; i++ {
+		out, err := zw.MakeStream(strings.Repeat("b", i+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.Copy(out, &repeatReader{b: byte('a' + i), n: blobSize})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	zw.MakeStream("last")
+	zw.Close()
+
+	rc, err := OpenBundleStream(ms, sugar("many", 1), "last")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+	rc, err = OpenBundleStream(ms, sugar("many", 1), "bbbbb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(&repeatChecker{b: 'e'}, rc)
+	rc.Close()
+	if err != nil || n != blobSize {
+		t.Errorf("Read %d bytes, %v, expected %d", n, err, blobSize)
+	}
+}
+
+func checkRead(t *testing.T, s *Store, id string, bid BlobID, expected []byte) {
+	t.Helper()
+	r, _, err := s.Blob(id, bid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Errorf("Read %q, expected %q", got, expected)
+	}
+}
+
+// repeatReader returns the byte b n times.
+type repeatReader struct {
+	b byte
+	n int64
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+	for i := range p {
+		p[i] = r.b
+	}
+	r.n -= int64(len(p))
+	return len(p), nil
+}
+
+// repeatChecker is a writer which fails if given anything other than the
+// byte b.
+type repeatChecker struct {
+	b byte
+}
+
+func (w *repeatChecker) Write(p []byte) (int, error) {
+	for i := range p {
+		if p[i] != w.b {
+			return i, errors.New("unexpected byte")
+		}
+	}
+	return len(p), nil
+}
+
+// rleStore is a store.Store which keeps each file run length encoded in
+// memory, so files of many gigabytes made mostly of repeated bytes are
+// cheap.
+type rleStore struct {
+	m     sync.Mutex
+	files map[string]*rleBuffer
+}
+
+func newRLEStore() *rleStore {
+	return &rleStore{files: make(map[string]*rleBuffer)}
+}
+
+func (s *rleStore) size(key string) int64 {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if f := s.files[key]; f != nil {
+		return f.size()
+	}
+	return 0
+}
+
+func (s *rleStore) List() <-chan string {
+	out := make(chan string)
+	keys, _ := s.ListPrefix("")
+	go func() {
+		for _, k := range keys {
+			out <- k
+		}
+		close(out)
+	}()
+	return out
+}
+
+func (s *rleStore) ListPrefix(prefix string) ([]string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var result []string
+	for k := range s.files {
+		if strings.HasPrefix(k, prefix) {
+			result = append(result, k)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func (s *rleStore) Open(key string) (store.ReadAtCloser, int64, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	f := s.files[key]
+	if f == nil {
+		return nil, 0, store.ErrNotExist
+	}
+	return f, f.size(), nil
+}
+
+func (s *rleStore) Create(key string) (io.WriteCloser, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.files[key] != nil {
+		return nil, store.ErrKeyExists
+	}
+	f := new(rleBuffer)
+	s.files[key] = f
+	return f, nil
+}
+
+func (s *rleStore) Delete(key string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	delete(s.files, key)
+	return nil
+}
+
+// rleBuffer is a run length encoded file. Each run is a byte repeated some
+// number of times, starting at the offset given in off.
+type rleBuffer struct {
+	runs []rleRun
+}
+
+type rleRun struct {
+	off int64
+	n   int64
+	b   byte
+}
+
+func (r *rleBuffer) size() int64 {
+	if len(r.runs) == 0 {
+		return 0
+	}
+	last := r.runs[len(r.runs)-1]
+	return last.off + last.n
+}
+
+func (r *rleBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		c := p[0]
+		k := 1
+		for k < len(p) && p[k] == c {
+			k++
+		}
+		if len(r.runs) > 0 && r.runs[len(r.runs)-1].b == c {
+			r.runs[len(r.runs)-1].n += int64(k)
+		} else {
+			r.runs = append(r.runs, rleRun{off: r.size(), n: int64(k), b: c})
+		}
+		p = p[k:]
+	}
+	return n, nil
+}
+
+func (r *rleBuffer) ReadAt(p []byte, off int64) (int, error) {
+	var n int
+	// find the run containing off
+	i := sort.Search(len(r.runs), func(i int) bool {
+		return r.runs[i].off+r.runs[i].n > off
+	})
+	for ; i < len(r.runs) && n < len(p); i++ {
+		run := r.runs[i]
+		q := p[n:]
+		if k := run.off + run.n - off; int64(len(q)) > k {
+			q = q[:k]
+		}
+		for j := range q {
+			q[j] = run.b
+		}
+		n += len(q)
+		off += int64(len(q))
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *rleBuffer) Close() error { return nil }
@@ -0,0 +1,183 @@
+/*
+Package bendo lets other Go programs keep content in a Bendo preservation
+store directly, without going through the REST server.
+
+A Repository joins an items.Store, which reads and writes items as bundles
+in a store.Store, with a blob cache, so content read once need not be
+recalled from tape again. A minimal program looks like
+
+	repo := bendo.New(store.NewFileSystem("/path/to/bundles"), nil)
+	u, err := repo.Open("item1", "me")
+	if err != nil {
+		return err
+	}
+	u.Put("path/to/file", f)
+	err = u.Commit()
+	...
+	r, blob, err := repo.Get("item1", "path/to/file")
+
+The REST server in package server is one consumer of this API. It adds a
+database index of the blobs, shares tape recalls between requests, and
+copies blobs into the cache in the background, none of which a Repository
+does by itself.
+*/
+package bendo
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/ndlib/bendo/blobcache"
+	"github.com/ndlib/bendo/cache"
+	"github.com/ndlib/bendo/items"
+	"github.com/ndlib/bendo/store"
+)
+
+// A Repository is a set of items kept in a store, with an optional cache
+// of blob content. It is safe to use from more than one goroutine, but each
+// item should only be open for writing by one Update at a time.
+type Repository struct {
+	Items *items.Store
+	Cache cache.Cache
+}
+
+// New returns a Repository keeping its items in s. If c is nil, blob
+// content is not cached.
+func New(s store.Store, c cache.Cache) *Repository {
+	if c == nil {
+		c = blobcache.EmptyCache{}
+	}
+	return &Repository{
+		Items: items.New(s),
+		Cache: c,
+	}
+}
+
+// CacheKey returns the key the given blob is kept under in a blob cache.
+func CacheKey(id string, bid items.BlobID) string {
+	return fmt.Sprintf("%s+%04d", id, bid)
+}
+
+// Item returns the metadata for the given item. It returns items.ErrNoItem
+// if there is no such item.
+func (r *Repository) Item(id string) (*items.Item, error) {
+	return r.Items.Item(id)
+}
+
+// Get returns the content and the metadata of the blob the given slot of an
+// item refers to. The slot may be a slot name in the most recent version, a
+// slot name prefixed by "@N/" to use version N, or "@blob/N" for blob N. If
+// the slot does not refer to a blob, an items.NoBlobError is returned. The
+// caller must close the returned reader.
+func (r *Repository) Get(id string, slot string) (io.ReadCloser, *items.Blob, error) {
+	item, err := r.Items.Item(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	var bid items.BlobID
+	if len(item.Versions) > 0 {
+		bid = item.BlobByExtendedSlot(slot)
+	}
+	if bid == 0 {
+		return nil, nil, items.NoBlobError{ID: id}
+	}
+	blob, err := r.Items.BlobInfo(id, bid)
+	if err != nil {
+		return nil, nil, err
+	}
+	rc, _, err := r.Blob(id, bid)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rc, blob, nil
+}
+
+// Blob returns the content of the given blob and its length. The cache is
+// used if it has a copy. Otherwise the blob is read from the store, and the
+// cache is left alone. The caller must close the returned reader.
+func (r *Repository) Blob(id string, bid items.BlobID) (io.ReadCloser, int64, error) {
+	content, length, err := r.Cache.Get(CacheKey(id, bid))
+	if err == nil && content != nil {
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.NewSectionReader(content, 0, length), content}, length, nil
+	}
+	return r.Items.Blob(id, bid)
+}
+
+// Walk calls fn with the id of every item in the repository, in no
+// particular order. If fn returns an error, the walk stops and the error is
+// returned.
+func (r *Repository) Walk(fn func(id string) error) error {
+	c := r.Items.List()
+	for id := range c {
+		err := fn(id)
+		if err != nil {
+			// drain the channel so the listing goroutine can exit
+			for range c {
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Open starts a new version of the given item, creating the item if it does
+// not exist. The version is saved when Commit is called.
+func (r *Repository) Open(id string, creator string) (*Update, error) {
+	w, err := r.Items.Open(id, creator)
+	if err != nil {
+		return nil, err
+	}
+	return &Update{repo: r, id: id, w: w}, nil
+}
+
+// An Update adds a new version to an item. The new version starts with
+// the slots of the previous one.
+type Update struct {
+	repo    *Repository
+	id      string
+	w       *items.Writer
+	deleted []items.BlobID
+}
+
+// Put saves the content of rd as a blob and points the given slot at it.
+// If the item already has a blob with the same content, it is used instead
+// of saving another copy.
+func (u *Update) Put(slot string, rd io.Reader) (items.BlobID, error) {
+	bid, err := u.w.WriteBlob(rd, 0, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	u.w.SetSlot(slot, bid)
+	return bid, nil
+}
+
+// Remove removes the given slot from the new version. The blob it pointed
+// to is kept.
+func (u *Update) Remove(slot string) {
+	u.w.SetSlot(slot, 0)
+}
+
+// Delete removes the content of the given blob from the store when the
+// update is committed. Slots pointing to it are not changed.
+func (u *Update) Delete(bid items.BlobID) {
+	u.w.DeleteBlob(bid)
+	u.deleted = append(u.deleted, bid)
+}
+
+// SetNote sets the note saved with the new version.
+func (u *Update) SetNote(note string) {
+	u.w.SetNote(note)
+}
+
+// Commit saves the new version. Deleted blobs are also removed from the
+// cache. The Update may not be used afterwards.
+func (u *Update) Commit() error {
+	err := u.w.Close()
+	for _, bid := range u.deleted {
+		u.repo.Cache.Delete(CacheKey(u.id, bid))
+	}
+	return err
+}
@@ -0,0 +1,136 @@
+package bendo
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/ndlib/bendo/blobcache"
+	"github.com/ndlib/bendo/items"
+	"github.com/ndlib/bendo/store"
+)
+
+func readAll(t *testing.T, r io.ReadCloser) string {
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestRepository(t *testing.T) {
+	c := blobcache.NewLRU(store.NewMemory(), 1000)
+	repo := New(store.NewMemory(), c)
+
+	u, err := repo.Open("abc", "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.SetNote("first")
+	b1, err := u.Put("a/file", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = u.Put("b/file", strings.NewReader("goodbye"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = u.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, blob, err := repo.Get("abc", "a/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, r); got != "hello" || blob.ID != b1 || blob.Size != 5 {
+		t.Errorf("Received %q, %#v", got, blob)
+	}
+	_, _, err = repo.Get("abc", "c/file")
+	if !errors.As(err, &items.NoBlobError{}) {
+		t.Errorf("Received %v, expected NoBlobError", err)
+	}
+	_, _, err = repo.Get("xyz", "a/file")
+	if err != items.ErrNoItem {
+		t.Errorf("Received %v, expected ErrNoItem", err)
+	}
+
+	// content in the cache is used in place of the store
+	w, _ := c.Put(CacheKey("abc", b1))
+	w.Write([]byte("cached"))
+	w.Close()
+	r, _, err = repo.Get("abc", "@blob/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, r); got != "cached" {
+		t.Errorf("Received %q, expected cached copy", got)
+	}
+
+	// a second version, which deletes the first blob
+	u, err = repo.Open("abc", "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Remove("a/file")
+	u.Delete(b1)
+	err = u.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Contains(CacheKey("abc", b1)) {
+		t.Errorf("Deleted blob is still cached")
+	}
+	_, _, err = repo.Get("abc", "a/file")
+	if !errors.As(err, &items.NoBlobError{}) {
+		t.Errorf("Received %v, expected NoBlobError", err)
+	}
+	r, _, err = repo.Get("abc", "@1/b/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, r); got != "goodbye" {
+		t.Errorf("Received %q", got)
+	}
+	item, err := repo.Item("abc")
+	if err != nil || len(item.Versions) != 2 || item.Versions[0].Note != "first" {
+		t.Errorf("Received %#v, %v", item, err)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	repo := New(store.NewMemory(), nil)
+	for _, id := range []string{"one", "two", "three"} {
+		u, err := repo.Open(id, "tester")
+		if err != nil {
+			t.Fatal(err)
+		}
+		u.Put("file", strings.NewReader(id))
+		if err = u.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var ids []string
+	err := repo.Walk(func(id string) error {
+		ids = append(ids, id)
+		return nil
+	})
+	sort.Strings(ids)
+	if err != nil || strings.Join(ids, " ") != "one three two" {
+		t.Errorf("Received %v, %v", ids, err)
+	}
+
+	stop := errors.New("stop")
+	n := 0
+	err = repo.Walk(func(id string) error {
+		n++
+		return stop
+	})
+	if err != stop || n != 1 {
+		t.Errorf("Received %v after %d items", err, n)
+	}
+}
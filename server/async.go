@@ -0,0 +1,309 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+
+	"github.com/ndlib/bendo/items"
+	"github.com/ndlib/bendo/transaction"
+)
+
+// An AsyncResponse is the body of the 202 response to a GET request which
+// asked for an asynchronous response, with the header
+// "Prefer: respond-async", when the blob is not in the cache.
+type AsyncResponse struct {
+	Location      string // the path to poll for the blob
+	Estimate      int    // the seconds until the blob is expected to be cached
+	QueuePosition int    `json:",omitempty"` // see setRecallHeaders
+}
+
+// A StagedNotification is the JSON body POSTed to the X-Webhook URL given
+// with an asynchronous request once the blob has been copied into the cache,
+// or the copy failed.
+type StagedNotification struct {
+	ItemID string
+	BlobID int
+	Status string // either "cached" or "error"
+	Error  string `json:",omitempty"`
+}
+
+// asyncStaging tracks the blobs being copied into the cache for asynchronous
+// requests, and the callback URLs to tell once each is done.
+type asyncStaging struct {
+	m         sync.Mutex
+	callbacks map[string][]string // indexed by cache key
+}
+
+// add records a callback, which may be "", for the blob having the given
+// cache key. It returns true if the blob was not already being staged.
+func (a *asyncStaging) add(key, callback string) bool {
+	a.m.Lock()
+	defer a.m.Unlock()
+	if a.callbacks == nil {
+		a.callbacks = make(map[string][]string)
+	}
+	list, staging := a.callbacks[key]
+	if callback != "" {
+		list = append(list, callback)
+	}
+	a.callbacks[key] = list
+	return !staging
+}
+
+// staging returns true if the blob having the given cache key is being
+// staged.
+func (a *asyncStaging) staging(key string) bool {
+	a.m.Lock()
+	defer a.m.Unlock()
+	_, ok := a.callbacks[key]
+	return ok
+}
+
+// finish removes the blob having the given cache key and returns its
+// callbacks.
+func (a *asyncStaging) finish(key string) []string {
+	a.m.Lock()
+	defer a.m.Unlock()
+	list := a.callbacks[key]
+	delete(a.callbacks, key)
+	return list
+}
+
+// preferAsync returns true if the request has a Prefer header asking for
+// an asynchronous response, as in RFC 7240.
+func preferAsync(r *http.Request) bool {
+	_, ok := preference(r, "respond-async")
+	return ok
+}
+
+// preference returns the value of the given preference in the Prefer
+// headers of the request, as in RFC 7240, and whether it was present at
+// all. Any parameters of the preference are ignored.
+func preference(r *http.Request, name string) (string, bool) {
+	for _, line := range r.Header.Values("Prefer") {
+		for _, pref := range strings.Split(line, ",") {
+			token, _, _ := strings.Cut(pref, ";")
+			key, value, _ := strings.Cut(token, "=")
+			if strings.EqualFold(strings.TrimSpace(key), name) {
+				return strings.Trim(strings.TrimSpace(value), `"`), true
+			}
+		}
+	}
+	return "", false
+}
+
+// DefaultCacheWait is how long a request waits for a blob to be copied into
+// the cache if CacheWait is not set.
+const DefaultCacheWait = 60 * time.Second
+
+// cacheWait returns how long the request should wait for a blob to be copied
+// into the cache. It is CacheWait, unless the request has the header
+// "Prefer: wait=<seconds>", in which case it is that long, but at least a
+// second and no more than MaxCacheWait.
+func (s *RESTServer) cacheWait(r *http.Request) time.Duration {
+	wait := s.CacheWait
+	if wait <= 0 {
+		wait = DefaultCacheWait
+	}
+	v, ok := preference(r, "wait")
+	if !ok {
+		return wait
+	}
+	seconds, err := strconv.Atoi(v)
+	if err != nil {
+		return wait
+	}
+	max := s.MaxCacheWait
+	if max < wait {
+		max = wait
+	}
+	d := time.Duration(seconds) * time.Second
+	if d < time.Second {
+		d = time.Second
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// respondAsync sends a 202 response to a request for a blob which is being
+// copied into the cache, telling the client where to poll for it and about
+// when it will be ready. The done channel is closed once the copy finishes.
+// If the request has an X-Webhook header, that URL is POSTed a
+// StagedNotification at that time. Release, if not nil, is called once the
+// copy finishes, so the recall counts against the user until then.
+func (s *RESTServer) respondAsync(w http.ResponseWriter, r *http.Request, key, id string, binfo *items.Blob, done <-chan singleflight.Result, release func()) {
+	callback := r.Header.Get("X-Webhook")
+	if callback != "" && !transaction.ValidCallbackURL(callback) {
+		if release != nil {
+			release()
+		}
+		w.WriteHeader(400)
+		fmt.Fprintln(w, "X-Webhook must be an http or https URL")
+		return
+	}
+	if s.staging.add(key, callback) {
+		go func() {
+			<-done
+			if release != nil {
+				release()
+			}
+			s.notifyStaged(key, id, binfo.ID)
+		}()
+	} else if release != nil {
+		// this blob is already counted against someone
+		release()
+	}
+	position, seconds := s.setRecallHeaders(w, key, binfo.Size)
+	location := apiPath(r, fmt.Sprintf("/item/%s/@blob/%d", id, binfo.ID))
+	w.Header().Set("Location", location)
+	w.Header().Set("Preference-Applied", "respond-async")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(AsyncResponse{
+		Location:      location,
+		Estimate:      seconds,
+		QueuePosition: position,
+	})
+}
+
+// notifyStaged POSTs a StagedNotification for the given blob to the callback
+// URLs waiting for it. It should be called once the blob has been copied into
+// the cache.
+func (s *RESTServer) notifyStaged(key, id string, bid items.BlobID) {
+	urls := s.staging.finish(key)
+	if len(urls) == 0 {
+		return
+	}
+	n := StagedNotification{
+		ItemID: id,
+		BlobID: int(bid),
+		Status: "cached",
+	}
+	if !s.Cache.Contains(key) {
+		n.Status = "error"
+		n.Error = "the blob could not be copied into the cache"
+		if err := s.errorledger.find(key); err != nil {
+			n.Error = err.Error()
+		}
+	}
+	body, err := json.Marshal(n)
+	if err != nil {
+		slog.Error("Encoding callback", "item", id, "blob", bid, "error", err)
+		return
+	}
+	for _, u := range urls {
+		go postCallback(u, body, "blob", key)
+	}
+}
+
+// defaultRecallRate is the bytes per second used to estimate how long a
+// recall will take before any have been timed.
+const defaultRecallRate = 50 << 20
+
+// recallRate is the bytes per second of the most recent copy of a blob from
+// tape into the cache. Only blobs of at least a megabyte are timed, since the
+// time to copy smaller ones is mostly the tape's latency.
+type recallRate struct {
+	rate atomic.Int64
+}
+
+// record notes that n bytes were recalled in the duration d.
+func (rr *recallRate) record(n int64, d time.Duration) {
+	if n < 1<<20 || d <= 0 {
+		return
+	}
+	rr.rate.Store(int64(float64(n) / d.Seconds()))
+}
+
+// A recallQueue lists the blobs being copied from tape into the cache, in
+// the order the copies started.
+type recallQueue struct {
+	m       sync.Mutex
+	entries []recallEntry
+}
+
+type recallEntry struct {
+	key     string
+	started time.Time
+}
+
+// add puts the blob having the given cache key at the end of the queue.
+func (q *recallQueue) add(key string) {
+	q.m.Lock()
+	q.entries = append(q.entries, recallEntry{key: key, started: time.Now()})
+	q.m.Unlock()
+}
+
+// remove takes the blob having the given cache key out of the queue.
+func (q *recallQueue) remove(key string) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	for i := range q.entries {
+		if q.entries[i].key == key {
+			q.entries = append(q.entries[:i], q.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+// position returns the place, counting from 1, of the blob having the given
+// cache key in the queue, and when its copy started. The place is 0 if the
+// blob is not being copied.
+func (q *recallQueue) position(key string) (int, time.Time) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	for i, e := range q.entries {
+		if e.key == key {
+			return i + 1, e.started
+		}
+	}
+	return 0, time.Time{}
+}
+
+// setRecallHeaders sets the headers telling a client waiting for the blob
+// having the given cache key and size when to try again. Retry-After is the
+// estimated seconds until the copy into the cache finishes. X-Queue-Position
+// is the blob's place among the copies in progress, in the order they
+// started, and is only sent if the copy has started. Both values are
+// returned.
+func (s *RESTServer) setRecallHeaders(w http.ResponseWriter, key string, size int64) (int, int) {
+	position, started := s.recalls.position(key)
+	estimate := s.estimateRecall(size)
+	if position > 0 {
+		estimate -= time.Since(started)
+	}
+	seconds := int((estimate + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	if position > 0 {
+		w.Header().Set("X-Queue-Position", strconv.Itoa(position))
+	}
+	return position, seconds
+}
+
+// estimateRecall returns how long a recall of a blob of the given size is
+// expected to take. It is always at least a second.
+func (s *RESTServer) estimateRecall(size int64) time.Duration {
+	rate := s.recallrate.rate.Load()
+	if rate <= 0 {
+		rate = defaultRecallRate
+	}
+	d := time.Duration(float64(size) / float64(rate) * float64(time.Second))
+	if d < time.Second {
+		d = time.Second
+	}
+	return d
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestPreferAsync(t *testing.T) {
+	var table = []struct {
+		prefer string
+		result bool
+	}{
+		{"", false},
+		{"respond-async", true},
+		{"Respond-Async", true},
+		{"respond-async, wait=10", true},
+		{"handling=lenient; foo=bar, respond-async; x=1", true},
+		{"return=minimal", false},
+		{"respond-asyncx", false},
+	}
+	for _, tab := range table {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tab.prefer != "" {
+			r.Header.Set("Prefer", tab.prefer)
+		}
+		if got := preferAsync(r); got != tab.result {
+			t.Errorf("%q: received %v, expected %v", tab.prefer, got, tab.result)
+		}
+	}
+}
+
+func TestEstimateRecall(t *testing.T) {
+	s := &RESTServer{}
+	if d := s.estimateRecall(10); d != time.Second {
+		t.Errorf("small blob: received %v, expected 1s", d)
+	}
+	if d := s.estimateRecall(defaultRecallRate * 10); d != 10*time.Second {
+		t.Errorf("default rate: received %v, expected 10s", d)
+	}
+	// small recalls do not change the rate
+	s.recallrate.record(100, time.Minute)
+	if d := s.estimateRecall(defaultRecallRate * 10); d != 10*time.Second {
+		t.Errorf("after small recall: received %v, expected 10s", d)
+	}
+	s.recallrate.record(10<<20, time.Second)
+	if d := s.estimateRecall(50 << 20); d != 5*time.Second {
+		t.Errorf("after recall: received %v, expected 5s", d)
+	}
+}
+
+func TestAsyncGet(t *testing.T) {
+	received := make(chan StagedNotification, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n StagedNotification
+		err := json.NewDecoder(r.Body).Decode(&n)
+		if err != nil {
+			t.Error(err)
+		}
+		received <- n
+	}))
+	defer receiver.Close()
+
+	file1 := uploadstring(t, "POST", "/upload", "hello async")
+	itemid := "async" + randomid()
+	txpath := sendtransaction(t, "/item/"+itemid+"/transaction",
+		[][]string{{"add", path.Base(file1)}, {"slot", "a.txt", path.Base(file1)}}, 202)
+	waitTransaction(t, txpath)
+
+	getAsync := func(route, webhook string) *http.Response {
+		req, _ := http.NewRequest("GET", testServer.URL+route, nil)
+		req.Header.Set("Prefer", "respond-async")
+		if webhook != "" {
+			req.Header.Set("X-Webhook", webhook)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// webhooks need to be http urls
+	resp := getAsync("/item/"+itemid+"/a.txt", "file:///etc/passwd")
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Errorf("Received status %d, expected 400", resp.StatusCode)
+	}
+
+	// the blob may have been cached by the last request, so use a new one
+	file2 := uploadstring(t, "POST", "/upload", "hello again")
+	txpath = sendtransaction(t, "/item/"+itemid+"/transaction",
+		[][]string{{"add", path.Base(file2)}, {"slot", "b.txt", path.Base(file2)}}, 202)
+	waitTransaction(t, txpath)
+
+	resp = getAsync("/api/v2/item/"+itemid+"/b.txt", receiver.URL)
+	var body AsyncResponse
+	err := json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	location := "/api/v2/item/" + itemid + "/@blob/2"
+	if resp.StatusCode != 202 || resp.Header.Get("Location") != location ||
+		resp.Header.Get("Preference-Applied") != "respond-async" ||
+		resp.Header.Get("Retry-After") != "1" {
+		t.Errorf("Received status %d, headers %v", resp.StatusCode, resp.Header)
+	}
+	if body.Location != location || body.Estimate != 1 {
+		t.Errorf("Received %#v", body)
+	}
+
+	select {
+	case n := <-received:
+		if n.ItemID != itemid || n.BlobID != 2 || n.Status != "cached" {
+			t.Errorf("Received %#v", n)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("No callback received")
+	}
+
+	resp = getAsync(location, "")
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 || string(b) != "hello again" {
+		t.Errorf("Received status %d, body %q", resp.StatusCode, b)
+	}
+}
+
+func TestCacheWait(t *testing.T) {
+	s := &RESTServer{CacheWait: 30 * time.Second, MaxCacheWait: 5 * time.Minute}
+	var table = []struct {
+		prefer string
+		wait   time.Duration
+	}{
+		{"", 30 * time.Second},
+		{"wait=10", 10 * time.Second},
+		{"respond-async, wait=120", 120 * time.Second},
+		{`wait="90"`, 90 * time.Second},
+		{"wait=0", time.Second},
+		{"wait=3600", 5 * time.Minute},
+		{"wait=soon", 30 * time.Second},
+	}
+	for _, tab := range table {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tab.prefer != "" {
+			r.Header.Set("Prefer", tab.prefer)
+		}
+		if got := s.cacheWait(r); got != tab.wait {
+			t.Errorf("%q: received %v, expected %v", tab.prefer, got, tab.wait)
+		}
+	}
+
+	// without a maximum, clients may only wait less
+	s = &RESTServer{}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Prefer", "wait=3600")
+	if got := s.cacheWait(r); got != DefaultCacheWait {
+		t.Errorf("Received %v, expected %v", got, DefaultCacheWait)
+	}
+}
+
+func TestRecallHeaders(t *testing.T) {
+	s := &RESTServer{}
+	s.recalls.add("a")
+	s.recalls.add("b")
+	s.recalls.add("c")
+	s.recalls.remove("a")
+
+	w := httptest.NewRecorder()
+	position, seconds := s.setRecallHeaders(w, "c", defaultRecallRate*10)
+	if position != 2 || w.Header().Get("X-Queue-Position") != "2" {
+		t.Errorf("Received position %d, header %q, expected 2", position, w.Header().Get("X-Queue-Position"))
+	}
+	if seconds != 10 || w.Header().Get("Retry-After") != "10" {
+		t.Errorf("Received %d seconds, header %q, expected 10", seconds, w.Header().Get("Retry-After"))
+	}
+
+	// blobs not being copied have no position
+	w = httptest.NewRecorder()
+	position, _ = s.setRecallHeaders(w, "a", 10)
+	if position != 0 || w.Header().Get("X-Queue-Position") != "" || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Received position %d, headers %v", position, w.Header())
+	}
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+	"github.com/julienschmidt/httprouter"
+)
+
+// An AuditDB keeps an append-only log of every request which changes
+// something, so it can later be found who did what, and when. Entries are
+// never changed or removed by bendo.
+type AuditDB interface {
+	// RecordAudit adds an entry to the log.
+	RecordAudit(entry AuditEntry) error
+
+	// SearchAudit returns the entries made between start and end,
+	// inclusive, newest first. A zero start or end leaves that side
+	// unbounded. If item is not empty, only entries for that item are
+	// returned. At most limit entries are returned.
+	SearchAudit(start, end time.Time, item string, limit int) ([]AuditEntry, error)
+}
+
+// An AuditEntry records one request which changed something.
+type AuditEntry struct {
+	When   time.Time
+	User   string // the token user, or "" if anonymous
+	Remote string // the address the request came from
+	Method string
+	Path   string
+	Item   string // the item affected, if known
+	Status int    // the HTTP status of the response
+}
+
+// auditWrapper returns a handler which records every request to the given
+// route which is not a GET or a HEAD in the audit log, once the handler
+// has finished. It is used for the routes needing write access, which are
+// the ones that change something. It must run inside authzWrapper so the
+// user is known.
+func (s *RESTServer) auditWrapper(handler httprouter.Handle, route string) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if s.Audit == nil || r.Method == "GET" || r.Method == "HEAD" {
+			handler(w, r, ps)
+			return
+		}
+		// find the item first, since the handler may delete what
+		// leads to it
+		entry := AuditEntry{
+			When:   time.Now(),
+			User:   ps.ByName("username"),
+			Remote: r.RemoteAddr,
+			Method: r.Method,
+			Path:   r.URL.Path,
+			Item:   s.auditItem(route, ps),
+		}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		handler(sw, r, ps)
+		entry.Status = sw.status
+		err := s.Audit.RecordAudit(entry)
+		if err != nil {
+			requestLogger(r).Error("RecordAudit", "error", err)
+			raven.CaptureError(err, nil)
+		}
+	}
+}
+
+// auditItem returns the item a request to the given route affects, or ""
+// if it does not affect a single item.
+func (s *RESTServer) auditItem(route string, ps httprouter.Params) string {
+	switch {
+	case strings.HasPrefix(route, "/item/"),
+		strings.HasPrefix(route, "/admin/consistency/"):
+		return ps.ByName("id")
+	case strings.Contains(route, ":item"):
+		return ps.ByName("item")
+	case strings.Contains(route, ":tid") && s.TxStore != nil:
+		tx := s.TxStore.Lookup(ps.ByName("tid"))
+		if tx == nil {
+			return ""
+		}
+		tx.M.RLock()
+		defer tx.M.RUnlock()
+		return tx.ItemID
+	}
+	return ""
+}
+
+// statusWriter remembers the status code sent through it.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// AuditHandler handles requests to GET /admin/audit. The optional
+// parameters "item", "start", and "end" limit the entries returned to the
+// given item and time range. Times are in RFC 3339 format or dates, e.g.
+// 2020-01-31. The parameter "limit" sets the most entries to return
+// (default 100).
+func (s *RESTServer) AuditHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.Audit == nil {
+		NotImplementedHandler(w, r, ps)
+		return
+	}
+	start, err := timeValidate(r.FormValue("start"), time.Time{})
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintln(w, err)
+		return
+	}
+	end, err := timeValidate(r.FormValue("end"), time.Time{})
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintln(w, err)
+		return
+	}
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+	entries, err := s.Audit.SearchAudit(start, end, r.FormValue("item"), limit)
+	if err != nil {
+		requestLogger(r).Error("SearchAudit", "error", err)
+		raven.CaptureError(err, nil)
+		w.WriteHeader(500)
+		return
+	}
+	if entries == nil {
+		entries = []AuditEntry{}
+	}
+	writeHTMLorJSON(w, r, auditTemplate, entries)
+}
+
+var (
+	auditTemplate = template.Must(template.New("audit").Parse(`<html>
+<h1>Audit Log</h1>
+<table><thead><tr>
+	<th>When</th><th>User</th><th>Remote</th><th>Request</th><th>Item</th><th>Status</th>
+</tr></thead><tbody>
+{{ range . }}
+	<tr><td>{{ .When }}</td><td>{{ .User }}</td><td>{{ .Remote }}</td>
+	<td>{{ .Method }} {{ .Path }}</td>
+	<td>{{ if .Item }}<a href="/item/{{ .Item }}">{{ .Item }}</a>{{ end }}</td>
+	<td>{{ .Status }}</td></tr>
+{{ end }}
+</tbody></table>
+</html>`))
+)
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"encoding/json"
+	"path"
+	"testing"
+	"time"
+)
+
+func runAuditSequence(t *testing.T, db AuditDB) {
+	first := time.Now().Add(-time.Hour).Truncate(time.Second)
+	var entries = []AuditEntry{
+		{When: first, User: "alice", Remote: "10.0.0.1:1234", Method: "POST", Path: "/upload", Status: 200},
+		{When: first.Add(time.Minute), User: "alice", Remote: "10.0.0.1:1234", Method: "POST", Path: "/item/a1/transaction", Item: "a1", Status: 202},
+		{When: first.Add(2 * time.Minute), User: "bob", Remote: "10.0.0.2:1234", Method: "DELETE", Path: "/item/a1", Item: "a1", Status: 200},
+	}
+	for _, e := range entries {
+		err := db.RecordAudit(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var tests = []struct {
+		start, end time.Time
+		item       string
+		limit      int
+		expected   []int // indices into entries, newest first
+	}{
+		{time.Time{}, time.Time{}, "", 10, []int{2, 1, 0}},
+		{time.Time{}, time.Time{}, "", 2, []int{2, 1}},
+		{time.Time{}, time.Time{}, "a1", 10, []int{2, 1}},
+		{first.Add(time.Minute), time.Time{}, "", 10, []int{2, 1}},
+		{time.Time{}, first.Add(time.Minute), "", 10, []int{1, 0}},
+		{time.Time{}, time.Time{}, "b2", 10, nil},
+	}
+	for i, tab := range tests {
+		result, err := db.SearchAudit(tab.start, tab.end, tab.item, tab.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result) != len(tab.expected) {
+			t.Errorf("%d: Received %v, expected %v", i, result, tab.expected)
+			continue
+		}
+		for j, k := range tab.expected {
+			e := entries[k]
+			if !result[j].When.Equal(e.When) || result[j].User != e.User || result[j].Remote != e.Remote ||
+				result[j].Path != e.Path || result[j].Item != e.Item || result[j].Status != e.Status {
+				t.Errorf("%d: Received %#v, expected %#v", i, result[j], e)
+			}
+		}
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	file := uploadstring(t, "POST", "/upload", "audited content")
+	itemid := "audit" + randomid()
+	txpath := sendtransaction(t, "/item/"+itemid+"/transaction", [][]string{{"add", path.Base(file)}}, 202)
+	waitTransaction(t, txpath)
+	getbody(t, "GET", "/item/"+itemid, 200)
+
+	var entries []AuditEntry
+	body := getbody(t, "GET", "/admin/audit?format=json&item="+itemid, 200)
+	err := json.Unmarshal([]byte(body), &entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// reads are not logged
+	if len(entries) != 1 {
+		t.Fatalf("Received %v, expected one entry", entries)
+	}
+	e := entries[0]
+	if e.User != "nobody" || e.Method != "POST" || e.Path != "/item/"+itemid+"/transaction" || e.Status != 202 || e.Remote == "" {
+		t.Errorf("Received %#v", e)
+	}
+
+	getbody(t, "GET", "/admin/audit?start=yesterday", 400)
+}
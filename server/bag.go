@@ -0,0 +1,135 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+
+	raven "github.com/getsentry/raven-go"
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/ndlib/bendo"
+	"github.com/ndlib/bendo/items"
+)
+
+// BagHandler handles requests to GET /item/:id/@bag. It returns a BagIt bag
+// of the item as a zip file, built by items.WriteBag. The optional parameter
+// "version" gives the version to bag, the newest one by default. Blobs are
+// read through the cache, the same as other downloads, and count against
+// the user's download quota.
+func (s *RESTServer) BagHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s.versionDownload(w, r, ps, "application/zip", ".zip", items.WriteBag)
+}
+
+// ArchiveHandler handles requests to GET /item/:id/@zip and
+// /item/:id/@tar. It is like BagHandler, but returns only the files in the
+// version, as a plain zip or tar file built by items.WriteArchive, for people
+// who want every file of an item in one download.
+func (s *RESTServer) ArchiveHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	format := items.ZipFormat
+	contentType := "application/zip"
+	if ps.ByName("slot") == "/@tar" {
+		format = items.TarFormat
+		contentType = "application/x-tar"
+	}
+	s.versionDownload(w, r, ps, contentType, "."+format.String(),
+		func(w io.Writer, item *items.Item, vid items.VersionID, open func(blob *items.Blob) (io.ReadCloser, error)) error {
+			return items.WriteArchive(w, item, vid, format, open)
+		})
+}
+
+// versionDownload streams a version of the item id to the client in one
+// file, as made by write, with the given content type and file extension.
+// The optional parameter "version" gives the version, the newest one by
+// default.
+func (s *RESTServer) versionDownload(w http.ResponseWriter, r *http.Request, ps httprouter.Params, contentType, ext string,
+	write func(w io.Writer, item *items.Item, vid items.VersionID, open func(blob *items.Blob) (io.ReadCloser, error)) error) {
+	id := ps.ByName("id")
+	user := ps.ByName("username")
+	var vid int
+	if v := r.FormValue("version"); v != "" {
+		var err error
+		vid, err = strconv.Atoi(v)
+		if err != nil || vid <= 0 {
+			w.WriteHeader(400)
+			fmt.Fprintln(w, "version must be a positive integer")
+			return
+		}
+	}
+	item, err := s.Items.ItemContext(r.Context(), id)
+	if err == items.ErrNoItem {
+		writeUnavailable(w, r, s.itemMissing(r, id, ""))
+		return
+	} else if err != nil {
+		if u, ok := unavailableFor(err, id, "", nil); ok {
+			writeUnavailable(w, r, u)
+			return
+		}
+		requestLogger(r).Error("download version", "item", id, "error", err)
+		raven.CaptureError(err, nil)
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err)
+		return
+	}
+	ver := item.FindVersion(items.VersionID(vid))
+	if ver == nil {
+		w.WriteHeader(404)
+		fmt.Fprintln(w, items.ErrNoVersion)
+		return
+	}
+	if r.Method != "GET" {
+		setDownloadHeaders(w, id, contentType, ext)
+		return
+	}
+	inVersion := make(map[items.BlobID]bool)
+	for _, bid := range ver.Slots {
+		inVersion[bid] = true
+	}
+	var total int64
+	var uncached bool
+	for _, blob := range item.Blobs {
+		if !inVersion[blob.ID] || (blob.Bundle == 0 && blob.RefItem == "") {
+			continue
+		}
+		total += blob.Size
+		if blob.Size > 0 && !s.Cache.Contains(bendo.CacheKey(id, blob.ID)) {
+			uncached = true
+		}
+	}
+	if msg := s.checkTransfer(r, user, UsageDownload, total); msg != "" {
+		writeQuotaExceeded(w, r, msg)
+		return
+	}
+	if uncached {
+		release, ok := s.acquireRecall(user)
+		if !ok {
+			xRecallLimited.Add(1)
+			requestLogger(r).Warn("recall limited")
+			writeTooManyRequests(w, recallRetry, "Too many tape recalls in progress")
+			return
+		}
+		defer release()
+	}
+	s.recordAccess(id)
+	setDownloadHeaders(w, id, contentType, ext)
+	cw := &countingWriter{ResponseWriter: w}
+	defer func() { s.recordDownload(user, cw.n) }()
+	wait := s.cacheWait(r)
+	err = write(cw, item, items.VersionID(vid), func(blob *items.Blob) (io.ReadCloser, error) {
+		return s.openContent(id, blob, wait)
+	})
+	if err != nil {
+		// the response has already started, so the archive is left
+		// incomplete
+		requestLogger(r).Warn("download version", "item", id, "error", err)
+	}
+}
+
+// setDownloadHeaders sets the headers for a response holding a file of the
+// item id with the given content type and extension.
+func setDownloadHeaders(w http.ResponseWriter, id, contentType, ext string) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": id + ext}))
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestBag(t *testing.T) {
+	file1 := path.Base(uploadstring(t, "POST", "/upload", "bag file"))
+	itemid := "bag" + randomid()
+	txpath := sendtransaction(t, "/item/"+itemid+"/transaction",
+		[][]string{{"add", file1}, {"slot", "dir/a.txt", file1}}, 202)
+	waitTransaction(t, txpath)
+
+	body := getbody(t, "GET", "/item/"+itemid+"/@bag", 200)
+	zr, err := zip.NewReader(bytes.NewReader([]byte(body)), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := ioutil.ReadAll(r)
+		r.Close()
+		files[f.Name] = string(content)
+	}
+	if files[itemid+"/data/dir/a.txt"] != "bag file" {
+		t.Errorf("Received files %v", files)
+	}
+	if !strings.Contains(files[itemid+"/manifest-sha256.txt"], "  data/dir/a.txt\n") {
+		t.Errorf("Received manifest %q", files[itemid+"/manifest-sha256.txt"])
+	}
+
+	checkStatus(t, "HEAD", "/item/"+itemid+"/@bag", 200)
+	checkStatus(t, "GET", "/item/"+itemid+"/@bag?version=1", 200)
+	checkStatus(t, "GET", "/item/"+itemid+"/@bag?version=2", 404)
+	checkStatus(t, "GET", "/item/"+itemid+"/@bag?version=x", 400)
+	checkStatus(t, "GET", "/item/nosuch"+randomid()+"/@bag", 404)
+}
+
+func TestArchive(t *testing.T) {
+	file1 := path.Base(uploadstring(t, "POST", "/upload", "archive file"))
+	itemid := "archive" + randomid()
+	txpath := sendtransaction(t, "/item/"+itemid+"/transaction",
+		[][]string{{"add", file1}, {"slot", "dir/a.txt", file1}}, 202)
+	waitTransaction(t, txpath)
+
+	body := getbody(t, "GET", "/item/"+itemid+"/@zip", 200)
+	zr, err := zip.NewReader(bytes.NewReader([]byte(body)), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 1 || zr.File[0].Name != itemid+"/dir/a.txt" {
+		t.Errorf("Received files %v", zr.File)
+	}
+
+	body = getbody(t, "GET", "/item/"+itemid+"/@tar", 200)
+	hdr, err := tar.NewReader(strings.NewReader(body)).Next()
+	if err != nil || hdr.Name != itemid+"/dir/a.txt" || hdr.Size != 12 {
+		t.Errorf("Received %v, %v", hdr, err)
+	}
+
+	checkStatus(t, "HEAD", "/item/"+itemid+"/@tar", 200)
+	checkStatus(t, "GET", "/item/"+itemid+"/@zip?version=2", 404)
+	checkStatus(t, "GET", "/item/nosuch"+randomid()+"/@tar", 404)
+}
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/ndlib/bendo"
+	"github.com/ndlib/bendo/items"
+)
+
+// MaxBatchBlobs is the most blobs a single batch request may ask for.
+const MaxBatchBlobs = 1000
+
+// BatchHandler handles requests to POST /item/:id/@batch. The body is a
+// JSON list of the blobs to return, each either a slot path, in any form
+// GET /item/:id/*slot accepts, or a blob number. They are returned in the
+// order given, as the parts of a multipart/mixed response, or as the files
+// in a zip file if the parameter "format" is "zip" or the client accepts
+// application/zip.
+//
+// Every entry is resolved before anything is sent, so a missing or deleted
+// blob gives an error response for the whole request. An error reading a
+// blob after the response has started ends the response early, without the
+// closing boundary or zip directory, so clients can tell it is incomplete.
+func (s *RESTServer) BatchHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := ps.ByName("id")
+	user := ps.ByName("username")
+	slots, err := readBatchSlots(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintln(w, err)
+		return
+	}
+	var blobs []*items.Blob
+	var total int64
+	var uncached bool
+	for _, slot := range slots {
+		binfo, err := s.resolveblob(id, slot)
+		if err != nil && err != items.ErrNoItem {
+			if u, ok := unavailableFor(err, id, slot, nil); ok {
+				writeUnavailable(w, r, u)
+				return
+			}
+			requestLogger(r).Error("resolving slot", "item", id, "slot", slot, "error", err)
+			w.WriteHeader(500)
+			fmt.Fprintln(w, err)
+			return
+		}
+		if binfo == nil {
+			writeUnavailable(w, r, s.itemMissing(r, id, slot))
+			return
+		}
+		if !binfo.DeleteDate.IsZero() {
+			u, _ := unavailableFor(items.ErrDeleted, id, slot, binfo)
+			writeUnavailable(w, r, u)
+			return
+		}
+		blobs = append(blobs, binfo)
+		total += binfo.Size
+		if binfo.Size > 0 && !s.Cache.Contains(bendo.CacheKey(id, binfo.ID)) {
+			uncached = true
+		}
+	}
+	if msg := s.checkTransfer(r, user, UsageDownload, total); msg != "" {
+		writeQuotaExceeded(w, r, msg)
+		return
+	}
+	if uncached {
+		release, ok := s.acquireRecall(user)
+		if !ok {
+			xRecallLimited.Add(1)
+			requestLogger(r).Warn("recall limited")
+			writeTooManyRequests(w, recallRetry, "Too many tape recalls in progress")
+			return
+		}
+		defer release()
+	}
+	s.recordAccess(id)
+
+	asZip := r.FormValue("format") == "zip" || strings.Contains(r.Header.Get("Accept"), "application/zip")
+	var out batchWriter
+	var sent int64
+	defer func() { s.recordDownload(user, sent) }()
+	for i, binfo := range blobs {
+		logger := requestLogger(r).With("item", id, "blob", binfo.ID)
+		content, err := s.openContent(id, binfo, s.cacheWait(r))
+		if err != nil {
+			logger.Error("batch", "error", err)
+			if out != nil {
+				return // the response has already started
+			}
+			if u, ok := unavailableFor(err, id, slots[i], binfo); ok {
+				writeUnavailable(w, r, u)
+				return
+			}
+			w.WriteHeader(500)
+			fmt.Fprintln(w, err)
+			return
+		}
+		if out == nil {
+			if asZip {
+				out = newZipBatch(w, id)
+			} else {
+				out = newMultipartBatch(w, r, id)
+			}
+		}
+		part, err := out.Next(slots[i], binfo)
+		if err == nil {
+			var n int64
+			n, err = io.Copy(part, content)
+			sent += n
+		}
+		content.Close()
+		if err != nil {
+			logger.Warn("batch copy", "error", err)
+			return
+		}
+	}
+	err = out.Close()
+	if err != nil {
+		requestLogger(r).Warn("batch close", "item", id, "error", err)
+	}
+}
+
+// readBatchSlots decodes the body of a batch request into a list of slot
+// paths. Blob numbers are turned into "@blob/N" paths.
+func readBatchSlots(body io.Reader) ([]string, error) {
+	var list []interface{}
+	dec := json.NewDecoder(body)
+	dec.UseNumber()
+	err := dec.Decode(&list)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, errors.New("no blobs requested")
+	}
+	if len(list) > MaxBatchBlobs {
+		return nil, fmt.Errorf("too many blobs requested, the limit is %d", MaxBatchBlobs)
+	}
+	var result []string
+	for _, v := range list {
+		switch v := v.(type) {
+		case string:
+			if v == "" {
+				return nil, errors.New("empty slot path")
+			}
+			result = append(result, v)
+		case json.Number:
+			n, err := strconv.ParseInt(v.String(), 10, 0)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("bad blob number %s", v)
+			}
+			result = append(result, fmt.Sprintf("@blob/%d", n))
+		default:
+			return nil, fmt.Errorf("bad entry %v, expected a slot path or a blob number", v)
+		}
+	}
+	return result, nil
+}
+
+// openContent returns the content of the given blob, from the cache if it
+// is there. Otherwise it is recalled from tape, waiting up to the given time
+// for it to be copied into the cache if it is small enough to be kept there.
+// The caller must close the returned reader.
+func (s *RESTServer) openContent(id string, binfo *items.Blob, wait time.Duration) (io.ReadCloser, error) {
+	if binfo.Size == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	key := bendo.CacheKey(id, binfo.ID)
+	for waited := false; ; waited = true {
+		content, err := s.findContent(key, id, binfo, true)
+		if err != nil {
+			return nil, err
+		}
+		switch content.status {
+		case ContentCached, ContentLarge:
+			return content.r, nil
+		case ContentWaiting:
+			if waited {
+				return nil, errors.New("content not cached after waiting for it")
+			}
+			select {
+			case <-content.done:
+			case <-time.After(wait):
+				return nil, errors.New("timeout waiting for content")
+			}
+		default:
+			return nil, fmt.Errorf("unknown content status %d", content.status)
+		}
+	}
+}
+
+// A batchWriter sends the blobs of a batch response in some format.
+type batchWriter interface {
+	// Next starts the next blob, which was requested using the given
+	// slot path, and returns a writer for its content.
+	Next(slot string, binfo *items.Blob) (io.Writer, error)
+
+	// Close finishes the response.
+	Close() error
+}
+
+// multipartBatch sends each blob as a part of a multipart/mixed response.
+// Each part has the headers a request for the single blob would have.
+type multipartBatch struct {
+	mw *multipart.Writer
+	r  *http.Request
+	id string
+}
+
+func newMultipartBatch(w http.ResponseWriter, r *http.Request, id string) *multipartBatch {
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	return &multipartBatch{mw: mw, r: r, id: id}
+}
+
+func (b *multipartBatch) Next(slot string, binfo *items.Blob) (io.Writer, error) {
+	h := make(textproto.MIMEHeader)
+	contentType := binfo.MimeType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Length", strconv.FormatInt(binfo.Size, 10))
+	h.Set("Content-Location", apiPath(b.r, fmt.Sprintf("/item/%s/@blob/%d", b.id, binfo.ID)))
+	h.Set("X-Content-Sha256", hex.EncodeToString(binfo.SHA256))
+	h.Set("X-Content-Md5", hex.EncodeToString(binfo.MD5))
+	h.Set("X-Slot", slot)
+	if !strings.HasPrefix(slot, "@blob/") {
+		h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(slot)}))
+	}
+	return b.mw.CreatePart(h)
+}
+
+func (b *multipartBatch) Close() error {
+	return b.mw.Close()
+}
+
+// zipBatch sends the blobs as the files in a zip file, named by the slot
+// paths they were requested by. The files are stored without compression,
+// since many blobs are compressed already.
+type zipBatch struct {
+	zw *zip.Writer
+}
+
+func newZipBatch(w http.ResponseWriter, id string) *zipBatch {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": id + ".zip"}))
+	return &zipBatch{zw: zip.NewWriter(w)}
+}
+
+func (b *zipBatch) Next(slot string, binfo *items.Blob) (io.Writer, error) {
+	return b.zw.CreateHeader(&zip.FileHeader{
+		Name:     slot,
+		Method:   zip.Store,
+		Modified: binfo.SaveDate,
+	})
+}
+
+func (b *zipBatch) Close() error {
+	return b.zw.Close()
+}
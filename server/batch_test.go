@@ -0,0 +1,104 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+	"testing"
+)
+
+func postBatch(t *testing.T, route string, body string, accept string, expstatus int) *http.Response {
+	req, err := http.NewRequest("POST", testServer.URL+route, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != expstatus {
+		t.Errorf("%s %s: received status %d, expected %d", route, body, resp.StatusCode, expstatus)
+	}
+	return resp
+}
+
+func TestBatch(t *testing.T) {
+	file1 := path.Base(uploadstring(t, "POST", "/upload", "first batch file"))
+	file2 := path.Base(uploadstring(t, "POST", "/upload", "second batch file"))
+	itemid := "batch" + randomid()
+	txpath := sendtransaction(t, "/item/"+itemid+"/transaction",
+		[][]string{{"add", file1}, {"add", file2}, {"slot", "dir/a.txt", file1}, {"slot", "b.txt", file2}}, 202)
+	waitTransaction(t, txpath)
+
+	resp := postBatch(t, "/item/"+itemid+"/@batch", `["b.txt", 1, "dir/a.txt"]`, "", 200)
+	mediatype, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediatype != "multipart/mixed" {
+		t.Fatalf("Received content type %q, %v", resp.Header.Get("Content-Type"), err)
+	}
+	var expected = []struct {
+		slot, content, filename string
+	}{
+		{"b.txt", "second batch file", "b.txt"},
+		{"@blob/1", "first batch file", ""},
+		{"dir/a.txt", "first batch file", "a.txt"},
+	}
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for _, exp := range expected {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := ioutil.ReadAll(part)
+		if part.Header.Get("X-Slot") != exp.slot || string(content) != exp.content || part.FileName() != exp.filename {
+			t.Errorf("Received %v %q, expected %v", part.Header, content, exp)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("Received %v, expected the end of the parts", err)
+	}
+	resp.Body.Close()
+
+	// as a zip file
+	resp = postBatch(t, "/api/v2/item/"+itemid+"/@batch?format=zip", `["b.txt", "dir/a.txt"]`, "", 200)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 2 || zr.File[0].Name != "b.txt" || zr.File[1].Name != "dir/a.txt" {
+		t.Fatalf("Received %v", zr.File)
+	}
+	f, _ := zr.File[1].Open()
+	content, _ := ioutil.ReadAll(f)
+	f.Close()
+	if string(content) != "first batch file" {
+		t.Errorf("Received %q", content)
+	}
+
+	var errors = []struct {
+		body   string
+		status int
+	}{
+		{`["b.txt", "c.txt"]`, 404},
+		{`[]`, 400},
+		{`["b.txt", true]`, 400},
+		{`[0]`, 400},
+		{`not json`, 400},
+	}
+	for _, tab := range errors {
+		resp = postBatch(t, "/item/"+itemid+"/@batch", tab.body, "", tab.status)
+		resp.Body.Close()
+	}
+	resp = postBatch(t, "/item/nosuch"+randomid()+"/@batch", `[1]`, "", 404)
+	resp.Body.Close()
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ndlib/bendo/items"
+)
+
+var (
+	nBlobDBHit  = expvar.NewInt("blobdb.cache.hit")
+	nBlobDBMiss = expvar.NewInt("blobdb.cache.miss")
+)
+
+// A BlobDBCache is a read-through cache in front of a BlobDB. It remembers
+// the results of FindBlob and FindBlobBySlot for a fixed length of time,
+// since resolving a slot happens on every download. Lookups which do not find
+// a blob are not remembered.
+//
+// All the entries for an item are dropped whenever the item is indexed, which
+// happens after every transaction commit. Changes made to the underlying
+// database some other way may not be seen until the entries expire.
+type BlobDBCache struct {
+	BlobDB
+
+	ttl        time.Duration
+	maxEntries int
+
+	m       sync.Mutex                        // protects everything below
+	entries map[string]map[string]blobDBEntry // item id -> lookup key -> entry
+	count   int                               // total number of entries
+}
+
+type blobDBEntry struct {
+	blob    *items.Blob
+	expires time.Time
+}
+
+// NewBlobDBCache wraps db with a cache whose entries last for the given
+// time. At most maxEntries lookups are kept at once.
+func NewBlobDBCache(db BlobDB, ttl time.Duration, maxEntries int) *BlobDBCache {
+	return &BlobDBCache{
+		BlobDB:     db,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]map[string]blobDBEntry),
+	}
+}
+
+// FindBlob looks up the given blob, consulting the cache first.
+func (c *BlobDBCache) FindBlob(item string, blobid int) (*items.Blob, error) {
+	key := fmt.Sprintf("@blob/%d", blobid)
+	return c.lookup(item, key, func() (*items.Blob, error) {
+		return c.BlobDB.FindBlob(item, blobid)
+	})
+}
+
+// FindBlobBySlot looks up the blob for the given slot, consulting the cache
+// first.
+func (c *BlobDBCache) FindBlobBySlot(item string, version int, slot string) (*items.Blob, error) {
+	key := fmt.Sprintf("@%d/%s", version, slot)
+	return c.lookup(item, key, func() (*items.Blob, error) {
+		return c.BlobDB.FindBlobBySlot(item, version, slot)
+	})
+}
+
+// IndexItem indexes the item in the underlying database and drops any cached
+// lookups for it.
+func (c *BlobDBCache) IndexItem(itemid string, item *items.Item) error {
+	// invalidate both before and after, in case a lookup raced with the
+	// indexing and cached a stale answer.
+	c.Invalidate(itemid)
+	err := c.BlobDB.IndexItem(itemid, item)
+	c.Invalidate(itemid)
+	return err
+}
+
+// DeleteItem removes the item from the underlying database and drops any
+// cached lookups for it.
+func (c *BlobDBCache) DeleteItem(item string) error {
+	err := c.BlobDB.DeleteItem(item)
+	c.Invalidate(item)
+	return err
+}
+
+// Invalidate drops every cached lookup for the given item.
+func (c *BlobDBCache) Invalidate(item string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.count -= len(c.entries[item])
+	delete(c.entries, item)
+}
+
+// lookup returns the cached result for item and key, or calls find and
+// caches its result if there is none.
+func (c *BlobDBCache) lookup(item, key string, find func() (*items.Blob, error)) (*items.Blob, error) {
+	now := time.Now()
+	c.m.Lock()
+	e, ok := c.entries[item][key]
+	c.m.Unlock()
+	if ok && now.Before(e.expires) {
+		nBlobDBHit.Add(1)
+		return e.blob, nil
+	}
+	nBlobDBMiss.Add(1)
+	blob, err := find()
+	if blob == nil || err != nil {
+		return blob, err
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.count >= c.maxEntries {
+		c.purge(now)
+	}
+	m := c.entries[item]
+	if m == nil {
+		m = make(map[string]blobDBEntry)
+		c.entries[item] = m
+	}
+	if _, ok := m[key]; !ok {
+		c.count++
+	}
+	m[key] = blobDBEntry{blob: blob, expires: now.Add(c.ttl)}
+	return blob, nil
+}
+
+// purge removes expired entries. If the cache is still full afterwards it is
+// emptied. Must be called with c.m held.
+func (c *BlobDBCache) purge(now time.Time) {
+	for item, m := range c.entries {
+		for key, e := range m {
+			if !now.Before(e.expires) {
+				delete(m, key)
+				c.count--
+			}
+		}
+		if len(m) == 0 {
+			delete(c.entries, item)
+		}
+	}
+	if c.count >= c.maxEntries {
+		c.entries = make(map[string]map[string]blobDBEntry)
+		c.count = 0
+	}
+}
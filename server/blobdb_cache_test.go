@@ -0,0 +1,84 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ndlib/bendo/items"
+)
+
+// countingBlobDB is a BlobDB which counts the lookups made against it.
+type countingBlobDB struct {
+	BlobDB
+	finds int
+}
+
+func (db *countingBlobDB) FindBlob(item string, blobid int) (*items.Blob, error) {
+	db.finds++
+	if blobid > 5 {
+		return nil, nil
+	}
+	return &items.Blob{ID: items.BlobID(blobid)}, nil
+}
+
+func (db *countingBlobDB) FindBlobBySlot(item string, version int, slot string) (*items.Blob, error) {
+	db.finds++
+	return &items.Blob{ID: items.BlobID(version)}, nil
+}
+
+func (db *countingBlobDB) IndexItem(itemid string, item *items.Item) error {
+	return nil
+}
+
+func TestBlobDBCache(t *testing.T) {
+	db := &countingBlobDB{}
+	c := NewBlobDBCache(db, time.Hour, 100)
+
+	for i := 0; i < 3; i++ {
+		b, err := c.FindBlob("abc", 2)
+		if err != nil || b == nil || b.ID != 2 {
+			t.Fatal("FindBlob returned", b, err)
+		}
+		b, err = c.FindBlobBySlot("abc", 1, "file.txt")
+		if err != nil || b == nil || b.ID != 1 {
+			t.Fatal("FindBlobBySlot returned", b, err)
+		}
+	}
+	if db.finds != 2 {
+		t.Errorf("Got %d database lookups, expected 2", db.finds)
+	}
+
+	// misses are not cached
+	c.FindBlob("abc", 10)
+	c.FindBlob("abc", 10)
+	if db.finds != 4 {
+		t.Errorf("Got %d database lookups, expected 4", db.finds)
+	}
+
+	// indexing the item drops its entries
+	c.IndexItem("abc", &items.Item{ID: "abc"})
+	c.FindBlob("abc", 2)
+	if db.finds != 5 {
+		t.Errorf("Got %d database lookups, expected 5", db.finds)
+	}
+}
+
+func TestBlobDBCacheExpire(t *testing.T) {
+	db := &countingBlobDB{}
+	c := NewBlobDBCache(db, 10*time.Millisecond, 2)
+
+	c.FindBlob("abc", 1)
+	time.Sleep(20 * time.Millisecond)
+	c.FindBlob("abc", 1)
+	if db.finds != 2 {
+		t.Errorf("Got %d database lookups, expected 2", db.finds)
+	}
+
+	// adding past maxEntries should not grow the cache
+	c.FindBlob("abc", 2)
+	c.FindBlob("abc", 3)
+	c.FindBlob("def", 4)
+	if c.count > 2 {
+		t.Errorf("Cache has %d entries, expected at most 2", c.count)
+	}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/ndlib/bendo/cache"
+)
+
+// A cacheSummary gives the size of the cache's index.
+type cacheSummary struct {
+	Entries int // -1 if the cache cannot list its entries
+	Size    int64
+	MaxSize int64
+}
+
+// A cacheRescan is the result of rescanning the cache.
+type cacheRescan struct {
+	Before   cacheSummary
+	After    cacheSummary
+	Duration time.Duration
+}
+
+// summarizeCache returns the size of the cache's index.
+func (s *RESTServer) summarizeCache() cacheSummary {
+	result := cacheSummary{
+		Entries: -1,
+		Size:    s.Cache.Size(),
+		MaxSize: s.Cache.MaxSize(),
+	}
+	if c, ok := s.Cache.(cache.Lister); ok {
+		result.Entries = len(c.Entries())
+	}
+	return result
+}
+
+// CacheEntriesHandler handles requests to GET /admin/cache/entries. It lists
+// the entries in the cache index, a page at a time, using the parameters "n"
+// and "p" as for item listings. Entries being written are listed first as
+// pinned, followed by the rest in the order the cache would keep them
+// longest.
+func (s *RESTServer) CacheEntriesHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	c, ok := s.Cache.(cache.Lister)
+	if !ok {
+		NotImplementedHandler(w, r, ps)
+		return
+	}
+	entries := c.Entries()
+	q := parseItemListQuery(r)
+	page := newItemListPage(q, len(entries))
+	setPageHeaders(w, r, page)
+	if q.N >= len(entries) {
+		entries = nil
+	} else {
+		entries = entries[q.N:]
+	}
+	if len(entries) > q.P {
+		entries = entries[:q.P]
+	}
+	if entries == nil {
+		entries = []cache.Entry{}
+	}
+	writeHTMLorJSON(w, r, cacheEntriesTemplate, entries)
+}
+
+// CacheRescanHandler handles requests to POST /admin/cache/rescan. It
+// rebuilds the cache index from the content in the cache store, so files
+// added or removed by hand are noticed without restarting the server. The
+// response gives the size of the index before and after. Only one rescan
+// runs at a time; others get a 409.
+func (s *RESTServer) CacheRescanHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	c, ok := s.Cache.(cache.Scanner)
+	if !ok {
+		NotImplementedHandler(w, r, ps)
+		return
+	}
+	if !s.rescanning.TryLock() {
+		w.WriteHeader(409)
+		fmt.Fprintln(w, "A rescan is already in progress")
+		return
+	}
+	defer s.rescanning.Unlock()
+	result := cacheRescan{Before: s.summarizeCache()}
+	start := time.Now()
+	c.Scan()
+	result.Duration = time.Since(start)
+	result.After = s.summarizeCache()
+	requestLogger(r).Info("cache rescan",
+		"before", result.Before.Entries,
+		"after", result.After.Entries,
+		"size", result.After.Size,
+		"elapsed", result.Duration)
+	writeJSON(w, result)
+}
+
+var (
+	cacheEntriesTemplate = template.Must(template.New("cacheentries").Parse(`<html>
+<h1>Cache Entries</h1>
+<table><thead><tr>
+	<th>Key</th><th>Size</th><th>Expires</th><th>Pinned</th>
+</tr></thead><tbody>
+{{ range . }}
+	<tr>
+		<td>{{ .Key }}</td>
+		<td>{{ .Size }}</td>
+		<td>{{ if not .Expires.IsZero }}{{ .Expires }}{{ end }}</td>
+		<td>{{ if .Pinned }}yes{{ end }}</td>
+	</tr>
+{{ else }}
+	<tr><td colspan="4">No entries</td></tr>
+{{ end }}
+</tbody></table>
+</html>`))
+)
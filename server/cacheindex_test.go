@@ -0,0 +1,69 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	"github.com/ndlib/bendo"
+	"github.com/ndlib/bendo/blobcache"
+	"github.com/ndlib/bendo/cache"
+)
+
+func TestCacheIndex(t *testing.T) {
+	file1 := path.Base(uploadstring(t, "POST", "/upload", "cache index"))
+	itemid := "cacheindex" + randomid()
+	txpath := sendtransaction(t, "/item/"+itemid+"/transaction",
+		[][]string{{"add", file1}, {"slot", "a", file1}}, 202)
+	waitTransaction(t, txpath)
+	getbody(t, "GET", "/item/"+itemid+"/a", 200)
+
+	var rescan cacheRescan
+	body := getbody(t, "POST", "/admin/cache/rescan", 200)
+	err := json.Unmarshal([]byte(body), &rescan)
+	if err != nil || rescan.After.Entries < 1 || rescan.After.Size < int64(len("cache index")) {
+		t.Errorf("Received %s, %v", body, err)
+	}
+
+	resp := checkRoute(t, "GET", "/admin/cache/entries?format=json&p=1000", 200)
+	if resp == nil {
+		return
+	}
+	var entries []cache.Entry
+	err = json.NewDecoder(resp.Body).Decode(&entries)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.Get("X-Total-Count") == "" {
+		t.Error("Missing X-Total-Count header")
+	}
+	key := bendo.CacheKey(itemid, 1)
+	var found bool
+	for _, e := range entries {
+		if e.Key == key {
+			found = e.Size == int64(len("cache index"))
+		}
+	}
+	if !found {
+		t.Errorf("Entry %s not in %v", key, entries)
+	}
+
+	// caches which cannot be listed or scanned
+	s := &RESTServer{
+		Validator: NobodyValidator{},
+		Cache:     blobcache.EmptyCache{},
+	}
+	ts := httptest.NewServer(s.addRoutes())
+	defer ts.Close()
+	resp, err = http.Get(ts.URL + "/admin/cache/entries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 501 {
+		t.Errorf("Received status %d, expected 501", resp.StatusCode)
+	}
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+
+	"github.com/ndlib/bendo/transaction"
+)
+
+// TxNotification is the JSON body POSTed to a transaction's callback URLs
+// when the transaction finishes.
+type TxNotification struct {
+	Transaction string   // the transaction id
+	ItemID      string   // the item the transaction changed
+	Version     int      // the new version of the item, 0 if there is none
+	Status      string   // either "StatusFinished" or "StatusError"
+	Errors      []string // the transaction's errors, if any
+}
+
+var (
+	xCallbackSent  = expvar.NewInt("tx.callback.sent")
+	xCallbackError = expvar.NewInt("tx.callback.error")
+
+	// callbackClient is used to make the callback requests. The timeout
+	// keeps a slow receiver from tying up the request forever.
+	callbackClient = &http.Client{Timeout: 30 * time.Second}
+
+	// callbackDelays are how long to wait before each retry of a callback
+	// which failed. They are variables so the tests can shorten them.
+	callbackDelays = []time.Duration{time.Minute, 10 * time.Minute}
+)
+
+// notifyTx POSTs a TxNotification for tx to each of its callback URLs and to
+// the URLs in TxCallbacks for the user who made it. The requests are made in
+// the background.
+func (s *RESTServer) notifyTx(tx *transaction.Transaction) {
+	urls := tx.Callbacks()
+	tx.M.RLock()
+	urls = append(urls, s.TxCallbacks[tx.Creator]...)
+	n := TxNotification{
+		Transaction: tx.ID,
+		ItemID:      tx.ItemID,
+		Version:     tx.Version,
+		Status:      tx.Status.String(),
+		Errors:      append([]string(nil), tx.Err...),
+	}
+	tx.M.RUnlock()
+	if len(urls) == 0 {
+		return
+	}
+	body, err := json.Marshal(n)
+	if err != nil {
+		slog.Error("Encoding callback", "tx", n.Transaction, "error", err)
+		return
+	}
+	for _, u := range urls {
+		go postCallback(u, body, "tx", n.Transaction)
+	}
+}
+
+// postCallback POSTs body to the given URL, retrying if the request fails or
+// does not return a 2xx status. The key and value name what the callback is
+// for in the logs and error reports, e.g. "tx" and the transaction id.
+func postCallback(url string, body []byte, key, value string) {
+	logger := slog.With(key, value, "url", url)
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = postCallback0(url, body)
+		if err == nil {
+			xCallbackSent.Add(1)
+			logger.Info("Sent callback")
+			return
+		}
+		if attempt >= len(callbackDelays) {
+			break
+		}
+		logger.Warn("Callback failed, will retry", "error", err)
+		time.Sleep(callbackDelays[attempt])
+	}
+	xCallbackError.Add(1)
+	logger.Error("Callback failed", "error", err)
+	raven.CaptureError(err, map[string]string{key: value, "url": url})
+}
+
+func postCallback0(url string, body []byte) error {
+	resp, err := callbackClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("received status %d", resp.StatusCode)
+	}
+	return nil
+}
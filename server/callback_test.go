@@ -0,0 +1,51 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestTxCallback(t *testing.T) {
+	callbackDelays = []time.Duration{time.Millisecond}
+	var calls int
+	received := make(chan TxNotification, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			// fail the first time to make sure it is retried
+			w.WriteHeader(500)
+			return
+		}
+		var n TxNotification
+		err := json.NewDecoder(r.Body).Decode(&n)
+		if err != nil {
+			t.Error(err)
+		}
+		received <- n
+	}))
+	defer receiver.Close()
+
+	// callbacks need to be http urls
+	sendtransaction(t, "/item/callback"+randomid()+"/transaction",
+		[][]string{{"callback", "file:///etc/passwd"}}, 400)
+
+	file1 := uploadstring(t, "POST", "/upload", "hello callback")
+	itemid := "callback" + randomid()
+	txpath := sendtransaction(t, "/item/"+itemid+"/transaction",
+		[][]string{{"add", path.Base(file1)},
+			{"callback", receiver.URL + "/done"}}, 202)
+
+	select {
+	case n := <-received:
+		if n.Transaction != path.Base(txpath) || n.ItemID != itemid ||
+			n.Version != 1 || n.Status != "StatusFinished" || len(n.Errors) != 0 {
+			t.Errorf("Received %#v", n)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("No callback received")
+	}
+}
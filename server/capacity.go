@@ -0,0 +1,104 @@
+package server
+
+import (
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/ndlib/bendo/store"
+)
+
+// capacityFileID is the upload file id which is reserved for the capacity
+// report, since the router cannot have it as a separate route.
+const capacityFileID = "capacity"
+
+// An UploadCapacity tells a client how much it may still upload, so a large
+// ingest can be refused before it starts instead of when it is nearly done.
+type UploadCapacity struct {
+	FreeBytes int64 // bytes free in the upload area, or -1 if not known
+	Quota     int64 // the most bytes the caller may have uploaded at once, or 0 for no limit
+	Used      int64 // bytes the caller has uploaded which are not yet in an item
+	Remaining int64 // bytes the caller may still upload, or -1 for no limit
+}
+
+// quotaFor returns the upload quota for the given user, or 0 if there is
+// none.
+func (s *RESTServer) quotaFor(user string) int64 {
+	if q, ok := s.UploadQuotas[user]; ok {
+		return q
+	}
+	return s.UploadQuotas[RateLimitDefault]
+}
+
+// stagedBytes returns the total size of the files in the upload area
+// created by the given user, including any still being uploaded.
+func (s *RESTServer) stagedBytes(user string) int64 {
+	return s.FileStore.Used(user)
+}
+
+// uploadCapacity returns the capacity report for the given user.
+func (s *RESTServer) uploadCapacity(user string) UploadCapacity {
+	result := UploadCapacity{
+		FreeBytes: -1,
+		Quota:     s.quotaFor(user),
+		Used:      s.stagedBytes(user),
+		Remaining: -1,
+	}
+	free, err := s.FileStore.FreeSpace()
+	if err == nil {
+		result.FreeBytes = free
+	} else if err != store.ErrNotSupported {
+		slog.Error("FreeSpace", "error", err)
+	}
+	if result.Quota > 0 {
+		result.Remaining = result.Quota - result.Used
+		if result.Remaining < 0 {
+			result.Remaining = 0
+		}
+	}
+	return result
+}
+
+// overQuota returns true if the given user uploading n more bytes would put
+// them over their quota. If n is negative, which means the size is not
+// known, it is only checked whether they are already at their quota. This
+// refuses uploads before they start; the upload store itself stops any
+// which go over the quota while they are being written.
+func (s *RESTServer) overQuota(user string, n int64) bool {
+	quota := s.quotaFor(user)
+	if quota <= 0 {
+		return false
+	}
+	if n < 0 {
+		n = 0
+	}
+	used := s.stagedBytes(user)
+	return used >= quota || used+n > quota
+}
+
+// UploadCapacityHandler handles requests to GET /upload/capacity
+func (s *RESTServer) UploadCapacityHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	writeHTMLorJSON(w, r, capacityTemplate, s.uploadCapacity(ps.ByName("username")))
+}
+
+// writeOverQuota sends a 507 response for an upload over the user's quota.
+func writeOverQuota(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusInsufficientStorage)
+	fmt.Fprintln(w, "Upload quota exceeded")
+}
+
+var (
+	capacityTemplate = template.Must(template.New("capacity").Parse(`<html>
+<h1>Upload Capacity</h1>
+<dl>
+<dt>Free Bytes</dt><dd>{{ if lt .FreeBytes 0 }}unknown{{ else }}{{ .FreeBytes }}{{ end }}</dd>
+<dt>Quota</dt><dd>{{ if eq .Quota 0 }}none{{ else }}{{ .Quota }}{{ end }}</dd>
+<dt>Used</dt><dd>{{ .Used }}</dd>
+<dt>Remaining</dt><dd>{{ if lt .Remaining 0 }}unlimited{{ else }}{{ .Remaining }}{{ end }}</dd>
+</dl>
+<a href="/upload">Back</a>
+</html>`))
+)
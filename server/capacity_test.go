@@ -0,0 +1,121 @@
+package server
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/ndlib/bendo/fragment"
+	"github.com/ndlib/bendo/store"
+)
+
+func TestUploadQuota(t *testing.T) {
+	s := &RESTServer{
+		FileStore:    fragment.New(store.NewMemory()),
+		UploadQuotas: map[string]int64{RateLimitDefault: 10, "bob": 0},
+	}
+	upload := func(user, fileid, content string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/upload/"+fileid, strings.NewReader(content))
+		h := md5.Sum([]byte(content))
+		r.Header.Set("X-Upload-Md5", hex.EncodeToString(h[:]))
+		s.AppendFileHandler(w, r, httprouter.Params{
+			{Key: "fileid", Value: fileid},
+			{Key: "username", Value: user},
+		})
+		return w.Code
+	}
+	capacity := func(user string) UploadCapacity {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/upload/capacity", nil)
+		r.Header.Set("Accept-Encoding", "application/json")
+		s.GetFileHandler(w, r, httprouter.Params{
+			{Key: "fileid", Value: capacityFileID},
+			{Key: "username", Value: user},
+		})
+		var result UploadCapacity
+		err := json.NewDecoder(w.Body).Decode(&result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	var tests = []struct {
+		user    string
+		fileid  string
+		content string
+		status  int
+	}{
+		{"alice", "a1", "123456", 200},
+		{"alice", "a2", "123456", 507}, // would be over quota
+		{"alice", "a2", "1234", 200},
+		{"alice", "a3", "1", 507}, // at quota
+		{"carol", "c1", "123456", 200},
+		{"bob", "b1", "123456789012", 200}, // no limit
+		{"bob", capacityFileID, "1", 400},
+	}
+	for _, test := range tests {
+		status := upload(test.user, test.fileid, test.content)
+		if status != test.status {
+			t.Errorf("%s uploading %s: received status %d, expected %d",
+				test.user, test.fileid, status, test.status)
+		}
+	}
+
+	c := capacity("alice")
+	expected := UploadCapacity{FreeBytes: -1, Quota: 10, Used: 10, Remaining: 0}
+	if c != expected {
+		t.Errorf("Received %+v, expected %+v", c, expected)
+	}
+	c = capacity("bob")
+	expected = UploadCapacity{FreeBytes: -1, Quota: 0, Used: 12, Remaining: -1}
+	if c != expected {
+		t.Errorf("Received %+v, expected %+v", c, expected)
+	}
+
+	// deleting a file frees its space
+	s.FileStore.Delete("a1")
+	if status := upload("alice", "a3", "1"); status != 200 {
+		t.Errorf("Received status %d, expected 200", status)
+	}
+}
+
+func TestUploadQuotaUnknownLength(t *testing.T) {
+	// an upload whose length is not given is stopped once it goes over
+	s := &RESTServer{
+		FileStore:    fragment.New(store.NewMemory()),
+		UploadQuotas: map[string]int64{RateLimitDefault: 10},
+	}
+	s.FileStore.SetQuota(s.quotaFor)
+	upload := func(fileid, content string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/upload/"+fileid, strings.NewReader(content))
+		r.ContentLength = -1
+		h := md5.Sum([]byte(content))
+		r.Header.Set("X-Upload-Md5", hex.EncodeToString(h[:]))
+		s.AppendFileHandler(w, r, httprouter.Params{
+			{Key: "fileid", Value: fileid},
+			{Key: "username", Value: "alice"},
+		})
+		return w.Code
+	}
+	if status := upload("a1", "123456"); status != 200 {
+		t.Errorf("Received status %d, expected 200", status)
+	}
+	if status := upload("a1", "123456"); status != 507 {
+		t.Errorf("Received status %d, expected 507", status)
+	}
+	f := s.FileStore.Lookup("a1")
+	if stat := f.Stat(); stat.Size != 6 || stat.NFragments != 1 {
+		t.Errorf("Received %+v, expected one fragment of 6 bytes", stat)
+	}
+	if n := s.stagedBytes("alice"); n != 6 {
+		t.Errorf("Received %d bytes used, expected 6", n)
+	}
+}
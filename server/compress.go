@@ -0,0 +1,183 @@
+package server
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// compressHandler returns a handler which compresses JSON and HTML
+// responses from handler with gzip or deflate, if the client says it can
+// accept them. Other responses, such as blob contents, and responses which
+// set a Content-Length, such as range requests, are passed through as is.
+func compressHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cw := &compressWriter{
+			ResponseWriter: w,
+			encoding:       chooseEncoding(r.Header.Get("Accept-Encoding")),
+			head:           r.Method == "HEAD",
+		}
+		defer cw.Close()
+		handler.ServeHTTP(cw, r)
+	})
+}
+
+// chooseEncoding returns the content encoding to use for a response, given
+// the Accept-Encoding header of the request. It returns "" if the response
+// should not be compressed. Since clients also use Accept-Encoding to ask
+// for JSON, values other than encodings are ignored.
+func chooseEncoding(accept string) string {
+	var best string
+	var bestq float64
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name != "gzip" && name != "deflate" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, _ = strconv.ParseFloat(param[2:], 64)
+			}
+		}
+		// a weight of 0 means not acceptable. Prefer gzip when the
+		// weights are the same.
+		if q > bestq || (q > 0 && q == bestq && name == "gzip") {
+			best, bestq = name, q
+		}
+	}
+	return best
+}
+
+// compressible returns true if a response with the given headers and status
+// code should be compressed.
+func compressible(h http.Header, status int) bool {
+	switch {
+	case status < 200, status == http.StatusNoContent,
+		status == http.StatusPartialContent, status == http.StatusNotModified:
+		return false
+	}
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Length") != "" ||
+		h.Get("Content-Range") != "" {
+		return false
+	}
+	mediatype, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	switch mediatype {
+	case "application/json", "text/html":
+		return true
+	}
+	return false
+}
+
+// A compressWriter decides whether to compress a response when the first
+// part of the body is written, since only then are the headers known.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string // the encoding the client accepts, or ""
+	head        bool   // true for HEAD requests, which have no body
+	status      int
+	wroteHeader bool
+	w           io.WriteCloser // the compressor, if compressing
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.wroteHeader || cw.status != 0 {
+		return
+	}
+	cw.status = status
+	if cw.head || status < 200 || status == http.StatusNoContent ||
+		status == http.StatusNotModified {
+		// there will be no body, so send the headers now.
+		cw.wroteHeader = true
+		cw.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.start(p)
+	}
+	if cw.w != nil {
+		return cw.w.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// ReadFrom passes copies through to the underlying ResponseWriter when the
+// response is not compressed, so a blob served from a file in the cache can
+// be sent by the kernel.
+func (cw *compressWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !cw.wroteHeader {
+		if cw.Header().Get("Content-Type") == "" {
+			// let Write guess the content type from the first part
+			return io.Copy(writerOnly{cw}, src)
+		}
+		cw.start(nil)
+	}
+	if cw.w != nil {
+		return io.Copy(cw.w, src)
+	}
+	return io.Copy(cw.ResponseWriter, src)
+}
+
+// writerOnly hides the ReadFrom method of a writer.
+type writerOnly struct{ io.Writer }
+
+// start sends the response headers, compressing the body if we can. p is
+// the first part of the body, used to guess the content type if the
+// handler did not set one.
+func (cw *compressWriter) start(p []byte) {
+	cw.wroteHeader = true
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	h := cw.Header()
+	if h.Get("Content-Type") == "" {
+		h.Set("Content-Type", http.DetectContentType(p))
+	}
+	if compressible(h, cw.status) {
+		h.Add("Vary", "Accept-Encoding")
+		switch cw.encoding {
+		case "gzip":
+			cw.w = gzip.NewWriter(cw.ResponseWriter)
+		case "deflate":
+			cw.w = zlib.NewWriter(cw.ResponseWriter)
+		}
+		if cw.w != nil {
+			h.Set("Content-Encoding", cw.encoding)
+		}
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+}
+
+// Flush sends any buffered data to the client.
+func (cw *compressWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.start(nil)
+	}
+	if f, ok := cw.w.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close finishes the response.
+func (cw *compressWriter) Close() error {
+	if !cw.wroteHeader && cw.status != 0 {
+		// the handler set a status but wrote no body
+		cw.wroteHeader = true
+		cw.ResponseWriter.WriteHeader(cw.status)
+	}
+	if cw.w != nil {
+		return cw.w.Close()
+	}
+	return nil
+}
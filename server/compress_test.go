@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChooseEncoding(t *testing.T) {
+	var tests = []struct {
+		accept string
+		expect string
+	}{
+		{"", ""},
+		{"application/json", ""},
+		{"gzip", "gzip"},
+		{"gzip, application/json", "gzip"},
+		{"deflate, gzip", "gzip"},
+		{"gzip;q=0.5, deflate", "deflate"},
+		{"gzip;q=0, br", ""},
+		{"GZIP", "gzip"},
+	}
+	for _, test := range tests {
+		result := chooseEncoding(test.accept)
+		if result != test.expect {
+			t.Errorf("%q: received %q, expected %q", test.accept, result, test.expect)
+		}
+	}
+}
+
+func TestCompressHandler(t *testing.T) {
+	payload := strings.Repeat(`{"Slot": "some/long/path/to/a/file.txt"}`, 100)
+	h := compressHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/json":
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, payload)
+		case "/html":
+			// content type is guessed
+			io.WriteString(w, "<html><body>"+payload+"</body></html>")
+		case "/blob":
+			// sets a Content-Length
+			w.Header().Set("Content-Type", "application/json")
+			http.ServeContent(w, r, "", time.Time{}, strings.NewReader(payload))
+		case "/status":
+			w.WriteHeader(404)
+		}
+	}))
+	var tests = []struct {
+		path     string
+		accept   string
+		encoding string
+		status   int
+	}{
+		{"/json", "gzip", "gzip", 200},
+		{"/json", "deflate", "deflate", 200},
+		{"/json", "", "", 200},
+		{"/html", "gzip", "gzip", 200},
+		{"/blob", "gzip", "", 200},
+		{"/status", "gzip", "", 404},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.path, nil)
+		r.Header.Set("Accept-Encoding", test.accept)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s %q: received status %d", test.path, test.accept, w.Code)
+		}
+		if enc := w.Header().Get("Content-Encoding"); enc != test.encoding {
+			t.Errorf("%s %q: received encoding %q, expected %q", test.path, test.accept, enc, test.encoding)
+		}
+		if test.status != 200 {
+			continue
+		}
+		var body io.Reader = w.Body
+		switch test.encoding {
+		case "gzip":
+			body, _ = gzip.NewReader(w.Body)
+		case "deflate":
+			body, _ = zlib.NewReader(w.Body)
+		}
+		content, err := ioutil.ReadAll(body)
+		if err != nil {
+			t.Errorf("%s %q: %s", test.path, test.accept, err)
+		}
+		if !bytes.Contains(content, []byte(payload)) {
+			t.Errorf("%s %q: received %q", test.path, test.accept, content)
+		}
+	}
+}
+
+func TestCompressedJSON(t *testing.T) {
+	req, err := http.NewRequest("GET", testServer.URL+"/upload", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip, application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Received Content-Encoding %q", resp.Header.Get("Content-Encoding"))
+	}
+	body, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list []interface{}
+	err = json.NewDecoder(body).Decode(&list)
+	if err != nil {
+		t.Error(err)
+	}
+}
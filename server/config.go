@@ -0,0 +1,19 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// ConfigHandler handles requests to GET /admin/config
+// It returns the configuration the server was started from, as given in
+// Config, so the settings of a running server can be checked without
+// access to its host. Secrets are expected to be removed already.
+func (s *RESTServer) ConfigHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.Config == nil {
+		NotImplementedHandler(w, r, ps)
+		return
+	}
+	writeJSON(w, s.Config)
+}
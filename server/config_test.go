@@ -0,0 +1,65 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConfigRoute(t *testing.T) {
+	v, _ := NewListValidatorString("root Admin secret\nreader Read readkey\n")
+	s := &RESTServer{
+		Validator:  v,
+		RouteRoles: map[string]Role{"GET /admin/config": RoleRead},
+		Config:     map[string]string{"StoreDir": "/tmp/store"},
+	}
+	ts := httptest.NewServer(s.addRoutes())
+	defer ts.Close()
+
+	var table = []struct {
+		key    string
+		status int
+	}{
+		{"", 401},
+		{"readkey", 200},
+		{"secret", 200},
+	}
+	for _, tab := range table {
+		req, _ := http.NewRequest("GET", ts.URL+"/admin/config", nil)
+		if tab.key != "" {
+			req.Header.Set("X-Api-Key", tab.key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tab.status {
+			t.Errorf("%q: received status %d, expected %d", tab.key, resp.StatusCode, tab.status)
+			continue
+		}
+		if tab.status != 200 {
+			continue
+		}
+		var config map[string]string
+		err = json.Unmarshal(body, &config)
+		if err != nil || config["StoreDir"] != "/tmp/store" {
+			t.Errorf("Received %q, %v", body, err)
+		}
+	}
+}
+
+func TestRouteNames(t *testing.T) {
+	found := false
+	for _, name := range RouteNames() {
+		if name == "GET /admin/config" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("GET /admin/config not in %v", RouteNames())
+	}
+}
@@ -0,0 +1,326 @@
+package server
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/ndlib/bendo/items"
+)
+
+// A Reindexer is a BlobDB which can throw away everything it has indexed
+// for an item and index it again from scratch. IndexItem only adds new
+// versions and updates a few blob fields, so it cannot repair every kind of
+// drift between the database and the item store.
+type Reindexer interface {
+	ReindexItem(item string, thisItem *items.Item) error
+}
+
+// A ConsistencyResult records the outcome of comparing the BlobDB entries
+// for an item against the item's metadata in the item store.
+type ConsistencyResult struct {
+	Item      string
+	Checked   time.Time
+	Problems  []string // empty if the database matches the item store
+	Reindexed bool     // true if the item was reindexed to fix the problems
+	Error     string   `json:",omitempty"` // set if the check could not be done
+}
+
+// consistencyState tracks the progress of the background consistency
+// checker.
+type consistencyState struct {
+	m        sync.Mutex
+	bookmark string              // where the next pass continues the walk of the item store
+	lastRun  time.Time           // when the last pass finished
+	recent   []ConsistencyResult // most recent results with problems or errors
+}
+
+// maxConsistencyResults is the number of results with problems to remember.
+const maxConsistencyResults = 100
+
+var (
+	xConsistencyChecked   = expvar.NewInt("consistency.check.count")
+	xConsistencyDrift     = expvar.NewInt("consistency.check.drift")
+	xConsistencyError     = expvar.NewInt("consistency.check.error")
+	xConsistencyReindexed = expvar.NewInt("consistency.reindex.count")
+)
+
+// StartConsistency starts the background goroutine which compares a rotating
+// sample of items in the BlobDB against the item store. It returns
+// immediately and does not block.
+func (s *RESTServer) StartConsistency() {
+	go func() {
+		slog.Info("Starting consistency checker")
+		for {
+			time.Sleep(s.ConsistencyInterval)
+			if s.useTape {
+				s.consistencyPass()
+			}
+		}
+	}()
+}
+
+// consistencyPass checks the next ConsistencySample items in the item store,
+// continuing from where the last pass stopped. When the end of the item list
+// is reached, the next pass starts over from the beginning.
+func (s *RESTServer) consistencyPass() {
+	s.consistency.m.Lock()
+	bookmark := s.consistency.bookmark
+	s.consistency.m.Unlock()
+
+	n := s.ConsistencySample
+	if n <= 0 {
+		n = 100
+	}
+	var checked int
+	bookmark, err := s.Items.Walk(bookmark, func(item items.WalkItem) error {
+		s.CheckConsistency(item.ID, s.ConsistencyReindex)
+		checked++
+		if checked >= n {
+			return items.ErrStopWalk
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("consistency pass", "error", err)
+		bookmark = ""
+	}
+
+	s.consistency.m.Lock()
+	s.consistency.bookmark = bookmark
+	s.consistency.lastRun = time.Now()
+	s.consistency.m.Unlock()
+}
+
+// CheckConsistency compares the BlobDB entries for the given item against
+// the item's metadata in the item store. If they differ and reindex is true,
+// the item is reindexed. Results with problems are logged and remembered
+// for the consistency report.
+func (s *RESTServer) CheckConsistency(id string, reindex bool) ConsistencyResult {
+	result := ConsistencyResult{Item: id, Checked: time.Now()}
+	xConsistencyChecked.Add(1)
+	// go around any metadata cache so we see what is in the database
+	db := s.BlobDB
+	if c, ok := db.(*BlobDBCache); ok {
+		db = c.BlobDB
+	}
+	item, err := s.Items.ItemFromStore(id)
+	if err == nil {
+		result.Problems, err = compareIndex(db, id, item)
+	}
+	if err != nil {
+		slog.Error("consistency", "item", id, "error", err)
+		raven.CaptureError(err, map[string]string{"id": id})
+		xConsistencyError.Add(1)
+		result.Error = err.Error()
+		s.rememberConsistency(result)
+		return result
+	}
+	if len(result.Problems) == 0 {
+		return result
+	}
+	xConsistencyDrift.Add(1)
+	slog.Warn("consistency: database differs from item store", "item", id, "problems", result.Problems)
+	raven.CaptureMessage("Database Drift", map[string]string{"id": id})
+	if reindex {
+		err = s.reindex(db, id, item)
+		if err != nil {
+			slog.Error("consistency reindex", "item", id, "error", err)
+			raven.CaptureError(err, map[string]string{"id": id})
+			result.Error = err.Error()
+		} else {
+			xConsistencyReindexed.Add(1)
+			result.Reindexed = true
+		}
+	}
+	s.rememberConsistency(result)
+	return result
+}
+
+// reindex rebuilds the database entries for an item, from scratch if the
+// database supports it.
+func (s *RESTServer) reindex(db BlobDB, id string, item *items.Item) error {
+	var err error
+	if r, ok := db.(Reindexer); ok {
+		err = r.ReindexItem(id, item)
+	} else {
+		err = db.IndexItem(id, item)
+	}
+	if c, ok := s.BlobDB.(*BlobDBCache); ok {
+		c.Invalidate(id)
+	}
+	return err
+}
+
+func (s *RESTServer) rememberConsistency(result ConsistencyResult) {
+	s.consistency.m.Lock()
+	defer s.consistency.m.Unlock()
+	s.consistency.recent = append(s.consistency.recent, result)
+	if len(s.consistency.recent) > maxConsistencyResults {
+		s.consistency.recent = s.consistency.recent[1:]
+	}
+}
+
+// compareIndex returns a list of the differences between the database
+// entries for the item id and the given item metadata. The list is empty if
+// they agree.
+func compareIndex(db BlobDB, id string, item *items.Item) ([]string, error) {
+	var problems []string
+	var maxblob int
+	for _, blob := range item.Blobs {
+		if int(blob.ID) > maxblob {
+			maxblob = int(blob.ID)
+		}
+		b, err := db.FindBlob(id, int(blob.ID))
+		if err != nil {
+			return nil, err
+		}
+		if b == nil {
+			problems = append(problems, fmt.Sprintf("blob %d missing from database", blob.ID))
+			continue
+		}
+		problems = append(problems, compareBlob(blob, b)...)
+	}
+	b, err := db.FindBlob(id, maxblob+1)
+	if err != nil {
+		return nil, err
+	}
+	if b != nil {
+		problems = append(problems, fmt.Sprintf("database has blob %d not in item", maxblob+1))
+	}
+	for i, v := range item.Versions {
+		check := []int{int(v.ID)}
+		if i == len(item.Versions)-1 {
+			check = append(check, 0) // also check the current version
+		}
+		for _, vid := range check {
+			for slot, bid := range v.Slots {
+				b, err := db.FindBlobBySlot(id, vid, slot)
+				if err != nil {
+					return nil, err
+				}
+				switch {
+				case b == nil:
+					problems = append(problems, fmt.Sprintf("version %d slot %q missing from database", vid, slot))
+				case b.ID != bid:
+					problems = append(problems, fmt.Sprintf("version %d slot %q is blob %d in database, expected %d", vid, slot, b.ID, bid))
+				}
+			}
+		}
+	}
+	return problems, nil
+}
+
+// compareBlob returns the differences between the blob metadata in the item
+// store and the blob metadata in the database.
+func compareBlob(want, got *items.Blob) []string {
+	var problems []string
+	diff := func(field string, w, g interface{}) {
+		problems = append(problems, fmt.Sprintf("blob %d %s is %v in database, expected %v", want.ID, field, g, w))
+	}
+	if got.Size != want.Size {
+		diff("size", want.Size, got.Size)
+	}
+	if got.Bundle != want.Bundle {
+		diff("bundle", want.Bundle, got.Bundle)
+	}
+	if got.Creator != want.Creator {
+		diff("creator", want.Creator, got.Creator)
+	}
+	if got.MimeType != want.MimeType {
+		diff("mimetype", want.MimeType, got.MimeType)
+	}
+	if !bytes.Equal(got.MD5, want.MD5) {
+		diff("md5", fmt.Sprintf("%x", want.MD5), fmt.Sprintf("%x", got.MD5))
+	}
+	if !bytes.Equal(got.SHA256, want.SHA256) {
+		diff("sha256", fmt.Sprintf("%x", want.SHA256), fmt.Sprintf("%x", got.SHA256))
+	}
+	if got.DeleteDate.IsZero() != want.DeleteDate.IsZero() {
+		diff("deleted", !want.DeleteDate.IsZero(), !got.DeleteDate.IsZero())
+	}
+	if got.Deleter != want.Deleter {
+		diff("deleter", want.Deleter, got.Deleter)
+	}
+	return problems
+}
+
+// A ConsistencyReport lists the recent consistency checks which found
+// problems.
+type ConsistencyReport struct {
+	Enabled  bool
+	Interval time.Duration
+	Sample   int
+	Reindex  bool
+	LastRun  time.Time
+	Results  []ConsistencyResult // most recent first
+}
+
+// ConsistencyHandler handles requests to GET /admin/consistency
+func (s *RESTServer) ConsistencyHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	report := ConsistencyReport{
+		Enabled:  s.ConsistencyInterval > 0,
+		Interval: s.ConsistencyInterval,
+		Sample:   s.ConsistencySample,
+		Reindex:  s.ConsistencyReindex,
+	}
+	s.consistency.m.Lock()
+	report.LastRun = s.consistency.lastRun
+	for i := len(s.consistency.recent) - 1; i >= 0; i-- {
+		report.Results = append(report.Results, s.consistency.recent[i])
+	}
+	s.consistency.m.Unlock()
+	writeHTMLorJSON(w, r, consistencyTemplate, report)
+}
+
+// CheckConsistencyHandler handles requests to POST /admin/consistency/:id
+// It checks the given item now. If the parameter "reindex" is "true" the
+// item is reindexed if it has problems.
+func (s *RESTServer) CheckConsistencyHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := ps.ByName("id")
+	result := s.CheckConsistency(id, r.FormValue("reindex") == "true")
+	if result.Error != "" && len(result.Problems) == 0 {
+		w.WriteHeader(500)
+	}
+	writeHTMLorJSON(w, r, consistencyResultTemplate, result)
+}
+
+var (
+	consistencyTemplate = template.Must(template.New("consistency").Parse(`<html>
+<h1>Database Consistency</h1>
+<dl>
+<dt>Background Check</dt><dd>{{ if .Enabled }}every {{ .Interval }}, {{ .Sample }} items{{ if .Reindex }}, reindexing{{ end }}{{ else }}disabled{{ end }}</dd>
+<dt>Last Run</dt><dd>{{ if .LastRun.IsZero }}never{{ else }}{{ .LastRun }}{{ end }}</dd>
+</dl>
+<h2>Recent Problems</h2>
+<table><thead><tr>
+	<th>Item</th><th>Checked</th><th>Problems</th><th>Reindexed</th>
+</tr></thead><tbody>
+{{ range .Results }}
+	<tr>
+		<td><a href="/item/{{ .Item }}">{{ .Item }}</a></td>
+		<td>{{ .Checked }}</td>
+		<td>{{ range .Problems }}{{ . }}<br/>{{ end }}{{ .Error }}</td>
+		<td>{{ .Reindexed }}</td>
+	</tr>
+{{ end }}
+</tbody></table>
+</html>`))
+
+	consistencyResultTemplate = template.Must(template.New("consistencyresult").Parse(`<html>
+<h1>Consistency of {{ .Item }}</h1>
+{{ if .Error }}<p>Error: {{ .Error }}</p>{{ end }}
+{{ if .Problems }}
+<ul>{{ range .Problems }}<li>{{ . }}</li>{{ end }}</ul>
+{{ if .Reindexed }}<p>The item was reindexed.</p>{{ end }}
+{{ else }}{{ if not .Error }}<p>The database matches the item store.</p>{{ end }}{{ end }}
+</html>`))
+)
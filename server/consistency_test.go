@@ -0,0 +1,83 @@
+package server
+
+import (
+	"encoding/json"
+	"path"
+	"testing"
+
+	"github.com/ndlib/bendo/items"
+)
+
+func TestCompareIndex(t *testing.T) {
+	qc, err := NewQlCache("mem--consistency")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testitem := &items.Item{
+		ID:        "abcd",
+		MaxBundle: 1,
+		Blobs: []*items.Blob{
+			&items.Blob{ID: 1, Size: 5, Bundle: 1, MD5: []byte{1, 2}},
+			&items.Blob{ID: 2, Size: 10, Bundle: 1, MD5: []byte{3, 4}},
+		},
+		Versions: []*items.Version{
+			&items.Version{ID: 1, Slots: map[string]items.BlobID{"a": 1}},
+			&items.Version{ID: 2, Slots: map[string]items.BlobID{"a": 1, "b": 2}},
+		},
+	}
+	const itemid = "abcd"
+	qc.IndexItem(itemid, testitem)
+
+	problems, err := compareIndex(qc, itemid, testitem)
+	if err != nil || len(problems) != 0 {
+		t.Fatal("Received", problems, err)
+	}
+
+	// introduce drift that IndexItem will not repair
+	_, err = performExec(qc.db, `UPDATE blobs SET size = 99 WHERE item == ?1 AND blobid == 2`, itemid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = performExec(qc.db, `DELETE FROM slots WHERE item == ?1 AND name == "b"`, itemid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	qc.IndexItem(itemid, testitem)
+	problems, err = compareIndex(qc, itemid, testitem)
+	t.Log(problems)
+	// size of blob 2, and slot "b" in both version 2 and the current version
+	if err != nil || len(problems) != 3 {
+		t.Fatal("Received", problems, err)
+	}
+
+	err = qc.ReindexItem(itemid, testitem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	problems, err = compareIndex(qc, itemid, testitem)
+	if err != nil || len(problems) != 0 {
+		t.Fatal("Received", problems, err)
+	}
+}
+
+func TestConsistencyRoute(t *testing.T) {
+	file1 := uploadstring(t, "POST", "/upload", "hello consistency")
+	itemid := "consistent" + randomid()
+	txpath := sendtransaction(t, "/item/"+itemid+"/transaction",
+		[][]string{{"add", path.Base(file1)}, {"slot", "a", path.Base(file1)}}, 202)
+	waitTransaction(t, txpath)
+
+	body := getbody(t, "POST", "/admin/consistency/"+itemid, 200)
+	var result ConsistencyResult
+	err := json.Unmarshal([]byte(body), &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Item != itemid || len(result.Problems) != 0 || result.Error != "" {
+		t.Errorf("Received %#v", result)
+	}
+
+	// an item not in the store is an error
+	checkStatus(t, "POST", "/admin/consistency/nosuchitem"+randomid(), 500)
+	checkStatus(t, "GET", "/admin/consistency", 200)
+}
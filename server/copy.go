@@ -0,0 +1,33 @@
+package server
+
+import (
+	"io"
+	"sync"
+)
+
+// copyBuffers hands out copy buffers of one size, reusing them between
+// copies.
+type copyBuffers struct {
+	once sync.Once
+	pool sync.Pool
+}
+
+// copy copies src to dst using a buffer of the given size. If size is not
+// positive, io.Copy is used with its default buffer. In either case, if src
+// has a WriteTo method or dst has a ReadFrom method, it is used instead of a
+// buffer, which for files and network connections lets the kernel do the
+// copy (using copy_file_range, sendfile, or splice on Linux).
+func (cb *copyBuffers) copy(dst io.Writer, src io.Reader, size int) (int64, error) {
+	if size <= 0 {
+		return io.Copy(dst, src)
+	}
+	cb.once.Do(func() {
+		cb.pool.New = func() interface{} {
+			b := make([]byte, size)
+			return &b
+		}
+	})
+	bp := cb.pool.Get().(*[]byte)
+	defer cb.pool.Put(bp)
+	return io.CopyBuffer(dst, src, *bp)
+}
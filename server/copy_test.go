@@ -0,0 +1,163 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ndlib/bendo"
+	"github.com/ndlib/bendo/blobcache"
+	"github.com/ndlib/bendo/items"
+	"github.com/ndlib/bendo/store"
+)
+
+// onlyReader and onlyWriter hide any WriteTo or ReadFrom methods, so a copy
+// has to use a buffer.
+type onlyReader struct{ io.Reader }
+type onlyWriter struct{ io.Writer }
+
+func TestCopyBuffers(t *testing.T) {
+	data := testBlob(1000000)
+	for _, size := range []int{0, 1000, 1 << 20} {
+		var cb copyBuffers
+		for i := 0; i < 2; i++ {
+			var out bytes.Buffer
+			n, err := cb.copy(onlyWriter{&out}, onlyReader{bytes.NewReader(data)}, size)
+			if err != nil || n != int64(len(data)) || !bytes.Equal(out.Bytes(), data) {
+				t.Errorf("size %d: received %d, %v", size, n, err)
+			}
+		}
+	}
+}
+
+func TestFastCopy(t *testing.T) {
+	dir := t.TempDir()
+	c := blobcache.NewLRU(store.NewFileSystem(dir), 1<<20)
+	w, err := c.Put("item+0001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("hello fast copy"))
+	w.Close()
+	for _, fast := range []bool{false, true} {
+		s := &RESTServer{Cache: c, FastCopy: fast}
+		content, err := s.findContent("item+0001", "item", &items.Blob{ID: 1}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, isfile := content.r.(*os.File)
+		got, _ := io.ReadAll(content.r)
+		content.r.Close()
+		if isfile != fast || string(got) != "hello fast copy" {
+			t.Errorf("FastCopy %v: received file %v, %q", fast, isfile, got)
+		}
+	}
+}
+
+// readFromRecorder records the source of any copy done with ReadFrom.
+type readFromRecorder struct {
+	*httptest.ResponseRecorder
+	src io.Reader
+}
+
+func (rr *readFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	rr.src = src
+	return io.Copy(onlyWriter{rr.ResponseRecorder}, src)
+}
+
+func TestFastCopyHandler(t *testing.T) {
+	db, err := NewQlCache("mem--fastcopy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &RESTServer{
+		Validator: NobodyValidator{},
+		Items:     items.NewWithCache(store.NewMemory(), db),
+		BlobDB:    db,
+		Cache:     blobcache.NewLRU(store.NewFileSystem(t.TempDir()), 1<<20),
+		FastCopy:  true,
+	}
+	const content = "hello fast copy"
+	w, err := s.Items.Open("fast", "nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bid, _ := w.WriteBlob(strings.NewReader(content), int64(len(content)), nil, nil)
+	w.SetSlot("a", bid)
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cw, err := s.Cache.Put(bendo.CacheKey("fast", bid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cw.Write([]byte(content))
+	cw.Close()
+
+	handler := s.addRoutes()
+	for _, accept := range []string{"", "gzip"} {
+		req := httptest.NewRequest("GET", "/item/fast/a", nil)
+		req.Header.Set("Accept-Encoding", accept)
+		rr := &readFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+		handler.ServeHTTP(rr, req)
+		if rr.Code != 200 || rr.Body.String() != content {
+			t.Errorf("Accept-Encoding %q: received %d, %q", accept, rr.Code, rr.Body.String())
+		}
+		// ServeContent limits the copy to the length of the blob
+		src := rr.src
+		if lr, ok := src.(*io.LimitedReader); ok {
+			src = lr.R
+		}
+		if _, ok := src.(*os.File); !ok {
+			t.Errorf("Accept-Encoding %q: copied from %T, expected a file", accept, rr.src)
+		}
+	}
+}
+
+// The copy benchmarks compare buffer sizes for copies which cannot avoid a
+// buffer (as from a bundle on tape into the cache), and the kernel copy
+// between two files that io.Copy does by itself.
+
+func BenchmarkCopyBuffer(b *testing.B) {
+	data := testBlob(64 << 20)
+	for _, size := range []int{0, 256 << 10, 1 << 20, 4 << 20} {
+		b.Run(fmt.Sprintf("%dK", size>>10), func(b *testing.B) {
+			var cb copyBuffers
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				cb.copy(onlyWriter{io.Discard}, onlyReader{bytes.NewReader(data)}, size)
+			}
+		})
+	}
+}
+
+func BenchmarkCopyFile(b *testing.B) {
+	dir := b.TempDir()
+	src := filepath.Join(dir, "src")
+	data := testBlob(64 << 20)
+	if err := os.WriteFile(src, data, 0644); err != nil {
+		b.Fatal(err)
+	}
+	copyFile := func(b *testing.B, fast bool) {
+		b.SetBytes(int64(len(data)))
+		var cb copyBuffers
+		for i := 0; i < b.N; i++ {
+			in, _ := os.Open(src)
+			out, _ := os.Create(filepath.Join(dir, "dst"))
+			if fast {
+				cb.copy(out, in, 0)
+			} else {
+				cb.copy(onlyWriter{out}, onlyReader{in}, 1<<20)
+			}
+			in.Close()
+			out.Close()
+		}
+	}
+	b.Run("buffered", func(b *testing.B) { copyFile(b, false) })
+	b.Run("kernel", func(b *testing.B) { copyFile(b, true) })
+}
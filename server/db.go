@@ -1,7 +1,11 @@
 package server
 
 import (
-	"log"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log/slog"
+	"strings"
 
 	"github.com/BurntSushi/migration"
 )
@@ -23,8 +27,7 @@ func (d dbVersion) Get(tx migration.LimitedTx) (int, error) {
 	v, err := d.get(tx)
 	if err != nil {
 		// we assume error means there is no migration table
-		log.Println(err.Error())
-		log.Println("Assuming this is because there is no migration table, yet")
+		slog.Warn("Assuming this is because there is no migration table, yet", "error", err)
 		return 0, nil
 	}
 	return v, nil
@@ -61,3 +64,95 @@ func (d dbVersion) createTable(tx migration.LimitedTx) error {
 	}
 	return err
 }
+
+// CheckQlSchema checks the QL database in the given file without
+// migrating it. It returns an error if the database cannot be opened or if
+// its schema is newer than this version of bendo knows about. Older schemas
+// are not an error since they are migrated when the database is opened.
+func CheckQlSchema(filename string) error {
+	_, err := PlanQlMigrations(filename)
+	return err
+}
+
+// CheckMysqlSchema is like CheckQlSchema, but checks a MySQL database.
+// Only the Timeout field of opts is used.
+func CheckMysqlSchema(dial string, opts DBOptions) error {
+	_, err := PlanMysqlMigrations(dial, opts)
+	return err
+}
+
+// A MigrationPlan lists the schema migrations opening a database would
+// apply. It is empty if the database is up to date.
+type MigrationPlan struct {
+	From       int      // the current schema version
+	To         int      // the schema version after migrating
+	Statements []string // the SQL which would be run, in order
+}
+
+// PlanQlMigrations returns the migrations opening the QL database in the
+// given file would apply, without changing the database. It is an error
+// if the database schema is newer than this version of bendo knows about.
+func PlanQlMigrations(filename string) (MigrationPlan, error) {
+	driver := "ql"
+	if strings.HasPrefix(filename, "mem--") {
+		driver = "ql-mem"
+	}
+	return planMigrations(driver, filename, qlVersioning, qlMigrations)
+}
+
+// PlanMysqlMigrations is like PlanQlMigrations, but for a MySQL database.
+// Only the Timeout field of opts is used.
+func PlanMysqlMigrations(dial string, opts DBOptions) (MigrationPlan, error) {
+	dial, err := applyTimeout(dial, opts.Timeout)
+	if err != nil {
+		return MigrationPlan{}, err
+	}
+	return planMigrations("mysql", dial, mysqlVersioning, mysqlMigrations)
+}
+
+// planMigrations finds the schema version of a database and collects the
+// SQL the migrations after that version would run.
+func planMigrations(driver string, location string, versioning dbVersion, migrations []migration.Migrator) (MigrationPlan, error) {
+	var plan MigrationPlan
+	db, err := sql.Open(driver, location)
+	if err != nil {
+		return plan, err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return plan, err
+	}
+	defer tx.Rollback()
+	plan.From, err = versioning.get(tx)
+	if err != nil {
+		// no version table means a new database
+		plan.From = 0
+	}
+	plan.To = len(migrations)
+	if plan.From > plan.To {
+		return plan, fmt.Errorf("database schema is version %d, but this bendo only knows up to version %d", plan.From, plan.To)
+	}
+	rec := &recordTx{}
+	for _, m := range migrations[plan.From:] {
+		err = m(rec)
+		if err != nil {
+			return plan, err
+		}
+	}
+	plan.Statements = rec.statements
+	return plan, nil
+}
+
+// A recordTx saves the statements passed to Exec instead of running them.
+// The migrations only use Exec, so the other methods are not implemented
+// and will panic if called.
+type recordTx struct {
+	migration.LimitedTx
+	statements []string
+}
+
+func (r *recordTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	r.statements = append(r.statements, query)
+	return driver.RowsAffected(0), nil
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"expvar"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// DBOptions configures the connection pool of an external database.
+// Zero values leave the defaults in place.
+type DBOptions struct {
+	MaxOpenConns int // most connections open at once, 0 is unlimited
+	MaxIdleConns int // most idle connections kept, 0 uses the default of 2
+
+	// ConnMaxLifetime is how long a connection is reused before being
+	// closed and redialed. Keeping it shorter than the server's
+	// wait_timeout avoids errors from connections the server has dropped.
+	// Defaults to DefaultConnMaxLifetime.
+	ConnMaxLifetime time.Duration
+
+	// Timeout bounds how long to wait when connecting to the database and
+	// when reading or writing to it, so a stalled database gives errors
+	// instead of hanging requests. It is only used if the dial string does
+	// not set the timeout, readTimeout, or writeTimeout parameters.
+	Timeout time.Duration
+
+	// Queries taking longer than SlowQuery are logged. 0 disables this.
+	SlowQuery time.Duration
+
+	// MigrationLockTimeout is how long to wait for another process to
+	// finish migrating the schema. Defaults to DefaultMigrationLockTimeout.
+	MigrationLockTimeout time.Duration
+}
+
+// DefaultMigrationLockTimeout is the migration lock timeout used if none
+// is given.
+const DefaultMigrationLockTimeout = 10 * time.Minute
+
+// DefaultConnMaxLifetime is the connection lifetime used if none is given.
+const DefaultConnMaxLifetime = 5 * time.Minute
+
+var (
+	xDBQueryCount = expvar.NewInt("db.query.count")
+	xDBSlowCount  = expvar.NewInt("db.query.slow")
+	xDBErrorCount = expvar.NewInt("db.query.error")
+	xDBRetryCount = expvar.NewInt("db.query.retry")
+)
+
+// the pool statistics of the most recently opened database are published
+// under "db.pool".
+var (
+	poolM    sync.Mutex
+	poolDB   *sql.DB
+	poolOnce sync.Once
+)
+
+// publishPoolStats makes the connection pool statistics for db available
+// through expvar.
+func publishPoolStats(db *sql.DB) {
+	poolM.Lock()
+	poolDB = db
+	poolM.Unlock()
+	poolOnce.Do(func() {
+		expvar.Publish("db.pool", expvar.Func(func() interface{} {
+			poolM.Lock()
+			defer poolM.Unlock()
+			if poolDB == nil {
+				return nil
+			}
+			stats := poolDB.Stats()
+			return map[string]interface{}{
+				"MaxOpenConnections": stats.MaxOpenConnections,
+				"OpenConnections":    stats.OpenConnections,
+				"InUse":              stats.InUse,
+				"Idle":               stats.Idle,
+				"WaitCount":          stats.WaitCount,
+				"WaitSeconds":        stats.WaitDuration.Seconds(),
+				"MaxIdleClosed":      stats.MaxIdleClosed,
+				"MaxLifetimeClosed":  stats.MaxLifetimeClosed,
+			}
+		}))
+	})
+}
+
+// applyTimeout adds the given timeout to a MySQL dial string, unless the dial
+// string already has timeouts of its own.
+func applyTimeout(dial string, timeout time.Duration) (string, error) {
+	if timeout == 0 {
+		return dial, nil
+	}
+	cfg, err := mysql.ParseDSN(dial)
+	if err != nil {
+		return "", err
+	}
+	if cfg.Timeout != 0 || cfg.ReadTimeout != 0 || cfg.WriteTimeout != 0 {
+		return dial, nil
+	}
+	cfg.Timeout = timeout
+	cfg.ReadTimeout = timeout
+	cfg.WriteTimeout = timeout
+	return cfg.FormatDSN(), nil
+}
+
+// A timedDB wraps a database handle to count queries, log slow ones, and
+// retry a query once if it failed because its connection had gone bad.
+// Statements changing the database are not retried, since they may have run
+// before the error. Statements run inside a transaction are not wrapped.
+type timedDB struct {
+	*sql.DB
+	slow time.Duration // 0 to not log slow queries
+}
+
+// isBadConn returns true if err means the connection was unusable.
+// database/sql already retries driver.ErrBadConn, but the MySQL driver
+// returns ErrInvalidConn when it finds a connection closed by the server.
+func isBadConn(err error) bool {
+	return err == mysql.ErrInvalidConn || err == driver.ErrBadConn
+}
+
+// Exec runs a statement.
+func (db *timedDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	result, err := db.DB.Exec(query, args...)
+	db.finish(start, query, err)
+	return result, err
+}
+
+// Query runs a query, retrying once on a bad connection.
+func (db *timedDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	start := time.Now()
+	rows, err := db.DB.Query(query, args...)
+	if isBadConn(err) {
+		xDBRetryCount.Add(1)
+		rows, err = db.DB.Query(query, args...)
+	}
+	db.finish(start, query, err)
+	return rows, err
+}
+
+// QueryRow runs a query expected to return at most one row, retrying once
+// on a bad connection.
+func (db *timedDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	start := time.Now()
+	row := db.DB.QueryRow(query, args...)
+	if isBadConn(row.Err()) {
+		xDBRetryCount.Add(1)
+		row = db.DB.QueryRow(query, args...)
+	}
+	db.finish(start, query, row.Err())
+	return row
+}
+
+// finish records the metrics for a statement started at the given time.
+func (db *timedDB) finish(start time.Time, query string, err error) {
+	xDBQueryCount.Add(1)
+	if err != nil {
+		xDBErrorCount.Add(1)
+	}
+	elapsed := time.Now().Sub(start)
+	if db.slow > 0 && elapsed >= db.slow {
+		xDBSlowCount.Add(1)
+		slog.Warn("Slow query", "duration", elapsed, "query", query)
+	}
+}
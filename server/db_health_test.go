@@ -0,0 +1,60 @@
+package server
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestApplyTimeout(t *testing.T) {
+	var table = []struct {
+		dial   string
+		output string
+	}{
+		{"/bendo", "tcp(127.0.0.1:3306)/bendo?readTimeout=5s&timeout=5s&writeTimeout=5s"},
+		{"user:pw@tcp(db:3306)/bendo", "user:pw@tcp(db:3306)/bendo?readTimeout=5s&timeout=5s&writeTimeout=5s"},
+		{"/bendo?readTimeout=1s", "/bendo?readTimeout=1s"},
+	}
+	for _, tab := range table {
+		result, err := applyTimeout(tab.dial, 5*time.Second)
+		if err != nil {
+			t.Errorf("%s: received %s", tab.dial, err)
+			continue
+		}
+		if result != tab.output {
+			t.Errorf("%s: received %s, expected %s", tab.dial, result, tab.output)
+		}
+	}
+	result, _ := applyTimeout("/bendo", 0)
+	if result != "/bendo" {
+		t.Errorf("received %s, expected /bendo", result)
+	}
+}
+
+func TestTimedDB(t *testing.T) {
+	qc, err := NewQlCache("mem--timeddb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qc.db.Close()
+	db := &timedDB{DB: qc.db, slow: time.Nanosecond}
+
+	before := xDBQueryCount.Value()
+	slow := xDBSlowCount.Value()
+	var n int
+	err = db.QueryRow(`SELECT size FROM items`).Scan(&n)
+	if err != nil && err != sql.ErrNoRows {
+		t.Error(err)
+	}
+	rows, err := db.Query(`SELECT size FROM items`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+	if xDBQueryCount.Value() != before+2 {
+		t.Errorf("query count went from %d to %d", before, xDBQueryCount.Value())
+	}
+	if xDBSlowCount.Value() != slow+2 {
+		t.Errorf("slow count went from %d to %d", slow, xDBSlowCount.Value())
+	}
+}
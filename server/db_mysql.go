@@ -2,9 +2,11 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
-	"log"
+	"fmt"
+	"log/slog"
 	"strings"
 	"time"
 
@@ -22,12 +24,21 @@ import (
 // MsqlCache implements the items.ItemCache interface and the FixityDB interface
 // using MySQL as the backing store.
 type MsqlCache struct {
-	db *sql.DB
+	db *timedDB
 }
 
 var _ items.ItemCache = &MsqlCache{}
 var _ FixityDB = &MsqlCache{}
 var _ BlobDB = &MsqlCache{}
+var _ IdentifierDB = &MsqlCache{}
+var _ AccessDB = &MsqlCache{}
+var _ UsageDB = &MsqlCache{}
+var _ TombstoneDB = &MsqlCache{}
+var _ TokenDB = &MsqlCache{}
+var _ AuditDB = &MsqlCache{}
+var _ EventDB = &MsqlCache{}
+var _ Reindexer = &MsqlCache{}
+var _ MintDB = &MsqlCache{}
 
 // List of migrations to perform. Add new ones to the end.
 // DO NOT change the order of items already in this list.
@@ -36,6 +47,21 @@ var mysqlMigrations = []migration.Migrator{
 	mysqlschema2,
 	mysqlschema3,
 	mysqlschema4,
+	mysqlschema5,
+	mysqlschema6,
+	mysqlschema7,
+	mysqlschema8,
+	mysqlschema9,
+	mysqlschema10,
+	mysqlschema11,
+	mysqlschema12,
+	mysqlschema13,
+	mysqlschema14,
+	mysqlschema15,
+	mysqlschema16,
+	mysqlschema17,
+	mysqlschema18,
+	mysqlschema19,
 }
 
 // Adapt the schema versioning for MySQL
@@ -49,6 +75,24 @@ var mysqlVersioning = dbVersion{
 // NewMysqlCache connects to a MySQL database and returns an item satisifying
 // both the ItemCache and FixityDB interfaces.
 func NewMysqlCache(dial string) (*MsqlCache, error) {
+	return NewMysqlCacheOptions(dial, DBOptions{})
+}
+
+// NewMysqlCacheOptions is like NewMysqlCache, but uses the given options to
+// configure the connection pool.
+func NewMysqlCacheOptions(dial string, opts DBOptions) (*MsqlCache, error) {
+	dial, err := applyTimeout(dial, opts.Timeout)
+	if err != nil {
+		slog.Error("Open Mysql", "error", err)
+		return nil, err
+	}
+	// keep other bendo processes from migrating the schema at the same time
+	unlock, err := lockMysqlMigrations(dial, opts.MigrationLockTimeout)
+	if err != nil {
+		slog.Error("Open Mysql", "error", err)
+		return nil, err
+	}
+	defer unlock()
 	db, err := migration.OpenWith(
 		"mysql",
 		dial,
@@ -56,10 +100,58 @@ func NewMysqlCache(dial string) (*MsqlCache, error) {
 		mysqlVersioning.Get,
 		mysqlVersioning.Set)
 	if err != nil {
-		log.Println("Open Mysql", err)
+		slog.Error("Open Mysql", "error", err)
 		return nil, err
 	}
-	return &MsqlCache{db: db}, nil
+	if opts.ConnMaxLifetime == 0 {
+		opts.ConnMaxLifetime = DefaultConnMaxLifetime
+	}
+	db.SetMaxOpenConns(opts.MaxOpenConns)
+	if opts.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(opts.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(opts.ConnMaxLifetime)
+	publishPoolStats(db)
+	return &MsqlCache{db: &timedDB{DB: db, slow: opts.SlowQuery}}, nil
+}
+
+// the name of the MySQL lock held while migrating the schema
+const mysqlMigrationLock = "bendo_migration"
+
+// lockMysqlMigrations takes a MySQL named lock, waiting up to the given
+// timeout, so only one process migrates the schema at a time. Named locks
+// belong to a connection, so the lock has a connection of its own. The
+// returned function releases the lock.
+func lockMysqlMigrations(dial string, timeout time.Duration) (func(), error) {
+	if timeout == 0 {
+		timeout = DefaultMigrationLockTimeout
+	}
+	db, err := sql.Open("mysql", dial)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	var got sql.NullInt64
+	err = conn.QueryRowContext(ctx, `SELECT GET_LOCK(?, ?)`,
+		mysqlMigrationLock, int(timeout.Seconds())).Scan(&got)
+	if err == nil && got.Int64 != 1 {
+		err = fmt.Errorf("timed out waiting for lock %s held by another migration", mysqlMigrationLock)
+	}
+	if err != nil {
+		conn.Close()
+		db.Close()
+		return nil, err
+	}
+	return func() {
+		conn.ExecContext(ctx, `SELECT RELEASE_LOCK(?)`, mysqlMigrationLock)
+		conn.Close()
+		db.Close()
+	}, nil
 }
 
 // Lookup returns a cached Item, if one exists in the database.
@@ -72,7 +164,7 @@ func (ms *MsqlCache) Lookup(id string) *items.Item {
 	if err != nil {
 		if err != sql.ErrNoRows {
 			// some kind of error...treat it as a miss
-			log.Println("Item Cache: ", err)
+			slog.Error("Item Cache", "item", id, "error", err)
 			raven.CaptureError(err, nil)
 		}
 		return nil
@@ -81,7 +173,7 @@ func (ms *MsqlCache) Lookup(id string) *items.Item {
 	var thisItem = new(items.Item)
 	err = json.Unmarshal([]byte(value), thisItem)
 	if err != nil {
-		log.Println("Item Cache: error in lookup:", err)
+		slog.Error("Item Cache: error in lookup", "item", id, "error", err)
 		raven.CaptureError(err, nil)
 		return nil
 	}
@@ -101,7 +193,7 @@ func (ms *MsqlCache) Set(id string, thisItem *items.Item) {
 	}
 	value, err := json.Marshal(thisItem)
 	if err != nil {
-		log.Println("Item Cache:", err)
+		slog.Error("Item Cache", "item", id, "error", err)
 		raven.CaptureError(err, nil)
 		return
 	}
@@ -109,7 +201,7 @@ func (ms *MsqlCache) Set(id string, thisItem *items.Item) {
 
 	_, err = ms.db.Exec(stmt, id, created, modified, size, value, created, modified, size, value)
 	if err != nil {
-		log.Printf("Item Cache: %s", err.Error())
+		slog.Error("Item Cache", "item", id, "error", err)
 		return
 	}
 	ms.IndexItem(id, thisItem)
@@ -158,7 +250,7 @@ func (ms *MsqlCache) getMaxBlob(item string) (int, error) {
 	return 0, err
 }
 
-func (ms *MsqlCache) getMaxVersion(item string) (int, error) {
+func (ms *MsqlCache) FindMaxVersion(item string) (int, error) {
 	const maxversion = `
 			SELECT max(versionid)
 			FROM versions
@@ -178,7 +270,7 @@ func (ms *MsqlCache) getMaxVersion(item string) (int, error) {
 func (ms *MsqlCache) FindBlobBySlot(item string, version int, slot string) (*items.Blob, error) {
 	if version == 0 {
 		var err error
-		version, err = ms.getMaxVersion(item)
+		version, err = ms.FindMaxVersion(item)
 		if err != nil || version == 0 {
 			return nil, err
 		}
@@ -200,8 +292,8 @@ func (ms *MsqlCache) FindBlobBySlot(item string, version int, slot string) (*ite
 	return ms.FindBlob(item, bid)
 }
 
-func (ms *MsqlCache) GetItemList(offset int, pagesize int, sortorder string) ([]SimpleItem, error) {
-	query, args := buildItemListQuery(offset, pagesize, sortorder)
+func (ms *MsqlCache) GetItemList(offset int, pagesize int, sortorder string, creator string) ([]SimpleItem, error) {
+	query, args := buildItemListQuery(offset, pagesize, sortorder, creator)
 	var results []SimpleItem
 
 	rows, err := ms.db.Query(query, args...)
@@ -209,7 +301,7 @@ func (ms *MsqlCache) GetItemList(offset int, pagesize int, sortorder string) ([]
 		// no next record
 		return results, nil
 	} else if err != nil {
-		log.Println("GetItemList Query MySQL", err)
+		slog.Error("GetItemList Query MySQL", "error", err)
 		raven.CaptureError(err, nil)
 		return results, nil
 	}
@@ -221,7 +313,7 @@ func (ms *MsqlCache) GetItemList(offset int, pagesize int, sortorder string) ([]
 		var modified mysql.NullTime
 		err = rows.Scan(&rec.ID, &created, &modified, &rec.Size)
 		if err != nil {
-			log.Println("GetItemList Scan MySQL", err)
+			slog.Error("GetItemList Scan MySQL", "error", err)
 			raven.CaptureError(err, nil)
 			continue
 		}
@@ -236,13 +328,74 @@ func (ms *MsqlCache) GetItemList(offset int, pagesize int, sortorder string) ([]
 	return results, nil
 }
 
+func (ms *MsqlCache) FindSlots(pattern string, offset int, limit int) ([]SlotMatch, error) {
+	const query = `
+			SELECT s.item, s.versionid, s.blobid, s.name
+			FROM slots s
+			JOIN (SELECT item, MAX(versionid) AS v FROM versions GROUP BY item) m
+				ON s.item = m.item AND s.versionid = m.v
+			WHERE s.name LIKE ?
+			ORDER BY s.item, s.name
+			LIMIT ? OFFSET ?`
+
+	rows, err := ms.db.Query(query, globToLike(pattern), limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []SlotMatch
+	for rows.Next() {
+		var m SlotMatch
+		err = rows.Scan(&m.Item, &m.Version, &m.BlobID, &m.Slot)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, m)
+	}
+	return results, rows.Err()
+}
+
+func (ms *MsqlCache) FindMeta(key string, value string, offset int, limit int) ([]MetaMatch, error) {
+	query := `
+			SELECT item, versionid, blobid, name, value
+			FROM meta
+			WHERE name = ?`
+	args := []interface{}{key}
+	if value != "" {
+		query += ` AND value = ?`
+		args = append(args, value)
+	}
+	query += ` ORDER BY item, versionid, blobid LIMIT ? OFFSET ?`
+	args = append(args, limit, offset)
+	return scanMeta(ms.db.Query(query, args...))
+}
+
 // construct an return an sql query and parameter list, using the parameters passed
-func buildItemListQuery(offset int, pagesize int, sortorder string) (string, []interface{}) {
+// CountItems returns the number of items in the index, only counting those
+// having a version saved by creator if it is not empty.
+func (ms *MsqlCache) CountItems(creator string) (int, error) {
+	query := `SELECT COUNT(*) FROM items`
+	var args []interface{}
+	if creator != "" {
+		query += ` WHERE item IN (SELECT item FROM versions WHERE creator = ?)`
+		args = append(args, creator)
+	}
+	var n int
+	err := ms.db.QueryRow(query, args...).Scan(&n)
+	return n, err
+}
+
+func buildItemListQuery(offset int, pagesize int, sortorder string, creator string) (string, []interface{}) {
 	var query bytes.Buffer
 	// The mysql driver does not have positional parameters, so we build the
 	// parameter list in parallel to the query.
 	var args []interface{}
 	query.WriteString("SELECT item, created, modified, size FROM items ")
+	if creator != "" {
+		query.WriteString("WHERE item IN (SELECT item FROM versions WHERE creator = ?) ")
+		args = append(args, creator)
+	}
 
 	sortcolumn := ""
 	decending := false
@@ -276,6 +429,101 @@ func buildItemListQuery(offset int, pagesize int, sortorder string) (string, []i
 	return query.String(), args
 }
 
+// Delete removes the cached item record for id.
+func (ms *MsqlCache) Delete(id string) {
+	_, err := ms.db.Exec(`DELETE FROM items WHERE item = ?`, id)
+	if err != nil {
+		slog.Error("Item Cache", "item", id, "error", err)
+		raven.CaptureError(err, nil)
+	}
+}
+
+// ReindexItem removes every blob, version, and slot row for the given item
+// and then indexes it again. The cached item record is also replaced.
+func (ms *MsqlCache) ReindexItem(item string, thisItem *items.Item) error {
+	err := ms.deleteRows(item, "blobs", "versions", "slots", "meta")
+	if err != nil {
+		return err
+	}
+	// Set also indexes the item
+	ms.Set(item, thisItem)
+	return nil
+}
+
+// DeleteItem removes everything recorded about the given item: the cached
+// item record, the blob, version, and slot rows, any identifiers bound to
+// it, and any scheduled fixity checks. Past fixity results are kept.
+func (ms *MsqlCache) DeleteItem(item string) error {
+	return ms.deleteRows(item, "items", "blobs", "versions", "slots", "meta", "identifiers", "fixity")
+}
+
+// deleteRows removes the rows for item from each of the given tables in one
+// transaction. Only scheduled checks are removed from the fixity table.
+func (ms *MsqlCache) deleteRows(item string, tables ...string) error {
+	tx, err := ms.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		stmt := `DELETE FROM ` + table + ` WHERE item = ?`
+		if table == "fixity" {
+			stmt += ` AND status = "scheduled"`
+		}
+		_, err = tx.Exec(stmt, item)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// FindBlobByHash returns the item and id of a blob stored with the given
+// size and SHA-256 hash. Deleted blobs and references to other items have no
+// bundle and are not returned.
+func (ms *MsqlCache) FindBlobByHash(size int64, sha256 []byte) (string, items.BlobID, error) {
+	const query = `
+			SELECT item, blobid
+			FROM blobs
+			WHERE SHA256 = ? AND size = ? AND bundle > 0
+			LIMIT 1`
+	var item string
+	var bid int64
+	err := ms.db.QueryRow(query, sha256, size).Scan(&item, &bid)
+	if err == sql.ErrNoRows {
+		return "", 0, nil
+	}
+	return item, items.BlobID(bid), err
+}
+
+// FindReferences returns the blobs in other items which refer to blobs in
+// the given item. Deleted references have no refitem and are not returned.
+func (ms *MsqlCache) FindReferences(item string) ([]items.Reference, error) {
+	const query = `
+			SELECT item, blobid, refblob
+			FROM blobs
+			WHERE refitem = ? AND item != ?
+			ORDER BY item, blobid`
+	rows, err := ms.db.Query(query, item, item)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []items.Reference
+	for rows.Next() {
+		var ref items.Reference
+		var bid, refblob int64
+		err = rows.Scan(&ref.Item, &bid, &refblob)
+		if err != nil {
+			return nil, err
+		}
+		ref.Blob = items.BlobID(bid)
+		ref.RefBlob = items.BlobID(refblob)
+		result = append(result, ref)
+	}
+	return result, rows.Err()
+}
+
 // IndexItem adds row entries for every version, slot, and blob
 // for the given item. It is ok if some pieces are already in the tables.
 func (ms *MsqlCache) IndexItem(item string, thisItem *items.Item) error {
@@ -289,7 +537,7 @@ func (ms *MsqlCache) IndexItem(item string, thisItem *items.Item) error {
 	if err != nil {
 		return err
 	}
-	maxversion, err := ms.getMaxVersion(item)
+	maxversion, err := ms.FindMaxVersion(item)
 	if err != nil {
 		return err
 	}
@@ -309,21 +557,26 @@ func (ms *MsqlCache) IndexItem(item string, thisItem *items.Item) error {
 		if int(blob.ID) > maxblob {
 			const insertblob = `INSERT INTO blobs
 			(item, blobid, size, bundle, created, creator, MD5, SHA256,
-			mimetype, deleted, deleter, deletenote)
-			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+			mimetype, deleted, deleter, deletenote, refitem, refblob)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 			_, err = tx.Exec(insertblob, item, blob.ID, blob.Size, blob.Bundle,
 				blob.SaveDate, blob.Creator, blob.MD5, blob.SHA256,
-				blob.MimeType, dd, blob.Deleter, blob.DeleteNote)
+				blob.MimeType, dd, blob.Deleter, blob.DeleteNote,
+				blob.RefItem, blob.RefBlob)
 		} else {
+			// deleting a reference clears refitem
 			const updateblob = `UPDATE blobs SET
 					bundle = ?,
 					mimetype = ?,
 					deleted = ?,
 					deleter = ?,
-					deletenote = ?
+					deletenote = ?,
+					refitem = ?,
+					refblob = ?
 				WHERE item = ? AND blobid = ?`
 			_, err = tx.Exec(updateblob, blob.Bundle, blob.MimeType,
-				dd, blob.Deleter, blob.DeleteNote, item, blob.ID)
+				dd, blob.Deleter, blob.DeleteNote,
+				blob.RefItem, blob.RefBlob, item, blob.ID)
 		}
 		if err != nil {
 			tx.Rollback()
@@ -331,6 +584,25 @@ func (ms *MsqlCache) IndexItem(item string, thisItem *items.Item) error {
 		}
 	}
 
+	// blob metadata may change in any version, so it is replaced each time
+	_, err = tx.Exec(`DELETE FROM meta WHERE item = ? AND blobid > 0`, item)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, blob := range thisItem.Blobs {
+		for key, value := range blob.Meta {
+			const insertmeta = `INSERT INTO meta
+					(item, versionid, blobid, name, value)
+					VALUES (?, 0, ?, ?, ?)`
+			_, err = tx.Exec(insertmeta, item, blob.ID, key, value)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+
 	// update the version and slot tables. These should not change once created,
 	// so we do not have the update problem as the blobs do
 	for _, v := range thisItem.Versions {
@@ -357,6 +629,17 @@ func (ms *MsqlCache) IndexItem(item string, thisItem *items.Item) error {
 				return err
 			}
 		}
+
+		for key, value := range v.Meta {
+			const insertmeta = `INSERT INTO meta
+					(item, versionid, blobid, name, value)
+					VALUES (?, ?, 0, ?, ?)`
+			_, err := tx.Exec(insertmeta, item, v.ID, key, value)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
 	}
 	return tx.Commit()
 }
@@ -377,7 +660,7 @@ func (mc *MsqlCache) NextFixity(cutoff time.Time) int64 {
 	if err == sql.ErrNoRows {
 		return 0
 	} else if err != nil {
-		log.Println("nextfixity", err)
+		slog.Error("nextfixity", "error", err)
 		raven.CaptureError(err, nil)
 		return 0
 	}
@@ -399,7 +682,7 @@ func (mc *MsqlCache) GetFixity(id int64) *Fixity {
 	if err == sql.ErrNoRows {
 		return nil
 	} else if err != nil {
-		log.Println("GetFixtyByID  MySQL queryrow", err)
+		slog.Error("GetFixityByID MySQL queryrow", "error", err)
 		raven.CaptureError(err, nil)
 		return nil
 	}
@@ -420,7 +703,7 @@ func (mc *MsqlCache) SearchFixity(start, end time.Time, item string, status stri
 		// no next record
 		return nil
 	} else if err != nil {
-		log.Println("GetFixity Query MySQL", err)
+		slog.Error("GetFixity Query MySQL", "error", err)
 		raven.CaptureError(err, nil)
 		return nil
 	}
@@ -431,7 +714,7 @@ func (mc *MsqlCache) SearchFixity(start, end time.Time, item string, status stri
 		var when mysql.NullTime
 		err = rows.Scan(&rec.ID, &rec.Item, &when, &rec.Status, &rec.Notes)
 		if err != nil {
-			log.Println("GetFixity Scan MySQL", err)
+			slog.Error("GetFixity Scan MySQL", "error", err)
 			raven.CaptureError(err, nil)
 			continue
 		}
@@ -536,6 +819,517 @@ func (mc *MsqlCache) LookupCheck(item string) (time.Time, error) {
 	return time.Time{}, err
 }
 
+// FindIdentifier returns the item the given identifier is bound to, or ""
+// if it is not bound.
+func (mc *MsqlCache) FindIdentifier(identifier string) (string, error) {
+	const query = `SELECT item FROM identifiers WHERE identifier = ? LIMIT 1`
+
+	var item string
+	err := mc.db.QueryRow(query, identifier).Scan(&item)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return item, err
+}
+
+// ItemIdentifiers returns the identifiers bound to the given item.
+func (mc *MsqlCache) ItemIdentifiers(item string) ([]string, error) {
+	const query = `SELECT identifier FROM identifiers WHERE item = ? ORDER BY identifier`
+
+	rows, err := mc.db.Query(query, item)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []string
+	for rows.Next() {
+		var identifier string
+		err = rows.Scan(&identifier)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, identifier)
+	}
+	return result, rows.Err()
+}
+
+// BindIdentifier binds the identifier to the given item.
+func (mc *MsqlCache) BindIdentifier(identifier string, item string) error {
+	// an existing binding is left alone, so two binds of the same
+	// identifier cannot both succeed
+	const stmt = `INSERT IGNORE INTO identifiers (identifier, item, created) VALUES (?, ?, ?)`
+	result, err := mc.db.Exec(stmt, identifier, item, time.Now())
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n > 0 {
+		return err
+	}
+	current, err := mc.FindIdentifier(identifier)
+	if err == nil && current != item {
+		err = ErrIdentifierBound
+	}
+	return err
+}
+
+// UnbindIdentifier removes any binding for the given identifier.
+func (mc *MsqlCache) UnbindIdentifier(identifier string) error {
+	const stmt = `DELETE FROM identifiers WHERE identifier = ?`
+	_, err := mc.db.Exec(stmt, identifier)
+	return err
+}
+
+// RecordAccess sets the last access time of the given item and counts a
+// download for the day.
+func (mc *MsqlCache) RecordAccess(item string, when time.Time) error {
+	const stmt = `UPDATE items SET accessed = ? WHERE item = ?`
+	const count = `INSERT INTO item_downloads (item, day, downloads) VALUES (?, ?, 1)
+		ON DUPLICATE KEY UPDATE downloads = downloads + 1`
+	_, err := mc.db.Exec(stmt, when, item)
+	if err != nil {
+		return err
+	}
+	_, err = mc.db.Exec(count, item, usageDay(when))
+	return err
+}
+
+// RecordDeletion adds a tombstone for the given item.
+func (mc *MsqlCache) RecordDeletion(item string, when time.Time, deleter string) error {
+	const stmt = `INSERT INTO tombstones (item, deleted, deleter) VALUES (?, ?, ?)`
+	_, err := mc.db.Exec(stmt, item, when, deleter)
+	return err
+}
+
+// RecordRename adds a tombstone for the given item pointing to its new id.
+func (mc *MsqlCache) RecordRename(item string, newid string, when time.Time, renamer string) error {
+	const stmt = `INSERT INTO tombstones (item, deleted, deleter, renamed) VALUES (?, ?, ?, ?)`
+	_, err := mc.db.Exec(stmt, item, when, renamer, newid)
+	return err
+}
+
+// FindDeletion returns the most recent tombstone for the given item, or nil
+// if there is none.
+func (mc *MsqlCache) FindDeletion(item string) (*Tombstone, error) {
+	const query = `SELECT deleted, deleter, renamed FROM tombstones WHERE item = ? ORDER BY deleted DESC LIMIT 1`
+
+	var deleted mysql.NullTime
+	var renamed sql.NullString
+	result := &Tombstone{Item: item}
+	err := mc.db.QueryRow(query, item).Scan(&deleted, &result.Deleter, &renamed)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if deleted.Valid {
+		result.Deleted = deleted.Time
+	}
+	result.RenamedTo = renamed.String
+	return result, nil
+}
+
+// ReserveID records that id was minted, and returns false if it was minted
+// before.
+func (mc *MsqlCache) ReserveID(id string, when time.Time) (bool, error) {
+	const stmt = `INSERT IGNORE INTO minted (id, minted) VALUES (?, ?)`
+	result, err := mc.db.Exec(stmt, id, when)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// NextSequence increments the named counter and returns its new value. A
+// counter which does not exist yet starts at first.
+func (mc *MsqlCache) NextSequence(name string, first int64) (int64, error) {
+	// LAST_INSERT_ID(expr) hands the new value back in the result, so
+	// the increment and the read are one statement.
+	const stmt = `INSERT INTO sequences (name, value) VALUES (?, LAST_INSERT_ID(?))
+		ON DUPLICATE KEY UPDATE value = LAST_INSERT_ID(value + 1)`
+	result, err := mc.db.Exec(stmt, name, first)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// AddToken saves the given token under hash, and returns its id.
+func (mc *MsqlCache) AddToken(t APIToken, hash string) (int64, error) {
+	const stmt = `INSERT INTO tokens (hash, username, role, created, creator) VALUES (?, ?, ?, ?, ?)`
+	result, err := mc.db.Exec(stmt, hash, t.User, t.Role, t.Created, t.Creator)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// FindToken returns the token stored under hash, or nil if there is none.
+func (mc *MsqlCache) FindToken(hash string) (*APIToken, error) {
+	const query = `SELECT id, username, role, created, creator, revoked FROM tokens WHERE hash = ? LIMIT 1`
+	return mc.queryToken(query, hash)
+}
+
+// GetToken returns the token with the given id, or nil if there is none.
+func (mc *MsqlCache) GetToken(id int64) (*APIToken, error) {
+	const query = `SELECT id, username, role, created, creator, revoked FROM tokens WHERE id = ?`
+	return mc.queryToken(query, id)
+}
+
+func (mc *MsqlCache) queryToken(query string, arg interface{}) (*APIToken, error) {
+	var t APIToken
+	var created, revoked mysql.NullTime
+	err := mc.db.QueryRow(query, arg).Scan(&t.ID, &t.User, &t.Role, &created, &t.Creator, &revoked)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	t.Created = created.Time
+	if revoked.Valid {
+		t.Revoked = revoked.Time
+	}
+	return &t, nil
+}
+
+// ListTokens returns every token in order of id.
+func (mc *MsqlCache) ListTokens() ([]APIToken, error) {
+	const query = `SELECT id, username, role, created, creator, revoked FROM tokens ORDER BY id`
+	rows, err := mc.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []APIToken
+	for rows.Next() {
+		var t APIToken
+		var created, revoked mysql.NullTime
+		err = rows.Scan(&t.ID, &t.User, &t.Role, &created, &t.Creator, &revoked)
+		if err != nil {
+			return nil, err
+		}
+		t.Created = created.Time
+		if revoked.Valid {
+			t.Revoked = revoked.Time
+		}
+		result = append(result, t)
+	}
+	return result, rows.Err()
+}
+
+// RevokeToken sets the revocation time of the given token, unless it is
+// already revoked by then.
+func (mc *MsqlCache) RevokeToken(id int64, when time.Time) error {
+	const stmt = `UPDATE tokens SET revoked = ? WHERE id = ? AND (revoked IS NULL OR revoked > ?)`
+	_, err := mc.db.Exec(stmt, when, id, when)
+	return err
+}
+
+// ItemDownloads returns the daily download counts for item, or for every
+// item if it is empty, starting with the given day.
+func (mc *MsqlCache) ItemDownloads(item string, since time.Time) ([]DownloadRecord, error) {
+	const query = `SELECT item, day, downloads FROM item_downloads
+		WHERE day >= ? AND (? = '' OR item = ?)
+		ORDER BY day, item`
+
+	rows, err := mc.db.Query(query, usageDay(since), item, item)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []DownloadRecord
+	for rows.Next() {
+		var rec DownloadRecord
+		var day mysql.NullTime
+		err = rows.Scan(&rec.Item, &day, &rec.Downloads)
+		if err != nil {
+			return nil, err
+		}
+		rec.Day = day.Time
+		results = append(results, rec)
+	}
+	return results, rows.Err()
+}
+
+// ItemAccessList returns the size and times of every item.
+func (mc *MsqlCache) ItemAccessList() ([]SimpleItem, error) {
+	const query = `SELECT item, created, modified, accessed, size FROM items`
+
+	rows, err := mc.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []SimpleItem
+	for rows.Next() {
+		var rec SimpleItem
+		var created, modified, accessed mysql.NullTime
+		err = rows.Scan(&rec.ID, &created, &modified, &accessed, &rec.Size)
+		if err != nil {
+			return nil, err
+		}
+		rec.Created = created.Time
+		rec.Modified = modified.Time
+		rec.Accessed = accessed.Time
+		results = append(results, rec)
+	}
+	return results, rows.Err()
+}
+
+// RecordUsage adds n bytes to the usage for the given day.
+func (mc *MsqlCache) RecordUsage(kind string, name string, when time.Time, n int64) error {
+	const stmt = `INSERT INTO upload_usage (kind, name, day, bytes) VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE bytes = bytes + VALUES(bytes)`
+	_, err := mc.db.Exec(stmt, kind, name, usageDay(when), n)
+	return err
+}
+
+// UsageSince returns the daily usage records starting with the given day.
+func (mc *MsqlCache) UsageSince(since time.Time) ([]UsageRecord, error) {
+	const query = `SELECT kind, name, day, bytes FROM upload_usage WHERE day >= ?`
+
+	rows, err := mc.db.Query(query, usageDay(since))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []UsageRecord
+	for rows.Next() {
+		var rec UsageRecord
+		var day mysql.NullTime
+		err = rows.Scan(&rec.Kind, &rec.Name, &day, &rec.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		rec.Day = day.Time
+		results = append(results, rec)
+	}
+	return results, rows.Err()
+}
+
+// UserUsage returns the total bytes of the given kind and name starting
+// with the given day.
+func (mc *MsqlCache) UserUsage(kind string, name string, since time.Time) (int64, error) {
+	const query = `SELECT COALESCE(SUM(bytes), 0) FROM upload_usage WHERE kind = ? AND name = ? AND day >= ?`
+
+	var total int64
+	err := mc.db.QueryRow(query, kind, name, usageDay(since)).Scan(&total)
+	return total, err
+}
+
+// RecordAudit adds an entry to the audit log.
+func (mc *MsqlCache) RecordAudit(entry AuditEntry) error {
+	const stmt = `INSERT INTO audit (logged, username, remote, method, path, item, status) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	_, err := mc.db.Exec(stmt, entry.When, entry.User, entry.Remote, entry.Method, entry.Path, entry.Item, entry.Status)
+	return err
+}
+
+// SearchAudit returns the audit log entries in the given range, newest
+// first.
+func (mc *MsqlCache) SearchAudit(start, end time.Time, item string, limit int) ([]AuditEntry, error) {
+	var query bytes.Buffer
+	var args []interface{}
+	query.WriteString("SELECT logged, username, remote, method, path, item, status FROM audit")
+	conjunction := " WHERE "
+	if !start.IsZero() {
+		query.WriteString(conjunction + "logged >= ?")
+		conjunction = " AND "
+		args = append(args, start)
+	}
+	if !end.IsZero() {
+		query.WriteString(conjunction + "logged <= ?")
+		conjunction = " AND "
+		args = append(args, end)
+	}
+	if item != "" {
+		query.WriteString(conjunction + "item = ?")
+		args = append(args, item)
+	}
+	query.WriteString(" ORDER BY id DESC LIMIT ?")
+	args = append(args, limit)
+
+	rows, err := mc.db.Query(query.String(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		var logged mysql.NullTime
+		err = rows.Scan(&logged, &e.User, &e.Remote, &e.Method, &e.Path, &e.Item, &e.Status)
+		if err != nil {
+			return nil, err
+		}
+		e.When = logged.Time
+		result = append(result, e)
+	}
+	return result, rows.Err()
+}
+
+// AddEvent saves e in the event feed and returns its sequence number.
+func (mc *MsqlCache) AddEvent(e Event) (int64, error) {
+	const stmt = `INSERT INTO events (logged, type, item, version, tx, username, target, receipt)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	target, receipt, err := encodeReceipt(e.Receipt)
+	if err != nil {
+		return 0, err
+	}
+	result, err := mc.db.Exec(stmt, e.When, e.Type, e.Item, e.Version, e.Transaction, e.User, target, receipt)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// EventsAfter returns up to limit events following the one with sequence
+// number seq, in order.
+func (mc *MsqlCache) EventsAfter(seq int64, limit int) ([]Event, error) {
+	const query = `SELECT id, logged, type, item, version, tx, username, receipt FROM events
+		WHERE id > ?
+		ORDER BY id
+		LIMIT ?`
+	rows, err := mc.db.Query(query, seq, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []Event
+	for rows.Next() {
+		var e Event
+		var logged mysql.NullTime
+		var receipt sql.NullString
+		err = rows.Scan(&e.Seq, &logged, &e.Type, &e.Item, &e.Version, &e.Transaction, &e.User, &receipt)
+		if err != nil {
+			return nil, err
+		}
+		e.When = logged.Time
+		if receipt.Valid {
+			e.Receipt, err = decodeReceipt(receipt.String)
+			if err != nil {
+				return nil, err
+			}
+		}
+		result = append(result, e)
+	}
+	return result, rows.Err()
+}
+
+// LastEvent returns the sequence number of the newest event, or 0 if there
+// are none.
+func (mc *MsqlCache) LastEvent() (int64, error) {
+	const query = `SELECT COALESCE(MAX(id), 0) FROM events`
+	var seq int64
+	err := mc.db.QueryRow(query).Scan(&seq)
+	return seq, err
+}
+
+// LastExports returns when each item was last sent to the export target
+// with the given name.
+func (mc *MsqlCache) LastExports(target string) (map[string]time.Time, error) {
+	const query = `SELECT item, MAX(logged) FROM events
+		WHERE type = ? AND target = ?
+		GROUP BY item`
+	rows, err := mc.db.Query(query, EventExport, target)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[string]time.Time)
+	for rows.Next() {
+		var item string
+		var when mysql.NullTime
+		err = rows.Scan(&item, &when)
+		if err != nil {
+			return nil, err
+		}
+		result[item] = when.Time
+	}
+	return result, rows.Err()
+}
+
+// AddSubscription saves sub and returns its id.
+func (mc *MsqlCache) AddSubscription(sub Subscription) (int64, error) {
+	const stmt = `INSERT INTO subscriptions (url, prefix, types, created, creator, delivered, failures, lasterror)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	result, err := mc.db.Exec(stmt, sub.URL, sub.Prefix, strings.Join(sub.Types, ","),
+		sub.Created, sub.Creator, sub.Delivered, sub.Failures, sub.LastError)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// GetSubscription returns the subscription with the given id, or nil if
+// there is none.
+func (mc *MsqlCache) GetSubscription(id int64) (*Subscription, error) {
+	const query = `SELECT id, url, prefix, types, created, creator, delivered, failures, lasterror, lasttry
+		FROM subscriptions WHERE id = ?`
+	rows, err := mc.db.Query(query, id)
+	if err != nil {
+		return nil, err
+	}
+	list, err := scanMysqlSubscriptions(rows)
+	if err != nil || len(list) == 0 {
+		return nil, err
+	}
+	return &list[0], nil
+}
+
+// ListSubscriptions returns every subscription in order of id.
+func (mc *MsqlCache) ListSubscriptions() ([]Subscription, error) {
+	const query = `SELECT id, url, prefix, types, created, creator, delivered, failures, lasterror, lasttry
+		FROM subscriptions ORDER BY id`
+	rows, err := mc.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	return scanMysqlSubscriptions(rows)
+}
+
+func scanMysqlSubscriptions(rows *sql.Rows) ([]Subscription, error) {
+	defer rows.Close()
+	var result []Subscription
+	for rows.Next() {
+		var sub Subscription
+		var types string
+		var created, lasttry mysql.NullTime
+		err := rows.Scan(&sub.ID, &sub.URL, &sub.Prefix, &types, &created, &sub.Creator,
+			&sub.Delivered, &sub.Failures, &sub.LastError, &lasttry)
+		if err != nil {
+			return nil, err
+		}
+		if types != "" {
+			sub.Types = strings.Split(types, ",")
+		}
+		sub.Created = created.Time
+		if lasttry.Valid {
+			sub.LastTry = lasttry.Time
+		}
+		result = append(result, sub)
+	}
+	return result, rows.Err()
+}
+
+// UpdateDelivery saves the delivery state of sub.
+func (mc *MsqlCache) UpdateDelivery(sub Subscription) error {
+	const stmt = `UPDATE subscriptions SET delivered = ?, failures = ?, lasterror = ?, lasttry = ? WHERE id = ?`
+	var lasttry interface{}
+	if !sub.LastTry.IsZero() {
+		lasttry = sub.LastTry
+	}
+	_, err := mc.db.Exec(stmt, sub.Delivered, sub.Failures, sub.LastError, lasttry, sub.ID)
+	return err
+}
+
+// DeleteSubscription removes the subscription with the given id.
+func (mc *MsqlCache) DeleteSubscription(id int64) error {
+	const stmt = `DELETE FROM subscriptions WHERE id = ?`
+	_, err := mc.db.Exec(stmt, id)
+	return err
+}
+
 // database migrations. each one is a go function. Add them to the
 // list mysqlMigrations at top of this file for them to be run.
 
@@ -622,6 +1416,211 @@ func mysqlschema4(tx migration.LimitedTx) error {
 	return execlist(tx, s)
 }
 
+func mysqlschema5(tx migration.LimitedTx) error {
+	var s = []string{
+		`CREATE TABLE IF NOT EXISTS identifiers (
+				id int PRIMARY KEY AUTO_INCREMENT,
+				identifier varchar(255),
+				item varchar(255),
+				created datetime,
+				UNIQUE INDEX i_identifier (identifier),
+				INDEX i_item (item) )`,
+	}
+
+	return execlist(tx, s)
+}
+
+func mysqlschema6(tx migration.LimitedTx) error {
+	var s = []string{
+		`ALTER TABLE items ADD COLUMN accessed datetime`,
+	}
+
+	return execlist(tx, s)
+}
+
+func mysqlschema7(tx migration.LimitedTx) error {
+	var s = []string{
+		`CREATE INDEX i_creator ON versions (creator)`,
+	}
+
+	return execlist(tx, s)
+}
+
+func mysqlschema8(tx migration.LimitedTx) error {
+	var s = []string{
+		`CREATE TABLE IF NOT EXISTS upload_usage (
+				kind varchar(16),
+				name varchar(255),
+				day date,
+				bytes bigint,
+				PRIMARY KEY (kind, name, day),
+				INDEX i_day (day) )`,
+	}
+
+	return execlist(tx, s)
+}
+
+func mysqlschema9(tx migration.LimitedTx) error {
+	var s = []string{
+		`CREATE TABLE IF NOT EXISTS item_downloads (
+				item varchar(255),
+				day date,
+				downloads bigint,
+				PRIMARY KEY (item, day),
+				INDEX i_day (day) )`,
+	}
+
+	return execlist(tx, s)
+}
+
+func mysqlschema10(tx migration.LimitedTx) error {
+	var s = []string{
+		`CREATE TABLE IF NOT EXISTS tombstones (
+				id int PRIMARY KEY AUTO_INCREMENT,
+				item varchar(255),
+				deleted datetime,
+				deleter varchar(255),
+				INDEX i_item (item) )`,
+	}
+
+	return execlist(tx, s)
+}
+
+func mysqlschema11(tx migration.LimitedTx) error {
+	var s = []string{
+		`CREATE TABLE IF NOT EXISTS tokens (
+				id int PRIMARY KEY AUTO_INCREMENT,
+				hash char(64),
+				username varchar(255),
+				role varchar(16),
+				created datetime,
+				creator varchar(255),
+				revoked datetime,
+				UNIQUE INDEX i_hash (hash) )`,
+	}
+
+	return execlist(tx, s)
+}
+
+func mysqlschema12(tx migration.LimitedTx) error {
+	var s = []string{
+		`CREATE TABLE IF NOT EXISTS audit (
+				id int PRIMARY KEY AUTO_INCREMENT,
+				logged datetime,
+				username varchar(255),
+				remote varchar(255),
+				method varchar(16),
+				path text,
+				item varchar(255),
+				status int,
+				INDEX i_logged (logged),
+				INDEX i_item (item) )`,
+	}
+
+	return execlist(tx, s)
+}
+
+func mysqlschema13(tx migration.LimitedTx) error {
+	// finding duplicate blobs across items
+	var s = []string{
+		`CREATE INDEX i_sha256 ON blobs (SHA256)`,
+	}
+
+	return execlist(tx, s)
+}
+
+func mysqlschema14(tx migration.LimitedTx) error {
+	// the item event feed and the subscriptions to it
+	var s = []string{
+		`CREATE TABLE IF NOT EXISTS events (
+				id bigint PRIMARY KEY AUTO_INCREMENT,
+				logged datetime,
+				type varchar(16),
+				item varchar(255),
+				version int,
+				tx varchar(255),
+				username varchar(255) )`,
+		`CREATE TABLE IF NOT EXISTS subscriptions (
+				id int PRIMARY KEY AUTO_INCREMENT,
+				url text,
+				prefix varchar(255),
+				types varchar(255),
+				created datetime,
+				creator varchar(255),
+				delivered bigint,
+				failures int,
+				lasterror text,
+				lasttry datetime )`,
+	}
+
+	return execlist(tx, s)
+}
+
+func mysqlschema15(tx migration.LimitedTx) error {
+	// tombstones left by renaming an item point to its new id
+	var s = []string{
+		`ALTER TABLE tombstones ADD COLUMN renamed varchar(255)`,
+	}
+
+	return execlist(tx, s)
+}
+
+func mysqlschema16(tx migration.LimitedTx) error {
+	// events record the receipts of items sent to export targets
+	var s = []string{
+		`ALTER TABLE events ADD COLUMN target varchar(255)`,
+		`ALTER TABLE events ADD COLUMN receipt text`,
+		`CREATE INDEX events_target ON events (target)`,
+	}
+
+	return execlist(tx, s)
+}
+
+func mysqlschema17(tx migration.LimitedTx) error {
+	// user-defined metadata on versions and blobs. Rows for a version
+	// have a blobid of 0, and rows for a blob have a versionid of 0.
+	var s = []string{
+		`CREATE TABLE IF NOT EXISTS meta (
+				id int PRIMARY KEY AUTO_INCREMENT,
+				item varchar(255),
+				versionid int,
+				blobid int,
+				name varchar(255),
+				value text,
+				INDEX i_item (item),
+				INDEX i_name (name) )`,
+	}
+
+	return execlist(tx, s)
+}
+
+func mysqlschema18(tx migration.LimitedTx) error {
+	// minted item ids, and counters for the sequential minter. The value
+	// of a counter is the last number handed out.
+	var s = []string{
+		`CREATE TABLE IF NOT EXISTS minted (
+				id varchar(255) PRIMARY KEY,
+				minted datetime )`,
+		`CREATE TABLE IF NOT EXISTS sequences (
+				name varchar(255) PRIMARY KEY,
+				value bigint )`,
+	}
+
+	return execlist(tx, s)
+}
+
+func mysqlschema19(tx migration.LimitedTx) error {
+	// blobs which refer to a blob in another item, so the other blob is
+	// not removed while they do
+	var s = []string{
+		`ALTER TABLE blobs ADD COLUMN refitem varchar(255)`,
+		`ALTER TABLE blobs ADD COLUMN refblob int`,
+		`CREATE INDEX i_refitem ON blobs (refitem)`,
+	}
+
+	return execlist(tx, s)
+}
+
 // execlist exec's each item in the list, return if there is an error.
 // Used to work around mysql driver not handling compound exec statements.
 func execlist(tx migration.LimitedTx, stms []string) error {
@@ -27,6 +27,15 @@ func resetMysql(mc *MsqlCache) {
 	mc.db.Exec("DROP TABLE blobs")
 	mc.db.Exec("DROP TABLE slots")
 	mc.db.Exec("DROP TABLE versions")
+	mc.db.Exec("DROP TABLE identifiers")
+	mc.db.Exec("DROP TABLE upload_usage")
+	mc.db.Exec("DROP TABLE item_downloads")
+	mc.db.Exec("DROP TABLE tombstones")
+	mc.db.Exec("DROP TABLE tokens")
+	mc.db.Exec("DROP TABLE audit")
+	mc.db.Exec("DROP TABLE events")
+	mc.db.Exec("DROP TABLE subscriptions")
+	mc.db.Exec("DROP TABLE meta")
 }
 
 func TestMySQLItemCache(t *testing.T) {
@@ -75,3 +84,94 @@ func TestMySQLDelete(t *testing.T) {
 	runDeleteFixity(t, mc)
 	resetMysql(mc)
 }
+
+func TestMySQLIdentifiers(t *testing.T) {
+	mc, err := NewMysqlCache(dialmysql)
+	if err != nil {
+		t.Fatalf("Received %s", err.Error())
+	}
+	runIdentifierSequence(t, mc)
+	resetMysql(mc)
+}
+
+func TestMySQLAccess(t *testing.T) {
+	mc, err := NewMysqlCache(dialmysql)
+	if err != nil {
+		t.Fatalf("Received %s", err.Error())
+	}
+	runAccessSequence(t, mc)
+	resetMysql(mc)
+}
+
+func TestMySQLTombstones(t *testing.T) {
+	mc, err := NewMysqlCache(dialmysql)
+	if err != nil {
+		t.Fatalf("Received %s", err.Error())
+	}
+	runTombstoneSequence(t, mc)
+	resetMysql(mc)
+}
+
+func TestMySQLTokens(t *testing.T) {
+	mc, err := NewMysqlCache(dialmysql)
+	if err != nil {
+		t.Fatalf("Received %s", err.Error())
+	}
+	runTokenSequence(t, mc)
+	resetMysql(mc)
+}
+
+func TestMySQLUsage(t *testing.T) {
+	mc, err := NewMysqlCache(dialmysql)
+	if err != nil {
+		t.Fatalf("Received %s", err.Error())
+	}
+	runUsageSequence(t, mc)
+	resetMysql(mc)
+}
+
+func TestMySQLAudit(t *testing.T) {
+	mc, err := NewMysqlCache(dialmysql)
+	if err != nil {
+		t.Fatalf("Received %s", err.Error())
+	}
+	runAuditSequence(t, mc)
+	resetMysql(mc)
+}
+
+func TestMySQLEvents(t *testing.T) {
+	mc, err := NewMysqlCache(dialmysql)
+	if err != nil {
+		t.Fatalf("Received %s", err.Error())
+	}
+	runEventSequence(t, mc)
+	resetMysql(mc)
+}
+
+func TestMySQLFindSlots(t *testing.T) {
+	mc, err := NewMysqlCache(dialmysql)
+	if err != nil {
+		t.Fatalf("Received %s", err.Error())
+	}
+	runSlotSearchSequence(t, mc)
+	runMetaSearchSequence(t, mc)
+	resetMysql(mc)
+}
+
+func TestMySQLMigrationLock(t *testing.T) {
+	unlock, err := lockMysqlMigrations(dialmysql, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a second migrator has to wait
+	_, err = lockMysqlMigrations(dialmysql, time.Second)
+	if err == nil {
+		t.Error("Expected timeout waiting for the migration lock")
+	}
+	unlock()
+	unlock2, err := lockMysqlMigrations(dialmysql, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock2()
+}
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"database/sql"
 	"encoding/json"
-	"log"
+	"fmt"
+	"log/slog"
+	"sort"
 	"strings"
 	"time"
 
@@ -28,6 +30,15 @@ type QlCache struct {
 var _ items.ItemCache = &QlCache{}
 var _ FixityDB = &QlCache{}
 var _ BlobDB = &QlCache{}
+var _ IdentifierDB = &QlCache{}
+var _ AccessDB = &QlCache{}
+var _ UsageDB = &QlCache{}
+var _ TombstoneDB = &QlCache{}
+var _ TokenDB = &QlCache{}
+var _ AuditDB = &QlCache{}
+var _ EventDB = &QlCache{}
+var _ Reindexer = &QlCache{}
+var _ MintDB = &QlCache{}
 
 // List of migrations to perform. Add new ones to the end.
 // DO NOT change the order of items already in this list.
@@ -35,6 +46,21 @@ var qlMigrations = []migration.Migrator{
 	qlschema1,
 	qlschema2,
 	qlschema3,
+	qlschema4,
+	qlschema5,
+	qlschema6,
+	qlschema7,
+	qlschema8,
+	qlschema9,
+	qlschema10,
+	qlschema11,
+	qlschema12,
+	qlschema13,
+	qlschema14,
+	qlschema15,
+	qlschema16,
+	qlschema17,
+	qlschema18,
 }
 
 // adapt schema versioning for QL
@@ -62,7 +88,7 @@ func NewQlCache(filename string) (*QlCache, error) {
 		qlVersioning.Get,
 		qlVersioning.Set)
 	if err != nil {
-		log.Printf("Open QL: %s", err.Error())
+		slog.Error("Open QL", "error", err)
 		return nil, err
 	}
 	return &QlCache{db: db}, nil
@@ -77,7 +103,7 @@ func (qc *QlCache) Lookup(item string) *items.Item {
 	err := qc.db.QueryRow(dbLookup, item).Scan(&value)
 	if err != nil {
 		if err != sql.ErrNoRows {
-			log.Printf("Item Cache QL: %s", err.Error())
+			slog.Error("Item Cache QL", "item", item, "error", err)
 		}
 		return nil
 	}
@@ -104,19 +130,19 @@ func (qc *QlCache) Set(item string, thisItem *items.Item) {
 	}
 	value, err := json.Marshal(thisItem)
 	if err != nil {
-		log.Println("Item Cache QL:", err)
+		slog.Error("Item Cache QL", "item", item, "error", err)
 		raven.CaptureError(err, nil)
 		return
 	}
 	result, err := performExec(qc.db, dbUpdate, item, created, modified, size, value)
 	if err != nil {
-		log.Println("Item Cache QL:", err)
+		slog.Error("Item Cache QL", "item", item, "error", err)
 		raven.CaptureError(err, nil)
 		return
 	}
 	nrows, err := result.RowsAffected()
 	if err != nil {
-		log.Println("Item Cache QL:", err)
+		slog.Error("Item Cache QL", "item", item, "error", err)
 		raven.CaptureError(err, nil)
 		return
 	}
@@ -124,7 +150,7 @@ func (qc *QlCache) Set(item string, thisItem *items.Item) {
 		// record didn't exist. create it
 		_, err = performExec(qc.db, dbInsert, item, created, modified, size, value)
 		if err != nil {
-			log.Printf("Item Cache QL: %s", err.Error())
+			slog.Error("Item Cache QL", "item", item, "error", err)
 		}
 	}
 	qc.IndexItem(item, thisItem)
@@ -165,7 +191,7 @@ func (qc *QlCache) getMaxBlob(item string) (int, error) {
 	return 0, err
 }
 
-func (qc *QlCache) getMaxVersion(item string) (int, error) {
+func (qc *QlCache) FindMaxVersion(item string) (int, error) {
 	const maxversion = `
 			SELECT max(versionid)
 			FROM versions
@@ -185,7 +211,7 @@ func (qc *QlCache) getMaxVersion(item string) (int, error) {
 func (qc *QlCache) FindBlobBySlot(item string, version int, slot string) (*items.Blob, error) {
 	if version == 0 {
 		var err error
-		version, err = qc.getMaxVersion(item)
+		version, err = qc.FindMaxVersion(item)
 		if err != nil || version == 0 {
 			return nil, err
 		}
@@ -207,6 +233,52 @@ func (qc *QlCache) FindBlobBySlot(item string, version int, slot string) (*items
 	return qc.FindBlob(item, bid)
 }
 
+// FindBlobByHash returns the item and id of a blob stored with the given
+// size and SHA-256 hash. Deleted blobs and references to other items have no
+// bundle and are not returned.
+func (qc *QlCache) FindBlobByHash(size int64, sha256 []byte) (string, items.BlobID, error) {
+	const query = `
+			SELECT item, blobid
+			FROM blobs
+			WHERE SHA256 == ?1 AND size == ?2 AND bundle > 0
+			LIMIT 1`
+	var item string
+	var bid int64
+	err := qc.db.QueryRow(query, sha256, size).Scan(&item, &bid)
+	if err == sql.ErrNoRows {
+		return "", 0, nil
+	}
+	return item, items.BlobID(bid), err
+}
+
+// FindReferences returns the blobs in other items which refer to blobs in
+// the given item. Deleted references have no refitem and are not returned.
+func (qc *QlCache) FindReferences(item string) ([]items.Reference, error) {
+	const query = `
+			SELECT item, blobid, refblob
+			FROM blobs
+			WHERE refitem == ?1 AND item != ?1
+			ORDER BY item, blobid`
+	rows, err := qc.db.Query(query, item)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []items.Reference
+	for rows.Next() {
+		var ref items.Reference
+		var bid, refblob int64
+		err = rows.Scan(&ref.Item, &bid, &refblob)
+		if err != nil {
+			return nil, err
+		}
+		ref.Blob = items.BlobID(bid)
+		ref.RefBlob = items.BlobID(refblob)
+		result = append(result, ref)
+	}
+	return result, rows.Err()
+}
+
 // IndexItem adds row entries for every version, slot, and blob
 // for the given item. It is ok if some pieces are already in the tables.
 func (qc *QlCache) IndexItem(item string, thisItem *items.Item) error {
@@ -219,7 +291,7 @@ func (qc *QlCache) IndexItem(item string, thisItem *items.Item) error {
 	var maxversion int
 	maxblob, err := qc.getMaxBlob(item)
 	if err == nil {
-		maxversion, err = qc.getMaxVersion(item)
+		maxversion, err = qc.FindMaxVersion(item)
 	}
 	if err != nil {
 		return err
@@ -235,21 +307,26 @@ func (qc *QlCache) IndexItem(item string, thisItem *items.Item) error {
 		if int(blob.ID) > maxblob {
 			const insertblob = `INSERT INTO blobs
 			(item, blobid, size, bundle, created, creator, MD5, SHA256,
-			mimetype, deleted, deleter, deletenote)
-			VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11, ?12)`
+			mimetype, deleted, deleter, deletenote, refitem, refblob)
+			VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11, ?12, ?13, ?14)`
 			_, err = tx.Exec(insertblob, item, blob.ID, blob.Size, blob.Bundle,
 				blob.SaveDate, blob.Creator, blob.MD5, blob.SHA256,
-				blob.MimeType, blob.DeleteDate, blob.Deleter, blob.DeleteNote)
+				blob.MimeType, blob.DeleteDate, blob.Deleter, blob.DeleteNote,
+				blob.RefItem, blob.RefBlob)
 		} else {
+			// deleting a reference clears refitem
 			const updateblob = `UPDATE blobs SET
 					bundle = ?3,
 					mimetype = ?4,
 					deleted = ?5,
 					deleter = ?6,
-					deletenote = ?7
+					deletenote = ?7,
+					refitem = ?8,
+					refblob = ?9
 				WHERE item = ?1 AND blobid = ?2`
 			_, err = tx.Exec(updateblob, item, blob.ID, blob.Bundle, blob.MimeType,
-				blob.DeleteDate, blob.Deleter, blob.DeleteNote)
+				blob.DeleteDate, blob.Deleter, blob.DeleteNote,
+				blob.RefItem, blob.RefBlob)
 		}
 		if err != nil {
 			tx.Rollback()
@@ -257,6 +334,25 @@ func (qc *QlCache) IndexItem(item string, thisItem *items.Item) error {
 		}
 	}
 
+	// blob metadata may change in any version, so it is replaced each time
+	_, err = tx.Exec(`DELETE FROM meta WHERE item == ?1 AND blobid > 0`, item)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, blob := range thisItem.Blobs {
+		for key, value := range blob.Meta {
+			const insertmeta = `INSERT INTO meta
+					(item, versionid, blobid, name, value)
+					VALUES (?1, 0, ?2, ?3, ?4)`
+			_, err = tx.Exec(insertmeta, item, blob.ID, key, value)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+
 	// update the version and slot tables. These should not change once created,
 	// so we do not have the update problem as the blobs do
 	for _, v := range thisItem.Versions {
@@ -283,20 +379,80 @@ func (qc *QlCache) IndexItem(item string, thisItem *items.Item) error {
 				return err
 			}
 		}
+
+		for key, value := range v.Meta {
+			const insertmeta = `INSERT INTO meta
+					(item, versionid, blobid, name, value)
+					VALUES (?1, ?2, 0, ?3, ?4)`
+			_, err := tx.Exec(insertmeta, item, v.ID, key, value)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// Delete removes the cached item record for item.
+func (qc *QlCache) Delete(item string) {
+	_, err := performExec(qc.db, `DELETE FROM items WHERE item == ?1`, item)
+	if err != nil {
+		slog.Error("Item Cache QL", "item", item, "error", err)
+		raven.CaptureError(err, nil)
+	}
+}
+
+// ReindexItem removes every blob, version, and slot row for the given item
+// and then indexes it again. The cached item record is also replaced.
+func (qc *QlCache) ReindexItem(item string, thisItem *items.Item) error {
+	err := qc.deleteRows(item, "blobs", "versions", "slots", "meta")
+	if err != nil {
+		return err
+	}
+	// Set also indexes the item
+	qc.Set(item, thisItem)
+	return nil
+}
+
+// DeleteItem removes everything recorded about the given item: the cached
+// item record, the blob, version, and slot rows, any identifiers bound to
+// it, and any scheduled fixity checks. Past fixity results are kept.
+func (qc *QlCache) DeleteItem(item string) error {
+	return qc.deleteRows(item, "items", "blobs", "versions", "slots", "meta", "identifiers", "fixity")
+}
+
+// deleteRows removes the rows for item from each of the given tables in one
+// transaction. Only scheduled checks are removed from the fixity table.
+func (qc *QlCache) deleteRows(item string, tables ...string) error {
+	tx, err := qc.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		stmt := `DELETE FROM ` + table + ` WHERE item == ?1`
+		if table == "fixity" {
+			stmt += ` AND status == "scheduled"`
+		}
+		_, err = tx.Exec(stmt, item)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
 	}
 	return tx.Commit()
 }
 
-func (qc *QlCache) GetItemList(offset int, pagesize int, sortorder string) ([]SimpleItem, error) {
-	query := buildQLItemListQuery(offset, pagesize, sortorder)
+func (qc *QlCache) GetItemList(offset int, pagesize int, sortorder string, creator string) ([]SimpleItem, error) {
+	query, args := buildQLItemListQuery(offset, pagesize, sortorder, creator)
 	var results []SimpleItem
 
-	rows, err := qc.db.Query(query, pagesize, offset)
+	rows, err := qc.db.Query(query, args...)
 	if err == sql.ErrNoRows {
 		// no next record
 		return results, nil
 	} else if err != nil {
-		log.Println("GetItemList Query QL", err)
+		slog.Error("GetItemList Query QL", "error", err)
 		raven.CaptureError(err, nil)
 		return results, nil
 	}
@@ -306,7 +462,7 @@ func (qc *QlCache) GetItemList(offset int, pagesize int, sortorder string) ([]Si
 		var rec = SimpleItem{}
 		err = rows.Scan(&rec.ID, &rec.Created, &rec.Modified, &rec.Size)
 		if err != nil {
-			log.Println("GetItemList Scan QL", err)
+			slog.Error("GetItemList Scan QL", "error", err)
 			raven.CaptureError(err, nil)
 			continue
 		}
@@ -315,10 +471,108 @@ func (qc *QlCache) GetItemList(offset int, pagesize int, sortorder string) ([]Si
 	return results, nil
 }
 
+func (qc *QlCache) FindSlots(pattern string, offset int, limit int) ([]SlotMatch, error) {
+	// QL cannot join slots against the most recent version of each item,
+	// so the older versions are filtered out here.
+	const query = `
+			SELECT item, versionid, blobid, name
+			FROM slots
+			WHERE name LIKE ?1`
+
+	rows, err := qc.db.Query(query, globToRegexp(pattern))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var all []SlotMatch
+	for rows.Next() {
+		var m SlotMatch
+		err = rows.Scan(&m.Item, &m.Version, &m.BlobID, &m.Slot)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, m)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	var results []SlotMatch
+	maxversions := make(map[string]int)
+	for _, m := range all {
+		v, ok := maxversions[m.Item]
+		if !ok {
+			v, err = qc.FindMaxVersion(m.Item)
+			if err != nil {
+				return nil, err
+			}
+			maxversions[m.Item] = v
+		}
+		if m.Version == v {
+			results = append(results, m)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Item != results[j].Item {
+			return results[i].Item < results[j].Item
+		}
+		return results[i].Slot < results[j].Slot
+	})
+	if offset >= len(results) {
+		return nil, nil
+	}
+	results = results[offset:]
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+func (qc *QlCache) FindMeta(key string, value string, offset int, limit int) ([]MetaMatch, error) {
+	query := `
+			SELECT item, versionid, blobid, name, value
+			FROM meta
+			WHERE name == ?1`
+	args := []interface{}{key}
+	if value != "" {
+		query += ` AND value == ?2`
+		args = append(args, value)
+	}
+	query += ` ORDER BY item, versionid, blobid`
+	args = append(args, limit)
+	query += fmt.Sprintf(` LIMIT ?%d`, len(args))
+	if offset > 0 {
+		args = append(args, offset)
+		query += fmt.Sprintf(` OFFSET ?%d`, len(args))
+	}
+	return scanMeta(qc.db.Query(query, args...))
+}
+
 // construct an return an sql query and parameter list, using the parameters passed
-func buildQLItemListQuery(offset int, pagesize int, sortorder string) string {
+// CountItems returns the number of items in the index, only counting those
+// having a version saved by creator if it is not empty.
+func (qc *QlCache) CountItems(creator string) (int, error) {
+	query := `SELECT count(*) FROM items`
+	var args []interface{}
+	if creator != "" {
+		query += ` WHERE item IN (SELECT item FROM versions WHERE creator == ?1)`
+		args = append(args, creator)
+	}
+	var n int64
+	err := qc.db.QueryRow(query, args...).Scan(&n)
+	return int(n), err
+}
+
+func buildQLItemListQuery(offset int, pagesize int, sortorder string, creator string) (string, []interface{}) {
 	var query bytes.Buffer
+	var args = []interface{}{pagesize}
 	query.WriteString("SELECT item, created, modified, size FROM items ")
+	if creator != "" {
+		args = append(args, creator)
+		fmt.Fprintf(&query, "WHERE item IN (SELECT item FROM versions WHERE creator == ?%d) ", len(args))
+	}
 
 	sortcolumn := ""
 	decending := false
@@ -344,12 +598,12 @@ func buildQLItemListQuery(offset int, pagesize int, sortorder string) string {
 		}
 	}
 
-	query.WriteString(" ORDER BY scheduled_time ")
 	query.WriteString(" LIMIT ?1 ")
 	if offset > 0 {
-		query.WriteString("OFFSET ?2 ")
+		args = append(args, offset)
+		fmt.Fprintf(&query, "OFFSET ?%d ", len(args))
 	}
-	return query.String()
+	return query.String(), args
 }
 
 // NextFixity will return the item id of the earliest scheduled fixity check
@@ -366,7 +620,7 @@ func (qc *QlCache) NextFixity(cutoff time.Time) int64 {
 	var when time.Time
 	err := qc.db.QueryRow(query, cutoff).Scan(&id, &when)
 	if err != nil && err != sql.ErrNoRows {
-		log.Println("nextfixity QL", err)
+		slog.Error("nextfixity QL", "error", err)
 		raven.CaptureError(err, nil)
 	}
 	return id
@@ -386,7 +640,7 @@ func (qc *QlCache) GetFixity(id int64) *Fixity {
 		// no next record
 		return nil
 	} else if err != nil {
-		log.Println("GetFixity", err)
+		slog.Error("GetFixity", "error", err)
 		raven.CaptureError(err, nil)
 		return nil
 	}
@@ -402,7 +656,7 @@ func (qc *QlCache) SearchFixity(start, end time.Time, item string, status string
 	if err == sql.ErrNoRows {
 		return nil
 	} else if err != nil {
-		log.Println("GetFixity QL Query:", err)
+		slog.Error("GetFixity QL Query", "error", err)
 		raven.CaptureError(err, nil)
 		return nil
 	}
@@ -412,7 +666,7 @@ func (qc *QlCache) SearchFixity(start, end time.Time, item string, status string
 		var record = new(Fixity)
 		scanErr := rows.Scan(&record.ID, &record.Item, &record.ScheduledTime, &record.Status, &record.Notes)
 		if scanErr != nil {
-			log.Println("GetFixity QL Scan", err)
+			slog.Error("GetFixity QL Scan", "error", err)
 			raven.CaptureError(err, nil)
 			continue
 		}
@@ -507,6 +761,597 @@ func (qc *QlCache) LookupCheck(item string) (time.Time, error) {
 	return when, err
 }
 
+// FindIdentifier returns the item the given identifier is bound to, or ""
+// if it is not bound.
+func (qc *QlCache) FindIdentifier(identifier string) (string, error) {
+	const query = `SELECT item FROM identifiers WHERE identifier == ?1 LIMIT 1`
+
+	var item string
+	err := qc.db.QueryRow(query, identifier).Scan(&item)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return item, err
+}
+
+// ItemIdentifiers returns the identifiers bound to the given item.
+func (qc *QlCache) ItemIdentifiers(item string) ([]string, error) {
+	const query = `SELECT identifier FROM identifiers WHERE item == ?1 ORDER BY identifier`
+
+	rows, err := qc.db.Query(query, item)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []string
+	for rows.Next() {
+		var identifier string
+		err = rows.Scan(&identifier)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, identifier)
+	}
+	return result, rows.Err()
+}
+
+// BindIdentifier binds the identifier to the given item.
+func (qc *QlCache) BindIdentifier(identifier string, item string) error {
+	const query = `SELECT item FROM identifiers WHERE identifier == ?1 LIMIT 1`
+	const command = `INSERT INTO identifiers (identifier, item, created) VALUES (?1, ?2, ?3)`
+
+	// QL runs one transaction at a time, so no one else can bind the
+	// identifier between the check and the insert.
+	tx, err := qc.db.Begin()
+	if err != nil {
+		return err
+	}
+	var current string
+	err = tx.QueryRow(query, identifier).Scan(&current)
+	if err == sql.ErrNoRows {
+		_, err = tx.Exec(command, identifier, item, time.Now())
+	} else if err == nil && current != item {
+		err = ErrIdentifierBound
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// UnbindIdentifier removes any binding for the given identifier.
+func (qc *QlCache) UnbindIdentifier(identifier string) error {
+	const command = `DELETE FROM identifiers WHERE identifier == ?1`
+	_, err := performExec(qc.db, command, identifier)
+	return err
+}
+
+// RecordAccess sets the last access time of the given item and counts a
+// download for the day.
+func (qc *QlCache) RecordAccess(item string, when time.Time) error {
+	const command = `UPDATE items SET accessed = ?2 WHERE item == ?1`
+	const dbUpdate = `UPDATE item_downloads SET downloads = downloads + 1 WHERE item == ?1 && day == ?2`
+	const dbInsert = `INSERT INTO item_downloads (item, day, downloads) VALUES (?1, ?2, 1)`
+	day := usageDay(when)
+	tx, err := qc.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(command, item, when)
+	var result sql.Result
+	if err == nil {
+		result, err = tx.Exec(dbUpdate, item, day)
+	}
+	if err == nil {
+		var nrows int64
+		nrows, err = result.RowsAffected()
+		if err == nil && nrows == 0 {
+			_, err = tx.Exec(dbInsert, item, day)
+		}
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// RecordDeletion adds a tombstone for the given item.
+func (qc *QlCache) RecordDeletion(item string, when time.Time, deleter string) error {
+	const command = `INSERT INTO tombstones (item, deleted, deleter) VALUES (?1, ?2, ?3)`
+
+	_, err := performExec(qc.db, command, item, when, deleter)
+	return err
+}
+
+// RecordRename adds a tombstone for the given item pointing to its new id.
+func (qc *QlCache) RecordRename(item string, newid string, when time.Time, renamer string) error {
+	const command = `INSERT INTO tombstones (item, deleted, deleter, renamed) VALUES (?1, ?2, ?3, ?4)`
+
+	_, err := performExec(qc.db, command, item, when, renamer, newid)
+	return err
+}
+
+// FindDeletion returns the most recent tombstone for the given item, or nil
+// if there is none.
+func (qc *QlCache) FindDeletion(item string) (*Tombstone, error) {
+	const query = `SELECT deleted, deleter, renamed FROM tombstones WHERE item == ?1 ORDER BY deleted DESC LIMIT 1`
+
+	result := &Tombstone{Item: item}
+	var renamed *string
+	err := qc.db.QueryRow(query, item).Scan(&result.Deleted, &result.Deleter, &renamed)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if renamed != nil {
+		result.RenamedTo = *renamed
+	}
+	return result, nil
+}
+
+// ReserveID records that id was minted, and returns false if it was minted
+// before.
+func (qc *QlCache) ReserveID(id string, when time.Time) (bool, error) {
+	const query = `SELECT count(*) FROM minted WHERE id == ?1`
+	const command = `INSERT INTO minted (id, minted) VALUES (?1, ?2)`
+
+	// QL runs one transaction at a time, so no one else can reserve the
+	// id between the check and the insert.
+	tx, err := qc.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	var n int64
+	err = tx.QueryRow(query, id).Scan(&n)
+	if err == nil && n == 0 {
+		_, err = tx.Exec(command, id, when)
+	}
+	if err != nil || n > 0 {
+		_ = tx.Rollback()
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// NextSequence increments the named counter and returns its new value. A
+// counter which does not exist yet starts at first.
+func (qc *QlCache) NextSequence(name string, first int64) (int64, error) {
+	const query = `SELECT value FROM sequences WHERE name == ?1`
+	const dbUpdate = `UPDATE sequences SET value = ?2 WHERE name == ?1`
+	const dbInsert = `INSERT INTO sequences (name, value) VALUES (?1, ?2)`
+
+	tx, err := qc.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	err = tx.QueryRow(query, name).Scan(&n)
+	if err == sql.ErrNoRows {
+		n = first
+		_, err = tx.Exec(dbInsert, name, n)
+	} else if err == nil {
+		n++
+		_, err = tx.Exec(dbUpdate, name, n)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// AddToken saves the given token under hash, and returns its id.
+func (qc *QlCache) AddToken(t APIToken, hash string) (int64, error) {
+	const command = `INSERT INTO tokens (hash, username, role, created, creator) VALUES (?1, ?2, ?3, ?4, ?5)`
+
+	result, err := performExec(qc.db, command, hash, t.User, t.Role, t.Created, t.Creator)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// FindToken returns the token stored under hash, or nil if there is none.
+func (qc *QlCache) FindToken(hash string) (*APIToken, error) {
+	const query = `SELECT id(), username, role, created, creator, revoked FROM tokens WHERE hash == ?1`
+
+	return qc.queryToken(query, hash)
+}
+
+// GetToken returns the token with the given id, or nil if there is none.
+func (qc *QlCache) GetToken(id int64) (*APIToken, error) {
+	const query = `SELECT id(), username, role, created, creator, revoked FROM tokens WHERE id() == ?1`
+
+	return qc.queryToken(query, id)
+}
+
+func (qc *QlCache) queryToken(query string, arg interface{}) (*APIToken, error) {
+	var t APIToken
+	var revoked *time.Time
+	err := qc.db.QueryRow(query, arg).Scan(&t.ID, &t.User, &t.Role, &t.Created, &t.Creator, &revoked)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if revoked != nil {
+		t.Revoked = *revoked
+	}
+	return &t, nil
+}
+
+// ListTokens returns every token in order of id.
+func (qc *QlCache) ListTokens() ([]APIToken, error) {
+	const query = `SELECT id(), username, role, created, creator, revoked FROM tokens ORDER BY id()`
+
+	rows, err := qc.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []APIToken
+	for rows.Next() {
+		var t APIToken
+		var revoked *time.Time
+		err = rows.Scan(&t.ID, &t.User, &t.Role, &t.Created, &t.Creator, &revoked)
+		if err != nil {
+			return nil, err
+		}
+		if revoked != nil {
+			t.Revoked = *revoked
+		}
+		result = append(result, t)
+	}
+	return result, rows.Err()
+}
+
+// RevokeToken sets the revocation time of the given token, unless it is
+// already revoked by then.
+func (qc *QlCache) RevokeToken(id int64, when time.Time) error {
+	const command = `UPDATE tokens SET revoked = ?2 WHERE id() == ?1 && (revoked IS NULL || revoked > ?2)`
+
+	_, err := performExec(qc.db, command, id, when)
+	return err
+}
+
+// ItemDownloads returns the daily download counts for item, or for every
+// item if it is empty, starting with the given day.
+func (qc *QlCache) ItemDownloads(item string, since time.Time) ([]DownloadRecord, error) {
+	const query = `SELECT item, day, downloads FROM item_downloads
+		WHERE day >= ?1 && (?2 == "" || item == ?2)
+		ORDER BY day, item`
+
+	rows, err := qc.db.Query(query, usageDay(since), item)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []DownloadRecord
+	for rows.Next() {
+		var rec DownloadRecord
+		err = rows.Scan(&rec.Item, &rec.Day, &rec.Downloads)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, rec)
+	}
+	return results, rows.Err()
+}
+
+// ItemAccessList returns the size and times of every item.
+func (qc *QlCache) ItemAccessList() ([]SimpleItem, error) {
+	const query = `SELECT item, created, modified, accessed, size FROM items`
+
+	rows, err := qc.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []SimpleItem
+	for rows.Next() {
+		var rec SimpleItem
+		var accessed *time.Time
+		err = rows.Scan(&rec.ID, &rec.Created, &rec.Modified, &accessed, &rec.Size)
+		if err != nil {
+			return nil, err
+		}
+		if accessed != nil {
+			rec.Accessed = *accessed
+		}
+		results = append(results, rec)
+	}
+	return results, rows.Err()
+}
+
+// RecordUsage adds n bytes to the usage for the given day.
+func (qc *QlCache) RecordUsage(kind string, name string, when time.Time, n int64) error {
+	const dbUpdate = `UPDATE upload_usage SET bytes = bytes + ?4 WHERE kind == ?1 && name == ?2 && day == ?3`
+	const dbInsert = `INSERT INTO upload_usage (kind, name, day, bytes) VALUES (?1, ?2, ?3, ?4)`
+	day := usageDay(when)
+	tx, err := qc.db.Begin()
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec(dbUpdate, kind, name, day, n)
+	if err == nil {
+		var nrows int64
+		nrows, err = result.RowsAffected()
+		if err == nil && nrows == 0 {
+			_, err = tx.Exec(dbInsert, kind, name, day, n)
+		}
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// UsageSince returns the daily usage records starting with the given day.
+func (qc *QlCache) UsageSince(since time.Time) ([]UsageRecord, error) {
+	const query = `SELECT kind, name, day, bytes FROM upload_usage WHERE day >= ?1`
+
+	rows, err := qc.db.Query(query, usageDay(since))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []UsageRecord
+	for rows.Next() {
+		var rec UsageRecord
+		err = rows.Scan(&rec.Kind, &rec.Name, &rec.Day, &rec.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, rec)
+	}
+	return results, rows.Err()
+}
+
+// UserUsage returns the total bytes of the given kind and name starting
+// with the given day.
+func (qc *QlCache) UserUsage(kind string, name string, since time.Time) (int64, error) {
+	const query = `SELECT bytes FROM upload_usage WHERE kind == ?1 && name == ?2 && day >= ?3`
+
+	rows, err := qc.db.Query(query, kind, name, usageDay(since))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var total int64
+	for rows.Next() {
+		var n int64
+		err = rows.Scan(&n)
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, rows.Err()
+}
+
+// RecordAudit adds an entry to the audit log.
+func (qc *QlCache) RecordAudit(entry AuditEntry) error {
+	const command = `INSERT INTO audit (logged, username, remote, method, path, item, status) VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7)`
+
+	_, err := performExec(qc.db, command, entry.When, entry.User, entry.Remote, entry.Method, entry.Path, entry.Item, int64(entry.Status))
+	return err
+}
+
+// SearchAudit returns the audit log entries in the given range, newest
+// first.
+func (qc *QlCache) SearchAudit(start, end time.Time, item string, limit int) ([]AuditEntry, error) {
+	var query bytes.Buffer
+	// as with buildQLQuery, every parameter is passed and the query only
+	// uses the ones it needs.
+	query.WriteString("SELECT logged, username, remote, method, path, item, status FROM audit")
+	conjunction := " WHERE "
+	if !start.IsZero() {
+		query.WriteString(conjunction + "logged >= ?1")
+		conjunction = " && "
+	}
+	if !end.IsZero() {
+		query.WriteString(conjunction + "logged <= ?2")
+		conjunction = " && "
+	}
+	if item != "" {
+		query.WriteString(conjunction + "item == ?3")
+	}
+	query.WriteString(" ORDER BY id() DESC LIMIT ?4")
+
+	rows, err := qc.db.Query(query.String(), start, end, item, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		var status int64
+		err = rows.Scan(&e.When, &e.User, &e.Remote, &e.Method, &e.Path, &e.Item, &status)
+		if err != nil {
+			return nil, err
+		}
+		e.Status = int(status)
+		result = append(result, e)
+	}
+	return result, rows.Err()
+}
+
+// AddEvent saves e in the event feed and returns its sequence number.
+func (qc *QlCache) AddEvent(e Event) (int64, error) {
+	const command = `INSERT INTO events (logged, type, item, version, tx, username, target, receipt)
+		VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8)`
+
+	target, receipt, err := encodeReceipt(e.Receipt)
+	if err != nil {
+		return 0, err
+	}
+	result, err := performExec(qc.db, command, e.When, e.Type, e.Item, int64(e.Version), e.Transaction, e.User, target, receipt)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// EventsAfter returns up to limit events following the one with sequence
+// number seq, in order.
+func (qc *QlCache) EventsAfter(seq int64, limit int) ([]Event, error) {
+	const query = `SELECT id(), logged, type, item, version, tx, username, receipt FROM events
+		WHERE id() > ?1
+		ORDER BY id()
+		LIMIT ?2`
+
+	rows, err := qc.db.Query(query, seq, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []Event
+	for rows.Next() {
+		var e Event
+		var version int64
+		var receipt *string
+		err = rows.Scan(&e.Seq, &e.When, &e.Type, &e.Item, &version, &e.Transaction, &e.User, &receipt)
+		if err != nil {
+			return nil, err
+		}
+		e.Version = int(version)
+		if receipt != nil {
+			e.Receipt, err = decodeReceipt(*receipt)
+			if err != nil {
+				return nil, err
+			}
+		}
+		result = append(result, e)
+	}
+	return result, rows.Err()
+}
+
+// LastEvent returns the sequence number of the newest event, or 0 if there
+// are none.
+func (qc *QlCache) LastEvent() (int64, error) {
+	const query = `SELECT id() FROM events ORDER BY id() DESC LIMIT 1`
+
+	var seq int64
+	err := qc.db.QueryRow(query).Scan(&seq)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return seq, err
+}
+
+// LastExports returns when each item was last sent to the export target
+// with the given name.
+func (qc *QlCache) LastExports(target string) (map[string]time.Time, error) {
+	const query = `SELECT item, max(logged) FROM events
+		WHERE type == ?1 && target == ?2
+		GROUP BY item`
+
+	rows, err := qc.db.Query(query, EventExport, target)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[string]time.Time)
+	for rows.Next() {
+		var item string
+		var when time.Time
+		err = rows.Scan(&item, &when)
+		if err != nil {
+			return nil, err
+		}
+		result[item] = when
+	}
+	return result, rows.Err()
+}
+
+// AddSubscription saves sub and returns its id.
+func (qc *QlCache) AddSubscription(sub Subscription) (int64, error) {
+	const command = `INSERT INTO subscriptions (url, prefix, types, created, creator, delivered, failures, lasterror)
+		VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8)`
+
+	result, err := performExec(qc.db, command, sub.URL, sub.Prefix, strings.Join(sub.Types, ","),
+		sub.Created, sub.Creator, sub.Delivered, int64(sub.Failures), sub.LastError)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// GetSubscription returns the subscription with the given id, or nil if
+// there is none.
+func (qc *QlCache) GetSubscription(id int64) (*Subscription, error) {
+	const query = `SELECT id(), url, prefix, types, created, creator, delivered, failures, lasterror, lasttry
+		FROM subscriptions WHERE id() == ?1`
+
+	rows, err := qc.db.Query(query, id)
+	if err != nil {
+		return nil, err
+	}
+	list, err := scanQLSubscriptions(rows)
+	if err != nil || len(list) == 0 {
+		return nil, err
+	}
+	return &list[0], nil
+}
+
+// ListSubscriptions returns every subscription in order of id.
+func (qc *QlCache) ListSubscriptions() ([]Subscription, error) {
+	const query = `SELECT id(), url, prefix, types, created, creator, delivered, failures, lasterror, lasttry
+		FROM subscriptions ORDER BY id()`
+
+	rows, err := qc.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	return scanQLSubscriptions(rows)
+}
+
+func scanQLSubscriptions(rows *sql.Rows) ([]Subscription, error) {
+	defer rows.Close()
+	var result []Subscription
+	for rows.Next() {
+		var sub Subscription
+		var types string
+		var failures int64
+		var lasttry *time.Time
+		err := rows.Scan(&sub.ID, &sub.URL, &sub.Prefix, &types, &sub.Created, &sub.Creator,
+			&sub.Delivered, &failures, &sub.LastError, &lasttry)
+		if err != nil {
+			return nil, err
+		}
+		if types != "" {
+			sub.Types = strings.Split(types, ",")
+		}
+		sub.Failures = int(failures)
+		if lasttry != nil {
+			sub.LastTry = *lasttry
+		}
+		result = append(result, sub)
+	}
+	return result, rows.Err()
+}
+
+// UpdateDelivery saves the delivery state of sub.
+func (qc *QlCache) UpdateDelivery(sub Subscription) error {
+	const command = `UPDATE subscriptions SET delivered = ?2, failures = ?3, lasterror = ?4, lasttry = ?5 WHERE id() == ?1`
+
+	_, err := performExec(qc.db, command, sub.ID, sub.Delivered, int64(sub.Failures), sub.LastError, sub.LastTry)
+	return err
+}
+
+// DeleteSubscription removes the subscription with the given id.
+func (qc *QlCache) DeleteSubscription(id int64) error {
+	const command = `DELETE FROM subscriptions WHERE id() == ?1`
+
+	_, err := performExec(qc.db, command, id)
+	return err
+}
+
 func performExec(db *sql.DB, query string, args ...interface{}) (sql.Result, error) {
 	tx, err := db.Begin()
 	if err != nil {
@@ -609,3 +1454,228 @@ func qlschema3(tx migration.LimitedTx) error {
 	_, err := tx.Exec(s)
 	return err
 }
+
+func qlschema4(tx migration.LimitedTx) error {
+	// mapping of external identifiers to items
+	const s = `
+		CREATE TABLE IF NOT EXISTS identifiers (
+			identifier string,
+			item string,
+			created time
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS identifier_id ON identifiers (identifier);
+		CREATE INDEX IF NOT EXISTS identifier_item ON identifiers (item);
+		`
+
+	_, err := tx.Exec(s)
+	return err
+}
+
+func qlschema5(tx migration.LimitedTx) error {
+	// track when items were last read
+	const s = `ALTER TABLE items ADD accessed time;`
+
+	_, err := tx.Exec(s)
+	return err
+}
+
+func qlschema6(tx migration.LimitedTx) error {
+	// support listing items by creator
+	const s = `CREATE INDEX IF NOT EXISTS version_creator ON versions (creator);`
+
+	_, err := tx.Exec(s)
+	return err
+}
+
+func qlschema7(tx migration.LimitedTx) error {
+	// daily totals of uploaded bytes by token and by item
+	const s = `
+		CREATE TABLE IF NOT EXISTS upload_usage (
+			kind string,
+			name string,
+			day time,
+			bytes int64
+		);
+		CREATE INDEX IF NOT EXISTS upload_usage_day ON upload_usage (day);
+		`
+
+	_, err := tx.Exec(s)
+	return err
+}
+
+func qlschema8(tx migration.LimitedTx) error {
+	// daily download counts by item
+	const s = `
+		CREATE TABLE IF NOT EXISTS item_downloads (
+			item string,
+			day time,
+			downloads int64
+		);
+		CREATE INDEX IF NOT EXISTS item_downloads_item ON item_downloads (item);
+		CREATE INDEX IF NOT EXISTS item_downloads_day ON item_downloads (day);
+		`
+
+	_, err := tx.Exec(s)
+	return err
+}
+
+func qlschema9(tx migration.LimitedTx) error {
+	// deleted items
+	const s = `
+		CREATE TABLE IF NOT EXISTS tombstones (
+			item string,
+			deleted time,
+			deleter string
+		);
+		CREATE INDEX IF NOT EXISTS tombstones_item ON tombstones (item);
+		`
+
+	_, err := tx.Exec(s)
+	return err
+}
+
+func qlschema10(tx migration.LimitedTx) error {
+	// API tokens. Only a hash of each token is kept.
+	const s = `
+		CREATE TABLE IF NOT EXISTS tokens (
+			hash string,
+			username string,
+			role string,
+			created time,
+			creator string,
+			revoked time
+		);
+		CREATE INDEX IF NOT EXISTS tokens_hash ON tokens (hash);
+		`
+
+	_, err := tx.Exec(s)
+	return err
+}
+
+func qlschema11(tx migration.LimitedTx) error {
+	// the audit log of requests which change something
+	const s = `
+		CREATE TABLE IF NOT EXISTS audit (
+			logged time,
+			username string,
+			remote string,
+			method string,
+			path string,
+			item string,
+			status int64
+		);
+		CREATE INDEX IF NOT EXISTS audit_logged ON audit (logged);
+		CREATE INDEX IF NOT EXISTS audit_item ON audit (item);
+		`
+
+	_, err := tx.Exec(s)
+	return err
+}
+
+func qlschema12(tx migration.LimitedTx) error {
+	// finding duplicate blobs across items
+	const s = `CREATE INDEX IF NOT EXISTS blob_sha256 ON blobs (SHA256);`
+
+	_, err := tx.Exec(s)
+	return err
+}
+
+func qlschema13(tx migration.LimitedTx) error {
+	// the item event feed and the subscriptions to it
+	const s = `
+		CREATE TABLE IF NOT EXISTS events (
+			logged time,
+			type string,
+			item string,
+			version int64,
+			tx string,
+			username string
+		);
+		CREATE TABLE IF NOT EXISTS subscriptions (
+			url string,
+			prefix string,
+			types string,
+			created time,
+			creator string,
+			delivered int64,
+			failures int64,
+			lasterror string,
+			lasttry time
+		);
+		`
+
+	_, err := tx.Exec(s)
+	return err
+}
+
+func qlschema14(tx migration.LimitedTx) error {
+	// tombstones left by renaming an item point to its new id
+	const s = `ALTER TABLE tombstones ADD renamed string;`
+
+	_, err := tx.Exec(s)
+	return err
+}
+
+func qlschema15(tx migration.LimitedTx) error {
+	// events record the receipts of items sent to export targets
+	const s = `
+		ALTER TABLE events ADD target string;
+		ALTER TABLE events ADD receipt string;
+		CREATE INDEX IF NOT EXISTS events_target ON events (target);
+		`
+
+	_, err := tx.Exec(s)
+	return err
+}
+
+func qlschema16(tx migration.LimitedTx) error {
+	// user-defined metadata on versions and blobs. Rows for a version
+	// have a blobid of 0, and rows for a blob have a versionid of 0.
+	const s = `
+		CREATE TABLE IF NOT EXISTS meta (
+			item string,
+			versionid int,
+			blobid int,
+			name string,
+			value string
+		);
+		CREATE INDEX IF NOT EXISTS meta_item ON meta (item);
+		CREATE INDEX IF NOT EXISTS meta_name ON meta (name);
+		`
+
+	_, err := tx.Exec(s)
+	return err
+}
+
+func qlschema17(tx migration.LimitedTx) error {
+	// minted item ids, and counters for the sequential minter. The value
+	// of a counter is the last number handed out.
+	const s = `
+		CREATE TABLE IF NOT EXISTS minted (
+			id string,
+			minted time
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS minted_id ON minted (id);
+		CREATE TABLE IF NOT EXISTS sequences (
+			name string,
+			value int64
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS sequences_name ON sequences (name);
+		`
+
+	_, err := tx.Exec(s)
+	return err
+}
+
+func qlschema18(tx migration.LimitedTx) error {
+	// blobs which refer to a blob in another item, so the other blob is
+	// not removed while they do
+	const s = `
+		ALTER TABLE blobs ADD refitem string;
+		ALTER TABLE blobs ADD refblob int;
+		CREATE INDEX IF NOT EXISTS blob_refitem ON blobs (refitem);
+		`
+
+	_, err := tx.Exec(s)
+	return err
+}
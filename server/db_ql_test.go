@@ -93,7 +93,7 @@ func TestQLIndexItem(t *testing.T) {
 		t.Error("Received max blob", n, "expected", 3, err)
 	}
 
-	n, err = qc.getMaxVersion(itemid)
+	n, err = qc.FindMaxVersion(itemid)
 	if err != nil || n != 2 {
 		t.Error("Received max version", n, "expected", 2, err)
 	}
@@ -107,3 +107,201 @@ func TestQLIndexItem(t *testing.T) {
 		}
 	}
 }
+
+func TestQLDeleteItem(t *testing.T) {
+	qc, err := NewQlCache("mem--deleteitem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testitem := &items.Item{
+		ID:       "abcd",
+		Blobs:    []*items.Blob{&items.Blob{ID: 1, Size: 5, Bundle: 1}},
+		Versions: []*items.Version{&items.Version{ID: 1, Slots: map[string]items.BlobID{"a": 1}}},
+	}
+	qc.Set("abcd", testitem)
+	qc.Set("abcde", testitem)
+	err = qc.BindIdentifier("doi:abcd", "abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = qc.DeleteItem("abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qc.Lookup("abcd") != nil {
+		t.Error("item record not deleted")
+	}
+	b, err := qc.FindBlobBySlot("abcd", 0, "a")
+	if b != nil || err != nil {
+		t.Error("Received", b, err)
+	}
+	item, _ := qc.FindIdentifier("doi:abcd")
+	if item != "" {
+		t.Error("identifier still bound to", item)
+	}
+	// other items are untouched
+	b, err = qc.FindBlobBySlot("abcde", 0, "a")
+	if b == nil || err != nil {
+		t.Error("Received", b, err)
+	}
+}
+
+func TestQLItemListCreator(t *testing.T) {
+	qc, err := NewQlCache("mem--itemlistcreator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []struct{ id, creator string }{
+		{"a", "alice"},
+		{"b", "bob"},
+		{"c", "alice"},
+	} {
+		qc.Set(v.id, &items.Item{
+			ID:       v.id,
+			Versions: []*items.Version{&items.Version{ID: 1, Creator: v.creator}},
+		})
+	}
+	var tests = []struct {
+		creator string
+		offset  int
+		expect  int
+	}{
+		{"", 0, 3},
+		{"alice", 0, 2},
+		{"alice", 1, 1},
+		{"bob", 0, 1},
+		{"carol", 0, 0},
+	}
+	for _, test := range tests {
+		list, err := qc.GetItemList(test.offset, 10, "name", test.creator)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != test.expect {
+			t.Errorf("creator %q offset %d: got %d items, expected %d",
+				test.creator, test.offset, len(list), test.expect)
+		}
+		n, err := qc.CountItems(test.creator)
+		if err != nil || n != test.expect+test.offset {
+			t.Errorf("creator %q: counted %d, %v, expected %d",
+				test.creator, n, err, test.expect+test.offset)
+		}
+	}
+}
+
+func TestQLIdentifiers(t *testing.T) {
+	qc, err := NewQlCache("mem--identifiers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runIdentifierSequence(t, qc)
+	qc.db.Close()
+}
+
+func TestQLAccess(t *testing.T) {
+	qc, err := NewQlCache("mem--access")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runAccessSequence(t, qc)
+	qc.db.Close()
+}
+
+func TestQLTombstones(t *testing.T) {
+	qc, err := NewQlCache("mem--tombstones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runTombstoneSequence(t, qc)
+	qc.db.Close()
+}
+
+func TestQLAudit(t *testing.T) {
+	qc, err := NewQlCache("mem--audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runAuditSequence(t, qc)
+	qc.db.Close()
+}
+
+func TestQLEvents(t *testing.T) {
+	qc, err := NewQlCache("mem--events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runEventSequence(t, qc)
+	qc.db.Close()
+}
+
+func TestQLUsage(t *testing.T) {
+	qc, err := NewQlCache("mem--usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runUsageSequence(t, qc)
+	qc.db.Close()
+}
+
+func TestQLFindSlots(t *testing.T) {
+	qc, err := NewQlCache("mem--findslots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runSlotSearchSequence(t, qc)
+	runMetaSearchSequence(t, qc)
+	qc.db.Close()
+}
+
+func TestQLCheckSchema(t *testing.T) {
+	qc, err := NewQlCache("mem--checkschema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CheckQlSchema("mem--checkschema")
+	if err != nil {
+		t.Error(err)
+	}
+	// pretend a newer bendo has migrated the database
+	tx, err := qc.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = qlVersioning.set(tx, len(qlMigrations)+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+	err = CheckQlSchema("mem--checkschema")
+	if err == nil {
+		t.Error("Expected an error for a newer schema")
+	}
+}
+
+func TestQLPlanMigrations(t *testing.T) {
+	plan, err := PlanQlMigrations("mem--planmigrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.From != 0 || plan.To != len(qlMigrations) || len(plan.Statements) == 0 {
+		t.Errorf("Received plan %d to %d with %d statements", plan.From, plan.To, len(plan.Statements))
+	}
+	// the dry run did not change anything
+	plan, _ = PlanQlMigrations("mem--planmigrations")
+	if plan.From != 0 {
+		t.Errorf("Received version %d after a dry run", plan.From)
+	}
+
+	_, err = NewQlCache("mem--planmigrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err = PlanQlMigrations("mem--planmigrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.From != len(qlMigrations) || len(plan.Statements) != 0 {
+		t.Errorf("Received plan %d to %d with %d statements after migrating", plan.From, plan.To, len(plan.Statements))
+	}
+}
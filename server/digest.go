@@ -0,0 +1,45 @@
+package server
+
+import (
+	"encoding/base64"
+	"strings"
+)
+
+// The digest algorithm names used in the Content-Digest and Repr-Digest
+// headers of RFC 9530.
+const (
+	digestSHA256 = "sha-256"
+	digestMD5    = "md5" // deprecated by the RFC, but still accepted
+)
+
+// formatDigest returns a Content-Digest or Repr-Digest header value giving
+// the SHA-256 checksum h.
+func formatDigest(h []byte) string {
+	return digestSHA256 + "=:" + base64.StdEncoding.EncodeToString(h) + ":"
+}
+
+// parseDigest decodes a Content-Digest or Repr-Digest header value, which is
+// a structured field dictionary such as "sha-256=:base64:, md5=:base64:".
+// It returns the checksums keyed by lower case algorithm name. Members which
+// cannot be decoded are skipped.
+func parseDigest(v string) map[string][]byte {
+	result := make(map[string][]byte)
+	for _, member := range strings.Split(v, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if !ok {
+			continue
+		}
+		// ignore any parameters
+		value, _, _ = strings.Cut(value, ";")
+		value = strings.TrimSpace(value)
+		if len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+			continue
+		}
+		h, err := base64.StdEncoding.DecodeString(value[1 : len(value)-1])
+		if err != nil {
+			continue
+		}
+		result[strings.ToLower(name)] = h
+	}
+	return result
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"net/http"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestParseDigest(t *testing.T) {
+	sum := sha256.Sum256([]byte("hello world"))
+	v := formatDigest(sum[:])
+	if v != "sha-256=:uU0nuZNNPgilLlLX2n2r+sSE7+N6U4DukIj3rOLvzek=:" {
+		t.Errorf("Received %q", v)
+	}
+	var tests = []struct {
+		header string
+		names  []string
+	}{
+		{v, []string{"sha-256"}},
+		{"SHA-256=:uU0nuZNNPgilLlLX2n2r+sSE7+N6U4DukIj3rOLvzek=:", []string{"sha-256"}},
+		{"md5=:XrY7u+Ae7tCTyyK7j1rNww==:, " + v, []string{"md5", "sha-256"}},
+		{v + ";param=1", []string{"sha-256"}},
+		{"sha-256=uU0nuZNNPgilLlLX2n2r+sSE7+N6U4DukIj3rOLvzek=", nil}, // not a byte sequence
+		{"sha-256=:not base64:", nil},
+		{"", nil},
+	}
+	for _, test := range tests {
+		result := parseDigest(test.header)
+		if len(result) != len(test.names) {
+			t.Errorf("%q: received %v, expected %v", test.header, result, test.names)
+			continue
+		}
+		for _, name := range test.names {
+			if len(result[name]) == 0 {
+				t.Errorf("%q: missing %s in %v", test.header, name, result)
+			}
+		}
+	}
+	if h := parseDigest(v)["sha-256"]; !bytes.Equal(h, sum[:]) {
+		t.Errorf("Received %x, expected %x", h, sum)
+	}
+}
+
+func uploadWithDigest(t *testing.T, route, s, digest string) *http.Response {
+	req, err := http.NewRequest("POST", testServer.URL+route, strings.NewReader(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Digest", digest)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(route, err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestContentDigest(t *testing.T) {
+	const content = "hello world"
+	sum := sha256.Sum256([]byte(content))
+	// md5 of something else
+	resp := uploadWithDigest(t, "/upload", content, "md5=:AAAAAAAAAAAAAAAAAAAAAA==:")
+	if resp.StatusCode != 412 {
+		t.Errorf("Received status %d, expected 412", resp.StatusCode)
+	}
+	resp = uploadWithDigest(t, "/upload", content, "sha-512=:AAAA:")
+	if resp.StatusCode != 400 {
+		t.Errorf("Received status %d, expected 400", resp.StatusCode)
+	}
+	resp = uploadWithDigest(t, "/upload", content, formatDigest(sum[:]))
+	if resp.StatusCode != 200 {
+		t.Fatalf("Received status %d, expected 200", resp.StatusCode)
+	}
+	fileid := path.Base(resp.Header.Get("Location"))
+
+	itemid := "digest" + randomid()
+	txpath := sendtransaction(t, "/item/"+itemid+"/transaction",
+		[][]string{{"add", fileid}, {"slot", "a", fileid}}, 202)
+	waitTransaction(t, txpath)
+
+	resp = checkRoute(t, "GET", "/item/"+itemid+"/a", 200)
+	resp.Body.Close()
+	for _, name := range []string{"Content-Digest", "Repr-Digest"} {
+		if v := resp.Header.Get(name); v != formatDigest(sum[:]) {
+			t.Errorf("Received %s %q", name, v)
+		}
+	}
+
+	// a range response is only part of the content
+	req, _ := http.NewRequest("GET", testServer.URL+"/item/"+itemid+"/a", nil)
+	req.Header.Set("Range", "bytes=0-4")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 206 {
+		t.Errorf("Received status %d, expected 206", resp.StatusCode)
+	}
+	if v := resp.Header.Get("Content-Digest"); v != "" {
+		t.Errorf("Received Content-Digest %q for a range", v)
+	}
+	if v := resp.Header.Get("Repr-Digest"); v != formatDigest(sum[:]) {
+		t.Errorf("Received Repr-Digest %q", v)
+	}
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+	"github.com/julienschmidt/httprouter"
+)
+
+// A DownloadRecord is the number of times content from one item was read on
+// a single day.
+type DownloadRecord struct {
+	Item      string
+	Day       time.Time // midnight UTC at the start of the day
+	Downloads int64
+}
+
+// DownloadStats counts the downloads of one or more items over time, for
+// curators reporting on how their collections are used.
+type DownloadStats struct {
+	Generated time.Time
+	Items     []string  `json:",omitempty"` // the items counted, or empty for every item
+	Since     time.Time // the first day included
+	Bucket    string    // either "day" or "month"
+	Total     int64
+
+	// Periods has the downloads in each day or month, oldest first.
+	// Periods without downloads are included.
+	Periods []DownloadCount
+
+	// ByItem has the downloads of each item, largest first, truncated to
+	// the limit given when making the report. It is only filled in when
+	// more than one item is counted.
+	ByItem []DownloadCount `json:",omitempty"`
+}
+
+// A DownloadCount is the number of downloads in a period or of an item.
+type DownloadCount struct {
+	Name      string
+	Downloads int64
+}
+
+// periodFormat gives the layout of the period names for each bucket size.
+var periodFormat = map[string]string{
+	"day":   "2006-01-02",
+	"month": "2006-01",
+}
+
+// buildDownloadStats tallies the given records into buckets of the given
+// size, from the day containing since up to now. At most limit items are
+// listed in ByItem.
+func buildDownloadStats(records []DownloadRecord, items []string, now time.Time, since time.Time, bucket string, limit int) DownloadStats {
+	stats := DownloadStats{
+		Generated: now,
+		Items:     items,
+		Since:     usageDay(since),
+		Bucket:    bucket,
+	}
+	layout := periodFormat[bucket]
+	periods := make(map[string]int64)
+	byitem := make(map[string]int64)
+	for _, rec := range records {
+		if rec.Day.Before(stats.Since) {
+			continue
+		}
+		stats.Total += rec.Downloads
+		periods[rec.Day.UTC().Format(layout)] += rec.Downloads
+		byitem[rec.Item] += rec.Downloads
+	}
+	// list every period, even those without downloads
+	end := now.UTC().Format(layout)
+	for d := stats.Since; ; {
+		name := d.Format(layout)
+		stats.Periods = append(stats.Periods, DownloadCount{Name: name, Downloads: periods[name]})
+		if name >= end {
+			break
+		}
+		if bucket == "month" {
+			d = time.Date(d.Year(), d.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		} else {
+			d = d.AddDate(0, 0, 1)
+		}
+	}
+	if len(items) != 1 {
+		for _, total := range sortTotals(byitem) {
+			stats.ByItem = append(stats.ByItem, DownloadCount{Name: total.Name, Downloads: total.Bytes})
+		}
+		if len(stats.ByItem) > limit {
+			stats.ByItem = stats.ByItem[:limit]
+		}
+	}
+	return stats
+}
+
+// downloadParams reads the bucket size and starting day from the request.
+// The parameter "bucket" is either "day" (the default) or "month". The
+// parameter "since" is the first day to include, as YYYY-MM-DD. Otherwise
+// "days" gives how many days to include, counting today (default 30 for
+// days and 365 for months).
+func downloadParams(r *http.Request, now time.Time) (string, time.Time, bool) {
+	bucket := r.FormValue("bucket")
+	if bucket == "" {
+		bucket = "day"
+	}
+	if _, ok := periodFormat[bucket]; !ok {
+		return "", time.Time{}, false
+	}
+	if v := r.FormValue("since"); v != "" {
+		since, err := time.Parse("2006-01-02", v)
+		return bucket, since, err == nil && !since.After(now)
+	}
+	days, err := strconv.Atoi(r.FormValue("days"))
+	if err != nil || days <= 0 {
+		days = 30
+		if bucket == "month" {
+			days = 365
+		}
+	}
+	return bucket, usageDay(now).AddDate(0, 0, -(days - 1)), true
+}
+
+// ItemStatsHandler handles requests to GET /item/:id/@stats
+// It returns the number of downloads of the item in each day or month. See
+// downloadParams for the parameters.
+func (s *RESTServer) ItemStatsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.Access == nil {
+		NotImplementedHandler(w, r, ps)
+		return
+	}
+	id := ps.ByName("id")
+	s.writeDownloadStats(w, r, []string{id})
+}
+
+// DownloadStatsHandler handles requests to GET /admin/reports/downloads
+// It returns the number of downloads in each day or month of the items
+// given by the (repeatable) "item" parameter, such as all the items in a
+// collection, or of every item if none are given. The optional parameter
+// "limit" sets the most items to list (default 100). See downloadParams for
+// the other parameters.
+func (s *RESTServer) DownloadStatsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.Access == nil {
+		NotImplementedHandler(w, r, ps)
+		return
+	}
+	r.ParseForm()
+	s.writeDownloadStats(w, r, r.Form["item"])
+}
+
+// writeDownloadStats sends the download statistics for the given items, or
+// for every item if the list is empty.
+func (s *RESTServer) writeDownloadStats(w http.ResponseWriter, r *http.Request, items []string) {
+	now := time.Now()
+	bucket, since, ok := downloadParams(r, now)
+	if !ok {
+		w.WriteHeader(400)
+		w.Write([]byte("bucket must be day or month, and since must be a past date as YYYY-MM-DD\n"))
+		return
+	}
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit < 0 {
+		limit = 100
+	}
+	var records []DownloadRecord
+	if len(items) == 0 {
+		records, err = s.Access.ItemDownloads("", since)
+	}
+	for _, item := range items {
+		var list []DownloadRecord
+		list, err = s.Access.ItemDownloads(item, since)
+		if err != nil {
+			break
+		}
+		records = append(records, list...)
+	}
+	if err != nil {
+		requestLogger(r).Error("ItemDownloads", "items", items, "error", err)
+		raven.CaptureError(err, nil)
+		w.WriteHeader(500)
+		return
+	}
+	stats := buildDownloadStats(records, items, now, since, bucket, limit)
+	writeHTMLorJSON(w, r, downloadStatsTemplate, stats)
+}
+
+var (
+	downloadStatsTemplate = template.Must(template.New("downloadstats").Parse(`<html>
+<h1>Download Statistics</h1>
+<dl>
+<dt>Generated</dt><dd>{{ .Generated }}</dd>
+<dt>Items</dt><dd>{{ range .Items }}<a href="/item/{{ . }}">{{ . }}</a> {{ else }}All items{{ end }}</dd>
+<dt>Since</dt><dd>{{ .Since }}</dd>
+<dt>Total</dt><dd>{{ .Total }}</dd>
+</dl>
+<h2>Downloads by {{ .Bucket }}</h2>
+<table><thead><tr>
+	<th>Period</th><th>Downloads</th>
+</tr></thead><tbody>
+{{ range .Periods }}
+	<tr><td>{{ .Name }}</td><td>{{ .Downloads }}</td></tr>
+{{ end }}
+</tbody></table>
+{{ with .ByItem }}
+<h2>Items</h2>
+<table><thead><tr>
+	<th>Item</th><th>Downloads</th>
+</tr></thead><tbody>
+{{ range . }}
+	<tr><td><a href="/item/{{ .Name }}">{{ .Name }}</a></td><td>{{ .Downloads }}</td></tr>
+{{ end }}
+</tbody></table>
+{{ end }}
+</html>`))
+)
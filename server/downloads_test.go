@@ -0,0 +1,88 @@
+package server
+
+import (
+	"encoding/json"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestBuildDownloadStats(t *testing.T) {
+	now := time.Date(2020, 3, 2, 12, 0, 0, 0, time.UTC)
+	day := func(month time.Month, d int) time.Time {
+		return time.Date(2020, month, d, 0, 0, 0, 0, time.UTC)
+	}
+	records := []DownloadRecord{
+		{Item: "a", Day: day(1, 15), Downloads: 1},
+		{Item: "a", Day: day(2, 28), Downloads: 2},
+		{Item: "b", Day: day(2, 28), Downloads: 4},
+		{Item: "b", Day: day(3, 2), Downloads: 8},
+	}
+
+	stats := buildDownloadStats(records, nil, now, day(2, 28), "day", 1)
+	if stats.Total != 14 {
+		t.Errorf("Received total %d, expected 14", stats.Total)
+	}
+	var expected = []DownloadCount{
+		{"2020-02-28", 6}, {"2020-02-29", 0}, {"2020-03-01", 0}, {"2020-03-02", 8},
+	}
+	if len(stats.Periods) != len(expected) {
+		t.Fatalf("Received periods %v, expected %v", stats.Periods, expected)
+	}
+	for i := range expected {
+		if stats.Periods[i] != expected[i] {
+			t.Errorf("Received period %v, expected %v", stats.Periods[i], expected[i])
+		}
+	}
+	if len(stats.ByItem) != 1 || stats.ByItem[0] != (DownloadCount{"b", 12}) {
+		t.Errorf("Received items %v, expected b", stats.ByItem)
+	}
+
+	stats = buildDownloadStats(records, []string{"a"}, now, day(1, 10), "month", 100)
+	expected = []DownloadCount{{"2020-01", 1}, {"2020-02", 6}, {"2020-03", 8}}
+	if len(stats.Periods) != len(expected) {
+		t.Fatalf("Received periods %v, expected %v", stats.Periods, expected)
+	}
+	for i := range expected {
+		if stats.Periods[i] != expected[i] {
+			t.Errorf("Received period %v, expected %v", stats.Periods[i], expected[i])
+		}
+	}
+	if stats.ByItem != nil {
+		t.Errorf("Received items %v for a single item", stats.ByItem)
+	}
+}
+
+func TestDownloadStatsRoute(t *testing.T) {
+	file1 := uploadstring(t, "POST", "/upload", "hello download stats")
+	itemid := "stats" + randomid()
+	txpath := sendtransaction(t, "/item/"+itemid+"/transaction",
+		[][]string{{"add", path.Base(file1)}, {"slot", "a", path.Base(file1)}}, 202)
+	waitTransaction(t, txpath)
+	checkStatus(t, "GET", "/item/"+itemid+"/a", 200)
+	checkStatus(t, "GET", "/item/"+itemid+"/a", 200)
+	checkStatus(t, "HEAD", "/item/"+itemid+"/a", 200)
+
+	var stats DownloadStats
+	body := getbody(t, "GET", "/item/"+itemid+"/@stats?days=2", 200)
+	err := json.Unmarshal([]byte(body), &stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Total != 2 || len(stats.Periods) != 2 || stats.Periods[1].Downloads != 2 {
+		t.Errorf("Received %#v", stats)
+	}
+
+	body = getbody(t, "GET", "/admin/reports/downloads?bucket=month&item="+itemid+"&item=nothing", 200)
+	stats = DownloadStats{}
+	err = json.Unmarshal([]byte(body), &stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Total != 2 || len(stats.ByItem) != 1 || stats.ByItem[0].Name != itemid {
+		t.Errorf("Received %#v", stats)
+	}
+
+	checkStatus(t, "GET", "/admin/reports/downloads?bucket=year", 400)
+	checkStatus(t, "GET", "/item/"+itemid+"/@stats?since=yesterday", 400)
+}
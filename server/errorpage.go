@@ -0,0 +1,259 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+
+	"github.com/ndlib/bendo/items"
+)
+
+// The reasons given in an Unavailable response for why the requested
+// content cannot be returned.
+const (
+	// ReasonNeverExisted means there is no record of the item or file.
+	// The identifier may be mistyped.
+	ReasonNeverExisted = "never-existed"
+
+	// ReasonDeleted means the item or file did exist but was deleted. The
+	// Deleted and Deleter fields say when and by whom, and for a file,
+	// DeleteNote says why.
+	ReasonDeleted = "deleted"
+
+	// ReasonRenamed means the item has been given a new id, which is in
+	// RenamedTo. The response redirects to the same request for the new
+	// id.
+	ReasonRenamed = "renamed"
+
+	// ReasonTapeOffline means the content must be read from the
+	// preservation store, which is not available at the moment.
+	ReasonTapeOffline = "tape-offline"
+
+	// ReasonQuarantined means reading the content from the preservation
+	// store failed recently, and it is held back from further attempts
+	// for a short time.
+	ReasonQuarantined = "quarantined"
+)
+
+// An Unavailable is the body of the 404, 410, and 503 responses for items
+// and their files, and of the redirects for renamed items. It lets clients tell a mistyped identifier from an item
+// that was deleted or one that cannot be read right now.
+type Unavailable struct {
+	Status     int    // the HTTP status code
+	Reason     string // one of the Reason constants
+	Message    string
+	Item       string
+	Slot       string    // empty unless a file was requested
+	Deleted    time.Time // zero unless Reason is "deleted"
+	Deleter    string
+	DeleteNote string `json:",omitempty"` // why a file was deleted, if known
+	RetryAfter int    // seconds, 0 if retrying will not help
+	Successor  string `json:",omitempty"` // path to the file replacing a deleted one
+	RenamedTo  string `json:",omitempty"` // the new id, if Reason is "renamed"
+}
+
+// A TombstoneDB remembers which items have been deleted, so requests for
+// them can be answered with 410 Gone instead of 404 Not Found.
+type TombstoneDB interface {
+	// RecordDeletion notes that the given item was deleted.
+	RecordDeletion(item string, when time.Time, deleter string) error
+
+	// RecordRename notes that the given item was renamed to newid.
+	RecordRename(item string, newid string, when time.Time, renamer string) error
+
+	// FindDeletion returns the most recent deletion or rename of the given
+	// item, or nil if there is no record of the item being deleted.
+	FindDeletion(item string) (*Tombstone, error)
+}
+
+// A Tombstone records the deletion of an item. Renaming an item is recorded
+// as its deletion, with the id it was renamed to.
+type Tombstone struct {
+	Item      string
+	Deleted   time.Time
+	Deleter   string
+	RenamedTo string // empty unless the item was renamed
+}
+
+// errQuarantined wraps the error which happened the last time a blob was
+// read from the preservation store, while the blob is held back from
+// further attempts.
+type errQuarantined struct {
+	err error
+}
+
+func (e errQuarantined) Error() string { return e.err.Error() }
+func (e errQuarantined) Unwrap() error { return e.err }
+
+// quarantineRetry is the Retry-After given for quarantined blobs. It matches
+// how long the errorledger keeps errors.
+const quarantineRetry = 30
+
+// itemMissing returns the Unavailable describing a request for the given
+// item, or for a slot in it, which the item store does not have.
+func (s *RESTServer) itemMissing(r *http.Request, id string, slot string) Unavailable {
+	result := Unavailable{
+		Status:  http.StatusNotFound,
+		Reason:  ReasonNeverExisted,
+		Message: "Item not found",
+		Item:    id,
+		Slot:    slot,
+	}
+	if slot != "" {
+		result.Message = "File not found"
+	}
+	if s.Tombstones == nil {
+		return result
+	}
+	ts, err := s.Tombstones.FindDeletion(id)
+	if err != nil {
+		// not fatal, report the item as missing
+		requestLogger(r).Error("FindDeletion", "item", id, "error", err)
+		raven.CaptureError(err, nil)
+	}
+	if ts != nil && ts.RenamedTo != "" {
+		result.Status = http.StatusMovedPermanently
+		if r.Method != "GET" && r.Method != "HEAD" {
+			// keep the request method
+			result.Status = http.StatusPermanentRedirect
+		}
+		result.Reason = ReasonRenamed
+		result.Message = "Item has been renamed"
+		result.RenamedTo = ts.RenamedTo
+		result.Successor = renamedPath(r, id, ts.RenamedTo)
+	} else if ts != nil {
+		result.Status = http.StatusGone
+		result.Reason = ReasonDeleted
+		result.Message = "Item has been deleted"
+		result.Deleted = ts.Deleted
+		result.Deleter = ts.Deleter
+	}
+	return result
+}
+
+// addSuccessor sets the Successor of u, which describes the deleted blob bid
+// of item id, to the path of the blob which replaced it, if there is one.
+// The path names the slot pinned to the newest version of the item, so it
+// stays good after later versions.
+func (s *RESTServer) addSuccessor(r *http.Request, u *Unavailable, id string, bid items.BlobID) {
+	item, err := s.Items.Item(id)
+	if err != nil {
+		// not fatal, the response just has no successor
+		requestLogger(r).Warn("finding successor", "item", id, "blob", bid, "error", err)
+		return
+	}
+	next, slot := item.Successor(bid)
+	if next == 0 {
+		return
+	}
+	vid := item.Versions[len(item.Versions)-1].ID
+	u.Successor = slotURL(r, id, fmt.Sprintf("@%d/%s", vid, slot))
+}
+
+// unavailableFor returns the Unavailable describing err, an error from
+// reading the given item or blob, and true. If err is not one which has an
+// Unavailable response, it returns false. Errors saying the content does
+// not exist take precedence over its being quarantined, since trying again
+// will not change them.
+func unavailableFor(err error, id string, slot string, binfo *items.Blob) (Unavailable, bool) {
+	result := Unavailable{
+		Message: err.Error(),
+		Item:    id,
+		Slot:    slot,
+	}
+	var noblob items.NoBlobError
+	var q errQuarantined
+	switch {
+	case errors.Is(err, items.ErrNoStore):
+		result.Status = http.StatusServiceUnavailable
+		result.Reason = ReasonTapeOffline
+	case errors.Is(err, items.ErrDeleted):
+		result.Status = http.StatusGone
+		result.Reason = ReasonDeleted
+		if binfo != nil {
+			result.Deleted = binfo.DeleteDate
+			result.Deleter = binfo.Deleter
+			result.DeleteNote = binfo.DeleteNote
+		}
+	case errors.Is(err, items.ErrNoItem), errors.As(err, &noblob):
+		result.Status = http.StatusNotFound
+		result.Reason = ReasonNeverExisted
+	case errors.As(err, &q):
+		result.Status = http.StatusServiceUnavailable
+		result.Reason = ReasonQuarantined
+		result.RetryAfter = quarantineRetry
+	default:
+		return result, false
+	}
+	return result, true
+}
+
+// writeUnavailable sends u as the response. Clients asking for JSON (see
+// wantsJSON) or sending "Accept: application/json" get it as JSON, and
+// browsers get a page explaining what to do next. Anyone else gets the
+// message as plain text, except for deleted files, whose tombstone is
+// always sent as JSON so the record of who deleted them and why is not
+// lost.
+func writeUnavailable(w http.ResponseWriter, r *http.Request, u Unavailable) {
+	if u.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(u.RetryAfter))
+	}
+	w.Header().Set("X-Bendo-Reason", u.Reason)
+	if u.Reason == ReasonRenamed {
+		w.Header().Set("Location", u.Successor)
+	} else if u.Successor != "" {
+		w.Header().Add("Link", "<"+u.Successor+`>; rel="successor-version"`)
+	}
+	accept := r.Header.Get("Accept")
+	html := strings.Contains(accept, "text/html")
+	tombstone := u.Reason == ReasonDeleted && u.Slot != ""
+	switch {
+	case wantsJSON(r) || strings.Contains(accept, "application/json") || (tombstone && !html):
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(u.Status)
+		json.NewEncoder(w).Encode(u)
+	case html:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(u.Status)
+		err := unavailableTemplate.Execute(w, u)
+		if err != nil {
+			requestLogger(r).Error("template", "error", err)
+			raven.CaptureError(err, nil)
+		}
+	default:
+		w.WriteHeader(u.Status)
+		fmt.Fprintln(w, u.Message)
+	}
+}
+
+var (
+	unavailableTemplate = template.Must(template.New("unavailable").Parse(`<html>
+<h1>{{ .Message }}</h1>
+<dl>
+<dt>Item</dt><dd>{{ .Item }}</dd>
+{{ if .Slot }}<dt>File</dt><dd>{{ .Slot }}</dd>
+{{ end }}<dt>Reason</dt><dd>{{ .Reason }}</dd>
+{{ if not .Deleted.IsZero }}<dt>Deleted</dt><dd>{{ .Deleted.Format "2006-01-02" }}{{ if .Deleter }} by {{ .Deleter }}{{ end }}</dd>
+{{ end }}{{ if .DeleteNote }}<dt>Why</dt><dd>{{ .DeleteNote }}</dd>
+{{ end }}{{ if .RenamedTo }}<dt>Renamed to</dt><dd><a href="{{ .Successor }}">{{ .RenamedTo }}</a></dd>
+{{ else if .Successor }}<dt>Replaced by</dt><dd><a href="{{ .Successor }}">{{ .Successor }}</a></dd>
+{{ end }}</dl>
+{{ if eq .Reason "never-existed" }}<p>There is no record of this {{ if .Slot }}file{{ else }}item{{ end }}.
+Check that the identifier is typed correctly, including its case.</p>
+{{ else if eq .Reason "deleted" }}<p>This {{ if .Slot }}file{{ else }}item{{ end }} was deliberately removed and cannot be
+retrieved. If you believe it was removed in error, contact the repository
+administrators, who may be able to restore it from another copy.</p>
+{{ else if eq .Reason "tape-offline" }}<p>The preservation store holding this content is offline for the moment.
+Please try again later.</p>
+{{ else if eq .Reason "quarantined" }}<p>There was a problem reading this content from the preservation store.
+Please try again in {{ .RetryAfter }} seconds. If the problem continues,
+contact the repository administrators.</p>
+{{ end }}</html>`))
+)
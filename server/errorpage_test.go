@@ -0,0 +1,174 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ndlib/bendo/items"
+)
+
+func runTombstoneSequence(t *testing.T, db TombstoneDB) {
+	ts, err := db.FindDeletion("tomb1")
+	if err != nil || ts != nil {
+		t.Errorf("Received %v, %v, expected nil", ts, err)
+	}
+	first := time.Now().Add(-time.Hour).Truncate(time.Second)
+	second := first.Add(30 * time.Minute)
+	for _, when := range []time.Time{first, second} {
+		err = db.RecordDeletion("tomb1", when, "someone")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ts, err = db.FindDeletion("tomb1")
+	if err != nil || ts == nil || !ts.Deleted.Equal(second) || ts.Deleter != "someone" {
+		t.Errorf("Received %#v, %v", ts, err)
+	}
+	ts, err = db.FindDeletion("tomb2")
+	if err != nil || ts != nil {
+		t.Errorf("Received %v, %v, expected nil", ts, err)
+	}
+
+	third := second.Add(30 * time.Minute)
+	err = db.RecordRename("tomb1", "tomb3", third, "someone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, err = db.FindDeletion("tomb1")
+	if err != nil || ts == nil || !ts.Deleted.Equal(third) || ts.RenamedTo != "tomb3" {
+		t.Errorf("Received %#v, %v", ts, err)
+	}
+}
+
+func getUnavailable(t *testing.T, route string, accept string, expstatus int) (*http.Response, string) {
+	req, err := http.NewRequest("GET", testServer.URL+route, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", accept)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(route, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != expstatus {
+		t.Errorf("%s: Received status %d, expected %d", route, resp.StatusCode, expstatus)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func TestUnavailable(t *testing.T) {
+	itemid := "unavailable" + randomid()
+	resp, body := getUnavailable(t, "/item/"+itemid, "application/json", 404)
+	var u Unavailable
+	err := json.Unmarshal([]byte(body), &u)
+	if err != nil || u.Reason != ReasonNeverExisted || u.Item != itemid || u.Status != 404 {
+		t.Errorf("Received %q, %v", body, err)
+	}
+	if v := resp.Header.Get("X-Bendo-Reason"); v != ReasonNeverExisted {
+		t.Errorf("Received X-Bendo-Reason %q", v)
+	}
+
+	file1 := uploadstring(t, "POST", "/upload", "hello unavailable")
+	txpath := sendtransaction(t, "/item/"+itemid+"/transaction",
+		[][]string{{"add", path.Base(file1)}, {"slot", "a", path.Base(file1)}}, 202)
+	waitTransaction(t, txpath)
+
+	// a file missing from an item that exists
+	_, body = getUnavailable(t, "/item/"+itemid+"/b", "application/json", 404)
+	u = Unavailable{}
+	err = json.Unmarshal([]byte(body), &u)
+	if err != nil || u.Reason != ReasonNeverExisted || u.Slot != "b" {
+		t.Errorf("Received %q, %v", body, err)
+	}
+
+	checkStatus(t, "DELETE", "/item/"+itemid, 200)
+	_, body = getUnavailable(t, "/item/"+itemid+"/a", "application/json", 410)
+	u = Unavailable{}
+	err = json.Unmarshal([]byte(body), &u)
+	if err != nil || u.Reason != ReasonDeleted || u.Deleted.IsZero() || time.Since(u.Deleted) > time.Minute {
+		t.Errorf("Received %q, %v", body, err)
+	}
+
+	// browsers get a page
+	resp, body = getUnavailable(t, "/item/"+itemid, "text/html,application/xhtml+xml", 410)
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") ||
+		!strings.Contains(body, "deliberately removed") {
+		t.Errorf("Received %q", body)
+	}
+	// and everyone else plain text
+	_, body = getUnavailable(t, "/item/"+itemid, "*/*", 410)
+	if body != "Item has been deleted\n" {
+		t.Errorf("Received %q", body)
+	}
+}
+
+func TestSuccessorLink(t *testing.T) {
+	file1 := path.Base(uploadstring(t, "POST", "/upload", "old content"))
+	file2 := path.Base(uploadstring(t, "POST", "/upload", "new content"))
+	itemid := "successor" + randomid()
+	txpath := sendtransaction(t, "/item/"+itemid+"/transaction",
+		[][]string{{"add", file1}, {"slot", "a", file1}}, 202)
+	waitTransaction(t, txpath)
+	txpath = sendtransaction(t, "/item/"+itemid+"/transaction",
+		[][]string{{"add", file2}, {"slot", "a", file2}, {"delete", "1", "superseded"}}, 202)
+	waitTransaction(t, txpath)
+
+	resp, body := getUnavailable(t, APIPrefix+"/item/"+itemid+"/@blob/1", "application/json", 410)
+	var u Unavailable
+	err := json.Unmarshal([]byte(body), &u)
+	successor := APIPrefix + "/item/" + itemid + "/@2/a"
+	if err != nil || u.Reason != ReasonDeleted || u.Successor != successor {
+		t.Errorf("Received %q, %v", body, err)
+	}
+	if link := resp.Header.Get("Link"); link != "<"+successor+`>; rel="successor-version"` {
+		t.Errorf("Received Link header %q", link)
+	}
+	if content := getbody(t, "GET", successor, 200); content != "new content" {
+		t.Errorf("Received %q", content)
+	}
+
+	// the tombstone of a deleted file is JSON even when not asked for
+	resp, body = getUnavailable(t, "/item/"+itemid+"/@blob/1", "*/*", 410)
+	u = Unavailable{}
+	err = json.Unmarshal([]byte(body), &u)
+	if err != nil || u.Deleter == "" || u.Deleted.IsZero() || u.DeleteNote != "superseded" {
+		t.Errorf("Received %q, %v", body, err)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("Received Content-Type %q", ct)
+	}
+}
+
+func TestUnavailableFor(t *testing.T) {
+	var tests = []struct {
+		err    error
+		status int
+		reason string
+	}{
+		{items.ErrNoStore, 503, ReasonTapeOffline},
+		{errQuarantined{errors.New("read error")}, 503, ReasonQuarantined},
+		{items.ErrDeleted, 410, ReasonDeleted},
+		{items.ErrNoItem, 404, ReasonNeverExisted},
+		{items.NoBlobError{}, 404, ReasonNeverExisted},
+	}
+	for _, test := range tests {
+		u, ok := unavailableFor(test.err, "x", "", nil)
+		if !ok || u.Status != test.status || u.Reason != test.reason {
+			t.Errorf("%v: received %#v, %v", test.err, u, ok)
+		}
+	}
+	if _, ok := unavailableFor(errors.New("disk on fire"), "x", "", nil); ok {
+		t.Errorf("Expected other errors to have no response")
+	}
+}
@@ -0,0 +1,568 @@
+package server
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/ndlib/bendo/transaction"
+)
+
+// The types of events.
+const (
+	EventVersion = "version" // a transaction made a new version of an item
+	EventError   = "error"   // a transaction on an item failed
+	EventDelete  = "delete"  // an item was deleted
+	EventExport  = "export"  // an item was sent to an export target
+)
+
+// An Event records one change to an item. Events are numbered in the order
+// they happened, so a consumer can keep its place in the feed by remembering
+// the sequence number of the last event it processed.
+type Event struct {
+	Seq         int64 // assigned when the event is saved, starting from 1
+	When        time.Time
+	Type        string // one of EventVersion, EventError, EventDelete, or EventExport
+	Item        string
+	Version     int            `json:",omitempty"` // the new version, or the version exported
+	Transaction string         `json:",omitempty"` // the transaction, if there is one
+	User        string         // who made the change
+	Receipt     *ExportReceipt `json:",omitempty"` // the submission, for EventExport
+}
+
+// A Subscription has the events matching its filters POSTed to a URL, one at
+// a time and in order. Each subscription keeps its own place in the feed, so
+// a consumer which is down does not hold up the others, and it is sent
+// everything it missed once it comes back.
+type Subscription struct {
+	ID        int64
+	URL       string
+	Prefix    string   // only events for items beginning with this are sent
+	Types     []string // only events of these types are sent, or all if empty
+	Created   time.Time
+	Creator   string
+	Delivered int64     // the sequence number of the last event delivered or skipped
+	Failures  int       // the number of deliveries which have failed in a row
+	LastError string    // the error from the last failed delivery
+	LastTry   time.Time // when the last delivery was attempted
+}
+
+// Matches returns true if the event e should be sent to the subscription.
+func (sub *Subscription) Matches(e Event) bool {
+	if !strings.HasPrefix(e.Item, sub.Prefix) {
+		return false
+	}
+	if len(sub.Types) == 0 {
+		return true
+	}
+	for _, t := range sub.Types {
+		if t == e.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// An EventDB keeps the feed of item events and the subscriptions to it.
+type EventDB interface {
+	// AddEvent saves e and returns its sequence number. The Seq field of
+	// e is ignored.
+	AddEvent(e Event) (int64, error)
+
+	// EventsAfter returns up to limit events having sequence numbers
+	// greater than seq, in order.
+	EventsAfter(seq int64, limit int) ([]Event, error)
+
+	// LastEvent returns the sequence number of the newest event, or 0 if
+	// there are none.
+	LastEvent() (int64, error)
+
+	// LastExports returns when the newest EventExport for each item sent
+	// to the named export target happened.
+	LastExports(target string) (map[string]time.Time, error)
+
+	// AddSubscription saves sub and returns its id.
+	AddSubscription(sub Subscription) (int64, error)
+
+	// GetSubscription returns the subscription with the given id, or nil
+	// if there is none.
+	GetSubscription(id int64) (*Subscription, error)
+
+	// ListSubscriptions returns every subscription in order of id.
+	ListSubscriptions() ([]Subscription, error)
+
+	// UpdateDelivery saves the Delivered, Failures, LastError, and
+	// LastTry fields of sub.
+	UpdateDelivery(sub Subscription) error
+
+	// DeleteSubscription removes the subscription with the given id.
+	DeleteSubscription(id int64) error
+}
+
+var (
+	xEventSent  = expvar.NewInt("event.sent")
+	xEventError = expvar.NewInt("event.error")
+
+	// eventPoll is how often the subscriptions are checked for events to
+	// deliver, besides whenever an event is recorded. It is a variable so
+	// the tests can shorten it.
+	eventPoll = time.Minute
+
+	// eventBatch is the most events sent to one subscription before the
+	// others are given a turn.
+	eventBatch = 100
+)
+
+// recordTxEvent adds an event to the feed for the finished transaction tx.
+func (s *RESTServer) recordTxEvent(tx *transaction.Transaction) {
+	tx.M.RLock()
+	e := Event{
+		Type:        EventVersion,
+		Item:        tx.ItemID,
+		Version:     tx.Version,
+		Transaction: tx.ID,
+		User:        tx.Creator,
+	}
+	if tx.Status != transaction.StatusFinished {
+		e.Type = EventError
+		e.Version = 0
+	}
+	tx.M.RUnlock()
+	s.recordEvent(e)
+}
+
+// recordEvent adds e to the feed, if there is one, and wakes the delivery
+// goroutine. The event happens now unless its When is already set.
+func (s *RESTServer) recordEvent(e Event) {
+	if s.Events == nil {
+		return
+	}
+	if e.When.IsZero() {
+		e.When = time.Now()
+	}
+	_, err := s.Events.AddEvent(e)
+	if err != nil {
+		slog.Error("AddEvent", "item", e.Item, "type", e.Type, "error", err)
+		raven.CaptureError(err, map[string]string{"id": e.Item})
+		return
+	}
+	s.nudgeEvents()
+}
+
+// nudgeEvents wakes the delivery goroutine, if it is not already busy.
+func (s *RESTServer) nudgeEvents() {
+	select {
+	case s.eventsig <- struct{}{}:
+	default:
+	}
+}
+
+// StartEvents starts the goroutine which delivers events to the
+// subscriptions. It should be called at most once.
+func (s *RESTServer) StartEvents() {
+	s.eventsig = make(chan struct{}, 1)
+	go func() {
+		for {
+			if s.deliverEvents() {
+				// there are more events waiting
+				s.nudgeEvents()
+			}
+			select {
+			case <-s.eventsig:
+			case <-time.After(eventPoll):
+			}
+		}
+	}()
+}
+
+// deliverEvents sends the next batch of waiting events to each subscription,
+// in parallel. Subscriptions whose last delivery failed are skipped until
+// their retry time. It returns true if any subscription has more events
+// waiting.
+func (s *RESTServer) deliverEvents() bool {
+	s.eventmu.Lock()
+	defer s.eventmu.Unlock()
+	subs, err := s.Events.ListSubscriptions()
+	if err != nil {
+		slog.Error("ListSubscriptions", "error", err)
+		return false
+	}
+	var wg sync.WaitGroup
+	var m sync.Mutex
+	more := false
+	now := time.Now()
+	for i := range subs {
+		sub := &subs[i]
+		if sub.Failures > 0 && now.Before(sub.LastTry.Add(eventRetry(sub.Failures))) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if s.deliverTo(sub) {
+				m.Lock()
+				more = true
+				m.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return more
+}
+
+// deliverTo sends the next batch of events to sub, stopping at the first
+// one which fails, and saves its new delivery state. It returns true if a
+// full batch was sent without error.
+func (s *RESTServer) deliverTo(sub *Subscription) bool {
+	logger := slog.With("subscription", sub.ID, "url", sub.URL)
+	list, err := s.Events.EventsAfter(sub.Delivered, eventBatch)
+	if err != nil {
+		logger.Error("EventsAfter", "error", err)
+		return false
+	}
+	if len(list) == 0 {
+		return false
+	}
+	for _, e := range list {
+		if !sub.Matches(e) {
+			sub.Delivered = e.Seq
+			continue
+		}
+		body, _ := json.Marshal(e)
+		sub.LastTry = time.Now()
+		err = postCallback0(sub.URL, body)
+		if err != nil {
+			xEventError.Add(1)
+			sub.Failures++
+			sub.LastError = err.Error()
+			logger.Warn("Event delivery failed", "seq", e.Seq, "failures", sub.Failures, "error", err)
+			break
+		}
+		xEventSent.Add(1)
+		sub.Delivered = e.Seq
+		sub.Failures = 0
+		sub.LastError = ""
+	}
+	err2 := s.Events.UpdateDelivery(*sub)
+	if err2 != nil {
+		logger.Error("UpdateDelivery", "error", err2)
+		return false
+	}
+	return err == nil && len(list) == eventBatch
+}
+
+// eventRetry returns how long to wait before retrying a subscription whose
+// deliveries have failed the given number of times in a row. It doubles from
+// a minute up to an hour.
+func eventRetry(failures int) time.Duration {
+	if failures > 7 {
+		return time.Hour
+	}
+	d := time.Minute << uint(failures-1)
+	if d > time.Hour {
+		d = time.Hour
+	}
+	return d
+}
+
+// ListEventsHandler handles requests to GET /admin/events
+// It returns the events after the sequence number given by the parameter
+// "since", oldest first, so a consumer may also read the feed itself rather
+// than subscribing to it. The parameter "limit" gives the most events to
+// return, 100 by default. The parameters "prefix" and "type" filter the
+// events the same way as a subscription.
+func (s *RESTServer) ListEventsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.Events == nil {
+		NotImplementedHandler(w, r, ps)
+		return
+	}
+	since, err := strconv.ParseInt(r.FormValue("since"), 10, 64)
+	if err != nil && r.FormValue("since") != "" {
+		w.WriteHeader(400)
+		fmt.Fprintln(w, "since must be a sequence number")
+		return
+	}
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	filter := Subscription{
+		Prefix: r.FormValue("prefix"),
+		Types:  eventTypes(r),
+	}
+	result := []Event{}
+	for len(result) < limit {
+		list, err := s.Events.EventsAfter(since, eventBatch)
+		if err != nil {
+			requestLogger(r).Error("EventsAfter", "error", err)
+			raven.CaptureError(err, nil)
+			w.WriteHeader(500)
+			fmt.Fprintln(w, err)
+			return
+		}
+		if len(list) == 0 {
+			break
+		}
+		for _, e := range list {
+			if filter.Matches(e) {
+				result = append(result, e)
+				if len(result) == limit {
+					break
+				}
+			}
+		}
+		since = list[len(list)-1].Seq
+	}
+	writeHTMLorJSON(w, r, eventListTemplate, result)
+}
+
+// ListSubscriptionsHandler handles requests to GET /admin/subscriptions
+func (s *RESTServer) ListSubscriptionsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.Events == nil {
+		NotImplementedHandler(w, r, ps)
+		return
+	}
+	list, err := s.Events.ListSubscriptions()
+	if err != nil {
+		requestLogger(r).Error("ListSubscriptions", "error", err)
+		raven.CaptureError(err, nil)
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err)
+		return
+	}
+	if list == nil {
+		list = []Subscription{}
+	}
+	writeHTMLorJSON(w, r, subscriptionListTemplate, list)
+}
+
+// GetSubscriptionHandler handles requests to GET /admin/subscriptions/:id
+func (s *RESTServer) GetSubscriptionHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.Events == nil {
+		NotImplementedHandler(w, r, ps)
+		return
+	}
+	sub := s.findSubscription(w, r, ps)
+	if sub != nil {
+		writeHTMLorJSON(w, r, subscriptionListTemplate, []Subscription{*sub})
+	}
+}
+
+// CreateSubscriptionHandler handles requests to POST /admin/subscriptions
+// The parameter "url" is where the events are POSTed, and is required. The
+// optional parameter "prefix" limits the events to items whose ids begin
+// with it, and "type" to the given event types, which may be repeated or
+// separated by commas. Only events recorded after the subscription is made
+// are sent, unless the parameter "from" gives the sequence number of the
+// first event to send.
+func (s *RESTServer) CreateSubscriptionHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.Events == nil {
+		NotImplementedHandler(w, r, ps)
+		return
+	}
+	sub := Subscription{
+		URL:     r.FormValue("url"),
+		Prefix:  r.FormValue("prefix"),
+		Types:   eventTypes(r),
+		Created: time.Now(),
+		Creator: ps.ByName("username"),
+	}
+	if !transaction.ValidCallbackURL(sub.URL) {
+		w.WriteHeader(400)
+		fmt.Fprintln(w, "an http or https url is required")
+		return
+	}
+	for _, t := range sub.Types {
+		if t != EventVersion && t != EventError && t != EventDelete {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "unknown event type %q\n", t)
+			return
+		}
+	}
+	var err error
+	if v := r.FormValue("from"); v != "" {
+		sub.Delivered, err = parseFrom(v)
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintln(w, err)
+			return
+		}
+	} else {
+		sub.Delivered, err = s.Events.LastEvent()
+	}
+	if err == nil {
+		sub.ID, err = s.Events.AddSubscription(sub)
+	}
+	if err != nil {
+		requestLogger(r).Error("AddSubscription", "error", err)
+		raven.CaptureError(err, nil)
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err)
+		return
+	}
+	requestLogger(r).Info("created subscription", "id", sub.ID, "url", sub.URL, "prefix", sub.Prefix)
+	s.nudgeEvents()
+	w.Header().Set("Location", apiPath(r, fmt.Sprintf("/admin/subscriptions/%d", sub.ID)))
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(201)
+	json.NewEncoder(w).Encode(sub)
+}
+
+// ReplaySubscriptionHandler handles requests to
+// POST /admin/subscriptions/:id/replay
+// It moves the subscription's place in the feed so every matching event
+// starting with the sequence number given by the parameter "from" is sent
+// again. Any delivery failures are forgotten, so sending starts at once.
+func (s *RESTServer) ReplaySubscriptionHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.Events == nil {
+		NotImplementedHandler(w, r, ps)
+		return
+	}
+	from, err := parseFrom(r.FormValue("from"))
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintln(w, err)
+		return
+	}
+	// wait for any delivery in progress, so it does not undo this
+	s.eventmu.Lock()
+	defer s.eventmu.Unlock()
+	sub := s.findSubscription(w, r, ps)
+	if sub == nil {
+		return
+	}
+	sub.Delivered = from
+	sub.Failures = 0
+	sub.LastError = ""
+	err = s.Events.UpdateDelivery(*sub)
+	if err != nil {
+		requestLogger(r).Error("UpdateDelivery", "id", sub.ID, "error", err)
+		raven.CaptureError(err, nil)
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err)
+		return
+	}
+	requestLogger(r).Info("replaying subscription", "id", sub.ID, "from", from+1)
+	s.nudgeEvents()
+	writeJSON(w, sub)
+}
+
+// DeleteSubscriptionHandler handles requests to DELETE /admin/subscriptions/:id
+func (s *RESTServer) DeleteSubscriptionHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.Events == nil {
+		NotImplementedHandler(w, r, ps)
+		return
+	}
+	sub := s.findSubscription(w, r, ps)
+	if sub == nil {
+		return
+	}
+	err := s.Events.DeleteSubscription(sub.ID)
+	if err != nil {
+		requestLogger(r).Error("DeleteSubscription", "id", sub.ID, "error", err)
+		raven.CaptureError(err, nil)
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err)
+		return
+	}
+	requestLogger(r).Info("deleted subscription", "id", sub.ID, "url", sub.URL)
+}
+
+// findSubscription returns the subscription named by the "id" parameter. If
+// there is no such subscription, or there is an error, it writes the
+// response and returns nil.
+func (s *RESTServer) findSubscription(w http.ResponseWriter, r *http.Request, ps httprouter.Params) *Subscription {
+	id, err := strconv.ParseInt(ps.ByName("id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(404)
+		fmt.Fprintln(w, "subscription not found")
+		return nil
+	}
+	sub, err := s.Events.GetSubscription(id)
+	if err != nil {
+		requestLogger(r).Error("GetSubscription", "id", id, "error", err)
+		raven.CaptureError(err, nil)
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err)
+		return nil
+	}
+	if sub == nil {
+		w.WriteHeader(404)
+		fmt.Fprintln(w, "subscription not found")
+	}
+	return sub
+}
+
+// eventTypes returns the event types given in the "type" parameters of r.
+func eventTypes(r *http.Request) []string {
+	r.ParseForm()
+	var result []string
+	for _, v := range r.Form["type"] {
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				result = append(result, t)
+			}
+		}
+	}
+	return result
+}
+
+// parseFrom parses the sequence number of the first event to send, and
+// returns the sequence number of the event before it.
+func parseFrom(v string) (int64, error) {
+	from, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || from <= 0 {
+		return 0, fmt.Errorf("from must be a positive sequence number")
+	}
+	return from - 1, nil
+}
+
+var (
+	subscriptionListTemplate = template.Must(template.New("subscriptionlist").Parse(`<html>
+<h1>Event Subscriptions</h1>
+<table>
+<thead><tr><th>ID</th><th>URL</th><th>Prefix</th><th>Types</th><th>Delivered</th><th>Failures</th><th>Last Error</th><th>Created</th><th>Creator</th></tr></thead>
+<tbody>
+{{ range . }}<tr>
+<td>{{ .ID }}</td>
+<td>{{ .URL }}</td>
+<td>{{ .Prefix }}</td>
+<td>{{ range .Types }}{{ . }} {{ end }}</td>
+<td>{{ .Delivered }}</td>
+<td>{{ .Failures }}</td>
+<td>{{ .LastError }}</td>
+<td>{{ .Created.Format "2006-01-02 15:04:05" }}</td>
+<td>{{ .Creator }}</td>
+</tr>
+{{ end }}</tbody>
+</table>
+</html>`))
+
+	eventListTemplate = template.Must(template.New("eventlist").Parse(`<html>
+<h1>Events</h1>
+<table>
+<thead><tr><th>Seq</th><th>When</th><th>Type</th><th>Item</th><th>Version</th><th>Transaction</th><th>User</th></tr></thead>
+<tbody>
+{{ range . }}<tr>
+<td>{{ .Seq }}</td>
+<td>{{ .When.Format "2006-01-02 15:04:05" }}</td>
+<td>{{ .Type }}</td>
+<td><a href="/item/{{ .Item }}">{{ .Item }}</a></td>
+<td>{{ if .Version }}{{ .Version }}{{ end }}</td>
+<td>{{ .Transaction }}</td>
+<td>{{ .User }}</td>
+</tr>
+{{ end }}</tbody>
+</table>
+</html>`))
+)
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func runEventSequence(t *testing.T, db EventDB) {
+	seq, err := db.LastEvent()
+	if err != nil || seq != 0 {
+		t.Errorf("Received %d, %v, expected 0", seq, err)
+	}
+	when := time.Now().Truncate(time.Second)
+	var seqs []int64
+	for _, e := range []Event{
+		{When: when, Type: EventVersion, Item: "abc", Version: 1, Transaction: "tx1", User: "loader"},
+		{When: when, Type: EventError, Item: "def", Transaction: "tx2", User: "loader"},
+		{When: when, Type: EventDelete, Item: "abc", User: "admin"},
+	} {
+		seq, err = db.AddEvent(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(seqs) > 0 && seq <= seqs[len(seqs)-1] {
+			t.Errorf("Received sequence %d after %d", seq, seqs[len(seqs)-1])
+		}
+		seqs = append(seqs, seq)
+	}
+	last, err := db.LastEvent()
+	if err != nil || last != seqs[2] {
+		t.Errorf("Received %d, %v, expected %d", last, err, seqs[2])
+	}
+	list, err := db.EventsAfter(0, 2)
+	if err != nil || len(list) != 2 || list[0].Seq != seqs[0] || list[1].Seq != seqs[1] {
+		t.Fatalf("Received %v, %v", list, err)
+	}
+	e := list[0]
+	if e.Type != EventVersion || e.Item != "abc" || e.Version != 1 || e.Transaction != "tx1" ||
+		e.User != "loader" || !e.When.Equal(when) {
+		t.Errorf("Received %#v", e)
+	}
+	list, err = db.EventsAfter(seqs[1], 10)
+	if err != nil || len(list) != 1 || list[0].Type != EventDelete {
+		t.Errorf("Received %v, %v", list, err)
+	}
+
+	created := when
+	id, err := db.AddSubscription(Subscription{
+		URL:       "http://example.com/events",
+		Prefix:    "ab",
+		Types:     []string{EventVersion, EventDelete},
+		Created:   created,
+		Creator:   "admin",
+		Delivered: seqs[0],
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := db.GetSubscription(id)
+	if err != nil || sub == nil || sub.URL != "http://example.com/events" || sub.Prefix != "ab" ||
+		len(sub.Types) != 2 || sub.Types[1] != EventDelete || sub.Delivered != seqs[0] ||
+		!sub.Created.Equal(created) || !sub.LastTry.IsZero() {
+		t.Fatalf("Received %#v, %v", sub, err)
+	}
+	sub.Delivered = seqs[2]
+	sub.Failures = 2
+	sub.LastError = "received status 500"
+	sub.LastTry = created.Add(time.Minute)
+	err = db.UpdateDelivery(*sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.AddSubscription(Subscription{URL: "http://example.com/all", Created: created})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subs, err := db.ListSubscriptions()
+	if err != nil || len(subs) != 2 {
+		t.Fatalf("Received %v, %v", subs, err)
+	}
+	if subs[0].Delivered != seqs[2] || subs[0].Failures != 2 || subs[0].LastError != "received status 500" ||
+		!subs[0].LastTry.Equal(created.Add(time.Minute)) || len(subs[1].Types) != 0 {
+		t.Errorf("Received %#v", subs)
+	}
+	err = db.DeleteSubscription(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err = db.GetSubscription(id)
+	if err != nil || sub != nil {
+		t.Errorf("Received %#v, %v, expected nil", sub, err)
+	}
+
+	// export receipts
+	receipt := &ExportReceipt{Target: "aptrust", Key: "nd.edu.abc.tar", Bytes: 100, SHA256: "00ff", Files: 2}
+	for _, e := range []Event{
+		{When: when, Type: EventExport, Item: "abc", Version: 1, User: "export:aptrust", Receipt: receipt},
+		{When: when.Add(time.Hour), Type: EventExport, Item: "abc", Version: 2, User: "export:aptrust", Receipt: receipt},
+		{When: when, Type: EventExport, Item: "def", Version: 1, User: "export:other",
+			Receipt: &ExportReceipt{Target: "other"}},
+	} {
+		_, err = db.AddEvent(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err = db.EventsAfter(seqs[2], 1)
+	if err != nil || len(list) != 1 || list[0].Receipt == nil || *list[0].Receipt != *receipt {
+		t.Errorf("Received %#v, %v", list, err)
+	}
+	exports, err := db.LastExports("aptrust")
+	if err != nil || len(exports) != 1 || !exports["abc"].Equal(when.Add(time.Hour)) {
+		t.Errorf("Received %v, %v", exports, err)
+	}
+}
+
+func TestSubscriptionMatches(t *testing.T) {
+	var table = []struct {
+		prefix string
+		types  []string
+		e      Event
+		match  bool
+	}{
+		{"", nil, Event{Type: EventVersion, Item: "abc"}, true},
+		{"ab", nil, Event{Type: EventVersion, Item: "abc"}, true},
+		{"ab", nil, Event{Type: EventVersion, Item: "xabc"}, false},
+		{"", []string{EventDelete}, Event{Type: EventVersion, Item: "abc"}, false},
+		{"", []string{EventError, EventVersion}, Event{Type: EventVersion, Item: "abc"}, true},
+	}
+	for _, tab := range table {
+		sub := Subscription{Prefix: tab.prefix, Types: tab.types}
+		if sub.Matches(tab.e) != tab.match {
+			t.Errorf("%q %v %v: expected %v", tab.prefix, tab.types, tab.e, tab.match)
+		}
+	}
+}
+
+func TestEventDelivery(t *testing.T) {
+	db, err := NewQlCache("mem--eventdelivery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.db.Close()
+	s := &RESTServer{Events: db}
+
+	var fail bool
+	var received []Event
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(503)
+			return
+		}
+		var e Event
+		err := json.NewDecoder(r.Body).Decode(&e)
+		if err != nil {
+			t.Error(err)
+		}
+		received = append(received, e)
+	}))
+	defer receiver.Close()
+
+	s.recordEvent(Event{Type: EventVersion, Item: "before", Version: 1})
+	_, err = db.AddSubscription(Subscription{URL: receiver.URL, Prefix: "abc", Delivered: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.recordEvent(Event{Type: EventVersion, Item: "abc1", Version: 1})
+	s.recordEvent(Event{Type: EventVersion, Item: "xyz", Version: 1})
+	s.deliverEvents()
+	if len(received) != 1 || received[0].Item != "abc1" || received[0].Seq != 2 {
+		t.Fatalf("Received %v", received)
+	}
+
+	// a failed delivery is kept and retried later
+	fail = true
+	s.recordEvent(Event{Type: EventDelete, Item: "abc1"})
+	s.deliverEvents()
+	subs, _ := db.ListSubscriptions()
+	if len(subs) != 1 || subs[0].Delivered != 3 || subs[0].Failures != 1 || subs[0].LastError == "" {
+		t.Fatalf("Received %#v", subs)
+	}
+	fail = false
+	s.deliverEvents() // too soon to retry
+	if len(received) != 1 {
+		t.Errorf("Received %v", received)
+	}
+	subs[0].LastTry = time.Now().Add(-time.Hour)
+	db.UpdateDelivery(subs[0])
+	s.deliverEvents()
+	if len(received) != 2 || received[1].Type != EventDelete {
+		t.Errorf("Received %v", received)
+	}
+	subs, _ = db.ListSubscriptions()
+	if subs[0].Delivered != 4 || subs[0].Failures != 0 || subs[0].LastError != "" {
+		t.Errorf("Received %#v", subs)
+	}
+}
+
+func TestSubscriptionRoutes(t *testing.T) {
+	db, err := NewQlCache("mem--subscriptionroutes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.db.Close()
+	v, _ := NewListValidatorString("root Admin secret\n")
+	s := &RESTServer{Validator: v, Events: db}
+	ts := httptest.NewServer(s.addRoutes())
+	defer ts.Close()
+
+	s.recordEvent(Event{Type: EventVersion, Item: "abc", Version: 1})
+	s.recordEvent(Event{Type: EventDelete, Item: "abc"})
+
+	var table = []struct {
+		verb   string
+		route  string
+		status int
+	}{
+		{"POST", "/admin/subscriptions?url=file:///etc/passwd", 400},
+		{"POST", "/admin/subscriptions?url=http://example.com&type=bogus", 400},
+		{"POST", "/admin/subscriptions?url=http://example.com&from=0", 400},
+		{"POST", "/admin/subscriptions?url=http://example.com&type=version,delete", 201},
+		{"GET", "/admin/subscriptions/1", 200},
+		{"GET", "/admin/subscriptions/2", 404},
+		{"POST", "/admin/subscriptions/1/replay?from=1", 200},
+		{"POST", "/admin/subscriptions/1/replay", 400},
+		{"DELETE", "/admin/subscriptions/1", 200},
+		{"GET", "/admin/subscriptions/1", 404},
+	}
+	for _, tab := range table {
+		req, _ := http.NewRequest(tab.verb, ts.URL+tab.route, nil)
+		req.Header.Set("X-Api-Key", "secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tab.status {
+			t.Errorf("%s %s: received status %d, expected %d", tab.verb, tab.route, resp.StatusCode, tab.status)
+		}
+	}
+
+	// the feed may be read directly
+	req, _ := http.NewRequest("GET", ts.URL+"/admin/events?since=0&type=delete&format=json", nil)
+	req.Header.Set("X-Api-Key", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list []Event
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if err != nil || len(list) != 1 || list[0].Seq != 2 || list[0].Item != "abc" {
+		t.Errorf("Received %v, %v", list, err)
+	}
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+
+	"github.com/ndlib/bendo/items"
+	"github.com/ndlib/bendo/store"
+)
+
+// An ExportTarget sends bags of the items in one collection to an external
+// preservation service, such as APTrust, in the submission format it
+// expects. Every Interval the items beginning with Prefix which have changed
+// since they were last sent are bagged and put into Dest, which is usually
+// the service's receiving bucket. Each bag is a tar file named
+// "<Institution>.<item>.tar" holding the newest version of the item, with
+// an aptrust-info.txt tag file and a tag manifest. A receipt for each bag is
+// recorded as an EventExport for the item, and POSTed to NotifyURL if it is
+// set.
+type ExportTarget struct {
+	Name         string        // identifies the target in the receipts
+	Prefix       string        // only items beginning with this are sent. Empty for every item
+	Institution  string        // the identifier of the depositor, such as "nd.edu"
+	Organization string        // the Source-Organization in bag-info.txt. Institution if empty
+	Access       string        // the access level: "Consortia", "Institution", or "Restricted"
+	Storage      string        // the Storage-Option in aptrust-info.txt. "Standard" if empty
+	Dest         store.Store   // where the bags are put
+	NotifyURL    string        // where to POST the receipts, if anywhere
+	Interval     time.Duration // how often to look for items to send
+}
+
+// An ExportReceipt records one bag sent to an ExportTarget.
+type ExportReceipt struct {
+	Target string // the name of the target
+	Key    string // the name of the bag in the target's store
+	Bytes  int64  // the size of the bag
+	SHA256 string // the checksum of the bag, in hex
+	Files  int    // the number of files in the version
+}
+
+var (
+	xExportSent  = expvar.NewInt("export.sent")
+	xExportBytes = expvar.NewInt("export.bytes")
+	xExportError = expvar.NewInt("export.error")
+)
+
+// StartExports starts a background goroutine for each of the ExportTargets,
+// which sends the items needing it to the target every interval. It returns
+// immediately and does not block.
+func (s *RESTServer) StartExports() {
+	for i := range s.ExportTargets {
+		t := &s.ExportTargets[i]
+		go func() {
+			slog.Info("Starting export", "target", t.Name, "prefix", t.Prefix, "interval", t.Interval)
+			for {
+				s.runExport(t)
+				time.Sleep(t.Interval)
+			}
+		}()
+	}
+}
+
+// runExport sends every item matching t which was modified since it was
+// last sent to t. Items which fail are logged and tried again the next time.
+func (s *RESTServer) runExport(t *ExportTarget) {
+	logger := slog.With("target", t.Name)
+	list, err := s.Access.ItemAccessList()
+	if err != nil {
+		logger.Error("ItemAccessList", "error", err)
+		raven.CaptureError(err, map[string]string{"target": t.Name})
+		return
+	}
+	last, err := s.Events.LastExports(t.Name)
+	if err != nil {
+		logger.Error("LastExports", "error", err)
+		raven.CaptureError(err, map[string]string{"target": t.Name})
+		return
+	}
+	for _, item := range list {
+		if !strings.HasPrefix(item.ID, t.Prefix) {
+			continue
+		}
+		if when, ok := last[item.ID]; ok && !item.Modified.After(when) {
+			continue
+		}
+		err = s.exportItem(t, item.ID)
+		if err != nil {
+			xExportError.Add(1)
+			logger.Error("Export failed", "item", item.ID, "error", err)
+			raven.CaptureError(err, map[string]string{"target": t.Name, "id": item.ID})
+		}
+	}
+}
+
+// exportItem puts a bag of the newest version of the item id into the store
+// of t, and records its receipt.
+func (s *RESTServer) exportItem(t *ExportTarget, id string) error {
+	// the export is dated from when the item was read, so a version
+	// added while it is being sent is sent the next time
+	start := time.Now()
+	item, err := s.Items.Item(id)
+	if err != nil {
+		return err
+	}
+	ver := item.FindVersion(0)
+	if ver == nil {
+		return items.ErrNoVersion
+	}
+	name := exportBagName(t.Institution, id)
+	opts := exportBagOptions(t, item, ver, name)
+	key := name + ".tar"
+	// a bag left from an earlier export is replaced
+	err = t.Dest.Delete(key)
+	if err != nil {
+		return err
+	}
+	w, err := t.Dest.Create(key)
+	if err != nil {
+		return err
+	}
+	hw := sha256.New()
+	cw := &countWriter{w: io.MultiWriter(w, hw)}
+	err = items.WriteBagOptions(cw, item, ver.ID, func(blob *items.Blob) (io.ReadCloser, error) {
+		r, _, err := s.Items.BlobContext(s.serverContext(), id, blob.ID)
+		return r, err
+	}, opts)
+	err2 := w.Close()
+	if err == nil {
+		err = err2
+	}
+	if err != nil {
+		// do not leave a partial bag to be ingested
+		t.Dest.Delete(key)
+		return err
+	}
+	receipt := &ExportReceipt{
+		Target: t.Name,
+		Key:    key,
+		Bytes:  cw.n,
+		SHA256: hex.EncodeToString(hw.Sum(nil)),
+		Files:  len(ver.Slots),
+	}
+	xExportSent.Add(1)
+	xExportBytes.Add(cw.n)
+	slog.Info("Exported item", "target", t.Name, "item", id, "version", ver.ID, "key", key, "bytes", cw.n)
+	e := Event{
+		When:    start,
+		Type:    EventExport,
+		Item:    id,
+		Version: int(ver.ID),
+		User:    "export:" + t.Name,
+		Receipt: receipt,
+	}
+	s.recordEvent(e)
+	if t.NotifyURL != "" {
+		body, _ := json.Marshal(e)
+		go postCallback(t.NotifyURL, body, "id", id)
+	}
+	return nil
+}
+
+// exportBagName returns the name of the bag of the item id deposited by the
+// given institution. Characters other than letters, digits, ".", "-", and
+// "_" are changed to "_", since the name is also used as a file name.
+func exportBagName(institution, id string) string {
+	clean := strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9',
+			r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, id)
+	return institution + "." + clean
+}
+
+// exportBagOptions returns the options to bag version ver of item for the
+// target t under the given name.
+func exportBagOptions(t *ExportTarget, item *items.Item, ver *items.Version, name string) items.BagOptions {
+	org := t.Organization
+	if org == "" {
+		org = t.Institution
+	}
+	storage := t.Storage
+	if storage == "" {
+		storage = "Standard"
+	}
+	var info strings.Builder
+	fmt.Fprintf(&info, "Title: %s\n", item.ID)
+	fmt.Fprintf(&info, "Description: Bendo item %s version %d\n", item.ID, ver.ID)
+	fmt.Fprintf(&info, "Access: %s\n", t.Access)
+	fmt.Fprintf(&info, "Storage-Option: %s\n", storage)
+	return items.BagOptions{
+		Name: name,
+		Tar:  true,
+		Info: []string{
+			"Source-Organization: " + org,
+			"Internal-Sender-Identifier: " + item.ID,
+		},
+		Tags: []items.BagTag{{Name: "aptrust-info.txt", Body: []byte(info.String())}},
+	}
+}
+
+// countWriter counts the bytes written through it.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// encodeReceipt returns the target and the JSON encoding of r, to be saved
+// with an event. Both are empty if r is nil.
+func encodeReceipt(r *ExportReceipt) (string, string, error) {
+	if r == nil {
+		return "", "", nil
+	}
+	b, err := json.Marshal(r)
+	return r.Target, string(b), err
+}
+
+// decodeReceipt is the reverse of encodeReceipt. It returns nil if s is
+// empty.
+func decodeReceipt(s string) (*ExportReceipt, error) {
+	if s == "" {
+		return nil, nil
+	}
+	r := new(ExportReceipt)
+	err := json.Unmarshal([]byte(s), r)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
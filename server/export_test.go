@@ -0,0 +1,121 @@
+package server
+
+import (
+	"archive/tar"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ndlib/bendo/items"
+	"github.com/ndlib/bendo/store"
+)
+
+func TestExportBagName(t *testing.T) {
+	var table = []struct {
+		id     string
+		output string
+	}{
+		{"abc", "nd.edu.abc"},
+		{"und:q1/2", "nd.edu.und_q1_2"},
+		{"a-b_c.d", "nd.edu.a-b_c.d"},
+	}
+	for _, tab := range table {
+		name := exportBagName("nd.edu", tab.id)
+		if name != tab.output {
+			t.Errorf("exportBagName(%q) == %q, expected %q", tab.id, name, tab.output)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	db, err := NewQlCache("mem--export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	itemstore := items.New(store.NewMemory())
+	for _, id := range []string{"und:abc", "other"} {
+		w, _ := itemstore.Open(id, "nobody")
+		bid, _ := w.WriteBlob(strings.NewReader("hello"), 5, nil, nil)
+		w.SetSlot("a.txt", bid)
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	access := &storageAccess{list: []SimpleItem{
+		{ID: "und:abc", Modified: time.Now().Add(-time.Hour)},
+		{ID: "other", Modified: time.Now().Add(-time.Hour)},
+	}}
+	dest := store.NewMemory()
+	s := &RESTServer{
+		Items:  itemstore,
+		Access: access,
+		Events: db,
+	}
+	target := &ExportTarget{
+		Name:        "aptrust",
+		Prefix:      "und:",
+		Institution: "nd.edu",
+		Access:      "Institution",
+		Dest:        dest,
+	}
+
+	s.runExport(target)
+	keys, _ := dest.ListPrefix("")
+	if len(keys) != 1 || keys[0] != "nd.edu.und_abc.tar" {
+		t.Fatalf("Received keys %v", keys)
+	}
+	files := readExport(t, dest, keys[0])
+	if files["nd.edu.und_abc/data/a.txt"] != "hello" ||
+		!strings.Contains(files["nd.edu.und_abc/aptrust-info.txt"], "Access: Institution\n") ||
+		!strings.Contains(files["nd.edu.und_abc/bag-info.txt"], "Source-Organization: nd.edu\n") {
+		t.Errorf("Received bag %v", files)
+	}
+	list, err := db.EventsAfter(0, 10)
+	if err != nil || len(list) != 1 {
+		t.Fatalf("Received %v, %v", list, err)
+	}
+	e := list[0]
+	if e.Type != EventExport || e.Item != "und:abc" || e.Version != 1 || e.Receipt == nil ||
+		e.Receipt.Target != "aptrust" || e.Receipt.Key != keys[0] || e.Receipt.Bytes == 0 {
+		t.Errorf("Received %#v", e)
+	}
+
+	// unchanged items are not sent again
+	dest.Delete(keys[0])
+	s.runExport(target)
+	keys, _ = dest.ListPrefix("")
+	if len(keys) != 0 {
+		t.Errorf("Received keys %v, expected none", keys)
+	}
+	access.list[0].Modified = time.Now().Add(time.Hour)
+	s.runExport(target)
+	keys, _ = dest.ListPrefix("")
+	if len(keys) != 1 {
+		t.Errorf("Received keys %v, expected one", keys)
+	}
+}
+
+// readExport returns the files in the tar file key in the store, indexed by
+// name.
+func readExport(t *testing.T, s store.Store, key string) map[string]string {
+	rac, _, err := s.Open(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rac.Close()
+	tr := tar.NewReader(store.NewReader(rac))
+	result := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(tr)
+		result[hdr.Name] = string(content)
+	}
+	return result
+}
@@ -5,7 +5,7 @@ import (
 	"errors"
 	"expvar"
 	"fmt"
-	"log"
+	"log/slog"
 	"math/rand"
 	"net/http"
 	"strconv"
@@ -14,6 +14,8 @@ import (
 
 	raven "github.com/getsentry/raven-go"
 	"github.com/julienschmidt/httprouter"
+
+	"github.com/ndlib/bendo/items"
 )
 
 // A Fixity represents a single past or future fixity check.
@@ -102,7 +104,7 @@ const (
 // implements an infinite loop doing fixity checking. This function does not
 // return.
 func (s *RESTServer) fixity() {
-	log.Println("Starting fixity loop")
+	slog.Info("Starting fixity loop")
 	for {
 		id := s.FixityDatabase.NextFixity(time.Now())
 		if id == 0 || !s.useTape {
@@ -113,16 +115,23 @@ func (s *RESTServer) fixity() {
 		}
 		fx := s.FixityDatabase.GetFixity(id)
 		if fx == nil {
-			log.Println("fixity received bad id", id)
+			slog.Error("fixity received bad id", "fixity", id)
 			raven.CaptureMessage("fixity received bad id", map[string]string{"id": fmt.Sprintf("%d", id)})
 			continue
 		}
-		log.Println("begin fixity check for", fx.Item)
+		logger := slog.With("item", fx.Item, "fixity", id)
+		logger.Info("begin fixity check")
 		starttime := time.Now()
-		nbytes, problems, err := s.Items.Validate(fx.Item)
+		var nbytes int64
+		var problems []string
+		err := s.hashpool.Do(func() error {
+			var err error
+			nbytes, problems, err = s.Items.Validate(fx.Item)
+			return err
+		})
 		fx.Status = "ok"
 		if err != nil {
-			log.Println("fixity validate error", err)
+			logger.Error("fixity validate error", "error", err)
 			fx.Status = "error"
 			fx.Notes = err.Error()
 			xFixityError.Add(1)
@@ -134,10 +143,10 @@ func (s *RESTServer) fixity() {
 			raven.CaptureMessage("Fixity Mismatch", map[string]string{"id": fx.Item})
 		}
 		d := time.Now().Sub(starttime)
-		log.Println("Fixity for", fx.Item, "is", fx.Status, "duration = ", d)
+		logger.Info("fixity check finished", "status", fx.Status, "duration", d)
 		_, err = s.FixityDatabase.UpdateFixity(*fx)
 		if err != nil {
-			log.Println("fixity:", err)
+			logger.Error("fixity update", "error", err)
 			raven.CaptureError(err, nil)
 		}
 
@@ -159,27 +168,32 @@ func (s *RESTServer) fixity() {
 //
 // This will scan each item in the store and then exit.
 func (s *RESTServer) scanfixity() {
-	log.Println("Starting scanfixity")
+	slog.Info("Starting scanfixity")
 	rand.Seed(time.Now().Unix())
 	var starttime = time.Now()
-	for id := range s.Items.List() {
+	_, err := s.Items.Walk("", func(item items.WalkItem) error {
+		id := item.ID
 		when, err := s.FixityDatabase.LookupCheck(id)
 		if err != nil {
 			// error? skip this id
-			log.Println("scanfixity", id, err)
+			slog.Error("scanfixity", "item", id, "error", err)
 			raven.CaptureError(err, map[string]string{"id": id})
-			continue
+			return nil
 		}
 		if !when.IsZero() {
 			// something is scheduled
-			continue
+			return nil
 		}
 		// This item is new, so check it sometime in the next 12 hours to make
 		// sure it is okay.
-		log.Println("scanfixity adding", id)
+		slog.Info("scanfixity adding", "item", id)
 		s.addwithjitter(id, 0, 12*time.Hour)
+		return nil
+	})
+	if err != nil {
+		slog.Error("scanfixity", "error", err)
 	}
-	log.Println("Ending scanfixity. duration = ", time.Now().Sub(starttime))
+	slog.Info("Ending scanfixity", "duration", time.Now().Sub(starttime))
 }
 
 // addwithjitter creates a fixity check for the item id some time between
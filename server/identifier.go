@@ -0,0 +1,121 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	raven "github.com/getsentry/raven-go"
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/ndlib/bendo/items"
+)
+
+// An IdentifierDB maps external persistent identifiers, such as DOIs, ARKs,
+// or handles, onto item ids. Identifiers are treated as opaque strings. Each
+// identifier may be bound to at most one item, but an item may have any
+// number of identifiers.
+type IdentifierDB interface {
+	// FindIdentifier returns the item id bound to the given identifier.
+	// Returns "" if the identifier is not bound to anything.
+	FindIdentifier(identifier string) (string, error)
+
+	// ItemIdentifiers returns the list of identifiers bound to the given
+	// item. It returns an empty list if there are none.
+	ItemIdentifiers(item string) ([]string, error)
+
+	// BindIdentifier binds identifier to the given item. It is not an error
+	// to bind an identifier to the item it is already bound to. Returns
+	// ErrIdentifierBound if the identifier is bound to a different item.
+	BindIdentifier(identifier string, item string) error
+
+	// UnbindIdentifier removes the binding for the given identifier. It is
+	// not an error to unbind an identifier which is not bound.
+	UnbindIdentifier(identifier string) error
+}
+
+// ErrIdentifierBound means an identifier is already bound to a different item.
+var ErrIdentifierBound = errors.New("identifier is bound to another item")
+
+// IdentifierHandler handles requests to GET /id/*identifier
+// It redirects to the item the identifier is bound to.
+func (s *RESTServer) IdentifierHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.Identifiers == nil {
+		NotImplementedHandler(w, r, ps)
+		return
+	}
+	identifier := normalizeIdentifier(ps.ByName("identifier"))
+	item, err := s.Identifiers.FindIdentifier(identifier)
+	if err != nil {
+		requestLogger(r).Error("FindIdentifier", "identifier", identifier, "error", err)
+		raven.CaptureError(err, nil)
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err)
+		return
+	}
+	if item == "" {
+		w.WriteHeader(404)
+		fmt.Fprintln(w, "identifier not found")
+		return
+	}
+	http.Redirect(w, r, "/item/"+item, http.StatusFound)
+}
+
+// BindIdentifierHandler handles requests to PUT /id/*identifier
+// The item to bind to is given in the "item" parameter.
+func (s *RESTServer) BindIdentifierHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.Identifiers == nil {
+		NotImplementedHandler(w, r, ps)
+		return
+	}
+	identifier := normalizeIdentifier(ps.ByName("identifier"))
+	item := r.FormValue("item")
+	if identifier == "" || item == "" {
+		w.WriteHeader(400)
+		fmt.Fprintln(w, "an identifier and an item are required")
+		return
+	}
+	err := s.Identifiers.BindIdentifier(identifier, item)
+	if err == ErrIdentifierBound {
+		w.WriteHeader(409)
+		fmt.Fprintln(w, err)
+		return
+	} else if err != nil {
+		requestLogger(r).Error("BindIdentifier", "identifier", identifier, "error", err)
+		raven.CaptureError(err, nil)
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err)
+		return
+	}
+	w.WriteHeader(201)
+}
+
+// UnbindIdentifierHandler handles requests to DELETE /id/*identifier
+func (s *RESTServer) UnbindIdentifierHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.Identifiers == nil {
+		NotImplementedHandler(w, r, ps)
+		return
+	}
+	identifier := normalizeIdentifier(ps.ByName("identifier"))
+	err := s.Identifiers.UnbindIdentifier(identifier)
+	if err != nil {
+		requestLogger(r).Error("UnbindIdentifier", "identifier", identifier, "error", err)
+		raven.CaptureError(err, nil)
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err)
+	}
+}
+
+// normalizeIdentifier removes the leading slash httprouter leaves on star
+// parameters, and any surrounding whitespace.
+func normalizeIdentifier(s string) string {
+	return strings.TrimSpace(strings.TrimPrefix(s, "/"))
+}
+
+// An itemWithIdentifiers adds the bound external identifiers to an item when
+// displaying it.
+type itemWithIdentifiers struct {
+	*items.Item
+	Identifiers []string
+}
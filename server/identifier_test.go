@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestIdentifierRoutes(t *testing.T) {
+	file1 := uploadstring(t, "POST", "/upload", "hello identifier")
+	itemid := "ident" + randomid()
+	txpath := sendtransaction(t, "/item/"+itemid+"/transaction",
+		[][]string{{"add", path.Base(file1)}}, 202)
+	waitTransaction(t, txpath)
+
+	ark := "ark:/13960/t" + randomid()
+	checkStatus(t, "GET", "/id/"+ark, 404)
+	itemETag := func() string {
+		resp := checkRoute(t, "GET", "/item/"+itemid, 200)
+		if resp == nil {
+			return ""
+		}
+		resp.Body.Close()
+		return resp.Header.Get("ETag")
+	}
+	before := itemETag()
+	checkStatus(t, "PUT", "/id/"+ark+"?item="+itemid, 201)
+	// the item's ETag changes with its identifiers
+	if after := itemETag(); after == before {
+		t.Errorf("ETag %s did not change when an identifier was bound", after)
+	}
+	// binding twice to the same item is fine
+	checkStatus(t, "PUT", "/id/"+ark+"?item="+itemid, 201)
+	// but not to a different item
+	checkStatus(t, "PUT", "/id/"+ark+"?item=other", 409)
+	checkStatus(t, "PUT", "/id/"+ark, 400)
+
+	// the redirect is followed to the item
+	checkStatus(t, "GET", "/id/"+ark, 200)
+
+	body := getbody(t, "GET", "/item/"+itemid, 200)
+	var result struct {
+		ID          string
+		Identifiers []string
+	}
+	err := json.Unmarshal([]byte(body), &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ID != itemid || len(result.Identifiers) != 1 || result.Identifiers[0] != ark {
+		t.Errorf("Received %#v, expected identifier %s", result, ark)
+	}
+
+	checkStatus(t, "DELETE", "/id/"+ark, 200)
+	checkStatus(t, "GET", "/id/"+ark, 404)
+}
+
+func runIdentifierSequence(t *testing.T, db IdentifierDB) {
+	const ident = "doi:10.1000/182"
+
+	item, err := db.FindIdentifier(ident)
+	if err != nil || item != "" {
+		t.Errorf("FindIdentifier received %q, %v, expected empty", item, err)
+	}
+	err = db.BindIdentifier(ident, "item1")
+	if err != nil {
+		t.Error(err)
+	}
+	err = db.BindIdentifier(ident, "item1")
+	if err != nil {
+		t.Error("rebinding to same item:", err)
+	}
+	err = db.BindIdentifier(ident, "item2")
+	if err != ErrIdentifierBound {
+		t.Error("Received", err, "expected", ErrIdentifierBound)
+	}
+	err = db.BindIdentifier("hdl:2345/abc", "item1")
+	if err != nil {
+		t.Error(err)
+	}
+	item, err = db.FindIdentifier(ident)
+	if err != nil || item != "item1" {
+		t.Errorf("FindIdentifier received %q, %v, expected item1", item, err)
+	}
+	ids, err := db.ItemIdentifiers("item1")
+	if err != nil || len(ids) != 2 {
+		t.Error("ItemIdentifiers received", ids, err)
+	}
+	err = db.UnbindIdentifier(ident)
+	if err != nil {
+		t.Error(err)
+	}
+	ids, err = db.ItemIdentifiers("item1")
+	if err != nil || len(ids) != 1 || ids[0] != "hdl:2345/abc" {
+		t.Error("ItemIdentifiers received", ids, err)
+	}
+
+	// of many binds at once, only one wins
+	var wg sync.WaitGroup
+	var bound int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(item string) {
+			defer wg.Done()
+			err := db.BindIdentifier(ident, item)
+			if err == nil {
+				atomic.AddInt32(&bound, 1)
+			} else if err != ErrIdentifierBound {
+				t.Error(err)
+			}
+		}(fmt.Sprintf("item%d", i+10))
+	}
+	wg.Wait()
+	if bound != 1 {
+		t.Errorf("Identifier bound %d times, expected once", bound)
+	}
+}
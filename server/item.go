@@ -1,14 +1,22 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"expvar"
 	"fmt"
 	"html/template"
 	"io"
-	"log"
+	"log/slog"
+	"mime"
 	"net/http"
+	"net/url"
+	"os"
+	"path"
 	"strconv"
 	"strings"
 	"sync"
@@ -18,8 +26,11 @@ import (
 	"github.com/julienschmidt/httprouter"
 	"golang.org/x/sync/singleflight"
 
+	"github.com/ndlib/bendo"
+	"github.com/ndlib/bendo/apiv2"
 	"github.com/ndlib/bendo/items"
 	"github.com/ndlib/bendo/store"
+	"github.com/ndlib/bendo/transaction"
 )
 
 var (
@@ -43,12 +54,47 @@ type BlobDB interface {
 	// Use version = 0 to refer to the most recent version of the item.
 	FindBlobBySlot(item string, version int, slot string) (*items.Blob, error)
 
+	// FindMaxVersion returns the most recent version of the given item in
+	// the index, or 0 if the item is not in the index.
+	FindMaxVersion(item string) (int, error)
+
 	// Index the given item using the given id.
 	// (The item id should already be in the item structure. can that parameter be removed?)
 	IndexItem(itemid string, item *items.Item) error
 
 	// GetItemList returns a list of item information for a listing page.
-	GetItemList(offset int, pagesize int, sortorder string) ([]SimpleItem, error)
+	// If creator is not empty, only items having a version saved by that
+	// user are returned.
+	GetItemList(offset int, pagesize int, sortorder string, creator string) ([]SimpleItem, error)
+
+	// CountItems returns the number of items GetItemList would list for
+	// the given creator, over all pages.
+	CountItems(creator string) (int, error)
+
+	// FindSlots returns the slots in the most recent version of every item
+	// whose names match the given glob pattern, in which "*" matches any
+	// run of characters and "?" matches a single character. The results
+	// are sorted by item and slot name. The Blob field is not filled in.
+	FindSlots(pattern string, offset int, limit int) ([]SlotMatch, error)
+
+	// FindMeta returns the versions and blobs of every item which have
+	// the metadata key set to value, or to anything if value is empty.
+	// The results are sorted by item, version, and blob.
+	FindMeta(key string, value string, offset int, limit int) ([]MetaMatch, error)
+
+	// FindBlobByHash returns the item and id of a blob stored with the
+	// given size and SHA-256 hash, or an item of "" if there is none.
+	// It lets the item store reuse content saved in other items.
+	FindBlobByHash(size int64, sha256 []byte) (string, items.BlobID, error)
+
+	// FindReferences returns the blobs in other items which refer to
+	// blobs in the given item. They keep the item store from removing
+	// content which is still referred to.
+	FindReferences(item string) ([]items.Reference, error)
+
+	// DeleteItem removes everything in the index for the given item.
+	// It is not an error if the item is not in the index.
+	DeleteItem(item string) error
 }
 
 // SlotHandler handles requests to GET /item/:id/*slot
@@ -63,6 +109,31 @@ func (s *RESTServer) SlotHandler(w http.ResponseWriter, r *http.Request, ps http
 		s.ItemHandler(w, r, ps)
 		return
 	}
+	if slot == "@stats" {
+		s.ItemStatsHandler(w, r, ps)
+		return
+	}
+	if slot == "@bag" {
+		s.BagHandler(w, r, ps)
+		return
+	}
+	if slot == "@zip" || slot == "@tar" {
+		s.ArchiveHandler(w, r, ps)
+		return
+	}
+	if slot == "@list" || strings.HasPrefix(slot, "@list/") {
+		s.ListSlotsHandler(w, r, ps)
+		return
+	}
+	if v := r.FormValue("version"); v != "" {
+		vid, err := strconv.Atoi(v)
+		if err != nil || vid <= 0 || slot[0] == '@' {
+			w.WriteHeader(400)
+			fmt.Fprintln(w, "version must be a positive integer, and not given with an @ path")
+			return
+		}
+		slot = fmt.Sprintf("@%d/%s", vid, slot)
+	}
 
 	binfo, err := s.resolveblob(id, slot)
 
@@ -70,24 +141,82 @@ func (s *RESTServer) SlotHandler(w http.ResponseWriter, r *http.Request, ps http
 		switch {
 		case err == items.ErrNoStore:
 			// if item store use disabled, return 503
-			w.WriteHeader(503)
-			log.Printf("GET/HEAD /item/%s/%s returns 503 - tape disabled", id, slot)
+			requestLogger(r).Warn("tape disabled", "item", id, "slot", slot, "status", 503)
+			u, _ := unavailableFor(err, id, slot, nil)
+			writeUnavailable(w, r, u)
 		case binfo == nil || err == items.ErrNoItem:
-			w.WriteHeader(404)
+			writeUnavailable(w, r, s.itemMissing(r, id, slot))
 		default:
 			raven.CaptureError(err, nil)
-			log.Println(id, ":", err)
+			requestLogger(r).Error("resolving slot", "item", id, "slot", slot, "error", err)
 			w.WriteHeader(500)
-		}
-		if err != nil {
 			fmt.Fprintln(w, err)
 		}
 		return
 	}
 	w.Header().Set("X-Content-Sha256", hex.EncodeToString(binfo.SHA256))
 	w.Header().Set("X-Content-Md5", hex.EncodeToString(binfo.MD5))
-	w.Header().Set("Location", fmt.Sprintf("/item/%s/@blob/%d", id, binfo.ID))
-	s.getblob(w, r, id, binfo)
+	w.Header().Set("Location", apiPath(r, fmt.Sprintf("/item/%s/@blob/%d", id, binfo.ID)))
+	if pinned := s.pinnedSlot(id, slot, binfo); pinned != "" {
+		w.Header().Set("Content-Location", slotURL(r, id, pinned))
+	}
+	if v := contentDisposition(r, slot); v != "" {
+		w.Header().Set("Content-Disposition", v)
+	}
+	if r.Method == "GET" {
+		s.recordAccess(id)
+	}
+	s.getblob(w, r, id, slot, binfo, ps.ByName("username"))
+}
+
+// pinnedSlot returns the slot path naming the given blob in the version it
+// was resolved from, so it keeps naming the same blob after the item
+// changes. Slot paths beginning with "@" are already pinned. It returns ""
+// if the version cannot be determined, such as when a new version was
+// saved since the slot was resolved.
+func (s *RESTServer) pinnedSlot(id, slot string, binfo *items.Blob) string {
+	if slot[0] == '@' {
+		return slot
+	}
+	vid, err := s.BlobDB.FindMaxVersion(id)
+	if err != nil || vid == 0 {
+		return ""
+	}
+	b, err := s.BlobDB.FindBlobBySlot(id, vid, slot)
+	if err != nil || b == nil || b.ID != binfo.ID {
+		return ""
+	}
+	return fmt.Sprintf("@%d/%s", vid, slot)
+}
+
+// slotURL returns the path to the given slot of the item id, escaped for
+// use in a URL.
+func slotURL(r *http.Request, id, slot string) string {
+	u := url.URL{Path: "/item/" + id + "/" + slot}
+	return apiPath(r, u.EscapedPath())
+}
+
+// contentDisposition returns the Content-Disposition header to send for
+// the given slot path, or "" if none should be sent. The file name is the
+// last part of the slot path, unless the parameter "filename" is given.
+// Blobs named by number have no file name of their own. The parameter
+// "download", if true, asks browsers to save the file instead of showing it.
+func contentDisposition(r *http.Request, slot string) string {
+	filename := r.FormValue("filename")
+	if filename == "" && !strings.HasPrefix(slot, "@blob/") {
+		filename = path.Base(slot)
+	}
+	disposition := "inline"
+	if download, _ := strconv.ParseBool(r.FormValue("download")); download {
+		disposition = "attachment"
+	}
+	if filename == "" {
+		if disposition == "inline" {
+			return ""
+		}
+		return disposition
+	}
+	return mime.FormatMediaType(disposition, map[string]string{"filename": filename})
 }
 
 // IndexItem loads an item from the item store and indexes it into our blob database
@@ -176,29 +305,82 @@ func (s *RESTServer) resolveblob0(itemID string, slot string) (*items.Blob, erro
 
 // getblob will find the given blob, either in the cache or on
 // tape, and then send it as a response. If there is an error, it
-// will return an error response.
-func (s *RESTServer) getblob(w http.ResponseWriter, r *http.Request, id string, binfo *items.Blob) {
+// will return an error response. Reading the blob from tape counts against
+// the given user's recall limit. The slot is the path the blob was
+// requested by.
+func (s *RESTServer) getblob(w http.ResponseWriter, r *http.Request, id string, slot string, binfo *items.Blob, user string) {
 	// GET requests always cache content. HEAD requests cache content only if
 	// the Request-Cache header is passed (with any value)
 	docache := r.Method == "GET" || r.Header.Get("Request-Cache") != ""
-	key := fmt.Sprintf("%s+%04d", id, binfo.ID)
+	key := bendo.CacheKey(id, binfo.ID)
+	logger := requestLogger(r).With("item", id, "blob", binfo.ID)
+	// blobs never change, so if the client has this one already there is
+	// no need to look for the content.
+	etag := blobETag(binfo)
+	if binfo.DeleteDate.IsZero() && checkNotModified(w, r, etag, binfo.SaveDate) {
+		return
+	}
+	// zero length blobs have nothing to recall, so skip the cache and tape.
+	// (deleted blobs also have a size of 0, but they have no bundle.)
+	if binfo.Size == 0 && binfo.Bundle != 0 {
+		w.Header().Set("ETag", etag)
+		setContentType(w, binfo)
+		setDigest(w, r, binfo)
+		http.ServeContent(w, r, "", binfo.SaveDate, bytes.NewReader(nil))
+		return
+	}
+	if r.Method == "GET" {
+		// a range request may want only a little of the blob, so only
+		// check whether the user is already at their quota.
+		n := binfo.Size
+		if r.Header.Get("Range") != "" {
+			n = 0
+		}
+		if msg := s.checkTransfer(r, user, UsageDownload, n); msg != "" {
+			writeQuotaExceeded(w, r, msg)
+			return
+		}
+	}
+	// polling for a blob being cached for an asynchronous request does not
+	// count as another recall.
+	async := r.Method == "GET" && preferAsync(r)
+	var release func()
+	if docache && !s.Cache.Contains(key) && !(async && s.staging.staging(key)) {
+		var ok bool
+		release, ok = s.acquireRecall(user)
+		if !ok {
+			xRecallLimited.Add(1)
+			logger.Warn("recall limited")
+			writeTooManyRequests(w, recallRetry, "Too many tape recalls in progress")
+			return
+		}
+		defer func() {
+			if release != nil {
+				release()
+			}
+		}()
+	}
 	firsttime := true
 retry:
 	content, err := s.findContent(key, id, binfo, docache)
 	if err == items.ErrNoStore {
-		w.WriteHeader(503)
-		fmt.Fprintln(w, err)
-		return
-	} else if err == items.ErrDeleted {
-		w.WriteHeader(410)
-		fmt.Fprintln(w, err)
-		return
-	} else if _, ok := err.(items.NoBlobError); ok {
-		w.WriteHeader(404)
-		fmt.Fprintln(w, err)
-		return
-	} else if err != nil {
-		log.Println("getblob", key, err)
+		if mw := s.activeMaintenance(); mw != nil {
+			writeMaintenance(w, mw)
+			return
+		}
+	}
+	if err != nil {
+		if u, ok := unavailableFor(err, id, slot, binfo); ok {
+			if u.Reason == ReasonDeleted {
+				s.addSuccessor(r, &u, id, binfo.ID)
+			}
+			if u.Reason == ReasonQuarantined {
+				logger.Warn("getblob quarantined", "error", err)
+			}
+			writeUnavailable(w, r, u)
+			return
+		}
+		logger.Error("getblob", "error", err)
 		w.WriteHeader(500)
 		fmt.Fprintln(w, err)
 		return
@@ -207,68 +389,171 @@ retry:
 	case ContentCached:
 		if firsttime {
 			nCacheHit.Add(1)
-			log.Println("Cache Hit", key)
+			logger.Debug("cache hit")
 			w.Header().Set("X-Cached", "1")
 		}
 		defer content.r.Close()
 	case ContentLarge:
-		log.Println("Cache Miss (too large)", key)
+		logger.Debug("cache miss, too large")
 		w.Header().Set("X-Cached", "2")
 		defer content.r.Close()
 	case ContentWaiting:
 		if !firsttime {
 			// why are we waiting for content a second time?
-			log.Println("getblob", key, "unexpectedly waiting for content a second time")
+			logger.Error("getblob unexpectedly waiting for content a second time")
 			w.WriteHeader(500)
 			fmt.Fprintln(w, "The file cannot be accessed at this time")
 			return
 		}
 		nCacheMiss.Add(1)
-		log.Println("Cache Miss", key)
+		logger.Debug("cache miss")
 		w.Header().Set("X-Cached", "0")
 		// Since content is not returned for non-GET requests, don't wait
 		// for it to be cached.
 		if r.Method != "GET" {
 			break
 		}
+		// if asked, tell the client to come back later instead of
+		// waiting. The recall slot is released once the copy finishes.
+		if async {
+			s.respondAsync(w, r, key, id, binfo, content.done, release)
+			release = nil
+			return
+		}
 		select {
 		case <-content.done:
-			log.Println("Waiting for content is done, trying again", key)
+			logger.Debug("waiting for content is done, trying again")
 			firsttime = false
 			goto retry
-		case <-time.After(60 * time.Second):
-			log.Println("getblob", key, "timeout")
+		case <-time.After(s.cacheWait(r)):
+			logger.Warn("getblob timeout")
+			s.setRecallHeaders(w, key, binfo.Size)
 			w.WriteHeader(504)
 			fmt.Fprintln(w, "timeout")
 			return
 		}
 	default:
-		log.Println("getblob received status", content.status)
+		logger.Error("getblob received unknown status", "status", content.status)
 		w.WriteHeader(500)
 		fmt.Fprintln(w, "received status", content.status)
 		return
 	}
 
-	w.Header().Set("ETag", fmt.Sprintf(`"%d"`, binfo.ID))
+	if r.Method == "GET" && content.status == ContentCached {
+		s.recordWarm(key, id, binfo)
+	}
+	cw := &countingWriter{ResponseWriter: w}
+	defer func() { s.recordDownload(user, cw.n) }()
+	w = cw
+	w.Header().Set("ETag", etag)
+	setContentType(w, binfo)
+	setDigest(w, r, binfo)
 	// use ServeContent to support range requests. Fall back to io.Copy if the
 	// data source does not support seeks.
 	if c, ok := content.r.(io.ReadSeeker); ok {
-		http.ServeContent(w, r, "", time.Time{}, c)
+		http.ServeContent(w, r, "", binfo.SaveDate, c)
 		return
 	}
 
+	if !binfo.SaveDate.IsZero() {
+		w.Header().Set("Last-Modified", binfo.SaveDate.UTC().Format(http.TimeFormat))
+	}
+
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", content.size))
 
 	// all the headers have been set, now do we need to copy bits?
 	if r.Method != "GET" {
 		return
 	}
-	n, err := io.Copy(w, content.r)
+	n, err := s.clientcopy.copy(w, content.r, s.ClientCopyBuffer)
 	if err != nil {
-		log.Printf("getblob (%s,%d) %d,%s", id, binfo.ID, n, err.Error())
+		logger.Warn("getblob copy", "bytes", n, "error", err)
+	}
+}
+
+// setContentType sets the Content-Type header to the stored mime type of
+// the blob, if it has one. Otherwise it is left for ServeContent to guess.
+func setContentType(w http.ResponseWriter, binfo *items.Blob) {
+	if binfo.MimeType != "" {
+		w.Header().Set("Content-Type", binfo.MimeType)
+	}
+}
+
+// setDigest sets the RFC 9530 Repr-Digest header to the SHA-256 checksum of
+// the blob. Content-Digest is also set unless a range was asked for, since
+// then the message content may be only part of the blob.
+func setDigest(w http.ResponseWriter, r *http.Request, binfo *items.Blob) {
+	if len(binfo.SHA256) == 0 {
+		return
+	}
+	w.Header().Set("Repr-Digest", formatDigest(binfo.SHA256))
+	if r.Header.Get("Range") == "" {
+		w.Header().Set("Content-Digest", formatDigest(binfo.SHA256))
 	}
 }
 
+// blobETag returns the entity tag for the content of a blob. It is the
+// blob's SHA-256 checksum, rather than its id, since blob ids start over at
+// 1 when an item is deleted and made again.
+func blobETag(b *items.Blob) string {
+	if len(b.SHA256) > 0 {
+		return `"` + hex.EncodeToString(b.SHA256) + `"`
+	}
+	if len(b.MD5) > 0 {
+		return `"` + hex.EncodeToString(b.MD5) + `"`
+	}
+	return fmt.Sprintf(`"%d-%d"`, b.ID, b.SaveDate.UnixNano())
+}
+
+// itemETag returns the entity tag for an item listing. Identifiers and
+// other metadata can change without a new version being saved, so the tag
+// is the newest version id followed by a hash of the whole listing.
+func itemETag(v *items.Version, result interface{}) string {
+	buf, _ := json.Marshal(result)
+	sum := sha256.Sum256(buf)
+	return fmt.Sprintf(`"%d-%s"`, v.ID, hex.EncodeToString(sum[:8]))
+}
+
+// checkNotModified returns true, after sending a 304 Not Modified response,
+// if the conditional headers of a GET or HEAD request r show the client
+// already has the version of the resource having the given etag and
+// modification time. If-None-Match takes precedence over If-Modified-Since,
+// as in RFC 7232. A zero modtime is never considered to match.
+func checkNotModified(w http.ResponseWriter, r *http.Request, etag string, modtime time.Time) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	match := false
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		match = etagMatches(inm, etag)
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" && !modtime.IsZero() {
+		t, err := http.ParseTime(ims)
+		// HTTP dates only have a resolution of seconds
+		match = err == nil && !modtime.Truncate(time.Second).After(t)
+	}
+	if !match {
+		return false
+	}
+	w.Header().Set("ETag", etag)
+	if !modtime.IsZero() {
+		w.Header().Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches returns true if the list of entity tags from an If-None-Match
+// header includes etag. Weak tags match their strong counterpart.
+func etagMatches(list string, etag string) bool {
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
 // contentSource is either a ReadCloser that contains the requested data, or it is a promise of a future data stream, which is ready when the done channel is closed.
 type contentSource struct {
 	status ContentStatus
@@ -355,11 +640,16 @@ func (s *RESTServer) findContent(key string, id string, binfo *items.Blob, doLoa
 		// item was cached
 		result.status = ContentCached
 		result.r = NewReadSeekCloser(cacheContents, length)
+		if f, ok := cacheContents.(*os.File); ok && s.FastCopy {
+			// a newly opened file is at offset 0, and serving it
+			// directly lets the kernel copy it to the client.
+			result.r = f
+		}
 		result.size = length
 		return result, nil
 	}
 	// need to source the content from tape
-	if !s.useTape {
+	if !s.useTape || s.activeMaintenance() != nil {
 		return result, items.ErrNoStore
 	}
 	length = binfo.Size
@@ -371,7 +661,7 @@ func (s *RESTServer) findContent(key string, id string, binfo *items.Blob, doLoa
 	// were there previous errors when caching this blob?
 	err = s.errorledger.find(key)
 	if err != nil {
-		return result, err
+		return result, errQuarantined{err}
 	}
 	// cache this item if it is not too large.
 	// doing 1/8th of the cache size is arbitrary.
@@ -393,8 +683,12 @@ func (s *RESTServer) findContent(key string, id string, binfo *items.Blob, doLoa
 		return result, nil
 	}
 	// item is too large to be cached
-	// get it directly from tape
-	realContents, _, err := s.Items.Blob(id, binfo.ID)
+	// get it directly from tape, sharing the read with any other
+	// requests for it
+	realContents, err := s.largereads.open(s.serverContext(), key, func(ctx context.Context) (io.ReadCloser, error) {
+		r, _, err := s.Items.BlobContext(ctx, id, binfo.ID)
+		return r, err
+	})
 	if err != nil {
 		return result, err
 	}
@@ -408,6 +702,9 @@ func (s *RESTServer) findContent(key string, id string, binfo *items.Blob, doLoa
 // there was an error. Errors are added to the errorledger.
 func (s *RESTServer) copyBlobIntoCache(key, id string, bid items.BlobID) {
 	starttime := time.Now()
+	logger := slog.With("item", id, "blob", bid)
+	s.recalls.add(key)
+	defer s.recalls.remove(key)
 	var keepcopy bool
 	// defer this first so it is the last to run at exit.
 	// because cw needs to be Closed() before the Delete().
@@ -416,13 +713,13 @@ func (s *RESTServer) copyBlobIntoCache(key, id string, bid items.BlobID) {
 		if !keepcopy {
 			s.Cache.Delete(key)
 		}
-		log.Println("copyblob finished", key, time.Now().Sub(starttime))
+		logger.Info("copyblob finished", "duration", time.Now().Sub(starttime))
 	}()
 	cw, err := s.Cache.Put(key)
 	if err != nil {
 		// since there is a gaurd around calling copyBlobIntoCache() we
 		// shouldn't be receiving ErrPutPending errors here...
-		log.Printf("cache put %s: %s", key, err.Error())
+		logger.Warn("cache put", "error", err)
 		keepcopy = true // in case someone else added a copy already
 		return
 	}
@@ -432,30 +729,35 @@ func (s *RESTServer) copyBlobIntoCache(key, id string, bid items.BlobID) {
 			// also want to also put this into the errorlog, but don't want to
 			// potentially shadow any earlier errors that may have been put
 			// there in this effort. So for now we just log it.
-			log.Println("cache close", key, err)
+			logger.Error("cache close", "error", err)
 			keepcopy = false
 		}
 	}()
-	cr, length, err := s.Items.Blob(id, bid)
+	cr, length, err := s.Items.BlobContext(s.serverContext(), id, bid)
 	if err != nil {
-		log.Printf("cache items get %s: %s", key, err.Error())
+		logger.Error("cache items get", "error", err)
 		s.errorledger.add(key, err)
 		return
 	}
 	defer cr.Close()
 	// should we put a timeout on the copy?
-	n, err := io.Copy(cw, cr)
+	n, err := s.cachecopy.copy(cw, cr, s.CacheCopyBuffer)
 	if err != nil {
-		log.Printf("cache copy %s: %s", key, err.Error())
+		logger.Error("cache copy", "error", err)
+		if errors.Is(err, items.ErrBadContent) {
+			// the copy in the store is damaged
+			raven.CaptureError(err, map[string]string{"id": id})
+		}
 		s.errorledger.add(key, err)
 		return
 	}
 	if n != length {
 		err = fmt.Errorf("cache length mismatch: read %d, expected %d", n, length)
-		log.Println(err)
+		logger.Error("cache copy", "error", err)
 		s.errorledger.add(key, err)
 		return
 	}
+	s.recallrate.record(n, time.Since(starttime))
 	keepcopy = true
 }
 
@@ -516,24 +818,144 @@ func (r *readseekcloser) Seek(offset int64, whence int) (int64, error) {
 // ItemHandler handles requests to GET /item/:id
 func (s *RESTServer) ItemHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	id := ps.ByName("id")
-	item, err := s.Items.Item(id)
+	item, err := s.Items.ItemContext(r.Context(), id)
 	if err != nil {
 		// If Item Store Disable, return a 503
+		if err == items.ErrNoStore {
+			requestLogger(r).Warn("tape disabled", "item", id, "status", 503)
+			u, _ := unavailableFor(err, id, "", nil)
+			writeUnavailable(w, r, u)
+		} else {
+			writeUnavailable(w, r, s.itemMissing(r, id, ""))
+		}
+		return
+	}
+	result := itemWithIdentifiers{Item: item}
+	if s.Identifiers != nil {
+		result.Identifiers, err = s.Identifiers.ItemIdentifiers(id)
+		if err != nil {
+			// not fatal, display the item without them
+			requestLogger(r).Error("ItemIdentifiers", "item", id, "error", err)
+			raven.CaptureError(err, nil)
+		}
+	}
+	// sometimes when there are storage errors no Version list gets saved to tape.
+	if len(item.Versions) > 0 {
+		v := item.Versions[len(item.Versions)-1]
+		etag := itemETag(v, result)
+		// the save date of the version does not change when the
+		// identifiers do, so only the ETag is used to validate
+		if checkNotModified(w, r, etag, time.Time{}) {
+			return
+		}
+		w.Header().Set("ETag", etag)
+		if !v.SaveDate.IsZero() {
+			w.Header().Set("Last-Modified", v.SaveDate.UTC().Format(http.TimeFormat))
+		}
+	}
+	if isV2(r) {
+		writeJSON(w, apiv2.NewItem(item, result.Identifiers))
+		return
+	}
+	writeHTMLorJSON(w, r, itemTemplate, result)
+}
+
+// ListItemsHandler handles requests to GET /items
+// It returns a page of items, optionally only those having a version saved
+// by a given user. It takes the same parameters as the item list UI. The
+// total number of items and links to the other pages are in the headers.
+func (s *RESTServer) ListItemsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	q := parseItemListQuery(r)
+	list, err := s.BlobDB.GetItemList(q.N, q.P, q.Sort, q.Creator)
+	if err != nil {
+		requestLogger(r).Error("ListItems", "error", err)
+		raven.CaptureError(err, nil)
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err)
+		return
+	}
+	if list == nil {
+		list = []SimpleItem{}
+	}
+	setPageHeaders(w, r, newItemListPage(q, s.countItems(r, q)))
+	writeHTMLorJSON(w, r, itemListTemplate, list)
+}
+
+// DeleteItemHandler handles requests to DELETE /item/:id
+// It removes every bundle of the item from the store, along with its cached
+// content and its database entries. This cannot be undone. An item whose
+// blobs are referred to by other items is not deleted, and 409 is returned.
+func (s *RESTServer) DeleteItemHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := ps.ByName("id")
+	item, err := s.Items.Item(id)
+	if err != nil {
 		if err == items.ErrNoStore {
 			w.WriteHeader(503)
-			log.Printf("GET /item/%s returns 503 - tape disabled", id)
 		} else {
 			w.WriteHeader(404)
 		}
 		fmt.Fprintln(w, err.Error())
 		return
 	}
-	// sometimes when there are storage errors no Version list gets saved to tape.
-	if len(item.Versions) > 0 {
-		vid := item.Versions[len(item.Versions)-1].ID
-		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, vid))
+	// open a transaction on the item so no other transaction can change it
+	// while we are deleting it. It also leaves a record of the deletion.
+	tx, err := s.TxStore.Create(id)
+	if err != nil {
+		w.WriteHeader(409)
+		fmt.Fprintln(w, err.Error())
+		return
 	}
-	writeHTMLorJSON(w, r, itemTemplate, item)
+	tx.Creator = ps.ByName("username")
+	logger := requestLogger(r).With("item", id)
+	logger.Info("deleting item")
+	err = s.deleteItem(tx, item, logger)
+	if errors.Is(err, items.ErrReferenced) {
+		// blobs in other items refer to this one, and would break
+		w.WriteHeader(409)
+		fmt.Fprintln(w, err.Error())
+	} else if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err.Error())
+	}
+}
+
+// deleteItem removes item from the store, the blob cache, and the database,
+// and records its tombstone. The transaction tx should have been opened on
+// the item, so nothing else changes it meanwhile, and is finished with the
+// result.
+func (s *RESTServer) deleteItem(tx *transaction.Transaction, item *items.Item, logger *slog.Logger) error {
+	id := item.ID
+	err := s.Items.Delete(id)
+	if err == items.ErrNoItem {
+		// no bundles in the store, but clean up everything else anyway
+		err = nil
+	}
+	if err == nil {
+		if s.Cache != nil {
+			for _, blob := range item.Blobs {
+				s.Cache.Delete(bendo.CacheKey(id, blob.ID))
+			}
+		}
+		err = s.BlobDB.DeleteItem(id)
+	}
+	if err != nil {
+		logger.Error("DeleteItem", "error", err)
+		raven.CaptureError(err, map[string]string{"id": id})
+		tx.AppendError(err.Error())
+		tx.SetStatus(transaction.StatusError)
+		return err
+	}
+	if s.Tombstones != nil {
+		err = s.Tombstones.RecordDeletion(id, time.Now(), tx.Creator)
+		if err != nil {
+			// the item is gone, so only the 410 responses are lost
+			logger.Error("RecordDeletion", "error", err)
+			raven.CaptureError(err, map[string]string{"id": id})
+		}
+	}
+	tx.SetStatus(transaction.StatusFinished)
+	s.recordEvent(Event{Type: EventDelete, Item: id, Transaction: tx.ID, User: tx.Creator})
+	return nil
 }
 
 func minus1(a interface{}) int {
@@ -576,7 +998,8 @@ tbody tr:nth-child(even) { background-color: #eeeeee; }
 </tbody></table>
 <dl>
 <dt>MaxBundle</dt><dd>{{ .MaxBundle }}</dd>
-</dl>
+{{ range .Identifiers }}<dt>Identifier</dt><dd>{{ . }}</dd>
+{{ end }}</dl>
 {{ $blobs := .Blobs }}
 {{ $id := .ID }}
 {{ with index .Versions (len .Versions | minus1) }}
@@ -607,5 +1030,15 @@ tbody tr:nth-child(even) { background-color: #eeeeee; }
 	{{ end }}
 	</tbody></table>
 {{ end }}
+</body></html>`))
+
+	itemListTemplate = template.Must(template.New("itemlist").Parse(`
+<html><body>
+<h1>Items</h1>
+<ul>
+{{ range . }}
+	<li><a href="/item/{{ .ID }}">{{ .ID }}</a> {{ .Modified }}</li>
+{{ end }}
+</ul>
 </body></html>`))
 )
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An LDAPValidator checks user names and passwords against an LDAP directory,
+// such as Active Directory, and gives each user a role based on the groups
+// they are in. Users are found by searching for an entry whose UserAttribute
+// is the user name, and their password is checked by binding as that entry.
+// API keys, which have no password, are passed to Fallback.
+type LDAPValidator struct {
+	// URL is the directory server, as either "ldap://host[:port]" or
+	// "ldaps://host[:port]". If StartTLS is set, "ldap" connections are
+	// upgraded to TLS before any passwords are sent. TLSConfig, if not
+	// nil, is used for TLS connections.
+	URL       string
+	StartTLS  bool
+	TLSConfig *tls.Config
+
+	// BindDN and BindPassword are the account to search for users with.
+	// If BindDN is empty, the search is done anonymously.
+	BindDN       string
+	BindPassword string
+
+	// BaseDN is the subtree to search for users in. UserAttribute is the
+	// attribute holding the user name (default "uid"; Active Directory
+	// uses "sAMAccountName"), and GroupAttribute lists the groups a user
+	// is in (default "memberOf").
+	BaseDN         string
+	UserAttribute  string
+	GroupAttribute string
+
+	// Groups gives the role for the members of each group, by the group's
+	// DN. Case and spaces around the separators in the DNs are ignored. A
+	// user in more than one group gets the greatest of their roles. Users
+	// in none of the groups are refused.
+	Groups map[string]Role
+
+	// CacheTime is how long the result of checking a password is
+	// remembered, to spare the directory a request for every API call.
+	// NewLDAPValidator sets it to 5 minutes.
+	// Timeout bounds each exchange with the directory (default 10
+	// seconds).
+	CacheTime time.Duration
+	Timeout   time.Duration
+
+	// Fallback, if not nil, validates API keys.
+	Fallback TokenValidator
+
+	m     sync.Mutex
+	cache map[[sha256.Size]byte]ldapResultEntry
+}
+
+// ldapResultEntry is a remembered result of checking a password.
+type ldapResultEntry struct {
+	user    string
+	role    Role
+	expires time.Time
+}
+
+var _ PasswordValidator = &LDAPValidator{}
+
+// NewLDAPValidator returns an LDAPValidator using the given directory. The
+// role names in groups are as for AtoRole.
+func NewLDAPValidator(url string, basedn string, groups map[string]string) (*LDAPValidator, error) {
+	if !strings.HasPrefix(url, "ldap://") && !strings.HasPrefix(url, "ldaps://") {
+		return nil, errors.New("LDAP URL must begin with ldap:// or ldaps://")
+	}
+	if basedn == "" {
+		return nil, errors.New("no LDAP base DN given")
+	}
+	v := &LDAPValidator{
+		URL:            url,
+		BaseDN:         basedn,
+		UserAttribute:  "uid",
+		GroupAttribute: "memberOf",
+		Groups:         make(map[string]Role),
+		CacheTime:      5 * time.Minute,
+		Timeout:        10 * time.Second,
+	}
+	for group, name := range groups {
+		role := AtoRole(name)
+		if role == RoleUnknown {
+			return nil, errors.New("unknown role " + name + " for group " + group)
+		}
+		v.Groups[group] = role
+	}
+	return v, nil
+}
+
+// TokenValid passes the token to the Fallback validator, if there is one.
+func (v *LDAPValidator) TokenValid(token string) (string, Role, error) {
+	if v.Fallback == nil {
+		return "", RoleUnknown, nil
+	}
+	return v.Fallback.TokenValid(token)
+}
+
+// PasswordValid checks the given user name and password against the
+// directory, returning the user's role.
+func (v *LDAPValidator) PasswordValid(name string, password string) (string, Role, error) {
+	// an empty password would be an unauthenticated bind, which succeeds
+	if name == "" || password == "" {
+		return "", RoleUnknown, nil
+	}
+	key := sha256.Sum256([]byte(name + "\x00" + password))
+	now := time.Now()
+	v.m.Lock()
+	entry, ok := v.cache[key]
+	v.m.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.user, entry.role, nil
+	}
+
+	role, err := v.lookup(name, password)
+	if err != nil {
+		return "", RoleUnknown, err
+	}
+	entry = ldapResultEntry{expires: now.Add(v.CacheTime)}
+	if role != RoleUnknown {
+		entry.user = name
+		entry.role = role
+	}
+	v.m.Lock()
+	if v.cache == nil {
+		v.cache = make(map[[sha256.Size]byte]ldapResultEntry)
+	}
+	// drop expired entries so the cache doesn't grow without bound
+	for k, e := range v.cache {
+		if now.After(e.expires) {
+			delete(v.cache, k)
+		}
+	}
+	v.cache[key] = entry
+	v.m.Unlock()
+	return entry.user, entry.role, nil
+}
+
+// lookup finds the user in the directory, checks their password, and
+// returns their role. Unknown users and wrong passwords return
+// RoleUnknown without an error.
+func (v *LDAPValidator) lookup(name string, password string) (Role, error) {
+	timeout := v.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	conn, err := dialLDAP(v.URL, v.StartTLS, v.TLSConfig, timeout)
+	if err != nil {
+		return RoleUnknown, err
+	}
+	defer conn.Close()
+	if v.BindDN != "" {
+		err = conn.Bind(v.BindDN, v.BindPassword)
+		if err != nil {
+			return RoleUnknown, err
+		}
+	}
+	groupattr := v.GroupAttribute
+	if groupattr == "" {
+		groupattr = "memberOf"
+	}
+	userattr := v.UserAttribute
+	if userattr == "" {
+		userattr = "uid"
+	}
+	// ask for two entries so an ambiguous name can be refused
+	entries, err := conn.Search(v.BaseDN, userattr, name, 2, []string{groupattr})
+	if e, ok := err.(*ldapError); ok && e.Code == ldapSizeLimitExceeded {
+		return RoleUnknown, nil
+	} else if err != nil {
+		return RoleUnknown, err
+	}
+	if len(entries) != 1 {
+		return RoleUnknown, nil
+	}
+	err = conn.Bind(entries[0].DN, password)
+	if e, ok := err.(*ldapError); ok && e.Code == ldapInvalidCredentials {
+		return RoleUnknown, nil
+	} else if err != nil {
+		return RoleUnknown, err
+	}
+	member := make(map[string]bool)
+	for _, group := range entries[0].Attrs[strings.ToLower(groupattr)] {
+		member[normalizeDN(group)] = true
+	}
+	role := RoleUnknown
+	for group, r := range v.Groups {
+		if member[normalizeDN(group)] && r > role {
+			role = r
+		}
+	}
+	return role, nil
+}
+
+// normalizeDN puts a distinguished name into a form in which equal names
+// are equal strings, by lower casing it and removing spaces around the
+// separators.
+func normalizeDN(dn string) string {
+	parts := strings.Split(strings.ToLower(dn), ",")
+	for i, p := range parts {
+		attr, value, ok := strings.Cut(p, "=")
+		if ok {
+			p = strings.TrimSpace(attr) + "=" + strings.TrimSpace(value)
+		}
+		parts[i] = strings.TrimSpace(p)
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// fakeDirectory is a tiny LDAP server holding a few users, enough to test
+// the LDAPValidator.
+type fakeDirectory struct {
+	l         net.Listener
+	passwords map[string]string   // by DN
+	users     map[string]string   // uid to DN
+	groups    map[string][]string // by DN
+
+	m     sync.Mutex
+	binds int
+}
+
+func newFakeDirectory(t *testing.T) *fakeDirectory {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &fakeDirectory{
+		l: l,
+		passwords: map[string]string{
+			"cn=bendo,dc=example,dc=org":            "service",
+			"uid=alice,ou=people,dc=example,dc=org": "alice-pw",
+			"uid=bob,ou=people,dc=example,dc=org":   "bob-pw",
+			"uid=carol,ou=people,dc=example,dc=org": "carol-pw",
+		},
+		users: map[string]string{
+			"alice": "uid=alice,ou=people,dc=example,dc=org",
+			"bob":   "uid=bob,ou=people,dc=example,dc=org",
+			"carol": "uid=carol,ou=people,dc=example,dc=org",
+		},
+		groups: map[string][]string{
+			"uid=alice,ou=people,dc=example,dc=org": {
+				"CN=Bendo Readers,OU=Groups,DC=example,DC=org",
+				"cn=bendo writers,ou=groups,dc=example,dc=org",
+			},
+			"uid=bob,ou=people,dc=example,dc=org": {
+				"cn=staff,ou=groups,dc=example,dc=org",
+			},
+			"uid=carol,ou=people,dc=example,dc=org": {
+				"cn=bendo readers, ou=groups, dc=example, dc=org",
+			},
+		},
+	}
+	go d.serve()
+	return d
+}
+
+func (d *fakeDirectory) URL() string {
+	return "ldap://" + d.l.Addr().String()
+}
+
+func (d *fakeDirectory) Binds() int {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.binds
+}
+
+func (d *fakeDirectory) serve() {
+	for {
+		conn, err := d.l.Accept()
+		if err != nil {
+			return
+		}
+		go d.handle(conn)
+	}
+}
+
+func (d *fakeDirectory) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(id int, op []byte) {
+		conn.Write(berEncode(berSequence, berInt(berInteger, id), op))
+	}
+	result := func(tag byte, code int) []byte {
+		return berEncode(tag,
+			berInt(berEnumerated, code),
+			berString(berOctetString, ""),
+			berString(berOctetString, ""))
+	}
+	for {
+		msg, err := berRead(r)
+		if err != nil {
+			return
+		}
+		parts, _ := berChildren(msg.data)
+		id := berToInt(parts[0].data)
+		op := parts[1]
+		args, _ := berChildren(op.data)
+		switch op.tag {
+		case ldapBindRequest:
+			d.m.Lock()
+			d.binds++
+			d.m.Unlock()
+			dn, password := string(args[1].data), string(args[2].data)
+			code := ldapInvalidCredentials
+			if pw, ok := d.passwords[dn]; ok && pw == password {
+				code = ldapSuccess
+			}
+			reply(id, result(ldapBindResponse, code))
+		case ldapSearchRequest:
+			filter, _ := berChildren(args[6].data)
+			attr, value := string(filter[0].data), string(filter[1].data)
+			if attr == "uid" {
+				if dn, ok := d.users[value]; ok {
+					var vals [][]byte
+					for _, g := range d.groups[dn] {
+						vals = append(vals, berString(berOctetString, g))
+					}
+					reply(id, berEncode(ldapSearchEntry,
+						berString(berOctetString, dn),
+						berEncode(berSequence,
+							berEncode(berSequence,
+								berString(berOctetString, "memberOf"),
+								berEncode(berSet, vals...)))))
+				}
+			}
+			reply(id, result(ldapSearchDone, ldapSuccess))
+		case ldapUnbindRequest:
+			return
+		}
+	}
+}
+
+func TestBER(t *testing.T) {
+	for _, n := range []int{0, 1, 127, 128, 255, 256, 65535, 1 << 20, -1, -128, -129} {
+		e, rest, err := berParse(berInt(berInteger, n))
+		if err != nil || len(rest) != 0 || berToInt(e.data) != n {
+			t.Errorf("%d: received %d, %v, %v", n, berToInt(e.data), rest, err)
+		}
+	}
+	long := strings.Repeat("x", 1000)
+	e, _, err := berParse(berString(berOctetString, long))
+	if err != nil || string(e.data) != long {
+		t.Errorf("Received %v", err)
+	}
+	if _, _, err := berParse([]byte{berOctetString, 5, 'a'}); err == nil {
+		t.Errorf("Expected an error for a short element")
+	}
+}
+
+func TestLDAPValidator(t *testing.T) {
+	d := newFakeDirectory(t)
+	defer d.l.Close()
+	v, err := NewLDAPValidator(d.URL(), "dc=example,dc=org", map[string]string{
+		"cn=Bendo Readers,ou=Groups,dc=example,dc=org": "Read",
+		"cn=Bendo Writers,ou=Groups,dc=example,dc=org": "Write",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.BindDN = "cn=bendo,dc=example,dc=org"
+	v.BindPassword = "service"
+	v.Fallback, _ = NewListValidatorString("scripts Admin 1234\n")
+
+	var tests = []struct {
+		name     string
+		password string
+		user     string
+		role     Role
+	}{
+		{"alice", "alice-pw", "alice", RoleWrite},
+		{"alice", "wrong", "", RoleUnknown},
+		{"alice", "", "", RoleUnknown},
+		{"bob", "bob-pw", "", RoleUnknown}, // in no bendo group
+		{"carol", "carol-pw", "carol", RoleRead},
+		{"dave", "dave-pw", "", RoleUnknown}, // not in directory
+	}
+	for _, test := range tests {
+		user, role, err := v.PasswordValid(test.name, test.password)
+		if err != nil || user != test.user || role != test.role {
+			t.Errorf("%s/%s: received %q, %v, %v; expected %q, %v",
+				test.name, test.password, user, role, err, test.user, test.role)
+		}
+	}
+
+	// results are cached
+	n := d.Binds()
+	v.PasswordValid("alice", "alice-pw")
+	if d.Binds() != n {
+		t.Errorf("Received %d binds, expected %d", d.Binds(), n)
+	}
+
+	// API keys go to the fallback
+	user, role, err := v.TokenValid("1234")
+	if err != nil || user != "scripts" || role != RoleAdmin {
+		t.Errorf("Received %q, %v, %v", user, role, err)
+	}
+
+	// check a request using basic authentication
+	s := &RESTServer{Validator: v}
+	h := s.authzWrapper(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		w.Write([]byte(ps.ByName("username")))
+	}, RoleWrite)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("alice", "alice-pw")
+	h(w, r, nil)
+	if w.Code != 200 || w.Body.String() != "alice" {
+		t.Errorf("Received %d %q", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	r.SetBasicAuth("carol", "carol-pw")
+	h(w, r, nil)
+	if w.Code != 401 {
+		t.Errorf("Received %d, expected 401", w.Code)
+	}
+	// a token given as the user name still works
+	w = httptest.NewRecorder()
+	r.SetBasicAuth("1234", "")
+	h(w, r, nil)
+	if w.Code != 200 || w.Body.String() != "scripts" {
+		t.Errorf("Received %d %q", w.Code, w.Body.String())
+	}
+
+	if _, err := NewLDAPValidator(d.URL(), "dc=example,dc=org", map[string]string{"cn=x": "boss"}); err == nil {
+		t.Errorf("Expected an error for an unknown role")
+	}
+}
+
+func TestNormalizeDN(t *testing.T) {
+	a := normalizeDN("CN=Bendo Admins, OU=Groups,DC=example , DC=org")
+	b := normalizeDN("cn=bendo admins,ou=groups,dc=example,dc=org")
+	if a != b {
+		t.Errorf("Received %q and %q", a, b)
+	}
+}
@@ -0,0 +1,428 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// This file has a minimal LDAP v3 client (RFC 4511), supporting only the
+// simple bind and equality search needed to check a user's password and
+// groups. Messages are encoded with the subset of BER that LDAP uses.
+
+// BER and LDAP tags
+const (
+	berBoolean     = 0x01
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+	berSequence    = 0x30
+	berSet         = 0x31
+
+	ldapBindRequest      = 0x60 // [APPLICATION 0]
+	ldapBindResponse     = 0x61 // [APPLICATION 1]
+	ldapUnbindRequest    = 0x42 // [APPLICATION 2], primitive
+	ldapSearchRequest    = 0x63 // [APPLICATION 3]
+	ldapSearchEntry      = 0x64 // [APPLICATION 4]
+	ldapSearchDone       = 0x65 // [APPLICATION 5]
+	ldapSearchReference  = 0x73 // [APPLICATION 19]
+	ldapExtendedRequest  = 0x77 // [APPLICATION 23]
+	ldapExtendedResponse = 0x78 // [APPLICATION 24]
+	ldapSimpleAuth       = 0x80 // [0], primitive
+	ldapExtendedName     = 0x80 // [0], primitive
+	ldapEqualityMatch    = 0xa3 // [3], constructed
+)
+
+// LDAP result codes
+const (
+	ldapSuccess            = 0
+	ldapSizeLimitExceeded  = 4
+	ldapInvalidCredentials = 49
+)
+
+// ldapStartTLSOID names the StartTLS extended operation.
+const ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+
+// berMaxLength is the largest element we will read, to protect against
+// a confused or hostile server.
+const berMaxLength = 16 << 20
+
+var errBER = errors.New("ldap: malformed message")
+
+// A berElem is a single decoded BER element. For constructed elements the
+// data holds the encoded children.
+type berElem struct {
+	tag  byte
+	data []byte
+}
+
+// berEncode returns the element with the given tag whose content is the
+// concatenation of the given parts.
+func berEncode(tag byte, parts ...[]byte) []byte {
+	var n int
+	for _, p := range parts {
+		n += len(p)
+	}
+	result := append([]byte{tag}, berLength(n)...)
+	for _, p := range parts {
+		result = append(result, p...)
+	}
+	return result
+}
+
+func berLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+func berString(tag byte, s string) []byte {
+	return berEncode(tag, []byte(s))
+}
+
+// berInt encodes n as a two's complement integer in the fewest bytes.
+func berInt(tag byte, n int) []byte {
+	b := []byte{byte(n)}
+	for n >= 0x80 || n < -0x80 {
+		n >>= 8
+		b = append([]byte{byte(n)}, b...)
+	}
+	return berEncode(tag, b)
+}
+
+func berBool(b bool) []byte {
+	if b {
+		return berEncode(berBoolean, []byte{0xff})
+	}
+	return berEncode(berBoolean, []byte{0})
+}
+
+// berToInt decodes the content of an integer or enumerated element.
+func berToInt(data []byte) int {
+	var n int
+	for i, b := range data {
+		if i == 0 && b&0x80 != 0 {
+			n = -1
+		}
+		n = n<<8 | int(b)
+	}
+	return n
+}
+
+// berParse decodes the first element in b, returning it and the bytes
+// after it. Only single byte tags are supported, which is all LDAP needs.
+func berParse(b []byte) (berElem, []byte, error) {
+	if len(b) < 2 {
+		return berElem{}, nil, errBER
+	}
+	tag := b[0]
+	n := int(b[1])
+	b = b[2:]
+	if n&0x80 != 0 {
+		nbytes := n & 0x7f
+		if nbytes == 0 || nbytes > 4 || len(b) < nbytes {
+			return berElem{}, nil, errBER
+		}
+		n = 0
+		for _, c := range b[:nbytes] {
+			n = n<<8 | int(c)
+		}
+		b = b[nbytes:]
+	}
+	if n > len(b) {
+		return berElem{}, nil, errBER
+	}
+	return berElem{tag: tag, data: b[:n]}, b[n:], nil
+}
+
+// berChildren decodes the children of a constructed element.
+func berChildren(data []byte) ([]berElem, error) {
+	var result []berElem
+	for len(data) > 0 {
+		var e berElem
+		var err error
+		e, data, err = berParse(data)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, e)
+	}
+	return result, nil
+}
+
+// berRead reads a single element from r.
+func berRead(r *bufio.Reader) (berElem, error) {
+	var header [2]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return berElem{}, err
+	}
+	n := int(header[1])
+	if n&0x80 != 0 {
+		nbytes := n & 0x7f
+		if nbytes == 0 || nbytes > 4 {
+			return berElem{}, errBER
+		}
+		var lb [4]byte
+		_, err = io.ReadFull(r, lb[:nbytes])
+		if err != nil {
+			return berElem{}, err
+		}
+		n = 0
+		for _, c := range lb[:nbytes] {
+			n = n<<8 | int(c)
+		}
+	}
+	if n > berMaxLength {
+		return berElem{}, errBER
+	}
+	data := make([]byte, n)
+	_, err = io.ReadFull(r, data)
+	return berElem{tag: header[0], data: data}, err
+}
+
+// An ldapError is a result code other than success returned by the server.
+type ldapError struct {
+	Code    int
+	Message string
+}
+
+func (e *ldapError) Error() string {
+	return fmt.Sprintf("ldap: result code %d: %s", e.Code, e.Message)
+}
+
+// An ldapEntry is a single entry returned by a search.
+type ldapEntry struct {
+	DN    string
+	Attrs map[string][]string // keyed by lower case attribute name
+}
+
+// An ldapConn is a connection to an LDAP server.
+type ldapConn struct {
+	conn  net.Conn
+	r     *bufio.Reader
+	msgid int
+}
+
+// dialLDAP connects to the server at the given "ldap://" or "ldaps://" URL.
+// If startTLS is set, a plain connection is upgraded to TLS before it is
+// used. The whole exchange on the connection must finish within timeout.
+func dialLDAP(rawurl string, startTLS bool, tlsConfig *tls.Config, timeout time.Duration) (*ldapConn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		switch u.Scheme {
+		case "ldap":
+			host = net.JoinHostPort(u.Hostname(), "389")
+		case "ldaps":
+			host = net.JoinHostPort(u.Hostname(), "636")
+		}
+	}
+	if u.Scheme != "ldap" && u.Scheme != "ldaps" {
+		return nil, fmt.Errorf("ldap: unknown URL scheme %q", u.Scheme)
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = u.Hostname()
+	}
+	conn, err := net.DialTimeout("tcp", host, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if u.Scheme == "ldaps" {
+		conn = tls.Client(conn, tlsConfig)
+	}
+	c := &ldapConn{conn: conn, r: bufio.NewReader(conn)}
+	if startTLS && u.Scheme == "ldap" {
+		err = c.startTLS(tlsConfig)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Close ends the session and closes the connection.
+func (c *ldapConn) Close() error {
+	c.send(berEncode(ldapUnbindRequest))
+	return c.conn.Close()
+}
+
+// send writes a message containing the given operation, and returns its
+// message id.
+func (c *ldapConn) send(op []byte) (int, error) {
+	c.msgid++
+	msg := berEncode(berSequence, berInt(berInteger, c.msgid), op)
+	_, err := c.conn.Write(msg)
+	return c.msgid, err
+}
+
+// receive reads the next message for the given message id, returning its
+// operation.
+func (c *ldapConn) receive(msgid int) (berElem, error) {
+	for {
+		e, err := berRead(c.r)
+		if err != nil {
+			return berElem{}, err
+		}
+		if e.tag != berSequence {
+			return berElem{}, errBER
+		}
+		parts, err := berChildren(e.data)
+		if err != nil || len(parts) < 2 || parts[0].tag != berInteger {
+			return berElem{}, errBER
+		}
+		// skip unsolicited notifications and anything else not ours
+		if berToInt(parts[0].data) == msgid {
+			return parts[1], nil
+		}
+	}
+}
+
+// ldapResult checks the LDAPResult in a response operation with the given
+// tag, returning an ldapError if it is not a success.
+func ldapResult(op berElem, tag byte) error {
+	if op.tag != tag {
+		return errBER
+	}
+	parts, err := berChildren(op.data)
+	if err != nil || len(parts) < 3 || parts[0].tag != berEnumerated {
+		return errBER
+	}
+	code := berToInt(parts[0].data)
+	if code != ldapSuccess {
+		return &ldapError{Code: code, Message: string(parts[2].data)}
+	}
+	return nil
+}
+
+func (c *ldapConn) startTLS(tlsConfig *tls.Config) error {
+	id, err := c.send(berEncode(ldapExtendedRequest, berString(ldapExtendedName, ldapStartTLSOID)))
+	if err != nil {
+		return err
+	}
+	op, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	err = ldapResult(op, ldapExtendedResponse)
+	if err != nil {
+		return err
+	}
+	tconn := tls.Client(c.conn, tlsConfig)
+	err = tconn.Handshake()
+	if err != nil {
+		return err
+	}
+	c.conn = tconn
+	c.r = bufio.NewReader(tconn)
+	return nil
+}
+
+// Bind authenticates the connection as dn using a simple bind.
+func (c *ldapConn) Bind(dn string, password string) error {
+	id, err := c.send(berEncode(ldapBindRequest,
+		berInt(berInteger, 3),
+		berString(berOctetString, dn),
+		berString(ldapSimpleAuth, password)))
+	if err != nil {
+		return err
+	}
+	op, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	return ldapResult(op, ldapBindResponse)
+}
+
+// Search returns up to limit entries under base whose attribute attr is
+// equal to value, with the given attributes filled in.
+func (c *ldapConn) Search(base string, attr string, value string, limit int, attrs []string) ([]ldapEntry, error) {
+	var attrlist [][]byte
+	for _, a := range attrs {
+		attrlist = append(attrlist, berString(berOctetString, a))
+	}
+	id, err := c.send(berEncode(ldapSearchRequest,
+		berString(berOctetString, base),
+		berInt(berEnumerated, 2), // wholeSubtree
+		berInt(berEnumerated, 0), // neverDerefAliases
+		berInt(berInteger, limit),
+		berInt(berInteger, 0), // no time limit
+		berBool(false),
+		berEncode(ldapEqualityMatch,
+			berString(berOctetString, attr),
+			berString(berOctetString, value)),
+		berEncode(berSequence, attrlist...)))
+	if err != nil {
+		return nil, err
+	}
+	var result []ldapEntry
+	for {
+		op, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch op.tag {
+		case ldapSearchEntry:
+			entry, err := parseLDAPEntry(op.data)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, entry)
+		case ldapSearchReference:
+			// we don't follow referrals
+		default:
+			return result, ldapResult(op, ldapSearchDone)
+		}
+	}
+}
+
+// parseLDAPEntry decodes the content of a SearchResultEntry.
+func parseLDAPEntry(data []byte) (ldapEntry, error) {
+	parts, err := berChildren(data)
+	if err != nil || len(parts) != 2 {
+		return ldapEntry{}, errBER
+	}
+	entry := ldapEntry{
+		DN:    string(parts[0].data),
+		Attrs: make(map[string][]string),
+	}
+	attrs, err := berChildren(parts[1].data)
+	if err != nil {
+		return entry, err
+	}
+	for _, a := range attrs {
+		pair, err := berChildren(a.data)
+		if err != nil || len(pair) != 2 {
+			return entry, errBER
+		}
+		values, err := berChildren(pair[1].data)
+		if err != nil {
+			return entry, err
+		}
+		name := strings.ToLower(string(pair[0].data))
+		for _, v := range values {
+			entry.Attrs[name] = append(entry.Attrs[name], string(v.data))
+		}
+	}
+	return entry, nil
+}
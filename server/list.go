@@ -0,0 +1,117 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	raven "github.com/getsentry/raven-go"
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/ndlib/bendo/apiv2"
+	"github.com/ndlib/bendo/items"
+)
+
+// ListSlotsHandler handles requests to GET /item/:id/@list/*path
+// It lists one directory of a version of the item, taking the slot names as
+// paths separated by "/". Each file is given with its size, checksums, and
+// modification time, and the entries are sorted by name, so a client may
+// sync a directory tree the same way it would one on disk. The optional
+// parameter "version" gives the version to list, the newest one by
+// default. If "recursive" is true every file below the directory is listed,
+// with names relative to it, and no directories are listed.
+func (s *RESTServer) ListSlotsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := ps.ByName("id")
+	// the slot parameter is "/@list" followed by the directory, if any
+	dir := strings.Trim(strings.TrimPrefix(ps.ByName("slot"), "/@list"), "/")
+	var vid int
+	if v := r.FormValue("version"); v != "" {
+		var err error
+		vid, err = strconv.Atoi(v)
+		if err != nil || vid <= 0 {
+			w.WriteHeader(400)
+			fmt.Fprintln(w, "version must be a positive integer")
+			return
+		}
+	}
+	recursive, _ := strconv.ParseBool(r.FormValue("recursive"))
+	item, err := s.Items.ItemContext(r.Context(), id)
+	if err == items.ErrNoItem {
+		writeUnavailable(w, r, s.itemMissing(r, id, ""))
+		return
+	} else if err != nil {
+		if u, ok := unavailableFor(err, id, "", nil); ok {
+			writeUnavailable(w, r, u)
+			return
+		}
+		requestLogger(r).Error("list", "item", id, "error", err)
+		raven.CaptureError(err, nil)
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err)
+		return
+	}
+	ver := item.FindVersion(items.VersionID(vid))
+	if ver == nil {
+		w.WriteHeader(404)
+		fmt.Fprintln(w, items.ErrNoVersion)
+		return
+	}
+	entries := listSlots(item, ver, dir, recursive)
+	if dir != "" && len(entries) == 0 {
+		w.WriteHeader(404)
+		fmt.Fprintln(w, "no such directory")
+		return
+	}
+	writeJSON(w, apiv2.Listing{
+		Item:    id,
+		Version: int(ver.ID),
+		Path:    dir,
+		Entries: entries,
+	})
+}
+
+// listSlots returns the entries of the directory dir in the given version of
+// item, sorted by name. The top directory is "". Slots naming blobs which
+// have been deleted are skipped. If recursive is true the files in every
+// subdirectory are returned instead of the subdirectories themselves.
+func listSlots(item *items.Item, ver *items.Version, dir string, recursive bool) []apiv2.Entry {
+	blobs := make(map[items.BlobID]*items.Blob, len(item.Blobs))
+	for _, b := range item.Blobs {
+		blobs[b.ID] = b
+	}
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+	var files []apiv2.Entry
+	dirs := make(map[string]int) // index of each directory in files
+	for name, bid := range ver.Slots {
+		b := blobs[bid]
+		if !strings.HasPrefix(name, prefix) || b == nil || !b.DeleteDate.IsZero() {
+			continue
+		}
+		e := apiv2.NewEntry(name[len(prefix):], b, ver.SlotMeta[name])
+		i := strings.IndexByte(e.Name, '/')
+		if recursive || i == -1 {
+			files = append(files, e)
+			continue
+		}
+		// the file is in a subdirectory
+		sub := e.Name[:i]
+		if j, ok := dirs[sub]; ok {
+			if e.Modified.After(files[j].Modified) {
+				files[j].Modified = e.Modified
+			}
+			continue
+		}
+		dirs[sub] = len(files)
+		files = append(files, apiv2.Entry{Name: sub, Dir: true, Modified: e.Modified})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	if files == nil {
+		files = []apiv2.Entry{}
+	}
+	return files
+}
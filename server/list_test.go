@@ -0,0 +1,112 @@
+package server
+
+import (
+	"encoding/json"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/ndlib/bendo/apiv2"
+	"github.com/ndlib/bendo/items"
+)
+
+func TestListSlots(t *testing.T) {
+	early := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	late := early.Add(time.Hour)
+	item := &items.Item{
+		ID: "abc",
+		Blobs: []*items.Blob{
+			{ID: 1, SaveDate: early, Size: 1, Bundle: 1},
+			{ID: 2, SaveDate: late, Size: 2, Bundle: 1},
+			{ID: 3, SaveDate: late, Size: 3, DeleteDate: late},
+		},
+	}
+	ver := &items.Version{
+		ID: 1,
+		Slots: map[string]items.BlobID{
+			"z.txt":       1,
+			"a/b/c.txt":   1,
+			"a/d.txt":     2,
+			"gone.txt":    3,
+			"m/n.txt":     1,
+			"a/b/e/f.txt": 1,
+		},
+	}
+	var tests = []struct {
+		dir       string
+		recursive bool
+		expected  []string
+	}{
+		{"", false, []string{"a/", "m/", "z.txt"}},
+		{"a", false, []string{"b/", "d.txt"}},
+		{"a/b", false, []string{"c.txt", "e/"}},
+		{"a", true, []string{"b/c.txt", "b/e/f.txt", "d.txt"}},
+		{"", true, []string{"a/b/c.txt", "a/b/e/f.txt", "a/d.txt", "m/n.txt", "z.txt"}},
+		{"nothing", false, []string{}},
+		{"z.txt", false, []string{}},
+	}
+	for _, test := range tests {
+		entries := listSlots(item, ver, test.dir, test.recursive)
+		var names []string
+		for _, e := range entries {
+			if e.Dir {
+				e.Name += "/"
+			}
+			names = append(names, e.Name)
+		}
+		if len(names) != len(test.expected) {
+			t.Errorf("%q, %v: received %v, expected %v", test.dir, test.recursive, names, test.expected)
+			continue
+		}
+		for i := range names {
+			if names[i] != test.expected[i] {
+				t.Errorf("%q, %v: received %v, expected %v", test.dir, test.recursive, names, test.expected)
+				break
+			}
+		}
+	}
+	// directories have the newest modification time of their files
+	entries := listSlots(item, ver, "", false)
+	if !entries[0].Modified.Equal(late) || !entries[1].Modified.Equal(early) {
+		t.Errorf("Received %v", entries)
+	}
+}
+
+func TestListSlotsHandler(t *testing.T) {
+	file1 := path.Base(uploadstring(t, "POST", "/upload", "list file"))
+	itemid := "list" + randomid()
+	txpath := sendtransaction(t, "/item/"+itemid+"/transaction",
+		[][]string{{"add", file1},
+			{"slot", "dir/a.txt", file1},
+			{"slot", "b.txt", file1},
+			{"slotmeta", "b.txt", "mtime", "2016-11-17T10:00:00Z"}}, 202)
+	waitTransaction(t, txpath)
+
+	var listing apiv2.Listing
+	body := getbody(t, "GET", APIPrefix+"/item/"+itemid+"/@list", 200)
+	err := json.Unmarshal([]byte(body), &listing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listing.Item != itemid || listing.Version != 1 || len(listing.Entries) != 2 {
+		t.Fatalf("Received %s", body)
+	}
+	b, dir := listing.Entries[0], listing.Entries[1]
+	if b.Name != "b.txt" || b.Size != 9 || b.SHA256 == "" || b.Modified.Year() != 2016 {
+		t.Errorf("Received %+v", b)
+	}
+	if dir.Name != "dir" || !dir.Dir {
+		t.Errorf("Received %+v", dir)
+	}
+	body = getbody(t, "GET", "/item/"+itemid+"/@list/dir/", 200)
+	json.Unmarshal([]byte(body), &listing)
+	if listing.Path != "dir" || len(listing.Entries) != 1 || listing.Entries[0].Name != "a.txt" {
+		t.Errorf("Received %s", body)
+	}
+
+	checkStatus(t, "GET", "/item/"+itemid+"/@list/nothing", 404)
+	checkStatus(t, "GET", "/item/"+itemid+"/@list?version=1", 200)
+	checkStatus(t, "GET", "/item/"+itemid+"/@list?version=2", 404)
+	checkStatus(t, "GET", "/item/"+itemid+"/@list?version=x", 400)
+	checkStatus(t, "GET", "/item/nosuch"+randomid()+"/@list", 404)
+}
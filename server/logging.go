@@ -0,0 +1,24 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+)
+
+type loggerKey struct{}
+
+// requestLogger returns the logger for the request r. It carries the fields
+// added by logWrapper and authzWrapper, such as the method, path, and user.
+// If there is none, the default logger is returned.
+func requestLogger(r *http.Request) *slog.Logger {
+	if l, ok := r.Context().Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// withLogger returns a shallow copy of r whose logger is l.
+func withLogger(r *http.Request, l *slog.Logger) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), loggerKey{}, l))
+}
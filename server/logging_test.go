@@ -0,0 +1,45 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestRequestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+
+	s := &RESTServer{Validator: NobodyValidator{}}
+	handler := logWrapper(s.authzWrapper(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		buf.Reset()
+		requestLogger(r).Info("inside", "item", ps.ByName("id"))
+	}, RoleRead))
+
+	r := httptest.NewRequest("GET", "/item/abc", nil)
+	handler(httptest.NewRecorder(), r, httprouter.Params{{Key: "id", Value: "abc"}})
+
+	var entry map[string]interface{}
+	err := json.Unmarshal(buf.Bytes(), &entry)
+	if err != nil {
+		t.Fatal(err, buf.String())
+	}
+	var expected = map[string]string{
+		"msg":    "inside",
+		"method": "GET",
+		"path":   "/item/abc",
+		"user":   "nobody",
+		"item":   "abc",
+	}
+	for k, v := range expected {
+		if entry[k] != v {
+			t.Errorf("%s: received %v, expected %s", k, entry[k], v)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// A MaintenanceWindow is a period of time during which the server refuses
+// requests which would change anything. Reads are still served, as long as
+// they do not need the tape system.
+type MaintenanceWindow struct {
+	Start  time.Time
+	End    time.Time
+	Reason string
+}
+
+// maintenanceState holds the scheduled maintenance window, if any.
+type maintenanceState struct {
+	m      sync.RWMutex
+	window *MaintenanceWindow
+}
+
+// ScheduleMaintenance sets the maintenance window, replacing any previous
+// one. A zero Start time means the window begins now.
+func (s *RESTServer) ScheduleMaintenance(mw MaintenanceWindow) error {
+	if mw.Start.IsZero() {
+		mw.Start = time.Now()
+	}
+	if !mw.End.After(mw.Start) {
+		return fmt.Errorf("maintenance window ends before it starts")
+	}
+	slog.Info("Scheduling maintenance", "start", mw.Start, "end", mw.End, "reason", mw.Reason)
+	s.maintenance.m.Lock()
+	s.maintenance.window = &mw
+	s.maintenance.m.Unlock()
+	return nil
+}
+
+// CancelMaintenance removes any scheduled maintenance window.
+func (s *RESTServer) CancelMaintenance() {
+	slog.Info("Canceling maintenance")
+	s.maintenance.m.Lock()
+	s.maintenance.window = nil
+	s.maintenance.m.Unlock()
+}
+
+// activeMaintenance returns the maintenance window if we are currently in
+// it, and nil otherwise.
+func (s *RESTServer) activeMaintenance() *MaintenanceWindow {
+	s.maintenance.m.RLock()
+	defer s.maintenance.m.RUnlock()
+	mw := s.maintenance.window
+	if mw == nil {
+		return nil
+	}
+	now := time.Now()
+	if now.Before(mw.Start) || !now.Before(mw.End) {
+		return nil
+	}
+	return mw
+}
+
+// maintenanceStatus is returned by GET /admin/maintenance and in the
+// body of responses refused during maintenance.
+type maintenanceStatus struct {
+	Scheduled bool
+	Active    bool
+	Start     time.Time `json:",omitempty"`
+	End       time.Time `json:",omitempty"`
+	Reason    string    `json:",omitempty"`
+}
+
+func (s *RESTServer) maintenanceStatus() maintenanceStatus {
+	var result maintenanceStatus
+	s.maintenance.m.RLock()
+	mw := s.maintenance.window
+	s.maintenance.m.RUnlock()
+	if mw != nil {
+		result.Scheduled = true
+		result.Active = s.activeMaintenance() != nil
+		result.Start = mw.Start
+		result.End = mw.End
+		result.Reason = mw.Reason
+	}
+	return result
+}
+
+// writeMaintenance returns a 503 for a request refused because of the
+// maintenance window mw. The Retry-After header is set to the end of the
+// window.
+func writeMaintenance(w http.ResponseWriter, mw *MaintenanceWindow) {
+	seconds := int(time.Until(mw.End).Seconds()) + 1
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.Header().Set("X-Bendo-Maintenance", "true")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(maintenanceStatus{
+		Scheduled: true,
+		Active:    true,
+		Start:     mw.Start,
+		End:       mw.End,
+		Reason:    mw.Reason,
+	})
+}
+
+// maintenanceWrapper returns a handler which refuses requests that change
+// anything while a maintenance window is in effect. GET and HEAD requests,
+// and requests to the admin routes, are always passed through.
+func (s *RESTServer) maintenanceWrapper(handler httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		// batch requests only read blobs, so are treated like a GET
+		if r.Method == "GET" || r.Method == "HEAD" ||
+			strings.HasPrefix(strings.TrimPrefix(r.URL.Path, APIPrefix), "/admin/") ||
+			strings.HasSuffix(r.URL.Path, "/@batch") {
+			handler(w, r, ps)
+			return
+		}
+		if mw := s.activeMaintenance(); mw != nil {
+			requestLogger(r).Info("Refused during maintenance")
+			writeMaintenance(w, mw)
+			return
+		}
+		handler(w, r, ps)
+	}
+}
+
+// GetMaintenanceHandler handles requests to GET /admin/maintenance
+func (s *RESTServer) GetMaintenanceHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(s.maintenanceStatus())
+}
+
+// SetMaintenanceHandler handles requests to PUT /admin/maintenance. The
+// body is a JSON object with the fields of a MaintenanceWindow.
+func (s *RESTServer) SetMaintenanceHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var mw MaintenanceWindow
+	err := json.NewDecoder(r.Body).Decode(&mw)
+	if err == nil {
+		err = s.ScheduleMaintenance(mw)
+	}
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintln(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(201)
+	json.NewEncoder(w).Encode(s.maintenanceStatus())
+}
+
+// CancelMaintenanceHandler handles requests to DELETE /admin/maintenance
+func (s *RESTServer) CancelMaintenanceHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s.CancelMaintenance()
+	w.WriteHeader(204)
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMaintenance(t *testing.T) {
+	defer checkStatus(t, "DELETE", "/admin/maintenance", 204)
+
+	// a window in the future does not affect anything
+	start := time.Now().Add(time.Hour)
+	window := fmt.Sprintf(`{"Start": %q, "End": %q, "Reason": "later"}`,
+		start.Format(time.RFC3339), start.Add(time.Hour).Format(time.RFC3339))
+	uploadstringhash(t, "PUT", "/admin/maintenance", window, "", 201)
+	uploadstring(t, "POST", "/upload", "hello")
+
+	// a window ending before it starts is refused
+	window = fmt.Sprintf(`{"Start": %q, "End": %q}`,
+		start.Format(time.RFC3339), start.Add(-time.Hour).Format(time.RFC3339))
+	uploadstringhash(t, "PUT", "/admin/maintenance", window, "", 400)
+
+	// a window starting now
+	end := time.Now().Add(10 * time.Minute)
+	window = fmt.Sprintf(`{"End": %q, "Reason": "moving racks"}`, end.Format(time.RFC3339))
+	uploadstringhash(t, "PUT", "/admin/maintenance", window, "", 201)
+
+	var status maintenanceStatus
+	err := json.Unmarshal([]byte(getbody(t, "GET", "/admin/maintenance", 200)), &status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Active || status.Reason != "moving racks" {
+		t.Errorf("Received %#v", status)
+	}
+
+	// changes are refused on both API versions
+	for _, route := range []string{"/upload", APIPrefix + "/upload"} {
+		resp := checkRoute(t, "POST", route, 503)
+		if resp == nil {
+			continue
+		}
+		retry, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		if retry < 500 || retry > 601 {
+			t.Errorf("%s: Received Retry-After %d", route, retry)
+		}
+		status = maintenanceStatus{}
+		json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+		if status.Reason != "moving racks" {
+			t.Errorf("%s: Received %#v", route, status)
+		}
+	}
+	// reads still work
+	checkStatus(t, "GET", "/upload", 200)
+
+	checkStatus(t, "DELETE", "/admin/maintenance", 204)
+	err = json.Unmarshal([]byte(getbody(t, "GET", "/admin/maintenance", 200)), &status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Scheduled || status.Active {
+		t.Errorf("Received %#v after cancel", status)
+	}
+	uploadstring(t, "POST", "/upload", "hello")
+}
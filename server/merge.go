@@ -0,0 +1,61 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/ndlib/bendo/transaction"
+)
+
+// lockMerged opens a transaction on each item which tx merges and then
+// deletes, so the items cannot change between being merged and being
+// deleted. It returns an error, having opened nothing, if any of them
+// already has a transaction in progress.
+func (s *RESTServer) lockMerged(tx *transaction.Transaction) ([]*transaction.Transaction, error) {
+	var result []*transaction.Transaction
+	for _, id := range tx.MergeDeletes() {
+		tx2, err := s.TxStore.Create(id)
+		if err != nil {
+			finishAll(result, transaction.StatusFinished)
+			return nil, fmt.Errorf("merging %s: %w", id, err)
+		}
+		tx.M.RLock()
+		tx2.Creator = tx.Creator
+		tx.M.RUnlock()
+		result = append(result, tx2)
+	}
+	return result, nil
+}
+
+// deleteMerged deletes the items locked by lockMerged once tx has finished
+// successfully, and otherwise releases them. An error deleting an item is
+// added to tx, though the new version made by tx is kept.
+func (s *RESTServer) deleteMerged(tx *transaction.Transaction, merged []*transaction.Transaction, logger *slog.Logger) {
+	tx.M.RLock()
+	finished := tx.Status == transaction.StatusFinished
+	tx.M.RUnlock()
+	if !finished {
+		finishAll(merged, transaction.StatusFinished)
+		return
+	}
+	for _, tx2 := range merged {
+		logger := logger.With("merged", tx2.ItemID)
+		item, err := s.Items.Item(tx2.ItemID)
+		if err == nil {
+			logger.Info("deleting merged item")
+			err = s.deleteItem(tx2, item, logger)
+		} else {
+			tx2.SetStatus(transaction.StatusError)
+		}
+		if err != nil {
+			tx.AppendError(fmt.Sprintf("deleting merged item %s: %v", tx2.ItemID, err))
+		}
+	}
+}
+
+// finishAll sets the status of each of txs to status.
+func finishAll(txs []*transaction.Transaction, status transaction.Status) {
+	for _, tx := range txs {
+		tx.SetStatus(status)
+	}
+}
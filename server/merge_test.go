@@ -0,0 +1,48 @@
+package server
+
+import (
+	"net/http"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestMergeItem(t *testing.T) {
+	keep := "mergekeep" + randomid()
+	dup := "mergedup" + randomid()
+	file := uploadstring(t, "POST", "/upload", "kept")
+	txpath := sendtransaction(t, "/item/"+keep+"/transaction",
+		[][]string{{"add", path.Base(file)}, {"slot", "a", path.Base(file)}}, 202)
+	waitTransaction(t, txpath)
+	file = uploadstring(t, "POST", "/upload", "duplicate")
+	txpath = sendtransaction(t, "/item/"+dup+"/transaction",
+		[][]string{{"add", path.Base(file)}, {"slot", "a", path.Base(file)}}, 202)
+	waitTransaction(t, txpath)
+
+	sendtransaction(t, "/item/"+keep+"/transaction", [][]string{{"merge", dup, "x", "keep"}}, 400)
+	txpath = sendtransaction(t, "/item/"+keep+"/transaction", [][]string{{"merge", dup, "dup", "delete"}}, 202)
+	waitTransaction(t, txpath)
+	if body := getbody(t, "GET", "/item/"+keep+"/dup/a", 200); body != "duplicate" {
+		t.Errorf("Received %q", body)
+	}
+	if body := getbody(t, "GET", "/item/"+keep+"/a", 200); body != "kept" {
+		t.Errorf("Received %q", body)
+	}
+	// the merged item is deleted after the transaction finishes
+	var status int
+	for i := 0; i < 10; i++ {
+		resp, err := http.Get(testServer.URL + "/item/" + dup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		status = resp.StatusCode
+		if status != 200 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status != 404 && status != 410 {
+		t.Errorf("Merged item %s received status %d, expected it deleted", dup, status)
+	}
+}
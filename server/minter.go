@@ -0,0 +1,200 @@
+package server
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/ndlib/bendo/items"
+)
+
+// A Minter makes new item identifiers. Each call to Mint should return an id
+// the minter has not returned before. Minters do not need to know which ids
+// are in use, since the server will discard any minted id that names an
+// existing item, or that was minted before if the server has a MintDB.
+type Minter interface {
+	Mint() (string, error)
+}
+
+// A MintDB remembers the item ids which have been minted, so an id is handed
+// out only once, even to requests made at the same time or after a restart.
+type MintDB interface {
+	// ReserveID records that id was minted. It returns false, and records
+	// nothing, if id was minted before.
+	ReserveID(id string, when time.Time) (bool, error)
+
+	// NextSequence increments the named counter and returns its new
+	// value. A counter which does not exist yet starts at first.
+	NextSequence(name string, first int64) (int64, error)
+}
+
+// SequentialMinter mints ids by appending an increasing number to Prefix.
+// The first id minted uses the value of Next. If DB is not nil, the number
+// is kept there in a counter named by Prefix, so the sequence continues
+// after a restart and is shared by every server using the database.
+type SequentialMinter struct {
+	Prefix string
+	Next   int64
+	DB     MintDB
+
+	m sync.Mutex
+}
+
+// Mint returns the next id in sequence.
+func (sm *SequentialMinter) Mint() (string, error) {
+	if sm.DB != nil {
+		n, err := sm.DB.NextSequence("minter:"+sm.Prefix, sm.Next)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s%d", sm.Prefix, n), nil
+	}
+	sm.m.Lock()
+	n := sm.Next
+	sm.Next++
+	sm.m.Unlock()
+	return fmt.Sprintf("%s%d", sm.Prefix, n), nil
+}
+
+// UUIDMinter mints random (version 4) UUIDs, with Prefix prepended.
+type UUIDMinter struct {
+	Prefix string
+}
+
+// Mint returns a new random UUID.
+func (um UUIDMinter) Mint() (string, error) {
+	var u [16]byte
+	_, err := rand.Read(u[:])
+	if err != nil {
+		return "", err
+	}
+	u[6] = (u[6] & 0x0f) | 0x40 // version 4
+	u[8] = (u[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%s%x-%x-%x-%x-%x", um.Prefix, u[0:4], u[4:6], u[6:8], u[8:10], u[10:]), nil
+}
+
+// NoidMinter mints random NOID-style ids suitable for use in ARKs. Each id is
+// Prefix followed by Length characters drawn from the NOID "betanumeric"
+// alphabet and a final check character computed over the entire id. Prefix
+// would typically be a shoulder, e.g. "t". Since the id is used in item URLs
+// the prefix should not contain a slash. If Length is 0, a length of 8 is used.
+type NoidMinter struct {
+	Prefix string
+	Length int
+}
+
+// the NOID betanumeric alphabet: digits and consonants, omitting "l".
+const noidAlphabet = "0123456789bcdfghjkmnpqrstvwxz"
+
+// Mint returns a new random NOID.
+func (nm NoidMinter) Mint() (string, error) {
+	length := nm.Length
+	if length <= 0 {
+		length = 8
+	}
+	max := big.NewInt(int64(len(noidAlphabet)))
+	id := []byte(nm.Prefix)
+	for i := 0; i < length; i++ {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		id = append(id, noidAlphabet[n.Int64()])
+	}
+	id = append(id, NoidCheckChar(string(id)))
+	return string(id), nil
+}
+
+// NoidCheckChar returns the NOID check character for the given string.
+// Characters not in the betanumeric alphabet count as zero.
+func NoidCheckChar(s string) byte {
+	var sum int
+	for i := 0; i < len(s); i++ {
+		ord := strings.IndexByte(noidAlphabet, s[i])
+		if ord > 0 {
+			sum += (i + 1) * ord
+		}
+	}
+	return noidAlphabet[sum%len(noidAlphabet)]
+}
+
+// NewMinter returns a minter of the given kind, which is one of "sequential",
+// "uuid", or "noid". The prefix is prepended to every id minted.
+func NewMinter(kind string, prefix string) (Minter, error) {
+	switch kind {
+	case "sequential":
+		return &SequentialMinter{Prefix: prefix, Next: 1}, nil
+	case "uuid":
+		return UUIDMinter{Prefix: prefix}, nil
+	case "noid":
+		return NoidMinter{Prefix: prefix}, nil
+	}
+	return nil, fmt.Errorf("unknown minter %q", kind)
+}
+
+// the number of ids to try minting before giving up on finding one not in use
+const maxMintAttempts = 100
+
+// ErrMintExhausted means the minter kept returning ids that were in use.
+var ErrMintExhausted = errors.New("could not mint an unused item id")
+
+// mintItemID returns a minted id that does not name an existing item. If
+// there is a MintDB the id is reserved in it, so it is not returned again.
+func (s *RESTServer) mintItemID() (string, error) {
+	for i := 0; i < maxMintAttempts; i++ {
+		id, err := s.Minter.Mint()
+		if err != nil {
+			return "", err
+		}
+		_, err = s.Items.Item(id)
+		if err == nil {
+			continue
+		} else if err != items.ErrNoItem {
+			return "", err
+		}
+		if s.Mints == nil {
+			return id, nil
+		}
+		ok, err := s.Mints.ReserveID(id, time.Now())
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return id, nil
+		}
+	}
+	return "", ErrMintExhausted
+}
+
+// MintItemHandler handles requests to POST /items
+// It mints a new item id and returns it in the response body. The item is
+// created by starting a transaction on the returned id.
+func (s *RESTServer) MintItemHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.Minter == nil {
+		NotImplementedHandler(w, r, ps)
+		return
+	}
+	id, err := s.mintItemID()
+	if err == items.ErrNoStore {
+		w.WriteHeader(503)
+		fmt.Fprintln(w, err)
+		return
+	} else if err != nil {
+		requestLogger(r).Error("MintItem", "error", err)
+		raven.CaptureError(err, nil)
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err)
+		return
+	}
+	w.Header().Set("Location", apiPath(r, "/item/"+id))
+	w.WriteHeader(201)
+	fmt.Fprint(w, id)
+}
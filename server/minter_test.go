@@ -0,0 +1,128 @@
+package server
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ndlib/bendo/items"
+	"github.com/ndlib/bendo/store"
+)
+
+func TestNoidMinter(t *testing.T) {
+	m := NoidMinter{Prefix: "t", Length: 6}
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id, err := m.Mint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(id) != 8 || !strings.HasPrefix(id, "t") {
+			t.Errorf("Received %q, expected t + 7 characters", id)
+		}
+		if NoidCheckChar(id[:len(id)-1]) != id[len(id)-1] {
+			t.Errorf("Received %q, check character does not match", id)
+		}
+		if seen[id] {
+			t.Errorf("Received %q twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestNoidCheckChar(t *testing.T) {
+	// example from the NOID documentation
+	c := NoidCheckChar("13030/xf93gt2")
+	if c != 'q' {
+		t.Errorf("Received %c, expected q", c)
+	}
+}
+
+func TestUUIDMinter(t *testing.T) {
+	id, err := UUIDMinter{}.Mint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(id) != 36 || id[14] != '4' {
+		t.Errorf("Received %q, expected a version 4 uuid", id)
+	}
+}
+
+func TestMintItemRoute(t *testing.T) {
+	id := getbody(t, "POST", "/items", 201)
+	if !strings.HasPrefix(id, "minted") {
+		t.Fatalf("Received %q, expected minted id", id)
+	}
+	t.Log("minted", id)
+	file1 := uploadstring(t, "POST", "/upload", "hello minter")
+	txpath := sendtransaction(t, "/item/"+id+"/transaction",
+		[][]string{{"add", path.Base(file1)}}, 202)
+	waitTransaction(t, txpath)
+
+	id2 := getbody(t, "POST", "/items", 201)
+	if id2 == id {
+		t.Errorf("Received %q twice", id)
+	}
+}
+
+// fixedMinter always mints the same id.
+type fixedMinter string
+
+func (f fixedMinter) Mint() (string, error) { return string(f), nil }
+
+func TestMintConcurrent(t *testing.T) {
+	db, err := NewQlCache("mem--mint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &RESTServer{
+		Items:  items.New(store.NewMemory()),
+		Minter: &SequentialMinter{Prefix: "seq", Next: 1, DB: db},
+		Mints:  db,
+	}
+	mint := func(n int) []string {
+		var m sync.Mutex
+		var wg sync.WaitGroup
+		var ids []string
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				id, err := s.mintItemID()
+				m.Lock()
+				defer m.Unlock()
+				if err == nil {
+					ids = append(ids, id)
+				} else if err != ErrMintExhausted {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+		return ids
+	}
+	seen := make(map[string]bool)
+	for _, id := range mint(20) {
+		if seen[id] {
+			t.Errorf("Received %q twice", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != 20 {
+		t.Errorf("Received %d ids, expected 20", len(seen))
+	}
+
+	// a restarted minter carries on from where the last one stopped
+	s.Minter = &SequentialMinter{Prefix: "seq", Next: 1, DB: db}
+	id, err := s.mintItemID()
+	if err != nil || id != "seq21" {
+		t.Errorf("Received %q, %v, expected seq21", id, err)
+	}
+
+	// only one request is given an id, even if the minter repeats itself
+	s.Minter = fixedMinter("same")
+	if ids := mint(10); len(ids) != 1 {
+		t.Errorf("Received %v, expected one id", ids)
+	}
+}
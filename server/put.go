@@ -0,0 +1,251 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/ndlib/bendo/fragment"
+	"github.com/ndlib/bendo/transaction"
+	"github.com/ndlib/bendo/util"
+)
+
+// DefaultPutWait is how long a PUT to a slot waits for its transaction to
+// finish before returning 202 Accepted.
+const DefaultPutWait = 60 * time.Second
+
+// PutSlotHandler handles requests to PUT /item/:id/*slot
+// It saves the request body as the given slot of the item in a single
+// request, making a new version. It is meant for small files; larger ones
+// should be uploaded in pieces and added with a transaction. The body is
+// kept as an upload and a transaction adding it is started, the same as if
+// the client had done both, and the response waits for the transaction to
+// finish. The optional parameter "mtime" gives the file's modification time
+// in RFC 3339 format, which is saved as slot metadata. If the request has
+// the header "Prefer: respond-async", or the transaction does not finish
+// within DefaultPutWait, a 202 is returned with the transaction's location.
+func (s *RESTServer) PutSlotHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := ps.ByName("id")
+	// the star parameter in httprouter returns the leading slash
+	slot := strings.TrimPrefix(ps.ByName("slot"), "/")
+	if slot == "" || slot[0] == '@' || strings.HasSuffix(slot, "/") {
+		w.WriteHeader(400)
+		fmt.Fprintln(w, "slot names must not be empty, begin with @, or end with /")
+		return
+	}
+	var mtime string
+	if v := r.FormValue("mtime"); v != "" {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintln(w, "mtime must be in RFC 3339 format")
+			return
+		}
+		mtime = t.UTC().Format(time.RFC3339Nano)
+	}
+	user := ps.ByName("username")
+	if s.SmallTxBytes > 0 {
+		if r.ContentLength > s.SmallTxBytes {
+			writePutTooLarge(w, s.SmallTxBytes)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, s.SmallTxBytes)
+	}
+	if s.overQuota(user, r.ContentLength) {
+		writeOverQuota(w)
+		return
+	}
+	if msg := s.checkTransfer(r, user, UsageToken, r.ContentLength); msg != "" {
+		writeQuotaExceeded(w, r, msg)
+		return
+	}
+	f, err := s.saveUpload(r, user)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			writePutTooLarge(w, s.SmallTxBytes)
+		case errors.Is(err, fragment.ErrQuota):
+			writeOverQuota(w)
+		case err == errChecksumMismatch:
+			w.WriteHeader(412)
+			fmt.Fprintln(w, err)
+		default:
+			w.WriteHeader(500)
+			fmt.Fprintln(w, err)
+		}
+		return
+	}
+	fid := f.Stat().ID
+	cmds := [][]string{{"add", fid}, {"slot", slot, fid}}
+	if mtime != "" {
+		cmds = append(cmds, []string{"slotmeta", slot, "mtime", mtime})
+	}
+	tx, err := s.TxStore.Create(id)
+	if err != nil {
+		// there is probably already a transaction open on the item
+		s.FileStore.Delete(fid)
+		w.WriteHeader(409)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+	tx.Creator = user
+	err = tx.AddCommandList(cmds)
+	if err != nil {
+		tx.SetStatus(transaction.StatusError)
+		w.WriteHeader(400)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+	err = s.checkTxLimits(tx)
+	if err != nil {
+		tx.AppendError(err.Error())
+		tx.SetStatus(transaction.StatusError)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+	location := apiPath(r, "/transaction/"+tx.ID)
+	done := s.txwaiters.add(tx.ID)
+	tx.SetStatus(transaction.StatusWaiting)
+	lane := s.enqueueTx(tx)
+	requestLogger(r).Info("Queued transaction", "tx", tx.ID, "item", id, "lane", lane, "slot", slot)
+	if preferAsync(r) {
+		w.Header().Set("Location", location)
+		w.Header().Set("Preference-Applied", "respond-async")
+		w.WriteHeader(202)
+		return
+	}
+	select {
+	case <-done:
+	case <-time.After(DefaultPutWait):
+		w.Header().Set("Location", location)
+		w.WriteHeader(202)
+		return
+	}
+	tx.M.RLock()
+	status, txerrs := tx.Status, append([]string(nil), tx.Err...)
+	tx.M.RUnlock()
+	if status != transaction.StatusFinished {
+		w.Header().Set("Location", location)
+		w.WriteHeader(500)
+		fmt.Fprintln(w, strings.Join(txerrs, "\n"))
+		return
+	}
+	item, err := s.Items.Item(id)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err)
+		return
+	}
+	ver := item.FindVersion(0)
+	entries := listSlots(item, ver, "", true)
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].Name >= slot })
+	w.Header().Set("Location", slotURL(r, id, slot))
+	if i == len(entries) || entries[i].Name != slot {
+		// another transaction has already changed the slot
+		w.WriteHeader(201)
+		return
+	}
+	w.Header().Set("X-Content-Sha256", entries[i].SHA256)
+	w.Header().Set("X-Content-Md5", entries[i].MD5)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(201)
+	writeJSON(w, entries[i])
+}
+
+// errChecksumMismatch is returned by saveUpload if the request body does not
+// have the checksum given in its headers.
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// saveUpload saves the body of r as a new upload made by user. The body is
+// checked against any checksums given in the headers, and the computed
+// checksums are recorded so the transaction adding the file verifies it.
+// The mime type is taken from the Content-Type header, if any. Nothing is
+// kept if there is an error.
+func (s *RESTServer) saveUpload(r *http.Request, user string) (fragment.FileEntry, error) {
+	uploadMD5, uploadSHA256 := uploadChecksums(r)
+	var f fragment.FileEntry
+	for f == nil {
+		f = s.FileStore.New(randomid())
+	}
+	fid := f.Stat().ID
+	f.SetCreator(user)
+	wr, err := f.Append()
+	if err != nil {
+		s.FileStore.Delete(fid)
+		return nil, err
+	}
+	hw := util.NewHashWriter(wr)
+	n, err := io.Copy(hw, r.Body)
+	s.recordUpload(user, n)
+	err2 := wr.Close()
+	if err == nil {
+		err = err2
+	}
+	md5sum, ok := hw.CheckMD5(uploadMD5)
+	sha256sum, ok2 := hw.CheckSHA256(uploadSHA256)
+	if err == nil && !(ok && ok2) {
+		err = errChecksumMismatch
+	}
+	if err != nil {
+		s.FileStore.Delete(fid)
+		return nil, err
+	}
+	f.SetMD5(md5sum)
+	f.SetSHA256(sha256sum)
+	if v := r.Header.Get("Content-Type"); v != "" {
+		f.SetMimeType(v)
+	}
+	return f, nil
+}
+
+// writePutTooLarge sends the response to a PUT whose body is larger than
+// the limit.
+func writePutTooLarge(w http.ResponseWriter, limit int64) {
+	w.Header().Set("X-Max-Put-Bytes", strconv.FormatInt(limit, 10))
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	fmt.Fprintln(w, "file is too large to PUT, upload it instead")
+}
+
+// txWaiters lets requests wait for the transactions they started to be
+// processed.
+type txWaiters struct {
+	m       sync.Mutex
+	waiting map[string]chan struct{} // indexed by transaction id
+}
+
+// add returns a channel which is closed once the transaction txid has been
+// processed, whether or not it succeeded.
+func (tw *txWaiters) add(txid string) <-chan struct{} {
+	tw.m.Lock()
+	defer tw.m.Unlock()
+	if tw.waiting == nil {
+		tw.waiting = make(map[string]chan struct{})
+	}
+	c, ok := tw.waiting[txid]
+	if !ok {
+		c = make(chan struct{})
+		tw.waiting[txid] = c
+	}
+	return c
+}
+
+// done closes the channel for the transaction txid, if anything is waiting
+// for it.
+func (tw *txWaiters) done(txid string) {
+	tw.m.Lock()
+	defer tw.m.Unlock()
+	if c, ok := tw.waiting[txid]; ok {
+		close(c)
+		delete(tw.waiting, txid)
+	}
+}
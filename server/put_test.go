@@ -0,0 +1,83 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/ndlib/bendo/apiv2"
+)
+
+func TestPutSlot(t *testing.T) {
+	itemid := "put" + randomid()
+	resp := putslot(t, "/item/"+itemid+"/dir/a.txt?mtime=2016-11-17T10:00:00Z", "put content", nil, 201)
+	var e apiv2.Entry
+	err := json.NewDecoder(resp.Body).Decode(&e)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Name != "dir/a.txt" || e.Size != 11 || e.Modified.Year() != 2016 {
+		t.Errorf("Received %+v", e)
+	}
+	if v := resp.Header.Get("X-Content-Sha256"); v == "" || v != e.SHA256 {
+		t.Errorf("Received X-Content-Sha256 %q, expected %q", v, e.SHA256)
+	}
+	text := getbody(t, "GET", "/item/"+itemid+"/dir/a.txt", 200)
+	if text != "put content" {
+		t.Errorf("Received %q, expected %q", text, "put content")
+	}
+
+	// replacing the file makes a new version
+	putslot(t, "/item/"+itemid+"/dir/a.txt", "new content", nil, 201).Body.Close()
+	text = getbody(t, "GET", "/item/"+itemid+"/dir/a.txt", 200)
+	if text != "new content" {
+		t.Errorf("Received %q, expected %q", text, "new content")
+	}
+	text = getbody(t, "GET", "/item/"+itemid+"/dir/a.txt?version=1", 200)
+	if text != "put content" {
+		t.Errorf("Received %q, expected %q", text, "put content")
+	}
+
+	// a checksum may be given
+	md5sum := map[string]string{"X-Upload-Md5": "5eb63bbbe01eeed093cb22bb8f5acdc3"}
+	putslot(t, "/item/"+itemid+"/b.txt", "hello world", md5sum, 201).Body.Close()
+	putslot(t, "/item/"+itemid+"/c.txt", "goodbye world", md5sum, 412).Body.Close()
+
+	putslot(t, "/item/"+itemid+"/@blob/1", "x", nil, 400).Body.Close()
+	putslot(t, "/item/"+itemid+"/dir/", "x", nil, 400).Body.Close()
+	putslot(t, "/item/"+itemid+"/d.txt?mtime=yesterday", "x", nil, 400).Body.Close()
+
+	// an asynchronous PUT returns the transaction
+	resp = putslot(t, "/item/"+itemid+"/e.txt", "later", map[string]string{"Prefer": "respond-async"}, 202)
+	resp.Body.Close()
+	txpath := resp.Header.Get("Location")
+	if !strings.HasPrefix(txpath, "/transaction/") {
+		t.Fatalf("Received location %q", txpath)
+	}
+	waitTransaction(t, txpath)
+	checkStatus(t, "GET", "/item/"+itemid+"/e.txt", 200)
+}
+
+// putslot sends a PUT request with the given body and headers, and checks
+// the response has the given status. The caller should close the body of
+// the response.
+func putslot(t *testing.T, route, body string, headers map[string]string, status int) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest("PUT", testServer.URL+route, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != status {
+		t.Errorf("%s: Received status %d, expected %d", route, resp.StatusCode, status)
+	}
+	return resp
+}
@@ -0,0 +1,24 @@
+package server
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+)
+
+// TestPythonClient runs the contract tests of the Python client in
+// clients/python against the test server, so a change to the API which
+// would break the client is caught here.
+func TestPythonClient(t *testing.T) {
+	python, err := exec.LookPath("python3")
+	if err != nil {
+		t.Skip("python3 is not installed")
+	}
+	cmd := exec.Command(python, "-m", "unittest", "-v", "test_bendo")
+	cmd.Dir = "../clients/python"
+	cmd.Env = append(os.Environ(), "BENDO_URL="+testServer.URL)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Errorf("%s\n%s", err, out)
+	}
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+	"github.com/julienschmidt/httprouter"
+)
+
+// A TransferQuota bounds how many bytes a single API key may upload and
+// download over a period of days. Zero fields mean no limit.
+type TransferQuota struct {
+	// Upload is the most bytes which may be uploaded in the period.
+	Upload int64
+
+	// Download is the most bytes of blob content which may be downloaded
+	// in the period.
+	Download int64
+
+	// Days is the length of the period, counting today. If it is zero,
+	// 30 days are used.
+	Days int
+}
+
+// defaultQuotaDays is the quota period used when none is given.
+const defaultQuotaDays = 30
+
+// transferQuotaFor returns the transfer quota for the given user.
+func (s *RESTServer) transferQuotaFor(user string) TransferQuota {
+	q, ok := s.TransferQuotas[user]
+	if !ok {
+		q = s.TransferQuotas[RateLimitDefault]
+	}
+	if q.Days <= 0 {
+		q.Days = defaultQuotaDays
+	}
+	return q
+}
+
+// quotaSince returns the first day counted in a period of the given
+// number of days ending today.
+func quotaSince(now time.Time, days int) time.Time {
+	return usageDay(now).AddDate(0, 0, -(days - 1))
+}
+
+// checkTransfer returns a message explaining why the given user may not
+// transfer n more bytes of the given kind, either UsageToken for uploads or
+// UsageDownload for downloads, or "" if they may. A negative n means the size
+// is not known, in which case it is only checked whether they are already at
+// their quota. Quotas are not enforced for anonymous users, when usage is
+// not tracked, or if the usage cannot be read.
+func (s *RESTServer) checkTransfer(r *http.Request, user string, kind string, n int64) string {
+	if user == "" || s.Usage == nil {
+		return ""
+	}
+	q := s.transferQuotaFor(user)
+	limit, what := q.Upload, "Upload"
+	if kind == UsageDownload {
+		limit, what = q.Download, "Download"
+	}
+	if limit <= 0 {
+		return ""
+	}
+	used, err := s.Usage.UserUsage(kind, user, quotaSince(time.Now(), q.Days))
+	if err != nil {
+		requestLogger(r).Error("UserUsage", "error", err)
+		raven.CaptureError(err, nil)
+		return ""
+	}
+	if n < 0 {
+		n = 0
+	}
+	if used < limit && used+n <= limit {
+		return ""
+	}
+	return fmt.Sprintf("%s quota exceeded: %d of %d bytes used in the last %d days, and this request needs %d more. See /usage for details.",
+		what, used, limit, q.Days, n)
+}
+
+// writeQuotaExceeded sends a 403 response for a transfer over the user's
+// quota.
+func writeQuotaExceeded(w http.ResponseWriter, r *http.Request, msg string) {
+	requestLogger(r).Warn("transfer quota exceeded", "message", msg)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprintln(w, msg)
+}
+
+// countingWriter counts the bytes written to a response. It passes ReadFrom
+// through, so copies from files can still be done by the kernel.
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+func (cw *countingWriter) ReadFrom(src io.Reader) (int64, error) {
+	n, err := io.Copy(cw.ResponseWriter, src)
+	cw.n += n
+	return n, err
+}
+
+// A TokenUsage reports the bytes a user has transferred over a number of
+// days, and how much of their quota remains.
+type TokenUsage struct {
+	User          string
+	Since         time.Time // the first day included
+	Days          int
+	Uploaded      int64
+	Downloaded    int64
+	UploadQuota   int64 // 0 for no limit
+	DownloadQuota int64 // 0 for no limit
+}
+
+// TokenUsageHandler handles requests to GET /usage
+// It reports the usage of the caller. The optional parameter "days" sets
+// how many days to include, counting today. It defaults to the period of
+// the caller's quota.
+func (s *RESTServer) TokenUsageHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.Usage == nil {
+		NotImplementedHandler(w, r, ps)
+		return
+	}
+	user := ps.ByName("username")
+	q := s.transferQuotaFor(user)
+	days, err := strconv.Atoi(r.FormValue("days"))
+	if err != nil || days <= 0 {
+		days = q.Days
+	}
+	result := TokenUsage{
+		User:          user,
+		Since:         quotaSince(time.Now(), days),
+		Days:          days,
+		UploadQuota:   q.Upload,
+		DownloadQuota: q.Download,
+	}
+	result.Uploaded, err = s.Usage.UserUsage(UsageToken, user, result.Since)
+	if err == nil {
+		result.Downloaded, err = s.Usage.UserUsage(UsageDownload, user, result.Since)
+	}
+	if err != nil {
+		requestLogger(r).Error("UserUsage", "error", err)
+		raven.CaptureError(err, nil)
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err)
+		return
+	}
+	writeHTMLorJSON(w, r, tokenUsageTemplate, result)
+}
+
+var (
+	tokenUsageTemplate = template.Must(template.New("tokenusage").Parse(`<html>
+<h1>Usage for {{ .User }}</h1>
+<dl>
+<dt>Since</dt><dd>{{ .Since.Format "2006-01-02" }} ({{ .Days }} days)</dd>
+<dt>Uploaded</dt><dd>{{ .Uploaded }}{{ if .UploadQuota }} of {{ .UploadQuota }}{{ end }} bytes</dd>
+<dt>Downloaded</dt><dd>{{ .Downloaded }}{{ if .DownloadQuota }} of {{ .DownloadQuota }}{{ end }} bytes</dd>
+</dl>
+</html>`))
+)
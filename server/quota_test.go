@@ -0,0 +1,115 @@
+package server
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/ndlib/bendo/fragment"
+	"github.com/ndlib/bendo/store"
+)
+
+func TestTransferQuota(t *testing.T) {
+	db, err := NewQlCache("mem--transferquota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.db.Close()
+	s := &RESTServer{
+		FileStore: fragment.New(store.NewMemory()),
+		Usage:     db,
+		TransferQuotas: map[string]TransferQuota{
+			RateLimitDefault: {Upload: 10, Download: 20},
+			"bob":            {},
+		},
+	}
+	// usage from before the period does not count
+	db.RecordUsage(UsageDownload, "alice", time.Now().AddDate(0, 0, -30), 100)
+	db.RecordUsage(UsageDownload, "alice", time.Now(), 15)
+
+	upload := func(user, fileid, content string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/upload/"+fileid, strings.NewReader(content))
+		h := md5.Sum([]byte(content))
+		r.Header.Set("X-Upload-Md5", hex.EncodeToString(h[:]))
+		s.AppendFileHandler(w, r, httprouter.Params{
+			{Key: "fileid", Value: fileid},
+			{Key: "username", Value: user},
+		})
+		return w.Code
+	}
+	var tests = []struct {
+		user    string
+		fileid  string
+		content string
+		status  int
+	}{
+		{"alice", "a1", "123456", 200},
+		{"alice", "a2", "123456", 403}, // would be over quota
+		{"alice", "a2", "1234", 200},
+		{"alice", "a3", "1", 403},          // at quota
+		{"bob", "b1", "123456789012", 200}, // no limit
+	}
+	for _, tab := range tests {
+		status := upload(tab.user, tab.fileid, tab.content)
+		if status != tab.status {
+			t.Errorf("%s uploading %q: received %d, expected %d", tab.user, tab.content, status, tab.status)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/item/x/y", nil)
+	if msg := s.checkTransfer(r, "alice", UsageDownload, 5); msg != "" {
+		t.Errorf("Received %q", msg)
+	}
+	msg := s.checkTransfer(r, "alice", UsageDownload, 6)
+	if !strings.HasPrefix(msg, "Download quota exceeded: 15 of 20 bytes") {
+		t.Errorf("Received %q", msg)
+	}
+	// anonymous users are not limited
+	if msg := s.checkTransfer(r, "", UsageDownload, 100); msg != "" {
+		t.Errorf("Received %q", msg)
+	}
+
+	w := httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/usage", nil)
+	r.Header.Set("Accept-Encoding", "application/json")
+	s.TokenUsageHandler(w, r, httprouter.Params{{Key: "username", Value: "alice"}})
+	var usage TokenUsage
+	err = json.NewDecoder(w.Body).Decode(&usage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.User != "alice" || usage.Days != 30 || usage.Uploaded != 10 || usage.Downloaded != 15 ||
+		usage.UploadQuota != 10 || usage.DownloadQuota != 20 {
+		t.Errorf("Received %#v", usage)
+	}
+}
+
+func TestDownloadUsage(t *testing.T) {
+	const content = "hello downloads"
+	file := uploadstring(t, "POST", "/upload", content)
+	itemid := "download" + randomid()
+	txpath := sendtransaction(t, "/item/"+itemid+"/transaction", [][]string{{"add", path.Base(file)}}, 202)
+	waitTransaction(t, txpath)
+
+	var before, after TokenUsage
+	err := json.Unmarshal([]byte(getbody(t, "GET", "/usage", 200)), &before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getbody(t, "GET", "/item/"+itemid+"/@blob/1", 200)
+	err = json.Unmarshal([]byte(getbody(t, "GET", "/usage", 200)), &after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Downloaded-before.Downloaded != int64(len(content)) {
+		t.Errorf("Received %d then %d, expected a difference of %d", before.Downloaded, after.Downloaded, len(content))
+	}
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"expvar"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// A RateLimit bounds how hard a single API key may use the server. Zero
+// fields mean no limit.
+type RateLimit struct {
+	// Rate is the number of requests per second allowed over time.
+	Rate float64
+
+	// Burst is how many requests may be made at once before Rate applies.
+	// If it is zero, one second worth of requests is allowed.
+	Burst int
+
+	// Recalls is how many requests for content not in the cache, which
+	// must be read from tape, may be in progress at once.
+	Recalls int
+}
+
+// recallRetry is how long a client over its recall limit is asked to wait.
+const recallRetry = 30 * time.Second
+
+// RateLimitDefault is the key in RESTServer.RateLimits,
+// RESTServer.UploadQuotas, and RESTServer.TransferQuotas giving the limit
+// for users not otherwise listed.
+const RateLimitDefault = "*"
+
+var (
+	xRateLimited   = expvar.NewInt("ratelimit.requests")
+	xRecallLimited = expvar.NewInt("ratelimit.recalls")
+)
+
+// rateLimiter tracks the requests and tape recalls made by each user.
+type rateLimiter struct {
+	m       sync.Mutex
+	buckets map[string]*tokenBucket
+	recalls map[string]int // number of recalls in progress
+}
+
+// a tokenBucket allows up to burst requests at once, refilling at rate
+// tokens per second.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limitFor returns the rate limit for the given user.
+func (s *RESTServer) limitFor(user string) RateLimit {
+	if l, ok := s.RateLimits[user]; ok {
+		return l
+	}
+	return s.RateLimits[RateLimitDefault]
+}
+
+// allowRequest returns true if user may make another request now. If not,
+// it also returns how long until the next request will be allowed.
+func (s *RESTServer) allowRequest(user string, now time.Time) (bool, time.Duration) {
+	limit := s.limitFor(user)
+	if limit.Rate <= 0 {
+		return true, 0
+	}
+	burst := float64(limit.Burst)
+	if burst <= 0 {
+		burst = math.Max(1, limit.Rate)
+	}
+	rl := &s.ratelimits
+	rl.m.Lock()
+	defer rl.m.Unlock()
+	if rl.buckets == nil {
+		rl.buckets = make(map[string]*tokenBucket)
+	}
+	b := rl.buckets[user]
+	if b == nil {
+		b = &tokenBucket{tokens: burst, last: now}
+		rl.buckets[user] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+	return false, wait
+}
+
+// acquireRecall reserves one of user's tape recalls. If the user is at
+// their limit it returns false. Otherwise the returned function must be
+// called once the recall is finished.
+func (s *RESTServer) acquireRecall(user string) (func(), bool) {
+	limit := s.limitFor(user)
+	if limit.Recalls <= 0 {
+		return func() {}, true
+	}
+	rl := &s.ratelimits
+	rl.m.Lock()
+	defer rl.m.Unlock()
+	if rl.recalls == nil {
+		rl.recalls = make(map[string]int)
+	}
+	if rl.recalls[user] >= limit.Recalls {
+		return nil, false
+	}
+	rl.recalls[user]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			rl.m.Lock()
+			rl.recalls[user]--
+			rl.m.Unlock()
+		})
+	}, true
+}
+
+// rateLimitWrapper refuses requests from users making them faster than
+// their rate limit allows. It needs to be inside the authzWrapper, so the
+// user is known.
+func (s *RESTServer) rateLimitWrapper(handler httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		user := ps.ByName("username")
+		ok, wait := s.allowRequest(user, time.Now())
+		if !ok {
+			xRateLimited.Add(1)
+			requestLogger(r).Warn("rate limited", "retry", wait)
+			writeTooManyRequests(w, wait, "Too many requests")
+			return
+		}
+		handler(w, r, ps)
+	}
+}
+
+// writeTooManyRequests sends a 429 response asking the client to wait
+// before trying again.
+func writeTooManyRequests(w http.ResponseWriter, wait time.Duration, msg string) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.WriteHeader(http.StatusTooManyRequests)
+	fmt.Fprintln(w, msg)
+}
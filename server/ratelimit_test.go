@@ -0,0 +1,91 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAllowRequest(t *testing.T) {
+	s := &RESTServer{
+		RateLimits: map[string]RateLimit{
+			"harvester":      {Rate: 1, Burst: 2},
+			RateLimitDefault: {Rate: 100},
+		},
+	}
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if ok, _ := s.allowRequest("harvester", now); !ok {
+			t.Fatalf("request %d refused", i)
+		}
+	}
+	ok, wait := s.allowRequest("harvester", now)
+	if ok || wait <= 0 || wait > time.Second {
+		t.Errorf("Received %v, %v", ok, wait)
+	}
+	// other users are not affected
+	if ok, _ := s.allowRequest("loader", now); !ok {
+		t.Errorf("loader refused")
+	}
+	now = now.Add(time.Second)
+	if ok, _ := s.allowRequest("harvester", now); !ok {
+		t.Errorf("harvester refused after waiting")
+	}
+	// no limit
+	s.RateLimits = nil
+	for i := 0; i < 1000; i++ {
+		if ok, _ := s.allowRequest("harvester", now); !ok {
+			t.Fatalf("request %d refused with no limit", i)
+		}
+	}
+}
+
+func TestAcquireRecall(t *testing.T) {
+	s := &RESTServer{
+		RateLimits: map[string]RateLimit{"harvester": {Recalls: 1}},
+	}
+	release, ok := s.acquireRecall("harvester")
+	if !ok {
+		t.Fatal("first recall refused")
+	}
+	if _, ok := s.acquireRecall("harvester"); ok {
+		t.Error("second recall allowed")
+	}
+	release()
+	release() // releasing twice is harmless
+	release, ok = s.acquireRecall("harvester")
+	if !ok {
+		t.Fatal("recall refused after release")
+	}
+	if _, ok := s.acquireRecall("harvester"); ok {
+		t.Error("second recall allowed after double release")
+	}
+	release()
+}
+
+func TestRateLimitRoute(t *testing.T) {
+	s := &RESTServer{
+		Validator:  NobodyValidator{},
+		RateLimits: map[string]RateLimit{RateLimitDefault: {Rate: 0.01, Burst: 1}},
+	}
+	ts := httptest.NewServer(s.addRoutes())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/admin/use_tape")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("Received status %d, expected 200", resp.StatusCode)
+	}
+	resp, err = http.Get(ts.URL + "/admin/use_tape")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 429 || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("Received status %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/ndlib/bendo"
+	"github.com/ndlib/bendo/items"
+	"github.com/ndlib/bendo/transaction"
+)
+
+// RenameResult describes what RenameItemHandler did.
+type RenameResult struct {
+	From  string // the old item id
+	To    string // the new item id
+	Bytes int64  // amount of blob content copied
+}
+
+// RenameItemHandler handles requests to POST /admin/rename/:id
+// It gives the item the new id in the parameter "to", keeping its versions,
+// blobs, and checksums, so an item whose accession number changed does not
+// need to be ingested again. The bundles are rewritten under the new id, and
+// the database entries and identifiers are moved to it. If there is a
+// TombstoneDB, requests for the old id are redirected to the new one from
+// then on. It runs until the item is rewritten, which may take a while for
+// large items.
+func (s *RESTServer) RenameItemHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := ps.ByName("id")
+	to := r.FormValue("to")
+	if to == "" || to == id || strings.ContainsAny(to, "/ \t\r\n") {
+		w.WriteHeader(400)
+		fmt.Fprintln(w, "a new item id without slashes or spaces is required")
+		return
+	}
+	// open transactions on both ids so no other transaction can change
+	// either while we are rewriting the item. They also leave a record of
+	// the rename.
+	tx, err := s.TxStore.Create(id)
+	if err != nil {
+		w.WriteHeader(409)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+	tx2, err := s.TxStore.Create(to)
+	if err != nil {
+		tx.SetStatus(transaction.StatusFinished)
+		w.WriteHeader(409)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+	user := ps.ByName("username")
+	tx.Creator = user
+	tx2.Creator = user
+	finish := func(status transaction.Status, msg string) {
+		for _, t := range []*transaction.Transaction{tx, tx2} {
+			if msg != "" {
+				t.AppendError(msg)
+			}
+			t.SetStatus(status)
+		}
+	}
+	logger := requestLogger(r).With("item", id, "to", to)
+	logger.Info("renaming item")
+	// get the old blob list so the cached content can be removed
+	old, err := s.Items.Item(id)
+	var n int64
+	if err == nil {
+		n, err = s.Items.Rename(id, to)
+	}
+	if errors.Is(err, items.ErrReferenced) {
+		// blobs in other items refer to this one, and would break
+		finish(transaction.StatusFinished, "")
+		w.WriteHeader(409)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+	switch err {
+	case nil:
+	case items.ErrNoItem:
+		finish(transaction.StatusFinished, "")
+		w.WriteHeader(404)
+		fmt.Fprintln(w, err.Error())
+		return
+	case items.ErrItemExists:
+		finish(transaction.StatusFinished, "")
+		w.WriteHeader(409)
+		fmt.Fprintln(w, err.Error())
+		return
+	case items.ErrNoStore:
+		finish(transaction.StatusFinished, "")
+		w.WriteHeader(503)
+		fmt.Fprintln(w, err.Error())
+		return
+	default:
+		logger.Error("Rename", "error", err)
+		raven.CaptureError(err, map[string]string{"id": id})
+		finish(transaction.StatusError, err.Error())
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+	// the item is renamed. the rest only moves the records which refer to
+	// it, so errors are logged but do not fail the request.
+	if s.Cache != nil {
+		for _, blob := range old.Blobs {
+			s.Cache.Delete(bendo.CacheKey(id, blob.ID))
+		}
+	}
+	s.moveItemRecords(logger, id, to, user)
+	finish(transaction.StatusFinished, "")
+	logger.Info("renamed item", "bytes", n)
+	s.recordEvent(Event{Type: EventDelete, Item: id, Transaction: tx.ID, User: user})
+	if item, err := s.Items.Item(to); err == nil {
+		s.recordEvent(Event{
+			Type:        EventVersion,
+			Item:        to,
+			Version:     int(item.Versions[len(item.Versions)-1].ID),
+			Transaction: tx2.ID,
+			User:        user,
+		})
+	}
+	w.Header().Set("Location", apiPath(r, "/item/"+to))
+	writeJSON(w, RenameResult{From: id, To: to, Bytes: n})
+}
+
+// moveItemRecords moves the database entries and identifiers of the item
+// from to the item to, which has just been renamed, and leaves a tombstone
+// pointing from the old id to the new one.
+func (s *RESTServer) moveItemRecords(logger *slog.Logger, from, to, user string) {
+	err := s.BlobDB.DeleteItem(from)
+	if err != nil {
+		logger.Error("DeleteItem", "error", err)
+		raven.CaptureError(err, map[string]string{"id": from})
+	}
+	err = s.IndexItem(to)
+	if err != nil {
+		logger.Error("IndexItem", "error", err)
+	}
+	if s.Identifiers != nil {
+		ids, err := s.Identifiers.ItemIdentifiers(from)
+		for i := 0; err == nil && i < len(ids); i++ {
+			err = s.Identifiers.UnbindIdentifier(ids[i])
+			if err == nil {
+				err = s.Identifiers.BindIdentifier(ids[i], to)
+			}
+		}
+		if err != nil {
+			logger.Error("moving identifiers", "error", err)
+			raven.CaptureError(err, map[string]string{"id": from})
+		}
+	}
+	if s.Tombstones != nil {
+		err = s.Tombstones.RecordRename(from, to, time.Now(), user)
+		if err != nil {
+			// the item is renamed, so only the redirects are lost
+			logger.Error("RecordRename", "error", err)
+			raven.CaptureError(err, map[string]string{"id": from})
+		}
+	}
+}
+
+// renamedPath returns the path of the request r with the item id from
+// replaced by to, keeping any query, for redirecting requests for an item
+// which has been renamed.
+func renamedPath(r *http.Request, from, to string) string {
+	p := r.URL.Path
+	old := "/item/" + from
+	if i := strings.Index(p, old); i >= 0 && (len(p) == i+len(old) || p[i+len(old)] == '/') {
+		p = p[:i] + "/item/" + to + p[i+len(old):]
+	} else {
+		p = apiPath(r, "/item/"+to)
+	}
+	if r.URL.RawQuery != "" {
+		p += "?" + r.URL.RawQuery
+	}
+	return p
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"testing"
+)
+
+func TestRenameItem(t *testing.T) {
+	oldid := "rename" + randomid()
+	newid := "renamed" + randomid()
+	file := uploadstring(t, "POST", "/upload", "hello rename")
+	txpath := sendtransaction(t, "/item/"+oldid+"/transaction",
+		[][]string{{"add", path.Base(file)}, {"slot", "a", path.Base(file)}}, 202)
+	waitTransaction(t, txpath)
+	// fill the cache under the old id
+	getbody(t, "GET", "/item/"+oldid+"/a", 200)
+
+	checkStatus(t, "POST", "/admin/rename/"+oldid, 400)
+	checkStatus(t, "POST", "/admin/rename/nosuchitem"+randomid()+"?to="+newid, 404)
+
+	body := getbody(t, "POST", "/admin/rename/"+oldid+"?to="+newid, 200)
+	var result RenameResult
+	err := json.Unmarshal([]byte(body), &result)
+	if err != nil || result.From != oldid || result.To != newid || result.Bytes != 12 {
+		t.Errorf("Received %s, %v", body, err)
+	}
+	if body := getbody(t, "GET", "/item/"+newid+"/a", 200); body != "hello rename" {
+		t.Errorf("Received %q", body)
+	}
+
+	// the old id redirects to the new one
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(testServer.URL + "/item/" + oldid + "/a?format=raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location := "/item/" + newid + "/a?format=raw"
+	if resp.StatusCode != 301 || resp.Header.Get("Location") != location ||
+		resp.Header.Get("X-Bendo-Reason") != ReasonRenamed {
+		t.Errorf("Received %d, %v", resp.StatusCode, resp.Header)
+	}
+	if body := getbody(t, "GET", "/item/"+oldid+"/a", 200); body != "hello rename" {
+		t.Errorf("Received %q", body)
+	}
+
+	// the new id is taken now
+	file = uploadstring(t, "POST", "/upload", "another")
+	txpath = sendtransaction(t, "/item/"+oldid+"/transaction",
+		[][]string{{"add", path.Base(file)}}, 202)
+	waitTransaction(t, txpath)
+	checkStatus(t, "POST", "/admin/rename/"+oldid+"?to="+newid, 409)
+}
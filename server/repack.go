@@ -0,0 +1,67 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	raven "github.com/getsentry/raven-go"
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/ndlib/bendo/items"
+	"github.com/ndlib/bendo/transaction"
+)
+
+// RepackItemHandler handles requests to POST /admin/repack/:id. It rewrites
+// the item into as few bundles as possible, keeping its blob ids and
+// checksums, and returns a RepackResult giving the number of bundles before
+// and after. It runs until the item is rewritten, which may take a while for
+// large items.
+func (s *RESTServer) RepackItemHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := ps.ByName("id")
+	// open a transaction on the item so no other transaction can change it
+	// while we are rewriting it. It also leaves a record of the repack.
+	tx, err := s.TxStore.Create(id)
+	if err != nil {
+		w.WriteHeader(409)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+	tx.Creator = ps.ByName("username")
+	logger := requestLogger(r).With("item", id)
+	result, err := s.Items.Repack(id)
+	if err == nil && result.After != result.Before {
+		var item *items.Item
+		item, err = s.Items.Item(id)
+		if err == nil {
+			// the blobs are in new bundles
+			err = s.reindex(s.BlobDB, id, item)
+		}
+	}
+	switch err {
+	case nil:
+	case items.ErrNoItem:
+		tx.SetStatus(transaction.StatusFinished)
+		w.WriteHeader(404)
+		fmt.Fprintln(w, err.Error())
+		return
+	case items.ErrNoStore:
+		tx.SetStatus(transaction.StatusFinished)
+		w.WriteHeader(503)
+		fmt.Fprintln(w, err.Error())
+		return
+	default:
+		logger.Error("Repack", "error", err)
+		raven.CaptureError(err, map[string]string{"id": id})
+		tx.AppendError(err.Error())
+		tx.SetStatus(transaction.StatusError)
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+	tx.SetStatus(transaction.StatusFinished)
+	logger.Info("repacked item",
+		"before", result.Before,
+		"after", result.After,
+		"bytes", result.Bytes)
+	writeJSON(w, result)
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"encoding/json"
+	"path"
+	"testing"
+
+	"github.com/ndlib/bendo/items"
+)
+
+func TestRepackItem(t *testing.T) {
+	itemid := "repack" + randomid()
+	for _, slot := range []string{"a", "b"} {
+		file := uploadstring(t, "POST", "/upload", "repack "+slot)
+		txpath := sendtransaction(t, "/item/"+itemid+"/transaction",
+			[][]string{{"add", path.Base(file)}, {"slot", slot, path.Base(file)}}, 202)
+		waitTransaction(t, txpath)
+	}
+
+	body := getbody(t, "POST", "/admin/repack/"+itemid, 200)
+	var result items.RepackResult
+	err := json.Unmarshal([]byte(body), &result)
+	if err != nil || result.Before != 2 || result.After != 1 {
+		t.Errorf("Received %s, %v", body, err)
+	}
+	for _, slot := range []string{"a", "b"} {
+		if body := getbody(t, "GET", "/item/"+itemid+"/"+slot, 200); body != "repack "+slot {
+			t.Errorf("Received %q for slot %s", body, slot)
+		}
+	}
+	// the database has the new bundles
+	var check ConsistencyResult
+	body = getbody(t, "POST", "/admin/consistency/"+itemid, 200)
+	err = json.Unmarshal([]byte(body), &check)
+	if err != nil || len(check.Problems) != 0 {
+		t.Errorf("Received %s, %v", body, err)
+	}
+
+	checkStatus(t, "POST", "/admin/repack/nosuchitem"+randomid(), 404)
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+	"github.com/julienschmidt/httprouter"
+)
+
+// An AccessDB tracks when the content of each item was last read, so we can
+// report on which content is cold and might be moved to cheaper storage,
+// and counts the reads each day for download statistics.
+type AccessDB interface {
+	// RecordAccess notes that content from the given item was read at the
+	// given time, and adds one to the item's downloads for that (UTC) day.
+	// It is not an error if the item is not in the database.
+	RecordAccess(item string, when time.Time) error
+
+	// ItemDownloads returns the daily download counts for the given item
+	// for every day on or after the one containing since. If item is
+	// empty, the counts for every item are returned.
+	ItemDownloads(item string, since time.Time) ([]DownloadRecord, error)
+
+	// ItemAccessList returns the id, size, creation, modification, and
+	// last access times for every item. The access time is zero for items
+	// that have not been read since access tracking began.
+	ItemAccessList() ([]SimpleItem, error)
+}
+
+// A ColdDataReport summarizes how long it has been since the content in the
+// item store was last used. An item is last used either when one of its
+// files was last read or when it was last modified, whichever is later.
+//
+// Bundles are not compressed, so the sizes are the number of bytes stored.
+type ColdDataReport struct {
+	Generated  time.Time
+	Years      int       // items not used in this many years are cold
+	Cutoff     time.Time // items not used since this time are cold
+	TotalItems int
+	TotalBytes int64
+	ColdItems  int
+	ColdBytes  int64
+
+	// Ages breaks down the items by the number of whole years since they
+	// were last used. The last entry includes everything older.
+	Ages []AgeBucket
+
+	// Items lists the cold items, least recently used first. It is
+	// truncated to the limit given when making the report.
+	Items []SimpleItem
+}
+
+// An AgeBucket counts the items last used a given number of years ago.
+type AgeBucket struct {
+	Years int
+	Items int
+	Bytes int64
+}
+
+// lastUsed returns the later of the access and modification times of item.
+func lastUsed(item SimpleItem) time.Time {
+	if item.Accessed.After(item.Modified) {
+		return item.Accessed
+	}
+	return item.Modified
+}
+
+// buildColdDataReport tallies the given items into a report as of the time
+// now. Items not used in the given number of years are cold, and at most
+// limit of them are listed individually.
+func buildColdDataReport(list []SimpleItem, now time.Time, years int, limit int) ColdDataReport {
+	report := ColdDataReport{
+		Generated: now,
+		Years:     years,
+		Cutoff:    now.AddDate(-years, 0, 0),
+		Ages:      make([]AgeBucket, years+1),
+	}
+	for i := range report.Ages {
+		report.Ages[i].Years = i
+	}
+	var cold []SimpleItem
+	for _, item := range list {
+		report.TotalItems++
+		report.TotalBytes += item.Size
+		used := lastUsed(item)
+		age := 0
+		for age < years && !used.After(now.AddDate(-(age+1), 0, 0)) {
+			age++
+		}
+		report.Ages[age].Items++
+		report.Ages[age].Bytes += item.Size
+		if used.Before(report.Cutoff) {
+			report.ColdItems++
+			report.ColdBytes += item.Size
+			cold = append(cold, item)
+		}
+	}
+	sort.Slice(cold, func(i, j int) bool {
+		return lastUsed(cold[i]).Before(lastUsed(cold[j]))
+	})
+	if len(cold) > limit {
+		cold = cold[:limit]
+	}
+	report.Items = cold
+	return report
+}
+
+// ColdDataHandler handles requests to GET /admin/reports/cold-data
+// The optional parameter "years" sets the age at which content is cold
+// (default 3), and "limit" sets the most cold items to list (default 100).
+func (s *RESTServer) ColdDataHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.Access == nil {
+		NotImplementedHandler(w, r, ps)
+		return
+	}
+	years, err := strconv.Atoi(r.FormValue("years"))
+	if err != nil || years <= 0 {
+		years = 3
+	}
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit < 0 {
+		limit = 100
+	}
+	list, err := s.Access.ItemAccessList()
+	if err != nil {
+		requestLogger(r).Error("ItemAccessList", "error", err)
+		raven.CaptureError(err, nil)
+		w.WriteHeader(500)
+		return
+	}
+	report := buildColdDataReport(list, time.Now(), years, limit)
+	writeHTMLorJSON(w, r, coldDataTemplate, report)
+}
+
+// recordAccess notes that the given item was read, if access tracking is
+// enabled. Errors are logged and otherwise ignored.
+func (s *RESTServer) recordAccess(item string) {
+	if s.Access == nil {
+		return
+	}
+	err := s.Access.RecordAccess(item, time.Now())
+	if err != nil {
+		slog.Error("RecordAccess", "item", item, "error", err)
+		raven.CaptureError(err, nil)
+	}
+}
+
+var (
+	coldDataTemplate = template.Must(template.New("colddata").Parse(`<html>
+<h1>Cold Data Report</h1>
+<dl>
+<dt>Generated</dt><dd>{{ .Generated }}</dd>
+<dt>Cold after</dt><dd>{{ .Years }} years ({{ .Cutoff }})</dd>
+<dt>Items</dt><dd>{{ .TotalItems }} ({{ .TotalBytes }} bytes)</dd>
+<dt>Cold Items</dt><dd>{{ .ColdItems }} ({{ .ColdBytes }} bytes)</dd>
+</dl>
+<h2>Years since last use</h2>
+<table><thead><tr>
+	<th>Years</th><th>Items</th><th>Bytes</th>
+</tr></thead><tbody>
+{{ range .Ages }}
+	<tr><td>{{ .Years }}</td><td>{{ .Items }}</td><td>{{ .Bytes }}</td></tr>
+{{ end }}
+</tbody></table>
+<h2>Cold Items</h2>
+<table><thead><tr>
+	<th>Item</th><th>Size</th><th>Modified</th><th>Accessed</th>
+</tr></thead><tbody>
+{{ range .Items }}
+	<tr>
+		<td><a href="/item/{{ .ID }}">{{ .ID }}</a></td>
+		<td>{{ .Size }}</td>
+		<td>{{ .Modified }}</td>
+		<td>{{ if .Accessed.IsZero }}never{{ else }}{{ .Accessed }}{{ end }}</td>
+	</tr>
+{{ end }}
+</tbody></table>
+</html>`))
+)
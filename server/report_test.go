@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/json"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/ndlib/bendo/items"
+)
+
+func TestBuildColdDataReport(t *testing.T) {
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	years := func(n int) time.Time { return now.AddDate(-n, 0, -1) }
+	list := []SimpleItem{
+		{ID: "new", Size: 1, Modified: now},
+		{ID: "read", Size: 10, Modified: years(6), Accessed: years(1)},
+		{ID: "old", Size: 100, Modified: years(4)},
+		{ID: "oldest", Size: 1000, Modified: years(10), Accessed: years(5)},
+	}
+	report := buildColdDataReport(list, now, 3, 1)
+	if report.TotalItems != 4 || report.TotalBytes != 1111 {
+		t.Errorf("Received total %d, %d", report.TotalItems, report.TotalBytes)
+	}
+	if report.ColdItems != 2 || report.ColdBytes != 1100 {
+		t.Errorf("Received cold %d, %d", report.ColdItems, report.ColdBytes)
+	}
+	var expected = []int64{1, 10, 0, 1100}
+	for i, bucket := range report.Ages {
+		if bucket.Years != i || bucket.Bytes != expected[i] {
+			t.Errorf("Received bucket %#v, expected %d bytes", bucket, expected[i])
+		}
+	}
+	if len(report.Items) != 1 || report.Items[0].ID != "oldest" {
+		t.Errorf("Received items %v, expected oldest", report.Items)
+	}
+}
+
+func runAccessSequence(t *testing.T, db interface {
+	AccessDB
+	items.ItemCache
+}) {
+	modified := time.Now().AddDate(-5, 0, 0).Truncate(time.Second)
+	db.Set("access1", &items.Item{
+		ID:       "access1",
+		Blobs:    []*items.Blob{{ID: 1, Size: 5}},
+		Versions: []*items.Version{{ID: 1, SaveDate: modified}},
+	})
+	list, err := db.ItemAccessList()
+	if err != nil || len(list) != 1 || list[0].Size != 5 || !list[0].Accessed.IsZero() {
+		t.Fatal("ItemAccessList received", list, err)
+	}
+	when := time.Now().Truncate(time.Second)
+	err = db.RecordAccess("access1", when)
+	if err != nil {
+		t.Error(err)
+	}
+	// unknown items are ignored
+	err = db.RecordAccess("not-an-item", when)
+	if err != nil {
+		t.Error(err)
+	}
+	list, err = db.ItemAccessList()
+	if err != nil || len(list) != 1 || !list[0].Accessed.Equal(when) {
+		t.Error("ItemAccessList received", list, err)
+	}
+
+	// each access is counted as a download
+	err = db.RecordAccess("access1", when)
+	if err != nil {
+		t.Error(err)
+	}
+	downloads, err := db.ItemDownloads("access1", when)
+	if err != nil || len(downloads) != 1 {
+		t.Fatal("ItemDownloads received", downloads, err)
+	}
+	if downloads[0].Downloads != 2 || !downloads[0].Day.Equal(usageDay(when)) {
+		t.Errorf("Received %v", downloads[0])
+	}
+	downloads, err = db.ItemDownloads("", when)
+	if err != nil || len(downloads) != 2 {
+		t.Error("ItemDownloads received", downloads, err)
+	}
+	downloads, err = db.ItemDownloads("access1", when.AddDate(0, 0, 1))
+	if err != nil || len(downloads) != 0 {
+		t.Error("ItemDownloads received", downloads, err)
+	}
+}
+
+func TestColdDataRoute(t *testing.T) {
+	file1 := uploadstring(t, "POST", "/upload", "hello cold data")
+	itemid := "cold" + randomid()
+	txpath := sendtransaction(t, "/item/"+itemid+"/transaction",
+		[][]string{{"add", path.Base(file1)}, {"slot", "a", path.Base(file1)}}, 202)
+	waitTransaction(t, txpath)
+	checkStatus(t, "GET", "/item/"+itemid+"/a", 200)
+
+	body := getbody(t, "GET", "/admin/reports/cold-data?years=1", 200)
+	var report ColdDataReport
+	err := json.Unmarshal([]byte(body), &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Years != 1 || len(report.Ages) != 2 {
+		t.Errorf("Received %#v", report)
+	}
+}
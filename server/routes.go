@@ -2,23 +2,30 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"expvar"
 	"fmt"
 	"html/template"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	_ "net/http/pprof" // for pprof server
+	"os"
+	"strings"
 	"sync"
+	"time"
 
 	raven "github.com/getsentry/raven-go"
 	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/acme/autocert"
 	"golang.org/x/sync/singleflight"
 
-	"github.com/ndlib/bendo/blobcache"
+	"github.com/ndlib/bendo/cache"
 	"github.com/ndlib/bendo/fragment"
 	"github.com/ndlib/bendo/items"
 	"github.com/ndlib/bendo/transaction"
+	"github.com/ndlib/bendo/util"
 )
 
 // RESTServer holds the configuration for a Bendo REST API server.
@@ -61,7 +68,7 @@ type RESTServer struct {
 	FileStore *fragment.Store
 
 	// Cache keeps smallish blobs retreived from tape.
-	Cache blobcache.T
+	Cache cache.Cache
 
 	// BlobDB holds the item/version/slot/blob information in a structured way
 	// so we can query it without needing to read and parse the JSON structures
@@ -72,11 +79,220 @@ type RESTServer struct {
 	FixityDatabase FixityDB
 	DisableFixity  bool
 
-	server   *http.Server   // used to close our listening socket
-	txqueue  chan string    // channel to feed background transaction workers. contains tx ids
-	txwg     sync.WaitGroup // for waiting for all background tx workers to exit
-	txcancel chan struct{}  // Is closed to indicate tx workers should exit
-	useTape  bool           // Is Bendo reading/writing from tape?
+	// Identifiers maps external identifiers (DOIs, ARKs, handles) to items.
+	// If nil, the identifier routes will return 501 Not Implemented.
+	Identifiers IdentifierDB
+
+	// Minter makes new item ids for clients that do not supply their own.
+	// If nil, the POST /items route will return 501 Not Implemented.
+	Minter Minter
+
+	// Mints remembers the ids Minter has handed out, so each is handed out
+	// only once. If nil, minted ids are only checked against the existing
+	// items, and an id may be handed out again before its item is created.
+	Mints MintDB
+
+	// Access records when items were last read, for the cold data report.
+	// If nil, access is not tracked and the report returns 501 Not
+	// Implemented.
+	Access AccessDB
+
+	// Usage keeps daily totals of the bytes uploaded by each token and
+	// added to each item. If nil, usage is only counted in the metrics and
+	// the usage report returns 501 Not Implemented.
+	Usage UsageDB
+
+	// Tokens holds the API tokens created through the /admin/tokens
+	// routes. If nil, those routes return 501 Not Implemented. The tokens
+	// are only accepted if Validator is a TokenDBValidator using Tokens.
+	Tokens TokenDB
+
+	// Tombstones records deleted items, so requests for them get 410 Gone.
+	// If nil, deleted items are reported as never having existed.
+	Tombstones TombstoneDB
+
+	// Audit keeps a log of every request which changes something. If nil,
+	// nothing is logged and the audit route returns 501 Not Implemented.
+	Audit AuditDB
+
+	// Events keeps the feed of item changes and the subscriptions which
+	// are sent them. If nil, no events are recorded and the event and
+	// subscription routes return 501 Not Implemented.
+	Events EventDB
+
+	// ConsistencyInterval is how often to compare a sample of items in
+	// BlobDB against their metadata in the item store. Zero disables the
+	// background check. ConsistencySample items are checked each time,
+	// rotating through the whole store. If ConsistencyReindex is true,
+	// items which differ are reindexed.
+	ConsistencyInterval time.Duration
+	ConsistencySample   int
+	ConsistencyReindex  bool
+
+	// DisableV1 turns off the legacy unprefixed routes, so the API is only
+	// served under APIPrefix.
+	DisableV1 bool
+
+	// V1Sunset is when the legacy routes are expected to be removed. If it
+	// is not zero, it is sent in a Sunset header on legacy responses.
+	V1Sunset time.Time
+
+	// MaxTxBytes and MaxTxFiles limit the total size and the number of
+	// uploaded files a single transaction may add. A transaction over
+	// either limit is refused with a 413 status. Zero means no limit.
+	MaxTxBytes int64
+	MaxTxFiles int
+
+	// SmallTxBytes and SmallTxFiles are the most bytes and uploaded files
+	// a transaction may add and still be processed in the small lane,
+	// which has its own workers. TxLanes assigns all the transactions
+	// started by a user to a lane, either LaneSmall or LaneLarge,
+	// whatever their size.
+	SmallTxBytes int64
+	SmallTxFiles int
+	TxLanes      map[string]string
+
+	// TxCallbacks lists, for each user, URLs to POST a TxNotification to
+	// whenever one of their transactions finishes. They are in addition
+	// to any given by "callback" commands in the transaction itself.
+	TxCallbacks map[string][]string
+
+	// TxTemplates are named command lists which may be used to start a
+	// transaction in place of a full command list. Arguments may contain
+	// parameter references such as "{file}", which are filled in from
+	// the values given when the template is used.
+	TxTemplates map[string][][]string
+
+	// RateLimits gives the rate limit for the API key of each user. The
+	// entry for RateLimitDefault, if any, applies to users not listed.
+	// Requests over a limit are refused with a 429 status.
+	RateLimits map[string]RateLimit
+
+	// UploadQuotas gives the most bytes each user may have in the upload
+	// area at once. Files count against the quota until a transaction
+	// adds them to an item or they are deleted. The entry for
+	// RateLimitDefault, if any, applies to users not listed. Uploads over
+	// a quota are refused with a 507 status. Zero means no limit.
+	UploadQuotas map[string]int64
+
+	// UploadExpire is how long an uploaded file which no transaction
+	// refers to is kept after it was last written to. Abandoned uploads
+	// are then deleted. Zero means DefaultUploadExpire.
+	UploadExpire time.Duration
+
+	// TransferQuotas gives the most bytes each user may upload and
+	// download over a period of days. The entry for RateLimitDefault, if
+	// any, applies to users not listed. Requests over a quota are refused
+	// with a 403 status. Quotas are only enforced if Usage is set.
+	TransferQuotas map[string]TransferQuota
+
+	// StorageAlerts are soft quotas on the size of the item store, in
+	// total or for the items beginning with a prefix. Every
+	// StorageCheckInterval the sizes are checked, and when one crosses
+	// a level an alert is logged, sent to Sentry, and POSTed to each of
+	// StorageAlertURLs. The sizes are also kept in the metrics. The
+	// projected date each quota is used up is based on the bytes added
+	// to items over the last StorageGrowthDays days, 30 by default.
+	// Alerts need Access, and the projections need Usage. A zero
+	// StorageCheckInterval disables the background check.
+	StorageAlerts        []StorageAlert
+	StorageAlertURLs     []string
+	StorageCheckInterval time.Duration
+	StorageGrowthDays    int
+
+	// ExportTargets are external preservation services which the items
+	// in a collection are sent to as bags, each on its own schedule.
+	// The receipts are recorded in Events. Exports need both Access and
+	// Events.
+	ExportTargets []ExportTarget
+
+	// HashCPU is the share of the CPUs, as a fraction of GOMAXPROCS, which
+	// may be spent computing checksums for commit verification and fixity
+	// checks together. Jobs beyond it wait in a queue, whose length is kept
+	// in the metrics. Zero places no limit.
+	HashCPU float64
+
+	// CacheCopyBuffer and ClientCopyBuffer are the sizes, in bytes, of the
+	// buffers used to copy blobs from tape into the cache and to stream
+	// blobs too large for the cache to clients. Zero uses the io.Copy
+	// default of 32 KB. Larger buffers mean fewer system calls during bulk
+	// restores.
+	CacheCopyBuffer  int
+	ClientCopyBuffer int
+
+	// CacheWait is how long a GET for a blob which is not in the cache
+	// waits for it to be copied from tape before giving up with a 504
+	// status. Zero uses DefaultCacheWait. Clients may ask for a different
+	// wait with the header "Prefer: wait=<seconds>", up to MaxCacheWait,
+	// which defaults to CacheWait.
+	CacheWait    time.Duration
+	MaxCacheWait time.Duration
+
+	// FastCopy sends cached blobs straight from their files, so the
+	// kernel can copy them to the client's connection (with sendfile on
+	// Linux) instead of copying them through user space. It only helps
+	// caches kept in a local directory.
+	FastCopy bool
+
+	// WarmFile is where a ranked list of the blobs read most often and
+	// most recently is saved, so the cache can be warmed with them after
+	// it has been emptied. If empty, no list is kept. At startup, the top
+	// WarmCount blobs on the list which are not cached are copied into
+	// the cache in the background, up to WarmBytes in total. Zero
+	// WarmBytes means half the cache's size. Blobs are only copied while
+	// no client recalls are in progress.
+	WarmFile  string
+	WarmCount int
+	WarmBytes int64
+
+	// TLSCertFile and TLSKeyFile, if both are set, make the server use
+	// HTTPS with the certificate and private key in the given PEM files.
+	// The certificate is reloaded when the files change.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// TLSConfig, if not nil, is used to serve HTTPS instead of the
+	// certificate files. This allows certificates to come from somewhere
+	// else, such as an ACME client.
+	TLSConfig *tls.Config
+
+	// ACMEHosts, if not empty, makes the server use HTTPS with
+	// certificates for these host names, which are obtained and renewed
+	// automatically from Let's Encrypt using ACME. It is used instead of
+	// the certificate files, but not instead of TLSConfig. The
+	// certificates are kept in ACMECacheDir, and if it is empty they are
+	// requested again each time the server starts. ACMEEmail, if given,
+	// is the contact address for the ACME account.
+	ACMEHosts    []string
+	ACMECacheDir string
+	ACMEEmail    string
+
+	// RouteRoles changes the least role needed to use an API route. The
+	// keys are a method and a route, as returned by RouteNames, such as
+	// "GET /items". RoleUnknown lets anyone use the route. Changes made by
+	// a route are audited whatever role it is given.
+	RouteRoles map[string]Role
+
+	// Config is the configuration the server was started from, with any
+	// secrets removed, to be returned by the /admin/config route. It is
+	// encoded as JSON. If nil, the route returns 501 Not Implemented.
+	Config interface{}
+
+	// RedirectPort, if set while serving HTTPS, is a port to listen on for
+	// plain HTTP requests, which are redirected to HTTPS.
+	RedirectPort string
+
+	server    *http.Server   // used to close our listening socket
+	redirect  *http.Server   // the HTTP to HTTPS redirect server, if any
+	txqueue   chan string    // channel to feed background transaction workers. contains tx ids
+	txsmall   chan string    // like txqueue, but for the small transaction lane
+	txwg      sync.WaitGroup // for waiting for all background tx workers to exit
+	txcancel  chan struct{}  // Is closed to indicate tx workers should exit
+	txwaiters txWaiters      // requests waiting for transactions to finish
+	eventsig  chan struct{}  // wakes the event delivery goroutine
+	eventmu   sync.Mutex     // held while changing subscription delivery state
+	useTape   bool           // Is Bendo reading/writing from tape?
+	hashpool  *util.HashPool // bounds the checksums computed at once. nil for no bound
 
 	// tapeinflight tracks whether a blob is being copied into the cache. If
 	// one is, then a channel is returned that will signal when the copy is
@@ -90,75 +306,175 @@ type RESTServer struct {
 	// long enough that others waiting on the channel can call findContent
 	// again to get the error).
 	errorledger errorlist
+
+	// cachecopy and clientcopy keep the buffers for CacheCopyBuffer and
+	// ClientCopyBuffer.
+	cachecopy  copyBuffers
+	clientcopy copyBuffers
+
+	// largereads shares reads of blobs too large for the cache between
+	// the requests for them.
+	largereads sharedReads
+
+	// shutdown is done once Stop is called, so reads from the item store
+	// still in progress, for requests or for filling the cache, end
+	// instead of holding up the shutdown.
+	shutdown     context.Context
+	stopRequests context.CancelFunc
+
+	consistency consistencyState // progress of the consistency checker
+
+	maintenance maintenanceState // the scheduled maintenance window, if any
+
+	acme *autocert.Manager // gets certificates for ACMEHosts, if any
+
+	ratelimits rateLimiter // the requests and recalls made by each user
+
+	staging    asyncStaging // blobs being cached for asynchronous requests
+	recallrate recallRate   // how fast blobs are copied from tape
+	recalls    recallQueue  // the blobs being copied from tape
+
+	rescanning sync.Mutex // held while the cache is being rescanned
+	warm       warmList   // the blobs read most, for warming the cache
+
+	storage storageState // the storage alert levels last seen
 }
 
 // the number of transaction commits to tape we allow at a given time. If there
 // are more they will wait in a queue.
 const MaxConcurrentCommits = 2
 
+// the number of additional commits we allow at a given time for transactions
+// in the small lane.
+const SmallLaneCommits = 1
+
 // Run initializes and starts all the goroutines used by the server. It then
 // blocks listening for and handling http requests.
 func (s *RESTServer) Run() error {
 	if s.Items == nil {
-		log.Fatalln("No base storage given. Items is nil.")
+		slog.Error("No base storage given. Items is nil.")
+		os.Exit(1)
 	}
 
 	if s.Validator == nil {
-		log.Println("No Validator given")
+		slog.Warn("No Validator given")
 		s.Validator = NobodyValidator{}
 	}
 
 	s.EnableTapeUse()
+	s.shutdown, s.stopRequests = context.WithCancel(context.Background())
+
+	if s.HashCPU > 0 {
+		s.hashpool = util.NewHashPool(util.HashWorkers(s.HashCPU))
+		slog.Info("Limiting checksum workers", "workers", s.hashpool.Size())
+	}
 
 	if !s.DisableFixity {
 		s.StartFixity()
 	}
 
+	if s.ConsistencyInterval > 0 {
+		s.StartConsistency()
+	}
+
+	if s.Events != nil {
+		s.StartEvents()
+	}
+
+	if s.StorageCheckInterval > 0 && s.Access != nil && len(s.StorageAlerts) > 0 {
+		s.StartStorageAlerts()
+	}
+
+	if len(s.ExportTargets) > 0 && s.Access != nil && s.Events != nil {
+		s.StartExports()
+	}
+
 	// index the cached items into memory
 	if s.Cache != nil {
-		// not everything needs a scan. but if it does, run it
-		// maybe Scan() should be added to the cache interface?
-		type Scanner interface {
-			Scan()
-		}
-		if c, ok := s.Cache.(Scanner); ok {
-			go c.Scan()
+		// the cache warmer shares this with the request handlers
+		if s.tapeinflight == nil {
+			s.tapeinflight = &singleflight.Group{}
 		}
+		warmlist := s.startWarmList()
+		go func() {
+			// not everything needs a scan. but if it does, run it
+			if c, ok := s.Cache.(cache.Scanner); ok {
+				c.Scan()
+			}
+			s.warmCache(warmlist)
+		}()
 	}
 
-	log.Println("Scanning Transactions")
+	slog.Info("Scanning Transactions")
 	s.TxStore.Load()
 
 	// init upload store
-	log.Println("Scanning Upload Queue")
+	slog.Info("Scanning Upload Queue")
 	s.FileStore.Load()
+	s.FileStore.SetQuota(s.quotaFor)
 
-	log.Println("Starting Transaction Cleaner")
+	slog.Info("Starting Transaction Cleaner")
 	go s.TxCleaner()
+	s.startUploadJanitor()
 
-	log.Println("Starting pending transactions")
+	slog.Info("Starting pending transactions")
 	s.txqueue = make(chan string, 100) // 100 is arbitrary. don't expect that many.
+	s.txsmall = make(chan string, 100)
 	s.txcancel = make(chan struct{})
 	for i := 0; i < MaxConcurrentCommits; i++ {
 		s.txwg.Add(1)
 		go s.transactionWorker(s.txqueue)
 	}
+	for i := 0; i < SmallLaneCommits; i++ {
+		s.txwg.Add(1)
+		go s.transactionWorker(s.txsmall)
+	}
 	go s.initCommitQueue() // run in background
 
 	// for pprof
 	if s.PProfPort != "" {
-		log.Println("Starting PProf on port", s.PProfPort)
+		slog.Info("Starting PProf", "port", s.PProfPort)
 		go func() {
-			log.Println("pprof:", http.ListenAndServe(":"+s.PProfPort, nil))
+			slog.Error("pprof", "error", http.ListenAndServe(":"+s.PProfPort, nil))
 		}()
 	}
-	log.Println("Listening on", s.PortNumber)
-
 	s.server = &http.Server{
 		Handler: raven.Recoverer(s.addRoutes()),
 		Addr:    ":" + s.PortNumber,
+		// requests are cancelled when the server stops
+		BaseContext: func(net.Listener) context.Context { return s.shutdown },
+	}
+	var err error
+	if s.useTLS() {
+		s.server.TLSConfig, err = s.tlsConfig()
+		if err != nil {
+			return err
+		}
+		if s.RedirectPort != "" {
+			slog.Info("Redirecting HTTP to HTTPS", "port", s.RedirectPort)
+			handler := redirectHandler(s.PortNumber)
+			if s.acme != nil {
+				// answer http-01 challenges rather than redirecting them
+				handler = s.acme.HTTPHandler(handler)
+			}
+			s.redirect = &http.Server{
+				Handler: handler,
+				Addr:    ":" + s.RedirectPort,
+			}
+			go func() {
+				err := s.redirect.ListenAndServe()
+				if err != http.ErrServerClosed {
+					slog.Error("redirect server", "error", err)
+				}
+			}()
+		}
+		slog.Info("Listening with TLS", "port", s.PortNumber)
+		// the certificate comes from the TLSConfig
+		err = s.server.ListenAndServeTLS("", "")
+	} else {
+		slog.Info("Listening", "port", s.PortNumber)
+		err = s.server.ListenAndServe()
 	}
-	err := s.server.ListenAndServe()
 
 	// being shutdown is not an error
 	if err == http.ErrServerClosed {
@@ -174,11 +490,28 @@ func (s *RESTServer) Stop() error {
 	// We don't stop the fixity process. Should we?
 	close(s.txcancel)
 	s.txwg.Wait() // wait for all tx workers to exit
+	s.FileStore.StopJanitor()
+	s.saveWarmList()
 
-	// then shutdown all the HTTP connections
+	// then end any reads in progress and shutdown all the HTTP connections
+	s.stopRequests()
+	if s.redirect != nil {
+		s.redirect.Shutdown(context.Background())
+	}
 	return s.server.Shutdown(context.Background())
 }
 
+// serverContext returns a context which is done once the server is
+// stopped. It is for reads from the item store which are not made for any
+// one request.
+func (s *RESTServer) serverContext() context.Context {
+	if s.shutdown == nil {
+		// the server is not running, as in tests
+		return context.Background()
+	}
+	return s.shutdown
+}
+
 // initCommitQueue adds all transactions in the tx store to the transaction queue.
 // It may block until they are all loaded and processed.
 func (s *RESTServer) initCommitQueue() {
@@ -186,10 +519,15 @@ func (s *RESTServer) initCommitQueue() {
 	// the queue. The transaction workers will sort it out.
 	for _, tid := range s.TxStore.List() {
 		select {
-		case s.txqueue <- tid:
 		case <-s.txcancel:
 			return
+		default:
+		}
+		tx := s.TxStore.Lookup(tid)
+		if tx == nil {
+			continue
 		}
+		s.enqueueTx(tx)
 	}
 }
 
@@ -197,16 +535,41 @@ func (s *RESTServer) Handler() http.Handler {
 	return s.addRoutes()
 }
 
-func (s *RESTServer) addRoutes() http.Handler {
-	var routes = []struct {
-		method  string
-		route   string
-		role    Role // RoleUnknown means no API key is needed to access
-		handler httprouter.Handle
-	}{
+// a route is one entry in the routing table.
+type route struct {
+	method  string
+	route   string
+	role    Role // RoleUnknown means no API key is needed to access
+	handler httprouter.Handle
+}
+
+// RouteNames returns the names of the API routes, such as "GET /items",
+// which may be given in RouteRoles.
+func RouteNames() []string {
+	var s RESTServer
+	var result []string
+	for _, route := range s.apiRoutes() {
+		result = append(result, route.method+" "+route.route)
+	}
+	return result
+}
+
+// apiRoutes returns the routing table of the API. These routes are served
+// under APIPrefix, and also at their legacy unprefixed paths unless
+// DisableV1 is set.
+func (s *RESTServer) apiRoutes() []route {
+	return []route{
 		{"GET", "/item/:id/*slot", RoleUnknown, s.SlotHandler},
 		{"HEAD", "/item/:id/*slot", RoleUnknown, s.SlotHandler},
+		{"PUT", "/item/:id/*slot", RoleWrite, s.PutSlotHandler},
 		{"GET", "/item/:id", RoleUnknown, s.ItemHandler},
+		{"POST", "/item/:id/@batch", RoleRead, s.BatchHandler},
+		{"DELETE", "/item/:id", RoleAdmin, s.DeleteItemHandler},
+		{"GET", "/items", RoleMDOnly, s.ListItemsHandler},
+		{"POST", "/items", RoleWrite, s.MintItemHandler},
+		{"GET", "/search", RoleMDOnly, s.SearchHandler},
+		{"GET", "/search/meta", RoleMDOnly, s.MetaSearchHandler},
+		{"GET", "/usage", RoleMDOnly, s.TokenUsageHandler},
 
 		// all the transaction things.
 		{"POST", "/item/:id/transaction", RoleWrite, s.NewTxHandler},
@@ -223,6 +586,11 @@ func (s *RESTServer) addRoutes() http.Handler {
 		{"GET", "/upload/:fileid/metadata", RoleMDOnly, s.GetFileInfoHandler},
 		{"PUT", "/upload/:fileid/metadata", RoleWrite, s.SetFileInfoHandler},
 
+		// external identifiers
+		{"GET", "/id/*identifier", RoleUnknown, s.IdentifierHandler},
+		{"PUT", "/id/*identifier", RoleWrite, s.BindIdentifierHandler},
+		{"DELETE", "/id/*identifier", RoleWrite, s.UnbindIdentifierHandler},
+
 		// fixity routes
 		{"GET", "/fixity", RoleRead, s.GetFixityHandler},
 		{"GET", "/fixity/:id", RoleRead, s.GetFixityIdHandler},
@@ -233,29 +601,116 @@ func (s *RESTServer) addRoutes() http.Handler {
 		// /admin/tape_use (enable, disable, get status)
 		{"GET", "/admin/use_tape", RoleUnknown, s.GetTapeUseHandler},
 		{"PUT", "/admin/use_tape/:status", RoleAdmin, s.SetTapeUseHandler},
+		{"GET", "/admin/reports/cold-data", RoleRead, s.ColdDataHandler},
+		{"GET", "/admin/reports/downloads", RoleRead, s.DownloadStatsHandler},
+		{"GET", "/admin/reports/storage", RoleRead, s.StorageHandler},
+		{"GET", "/admin/usage", RoleRead, s.UsageHandler},
+		{"GET", "/admin/stores", RoleRead, s.StoresHandler},
+		{"GET", "/admin/config", RoleAdmin, s.ConfigHandler},
+		{"GET", "/admin/audit", RoleAdmin, s.AuditHandler},
+		{"GET", "/admin/consistency", RoleRead, s.ConsistencyHandler},
+		{"POST", "/admin/consistency/:id", RoleAdmin, s.CheckConsistencyHandler},
+		{"GET", "/admin/cache/entries", RoleAdmin, s.CacheEntriesHandler},
+		{"POST", "/admin/cache/rescan", RoleAdmin, s.CacheRescanHandler},
+		{"POST", "/admin/repack/:id", RoleAdmin, s.RepackItemHandler},
+		{"POST", "/admin/rename/:id", RoleAdmin, s.RenameItemHandler},
+		{"GET", "/admin/maintenance", RoleUnknown, s.GetMaintenanceHandler},
+		{"PUT", "/admin/maintenance", RoleAdmin, s.SetMaintenanceHandler},
+		{"DELETE", "/admin/maintenance", RoleAdmin, s.CancelMaintenanceHandler},
+		{"GET", "/admin/tokens", RoleAdmin, s.ListTokensHandler},
+		{"POST", "/admin/tokens", RoleAdmin, s.CreateTokenHandler},
+		{"GET", "/admin/tokens/:id", RoleAdmin, s.GetTokenHandler},
+		{"DELETE", "/admin/tokens/:id", RoleAdmin, s.RevokeTokenHandler},
+		{"POST", "/admin/tokens/:id/rotate", RoleAdmin, s.RotateTokenHandler},
+		{"GET", "/admin/events", RoleRead, s.ListEventsHandler},
+		{"GET", "/admin/subscriptions", RoleAdmin, s.ListSubscriptionsHandler},
+		{"POST", "/admin/subscriptions", RoleAdmin, s.CreateSubscriptionHandler},
+		{"GET", "/admin/subscriptions/:id", RoleAdmin, s.GetSubscriptionHandler},
+		{"DELETE", "/admin/subscriptions/:id", RoleAdmin, s.DeleteSubscriptionHandler},
+		{"POST", "/admin/subscriptions/:id/replay", RoleAdmin, s.ReplaySubscriptionHandler},
 
 		// the read only bundle stuff
 		{"GET", "/bundle/list/:prefix", RoleRead, s.BundleListPrefixHandler},
 		{"GET", "/bundle/list/", RoleRead, s.BundleListHandler},
 		{"GET", "/bundle/open/:key", RoleRead, s.BundleOpenHandler},
 
+		{"GET", "/stats", RoleUnknown, NotImplementedHandler},
+	}
+}
+
+func (s *RESTServer) addRoutes() http.Handler {
+	// these routes are not part of the versioned API
+	var unversioned = []route{
 		// UI routes.
 		// these routes are not covered by the API spec and can change at any time
 		{"GET", "/ui/items", RoleUnknown, s.UIItemsHandler},
 
 		// other
 		{"GET", "/", RoleUnknown, WelcomeHandler},
-		{"GET", "/stats", RoleUnknown, NotImplementedHandler},
 		{"GET", "/debug/vars", RoleUnknown, VarHandler}, // standard route for expvars data
 	}
 
 	r := httprouter.New()
-	for _, route := range routes {
+	for _, route := range s.apiRoutes() {
+		role := route.role
+		if v, ok := s.RouteRoles[route.method+" "+route.route]; ok {
+			role = v
+		}
+		handler := route.handler
+		if route.role >= RoleWrite {
+			handler = s.auditWrapper(handler, route.route)
+		}
+		handler = s.maintenanceWrapper(s.authzWrapper(s.rateLimitWrapper(handler), role))
+		r.Handle(route.method,
+			APIPrefix+route.route,
+			logWrapper(handler))
+		if s.DisableV1 {
+			continue
+		}
+		r.Handle(route.method,
+			route.route,
+			logWrapper(s.deprecatedWrapper(handler)))
+	}
+	for _, route := range unversioned {
 		r.Handle(route.method,
 			route.route,
 			logWrapper(s.authzWrapper(route.handler, route.role)))
 	}
-	return r
+	return compressHandler(r)
+}
+
+// APIPrefix is the path prefix for the current version of the API. The
+// legacy (version 1) routes have no prefix.
+const APIPrefix = "/api/v2"
+
+// deprecatedWrapper marks responses from the legacy routes as deprecated,
+// and points to the equivalent route under APIPrefix.
+func (s *RESTServer) deprecatedWrapper(handler httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		w.Header().Set("Deprecation", "true")
+		if !s.V1Sunset.IsZero() {
+			w.Header().Set("Sunset", s.V1Sunset.UTC().Format(http.TimeFormat))
+		}
+		w.Header().Set("Link", "<"+APIPrefix+r.URL.Path+`>; rel="successor-version"`)
+		handler(w, r, ps)
+	}
+}
+
+// isV2 returns true if the request was made to a route under APIPrefix.
+// Those routes only return JSON, using the types in package apiv2 where a
+// route has one.
+func isV2(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, APIPrefix+"/")
+}
+
+// apiPath returns the given route path with the API prefix of the request
+// r, so paths returned to clients use the same version of the API they
+// called.
+func apiPath(r *http.Request, path string) string {
+	if isV2(r) {
+		return APIPrefix + path
+	}
+	return path
 }
 
 // General route handlers and convinence functions
@@ -283,25 +738,30 @@ func NotImplementedHandler(w http.ResponseWriter, r *http.Request, ps httprouter
 }
 
 // writeHTMLorJSON will either return val as JSON or as rendered using the
-// given template, depending on the request header "Accept-Encoding".
+// given template, depending on the request header "Accept-Encoding" (see
+// wantsJSON).
 func writeHTMLorJSON(w http.ResponseWriter,
 	r *http.Request,
 	tmpl *template.Template,
 	val interface{}) {
 
-	if r.Header.Get("Accept-Encoding") == "application/json" ||
-		r.FormValue("format") == "json" {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		json.NewEncoder(w).Encode(val)
+	if wantsJSON(r) {
+		writeJSON(w, val)
 		return
 	}
 	err := tmpl.Execute(w, val)
 	if err != nil {
-		log.Println(err)
+		requestLogger(r).Error("template", "error", err)
 		raven.CaptureError(err, nil)
 	}
 }
 
+// writeJSON sends val as a JSON response.
+func writeJSON(w http.ResponseWriter, val interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(val)
+}
+
 // authzWrapper returns a Handler which will first verify the user token as
 // having at least the given Role. The user name is added as a parameter
 // "username".
@@ -318,7 +778,20 @@ func (s *RESTServer) authzWrapper(handler httprouter.Handle, leastRole Role) htt
 			// token in password field?
 			_, token, _ = r.BasicAuth()
 		}
-		user, role, err := s.Validator.TokenValid(token)
+		var user string
+		var role Role
+		var err error
+		// try a user name and password first, if the validator can
+		// check them. Otherwise, or if they are not valid, the token
+		// is checked as usual.
+		if name, password, ok := r.BasicAuth(); ok && name != "" && password != "" {
+			if pv, ok := s.Validator.(PasswordValidator); ok {
+				user, role, err = pv.PasswordValid(name, password)
+			}
+		}
+		if err == nil && role == RoleUnknown {
+			user, role, err = s.Validator.TokenValid(token)
+		}
 		if err != nil {
 			w.WriteHeader(500)
 			fmt.Fprintln(w, err.Error())
@@ -333,7 +806,9 @@ func (s *RESTServer) authzWrapper(handler httprouter.Handle, leastRole Role) htt
 			return
 		}
 
-		log.Println("User", user)
+		logger := requestLogger(r).With("user", user)
+		logger.Debug("authorized")
+		r = withLogger(r, logger)
 
 		// remove any previous username
 		for i := range ps {
@@ -349,11 +824,30 @@ func (s *RESTServer) authzWrapper(handler httprouter.Handle, leastRole Role) htt
 	}
 }
 
+// wantsJSON returns true if the request asks for a JSON response.
+// Clients ask by listing "application/json" in the Accept-Encoding header,
+// possibly along with real encodings such as gzip, or by passing the
+// parameter format=json. Requests to the version 2 routes always get JSON.
+func wantsJSON(r *http.Request) bool {
+	if isV2(r) {
+		return true
+	}
+	for _, v := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(v) == "application/json" {
+			return true
+		}
+	}
+	return r.FormValue("format") == "json"
+}
+
 // logWrapper takes a handler and returns a handler which does the same thing,
-// after first logging the request URL.
+// after first logging the request URL. The request method and path are added
+// to the logger for the request, so later log entries for the request
+// include them.
 func logWrapper(handler httprouter.Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-		log.Println(r.Method, r.URL)
-		handler(w, r, ps)
+		logger := slog.With("method", r.Method, "path", r.URL.Path)
+		logger.Info("request", "query", r.URL.RawQuery)
+		handler(w, withLogger(r, logger), ps)
 	}
 }
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	raven "github.com/getsentry/raven-go"
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/ndlib/bendo/items"
+)
+
+// A SlotMatch is a slot found by a slot search.
+type SlotMatch struct {
+	Item    string
+	Version int // the most recent version of the item
+	Slot    string
+	BlobID  int
+	Blob    *items.Blob `json:",omitempty"`
+	URL     string      // the slot pinned to Version, so it keeps naming the same blob
+}
+
+// A MetaMatch is a version or a blob found by a metadata search. Exactly one
+// of Version and BlobID is not zero.
+type MetaMatch struct {
+	Item    string
+	Version int `json:",omitempty"` // the version having the metadata
+	BlobID  int `json:",omitempty"` // the blob having the metadata
+	Key     string
+	Value   string
+	URL     string `json:",omitempty"` // the blob, for blob metadata
+}
+
+// scanMeta reads the rows of a metadata search, which have the columns
+// item, versionid, blobid, name, and value.
+func scanMeta(rows *sql.Rows, err error) ([]MetaMatch, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []MetaMatch
+	for rows.Next() {
+		var m MetaMatch
+		err = rows.Scan(&m.Item, &m.Version, &m.BlobID, &m.Key, &m.Value)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, m)
+	}
+	return results, rows.Err()
+}
+
+// globToRegexp turns a glob pattern into an anchored regular expression,
+// as used by the QL LIKE operator. A "*" matches any run of characters,
+// including "/", and a "?" matches a single character.
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, c := range glob {
+		switch c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// globToLike turns a glob pattern into a pattern for the SQL LIKE operator,
+// using "\" as the escape character.
+func globToLike(glob string) string {
+	var b strings.Builder
+	for _, c := range glob {
+		switch c {
+		case '*':
+			b.WriteString("%")
+		case '?':
+			b.WriteString("_")
+		case '%', '_', '\\':
+			b.WriteRune('\\')
+			b.WriteRune(c)
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// slotPattern returns the glob pattern to search for given the slot
+// parameter. Values without a "*" or "?" are taken to be a prefix.
+func slotPattern(slot string) string {
+	if strings.ContainsAny(slot, "*?") {
+		return slot
+	}
+	return slot + "*"
+}
+
+// SearchHandler handles requests to GET /search
+// The parameter "slot" is a slot name prefix or glob to look for in the most
+// recent version of every item. The optional parameters "offset" and
+// "limit" (default 100, at most 1000) page through the results.
+func (s *RESTServer) SearchHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.BlobDB == nil {
+		NotImplementedHandler(w, r, ps)
+		return
+	}
+	slot := r.FormValue("slot")
+	if slot == "" {
+		w.WriteHeader(400)
+		w.Write([]byte("slot parameter is required\n"))
+		return
+	}
+	offset, limit := searchParams(r)
+	matches, err := s.BlobDB.FindSlots(slotPattern(slot), offset, limit)
+	if err != nil {
+		requestLogger(r).Error("FindSlots", "slot", slot, "error", err)
+		raven.CaptureError(err, nil)
+		w.WriteHeader(500)
+		return
+	}
+	for i := range matches {
+		m := &matches[i]
+		m.URL = slotURL(r, m.Item, fmt.Sprintf("@%d/%s", m.Version, m.Slot))
+		m.Blob, err = s.BlobDB.FindBlob(m.Item, m.BlobID)
+		if err != nil {
+			requestLogger(r).Error("FindBlob", "item", m.Item, "blob", m.BlobID, "error", err)
+		}
+	}
+	if matches == nil {
+		matches = []SlotMatch{}
+	}
+	writeHTMLorJSON(w, r, searchTemplate, matches)
+}
+
+// searchParams returns the offset and limit parameters of a search request.
+// The limit defaults to 100 and is at most 1000.
+func searchParams(r *http.Request) (int, int) {
+	offset, _ := strconv.Atoi(r.FormValue("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+	if limit > 1000 {
+		limit = 1000
+	}
+	return offset, limit
+}
+
+// MetaSearchHandler handles requests to GET /search/meta
+// The parameter "key" is the metadata key to look for on the versions and
+// blobs of every item, and the optional parameter "value" restricts the
+// matches to those with that value. The parameters "offset" and "limit"
+// page through the results as for SearchHandler.
+func (s *RESTServer) MetaSearchHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.BlobDB == nil {
+		NotImplementedHandler(w, r, ps)
+		return
+	}
+	key := r.FormValue("key")
+	if key == "" {
+		w.WriteHeader(400)
+		w.Write([]byte("key parameter is required\n"))
+		return
+	}
+	offset, limit := searchParams(r)
+	matches, err := s.BlobDB.FindMeta(key, r.FormValue("value"), offset, limit)
+	if err != nil {
+		requestLogger(r).Error("FindMeta", "key", key, "error", err)
+		raven.CaptureError(err, nil)
+		w.WriteHeader(500)
+		return
+	}
+	for i := range matches {
+		m := &matches[i]
+		if m.BlobID != 0 {
+			m.URL = slotURL(r, m.Item, fmt.Sprintf("@blob/%d", m.BlobID))
+		}
+	}
+	if matches == nil {
+		matches = []MetaMatch{}
+	}
+	writeHTMLorJSON(w, r, metaSearchTemplate, matches)
+}
+
+var (
+	searchTemplate = template.Must(template.New("search").Parse(`<html>
+<h1>Slot Search</h1>
+<table><thead><tr>
+	<th>Item</th><th>Version</th><th>Slot</th><th>Blob</th><th>Size</th><th>Mime Type</th>
+</tr></thead><tbody>
+{{ range . }}
+	<tr>
+		<td><a href="/item/{{ .Item }}">{{ .Item }}</a></td>
+		<td>{{ .Version }}</td>
+		<td><a href="{{ .URL }}">{{ .Slot }}</a></td>
+		<td>{{ .BlobID }}</td>
+		{{ with .Blob }}<td>{{ .Size }}</td><td>{{ .MimeType }}</td>{{ else }}<td></td><td></td>{{ end }}
+	</tr>
+{{ else }}
+	<tr><td colspan="6">No matches</td></tr>
+{{ end }}
+</tbody></table>
+</html>`))
+
+	metaSearchTemplate = template.Must(template.New("metasearch").Parse(`<html>
+<h1>Metadata Search</h1>
+<table><thead><tr>
+	<th>Item</th><th>Version</th><th>Blob</th><th>Key</th><th>Value</th>
+</tr></thead><tbody>
+{{ range . }}
+	<tr>
+		<td><a href="/item/{{ .Item }}">{{ .Item }}</a></td>
+		<td>{{ if .Version }}{{ .Version }}{{ end }}</td>
+		<td>{{ if .URL }}<a href="{{ .URL }}">{{ .BlobID }}</a>{{ end }}</td>
+		<td>{{ .Key }}</td>
+		<td>{{ .Value }}</td>
+	</tr>
+{{ else }}
+	<tr><td colspan="5">No matches</td></tr>
+{{ end }}
+</tbody></table>
+</html>`))
+)
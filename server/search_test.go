@@ -0,0 +1,189 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"testing"
+
+	"github.com/ndlib/bendo/items"
+)
+
+func TestSlotPattern(t *testing.T) {
+	var table = []struct {
+		slot, regexp, like string
+	}{
+		{"docs/", `^docs/.*$`, `docs/%`},
+		{"*.tif", `^.*\.tif$`, `%.tif`},
+		{"page-?.jpg", `^page-.\.jpg$`, `page-_.jpg`},
+		{"100%_done", `^100%_done.*$`, `100\%\_done%`},
+	}
+	for _, tab := range table {
+		p := slotPattern(tab.slot)
+		if got := globToRegexp(p); got != tab.regexp {
+			t.Errorf("%q: received regexp %q, expected %q", tab.slot, got, tab.regexp)
+		}
+		if got := globToLike(p); got != tab.like {
+			t.Errorf("%q: received like %q, expected %q", tab.slot, got, tab.like)
+		}
+	}
+}
+
+func runSlotSearchSequence(t *testing.T, db BlobDB) {
+	err := db.IndexItem("search1", &items.Item{
+		ID: "search1",
+		Versions: []*items.Version{
+			{ID: 1, Slots: map[string]items.BlobID{"docs/readme.txt": 1, "x.tif": 2}},
+			{ID: 2, Slots: map[string]items.BlobID{"docs/readme.txt": 1, "y.tif": 3}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.IndexItem("search2", &items.Item{
+		ID: "search2",
+		Versions: []*items.Version{
+			{ID: 1, Slots: map[string]items.BlobID{"docs/readme.txt": 1, "a_b.tif": 2}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var table = []struct {
+		pattern string
+		offset  int
+		expect  []string
+	}{
+		{"docs/*", 0, []string{"search1/docs/readme.txt", "search2/docs/readme.txt"}},
+		{"docs/*", 1, []string{"search2/docs/readme.txt"}},
+		{"*.tif", 0, []string{"search1/y.tif", "search2/a_b.tif"}},
+		{"?.tif", 0, []string{"search1/y.tif"}},
+		{"a_b*", 0, []string{"search2/a_b.tif"}},
+		{"a%b*", 0, nil},
+		{"x.tif", 0, nil}, // only in an older version
+	}
+	for _, tab := range table {
+		matches, err := db.FindSlots(tab.pattern, tab.offset, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, m := range matches {
+			got = append(got, m.Item+"/"+m.Slot)
+		}
+		if len(got) != len(tab.expect) {
+			t.Errorf("%q: received %v, expected %v", tab.pattern, got, tab.expect)
+			continue
+		}
+		for i := range got {
+			if got[i] != tab.expect[i] {
+				t.Errorf("%q: received %v, expected %v", tab.pattern, got, tab.expect)
+				break
+			}
+		}
+	}
+}
+
+func runMetaSearchSequence(t *testing.T, db BlobDB) {
+	item := &items.Item{
+		ID: "meta1",
+		Blobs: []*items.Blob{
+			{ID: 1, Meta: map[string]string{"rights": "CC-BY", "path": "a.txt"}},
+			{ID: 2, Meta: map[string]string{"rights": "InC"}},
+		},
+		Versions: []*items.Version{
+			{ID: 1, Meta: map[string]string{"batch": "7"}},
+		},
+	}
+	err := db.IndexItem("meta1", item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// blob metadata is replaced when the item is indexed again
+	item.Blobs[1].Meta = map[string]string{"rights": "CC-BY"}
+	item.Versions = append(item.Versions, &items.Version{ID: 2, Meta: map[string]string{"batch": "8"}})
+	err = db.IndexItem("meta1", item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var table = []struct {
+		key, value string
+		offset     int
+		expect     []string
+	}{
+		{"rights", "", 0, []string{"blob 1=CC-BY", "blob 2=CC-BY"}},
+		{"rights", "", 1, []string{"blob 2=CC-BY"}},
+		{"rights", "InC", 0, nil},
+		{"batch", "", 0, []string{"version 1=7", "version 2=8"}},
+		{"batch", "8", 0, []string{"version 2=8"}},
+		{"nothing", "", 0, nil},
+	}
+	for _, tab := range table {
+		matches, err := db.FindMeta(tab.key, tab.value, tab.offset, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, m := range matches {
+			if m.BlobID != 0 {
+				got = append(got, fmt.Sprintf("blob %d=%s", m.BlobID, m.Value))
+			} else {
+				got = append(got, fmt.Sprintf("version %d=%s", m.Version, m.Value))
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tab.expect) {
+			t.Errorf("%s=%s: received %v, expected %v", tab.key, tab.value, got, tab.expect)
+		}
+	}
+}
+
+func TestSearchRoute(t *testing.T) {
+	file1 := uploadstring(t, "POST", "/upload", "hello search")
+	fileid := path.Base(file1)
+	slot := "docs/" + fileid + ".txt"
+	itemid := "search" + randomid()
+	txpath := sendtransaction(t, "/item/"+itemid+"/transaction",
+		[][]string{{"add", fileid}, {"slot", slot, fileid}}, 202)
+	waitTransaction(t, txpath)
+
+	checkStatus(t, "GET", "/search", 400)
+	body := getbody(t, "GET", "/search?format=json&slot=docs/"+fileid, 200)
+	var matches []SlotMatch
+	err := json.Unmarshal([]byte(body), &matches)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].Item != itemid || matches[0].Version != 1 ||
+		matches[0].Blob == nil || matches[0].Blob.Size != int64(len("hello search")) ||
+		matches[0].URL != "/item/"+itemid+"/@1/"+slot {
+		t.Errorf("Received %s", body)
+	}
+}
+
+func TestMetaSearchRoute(t *testing.T) {
+	file1 := uploadstring(t, "POST", "/upload", "hello meta search")
+	fileid := path.Base(file1)
+	itemid := "metasearch" + randomid()
+	txpath := sendtransaction(t, "/item/"+itemid+"/transaction",
+		[][]string{{"add", fileid}, {"slot", "a", fileid}, {"blobmeta", fileid, "source", itemid},
+			{"versionmeta", "batch", itemid}}, 202)
+	waitTransaction(t, txpath)
+
+	checkStatus(t, "GET", "/search/meta", 400)
+	body := getbody(t, "GET", "/search/meta?format=json&key=source&value="+itemid, 200)
+	var matches []MetaMatch
+	err := json.Unmarshal([]byte(body), &matches)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].Item != itemid || matches[0].BlobID != 1 ||
+		matches[0].URL != "/item/"+itemid+"/@blob/1" {
+		t.Errorf("Received %s", body)
+	}
+	body = getbody(t, "GET", "/search/meta?format=json&key=batch&value="+itemid, 200)
+	matches = nil
+	err = json.Unmarshal([]byte(body), &matches)
+	if err != nil || len(matches) != 1 || matches[0].Version != 1 || matches[0].URL != "" {
+		t.Errorf("Received %s, %v", body, err)
+	}
+}
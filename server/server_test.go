@@ -8,10 +8,12 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"path"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/ndlib/bendo/apiv2"
 	"github.com/ndlib/bendo/blobcache"
 	"github.com/ndlib/bendo/fragment"
 	"github.com/ndlib/bendo/items"
@@ -89,8 +91,10 @@ func TestTransactionCommands(t *testing.T) {
 		t.Errorf("Received %#v, expected %#v", text, "hello world")
 	}
 	text = getbody(t, "GET", "/item/"+itemid+"/@blob/2", 410)
-	if text != "Blob has been deleted\n" {
-		t.Errorf("Received %#v, expected %#v", text, "Blob has been deleted\n")
+	var u Unavailable
+	err := json.Unmarshal([]byte(text), &u)
+	if err != nil || u.Reason != ReasonDeleted || u.Message != "Blob has been deleted" {
+		t.Errorf("Received %#v, %v", text, err)
 	}
 }
 
@@ -133,6 +137,18 @@ func TestUploadHash(t *testing.T) {
 	}
 }
 
+func TestUploadOffset(t *testing.T) {
+	ourpath := "/upload/uploadoffset" + randomid()
+	uploadoffset(t, ourpath, "world", 6, 200)
+	checkStatus(t, "GET", ourpath, 409) // missing the first piece
+	uploadoffset(t, ourpath, "hello ", 0, 200)
+	uploadoffset(t, ourpath, "there", 2, 409) // overlaps both
+	text := getbody(t, "GET", ourpath, 200)
+	if text != "hello world" {
+		t.Errorf("Received %#v, expected %#v", text, "hello world")
+	}
+}
+
 func TestDeleteFile(t *testing.T) {
 	// add a file, then delete it.
 	filepath := uploadstring(t, "POST", "/upload", "hello world")
@@ -211,6 +227,40 @@ func TestHeadCacheSHA(t *testing.T) {
 	}
 }
 
+func TestZeroLengthFile(t *testing.T) {
+	const emptyMd5HexSum = "d41d8cd98f00b204e9800998ecf8427e"
+
+	filePath := uploadstring(t, "POST", "/upload", "")
+	t.Log("got file path", filePath)
+	text := getbody(t, "GET", filePath, 200)
+	if text != "" {
+		t.Errorf("Received %#v, expected %#v", text, "")
+	}
+
+	itemid := "zero" + randomid()
+	txpath := sendtransaction(t, "/item/"+itemid+"/transaction",
+		[][]string{{"add", path.Base(filePath)}, {"slot", "empty", path.Base(filePath)}}, 202)
+	waitTransaction(t, txpath)
+
+	for _, verb := range []string{"HEAD", "GET"} {
+		resp := checkRoute(t, verb, "/item/"+itemid+"/empty", 200)
+		if resp == nil {
+			t.Fatalf("Unexpected nil response")
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if len(body) != 0 {
+			t.Errorf("%s: Received %#v, expected empty body", verb, string(body))
+		}
+		if v := resp.Header.Get("Content-Length"); v != "0" {
+			t.Errorf("%s: Content-Length expected 0, received %s", verb, v)
+		}
+		if v := resp.Header.Get("X-Content-Md5"); v != emptyMd5HexSum {
+			t.Errorf("%s: X-Content-Md5 expected %s, received %s", verb, emptyMd5HexSum, v)
+		}
+	}
+}
+
 func TestFixityHandler(t *testing.T) {
 	// DLTP-1199: does empty fixity search return "[]" and not "null"?
 	body := getbody(t, "GET", "/fixity?start=2018-12-18&end=2018-12-17", 200)
@@ -219,6 +269,352 @@ func TestFixityHandler(t *testing.T) {
 	}
 }
 
+func TestTransactionTiming(t *testing.T) {
+	const content = "hello timing"
+	file1 := uploadstring(t, "POST", "/upload", content)
+	itemid := "timing" + randomid()
+	txpath := sendtransaction(t, "/item/"+itemid+"/transaction",
+		[][]string{{"add", path.Base(file1)}}, 202)
+	waitTransaction(t, txpath)
+
+	// the status is finished before the item is indexed, so the index time
+	// may be set a moment later
+	var info transaction.Transaction
+	for i := 0; i < 10; i++ {
+		body := getbody(t, "GET", txpath, 200)
+		err := json.Unmarshal([]byte(body), &info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Timing.Index > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if info.Bytes != int64(len(content)) {
+		t.Errorf("Received %d bytes, expected %d", info.Bytes, len(content))
+	}
+	if info.Timing.Verify <= 0 || info.Timing.Ingest <= 0 || info.Timing.Index <= 0 {
+		t.Errorf("Received timing %+v", info.Timing)
+	}
+}
+
+func TestDeleteItem(t *testing.T) {
+	file1 := uploadstring(t, "POST", "/upload", "hello delete")
+	itemid := "delete" + randomid()
+	txpath := sendtransaction(t, "/item/"+itemid+"/transaction",
+		[][]string{{"add", path.Base(file1)}, {"slot", "a", path.Base(file1)}}, 202)
+	waitTransaction(t, txpath)
+	checkStatus(t, "GET", "/item/"+itemid+"/a", 200)
+
+	checkStatus(t, "DELETE", "/item/"+itemid, 200)
+	checkStatus(t, "GET", "/item/"+itemid, 410)
+	checkStatus(t, "GET", "/item/"+itemid+"/a", 410)
+	checkStatus(t, "DELETE", "/item/"+itemid, 404)
+
+	// items with an open transaction cannot be deleted
+	itemid = "delete" + randomid()
+	txpath = sendtransaction(t, "/item/"+itemid+"/transaction",
+		[][]string{{"add", path.Base(file1)}}, 202)
+	waitTransaction(t, txpath)
+	sendtransaction(t, "/item/"+itemid+"/transaction", [][]string{{"sleep"}}, 202)
+	checkStatus(t, "DELETE", "/item/"+itemid, 409)
+}
+
+func TestListItems(t *testing.T) {
+	file1 := uploadstring(t, "POST", "/upload", "hello list")
+	itemid := "list" + randomid()
+	txpath := sendtransaction(t, "/item/"+itemid+"/transaction",
+		[][]string{{"add", path.Base(file1)}}, 202)
+	waitTransaction(t, txpath)
+
+	var list []SimpleItem
+	body := getbody(t, "GET", "/items?creator=nobody&p=2000", 200)
+	err := json.Unmarshal([]byte(body), &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, item := range list {
+		found = found || item.ID == itemid
+	}
+	if !found {
+		t.Errorf("item %s not in list %v", itemid, list)
+	}
+
+	// the total and the page links are in the headers
+	resp := checkRoute(t, "GET", "/items?creator=nobody&p=1", 200)
+	if resp != nil {
+		resp.Body.Close()
+		total := resp.Header.Get("X-Total-Count")
+		if total != strconv.Itoa(len(list)) {
+			t.Errorf("Received X-Total-Count %q, expected %d", total, len(list))
+		}
+		// the first Link header is the successor-version link for the
+		// legacy route
+		links := resp.Header.Values("Link")
+		if len(links) != 2 || !strings.HasPrefix(links[1], `</items?creator=nobody&n=0&p=1>; rel="first"`) {
+			t.Errorf("Received Link %q", links)
+		}
+	}
+
+	body = getbody(t, "GET", "/items?creator=somebody-else", 200)
+	if strings.TrimSpace(body) != "[]" {
+		t.Errorf("Received %s, expected []", body)
+	}
+}
+
+func TestAPIVersions(t *testing.T) {
+	// the versioned routes return versioned locations
+	file1 := uploadstring(t, "POST", APIPrefix+"/upload", "hello version two")
+	if !strings.HasPrefix(file1, APIPrefix+"/upload/") {
+		t.Errorf("Received location %s", file1)
+	}
+	itemid := "vtwo" + randomid()
+	txpath := sendtransaction(t, APIPrefix+"/item/"+itemid+"/transaction",
+		[][]string{{"add", path.Base(file1)}, {"slot", "a", path.Base(file1)}}, 202)
+	if !strings.HasPrefix(txpath, APIPrefix+"/transaction/") {
+		t.Errorf("Received location %s", txpath)
+	}
+	waitTransaction(t, txpath)
+
+	// the versioned routes always return JSON, in the apiv2 schemas
+	var item apiv2.Item
+	var upload apiv2.Upload
+	for _, doc := range []struct {
+		route string
+		v     interface{}
+	}{
+		{APIPrefix + "/item/" + itemid, &item},
+		{APIPrefix + "/upload/" + path.Base(file1) + "/metadata", &upload},
+	} {
+		resp, err := http.Get(testServer.URL + doc.route)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = json.NewDecoder(resp.Body).Decode(doc.v)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf("%s: %v", doc.route, err)
+		}
+	}
+	if item.ID != itemid || len(item.Blobs) != 1 || item.Blobs[0].Size != 17 ||
+		len(item.Versions) != 1 || item.Versions[0].Slots["a"] != 1 || item.Identifiers == nil {
+		t.Errorf("Received %#v", item)
+	}
+	if upload.ID != path.Base(file1) || upload.Size != 17 || upload.Creator != "nobody" {
+		t.Errorf("Received %#v", upload)
+	}
+
+	resp := checkRoute(t, "GET", APIPrefix+"/item/"+itemid+"/a", 200)
+	if resp != nil {
+		resp.Body.Close()
+		if resp.Header.Get("Deprecation") != "" {
+			t.Error("Versioned route has Deprecation header")
+		}
+	}
+
+	// the legacy routes still work, but are marked deprecated
+	resp = checkRoute(t, "GET", "/item/"+itemid+"/a", 200)
+	if resp != nil {
+		resp.Body.Close()
+		if resp.Header.Get("Deprecation") != "true" {
+			t.Error("Legacy route missing Deprecation header")
+		}
+		link := resp.Header.Get("Link")
+		if link != "<"+APIPrefix+"/item/"+itemid+`/a>; rel="successor-version"` {
+			t.Errorf("Received Link header %s", link)
+		}
+		if resp.Header.Get("Location") != "/item/"+itemid+"/@blob/1" {
+			t.Errorf("Received location %s", resp.Header.Get("Location"))
+		}
+	}
+
+	// legacy routes can be turned off
+	s := &RESTServer{
+		Validator: NobodyValidator{},
+		DisableV1: true,
+	}
+	ts := httptest.NewServer(s.addRoutes())
+	defer ts.Close()
+	for _, route := range []struct {
+		path   string
+		status int
+	}{
+		{"/stats", 404},
+		{APIPrefix + "/stats", 501},
+		{"/", 200},
+	} {
+		resp, err := http.Get(ts.URL + route.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != route.status {
+			t.Errorf("%s: Received status %d, expected %d", route.path, resp.StatusCode, route.status)
+		}
+	}
+
+	// the sunset date is sent if one is set
+	s = &RESTServer{V1Sunset: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)}
+	w := httptest.NewRecorder()
+	s.deprecatedWrapper(NotImplementedHandler)(w, httptest.NewRequest("GET", "/stats", nil), nil)
+	if w.Header().Get("Sunset") != "Tue, 01 Jan 2030 00:00:00 GMT" {
+		t.Errorf("Received Sunset header %s", w.Header().Get("Sunset"))
+	}
+}
+
+func TestItemETag(t *testing.T) {
+	item := &items.Item{ID: "etag", Versions: []*items.Version{{ID: 1}}}
+	v := item.Versions[0]
+	a := itemETag(v, itemWithIdentifiers{Item: item})
+	b := itemETag(v, itemWithIdentifiers{Item: item, Identifiers: []string{"doi:10.1000/182"}})
+	if a == b {
+		t.Errorf("Received ETag %s both with and without an identifier", a)
+	}
+	if a != itemETag(v, itemWithIdentifiers{Item: item}) {
+		t.Errorf("ETag %s is not stable", a)
+	}
+}
+
+func TestConditionalGet(t *testing.T) {
+	filePath := uploadstring(t, "POST", "/upload", "hello world")
+	itemid := "cond" + randomid()
+	txpath := sendtransaction(t, "/item/"+itemid+"/transaction",
+		[][]string{{"add", path.Base(filePath)}, {"slot", "greeting", path.Base(filePath)}}, 202)
+	waitTransaction(t, txpath)
+
+	for i, route := range []string{"/item/" + itemid + "/greeting", "/item/" + itemid} {
+		resp := checkRoute(t, "GET", route, 200)
+		if resp == nil {
+			t.Fatalf("Unexpected nil response")
+		}
+		resp.Body.Close()
+		etag := resp.Header.Get("ETag")
+		modified := resp.Header.Get("Last-Modified")
+		if etag == "" || modified == "" {
+			t.Fatalf("%s: Received ETag %q and Last-Modified %q", route, etag, modified)
+		}
+		// the blob is tagged with its checksum, and the item listing only
+		// uses its ETag, since its metadata can change without a new version
+		const helloSHA256 = `"b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"`
+		imsStatus := 304
+		if i == 0 && etag != helloSHA256 {
+			t.Errorf("%s: Received ETag %s, expected %s", route, etag, helloSHA256)
+		} else if i == 1 {
+			imsStatus = 200
+		}
+		var tests = []struct {
+			header string
+			value  string
+			status int
+		}{
+			{"If-None-Match", etag, 304},
+			{"If-None-Match", `"9999", W/` + etag, 304},
+			{"If-None-Match", `"9999"`, 200},
+			{"If-Modified-Since", modified, imsStatus},
+			{"If-Modified-Since", "Mon, 01 Jan 2001 00:00:00 GMT", 200},
+		}
+		for _, test := range tests {
+			req, _ := http.NewRequest("GET", testServer.URL+route, nil)
+			req.Header.Set(test.header, test.value)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.status {
+				t.Errorf("%s %s %s: Received status %d, expected %d",
+					route, test.header, test.value, resp.StatusCode, test.status)
+			}
+		}
+	}
+}
+
+func TestStoredMimeType(t *testing.T) {
+	filePath := uploadstring(t, "POST", "/upload", "name,count\nbendo,1\n")
+	itemid := "mime" + randomid()
+	txpath := sendtransaction(t, "/item/"+itemid+"/transaction",
+		[][]string{{"add", path.Base(filePath)},
+			{"slot", "counts.csv", path.Base(filePath)},
+			{"mimetype", path.Base(filePath), "text/csv"}}, 202)
+	waitTransaction(t, txpath)
+
+	for _, verb := range []string{"HEAD", "GET"} {
+		resp := checkRoute(t, verb, "/item/"+itemid+"/counts.csv", 200)
+		if resp == nil {
+			t.Fatalf("Unexpected nil response")
+		}
+		resp.Body.Close()
+		if v := resp.Header.Get("Content-Type"); v != "text/csv" {
+			t.Errorf("%s: Content-Type expected text/csv, received %s", verb, v)
+		}
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	var tests = []struct {
+		query  string
+		slot   string
+		expect string
+	}{
+		{"", "a/path/file.pdf", `inline; filename=file.pdf`},
+		{"", "@3/a/path/file.pdf", `inline; filename=file.pdf`},
+		{"", "@blob/25", ``},
+		{"?download=1", "@blob/25", `attachment`},
+		{"?download=true", "file.pdf", `attachment; filename=file.pdf`},
+		{"?filename=report.pdf", "@blob/25", `inline; filename=report.pdf`},
+		{"?download=1&filename=my%20report.pdf", "file.pdf", `attachment; filename="my report.pdf"`},
+		{"?filename=r%C3%A9sum%C3%A9.pdf", "file.pdf", `inline; filename*=utf-8''r%C3%A9sum%C3%A9.pdf`},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/item/abc/"+test.slot+test.query, nil)
+		result := contentDisposition(r, test.slot)
+		if result != test.expect {
+			t.Errorf("%s%s: received %q, expected %q", test.slot, test.query, result, test.expect)
+		}
+	}
+}
+
+func TestPinnedVersion(t *testing.T) {
+	file1 := path.Base(uploadstring(t, "POST", "/upload", "first version"))
+	file2 := path.Base(uploadstring(t, "POST", "/upload", "second version"))
+	itemid := "pinned" + randomid()
+	txpath := sendtransaction(t, "/item/"+itemid+"/transaction",
+		[][]string{{"add", file1}, {"slot", "a b", file1}}, 202)
+	waitTransaction(t, txpath)
+	txpath = sendtransaction(t, "/item/"+itemid+"/transaction",
+		[][]string{{"add", file2}, {"slot", "a b", file2}}, 202)
+	waitTransaction(t, txpath)
+
+	var tests = []struct {
+		path     string
+		pinned   string
+		expected string
+	}{
+		{"/a%20b", "/@2/a%20b", "second version"},
+		{"/a%20b?version=1", "/@1/a%20b", "first version"},
+		{"/@1/a%20b", "/@1/a%20b", "first version"},
+	}
+	for _, test := range tests {
+		resp := checkRoute(t, "GET", "/item/"+itemid+test.path, 200)
+		if resp == nil {
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != test.expected {
+			t.Errorf("%s: received %q, expected %q", test.path, body, test.expected)
+		}
+		if loc := resp.Header.Get("Content-Location"); loc != "/item/"+itemid+test.pinned {
+			t.Errorf("%s: received Content-Location %s", test.path, loc)
+		}
+	}
+	checkStatus(t, "GET", "/item/"+itemid+"/a%20b?version=3", 404)
+	checkStatus(t, "GET", "/item/"+itemid+"/a%20b?version=x", 400)
+	checkStatus(t, "GET", "/item/"+itemid+"/@1/a%20b?version=1", 400)
+}
+
 //
 // Test Helpers
 //
@@ -251,6 +647,24 @@ func uploadstringhash(t *testing.T, verb, route, s, hash string, statuscode int)
 	return resp.Header.Get("Location")
 }
 
+func uploadoffset(t *testing.T, route, s string, offset int, statuscode int) {
+	req, err := http.NewRequest("POST", testServer.URL+route, strings.NewReader(s))
+	if err != nil {
+		t.Fatal("Problem creating request", err)
+	}
+	md5hash := md5.Sum([]byte(s))
+	req.Header.Set("X-Upload-Md5", hex.EncodeToString(md5hash[:]))
+	req.Header.Set("X-Upload-Offset", strconv.Itoa(offset))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(route, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != statuscode {
+		t.Errorf("%s: Received status %d, expected %d", route, resp.StatusCode, statuscode)
+	}
+}
+
 func sendtransaction(t *testing.T, route string, commands [][]string, statuscode int) string {
 	content, _ := json.Marshal(commands)
 	return uploadstringhash(t, "POST", route, string(content), "", statuscode)
@@ -314,9 +728,23 @@ func waitTransaction(t *testing.T, txpath string) {
 	for i := 0; i < 10; i++ {
 		time.Sleep(10 * time.Millisecond) // sleep a squinch
 		resp := checkRoute(t, "GET", txpath, 200)
-		var info struct{ Status transaction.Status }
 		dec := json.NewDecoder(resp.Body)
+		if strings.HasPrefix(txpath, APIPrefix+"/") {
+			var info apiv2.Transaction
+			err := dec.Decode(&info)
+			resp.Body.Close()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if info.Status == apiv2.StatusFinished || info.Status == apiv2.StatusError {
+				return
+			}
+			continue
+		}
+		var info struct{ Status transaction.Status }
 		err := dec.Decode(&info)
+		resp.Body.Close()
 		if err != nil {
 			t.Error(err)
 			return
@@ -336,19 +764,34 @@ func init() {
 	db, _ := NewQlCache("mem--server")
 	server := &RESTServer{
 		Validator:      NobodyValidator{},
-		Items:          items.NewWithCache(store.NewMemory(), items.NewMemoryCache()),
+		Items:          items.NewWithCache(store.NewMemory(), db),
 		TxStore:        transaction.New(store.NewMemory()),
 		FileStore:      fragment.New(store.NewMemory()),
 		Cache:          blobcache.NewLRU(store.NewMemory(), 400),
 		BlobDB:         db,
 		FixityDatabase: db,
-		useTape:        true,
+		Identifiers:    db,
+		Access:         db,
+		Usage:          db,
+		Tombstones:     db,
+		Audit:          db,
+		Events:         db,
+		Minter:         &SequentialMinter{Prefix: "minted", Next: 1, DB: db},
+		Mints:          db,
+		TxTemplates: map[string][][]string{
+			"add-files": {{"add", "{file}"}, {"slot", "{dir}/{file}", "{file}"}, {"note", "{note}"}},
+		},
+		useTape: true,
 	}
 	server.txqueue = make(chan string)
+	server.txsmall = make(chan string)
 	server.txcancel = make(chan struct{})
 	for i := 0; i < MaxConcurrentCommits; i++ {
 		go server.transactionWorker(server.txqueue)
 	}
+	for i := 0; i < SmallLaneCommits; i++ {
+		go server.transactionWorker(server.txsmall)
+	}
 
 	server.TxStore.Load()
 	testServer = httptest.NewServer(server.addRoutes())
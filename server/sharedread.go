@@ -0,0 +1,320 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"io"
+	"sync"
+	"time"
+)
+
+// Blobs too large for the cache are read straight from tape for each
+// request. So a burst of requests for one such blob does not send every one
+// of them to the tape drives, requests which arrive while a read of the blob
+// is starting share it: one goroutine reads the blob, and every request gets
+// a copy of each chunk read.
+//
+// The readers are kept within sharedReadLimit bytes of each other, so a slow
+// client slows the others. If the fastest reader is kept waiting for
+// sharedReadStall, the slowest reader is detached and given its own read of
+// the blob, so one stalled client cannot hold up everyone.
+//
+// Each shared read has its own context, which is cancelled once every
+// reader has closed, so a read from tape nobody is waiting for stops.
+
+const sharedReadChunk = 1 << 20
+
+// these are vars so the tests can shorten them.
+var (
+	sharedReadLimit int64 = 64 << 20
+	sharedReadStall       = 30 * time.Second
+)
+
+var (
+	xSharedReads   = expvar.NewInt("tape.read.shared")
+	xSharedDetachs = expvar.NewInt("tape.read.detached")
+)
+
+// errAbandoned is set on a shared read when every reader has closed.
+var errAbandoned = errors.New("shared read abandoned")
+
+// sharedReads is the set of shared reads in progress, by cache key.
+type sharedReads struct {
+	m     sync.Mutex
+	reads map[string]*sharedRead
+}
+
+// open returns a reader for the blob with the given key. If a read of the
+// blob has started and has not yet discarded any of it, the reader shares
+// that read. Otherwise open is called to start a new one, with a context
+// derived from ctx which is cancelled when the read is abandoned. Since
+// opening a blob can wait on a tape drive, open is called without holding
+// sh.m, and requests for the same blob wait for it to finish instead.
+func (sh *sharedReads) open(ctx context.Context, key string, open func(context.Context) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	sh.m.Lock()
+	for {
+		sr := sh.reads[key]
+		if sr == nil {
+			break
+		}
+		sh.m.Unlock()
+		select {
+		case <-sr.ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if r := sr.join(); r != nil {
+			xSharedReads.Add(1)
+			return r, nil
+		}
+		sh.m.Lock()
+		if sh.reads[key] == sr {
+			// the read has moved on, so start another
+			break
+		}
+	}
+	readctx, cancel := context.WithCancel(ctx)
+	sr := &sharedRead{
+		parent:  ctx,
+		ctx:     readctx,
+		cancel:  cancel,
+		open:    open,
+		ready:   make(chan struct{}),
+		changed: make(chan struct{}),
+		readers: make(map[*sharedReader]bool),
+	}
+	r := sr.join()
+	if sh.reads == nil {
+		sh.reads = make(map[string]*sharedRead)
+	}
+	sh.reads[key] = sr
+	sh.m.Unlock()
+
+	src, err := open(readctx)
+	if err != nil {
+		// anyone waiting will not be able to join, and will try again
+		sr.m.Lock()
+		sr.err = err
+		sr.m.Unlock()
+		cancel()
+		sh.remove(key, sr)
+		close(sr.ready)
+		return nil, err
+	}
+	close(sr.ready)
+	go func() {
+		sr.run(src)
+		sh.remove(key, sr)
+	}()
+	return r, nil
+}
+
+// remove takes sr out of the set, if it is still the read for key.
+func (sh *sharedReads) remove(key string, sr *sharedRead) {
+	sh.m.Lock()
+	if sh.reads[key] == sr {
+		delete(sh.reads, key)
+	}
+	sh.m.Unlock()
+}
+
+// A sharedRead is a single read of a blob whose content is passed to any
+// number of sharedReaders.
+type sharedRead struct {
+	parent context.Context                              // for readers which are detached
+	open   func(context.Context) (io.ReadCloser, error) // for readers which are detached
+	ctx    context.Context                              // the context of the shared read
+	cancel context.CancelFunc                           // ends the shared read
+	ready  chan struct{}                                // closed once the blob has been opened, or failed to
+
+	m       sync.Mutex
+	chunks  [][]byte // the data from offset base to end
+	base    int64
+	end     int64
+	err     error         // io.EOF once the blob has been read, or the error reading it
+	changed chan struct{} // closed and replaced whenever anything changes
+	readers map[*sharedReader]bool
+}
+
+// join returns a new reader for sr, or nil if the start of the blob has
+// already been discarded or the read has ended.
+func (sr *sharedRead) join() *sharedReader {
+	sr.m.Lock()
+	defer sr.m.Unlock()
+	if sr.base > 0 || sr.err != nil || sr.ctx.Err() != nil {
+		return nil
+	}
+	r := &sharedReader{sr: sr}
+	sr.readers[r] = true
+	return r
+}
+
+// wake tells everyone waiting that something has changed. sr.m must be held.
+func (sr *sharedRead) wake() {
+	close(sr.changed)
+	sr.changed = make(chan struct{})
+}
+
+// slowest returns the reader furthest behind, or nil if there are no
+// readers. sr.m must be held.
+func (sr *sharedRead) slowest() *sharedReader {
+	var result *sharedReader
+	for r := range sr.readers {
+		if result == nil || r.pos < result.pos {
+			result = r
+		}
+	}
+	return result
+}
+
+// trim discards the chunks every reader has read, and returns true if any
+// were. sr.m must be held.
+func (sr *sharedRead) trim() bool {
+	slow := sr.slowest()
+	if slow == nil {
+		return false
+	}
+	trimmed := false
+	for len(sr.chunks) > 0 && sr.base+int64(len(sr.chunks[0])) <= slow.pos {
+		sr.base += int64(len(sr.chunks[0]))
+		sr.chunks[0] = nil
+		sr.chunks = sr.chunks[1:]
+		trimmed = true
+	}
+	return trimmed
+}
+
+// run copies src into sr until it is exhausted, there is an error, or every
+// reader has closed. It closes src when done.
+func (sr *sharedRead) run(src io.ReadCloser) {
+	defer sr.cancel()
+	defer src.Close()
+	for {
+		sr.m.Lock()
+		for len(sr.readers) > 0 && sr.end-sr.base >= sharedReadLimit {
+			changed := sr.changed
+			sr.m.Unlock()
+			select {
+			case <-changed:
+			case <-time.After(sharedReadStall):
+				sr.m.Lock()
+				if slow := sr.slowest(); slow != nil {
+					slow.detached = true
+					delete(sr.readers, slow)
+					xSharedDetachs.Add(1)
+					sr.trim()
+					sr.wake()
+				}
+				sr.m.Unlock()
+			}
+			sr.m.Lock()
+		}
+		if len(sr.readers) == 0 {
+			sr.err = errAbandoned
+			sr.m.Unlock()
+			return
+		}
+		sr.m.Unlock()
+
+		buf := make([]byte, sharedReadChunk)
+		n, err := io.ReadFull(src, buf)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+
+		sr.m.Lock()
+		if n > 0 {
+			sr.chunks = append(sr.chunks, buf[:n])
+			sr.end += int64(n)
+		}
+		sr.err = err
+		sr.wake()
+		sr.m.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// A sharedReader reads the content of a sharedRead. If it falls too far
+// behind it is detached, and then reads from its own copy of the blob.
+type sharedReader struct {
+	sr       *sharedRead
+	pos      int64
+	detached bool          // guarded by sr.m
+	own      io.ReadCloser // used once detached
+}
+
+func (r *sharedReader) Read(p []byte) (int, error) {
+	sr := r.sr
+	sr.m.Lock()
+	for !r.detached {
+		if r.pos < sr.end {
+			n := 0
+			offset := r.pos - sr.base
+			for _, chunk := range sr.chunks {
+				if offset >= int64(len(chunk)) {
+					offset -= int64(len(chunk))
+					continue
+				}
+				n = copy(p, chunk[offset:])
+				break
+			}
+			r.pos += int64(n)
+			if sr.trim() {
+				// there may be room to read more
+				sr.wake()
+			}
+			sr.m.Unlock()
+			return n, nil
+		}
+		if sr.err != nil {
+			err := sr.err
+			sr.m.Unlock()
+			return 0, err
+		}
+		changed := sr.changed
+		sr.m.Unlock()
+		<-changed
+		sr.m.Lock()
+	}
+	sr.m.Unlock()
+	return r.readOwn(p)
+}
+
+// readOwn reads from the reader's own copy of the blob, opening it and
+// skipping to the current position if needed.
+func (r *sharedReader) readOwn(p []byte) (int, error) {
+	if r.own == nil {
+		src, err := r.sr.open(r.sr.parent)
+		if err != nil {
+			return 0, err
+		}
+		r.own = src
+		_, err = io.CopyN(io.Discard, src, r.pos)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.own.Read(p)
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *sharedReader) Close() error {
+	sr := r.sr
+	sr.m.Lock()
+	delete(sr.readers, r)
+	if len(sr.readers) == 0 {
+		// stop a read which may be waiting on the store
+		sr.cancel()
+	}
+	sr.trim()
+	sr.wake()
+	sr.m.Unlock()
+	if r.own != nil {
+		return r.own.Close()
+	}
+	return nil
+}
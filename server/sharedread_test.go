@@ -0,0 +1,251 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// gatedReader blocks reads until its gate is closed.
+type gatedReader struct {
+	gate <-chan struct{}
+	r    io.Reader
+}
+
+func (g *gatedReader) Read(p []byte) (int, error) {
+	<-g.gate
+	return g.r.Read(p)
+}
+
+func testBlob(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestSharedRead(t *testing.T) {
+	data := testBlob(5*sharedReadChunk + 123)
+	gate := make(chan struct{})
+	var opens int32
+	open := func(ctx context.Context) (io.ReadCloser, error) {
+		atomic.AddInt32(&opens, 1)
+		return io.NopCloser(&gatedReader{gate: gate, r: bytes.NewReader(data)}), nil
+	}
+	var sh sharedReads
+	var readers []io.ReadCloser
+	for i := 0; i < 4; i++ {
+		r, err := sh.open(context.Background(), "a", open)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readers = append(readers, r)
+	}
+	close(gate)
+	var wg sync.WaitGroup
+	for _, r := range readers {
+		wg.Add(1)
+		go func(r io.ReadCloser) {
+			defer wg.Done()
+			defer r.Close()
+			got, err := io.ReadAll(r)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("Received %d bytes, %v", len(got), err)
+			}
+		}(r)
+	}
+	wg.Wait()
+	if opens != 1 {
+		t.Errorf("Received %d opens, expected 1", opens)
+	}
+
+	// a finished read is not joined
+	r, err := sh.open(context.Background(), "a", open)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(got, data) || opens != 2 {
+		t.Errorf("Received %d bytes, %v, %d opens", len(got), err, opens)
+	}
+}
+
+func TestSharedReadDetach(t *testing.T) {
+	defer func(limit int64, stall time.Duration) {
+		sharedReadLimit = limit
+		sharedReadStall = stall
+	}(sharedReadLimit, sharedReadStall)
+	sharedReadLimit = 2 * sharedReadChunk
+	sharedReadStall = 20 * time.Millisecond
+
+	data := testBlob(6 * sharedReadChunk)
+	var opens int32
+	open := func(ctx context.Context) (io.ReadCloser, error) {
+		atomic.AddInt32(&opens, 1)
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	var sh sharedReads
+	fast, _ := sh.open(context.Background(), "b", open)
+	slow, _ := sh.open(context.Background(), "b", open)
+	// the slow reader reads a little and then stalls
+	buf := make([]byte, 1000)
+	n, err := io.ReadFull(slow, buf)
+	if err != nil || !bytes.Equal(buf[:n], data[:n]) {
+		t.Fatal(n, err)
+	}
+	got, err := io.ReadAll(fast)
+	fast.Close()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Received %d bytes, %v", len(got), err)
+	}
+	// the slow reader was detached and gets its own copy
+	got, err = io.ReadAll(slow)
+	slow.Close()
+	if err != nil || !bytes.Equal(got, data[1000:]) {
+		t.Errorf("Received %d bytes, %v", len(got), err)
+	}
+	if opens != 2 {
+		t.Errorf("Received %d opens, expected 2", opens)
+	}
+}
+
+func TestSharedReadAbandon(t *testing.T) {
+	data := testBlob(3 * sharedReadChunk)
+	closed := make(chan struct{})
+	open := func(ctx context.Context) (io.ReadCloser, error) {
+		return &closeNotifier{Reader: bytes.NewReader(data), closed: closed}, nil
+	}
+	var sh sharedReads
+	r, _ := sh.open(context.Background(), "c", open)
+	r.Close()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("source was not closed")
+	}
+}
+
+func TestSharedReadCancel(t *testing.T) {
+	closed := make(chan struct{})
+	open := func(ctx context.Context) (io.ReadCloser, error) {
+		// a read which waits on the store until it is cancelled
+		return &closeNotifier{Reader: &ctxBlockedReader{ctx}, closed: closed}, nil
+	}
+	var sh sharedReads
+	r, _ := sh.open(context.Background(), "d", open)
+	r.Close()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("blocked read was not cancelled")
+	}
+}
+
+func TestSharedReadSlowOpen(t *testing.T) {
+	data := testBlob(sharedReadChunk + 45)
+	entered := make(chan struct{})
+	mounted := make(chan struct{})
+	gate := make(chan struct{})
+	var opens int32
+	// opening the blob waits for a tape to be mounted
+	slow := func(ctx context.Context) (io.ReadCloser, error) {
+		if atomic.AddInt32(&opens, 1) == 1 {
+			close(entered)
+		}
+		<-mounted
+		return io.NopCloser(&gatedReader{gate: gate, r: bytes.NewReader(data)}), nil
+	}
+	var sh sharedReads
+	results := make(chan io.ReadCloser, 2)
+	opener := func() {
+		r, err := sh.open(context.Background(), "e", slow)
+		if err != nil {
+			t.Error(err)
+		}
+		results <- r
+	}
+	go opener()
+	<-entered
+	go opener()
+
+	// other blobs can be opened in the meantime
+	done := make(chan struct{})
+	go func() {
+		r, err := sh.open(context.Background(), "f", func(ctx context.Context) (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(data)), nil
+		})
+		if err == nil {
+			r.Close()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("open of another blob waited for a slow open")
+	}
+
+	close(mounted)
+	readers := []io.ReadCloser{<-results, <-results}
+	close(gate)
+	for _, r := range readers {
+		if r == nil {
+			continue
+		}
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("Received %d bytes, %v", len(got), err)
+		}
+	}
+	if opens != 1 {
+		t.Errorf("Received %d opens, expected 1", opens)
+	}
+
+	// a reader waiting on an open which fails makes its own attempt
+	var calls int32
+	failing := func(ctx context.Context) (io.ReadCloser, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	if _, err := sh.open(context.Background(), "g", failing); err != io.ErrUnexpectedEOF {
+		t.Errorf("Received %v, expected %v", err, io.ErrUnexpectedEOF)
+	}
+	r, err := sh.open(context.Background(), "g", failing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(got, data) || calls != 2 {
+		t.Errorf("Received %d bytes after %d opens", len(got), calls)
+	}
+}
+
+// ctxBlockedReader blocks reads until its context is done.
+type ctxBlockedReader struct {
+	ctx context.Context
+}
+
+func (c *ctxBlockedReader) Read(p []byte) (int, error) {
+	<-c.ctx.Done()
+	return 0, c.ctx.Err()
+}
+
+type closeNotifier struct {
+	io.Reader
+	closed chan struct{}
+}
+
+func (c *closeNotifier) Close() error {
+	close(c.closed)
+	return nil
+}
@@ -0,0 +1,276 @@
+package server
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+	"github.com/julienschmidt/httprouter"
+)
+
+// A StorageAlert is a soft quota on the bytes kept in the item store, either
+// in total or by the items whose ids begin with a prefix. Nothing is refused
+// when one is crossed; instead an alert is sent, so the volume can be grown
+// before it is full.
+type StorageAlert struct {
+	Prefix string // only items beginning with this are counted. Empty for the whole store
+	Bytes  int64  // the soft quota
+	Levels []int  // the percentages of Bytes at which to alert. 100 if empty
+}
+
+// levels returns the alert levels of a, smallest first.
+func (a StorageAlert) levels() []int {
+	if len(a.Levels) == 0 {
+		return []int{100}
+	}
+	result := append([]int(nil), a.Levels...)
+	sort.Ints(result)
+	return result
+}
+
+// A StorageStatus describes how much of one StorageAlert is used, and when
+// it will be used up if the recent growth continues.
+type StorageStatus struct {
+	Prefix      string
+	Bytes       int64     // the soft quota
+	Used        int64     // bytes in the items counted
+	Items       int       // the number of items counted
+	Percent     float64   // Used as a percentage of Bytes
+	Level       int       // the highest alert level crossed, or 0 if none
+	DailyGrowth int64     // average bytes added each day over the growth period
+	Full        time.Time // when Used is projected to reach Bytes. Zero if it is not growing
+}
+
+// A StorageReport gives the status of every StorageAlert.
+type StorageReport struct {
+	Generated  time.Time
+	GrowthDays int // the number of days of usage the growth is averaged over
+	Alerts     []StorageStatus
+}
+
+// A StorageNotice is POSTed to each of the StorageAlertURLs when the usage
+// of a StorageAlert crosses one of its levels.
+type StorageNotice struct {
+	Server string // the host name of this server
+	StorageStatus
+}
+
+// storageState remembers the alert level each StorageAlert was last seen at,
+// so an alert is only sent when a level is newly crossed.
+type storageState struct {
+	m      sync.Mutex
+	levels map[string]int // the alert level by prefix
+}
+
+// defaultGrowthDays is the number of days growth is averaged over when
+// StorageGrowthDays is not set.
+const defaultGrowthDays = 30
+
+var (
+	xStorageUsed    = expvar.NewMap("storage.used")
+	xStoragePercent = expvar.NewMap("storage.percent")
+	xStorageAlert   = expvar.NewInt("storage.alert")
+)
+
+// buildStorageReport tallies the sizes of the given items and the bytes added
+// to items each day, given by the usage records, into a report on each of
+// the alerts as of the time now. Growth is averaged over the given number of
+// days.
+func buildStorageReport(list []SimpleItem, usage []UsageRecord, alerts []StorageAlert, now time.Time, days int) StorageReport {
+	report := StorageReport{
+		Generated:  now,
+		GrowthDays: days,
+		Alerts:     []StorageStatus{},
+	}
+	since := usageDay(now).AddDate(0, 0, -(days - 1))
+	for _, a := range alerts {
+		status := StorageStatus{Prefix: a.Prefix, Bytes: a.Bytes}
+		for _, item := range list {
+			if strings.HasPrefix(item.ID, a.Prefix) {
+				status.Used += item.Size
+				status.Items++
+			}
+		}
+		var added int64
+		for _, rec := range usage {
+			if rec.Kind == UsageItem && !rec.Day.Before(since) && strings.HasPrefix(rec.Name, a.Prefix) {
+				added += rec.Bytes
+			}
+		}
+		status.DailyGrowth = added / int64(days)
+		if a.Bytes > 0 {
+			status.Percent = 100 * float64(status.Used) / float64(a.Bytes)
+			for _, level := range a.levels() {
+				if status.Percent >= float64(level) {
+					status.Level = level
+				}
+			}
+			left := a.Bytes - status.Used
+			if left <= 0 {
+				status.Full = now
+			} else if status.DailyGrowth > 0 {
+				status.Full = now.AddDate(0, 0, int(left/status.DailyGrowth))
+			}
+		}
+		report.Alerts = append(report.Alerts, status)
+	}
+	return report
+}
+
+// storageReport makes a StorageReport for the current contents of the item
+// store.
+func (s *RESTServer) storageReport() (StorageReport, error) {
+	days := s.StorageGrowthDays
+	if days <= 0 {
+		days = defaultGrowthDays
+	}
+	list, err := s.Access.ItemAccessList()
+	if err != nil {
+		return StorageReport{}, err
+	}
+	var usage []UsageRecord
+	if s.Usage != nil {
+		usage, err = s.Usage.UsageSince(time.Now().AddDate(0, 0, -days))
+		if err != nil {
+			return StorageReport{}, err
+		}
+	}
+	return buildStorageReport(list, usage, s.StorageAlerts, time.Now(), days), nil
+}
+
+// StartStorageAlerts starts the background goroutine which checks the item
+// store against the StorageAlerts every StorageCheckInterval. It returns
+// immediately and does not block.
+func (s *RESTServer) StartStorageAlerts() {
+	go func() {
+		slog.Info("Starting storage alerts")
+		for {
+			s.checkStorage()
+			time.Sleep(s.StorageCheckInterval)
+		}
+	}()
+}
+
+// checkStorage updates the storage metrics, and sends an alert for each
+// StorageAlert which has crossed a higher level since it was last checked.
+// The levels are not remembered across restarts, so the alerts for any
+// levels already crossed are sent again by the first check.
+func (s *RESTServer) checkStorage() {
+	report, err := s.storageReport()
+	if err != nil {
+		slog.Error("storage report", "error", err)
+		raven.CaptureError(err, nil)
+		return
+	}
+	s.storage.m.Lock()
+	if s.storage.levels == nil {
+		s.storage.levels = make(map[string]int)
+	}
+	var crossed []StorageStatus
+	for _, status := range report.Alerts {
+		name := storageMetricName(status.Prefix)
+		used := new(expvar.Int)
+		used.Set(status.Used)
+		xStorageUsed.Set(name, used)
+		percent := new(expvar.Float)
+		percent.Set(status.Percent)
+		xStoragePercent.Set(name, percent)
+		if status.Level > s.storage.levels[status.Prefix] {
+			crossed = append(crossed, status)
+		}
+		// a level which is no longer crossed may alert again later
+		s.storage.levels[status.Prefix] = status.Level
+	}
+	s.storage.m.Unlock()
+	for _, status := range crossed {
+		s.sendStorageAlert(status)
+	}
+}
+
+// sendStorageAlert logs that status has crossed an alert level, and POSTs a
+// StorageNotice about it to each of the StorageAlertURLs in the background.
+func (s *RESTServer) sendStorageAlert(status StorageStatus) {
+	xStorageAlert.Add(1)
+	msg := fmt.Sprintf("Storage for %q is %.1f%% used (%d of %d bytes)",
+		status.Prefix, status.Percent, status.Used, status.Bytes)
+	slog.Warn(msg, "level", status.Level, "full", status.Full)
+	raven.CaptureMessage(msg, map[string]string{"prefix": status.Prefix})
+	if len(s.StorageAlertURLs) == 0 {
+		return
+	}
+	n := StorageNotice{StorageStatus: status}
+	n.Server, _ = os.Hostname()
+	body, err := json.Marshal(n)
+	if err != nil {
+		slog.Error("Encoding storage alert", "error", err)
+		return
+	}
+	for _, u := range s.StorageAlertURLs {
+		go postCallback(u, body, "storage", status.Prefix)
+	}
+}
+
+// storageMetricName returns the name the metrics for the given prefix are
+// kept under.
+func storageMetricName(prefix string) string {
+	if prefix == "" {
+		return "*"
+	}
+	return prefix
+}
+
+// StorageHandler handles requests to GET /admin/reports/storage
+// It shows how much of each storage alert's soft quota is used, and when it
+// is projected to be used up.
+func (s *RESTServer) StorageHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.Access == nil {
+		NotImplementedHandler(w, r, ps)
+		return
+	}
+	report, err := s.storageReport()
+	if err != nil {
+		requestLogger(r).Error("storage report", "error", err)
+		raven.CaptureError(err, nil)
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err)
+		return
+	}
+	writeHTMLorJSON(w, r, storageTemplate, report)
+}
+
+var (
+	storageTemplate = template.Must(template.New("storage").Parse(`<html>
+<h1>Storage Alerts</h1>
+<dl>
+<dt>Generated</dt><dd>{{ .Generated }}</dd>
+<dt>Growth averaged over</dt><dd>{{ .GrowthDays }} days</dd>
+</dl>
+<table><thead><tr>
+	<th>Prefix</th><th>Items</th><th>Used</th><th>Quota</th><th>Percent</th><th>Level</th><th>Daily Growth</th><th>Projected Full</th>
+</tr></thead><tbody>
+{{ range .Alerts }}
+	<tr>
+		<td>{{ if .Prefix }}{{ .Prefix }}{{ else }}(all){{ end }}</td>
+		<td>{{ .Items }}</td>
+		<td>{{ .Used }}</td>
+		<td>{{ .Bytes }}</td>
+		<td>{{ printf "%.1f" .Percent }}</td>
+		<td>{{ if .Level }}{{ .Level }}%{{ end }}</td>
+		<td>{{ .DailyGrowth }}</td>
+		<td>{{ if .Full.IsZero }}never{{ else }}{{ .Full.Format "2006-01-02" }}{{ end }}</td>
+	</tr>
+{{ else }}
+	<tr><td colspan="8">No storage alerts are configured.</td></tr>
+{{ end }}
+</tbody></table>
+</html>`))
+)
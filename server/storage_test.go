@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBuildStorageReport(t *testing.T) {
+	now := time.Date(2020, 3, 10, 12, 0, 0, 0, time.UTC)
+	list := []SimpleItem{
+		{ID: "abc1", Size: 400},
+		{ID: "abc2", Size: 200},
+		{ID: "xyz1", Size: 300},
+	}
+	usage := []UsageRecord{
+		{Kind: UsageItem, Name: "abc1", Day: usageDay(now), Bytes: 80},
+		{Kind: UsageItem, Name: "abc2", Day: usageDay(now).AddDate(0, 0, -9), Bytes: 20},
+		{Kind: UsageItem, Name: "abc2", Day: usageDay(now).AddDate(0, 0, -10), Bytes: 1000}, // too old
+		{Kind: UsageToken, Name: "abc", Day: usageDay(now), Bytes: 1000},
+		{Kind: UsageItem, Name: "xyz1", Day: usageDay(now), Bytes: 50},
+	}
+	alerts := []StorageAlert{
+		{Bytes: 1000, Levels: []int{95, 80}},
+		{Prefix: "abc", Bytes: 700, Levels: []int{50, 80}},
+		{Prefix: "xyz", Bytes: 200},
+		{Prefix: "none", Bytes: 100},
+	}
+	report := buildStorageReport(list, usage, alerts, now, 10)
+	if len(report.Alerts) != 4 {
+		t.Fatalf("Received %v", report.Alerts)
+	}
+	var table = []struct {
+		used   int64
+		items  int
+		level  int
+		growth int64
+		full   time.Time
+	}{
+		{900, 3, 80, 15, now.AddDate(0, 0, 6)},
+		{600, 2, 80, 10, now.AddDate(0, 0, 10)},
+		{300, 1, 100, 5, now},
+		{0, 0, 0, 0, time.Time{}},
+	}
+	for i, tab := range table {
+		st := report.Alerts[i]
+		if st.Used != tab.used || st.Items != tab.items || st.Level != tab.level ||
+			st.DailyGrowth != tab.growth || !st.Full.Equal(tab.full) {
+			t.Errorf("%d: Received %#v", i, st)
+		}
+	}
+}
+
+// storageAccess is an AccessDB which only lists items.
+type storageAccess struct {
+	list []SimpleItem
+}
+
+func (a *storageAccess) RecordAccess(item string, when time.Time) error { return nil }
+
+func (a *storageAccess) ItemDownloads(item string, since time.Time) ([]DownloadRecord, error) {
+	return nil, nil
+}
+
+func (a *storageAccess) ItemAccessList() ([]SimpleItem, error) {
+	return append([]SimpleItem(nil), a.list...), nil
+}
+
+func TestStorageAlerts(t *testing.T) {
+	var received []StorageNotice
+	done := make(chan struct{}, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n StorageNotice
+		err := json.NewDecoder(r.Body).Decode(&n)
+		if err != nil {
+			t.Error(err)
+		}
+		received = append(received, n)
+		done <- struct{}{}
+	}))
+	defer receiver.Close()
+
+	access := &storageAccess{list: []SimpleItem{{ID: "abc", Size: 50}}}
+	s := &RESTServer{
+		Access:           access,
+		StorageAlerts:    []StorageAlert{{Bytes: 100, Levels: []int{50, 90}}},
+		StorageAlertURLs: []string{receiver.URL},
+	}
+	wait := func(n int) {
+		for i := 0; i < n; {
+			select {
+			case <-done:
+				i++
+			case <-time.After(time.Second):
+				t.Fatalf("Received %d alerts, expected %d", i, n)
+			}
+		}
+	}
+
+	s.checkStorage()
+	wait(1)
+	if received[0].Level != 50 || received[0].Used != 50 {
+		t.Errorf("Received %#v", received[0])
+	}
+	// no new alert until the next level is crossed
+	s.checkStorage()
+	access.list[0].Size = 95
+	s.checkStorage()
+	wait(1)
+	if received[1].Level != 90 {
+		t.Errorf("Received %#v", received[1])
+	}
+	// dropping below a level lets it alert again
+	access.list[0].Size = 10
+	s.checkStorage()
+	access.list[0].Size = 60
+	s.checkStorage()
+	wait(1)
+	time.Sleep(10 * time.Millisecond)
+	if len(received) != 3 || received[2].Level != 50 {
+		t.Errorf("Received %#v", received)
+	}
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/ndlib/bendo/store"
+)
+
+// A StoresReport lists the latency histograms and error counts of the
+// metered stores.
+type StoresReport struct {
+	Buckets []string // labels for the histogram buckets
+	Stores  []store.StoreStats
+}
+
+// StoresHandler handles requests to GET /admin/stores
+// It shows how long the operations on each metered store, such as the tape
+// and the cache, have taken since the server started.
+func (s *RESTServer) StoresHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	report := StoresReport{
+		Buckets: bucketLabels(store.LatencyBuckets),
+		Stores:  store.Meters(),
+	}
+	writeHTMLorJSON(w, r, storesTemplate, report)
+}
+
+// bucketLabels returns names for histogram buckets having the given upper
+// bounds in seconds, including the final bucket having no bound.
+func bucketLabels(bounds []float64) []string {
+	var result []string
+	for _, b := range bounds {
+		d := time.Duration(b * float64(time.Second))
+		result = append(result, "≤"+d.String())
+	}
+	return append(result, "more")
+}
+
+var (
+	storesTemplate = template.Must(template.New("stores").Parse(`<html>
+<h1>Stores</h1>
+{{ $buckets := .Buckets }}
+{{ range .Stores }}
+<h2>{{ .Name }}</h2>
+<table><thead><tr>
+	<th>Operation</th><th>Calls</th><th>Errors</th><th>Error Rate</th><th>Mean Seconds</th>
+	{{ range $buckets }}<th>{{ . }}</th>{{ end }}
+</tr></thead><tbody>
+{{ range $op, $stats := .Ops }}
+	<tr><td>{{ $op }}</td><td>{{ $stats.Count }}</td><td>{{ $stats.Errors }}</td>
+	<td>{{ printf "%.4f" $stats.ErrorRate }}</td><td>{{ printf "%.3f" $stats.Mean }}</td>
+	{{ range $stats.Buckets }}<td>{{ . }}</td>{{ end }}</tr>
+{{ end }}
+</tbody></table>
+{{ else }}
+<p>No stores are metered.</p>
+{{ end }}
+</html>`))
+)
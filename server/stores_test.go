@@ -0,0 +1,36 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/ndlib/bendo/store"
+)
+
+func TestStoresRoute(t *testing.T) {
+	ms := store.NewMetered(store.NewMemory(), "test-route")
+	ms.ListPrefix("")
+
+	body := getbody(t, "GET", "/admin/stores?format=json", 200)
+	var report StoresReport
+	err := json.Unmarshal([]byte(body), &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Buckets) != len(store.LatencyBuckets)+1 {
+		t.Errorf("Received buckets %v", report.Buckets)
+	}
+	var found bool
+	for _, s := range report.Stores {
+		if s.Name == "test-route" {
+			found = true
+			if s.Ops["listprefix"].Count != 1 {
+				t.Errorf("Received %#v", s)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Store test-route not in %#v", report.Stores)
+	}
+	getbody(t, "GET", "/admin/stores", 200)
+}
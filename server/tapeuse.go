@@ -2,7 +2,7 @@ package server
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
@@ -11,7 +11,7 @@ import (
 // EnableTapeUse turns on the tape use flag. This allows the
 // server to access the tape storage.
 func (s *RESTServer) EnableTapeUse() {
-	log.Println("Enabling Bendo Tape Use")
+	slog.Info("Enabling Bendo Tape Use")
 	s.useTape = true
 	s.Items.SetUseStore(true)
 }
@@ -19,7 +19,7 @@ func (s *RESTServer) EnableTapeUse() {
 // DisableTapeUse disables the tape use flag. The server will not
 // try to access the tape device while tape use is turned off.
 func (s *RESTServer) DisableTapeUse() {
-	log.Println("Disabling Bendo Tape Use")
+	slog.Info("Disabling Bendo Tape Use")
 	s.useTape = false
 	s.Items.SetUseStore(false)
 }
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// useTLS returns true if the server has been configured to serve HTTPS.
+func (s *RESTServer) useTLS() bool {
+	return s.TLSConfig != nil || len(s.ACMEHosts) > 0 || (s.TLSCertFile != "" && s.TLSKeyFile != "")
+}
+
+// tlsConfig returns the TLS configuration to serve HTTPS with. If no
+// TLSConfig was given but there are ACMEHosts, certificates are obtained
+// with ACME, and s.acme is set to the manager doing so. Otherwise the
+// certificate is loaded from TLSCertFile and TLSKeyFile, and is loaded again
+// whenever either file changes. This lets certificates renewed by an
+// external ACME client be used without restarting the server.
+func (s *RESTServer) tlsConfig() (*tls.Config, error) {
+	if s.TLSConfig != nil {
+		return s.TLSConfig, nil
+	}
+	if len(s.ACMEHosts) > 0 {
+		s.acme = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(s.ACMEHosts...),
+			Email:      s.ACMEEmail,
+		}
+		if s.ACMECacheDir != "" {
+			s.acme.Cache = autocert.DirCache(s.ACMECacheDir)
+		}
+		// this also answers tls-alpn-01 challenges
+		config := s.acme.TLSConfig()
+		config.MinVersion = tls.VersionTLS12
+		return config, nil
+	}
+	c := &certReloader{certFile: s.TLSCertFile, keyFile: s.TLSKeyFile}
+	err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: c.GetCertificate,
+	}, nil
+}
+
+// certCheckInterval is how often a certReloader looks to see whether its
+// files have changed.
+const certCheckInterval = time.Minute
+
+// A certReloader holds a certificate loaded from a pair of files. It
+// reloads the certificate if the files have changed since it was loaded.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	m         sync.Mutex
+	cert      *tls.Certificate
+	modified  time.Time // latest modification time of the two files
+	lastCheck time.Time
+}
+
+// load reads the certificate and key files.
+func (c *certReloader) load() error {
+	modified, err := c.modTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.m.Lock()
+	c.cert = &cert
+	c.modified = modified
+	c.lastCheck = time.Now()
+	c.m.Unlock()
+	return nil
+}
+
+func (c *certReloader) modTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return latest, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// GetCertificate returns the current certificate. It is intended to be used
+// as the GetCertificate field of a tls.Config. If the files cannot be
+// reloaded, the previous certificate is kept.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.m.Lock()
+	cert := c.cert
+	check := time.Since(c.lastCheck) >= certCheckInterval
+	if check {
+		c.lastCheck = time.Now()
+	}
+	modified := c.modified
+	c.m.Unlock()
+	if check {
+		m, err := c.modTime()
+		if err == nil && m.After(modified) {
+			err = c.load()
+			if err == nil {
+				slog.Info("Reloaded TLS certificate", "file", c.certFile)
+				c.m.Lock()
+				cert = c.cert
+				c.m.Unlock()
+			}
+		}
+		if err != nil {
+			slog.Error("Reloading TLS certificate", "file", c.certFile, "error", err)
+		}
+	}
+	return cert, nil
+}
+
+// redirectHandler returns a handler which redirects every request to the
+// same path using HTTPS on the given port.
+func redirectHandler(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a new self-signed certificate for the given name and
+// its key into dir.
+func writeTestCert(t *testing.T, dir string, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certfile := filepath.Join(dir, "cert.pem")
+	keyfile := filepath.Join(dir, "key.pem")
+	err = ioutil.WriteFile(certfile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyfile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyder}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certfile, keyfile
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bendotls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certfile, keyfile := writeTestCert(t, dir, "first.example.org")
+
+	c := &certReloader{certFile: certfile, keyFile: keyfile}
+	err = c.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commonName := func() string {
+		cert, err := c.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+	if name := commonName(); name != "first.example.org" {
+		t.Errorf("Received certificate for %s", name)
+	}
+
+	// replace the certificate. It is not seen until the check interval passes.
+	writeTestCert(t, dir, "second.example.org")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certfile, later, later)
+	os.Chtimes(keyfile, later, later)
+	if name := commonName(); name != "first.example.org" {
+		t.Errorf("Received certificate for %s before the check interval", name)
+	}
+	c.lastCheck = time.Time{}
+	if name := commonName(); name != "second.example.org" {
+		t.Errorf("Received certificate for %s after the check interval", name)
+	}
+
+	// a broken certificate keeps the previous one
+	ioutil.WriteFile(certfile, []byte("garbage"), 0600)
+	later = later.Add(time.Minute)
+	os.Chtimes(certfile, later, later)
+	c.lastCheck = time.Time{}
+	if name := commonName(); name != "second.example.org" {
+		t.Errorf("Received certificate for %s after a bad reload", name)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	s := &RESTServer{}
+	if s.useTLS() {
+		t.Error("TLS used with no certificate")
+	}
+	s.TLSCertFile = "/no/such/cert.pem"
+	s.TLSKeyFile = "/no/such/key.pem"
+	if !s.useTLS() {
+		t.Error("TLS not used with a certificate")
+	}
+	_, err := s.tlsConfig()
+	if err == nil {
+		t.Error("Expected an error for missing certificate files")
+	}
+}
+
+func TestACMEConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bendoacme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := &RESTServer{ACMEHosts: []string{"bendo.example.org"}, ACMECacheDir: dir}
+	if !s.useTLS() {
+		t.Error("TLS not used with ACME hosts")
+	}
+	config, err := s.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.acme == nil {
+		t.Fatal("No ACME manager")
+	}
+	found := false
+	for _, proto := range config.NextProtos {
+		if proto == "acme-tls/1" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Received protocols %v, expected acme-tls/1", config.NextProtos)
+	}
+	// other host names are refused without asking the ACME server
+	_, err = config.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.org"})
+	if err == nil {
+		t.Error("Received a certificate for a host not in ACMEHosts")
+	}
+
+	// challenges are answered rather than redirected
+	handler := s.acme.HTTPHandler(redirectHandler("443"))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://bendo.example.org/item/abc", nil))
+	if w.Code != 301 {
+		t.Errorf("Received %d, expected a redirect", w.Code)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://bendo.example.org/.well-known/acme-challenge/token", nil))
+	if w.Code == 301 {
+		t.Errorf("Challenge was redirected")
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	var tests = []struct {
+		port   string
+		url    string
+		expect string
+	}{
+		{"443", "http://bendo.example.org/item/abc?x=1", "https://bendo.example.org/item/abc?x=1"},
+		{"14000", "http://bendo.example.org:8080/item/abc", "https://bendo.example.org:14000/item/abc"},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		redirectHandler(test.port).ServeHTTP(w, httptest.NewRequest("GET", test.url, nil))
+		if w.Code != 301 || w.Header().Get("Location") != test.expect {
+			t.Errorf("%s: received %d %s, expected %s", test.url, w.Code, w.Header().Get("Location"), test.expect)
+		}
+	}
+}
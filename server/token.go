@@ -16,6 +16,14 @@ type TokenValidator interface {
 	TokenValid(token string) (user string, role Role, err error)
 }
 
+// A PasswordValidator is a TokenValidator which can also check a user name
+// and password, such as those given with HTTP basic authentication. It has
+// the same return conventions as TokenValid.
+type PasswordValidator interface {
+	TokenValidator
+	PasswordValid(name string, password string) (user string, role Role, err error)
+}
+
 // A Role is an enumeration describing the permission level a given user has.
 type Role int
 
@@ -47,6 +55,22 @@ func AtoRole(s string) Role {
 	}
 }
 
+// String returns the name of the role, as accepted by AtoRole.
+func (r Role) String() string {
+	switch r {
+	case RoleMDOnly:
+		return "MDOnly"
+	case RoleRead:
+		return "Read"
+	case RoleWrite:
+		return "Write"
+	case RoleAdmin:
+		return "Admin"
+	default:
+		return "Unknown"
+	}
+}
+
 // A NobodyValidator is a TokenValidator that for every possible token
 // returns a user named "nobody" with the Admin role.
 type NobodyValidator struct{}
@@ -0,0 +1,302 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+	"github.com/julienschmidt/httprouter"
+)
+
+// An APIToken is a token created through the token routes. Only a hash of
+// the token itself is kept, so the Token field is filled in only in the
+// response to creating or rotating a token.
+type APIToken struct {
+	ID      int64
+	User    string
+	Role    string
+	Token   string `json:",omitempty"`
+	Created time.Time
+	Creator string    // the admin who made the token
+	Revoked time.Time // zero if the token has not been revoked
+}
+
+// Active returns true if the token may be used at the given time.
+func (t *APIToken) Active(now time.Time) bool {
+	return t.Revoked.IsZero() || now.Before(t.Revoked)
+}
+
+// A TokenDB stores the tokens created through the token routes. Tokens are
+// looked up by the hex encoded SHA-256 hash of their value.
+type TokenDB interface {
+	// AddToken saves the given token, ignoring its ID and Token fields, and
+	// returns its new id.
+	AddToken(t APIToken, hash string) (int64, error)
+
+	// FindToken returns the token having the given hash, whether or not it
+	// has been revoked. It returns nil if there is no such token.
+	FindToken(hash string) (*APIToken, error)
+
+	// GetToken returns the token with the given id, or nil if there is none.
+	GetToken(id int64) (*APIToken, error)
+
+	// ListTokens returns every token, including revoked ones, in order of id.
+	ListTokens() ([]APIToken, error)
+
+	// RevokeToken makes the given token invalid from the given time on. A
+	// token already revoked before that time is not changed.
+	RevokeToken(id int64, when time.Time) error
+}
+
+// A TokenDBValidator validates tokens stored in a TokenDB. Tokens not in the
+// database are passed to Fallback, so tokens from a token file or an LDAP
+// directory may be used alongside them.
+type TokenDBValidator struct {
+	DB       TokenDB
+	Fallback TokenValidator
+}
+
+var _ PasswordValidator = &TokenDBValidator{}
+
+// TokenValid looks for the token in the database, and then in Fallback.
+// Revoked tokens are invalid even if Fallback knows them.
+func (v *TokenDBValidator) TokenValid(token string) (string, Role, error) {
+	if token != "" {
+		t, err := v.DB.FindToken(hashToken(token))
+		if err != nil {
+			return "", RoleUnknown, err
+		}
+		if t != nil {
+			if !t.Active(time.Now()) {
+				return "", RoleUnknown, nil
+			}
+			return t.User, AtoRole(t.Role), nil
+		}
+	}
+	if v.Fallback == nil {
+		return "", RoleUnknown, nil
+	}
+	return v.Fallback.TokenValid(token)
+}
+
+// PasswordValid passes the name and password to Fallback, if it can check
+// them.
+func (v *TokenDBValidator) PasswordValid(name string, password string) (string, Role, error) {
+	if pv, ok := v.Fallback.(PasswordValidator); ok {
+		return pv.PasswordValid(name, password)
+	}
+	return "", RoleUnknown, nil
+}
+
+// hashToken returns the hash a token is stored under.
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// newToken returns a new random token.
+func newToken() (string, error) {
+	b := make([]byte, 24)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// ListTokensHandler handles requests to GET /admin/tokens
+func (s *RESTServer) ListTokensHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.Tokens == nil {
+		NotImplementedHandler(w, r, ps)
+		return
+	}
+	list, err := s.Tokens.ListTokens()
+	if err != nil {
+		requestLogger(r).Error("ListTokens", "error", err)
+		raven.CaptureError(err, nil)
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err)
+		return
+	}
+	if list == nil {
+		list = []APIToken{}
+	}
+	writeHTMLorJSON(w, r, tokenListTemplate, list)
+}
+
+// GetTokenHandler handles requests to GET /admin/tokens/:id
+func (s *RESTServer) GetTokenHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.Tokens == nil {
+		NotImplementedHandler(w, r, ps)
+		return
+	}
+	t := s.findToken(w, r, ps)
+	if t != nil {
+		writeHTMLorJSON(w, r, tokenListTemplate, []APIToken{*t})
+	}
+}
+
+// CreateTokenHandler handles requests to POST /admin/tokens
+// The parameters "user" and "role" give the user name and role of the new
+// token. The token is only returned in the response, so it must be saved
+// then.
+func (s *RESTServer) CreateTokenHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.Tokens == nil {
+		NotImplementedHandler(w, r, ps)
+		return
+	}
+	user := r.FormValue("user")
+	role := AtoRole(r.FormValue("role"))
+	if user == "" || strings.ContainsAny(user, " \t\r\n") || role == RoleUnknown {
+		w.WriteHeader(400)
+		fmt.Fprintln(w, "a user name without spaces and a role of MDOnly, Read, Write, or Admin are required")
+		return
+	}
+	s.createToken(w, r, APIToken{
+		User:    user,
+		Role:    role.String(),
+		Created: time.Now(),
+		Creator: ps.ByName("username"),
+	})
+}
+
+// RotateTokenHandler handles requests to POST /admin/tokens/:id/rotate
+// It makes a new token for the same user and role and revokes the old one.
+// The parameter "grace" is a duration, such as "24h", for which the old
+// token keeps working so clients can be moved over. It defaults to 0.
+func (s *RESTServer) RotateTokenHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.Tokens == nil {
+		NotImplementedHandler(w, r, ps)
+		return
+	}
+	var grace time.Duration
+	if v := r.FormValue("grace"); v != "" {
+		var err error
+		grace, err = time.ParseDuration(v)
+		if err != nil || grace < 0 {
+			w.WriteHeader(400)
+			fmt.Fprintln(w, "bad grace duration")
+			return
+		}
+	}
+	old := s.findToken(w, r, ps)
+	if old == nil {
+		return
+	}
+	now := time.Now()
+	if !old.Active(now) {
+		w.WriteHeader(409)
+		fmt.Fprintln(w, "token has been revoked")
+		return
+	}
+	err := s.Tokens.RevokeToken(old.ID, now.Add(grace))
+	if err != nil {
+		requestLogger(r).Error("RevokeToken", "id", old.ID, "error", err)
+		raven.CaptureError(err, nil)
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err)
+		return
+	}
+	requestLogger(r).Info("revoked token", "id", old.ID, "token-user", old.User, "grace", grace)
+	s.createToken(w, r, APIToken{
+		User:    old.User,
+		Role:    old.Role,
+		Created: now,
+		Creator: ps.ByName("username"),
+	})
+}
+
+// RevokeTokenHandler handles requests to DELETE /admin/tokens/:id
+func (s *RESTServer) RevokeTokenHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.Tokens == nil {
+		NotImplementedHandler(w, r, ps)
+		return
+	}
+	t := s.findToken(w, r, ps)
+	if t == nil {
+		return
+	}
+	err := s.Tokens.RevokeToken(t.ID, time.Now())
+	if err != nil {
+		requestLogger(r).Error("RevokeToken", "id", t.ID, "error", err)
+		raven.CaptureError(err, nil)
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err)
+		return
+	}
+	requestLogger(r).Info("revoked token", "id", t.ID, "token-user", t.User)
+}
+
+// findToken returns the token named by the "id" parameter. If there is no
+// such token, or there is an error, it writes the response and returns nil.
+func (s *RESTServer) findToken(w http.ResponseWriter, r *http.Request, ps httprouter.Params) *APIToken {
+	id, err := strconv.ParseInt(ps.ByName("id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(404)
+		fmt.Fprintln(w, "token not found")
+		return nil
+	}
+	t, err := s.Tokens.GetToken(id)
+	if err != nil {
+		requestLogger(r).Error("GetToken", "id", id, "error", err)
+		raven.CaptureError(err, nil)
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err)
+		return nil
+	}
+	if t == nil {
+		w.WriteHeader(404)
+		fmt.Fprintln(w, "token not found")
+	}
+	return t
+}
+
+// createToken gives t a new random value, saves it, and sends it as a JSON
+// response.
+func (s *RESTServer) createToken(w http.ResponseWriter, r *http.Request, t APIToken) {
+	var err error
+	t.Token, err = newToken()
+	if err == nil {
+		t.ID, err = s.Tokens.AddToken(t, hashToken(t.Token))
+	}
+	if err != nil {
+		requestLogger(r).Error("AddToken", "error", err)
+		raven.CaptureError(err, nil)
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err)
+		return
+	}
+	requestLogger(r).Info("created token", "id", t.ID, "token-user", t.User, "role", t.Role)
+	w.Header().Set("Location", apiPath(r, fmt.Sprintf("/admin/tokens/%d", t.ID)))
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(201)
+	json.NewEncoder(w).Encode(t)
+}
+
+var (
+	tokenListTemplate = template.Must(template.New("tokenlist").Parse(`<html>
+<h1>API Tokens</h1>
+<table>
+<thead><tr><th>ID</th><th>User</th><th>Role</th><th>Created</th><th>Creator</th><th>Revoked</th></tr></thead>
+<tbody>
+{{ range . }}<tr>
+<td>{{ .ID }}</td>
+<td>{{ .User }}</td>
+<td>{{ .Role }}</td>
+<td>{{ .Created.Format "2006-01-02 15:04:05" }}</td>
+<td>{{ .Creator }}</td>
+<td>{{ if not .Revoked.IsZero }}{{ .Revoked.Format "2006-01-02 15:04:05" }}{{ end }}</td>
+</tr>
+{{ end }}</tbody>
+</table>
+</html>`))
+)
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func runTokenSequence(t *testing.T, db TokenDB) {
+	created := time.Now().Truncate(time.Second)
+	id, err := db.AddToken(APIToken{User: "loader", Role: "Write", Created: created, Creator: "admin"}, hashToken("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := db.FindToken(hashToken("abc"))
+	if err != nil || tok == nil || tok.ID != id || tok.User != "loader" || tok.Role != "Write" ||
+		!tok.Created.Equal(created) || !tok.Revoked.IsZero() {
+		t.Errorf("Received %#v, %v", tok, err)
+	}
+	tok, err = db.FindToken(hashToken("xyz"))
+	if err != nil || tok != nil {
+		t.Errorf("Received %#v, %v, expected nil", tok, err)
+	}
+	tok, err = db.GetToken(id + 100)
+	if err != nil || tok != nil {
+		t.Errorf("Received %#v, %v, expected nil", tok, err)
+	}
+
+	// a later revocation does not replace an earlier one
+	err = db.RevokeToken(id, created.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.RevokeToken(id, created.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err = db.GetToken(id)
+	if err != nil || tok == nil || !tok.Revoked.Equal(created.Add(time.Hour)) {
+		t.Errorf("Received %#v, %v", tok, err)
+	}
+
+	_, err = db.AddToken(APIToken{User: "reader", Role: "Read", Created: created}, hashToken("def"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := db.ListTokens()
+	if err != nil || len(list) != 2 || list[0].User != "loader" || list[1].User != "reader" {
+		t.Errorf("Received %v, %v", list, err)
+	}
+}
+
+func TestQLTokens(t *testing.T) {
+	qc, err := NewQlCache("mem--tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runTokenSequence(t, qc)
+	qc.db.Close()
+}
+
+func tokenRequest(t *testing.T, ts *httptest.Server, verb, route, key string, expstatus int) *APIToken {
+	req, err := http.NewRequest(verb, ts.URL+route, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Api-Key", key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != expstatus {
+		t.Fatalf("%s %s: received status %d, expected %d", verb, route, resp.StatusCode, expstatus)
+	}
+	if expstatus != 201 {
+		return nil
+	}
+	var tok APIToken
+	body, _ := ioutil.ReadAll(resp.Body)
+	err = json.Unmarshal(body, &tok)
+	if err != nil || tok.Token == "" {
+		t.Fatalf("Received %q, %v", body, err)
+	}
+	if resp.Header.Get("Location") == "" {
+		t.Errorf("No Location header")
+	}
+	return &tok
+}
+
+func TestTokenRoutes(t *testing.T) {
+	db, err := NewQlCache("mem--tokenroutes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.db.Close()
+	fallback, _ := NewListValidatorString("root Admin secret\n")
+	v := &TokenDBValidator{DB: db, Fallback: fallback}
+	s := &RESTServer{Validator: v, Tokens: db}
+	ts := httptest.NewServer(s.addRoutes())
+	defer ts.Close()
+
+	tokenRequest(t, ts, "POST", "/admin/tokens?user=loader&role=boss", "secret", 400)
+	tokenRequest(t, ts, "POST", "/admin/tokens?user=load+er&role=Write", "secret", 400)
+	first := tokenRequest(t, ts, "POST", "/admin/tokens?user=loader&role=write", "secret", 201)
+	if first.User != "loader" || first.Role != "Write" || first.Creator != "root" {
+		t.Errorf("Received %#v", first)
+	}
+	user, role, err := v.TokenValid(first.Token)
+	if err != nil || user != "loader" || role != RoleWrite {
+		t.Errorf("Received %q, %v, %v", user, role, err)
+	}
+	// the new token is not an admin token
+	tokenRequest(t, ts, "GET", "/admin/tokens", first.Token, 401)
+
+	// the list does not have the tokens themselves
+	req, _ := http.NewRequest("GET", ts.URL+"/admin/tokens?format=json", nil)
+	req.Header.Set("X-Api-Key", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list []APIToken
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if err != nil || len(list) != 1 || list[0].Token != "" || list[0].ID != first.ID {
+		t.Errorf("Received %v, %v", list, err)
+	}
+
+	// rotate, keeping the old token for a while
+	route := "/admin/tokens/" + strconv.FormatInt(first.ID, 10)
+	second := tokenRequest(t, ts, "POST", route+"/rotate?grace=1h", "secret", 201)
+	for _, token := range []string{first.Token, second.Token} {
+		user, role, err = v.TokenValid(token)
+		if err != nil || user != "loader" || role != RoleWrite {
+			t.Errorf("Received %q, %v, %v", user, role, err)
+		}
+	}
+	// and now revoke it immediately
+	tokenRequest(t, ts, "DELETE", route, "secret", 200)
+	user, role, err = v.TokenValid(first.Token)
+	if err != nil || role != RoleUnknown {
+		t.Errorf("Received %q, %v, %v", user, role, err)
+	}
+	tokenRequest(t, ts, "POST", route+"/rotate", "secret", 409)
+	tokenRequest(t, ts, "GET", "/admin/tokens/9999", "secret", 404)
+	tokenRequest(t, ts, "GET", "/admin/tokens/"+strconv.FormatInt(second.ID, 10), "secret", 200)
+
+	// tokens from the fallback still work
+	user, role, err = v.TokenValid("secret")
+	if err != nil || user != "root" || role != RoleAdmin {
+		t.Errorf("Received %q, %v, %v", user, role, err)
+	}
+}
@@ -2,16 +2,20 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"expvar"
 	"fmt"
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
+	"strconv"
 	"time"
 
 	raven "github.com/getsentry/raven-go"
 	"github.com/julienschmidt/httprouter"
 
+	"github.com/ndlib/bendo/apiv2"
+	"github.com/ndlib/bendo/items"
 	"github.com/ndlib/bendo/transaction"
 )
 
@@ -44,6 +48,10 @@ func (s *RESTServer) TxInfoHandler(w http.ResponseWriter, r *http.Request, ps ht
 	}
 	tx.M.RLock()
 	defer tx.M.RUnlock()
+	if isV2(r) {
+		writeJSON(w, apiv2.NewTransaction(tx))
+		return
+	}
 	writeHTMLorJSON(w, r, txInfoTemplate, tx)
 }
 
@@ -55,9 +63,14 @@ var (
 	<dt>ID</dt><dd>{{ .ID }}</dd>
 	<dt>For Item</dt><dd><a href="/item/{{ .ItemID }}">{{ .ItemID }}</a></dd>
 	<dt>Status</dt><dd>{{ .Status }}</dd>
+	<dt>Version</dt><dd>{{ if .Version }}{{ .Version }}{{ end }}</dd>
 	<dt>Started</dt><dd>{{ .Started }}</dd>
 	<dt>Modified</dt><dd>{{ .Modified }}</dd>
 	<dt>Errors</dt><dd>{{ range .Err }}{{ . }}<br/>{{ end }}</dd>
+	<dt>Bytes</dt><dd>{{ .Bytes }}</dd>
+	<dt>Verify Time</dt><dd>{{ .Timing.Verify }}</dd>
+	<dt>Ingest Time</dt><dd>{{ .Timing.Ingest }}</dd>
+	<dt>Index Time</dt><dd>{{ .Timing.Index }}</dd>
 	<dt>Commands</dt><dd>{{ range .Commands }}
 		{{ if index . 0 | eq "add" }}
 			{{ $fname := index . 1 }}
@@ -82,11 +95,15 @@ func (s *RESTServer) NewTxHandler(w http.ResponseWriter, r *http.Request, ps htt
 		fmt.Fprintln(w, err.Error())
 		return
 	}
-	w.Header().Set("Location", "/transaction/"+tx.ID)
+	w.Header().Set("Location", apiPath(r, "/transaction/"+tx.ID))
 	tx.Creator = ps.ByName("username")
 	// TODO(dbrower): use a limit reader to 1MB(?) for this
 	var cmds [][]string
-	err = json.NewDecoder(r.Body).Decode(&cmds)
+	if name := r.URL.Query().Get("template"); name != "" {
+		cmds, err = s.templateCommands(name, r.Body)
+	} else {
+		err = json.NewDecoder(r.Body).Decode(&cmds)
+	}
 	if err != nil {
 		tx.SetStatus(transaction.StatusError)
 		w.WriteHeader(400)
@@ -100,11 +117,100 @@ func (s *RESTServer) NewTxHandler(w http.ResponseWriter, r *http.Request, ps htt
 		fmt.Fprintln(w, err.Error())
 		return
 	}
+	err = s.checkTxLimits(tx)
+	if err != nil {
+		tx.AppendError(err.Error())
+		tx.SetStatus(transaction.StatusError)
+		w.Header().Set("X-Max-Transaction-Bytes", strconv.FormatInt(s.MaxTxBytes, 10))
+		w.Header().Set("X-Max-Transaction-Files", strconv.Itoa(s.MaxTxFiles))
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+	// refuse to purge blobs other items refer to. Other errors are left
+	// for the commit, which checks again before deleting anything.
+	if bids := tx.DeletedBlobs(); len(bids) > 0 {
+		err = s.Items.CheckReferences(id, bids)
+		if errors.Is(err, items.ErrReferenced) {
+			tx.AppendError(err.Error())
+			tx.SetStatus(transaction.StatusError)
+			w.WriteHeader(409)
+			fmt.Fprintln(w, err.Error())
+			return
+		}
+	}
 	tx.SetStatus(transaction.StatusWaiting)
-	s.txqueue <- tx.ID
+	lane := s.enqueueTx(tx)
+	requestLogger(r).Info("Queued transaction", "tx", tx.ID, "item", id, "lane", lane)
 	w.WriteHeader(202)
 }
 
+// The transaction processing lanes. Each lane has its own workers, so small
+// transactions are not stuck waiting behind large ingests.
+const (
+	LaneSmall = "small"
+	LaneLarge = "large"
+)
+
+// txLane returns the lane tx should be processed in. Users listed in
+// TxLanes always use the lane given there. Otherwise a transaction adding
+// at most SmallTxFiles uploaded files totaling at most SmallTxBytes is
+// small, and everything else is large.
+func (s *RESTServer) txLane(tx *transaction.Transaction) string {
+	tx.M.RLock()
+	creator := tx.Creator
+	tx.M.RUnlock()
+	if lane, ok := s.TxLanes[creator]; ok {
+		return lane
+	}
+	fids := tx.ReferencedFiles()
+	if len(fids) <= s.SmallTxFiles && s.uploadedBytes(fids) <= s.SmallTxBytes {
+		return LaneSmall
+	}
+	return LaneLarge
+}
+
+// enqueueTx adds tx to the queue for its lane, and returns the lane. It
+// may block if the queue is full.
+func (s *RESTServer) enqueueTx(tx *transaction.Transaction) string {
+	lane := s.txLane(tx)
+	queue := s.txqueue
+	if lane == LaneSmall && s.txsmall != nil {
+		queue = s.txsmall
+	}
+	queue <- tx.ID
+	return lane
+}
+
+// uploadedBytes returns the total size of the given uploaded files. Files
+// which cannot be found are skipped.
+func (s *RESTServer) uploadedBytes(fids []string) int64 {
+	var nbytes int64
+	for _, fid := range fids {
+		if f := s.FileStore.Lookup(fid); f != nil {
+			nbytes += f.Stat().Size
+		}
+	}
+	return nbytes
+}
+
+// checkTxLimits returns an error if the uploaded files added by tx are more
+// than MaxTxFiles or total more than MaxTxBytes.
+func (s *RESTServer) checkTxLimits(tx *transaction.Transaction) error {
+	if s.MaxTxBytes <= 0 && s.MaxTxFiles <= 0 {
+		return nil
+	}
+	fids := tx.ReferencedFiles()
+	// missing files are reported when the transaction is verified
+	nbytes := s.uploadedBytes(fids)
+	if (s.MaxTxFiles > 0 && len(fids) > s.MaxTxFiles) ||
+		(s.MaxTxBytes > 0 && nbytes > s.MaxTxBytes) {
+		return fmt.Errorf("transaction adds %d files totaling %d bytes, more than the limit of %d files and %d bytes (0 is no limit). Split the ingest into several transactions",
+			len(fids), nbytes, s.MaxTxFiles, s.MaxTxBytes)
+	}
+	return nil
+}
+
 // transactionWorker pulls transactions off of the channel and then
 // processes them. It is intended for many of these to run in parallel.
 // Close s.txcancel for all workers to gracefully exit.
@@ -130,19 +236,17 @@ func (s *RESTServer) transactionWorker(queue <-chan string) {
 			// ignore and get next transaction
 			continue
 		}
-		log.Printf("Starting transaction %s on %s (%s)",
-			tx.ID,
-			tx.ItemID,
-			tx.Status.String())
+		logger := slog.With("tx", tx.ID, "item", tx.ItemID, "user", tx.Creator)
+		logger.Info("Starting transaction", "status", tx.Status.String())
 		start := time.Now()
 		switch tx.Status {
 		default:
-			log.Printf("Unknown status %s", tx.Status.String())
+			logger.Error("Unknown status", "status", tx.Status.String())
 		case transaction.StatusWaiting:
 			tx.SetStatus(transaction.StatusChecking)
 			fallthrough
 		case transaction.StatusChecking:
-			tx.VerifyFiles(s.FileStore)
+			tx.VerifyFilesPool(s.FileStore, s.hashpool)
 			if len(tx.Err) > 0 {
 				tx.SetStatus(transaction.StatusError)
 				goto out
@@ -150,9 +254,10 @@ func (s *RESTServer) transactionWorker(queue <-chan string) {
 			tx.SetStatus(transaction.StatusIngest)
 			fallthrough
 		case transaction.StatusIngest:
-			// make sure the tape is available. Keep looping until it is.
-			for !s.useTape {
-				log.Printf("Transaction %s waiting for tape availability", tx.ID)
+			// make sure the tape is available and we are not in a
+			// maintenance window. Keep looping until it is.
+			for !s.useTape || s.activeMaintenance() != nil {
+				logger.Info("Transaction waiting for tape availability")
 				// wait for tape use to be enabled. for now we poll it every minute.
 				select {
 				case <-s.txcancel:
@@ -160,15 +265,47 @@ func (s *RESTServer) transactionWorker(queue <-chan string) {
 				case <-time.After(1 * time.Minute): // this time is arbitrary
 				}
 			}
+			merged, err := s.lockMerged(tx)
+			if err != nil {
+				tx.AppendError(err.Error())
+				tx.SetStatus(transaction.StatusError)
+				goto out
+			}
 			tx.Commit(*s.Items, s.FileStore, s.Cache)
+			tx.M.RLock()
+			finished, nbytes := tx.Status == transaction.StatusFinished, tx.Bytes
+			tx.M.RUnlock()
+			if finished {
+				s.recordUsage(UsageItem, tx.ItemID, nbytes)
+			}
+			indexStart := time.Now()
 			s.IndexItem(tx.ItemID)
+			tx.SetIndexTime(time.Now().Sub(indexStart))
+			s.deleteMerged(tx, merged, logger)
 		}
 	out:
 		duration := time.Now().Sub(start)
-		log.Printf("Finish transaction %s on %s (%s)", tx.ID, tx.ItemID, duration.String())
+		tx.M.RLock()
+		timing := tx.Timing
+		nbytes := tx.Bytes
+		tx.M.RUnlock()
+		logger.Info("Finish transaction",
+			"duration", duration,
+			"verify", timing.Verify,
+			"ingest", timing.Ingest,
+			"index", timing.Index,
+			"bytes", nbytes)
 
 		xTransactionTime.Add(duration.Seconds())
 		xTransactionCount.Add(1)
+		xTransactionBytes.Add(nbytes)
+		xTransactionVerify.Add(timing.Verify.Seconds())
+		xTransactionIngest.Add(timing.Ingest.Seconds())
+		xTransactionIndex.Add(timing.Index.Seconds())
+
+		s.notifyTx(tx)
+		s.recordTxEvent(tx)
+		s.txwaiters.done(tx.ID)
 	}
 
 }
@@ -176,20 +313,24 @@ func (s *RESTServer) transactionWorker(queue <-chan string) {
 var (
 	xTransactionCount = expvar.NewInt("tx.count")
 	xTransactionTime  = expvar.NewFloat("tx.seconds")
+	xTransactionBytes = expvar.NewInt("tx.bytes")
+
+	// time spent in each phase of committing transactions
+	xTransactionVerify = expvar.NewFloat("tx.verify.seconds")
+	xTransactionIngest = expvar.NewFloat("tx.ingest.seconds")
+	xTransactionIndex  = expvar.NewFloat("tx.index.seconds")
 )
 
-// TxCleaner will loop forever removing old transactions and old orphened
-// uploaded files. That means any finished transactions which are older than a
-// few days. Both the transaction and any uploaded files referenced by the
-// transaction are deleted. This function will never return.
+// TxCleaner will loop forever removing old transactions. That means any
+// finished transactions which are older than a few days. Both the transaction
+// and any uploaded files referenced by the transaction are deleted. Uploaded
+// files no transaction refers to are removed by the upload janitor instead.
+// This function will never return.
 func (s *RESTServer) TxCleaner() {
 	for {
 		err := s.transactionCleaner()
-		if err == nil {
-			err = s.fileCleaner()
-		}
 		if err != nil {
-			log.Println("TxCleaner:", err)
+			slog.Error("TxCleaner", "error", err)
 			raven.CaptureError(err, nil)
 		}
 		// wait for a while before beginning again
@@ -222,7 +363,7 @@ func (s *RESTServer) transactionCleaner() error {
 				continue
 			}
 		}
-		log.Printf("TxCleaner: removing transaction %s\n", txid)
+		slog.Info("TxCleaner: removing transaction", "tx", txid)
 		// delete every file referenced by the transaction
 		for _, fid := range tx.ReferencedFiles() {
 			err := s.FileStore.Delete(fid)
@@ -239,26 +380,41 @@ func (s *RESTServer) transactionCleaner() error {
 	return nil
 }
 
-// fileCleaner will remove any files in the upload cache directory older than
-// two weeks. (This time is completely arbitrary).
-func (s *RESTServer) fileCleaner() error {
-	cutoff := time.Now().Add(-14 * 24 * time.Hour)
-	for _, fid := range s.FileStore.List() {
-		f := s.FileStore.Lookup(fid)
-		if f == nil {
-			continue
-		}
-		stat := f.Stat()
-		if stat.Modified.After(cutoff) {
+// DefaultUploadExpire is how long uploaded files no transaction refers to
+// are kept after they were last written to, if UploadExpire is not set.
+const DefaultUploadExpire = 14 * 24 * time.Hour
+
+// startUploadJanitor starts the upload store's janitor, which deletes files
+// not written to for UploadExpire unless a transaction refers to them. Files
+// a transaction refers to are deleted along with the transaction by
+// TxCleaner.
+func (s *RESTServer) startUploadJanitor() {
+	expire := s.UploadExpire
+	if expire <= 0 {
+		expire = DefaultUploadExpire
+	}
+	// check a few times in each period, but at least twice a day
+	interval := expire / 4
+	if interval > 12*time.Hour {
+		interval = 12 * time.Hour
+	}
+	s.FileStore.StartJanitor(expire, interval, s.referencedFiles)
+}
+
+// referencedFiles returns the ids of the uploaded files any transaction in
+// the transaction store refers to.
+func (s *RESTServer) referencedFiles() map[string]bool {
+	result := make(map[string]bool)
+	for _, txid := range s.TxStore.List() {
+		tx := s.TxStore.Lookup(txid)
+		if tx == nil {
 			continue
 		}
-		log.Printf("TxCleaner: removing file %s\n", fid)
-		err := s.FileStore.Delete(fid)
-		if err != nil {
-			return err
+		for _, fid := range tx.ReferencedFiles() {
+			result[fid] = true
 		}
 	}
-	return nil
+	return result
 }
 
 // CancelTxHandler handles requests to POST /transaction/:tid/cancel
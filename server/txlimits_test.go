@@ -0,0 +1,120 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/ndlib/bendo/fragment"
+	"github.com/ndlib/bendo/store"
+	"github.com/ndlib/bendo/transaction"
+)
+
+func TestTxLimits(t *testing.T) {
+	s := &RESTServer{
+		TxStore:    transaction.New(store.NewMemory()),
+		FileStore:  fragment.New(store.NewMemory()),
+		MaxTxBytes: 10,
+		MaxTxFiles: 2,
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		f := s.FileStore.New(name)
+		w, err := f.Append()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("12345"))
+		w.Close()
+	}
+	var tests = []struct {
+		cmds string
+		ok   bool
+	}{
+		{`[["add", "a"]]`, true},
+		{`[["add", "a"], ["add", "b"]]`, true},
+		{`[["add", "a"], ["add", "b"], ["add", "c"]]`, false}, // too many files and bytes
+		{`[["add", "a"], ["add", "missing"]]`, true},
+		{`[["note", "hello"]]`, true},
+	}
+	for _, test := range tests {
+		tx, err := s.TxStore.Create("item" + randomid())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var cmds [][]string
+		err = json.Unmarshal([]byte(test.cmds), &cmds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.AddCommandList(cmds)
+		err = s.checkTxLimits(tx)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: received %v", test.cmds, err)
+		}
+	}
+
+	// the handler refuses the transaction
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/item/big/transaction",
+		bytes.NewBufferString(`[["add", "a"], ["add", "b"], ["add", "c"]]`))
+	s.NewTxHandler(w, r, httprouter.Params{{Key: "id", Value: "big"}})
+	if w.Code != 413 {
+		t.Errorf("Received status %d, expected 413", w.Code)
+	}
+	if h := w.Header().Get("X-Max-Transaction-Files"); h != "2" {
+		t.Errorf("Received X-Max-Transaction-Files %q", h)
+	}
+	if h := w.Header().Get("X-Max-Transaction-Bytes"); h != "10" {
+		t.Errorf("Received X-Max-Transaction-Bytes %q", h)
+	}
+}
+
+func TestTxLane(t *testing.T) {
+	s := &RESTServer{
+		TxStore:      transaction.New(store.NewMemory()),
+		FileStore:    fragment.New(store.NewMemory()),
+		SmallTxBytes: 10,
+		SmallTxFiles: 2,
+		TxLanes:      map[string]string{"loader": LaneLarge, "urgent": LaneSmall},
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		f := s.FileStore.New(name)
+		w, err := f.Append()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("12345"))
+		w.Close()
+	}
+	var tests = []struct {
+		creator string
+		cmds    string
+		lane    string
+	}{
+		{"nobody", `[["note", "hello"]]`, LaneSmall},
+		{"nobody", `[["add", "a"], ["add", "b"]]`, LaneSmall},
+		{"nobody", `[["add", "a"], ["add", "b"], ["add", "c"]]`, LaneLarge},
+		{"loader", `[["note", "hello"]]`, LaneLarge},
+		{"urgent", `[["add", "a"], ["add", "b"], ["add", "c"]]`, LaneSmall},
+	}
+	for _, test := range tests {
+		tx, err := s.TxStore.Create("item" + randomid())
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.Creator = test.creator
+		var cmds [][]string
+		err = json.Unmarshal([]byte(test.cmds), &cmds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.AddCommandList(cmds)
+		lane := s.txLane(tx)
+		if lane != test.lane {
+			t.Errorf("%s %s: received lane %s, expected %s", test.creator, test.cmds, lane, test.lane)
+		}
+	}
+}
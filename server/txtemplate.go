@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+)
+
+// A TxParam is the value given for a transaction template parameter. It is
+// decoded from either a JSON string or a JSON list of strings.
+type TxParam []string
+
+// UnmarshalJSON accepts either a string or a list of strings.
+func (p *TxParam) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*p = TxParam{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return fmt.Errorf("template parameter must be a string or a list of strings")
+	}
+	*p = TxParam(list)
+	return nil
+}
+
+// templateParam matches a parameter reference such as "{file}".
+var templateParam = regexp.MustCompile(`\{([A-Za-z0-9_-]+)\}`)
+
+// TemplateParams returns the sorted names of the parameters referenced in
+// the given template.
+func TemplateParams(tmpl [][]string) []string {
+	seen := make(map[string]bool)
+	var result []string
+	for _, cmd := range tmpl {
+		for _, arg := range cmd {
+			for _, m := range templateParam.FindAllStringSubmatch(arg, -1) {
+				if !seen[m[1]] {
+					seen[m[1]] = true
+					result = append(result, m[1])
+				}
+			}
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// templateCommands returns the command list given by the template with the
+// given name, using the parameters in the JSON object read from body.
+func (s *RESTServer) templateCommands(name string, body io.Reader) ([][]string, error) {
+	tmpl, ok := s.TxTemplates[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown transaction template %q", name)
+	}
+	var params map[string]TxParam
+	err := json.NewDecoder(body).Decode(&params)
+	if err == io.EOF {
+		// an empty body is fine for templates without parameters
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return expandTemplate(tmpl, params)
+}
+
+// expandTemplate returns the command list made by replacing each parameter
+// reference "{name}" in tmpl with its value from params. A command which
+// references a parameter given as a list is repeated once for each item in
+// the list, so a template can act on any number of files. A command may
+// reference at most one parameter with more than one value. It is an error
+// for a referenced parameter to be missing, or for params to have a
+// parameter the template does not use.
+func expandTemplate(tmpl [][]string, params map[string]TxParam) ([][]string, error) {
+	used := make(map[string]bool)
+	for _, name := range TemplateParams(tmpl) {
+		if _, ok := params[name]; !ok {
+			return nil, fmt.Errorf("missing template parameter %q", name)
+		}
+		used[name] = true
+	}
+	for name := range params {
+		if !used[name] {
+			return nil, fmt.Errorf("unknown template parameter %q", name)
+		}
+	}
+
+	var result [][]string
+	for _, cmd := range tmpl {
+		// find the list parameter, if any, this command repeats over
+		var list string
+		for _, name := range TemplateParams([][]string{cmd}) {
+			if len(params[name]) == 1 {
+				continue
+			}
+			if list != "" {
+				return nil, fmt.Errorf("command %v uses more than one list parameter", cmd)
+			}
+			list = name
+		}
+		n := 1
+		if list != "" {
+			n = len(params[list])
+		}
+		for i := 0; i < n; i++ {
+			var expanded []string
+			for _, arg := range cmd {
+				arg = templateParam.ReplaceAllStringFunc(arg, func(ref string) string {
+					name := ref[1 : len(ref)-1]
+					if name == list {
+						return params[name][i]
+					}
+					return params[name][0]
+				})
+				expanded = append(expanded, arg)
+			}
+			result = append(result, expanded)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"encoding/json"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestExpandTemplate(t *testing.T) {
+	tmpl := [][]string{
+		{"add", "{file}"},
+		{"slot", "{dir}/{file}", "{file}"},
+		{"note", "{note}"},
+	}
+	var table = []struct {
+		params string
+		expect [][]string // nil means an error is expected
+	}{
+		{`{"file": "a", "dir": "d", "note": "n"}`,
+			[][]string{{"add", "a"}, {"slot", "d/a", "a"}, {"note", "n"}}},
+		{`{"file": ["a", "b"], "dir": "d", "note": "n"}`,
+			[][]string{{"add", "a"}, {"add", "b"}, {"slot", "d/a", "a"}, {"slot", "d/b", "b"}, {"note", "n"}}},
+		{`{"file": [], "dir": "d", "note": "n"}`,
+			[][]string{{"note", "n"}}},
+		{`{"file": "a", "dir": "d"}`, nil},                            // missing
+		{`{"file": "a", "dir": "d", "note": "n", "extra": "x"}`, nil}, // unknown
+		{`{"file": ["a", "b"], "dir": ["d", "e"], "note": "n"}`, nil}, // two lists
+	}
+	for _, tab := range table {
+		var params map[string]TxParam
+		err := json.Unmarshal([]byte(tab.params), &params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := expandTemplate(tmpl, params)
+		if tab.expect == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error, received %v", tab.params, result)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: received error %s", tab.params, err)
+			continue
+		}
+		if !reflect.DeepEqual(result, tab.expect) {
+			t.Errorf("%s: received %v, expected %v", tab.params, result, tab.expect)
+		}
+	}
+}
+
+func TestTemplateTransaction(t *testing.T) {
+	file1 := uploadstring(t, "POST", "/upload", "hello template 1")
+	file2 := uploadstring(t, "POST", "/upload", "hello template 2")
+	fids := []string{path.Base(file1), path.Base(file2)}
+	itemid := "template" + randomid()
+
+	params, _ := json.Marshal(map[string]interface{}{
+		"file": fids,
+		"dir":  "access",
+		"note": "from a template",
+	})
+	txpath := uploadstringhash(t, "POST", "/item/"+itemid+"/transaction?template=add-files",
+		string(params), "", 202)
+	waitTransaction(t, txpath)
+	for _, fid := range fids {
+		checkStatus(t, "GET", "/item/"+itemid+"/access/"+fid, 200)
+	}
+
+	uploadstringhash(t, "POST", "/item/"+itemid+"/transaction?template=no-such-template",
+		"{}", "", 400)
+	uploadstringhash(t, "POST", "/item/"+itemid+"/transaction?template=add-files",
+		`{"file": "x"}`, "", 400)
+}
@@ -1,10 +1,11 @@
 package server
 
 import (
+	"fmt"
 	"html/template"
-	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	raven "github.com/getsentry/raven-go"
@@ -18,26 +19,39 @@ type SimpleItem struct {
 	MaxBundle int // largest bundle id used by this item
 	Created   time.Time
 	Modified  time.Time
+	Accessed  time.Time // last time content was read. zero if unknown
 	Size      int64
 }
 
-// UIItemsHandler handles requests from GET /ui/items
-func (s *RESTServer) UIItemsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	n := 0
-	p := 1000
-	sort := "-modified"
+// An itemListQuery holds the paging, sorting, and filtering options for an
+// item listing.
+type itemListQuery struct {
+	N       int    // offset of the first item
+	P       int    // page size
+	Sort    string // sort order
+	Creator string // only items having a version saved by this user
+}
+
+// parseItemListQuery reads the item listing options from the request
+// parameters "n", "p", "s", and "creator". Unrecognized values are ignored.
+func parseItemListQuery(r *http.Request) itemListQuery {
+	q := itemListQuery{
+		P:       1000,
+		Sort:    "-modified",
+		Creator: r.FormValue("creator"),
+	}
 
 	if option := r.FormValue("n"); option != "" {
 		offset, err := strconv.Atoi(option)
 		if err == nil && offset >= 0 {
-			n = offset
+			q.N = offset
 		}
 	}
 
 	if option := r.FormValue("p"); option != "" {
 		pagesize, err := strconv.Atoi(option)
 		if err == nil && pagesize > 0 && pagesize < 2000 {
-			p = pagesize
+			q.P = pagesize
 		}
 	}
 
@@ -46,38 +60,113 @@ func (s *RESTServer) UIItemsHandler(w http.ResponseWriter, r *http.Request, ps h
 		switch option {
 		case "name", "-name", "size", "-size",
 			"modified", "-modified", "created", "-created":
-			sort = option
+			q.Sort = option
+		}
+	}
+	return q
+}
+
+// An itemListPage is one page of an item listing, along with where the
+// other pages start.
+type itemListPage struct {
+	itemListQuery
+	Total int // the number of items on every page, or -1 if not known
+	NextN int // offset of the next page, or -1 if this is the last one
+	PrevN int // offset of the previous page, or -1 if this is the first one
+	LastN int // offset of the last page, or -1 if not known
+}
+
+// newItemListPage works out the offsets of the pages around the one asked
+// for by q, given the total number of items. A negative total means it is
+// not known, in which case there is always a next page.
+func newItemListPage(q itemListQuery, total int) itemListPage {
+	page := itemListPage{
+		itemListQuery: q,
+		Total:         total,
+		NextN:         q.N + q.P,
+		PrevN:         -1,
+		LastN:         -1,
+	}
+	if q.N > 0 {
+		page.PrevN = q.N - q.P
+		if page.PrevN < 0 {
+			page.PrevN = 0
 		}
 	}
+	if total >= 0 {
+		if page.NextN >= total {
+			page.NextN = -1
+		}
+		page.LastN = 0
+		if total > 0 {
+			page.LastN = ((total - 1) / q.P) * q.P
+		}
+	}
+	return page
+}
 
-	items, err := s.BlobDB.GetItemList(n, p, sort)
+// setPageHeaders sets an X-Total-Count header giving the number of items
+// in the listing, if known, and an RFC 8288 Link header pointing to the
+// first, previous, next, and last pages. The links keep the other
+// parameters of the request.
+func setPageHeaders(w http.ResponseWriter, r *http.Request, page itemListPage) {
+	link := func(rel string, n int) string {
+		u := *r.URL
+		v := u.Query()
+		v.Set("n", strconv.Itoa(n))
+		v.Set("p", strconv.Itoa(page.P))
+		u.RawQuery = v.Encode()
+		return fmt.Sprintf("<%s>; rel=%q", u.RequestURI(), rel)
+	}
+	links := []string{link("first", 0)}
+	if page.PrevN >= 0 {
+		links = append(links, link("prev", page.PrevN))
+	}
+	if page.NextN >= 0 {
+		links = append(links, link("next", page.NextN))
+	}
+	if page.LastN >= 0 {
+		links = append(links, link("last", page.LastN))
+	}
+	w.Header().Add("Link", strings.Join(links, ", "))
+	if page.Total >= 0 {
+		w.Header().Set("X-Total-Count", strconv.Itoa(page.Total))
+	}
+}
+
+// countItems returns the number of items in the listing for q, or -1 if it
+// cannot be found.
+func (s *RESTServer) countItems(r *http.Request, q itemListQuery) int {
+	total, err := s.BlobDB.CountItems(q.Creator)
 	if err != nil {
-		log.Println(err)
+		requestLogger(r).Error("CountItems", "error", err)
+		raven.CaptureError(err, nil)
+		return -1
+	}
+	return total
+}
+
+// UIItemsHandler handles requests from GET /ui/items
+func (s *RESTServer) UIItemsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	q := parseItemListQuery(r)
+	items, err := s.BlobDB.GetItemList(q.N, q.P, q.Sort, q.Creator)
+	if err != nil {
+		requestLogger(r).Error("GetItemList", "error", err)
 		raven.CaptureError(err, nil)
 	}
 
 	results := struct {
-		N     int
-		NextN int
-		PrevN int
-		P     int
-		Sort  string
+		itemListPage
 		Items []SimpleItem
 	}{
-		N:     n,
-		NextN: n + p,
-		P:     p,
-		Sort:  sort,
-		Items: items,
-	}
-	// only need to set if the previous page will be > 0
-	if n > p {
-		results.PrevN = n - p
+		itemListPage: newItemListPage(q, s.countItems(r, q)),
+		Items:        items,
 	}
+	setPageHeaders(w, r, results.itemListPage)
 
 	err = itemlistTemplate.Execute(w, results)
 	if err != nil {
-		log.Println(err)
+		requestLogger(r).Error("template", "error", err)
 		raven.CaptureError(err, nil)
 	}
 }
@@ -103,18 +192,31 @@ tbody tr:nth-child(even) { background-color: #eeeeee; }
 <dl>
 	<dt>Start Offset</dt><dd>{{ .N }}</dd>
 	<dt>Items per page</dt><dd>{{ .P }}</dd>
+	{{ if ge .Total 0 }}<dt>Total Items</dt><dd>{{ .Total }}</dd>{{ end }}
 	<dt>Sort</dt><dd>{{ .Sort }}</dd>
+	{{ if .Creator }}<dt>Creator</dt><dd>{{ .Creator }}</dd>{{ end }}
 </dl>
 
-<a href="?p={{ .P }}&n={{ .PrevN }}&s={{ .Sort }}">Previous Page</a>
-•
-<a href="?p={{ .P }}&n={{ .NextN }}&s={{ .Sort }}">Next Page</a>
+<form method="get">
+	<input type="hidden" name="p" value="{{ .P }}">
+	<input type="hidden" name="s" value="{{ .Sort }}">
+	<label>Creator <input type="text" name="creator" value="{{ .Creator }}"></label>
+	<input type="submit" value="Filter">
+</form>
+
+<a href="?p={{ .P }}&n=0&s={{ .Sort }}&creator={{ .Creator }}">First Page</a>
+{{ if ge .PrevN 0 }}•
+<a href="?p={{ .P }}&n={{ .PrevN }}&s={{ .Sort }}&creator={{ .Creator }}">Previous Page</a>{{ end }}
+{{ if ge .NextN 0 }}•
+<a href="?p={{ .P }}&n={{ .NextN }}&s={{ .Sort }}&creator={{ .Creator }}">Next Page</a>{{ end }}
+{{ if ge .LastN 0 }}•
+<a href="?p={{ .P }}&n={{ .LastN }}&s={{ .Sort }}&creator={{ .Creator }}">Last Page</a>{{ end }}
 
 <table><thead><tr>
-	<th><a href="?p={{ .P }}&s={{ nextsort "name" .Sort }}">Item</a></th>
-	<th><a href="?p={{ .P }}&s={{ nextsort "created" .Sort }}">Date Created</a></th>
-	<th><a href="?p={{ .P }}&s={{ nextsort "modified" .Sort }}">Date Modified</a></th>
-	<th><a href="?p={{ .P }}&s={{ nextsort "size" .Sort }}">Size</a></th>
+	<th><a href="?p={{ .P }}&s={{ nextsort "name" .Sort }}&creator={{ .Creator }}">Item</a></th>
+	<th><a href="?p={{ .P }}&s={{ nextsort "created" .Sort }}&creator={{ .Creator }}">Date Created</a></th>
+	<th><a href="?p={{ .P }}&s={{ nextsort "modified" .Sort }}&creator={{ .Creator }}">Date Modified</a></th>
+	<th><a href="?p={{ .P }}&s={{ nextsort "size" .Sort }}&creator={{ .Creator }}">Size</a></th>
 </tr></thead><tbody>
 {{ range .Items }}
 	<tr>
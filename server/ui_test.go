@@ -0,0 +1,41 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestItemListPage(t *testing.T) {
+	var tests = []struct {
+		n, p, total         int
+		prev, next, lastpos int
+	}{
+		{0, 10, 25, -1, 10, 20},
+		{10, 10, 25, 0, 20, 20},
+		{20, 10, 25, 10, -1, 20},
+		{5, 10, 25, 0, 15, 20},
+		{0, 10, 10, -1, -1, 0},
+		{0, 10, 0, -1, -1, 0},
+		{10, 10, -1, 0, 20, -1}, // total not known
+	}
+	for _, test := range tests {
+		page := newItemListPage(itemListQuery{N: test.n, P: test.p}, test.total)
+		if page.PrevN != test.prev || page.NextN != test.next || page.LastN != test.lastpos {
+			t.Errorf("%v: received prev %d, next %d, last %d", test, page.PrevN, page.NextN, page.LastN)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/items?s=name&n=10&p=10", nil)
+	setPageHeaders(w, r, newItemListPage(itemListQuery{N: 10, P: 10}, 25))
+	const expected = `</items?n=0&p=10&s=name>; rel="first", ` +
+		`</items?n=0&p=10&s=name>; rel="prev", ` +
+		`</items?n=20&p=10&s=name>; rel="next", ` +
+		`</items?n=20&p=10&s=name>; rel="last"`
+	if link := w.Header().Get("Link"); link != expected {
+		t.Errorf("Received %s, expected %s", link, expected)
+	}
+	if total := w.Header().Get("X-Total-Count"); total != "25" {
+		t.Errorf("Received X-Total-Count %q", total)
+	}
+}
@@ -3,34 +3,125 @@ package server
 import (
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"math/rand"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/julienschmidt/httprouter"
 
+	"github.com/ndlib/bendo/apiv2"
 	"github.com/ndlib/bendo/fragment"
 	"github.com/ndlib/bendo/util"
 )
 
 // ListFileHandler handles requests to GET /upload
+// It returns a page of the files in the upload area, taking the parameters
+// "n", "p", "s", and "creator" as for item listings, with the sort orders
+// "name" and "-name" sorting by file id. The total number of files and links
+// to the other pages are in the headers. For compatibility, a JSON request
+// to the unversioned route with none of these parameters gets the id of
+// every file instead.
 func (s *RESTServer) ListFileHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	writeHTMLorJSON(w, r, listFileTemplate, s.FileStore.List())
+	if !isV2(r) && wantsJSON(r) && !hasListParams(r) {
+		writeJSON(w, s.FileStore.List())
+		return
+	}
+	q := parseItemListQuery(r)
+	list, total := s.listUploads(q)
+	setPageHeaders(w, r, newItemListPage(q, total))
+	if isV2(r) {
+		result := make([]apiv2.Upload, len(list))
+		for i := range list {
+			result[i] = apiv2.NewUpload(list[i])
+		}
+		writeJSON(w, result)
+		return
+	}
+	writeHTMLorJSON(w, r, listFileTemplate, list)
+}
+
+// hasListParams returns true if the request has any of the parameters of an
+// item listing.
+func hasListParams(r *http.Request) bool {
+	for _, name := range []string{"n", "p", "s", "creator"} {
+		if r.FormValue(name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// listUploads returns the page of files in the upload area asked for by q,
+// and the number of files on every page.
+func (s *RESTServer) listUploads(q itemListQuery) ([]fragment.Stat, int) {
+	var list []fragment.Stat
+	for _, id := range s.FileStore.List() {
+		f := s.FileStore.Lookup(id)
+		if f == nil {
+			continue // deleted since it was listed
+		}
+		stat := f.Stat()
+		if q.Creator != "" && stat.Creator != q.Creator {
+			continue
+		}
+		list = append(list, stat)
+	}
+	desc := strings.HasPrefix(q.Sort, "-")
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if desc {
+			a, b = b, a
+		}
+		switch strings.TrimPrefix(q.Sort, "-") {
+		case "size":
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		case "modified":
+			if !a.Modified.Equal(b.Modified) {
+				return a.Modified.Before(b.Modified)
+			}
+		case "created":
+			if !a.Created.Equal(b.Created) {
+				return a.Created.Before(b.Created)
+			}
+		}
+		return a.ID < b.ID
+	})
+	total := len(list)
+	if q.N >= len(list) {
+		list = nil
+	} else {
+		list = list[q.N:]
+	}
+	if len(list) > q.P {
+		list = list[:q.P]
+	}
+	if list == nil {
+		list = []fragment.Stat{}
+	}
+	return list, total
 }
 
 var (
 	listFileTemplate = template.Must(template.New("listfile").Parse(`<html>
 <h1>Files</h1>
-<ol>
+<table>
+<thead><tr><th>ID</th><th>Size</th><th>Creator</th><th>Modified</th></tr></thead>
+<tbody>
 {{ range . }}
-	<li><a href="/upload/{{ . }}/metadata">{{ . }}</a></li>
+	<tr><td><a href="/upload/{{ .ID }}/metadata">{{ .ID }}</a></td><td>{{ .Size }}</td><td>{{ .Creator }}</td><td>{{ .Modified }}</td></tr>
 {{ else }}
-	<li>No Files</li>
+	<tr><td>No Files</td></tr>
 {{ end }}
-</ol>
+</tbody>
+</table>
 </html>`))
 )
 
@@ -44,6 +135,10 @@ func (s *RESTServer) GetFileInfoHandler(w http.ResponseWriter, r *http.Request,
 		return
 	}
 	fstat := f.Stat()
+	if isV2(r) {
+		writeJSON(w, apiv2.NewUpload(fstat))
+		return
+	}
 	writeHTMLorJSON(w, r, fileInfoTemplate, fstat)
 }
 
@@ -69,15 +164,42 @@ var (
 )
 
 // AppendFileHandler handles requests to both POST /upload and POST /upload/:fileid
+//
+// If the request has an X-Upload-Offset header the body is saved at that
+// byte offset in the file, instead of after what has been uploaded so far,
+// so the pieces of a file may be sent in any order and at the same time.
 func (s *RESTServer) AppendFileHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	uploadMD5 := getHexadecimalHeader(r, "X-Upload-Md5")
-	uploadSHA256 := getHexadecimalHeader(r, "X-Upload-Sha256")
+	uploadMD5, uploadSHA256 := uploadChecksums(r)
 	if len(uploadMD5)+len(uploadSHA256) == 0 {
 		w.WriteHeader(400)
-		fmt.Fprintf(w, "At least one of X-Upload-Md5 or X-Upload-Sha256 must be provided")
+		fmt.Fprintf(w, "At least one of X-Upload-Md5, X-Upload-Sha256, or a sha-256 or md5 Content-Digest must be provided")
 		return
 	}
+	var offset int64 = -1
+	if v := r.Header.Get("X-Upload-Offset"); v != "" {
+		var err error
+		offset, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || offset < 0 {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "Bad X-Upload-Offset %q\n", v)
+			return
+		}
+	}
 	fileid := ps.ByName("fileid")
+	if fileid == capacityFileID {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%q is not a valid file id\n", fileid)
+		return
+	}
+	user := ps.ByName("username")
+	if s.overQuota(user, r.ContentLength) {
+		writeOverQuota(w)
+		return
+	}
+	if msg := s.checkTransfer(r, user, UsageToken, r.ContentLength); msg != "" {
+		writeQuotaExceeded(w, r, msg)
+		return
+	}
 	var f fragment.FileEntry // the file to append to
 	// if no file was given, make a new one
 	// if a file id was given, but doesn't exist...create it
@@ -104,23 +226,50 @@ func (s *RESTServer) AppendFileHandler(w http.ResponseWriter, r *http.Request, p
 		fmt.Fprintln(w, "no body")
 		return
 	}
-	wr, err := f.Append()
+	// set the creator first so the upload counts against their quota
+	if user != "" && f.Stat().Creator == "" {
+		f.SetCreator(user)
+	}
+	var wr io.WriteCloser
+	var err error
+	if offset >= 0 {
+		// the fragment checks the checksums itself, since rolling back
+		// could remove a piece another request has just added
+		wr, err = f.AppendAt(offset, uploadMD5, uploadSHA256)
+	} else {
+		wr, err = f.Append()
+	}
 	if err != nil {
 		w.WriteHeader(500)
 		fmt.Fprintln(w, err.Error())
 		return
 	}
 	hw := util.NewHashWriter(wr)
-	_, err = io.Copy(hw, r.Body)
+	n, err := io.Copy(hw, r.Body)
+	s.recordUpload(user, n)
 	err2 := wr.Close()
 	r.Body.Close()
-	w.Header().Set("Location", "/upload/"+f.Stat().ID)
+	w.Header().Set("Location", apiPath(r, "/upload/"+f.Stat().ID))
+	if errors.Is(err, fragment.ErrQuota) || errors.Is(err2, fragment.ErrQuota) {
+		writeOverQuota(w)
+		return
+	}
 	if err != nil {
 		w.WriteHeader(500)
 		fmt.Fprintln(w, err.Error())
 		return
 	}
-	if err2 != nil {
+	switch err2 {
+	case nil:
+	case fragment.ErrChecksum:
+		w.WriteHeader(412)
+		fmt.Fprintln(w, "Checksum mismatch")
+		return
+	case fragment.ErrOverlap:
+		w.WriteHeader(409)
+		fmt.Fprintln(w, err2.Error())
+		return
+	default:
 		w.WriteHeader(500)
 		fmt.Fprintln(w, err2.Error())
 		return
@@ -153,6 +302,24 @@ func (s *RESTServer) AppendFileHandler(w http.ResponseWriter, r *http.Request, p
 	}
 }
 
+// uploadChecksums returns the MD5 and SHA-256 checksums the request body is
+// expected to have, from the X-Upload-Md5 and X-Upload-Sha256 headers, or
+// else from a standard Content-Digest header. Either may be empty.
+func uploadChecksums(r *http.Request) ([]byte, []byte) {
+	uploadMD5 := getHexadecimalHeader(r, "X-Upload-Md5")
+	uploadSHA256 := getHexadecimalHeader(r, "X-Upload-Sha256")
+	if v := r.Header.Get("Content-Digest"); v != "" {
+		digests := parseDigest(v)
+		if len(uploadMD5) == 0 {
+			uploadMD5 = digests[digestMD5]
+		}
+		if len(uploadSHA256) == 0 {
+			uploadSHA256 = digests[digestSHA256]
+		}
+	}
+	return uploadMD5, uploadSHA256
+}
+
 // getHexadecimalHeader returns the value for `header`, after first
 // translating it from hexadecimal to binary. If the header doesn't exist
 // or is not valid hexadecimal, returns an empty slice.
@@ -205,14 +372,24 @@ func (s *RESTServer) SetFileInfoHandler(w http.ResponseWriter, r *http.Request,
 }
 
 // GetFileHandler handles requests to GET /upload/:fileid
+// It also handles GET /upload/capacity.
 func (s *RESTServer) GetFileHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	fileid := ps.ByName("fileid")
+	if fileid == capacityFileID {
+		s.UploadCapacityHandler(w, r, ps)
+		return
+	}
 	f := s.FileStore.Lookup(fileid)
 	if f == nil {
 		w.WriteHeader(404)
 		fmt.Fprintln(w, "Unknown file identifier")
 		return
 	}
+	if stat := f.Stat(); stat.Size != stat.Length {
+		w.WriteHeader(409)
+		fmt.Fprintln(w, "File is missing pieces")
+		return
+	}
 	fd := f.Open()
 	io.Copy(w, fd)
 	fd.Close()
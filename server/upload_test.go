@@ -0,0 +1,86 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ndlib/bendo/apiv2"
+	"github.com/ndlib/bendo/fragment"
+	"github.com/ndlib/bendo/store"
+)
+
+func TestListFilePaging(t *testing.T) {
+	s := &RESTServer{FileStore: fragment.New(store.NewMemory())}
+	for _, up := range []struct{ id, creator, content string }{
+		{"c", "alice", "1"},
+		{"a", "bob", "12"},
+		{"b", "alice", "123"},
+	} {
+		f := s.FileStore.New(up.id)
+		f.SetCreator(up.creator)
+		w, _ := f.Append()
+		io.WriteString(w, up.content)
+		w.Close()
+	}
+	list := func(path string, result interface{}) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Accept-Encoding", "application/json")
+		s.ListFileHandler(w, r, nil)
+		err := json.NewDecoder(w.Body).Decode(result)
+		if err != nil {
+			t.Fatal(path, err)
+		}
+		return w
+	}
+	ids := func(stats []fragment.Stat) string {
+		var result []string
+		for _, stat := range stats {
+			result = append(result, stat.ID)
+		}
+		return strings.Join(result, " ")
+	}
+
+	// without parameters the old list of ids is returned
+	var names []string
+	list("/upload", &names)
+	if len(names) != 3 {
+		t.Errorf("Received %v, expected 3 ids", names)
+	}
+
+	var tests = []struct {
+		query    string
+		expected string
+	}{
+		{"s=name", "a b c"},
+		{"s=-size", "b a c"},
+		{"s=-modified", "b a c"},
+		{"s=modified&n=1&p=1", "a"},
+		{"s=name&creator=alice", "b c"},
+		{"s=name&n=5", ""},
+	}
+	for _, test := range tests {
+		var stats []fragment.Stat
+		w := list("/upload?"+test.query, &stats)
+		if got := ids(stats); got != test.expected {
+			t.Errorf("%s: Received %q, expected %q", test.query, got, test.expected)
+		}
+		if test.query == "s=modified&n=1&p=1" {
+			if n := w.Header().Get("X-Total-Count"); n != "3" {
+				t.Errorf("Received X-Total-Count %q, expected 3", n)
+			}
+			if link := w.Header().Get("Link"); !strings.Contains(link, `rel="next"`) {
+				t.Errorf("Received Link %q, expected a next page", link)
+			}
+		}
+	}
+
+	var uploads []apiv2.Upload
+	list(APIPrefix+"/upload?creator=bob", &uploads)
+	if len(uploads) != 1 || uploads[0].ID != "a" || uploads[0].Size != 2 {
+		t.Errorf("Received %+v, expected file a", uploads)
+	}
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"expvar"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+	"github.com/julienschmidt/httprouter"
+)
+
+// The kinds of usage tracked.
+const (
+	UsageToken    = "token"    // bytes uploaded using a token, by user name
+	UsageItem     = "item"     // bytes added to an item by transactions
+	UsageDownload = "download" // bytes of blobs downloaded using a token, by user name
+)
+
+// A UsageDB keeps daily totals of the bytes uploaded and downloaded, so
+// heavy depositors can be billed and runaway ones found.
+type UsageDB interface {
+	// RecordUsage adds n bytes to the total for the given kind and name
+	// on the (UTC) day containing when.
+	RecordUsage(kind string, name string, when time.Time, n int64) error
+
+	// UsageSince returns the daily totals for every day on or after the
+	// one containing since.
+	UsageSince(since time.Time) ([]UsageRecord, error)
+
+	// UserUsage returns the total bytes for the given kind and name for
+	// every day on or after the one containing since.
+	UserUsage(kind string, name string, since time.Time) (int64, error)
+}
+
+// A UsageRecord is the number of bytes uploaded or downloaded by one token
+// or added to one item on a single day.
+type UsageRecord struct {
+	Kind  string    // one of UsageToken, UsageItem, or UsageDownload
+	Name  string    // the user name or item id
+	Day   time.Time // midnight UTC at the start of the day
+	Bytes int64
+}
+
+// usageDay returns the start of the UTC day containing t.
+func usageDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+var (
+	xUploadBytes      = expvar.NewInt("upload.bytes")
+	xUploadTokenBytes = expvar.NewMap("upload.bytes.token")
+	xDownloadBytes    = expvar.NewInt("download.bytes")
+)
+
+// recordUpload notes that the given user uploaded n bytes. It is counted in
+// the metrics and, if usage tracking is enabled, saved in the database.
+// Errors are logged and otherwise ignored.
+func (s *RESTServer) recordUpload(user string, n int64) {
+	xUploadBytes.Add(n)
+	xUploadTokenBytes.Add(user, n)
+	s.recordUsage(UsageToken, user, n)
+}
+
+// recordDownload notes that the given user downloaded n bytes of blob
+// content. Anonymous downloads are counted only in the metrics.
+func (s *RESTServer) recordDownload(user string, n int64) {
+	xDownloadBytes.Add(n)
+	if user != "" {
+		s.recordUsage(UsageDownload, user, n)
+	}
+}
+
+// recordUsage saves n bytes of usage for the given name, if usage tracking
+// is enabled. Errors are logged and otherwise ignored.
+func (s *RESTServer) recordUsage(kind string, name string, n int64) {
+	if s.Usage == nil || n == 0 {
+		return
+	}
+	err := s.Usage.RecordUsage(kind, name, time.Now(), n)
+	if err != nil {
+		slog.Error("RecordUsage", "kind", kind, "name", name, "error", err)
+		raven.CaptureError(err, nil)
+	}
+}
+
+// A UsageReport totals the bytes uploaded and downloaded by each token and
+// added to each item over a number of days.
+type UsageReport struct {
+	Generated time.Time
+	Since     time.Time // the first day included
+	Days      int
+	Tokens    []UsageTotal // largest first
+	Items     []UsageTotal // largest first, truncated to the limit
+	Daily     []UsageTotal // the bytes uploaded each day, oldest first
+	Downloads []UsageTotal // bytes downloaded by each token, largest first
+}
+
+// A UsageTotal is the number of bytes counted for a token, item, or day.
+type UsageTotal struct {
+	Name  string
+	Bytes int64
+}
+
+// buildUsageReport tallies the given records into a report. At most limit
+// items are listed.
+func buildUsageReport(records []UsageRecord, now time.Time, days int, limit int) UsageReport {
+	report := UsageReport{
+		Generated: now,
+		Since:     usageDay(now).AddDate(0, 0, -(days - 1)),
+		Days:      days,
+	}
+	tokens := make(map[string]int64)
+	items := make(map[string]int64)
+	daily := make(map[string]int64)
+	downloads := make(map[string]int64)
+	for _, rec := range records {
+		switch rec.Kind {
+		case UsageToken:
+			tokens[rec.Name] += rec.Bytes
+			daily[rec.Day.UTC().Format("2006-01-02")] += rec.Bytes
+		case UsageItem:
+			items[rec.Name] += rec.Bytes
+		case UsageDownload:
+			downloads[rec.Name] += rec.Bytes
+		}
+	}
+	report.Tokens = sortTotals(tokens)
+	report.Downloads = sortTotals(downloads)
+	report.Items = sortTotals(items)
+	if len(report.Items) > limit {
+		report.Items = report.Items[:limit]
+	}
+	for name, n := range daily {
+		report.Daily = append(report.Daily, UsageTotal{Name: name, Bytes: n})
+	}
+	sort.Slice(report.Daily, func(i, j int) bool {
+		return report.Daily[i].Name < report.Daily[j].Name
+	})
+	return report
+}
+
+// sortTotals turns the map into a list, largest first.
+func sortTotals(m map[string]int64) []UsageTotal {
+	var result []UsageTotal
+	for name, n := range m {
+		result = append(result, UsageTotal{Name: name, Bytes: n})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Bytes != result[j].Bytes {
+			return result[i].Bytes > result[j].Bytes
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// UsageHandler handles requests to GET /admin/usage
+// The optional parameter "days" sets how many days to include, counting
+// today (default 30), and "limit" sets the most items to list (default 100).
+func (s *RESTServer) UsageHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.Usage == nil {
+		NotImplementedHandler(w, r, ps)
+		return
+	}
+	days, err := strconv.Atoi(r.FormValue("days"))
+	if err != nil || days <= 0 {
+		days = 30
+	}
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit < 0 {
+		limit = 100
+	}
+	now := time.Now()
+	records, err := s.Usage.UsageSince(usageDay(now).AddDate(0, 0, -(days - 1)))
+	if err != nil {
+		requestLogger(r).Error("UsageSince", "error", err)
+		raven.CaptureError(err, nil)
+		w.WriteHeader(500)
+		return
+	}
+	report := buildUsageReport(records, now, days, limit)
+	writeHTMLorJSON(w, r, usageTemplate, report)
+}
+
+var (
+	usageTemplate = template.Must(template.New("usage").Parse(`<html>
+<h1>Usage</h1>
+<dl>
+<dt>Generated</dt><dd>{{ .Generated }}</dd>
+<dt>Since</dt><dd>{{ .Since }} ({{ .Days }} days)</dd>
+</dl>
+<h2>Tokens</h2>
+<table><thead><tr>
+	<th>User</th><th>Bytes</th>
+</tr></thead><tbody>
+{{ range .Tokens }}
+	<tr><td>{{ .Name }}</td><td>{{ .Bytes }}</td></tr>
+{{ end }}
+</tbody></table>
+<h2>Items</h2>
+<table><thead><tr>
+	<th>Item</th><th>Bytes</th>
+</tr></thead><tbody>
+{{ range .Items }}
+	<tr><td><a href="/item/{{ .Name }}">{{ .Name }}</a></td><td>{{ .Bytes }}</td></tr>
+{{ end }}
+</tbody></table>
+<h2>Daily</h2>
+<table><thead><tr>
+	<th>Day</th><th>Bytes</th>
+</tr></thead><tbody>
+{{ range .Daily }}
+	<tr><td>{{ .Name }}</td><td>{{ .Bytes }}</td></tr>
+{{ end }}
+</tbody></table>
+<h2>Downloads</h2>
+<table><thead><tr>
+	<th>User</th><th>Bytes</th>
+</tr></thead><tbody>
+{{ range .Downloads }}
+	<tr><td>{{ .Name }}</td><td>{{ .Bytes }}</td></tr>
+{{ end }}
+</tbody></table>
+</html>`))
+)
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestBuildUsageReport(t *testing.T) {
+	now := time.Date(2020, 3, 10, 15, 0, 0, 0, time.UTC)
+	day1 := usageDay(now.AddDate(0, 0, -1))
+	day2 := usageDay(now)
+	records := []UsageRecord{
+		{Kind: UsageToken, Name: "loader", Day: day1, Bytes: 100},
+		{Kind: UsageToken, Name: "loader", Day: day2, Bytes: 50},
+		{Kind: UsageToken, Name: "person", Day: day2, Bytes: 10},
+		{Kind: UsageItem, Name: "a", Day: day1, Bytes: 20},
+		{Kind: UsageItem, Name: "b", Day: day2, Bytes: 140},
+	}
+	report := buildUsageReport(records, now, 7, 1)
+	if !report.Since.Equal(time.Date(2020, 3, 4, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Received since %v", report.Since)
+	}
+	if len(report.Tokens) != 2 || report.Tokens[0] != (UsageTotal{"loader", 150}) {
+		t.Errorf("Received tokens %v", report.Tokens)
+	}
+	// limited to one item
+	if len(report.Items) != 1 || report.Items[0] != (UsageTotal{"b", 140}) {
+		t.Errorf("Received items %v", report.Items)
+	}
+	var daily = []UsageTotal{{"2020-03-09", 100}, {"2020-03-10", 60}}
+	if len(report.Daily) != 2 || report.Daily[0] != daily[0] || report.Daily[1] != daily[1] {
+		t.Errorf("Received daily %v, expected %v", report.Daily, daily)
+	}
+	// downloads are not counted as uploads
+	records = append(records, UsageRecord{Kind: UsageDownload, Name: "person", Day: day2, Bytes: 500})
+	report = buildUsageReport(records, now, 7, 1)
+	if len(report.Tokens) != 2 || report.Tokens[0] != (UsageTotal{"loader", 150}) || len(report.Daily) != 2 {
+		t.Errorf("Received %v", report)
+	}
+	if len(report.Downloads) != 1 || report.Downloads[0] != (UsageTotal{"person", 500}) {
+		t.Errorf("Received downloads %v", report.Downloads)
+	}
+}
+
+func runUsageSequence(t *testing.T, db UsageDB) {
+	now := time.Now()
+	var table = []struct {
+		kind, name string
+		when       time.Time
+		n          int64
+	}{
+		{UsageToken, "loader", now, 10},
+		{UsageToken, "loader", now, 15},
+		{UsageToken, "loader", now.AddDate(0, 0, -3), 7},
+		{UsageItem, "abc", now, 25},
+	}
+	for _, tab := range table {
+		err := db.RecordUsage(tab.kind, tab.name, tab.when, tab.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	records, err := db.UsageSince(now.AddDate(0, 0, -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Received %v, expected 2 records", records)
+	}
+	for _, rec := range records {
+		if rec.Bytes != 25 || !rec.Day.Equal(usageDay(now)) {
+			t.Errorf("Received %v", rec)
+		}
+	}
+	total, err := db.UserUsage(UsageToken, "loader", now.AddDate(0, 0, -3))
+	if err != nil || total != 32 {
+		t.Errorf("Received %d, %v, expected 32", total, err)
+	}
+	total, err = db.UserUsage(UsageDownload, "loader", now)
+	if err != nil || total != 0 {
+		t.Errorf("Received %d, %v, expected 0", total, err)
+	}
+}
+
+func TestUsageRoute(t *testing.T) {
+	const content = "hello usage"
+	uploadstring(t, "POST", "/upload", content)
+
+	body := getbody(t, "GET", "/admin/usage?days=1&format=json", 200)
+	var report UsageReport
+	err := json.Unmarshal([]byte(body), &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Days != 1 || len(report.Tokens) == 0 || report.Tokens[0].Bytes < int64(len(content)) {
+		t.Errorf("Received %#v", report)
+	}
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"encoding/json"
+	"expvar"
+	"log/slog"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ndlib/bendo/items"
+)
+
+// A warmEntry records how much a blob has been read recently.
+type warmEntry struct {
+	Key   string
+	Item  string
+	Blob  items.BlobID
+	Size  int64
+	Score float64   // number of reads, halved every warmHalfLife
+	Last  time.Time // when Score was last updated
+}
+
+// A warmList ranks the blobs read from the cache by how often and how
+// recently they were read, so the most used ones can be copied back into
+// the cache after it has been emptied.
+type warmList struct {
+	m       sync.Mutex
+	entries map[string]*warmEntry
+	dirty   bool // true if changed since the last save
+}
+
+const (
+	// warmHalfLife is how long it takes for a read to count half as much
+	// towards a blob's rank.
+	warmHalfLife = 7 * 24 * time.Hour
+
+	// warmListMax is the number of blobs the warm list keeps.
+	warmListMax = 10000
+
+	// warmSaveInterval is how often the warm list is saved.
+	warmSaveInterval = 10 * time.Minute
+
+	// warmIdleWait is how long to wait before checking again whether
+	// there is time to warm the cache.
+	warmIdleWait = 30 * time.Second
+)
+
+var (
+	xCacheWarmed      = expvar.NewInt("cache.warm.count")
+	xCacheWarmedBytes = expvar.NewInt("cache.warm.bytes")
+)
+
+// decayed returns the score of e at the time now.
+func (e *warmEntry) decayed(now time.Time) float64 {
+	d := now.Sub(e.Last)
+	if d <= 0 {
+		return e.Score
+	}
+	return e.Score * math.Exp2(-float64(d)/float64(warmHalfLife))
+}
+
+// record notes that the given blob was read at the time now.
+func (wl *warmList) record(key, item string, bid items.BlobID, size int64, now time.Time) {
+	wl.m.Lock()
+	defer wl.m.Unlock()
+	if wl.entries == nil {
+		wl.entries = make(map[string]*warmEntry)
+	}
+	e := wl.entries[key]
+	if e == nil {
+		e = &warmEntry{Key: key, Item: item, Blob: bid, Size: size, Last: now}
+		wl.entries[key] = e
+	}
+	e.Score = e.decayed(now) + 1
+	e.Last = now
+	wl.dirty = true
+	// trim in batches so every read does not need a sort
+	if len(wl.entries) > warmListMax+warmListMax/10 {
+		for _, e := range wl.rankedLocked(now)[warmListMax:] {
+			delete(wl.entries, e.Key)
+		}
+	}
+}
+
+// ranked returns the entries in the list, the highest ranked first.
+func (wl *warmList) ranked(now time.Time) []warmEntry {
+	wl.m.Lock()
+	defer wl.m.Unlock()
+	return wl.rankedLocked(now)
+}
+
+func (wl *warmList) rankedLocked(now time.Time) []warmEntry {
+	result := make([]warmEntry, 0, len(wl.entries))
+	for _, e := range wl.entries {
+		entry := *e
+		entry.Score = e.decayed(now)
+		entry.Last = now
+		result = append(result, entry)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Score != result[j].Score {
+			return result[i].Score > result[j].Score
+		}
+		return result[i].Key < result[j].Key
+	})
+	return result
+}
+
+// save writes the list to the given file, if it has changed since it was
+// last saved or loaded.
+func (wl *warmList) save(path string) error {
+	wl.m.Lock()
+	if !wl.dirty {
+		wl.m.Unlock()
+		return nil
+	}
+	wl.dirty = false
+	list := wl.rankedLocked(time.Now())
+	wl.m.Unlock()
+	buf, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file so a crash cannot leave half a list
+	err = os.WriteFile(path+".tmp", buf, 0644)
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	return err
+}
+
+// load replaces the list with the one saved in the given file. It is not an
+// error if the file does not exist.
+func (wl *warmList) load(path string) error {
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var list []warmEntry
+	err = json.Unmarshal(buf, &list)
+	if err != nil {
+		return err
+	}
+	wl.m.Lock()
+	defer wl.m.Unlock()
+	wl.entries = make(map[string]*warmEntry)
+	for i := range list {
+		wl.entries[list[i].Key] = &list[i]
+	}
+	wl.dirty = false
+	return nil
+}
+
+// recordWarm notes that a GET read the given blob, if the warm list is kept.
+func (s *RESTServer) recordWarm(key, id string, binfo *items.Blob) {
+	if s.WarmFile == "" {
+		return
+	}
+	s.warm.record(key, id, binfo.ID, binfo.Size, time.Now())
+}
+
+// startWarmList loads the saved warm list and starts the goroutine which
+// saves it periodically. It returns the list as it was loaded.
+func (s *RESTServer) startWarmList() []warmEntry {
+	if s.WarmFile == "" {
+		return nil
+	}
+	err := s.warm.load(s.WarmFile)
+	if err != nil {
+		slog.Error("loading warm list", "file", s.WarmFile, "error", err)
+	}
+	go func() {
+		for {
+			time.Sleep(warmSaveInterval)
+			s.saveWarmList()
+		}
+	}()
+	return s.warm.ranked(time.Now())
+}
+
+// saveWarmList saves the warm list, logging any error.
+func (s *RESTServer) saveWarmList() {
+	if s.WarmFile == "" {
+		return
+	}
+	err := s.warm.save(s.WarmFile)
+	if err != nil {
+		slog.Error("saving warm list", "file", s.WarmFile, "error", err)
+	}
+}
+
+// warmCache copies the first WarmCount blobs of list which are not already
+// cached into the cache, stopping once WarmBytes have been copied. Blobs
+// are only copied while tape is available and no other blobs are being
+// recalled, so client requests go first. It should be run after the cache
+// has been scanned, and returns when done.
+func (s *RESTServer) warmCache(list []warmEntry) {
+	if s.WarmCount <= 0 || len(list) == 0 {
+		return
+	}
+	cacheMaxSize := s.Cache.MaxSize()
+	budget := s.WarmBytes
+	if budget == 0 {
+		budget = cacheMaxSize / 2 // zero means no limit
+	}
+	if len(list) > s.WarmCount {
+		list = list[:s.WarmCount]
+	}
+	var count int
+	var total int64
+	for _, e := range list {
+		if s.Cache.Contains(e.Key) {
+			continue
+		}
+		// the same limit findContent uses for cacheable blobs
+		if cacheMaxSize > 0 && e.Size >= cacheMaxSize/8 {
+			continue
+		}
+		if budget > 0 && total+e.Size > budget {
+			continue
+		}
+		for !s.warmIdle() {
+			time.Sleep(warmIdleWait)
+		}
+		c := s.tapeinflight.DoChan(e.Key, func() (interface{}, error) {
+			s.copyBlobIntoCache(e.Key, e.Item, e.Blob)
+			return nil, nil
+		})
+		<-c
+		if s.Cache.Contains(e.Key) {
+			count++
+			total += e.Size
+			xCacheWarmed.Add(1)
+			xCacheWarmedBytes.Add(e.Size)
+		}
+	}
+	slog.Info("cache warmed", "blobs", count, "bytes", total)
+}
+
+// warmIdle is true if there is time to copy a blob into the cache for
+// warming it.
+func (s *RESTServer) warmIdle() bool {
+	if !s.useTape || s.activeMaintenance() != nil {
+		return false
+	}
+	s.recalls.m.Lock()
+	defer s.recalls.m.Unlock()
+	return len(s.recalls.entries) == 0
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+
+	"github.com/ndlib/bendo"
+	"github.com/ndlib/bendo/blobcache"
+	"github.com/ndlib/bendo/items"
+	"github.com/ndlib/bendo/store"
+)
+
+func TestWarmList(t *testing.T) {
+	var wl warmList
+	now := time.Now()
+	// c was read as often as b, but two half lives ago
+	wl.record("c", "item", 3, 10, now.Add(-2*warmHalfLife))
+	wl.record("c", "item", 3, 10, now.Add(-2*warmHalfLife))
+	wl.record("a", "item", 1, 10, now)
+	wl.record("a", "item", 1, 10, now)
+	wl.record("a", "item", 1, 10, now)
+	wl.record("b", "item", 2, 10, now)
+	wl.record("b", "item", 2, 10, now)
+
+	checkWarmOrder(t, wl.ranked(now), "a b c")
+	if e := wl.ranked(now)[2]; e.Score < 0.49 || e.Score > 0.51 {
+		t.Errorf("Received score %f, expected 0.5", e.Score)
+	}
+
+	path := filepath.Join(t.TempDir(), "warmlist.json")
+	err := wl.save(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded warmList
+	err = loaded.load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := loaded.ranked(now)
+	checkWarmOrder(t, list, "a b c")
+	if list[1].Item != "item" || list[1].Blob != 2 || list[1].Size != 10 {
+		t.Errorf("Received %v", list[1])
+	}
+
+	// a missing file is an empty list
+	var missing warmList
+	err = missing.load(path + "-missing")
+	if err != nil || len(missing.ranked(now)) != 0 {
+		t.Errorf("Received %v, %v", missing.ranked(now), err)
+	}
+}
+
+func checkWarmOrder(t *testing.T, list []warmEntry, expected string) {
+	var keys []string
+	for _, e := range list {
+		keys = append(keys, e.Key)
+	}
+	if strings.Join(keys, " ") != expected {
+		t.Errorf("Received order %v, expected %s", keys, expected)
+	}
+}
+
+func TestWarmCache(t *testing.T) {
+	s := &RESTServer{
+		Items:     items.New(store.NewMemory()),
+		Cache:     blobcache.NewLRU(store.NewMemory(), 1000),
+		WarmCount: 2,
+		WarmBytes: 20,
+	}
+	s.EnableTapeUse()
+	s.tapeinflight = &singleflight.Group{}
+	w, err := s.Items.Open("warm", "nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{"first blob", "second blob", "third"} {
+		_, err = w.WriteBlob(strings.NewReader(content), int64(len(content)), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	var list []warmEntry
+	for _, e := range []struct {
+		bid  items.BlobID
+		size int64
+	}{{1, 10}, {2, 11}, {3, 5}} {
+		list = append(list, warmEntry{
+			Key:  bendo.CacheKey("warm", e.bid),
+			Item: "warm",
+			Blob: e.bid,
+			Size: e.size,
+		})
+	}
+	s.warmCache(list)
+	// the second blob is over the byte budget, and the third is past
+	// the count
+	for i, expected := range []bool{true, false, false} {
+		if s.Cache.Contains(list[i].Key) != expected {
+			t.Errorf("Blob %d cached is %v, expected %v", i+1, !expected, expected)
+		}
+	}
+}
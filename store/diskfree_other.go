@@ -0,0 +1,8 @@
+//go:build !unix
+
+package store
+
+// diskFree is not supported on this platform.
+func diskFree(path string) (int64, error) {
+	return 0, ErrNotSupported
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package store
+
+import (
+	"syscall"
+)
+
+// diskFree returns the number of bytes available to unprivileged users on
+// the file system holding path.
+func diskFree(path string) (int64, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(path, &st)
+	if err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
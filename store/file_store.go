@@ -8,6 +8,7 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 	"unicode"
 	"unicode/utf8"
 
@@ -22,6 +23,7 @@ import (
 // specific file extension, you need to add it to your key.
 type FileSystem struct {
 	root string
+	lock LockPolicy // WORM retention for new files
 }
 
 const (
@@ -33,6 +35,12 @@ var (
 	// make sure it implements the Store interface
 	_ Store = &FileSystem{}
 
+	// and that it can lock files
+	_ Locker = &FileSystem{}
+
+	// and report the free disk space
+	_ FreeSpacer = &FileSystem{}
+
 	// ErrKeyExists indicates an attempt to create a key which already exists
 	ErrKeyExists = errors.New("Key already exists")
 
@@ -47,11 +55,20 @@ var (
 
 	// ErrKeyContainsControlChar  means the key provided contains Control Characters
 	ErrKeyContainsControlChar = errors.New("Key contains Control  Characters")
+
+	// ErrNotSupported indicates the store cannot do the requested operation
+	ErrNotSupported = errors.New("Operation not supported by store")
 )
 
 // NewFileSystem creates a new FileSystem store based at the given root path.
 func NewFileSystem(root string) *FileSystem {
-	return &FileSystem{root}
+	return &FileSystem{root: root}
+}
+
+// FreeSpace returns the number of bytes available to be written on the
+// disk holding this store.
+func (s *FileSystem) FreeSpace() (int64, error) {
+	return diskFree(s.root)
 }
 
 // List returns a channel listing all the keys in this store.
@@ -179,7 +196,39 @@ func (s *FileSystem) Create(key string) (io.WriteCloser, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &moveCloser{w, temp, target}, nil
+	return &moveCloser{w, temp, target, s.lock}, nil
+}
+
+// SetLockPolicy makes files created from now on write-once. A file is locked
+// by setting its access time to the end of its retention period and then
+// removing its write permissions, which is how NetApp SnapLock and similar
+// WORM filesystems commit a file. On other filesystems this only makes the
+// files read-only. The lock mode is not used.
+func (s *FileSystem) SetLockPolicy(p LockPolicy) {
+	s.lock = p
+}
+
+// Locking returns the lock policy used for new files.
+func (s *FileSystem) Locking() LockPolicy {
+	return s.lock
+}
+
+// LockStatus reports a file as locked if it is read-only. The retention
+// time is not known.
+func (s *FileSystem) LockStatus(key string) (LockInfo, error) {
+	var result LockInfo
+	if strings.Contains(key, "/") {
+		return result, ErrKeyContainsSlash
+	}
+	fi, err := os.Stat(filepath.Join(s.root, itemSubdir(key), key))
+	if err != nil {
+		return result, err
+	}
+	if fi.Mode().Perm()&0222 == 0 {
+		result.Locked = true
+		result.Mode = "read-only"
+	}
+	return result, nil
 }
 
 // setupSubDir makes sure the given subdirectory exists under the root, and
@@ -195,6 +244,7 @@ type moveCloser struct {
 	io.WriteCloser
 	source string
 	target string
+	lock   LockPolicy
 }
 
 func (w *moveCloser) Close() error {
@@ -213,7 +263,16 @@ func (w *moveCloser) Close() error {
 	if !os.IsNotExist(err) {
 		return ErrKeyExists
 	}
-	return os.Rename(w.source, w.target)
+	err = os.Rename(w.source, w.target)
+	if err != nil || !w.lock.Enabled() {
+		return err
+	}
+	now := time.Now()
+	err = os.Chtimes(w.target, now.Add(w.lock.Period), now)
+	if err == nil {
+		err = os.Chmod(w.target, 0444)
+	}
+	return err
 }
 
 // Delete the given key from the store. It is not an error if the key doesn't
@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestItemSubdir(t *testing.T) {
@@ -194,6 +195,65 @@ func TestCreate(t *testing.T) {
 
 }
 
+func TestSparseFile(t *testing.T) {
+	root, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(root)
+	s := NewFileSystem(root)
+
+	// make a file larger than 4 GB without writing all of it, and make
+	// sure offsets past 32 bits work.
+	const size = 5 << 30
+	add(t, s, "sparse", "")
+	fname := filepath.Join(root, itemSubdir("sparse"), "sparse")
+	f, err := os.OpenFile(fname, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte("end"), size-3)
+	f.Close()
+	if err != nil {
+		t.Skip("cannot make sparse file:", err)
+	}
+
+	r, n, err := s.Open("sparse")
+	if err != nil {
+		t.Fatalf("Received error %s", err.Error())
+	}
+	defer r.Close()
+	if n != size {
+		t.Errorf("Received length %d, expected %d", n, int64(size))
+	}
+	var buf = make([]byte, 8)
+	n64, err := r.ReadAt(buf, size-8)
+	if err != nil && err != io.EOF {
+		t.Errorf("Received error %s", err.Error())
+	}
+	if string(buf[:n64]) != "\x00\x00\x00\x00\x00end" {
+		t.Errorf("Received %q", buf[:n64])
+	}
+}
+
+func TestCreateEmpty(t *testing.T) {
+	root, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(root)
+	s := NewFileSystem(root)
+
+	add(t, s, "empty", "")
+	r, n, err := s.Open("empty")
+	if err != nil {
+		t.Fatalf("Received error %s", err.Error())
+	}
+	if n != 0 {
+		t.Errorf("Received length %d, expected 0", n)
+	}
+	var buf = make([]byte, 8)
+	n64, err := r.ReadAt(buf, 0)
+	if n64 != 0 || err != io.EOF {
+		t.Errorf("Received %d, %v, expected 0, EOF", n64, err)
+	}
+	r.Close()
+}
+
 func TestInvalidKeys(t *testing.T) {
 	var tests = []struct {
 		input  string
@@ -344,3 +404,54 @@ func exists(paths ...string) bool {
 	_, err := os.Stat(filepath.Join(paths...))
 	return err == nil
 }
+
+func TestLockPolicy(t *testing.T) {
+	root, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(root)
+	s := NewFileSystem(root)
+
+	add(t, s, "before", "hello")
+	s.SetLockPolicy(LockPolicy{Period: 24 * time.Hour})
+	add(t, s, "after", "hello")
+
+	var table = []struct {
+		key    string
+		locked bool
+	}{
+		{"before", false},
+		{"after", true},
+	}
+	for _, tab := range table {
+		info, err := s.LockStatus(tab.key)
+		if err != nil {
+			t.Fatalf("LockStatus(%s) == %s, expected nil", tab.key, err)
+		}
+		if info.Locked != tab.locked {
+			t.Errorf("LockStatus(%s) == %v, expected %v", tab.key, info.Locked, tab.locked)
+		}
+	}
+	fi, err := os.Stat(filepath.Join(root, itemSubdir("after"), "after"))
+	if err != nil {
+		t.Fatalf("Received error %s", err)
+	}
+	if fi.Mode().Perm()&0222 != 0 {
+		t.Errorf("Received mode %v, expected read-only", fi.Mode())
+	}
+}
+
+func TestFreeSpace(t *testing.T) {
+	root, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(root)
+	s := NewFileSystem(root)
+
+	n, err := s.FreeSpace()
+	if err == ErrNotSupported {
+		t.Skip("FreeSpace not supported on this platform")
+	}
+	if err != nil {
+		t.Fatalf("Received error %s", err.Error())
+	}
+	if n <= 0 {
+		t.Errorf("Received %d free bytes, expected more than 0", n)
+	}
+}
@@ -0,0 +1,39 @@
+package store
+
+import (
+	"time"
+)
+
+// A LockPolicy says how newly written keys are protected from being changed
+// or deleted, as is done by S3 Object Lock or NetApp SnapLock.
+type LockPolicy struct {
+	// Mode is the kind of lock to use. Its meaning depends on the store.
+	// For S3 it is either "GOVERNANCE" or "COMPLIANCE".
+	Mode string
+
+	// Period is how long a key is retained after it is written. A zero
+	// period means keys are not locked.
+	Period time.Duration
+}
+
+// Enabled returns true if keys should be locked under this policy.
+func (p LockPolicy) Enabled() bool {
+	return p.Period > 0
+}
+
+// LockInfo describes the lock on a key.
+type LockInfo struct {
+	Locked bool      // true if the key cannot currently be changed or deleted
+	Mode   string    // the kind of lock, if known
+	Until  time.Time // when the lock expires. Zero if not known.
+}
+
+// A Locker is a store able to lock the keys written to it. Once a lock
+// policy is set, every key created afterwards is locked according to it.
+// Keys written before the policy was set are not changed.
+type Locker interface {
+	Store
+	SetLockPolicy(p LockPolicy)
+	Locking() LockPolicy
+	LockStatus(key string) (LockInfo, error)
+}
@@ -68,6 +68,11 @@ func (ms *Memory) Open(key string) (ReadAtCloser, int64, error) {
 	return v, int64(len(v.b)), nil
 }
 
+// RangeReads returns true, since any part of a value may be read directly.
+func (ms *Memory) RangeReads() bool {
+	return true
+}
+
 // Need to support a RWMutex instead of a Mutex, since some code path
 // in reading a bundle opens a buf twice for reading.
 // Because the same Close() is used in both cases, we need a flag to
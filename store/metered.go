@@ -0,0 +1,255 @@
+package store
+
+import (
+	"expvar"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds, in seconds, of the buckets used by
+// the latency histograms of a metered store. A final bucket holds everything
+// slower than the last bound. Tape recalls can take minutes, so the buckets
+// go well past what a disk would need.
+var LatencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300}
+
+// The operations timed by a metered store. "close" is the closing of a
+// writer returned by Create, which is when some stores finish uploading.
+var meteredOps = []string{"list", "listprefix", "open", "create", "close", "delete"}
+
+// OpStats holds the latency histogram and error count for one operation on
+// a store.
+type OpStats struct {
+	Count   int64   // number of calls
+	Errors  int64   // number of calls returning an error
+	Seconds float64 // total time spent in calls
+	// Buckets holds the number of calls falling in each of the
+	// LatencyBuckets, followed by the number slower than all of them.
+	Buckets []int64
+}
+
+// ErrorRate returns the fraction of calls which returned an error.
+func (op OpStats) ErrorRate() float64 {
+	if op.Count == 0 {
+		return 0
+	}
+	return float64(op.Errors) / float64(op.Count)
+}
+
+// Mean returns the average latency of a call, in seconds.
+func (op OpStats) Mean() float64 {
+	if op.Count == 0 {
+		return 0
+	}
+	return op.Seconds / float64(op.Count)
+}
+
+// StoreStats holds the statistics for every operation on a named store.
+type StoreStats struct {
+	Name string
+	Ops  map[string]OpStats
+}
+
+// A meter collects the statistics for one named store. The same meter is
+// shared by every metered store given that name.
+type meter struct {
+	name string
+	m    sync.Mutex
+	ops  map[string]*OpStats
+}
+
+var (
+	metersM sync.Mutex
+	meters  = make(map[string]*meter)
+)
+
+func init() {
+	expvar.Publish("store", expvar.Func(func() interface{} { return Meters() }))
+}
+
+// getMeter returns the meter for the given store name, making it if needed.
+func getMeter(name string) *meter {
+	metersM.Lock()
+	defer metersM.Unlock()
+	m := meters[name]
+	if m == nil {
+		m = &meter{name: name, ops: make(map[string]*OpStats)}
+		for _, op := range meteredOps {
+			m.ops[op] = &OpStats{Buckets: make([]int64, len(LatencyBuckets)+1)}
+		}
+		meters[name] = m
+	}
+	return m
+}
+
+// record adds a call to op which started at start and returned err.
+func (m *meter) record(op string, start time.Time, err error) {
+	d := time.Since(start).Seconds()
+	i := sort.SearchFloat64s(LatencyBuckets, d)
+	m.m.Lock()
+	stats := m.ops[op]
+	stats.Count++
+	stats.Seconds += d
+	stats.Buckets[i]++
+	if err != nil {
+		stats.Errors++
+	}
+	m.m.Unlock()
+}
+
+// stats returns a copy of the statistics in this meter.
+func (m *meter) stats() StoreStats {
+	result := StoreStats{Name: m.name, Ops: make(map[string]OpStats)}
+	m.m.Lock()
+	for op, stats := range m.ops {
+		s := *stats
+		s.Buckets = append([]int64(nil), stats.Buckets...)
+		result.Ops[op] = s
+	}
+	m.m.Unlock()
+	return result
+}
+
+// Meters returns the statistics of every metered store, sorted by name.
+// They are also published through expvar as "store".
+func Meters() []StoreStats {
+	metersM.Lock()
+	var list []*meter
+	for _, m := range meters {
+		list = append(list, m)
+	}
+	metersM.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	var result []StoreStats
+	for _, m := range list {
+		result = append(result, m.stats())
+	}
+	return result
+}
+
+// NewMetered wraps a store by one which records how long each operation on
+// it takes and whether it failed, under the given name, such as "tape" or
+// "cache". Stores wrapped with the same name share their statistics. Only
+// the calls themselves are timed; reading the content returned by Open is
+// not, so the reader is passed back unchanged.
+//
+// The optional Stager, FreeSpacer, and Locker methods are passed to the
+// wrapped store when it has them.
+func NewMetered(s Store, name string) *Metered {
+	return &Metered{s: s, m: getMeter(name)}
+}
+
+// Metered is a store recording the latency of the operations on the store
+// it wraps. Make one with NewMetered.
+type Metered struct {
+	s Store
+	m *meter
+}
+
+// List returns the keys in the wrapped store. The time until the list has
+// been read to the end is recorded.
+func (ms *Metered) List() <-chan string {
+	start := time.Now()
+	in := ms.s.List()
+	out := make(chan string)
+	go func() {
+		for key := range in {
+			out <- key
+		}
+		close(out)
+		ms.m.record("list", start, nil)
+	}()
+	return out
+}
+
+func (ms *Metered) ListPrefix(prefix string) ([]string, error) {
+	start := time.Now()
+	result, err := ms.s.ListPrefix(prefix)
+	ms.m.record("listprefix", start, err)
+	return result, err
+}
+
+func (ms *Metered) Open(key string) (ReadAtCloser, int64, error) {
+	start := time.Now()
+	r, size, err := ms.s.Open(key)
+	ms.m.record("open", start, err)
+	return r, size, err
+}
+
+func (ms *Metered) Create(key string) (io.WriteCloser, error) {
+	start := time.Now()
+	w, err := ms.s.Create(key)
+	ms.m.record("create", start, err)
+	if err != nil {
+		return w, err
+	}
+	return &meteredWriter{WriteCloser: w, m: ms.m}, nil
+}
+
+func (ms *Metered) Delete(key string) error {
+	start := time.Now()
+	err := ms.s.Delete(key)
+	ms.m.record("delete", start, err)
+	return err
+}
+
+// Stage passes the keys to the wrapped store, if it is a Stager.
+func (ms *Metered) Stage(keys []string) {
+	if x, ok := ms.s.(Stager); ok {
+		x.Stage(keys)
+	}
+}
+
+// FreeSpace returns the free space of the wrapped store. It returns
+// ErrNotSupported if the wrapped store cannot tell.
+func (ms *Metered) FreeSpace() (int64, error) {
+	if fs, ok := ms.s.(FreeSpacer); ok {
+		return fs.FreeSpace()
+	}
+	return 0, ErrNotSupported
+}
+
+// RangeReads returns true if the wrapped store can read ranges efficiently.
+func (ms *Metered) RangeReads() bool {
+	return CanReadRanges(ms.s)
+}
+
+// SetLockPolicy sets the lock policy of the wrapped store. It does nothing
+// if the wrapped store cannot lock keys.
+func (ms *Metered) SetLockPolicy(p LockPolicy) {
+	if locker, ok := ms.s.(Locker); ok {
+		locker.SetLockPolicy(p)
+	}
+}
+
+// Locking returns the lock policy of the wrapped store, which is the zero
+// policy if it cannot lock keys.
+func (ms *Metered) Locking() LockPolicy {
+	if locker, ok := ms.s.(Locker); ok {
+		return locker.Locking()
+	}
+	return LockPolicy{}
+}
+
+// LockStatus returns the lock on the given key in the wrapped store. It
+// returns ErrNotSupported if the wrapped store cannot lock keys.
+func (ms *Metered) LockStatus(key string) (LockInfo, error) {
+	if locker, ok := ms.s.(Locker); ok {
+		return locker.LockStatus(key)
+	}
+	return LockInfo{}, ErrNotSupported
+}
+
+// meteredWriter times the closing of a writer.
+type meteredWriter struct {
+	io.WriteCloser
+	m *meter
+}
+
+func (w *meteredWriter) Close() error {
+	start := time.Now()
+	err := w.WriteCloser.Close()
+	w.m.record("close", start, err)
+	return err
+}
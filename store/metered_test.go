@@ -0,0 +1,63 @@
+package store
+
+import (
+	"testing"
+)
+
+func TestMetered(t *testing.T) {
+	ms := NewMetered(NewMemory(), "test-metered")
+	add(t, ms, "abc", "hello")
+	_, _, err := ms.Open("abc")
+	if err != nil {
+		t.Fatalf("Received error %s", err.Error())
+	}
+	_, _, err = ms.Open("missing")
+	if err == nil {
+		t.Fatalf("Received nil error, expected one")
+	}
+	for range ms.List() {
+	}
+
+	var stats StoreStats
+	for _, s := range Meters() {
+		if s.Name == "test-metered" {
+			stats = s
+		}
+	}
+	var table = []struct {
+		op     string
+		count  int64
+		errors int64
+	}{
+		{"create", 1, 0},
+		{"close", 1, 0},
+		{"open", 2, 1},
+		{"list", 1, 0},
+		{"delete", 0, 0},
+	}
+	for _, test := range table {
+		op := stats.Ops[test.op]
+		if op.Count != test.count || op.Errors != test.errors {
+			t.Errorf("%s: received %d calls and %d errors, expected %d and %d",
+				test.op, op.Count, op.Errors, test.count, test.errors)
+		}
+		var n int64
+		for _, b := range op.Buckets {
+			n += b
+		}
+		if n != op.Count {
+			t.Errorf("%s: histogram has %d calls, expected %d", test.op, n, op.Count)
+		}
+	}
+	if rate := stats.Ops["open"].ErrorRate(); rate != 0.5 {
+		t.Errorf("Received error rate %f, expected 0.5", rate)
+	}
+
+	// stores with the same name share statistics
+	NewMetered(NewMemory(), "test-metered").Delete("abc")
+	for _, s := range Meters() {
+		if s.Name == "test-metered" && s.Ops["delete"].Count != 1 {
+			t.Errorf("Received %d deletes, expected 1", s.Ops["delete"].Count)
+		}
+	}
+}
@@ -48,6 +48,10 @@ func (ps prefixstore) Open(key string) (ReadAtCloser, int64, error) {
 	return ps.s.Open(ps.p + key)
 }
 
+func (ps prefixstore) RangeReads() bool {
+	return CanReadRanges(ps.s)
+}
+
 func (ps prefixstore) Create(key string) (io.WriteCloser, error) {
 	return ps.s.Create(ps.p + key)
 }
@@ -2,6 +2,8 @@ package store
 
 import (
 	"bytes"
+	"crypto/md5"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
@@ -9,6 +11,7 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
@@ -24,8 +27,14 @@ type S3 struct {
 	Bucket string
 	Prefix string
 	sizes  *sizecache // keep HEAD info
+	lock   LockPolicy // Object Lock retention for new keys
 }
 
+var (
+	// ensure S3 can lock keys
+	_ Locker = &S3{}
+)
+
 // NewS3 creates a new S3 store. It will use the given bucket and will prepend
 // prefix to all keys. This is to allow for a bucket to be used for more than
 // one store. For example if prefix were "cache/" then an Open("hello") would
@@ -105,6 +114,12 @@ func (s *S3) Open(key string) (ReadAtCloser, int64, error) {
 	return result, size, nil
 }
 
+// RangeReads returns true, since each ReadAtCloser fetches only the ranges
+// of a key it is asked for.
+func (s *S3) RangeReads() bool {
+	return true
+}
+
 // Create will return a WriteCloser to upload content to the given key. Data is
 // batched and uploaded to S3 using the Multipart interface. The part sizes
 // increase, so objects up to the 5 TB limit S3 imposes is theoretically
@@ -120,9 +135,39 @@ func (s *S3) Create(key string) (io.WriteCloser, error) {
 		svc:    s.svc,
 		bucket: s.Bucket,
 		key:    fullkey,
+		lock:   s.lock,
 	}, nil
 }
 
+// SetLockPolicy makes keys created from now on have an S3 Object Lock
+// retention period. The bucket must have Object Lock enabled. Deleting a
+// locked key only adds a delete marker, so the data remains in the bucket
+// until the retention period passes.
+func (s *S3) SetLockPolicy(p LockPolicy) {
+	s.lock = p
+}
+
+// Locking returns the lock policy used for new keys.
+func (s *S3) Locking() LockPolicy {
+	return s.lock
+}
+
+// LockStatus returns the Object Lock retention on the given key.
+func (s *S3) LockStatus(key string) (LockInfo, error) {
+	var result LockInfo
+	info, err := s.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.Prefix + key),
+	})
+	if err != nil {
+		return result, err
+	}
+	result.Mode = aws.StringValue(info.ObjectLockMode)
+	result.Until = aws.TimeValue(info.ObjectLockRetainUntilDate)
+	result.Locked = result.Mode != "" && result.Until.After(time.Now())
+	return result, nil
+}
+
 // Delete will remove the given key from the store. The store's Prefix is
 // prepended first. It is not an error to delete something that doesn't exist.
 func (s *S3) Delete(key string) error {
@@ -335,6 +380,7 @@ type s3WriteCloser struct {
 	part     int           // the part number we are currently filling up (0-based. n.b. AWS is 1-based)
 	etags    []string      // list of etags for all our uploaded parts, index i == etag for part i
 	abort    bool          // true to abort upload at close
+	lock     LockPolicy    // the retention to give the object
 }
 
 // These are constants, but beware! The relationship that
@@ -452,10 +498,15 @@ func (wc *s3WriteCloser) startMultipart() error {
 		// already started one??
 		return nil
 	}
-	result, err := wc.svc.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+	input := &s3.CreateMultipartUploadInput{
 		Bucket: aws.String(wc.bucket),
 		Key:    aws.String(wc.key),
-	})
+	}
+	if wc.lock.Enabled() {
+		input.ObjectLockMode = aws.String(wc.lock.Mode)
+		input.ObjectLockRetainUntilDate = aws.Time(time.Now().Add(wc.lock.Period))
+	}
+	result, err := wc.svc.CreateMultipartUpload(input)
 	if err != nil {
 		log.Println("S3 startMultipart:", wc.key, err)
 		raven.CaptureError(err, map[string]string{"Bucket": wc.bucket, "Key": wc.key})
@@ -499,6 +550,10 @@ func (wc *s3WriteCloser) uploadpart(partno int, buf *bytes.Buffer) error {
 		PartNumber: aws.Int64(int64(partno + 1)), // parts are 1-based in AWS
 		UploadId:   aws.String(wc.uploadID),
 	}
+	if wc.lock.Enabled() {
+		// S3 requires an MD5 when uploading locked objects
+		input.ContentMD5 = aws.String(contentMD5(buf.Bytes()))
+	}
 	output, err := wc.svc.UploadPart(input)
 	// can we detect and retry in event of transient errors?
 	if err != nil {
@@ -526,6 +581,15 @@ func (wc *s3WriteCloser) uploadfull(buf *bytes.Buffer) error {
 		Key:           aws.String(wc.key),
 		ContentLength: aws.Int64(int64(source.Len())),
 	}
+	if wc.lock.Enabled() {
+		var data []byte
+		if buf != nil {
+			data = buf.Bytes()
+		}
+		input.ContentMD5 = aws.String(contentMD5(data))
+		input.ObjectLockMode = aws.String(wc.lock.Mode)
+		input.ObjectLockRetainUntilDate = aws.Time(time.Now().Add(wc.lock.Period))
+	}
 	_, err := wc.svc.PutObject(input)
 	// can we detect and retry in event of transient errors?
 	if err != nil {
@@ -533,3 +597,9 @@ func (wc *s3WriteCloser) uploadfull(buf *bytes.Buffer) error {
 	}
 	return err
 }
+
+// contentMD5 returns the value of a Content-MD5 header for data.
+func contentMD5(data []byte) string {
+	sum := md5.Sum(data)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
@@ -48,6 +48,29 @@ type Stager interface {
 	Stage(keys []string)
 }
 
+// RangeReader is a store which can read any part of a key without reading
+// what comes before it, such as an object store serving ranged requests.
+// Several ReadAtClosers opened on the same key can then each read a
+// different part of it at the same time. RangeReads returns false if this
+// is not efficient, which lets wrappers pass on the answer of the store they
+// wrap.
+type RangeReader interface {
+	RangeReads() bool
+}
+
+// CanReadRanges returns true if s is a RangeReader which can read ranges
+// efficiently.
+func CanReadRanges(s ROStore) bool {
+	rr, ok := s.(RangeReader)
+	return ok && rr.RangeReads()
+}
+
+// FreeSpacer is a store which can tell how many more bytes it can hold,
+// such as one on a local disk.
+type FreeSpacer interface {
+	FreeSpace() (int64, error)
+}
+
 // NewReader converts a ReaderAt into a io.Reader. It is here as a utility to
 // help work with the ReadAtCloser returned by Open.
 func NewReader(r io.ReaderAt) io.Reader {
@@ -0,0 +1,373 @@
+package transaction
+
+import (
+	"archive/zip"
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/ndlib/bendo/fragment"
+	"github.com/ndlib/bendo/items"
+)
+
+// A bag is an uploaded BagIt bag, as described in RFC 8493, serialized as a
+// zip file. The "bag" command adds the files in its payload to an item.
+type bag struct {
+	root    string               // the directory holding the bag, "" or ending in "/"
+	payload map[string]*zip.File // indexed by path under "data/"
+	tags    map[string]*zip.File // the other files, indexed by path in the bag
+
+	// manifests gives the hex checksums of the payload files, indexed by
+	// algorithm and then by path under "data/".
+	manifests map[string]map[string]string
+
+	// tagmanifests gives the hex checksums of the tag files, indexed by
+	// algorithm and then by path in the bag.
+	tagmanifests map[string]map[string]string
+
+	// info holds the fields of bag-info.txt, in order.
+	info []bagInfo
+}
+
+// A bagInfo is one field of bag-info.txt.
+type bagInfo struct {
+	Label string
+	Value string
+}
+
+// bagHashes are the manifest algorithms a bag may use.
+var bagHashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// openBag reads the structure and manifests of the bag serialized in the zip
+// file r. The bag may be at the top of the zip file or in a single directory.
+// It does not check the payload against the manifests; use verify for that.
+func openBag(r io.ReaderAt, size int64) (*bag, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	b := &bag{
+		payload:      make(map[string]*zip.File),
+		tags:         make(map[string]*zip.File),
+		manifests:    make(map[string]map[string]string),
+		tagmanifests: make(map[string]map[string]string),
+	}
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+	if files["bagit.txt"] == nil {
+		// look for a single directory holding the bag
+		for name := range files {
+			dir, rest, ok := strings.Cut(name, "/")
+			if ok && rest == "bagit.txt" {
+				if b.root != "" {
+					return nil, errors.New("more than one bagit.txt")
+				}
+				b.root = dir + "/"
+			}
+		}
+		if b.root == "" {
+			return nil, errors.New("no bagit.txt")
+		}
+	}
+	for name, f := range files {
+		if !strings.HasPrefix(name, b.root) || strings.HasSuffix(name, "/") {
+			continue
+		}
+		name = name[len(b.root):]
+		if strings.HasPrefix(name, "data/") {
+			b.payload[name[len("data/"):]] = f
+			continue
+		}
+		b.tags[name] = f
+		switch {
+		case strings.HasPrefix(name, "manifest-") && strings.HasSuffix(name, ".txt"):
+			alg := strings.TrimSuffix(strings.TrimPrefix(name, "manifest-"), ".txt")
+			if bagHashes[alg] == nil {
+				return nil, fmt.Errorf("unsupported manifest %s", name)
+			}
+			b.manifests[alg], err = readManifest(f, true)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+		case strings.HasPrefix(name, "tagmanifest-") && strings.HasSuffix(name, ".txt"):
+			alg := strings.TrimSuffix(strings.TrimPrefix(name, "tagmanifest-"), ".txt")
+			if bagHashes[alg] == nil {
+				return nil, fmt.Errorf("unsupported tag manifest %s", name)
+			}
+			b.tagmanifests[alg], err = readManifest(f, false)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+	if len(b.manifests) == 0 {
+		return nil, errors.New("no payload manifest")
+	}
+	declaration, err := readBagInfo(b.tags["bagit.txt"])
+	if err != nil {
+		return nil, fmt.Errorf("bagit.txt: %w", err)
+	}
+	if bagField(declaration, "BagIt-Version") == "" {
+		return nil, errors.New("bagit.txt has no BagIt-Version")
+	}
+	if f := b.tags["bag-info.txt"]; f != nil {
+		b.info, err = readBagInfo(f)
+		if err != nil {
+			return nil, fmt.Errorf("bag-info.txt: %w", err)
+		}
+	}
+	return b, nil
+}
+
+// readManifest returns the checksums in the given manifest file, indexed by
+// path. The paths in a payload manifest must begin with "data/", which is
+// removed.
+func readManifest(f *zip.File, payload bool) (map[string]string, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	result := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		sum, name, ok := strings.Cut(line, " ")
+		name = strings.TrimLeft(name, " \t")
+		if !ok || name == "" || (payload && !strings.HasPrefix(name, "data/")) {
+			return nil, fmt.Errorf("bad line %q", line)
+		}
+		name = strings.NewReplacer("%0A", "\n", "%0D", "\r", "%25", "%").Replace(name)
+		if payload {
+			name = name[len("data/"):]
+		}
+		result[name] = strings.ToLower(sum)
+	}
+	return result, scanner.Err()
+}
+
+// readBagInfo returns the fields in a tag file made of labels and values,
+// such as bagit.txt or bag-info.txt. Lines beginning with whitespace
+// continue the value of the field before them.
+func readBagInfo(f *zip.File) ([]bagInfo, error) {
+	if f == nil {
+		return nil, errors.New("missing")
+	}
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var result []bagInfo
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(result) == 0 {
+				return nil, fmt.Errorf("bad line %q", line)
+			}
+			result[len(result)-1].Value += "\n" + strings.TrimSpace(line)
+			continue
+		}
+		label, value, ok := strings.Cut(line, ":")
+		if !ok || strings.TrimSpace(label) == "" {
+			return nil, fmt.Errorf("bad line %q", line)
+		}
+		result = append(result, bagInfo{
+			Label: strings.TrimSpace(label),
+			Value: strings.TrimSpace(value),
+		})
+	}
+	return result, scanner.Err()
+}
+
+// bagField returns the value of the first field with the given label, or ""
+// if there is none.
+func bagField(info []bagInfo, label string) string {
+	for _, field := range info {
+		if strings.EqualFold(field.Label, label) {
+			return field.Value
+		}
+	}
+	return ""
+}
+
+// slots returns the paths of the payload files under "data/", sorted.
+func (b *bag) slots() []string {
+	var result []string
+	for name := range b.payload {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// checksum returns the checksum of the given payload file in the manifest
+// for the given algorithm, or nil if the bag has no such manifest.
+func (b *bag) checksum(alg, name string) []byte {
+	m := b.manifests[alg]
+	if m == nil {
+		return nil
+	}
+	sum, _ := hex.DecodeString(m[name])
+	return sum
+}
+
+// verify checks the payload against every manifest. Every payload file must
+// be listed in each manifest with a matching checksum, and every file listed
+// must be in the payload. It returns every problem found.
+func (b *bag) verify() []error {
+	var problems []error
+	for alg, m := range b.manifests {
+		for name := range m {
+			if b.payload[name] == nil {
+				problems = append(problems, fmt.Errorf("data/%s is in manifest-%s.txt but not in the bag", name, alg))
+			}
+		}
+	}
+	for _, name := range b.slots() {
+		hashes := make(map[string]hash.Hash)
+		var writers []io.Writer
+		for alg, m := range b.manifests {
+			if _, ok := m[name]; !ok {
+				problems = append(problems, fmt.Errorf("data/%s is not in manifest-%s.txt", name, alg))
+				continue
+			}
+			h := bagHashes[alg]()
+			hashes[alg] = h
+			writers = append(writers, h)
+		}
+		r, err := b.payload[name].Open()
+		if err != nil {
+			problems = append(problems, fmt.Errorf("data/%s: %w", name, err))
+			continue
+		}
+		_, err = io.Copy(io.MultiWriter(writers...), r)
+		r.Close()
+		if err != nil {
+			problems = append(problems, fmt.Errorf("data/%s: %w", name, err))
+			continue
+		}
+		for alg, h := range hashes {
+			if hex.EncodeToString(h.Sum(nil)) != b.manifests[alg][name] {
+				problems = append(problems, fmt.Errorf("data/%s does not match manifest-%s.txt", name, alg))
+			}
+		}
+	}
+	if oxum := bagField(b.info, "Payload-Oxum"); oxum != "" {
+		var octets int64
+		for _, f := range b.payload {
+			octets += int64(f.UncompressedSize64)
+		}
+		if oxum != fmt.Sprintf("%d.%d", octets, len(b.payload)) {
+			problems = append(problems, fmt.Errorf("Payload-Oxum is %s, but the payload has %d bytes in %d files", oxum, octets, len(b.payload)))
+		}
+	}
+	return append(problems, b.verifyTags()...)
+}
+
+// verifyTags checks the tag files listed in each tag manifest against it.
+// Unlike the payload, tag files need not be listed in a tag manifest.
+func (b *bag) verifyTags() []error {
+	var problems []error
+	var algs []string
+	for alg := range b.tagmanifests {
+		algs = append(algs, alg)
+	}
+	sort.Strings(algs)
+	for _, alg := range algs {
+		m := b.tagmanifests[alg]
+		var names []string
+		for name := range m {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			f := b.tags[name]
+			if f == nil {
+				problems = append(problems, fmt.Errorf("%s is in tagmanifest-%s.txt but not in the bag", name, alg))
+				continue
+			}
+			h := bagHashes[alg]()
+			r, err := f.Open()
+			if err == nil {
+				_, err = io.Copy(h, r)
+				r.Close()
+			}
+			if err != nil {
+				problems = append(problems, fmt.Errorf("%s: %w", name, err))
+			} else if hex.EncodeToString(h.Sum(nil)) != m[name] {
+				problems = append(problems, fmt.Errorf("%s does not match tagmanifest-%s.txt", name, alg))
+			}
+		}
+	}
+	return problems
+}
+
+// addBag writes each payload file in the bag uploaded as f into the item
+// as a new blob, and sets a slot named by its path under "data/" to it. The
+// blobs are checked against the bag's MD5 and SHA-256 manifests, if it has
+// them, as they are written. Each field of bag-info.txt is recorded in the
+// version metadata under the key "bag-info:" followed by its label. The
+// values of a repeated label are joined by newlines.
+func addBag(iw *items.Writer, f fragment.FileEntry) error {
+	ra := f.OpenAt()
+	defer ra.Close()
+	b, err := openBag(ra, f.Stat().Size)
+	if err != nil {
+		return err
+	}
+	for _, name := range b.slots() {
+		zf := b.payload[name]
+		r, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		bid, err := iw.WriteBlob(r, int64(zf.UncompressedSize64), b.checksum("md5", name), b.checksum("sha256", name))
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("data/%s: %w", name, err)
+		}
+		iw.SetSlot(name, bid)
+		r, err = zf.Open()
+		if err != nil {
+			return err
+		}
+		iw.SetMimeType(bid, sniffReader(r))
+		r.Close()
+	}
+	values := make(map[string][]string)
+	for _, field := range b.info {
+		values[field.Label] = append(values[field.Label], field.Value)
+	}
+	for label, v := range values {
+		iw.SetVersionMeta(bagInfoKey+label, strings.Join(v, "\n"))
+	}
+	return nil
+}
+
+// bagInfoKey begins the version metadata keys holding the fields of an
+// ingested bag's bag-info.txt.
+const bagInfoKey = "bag-info:"
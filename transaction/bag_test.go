@@ -0,0 +1,180 @@
+package transaction
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/ndlib/bendo/blobcache"
+	"github.com/ndlib/bendo/fragment"
+	"github.com/ndlib/bendo/items"
+	"github.com/ndlib/bendo/store"
+)
+
+// uploadBag adds b to the uploads as the file id, in a few fragments.
+func uploadBag(t *testing.T, uploads *fragment.Store, id string, b []byte) {
+	entry := uploads.New(id)
+	for len(b) > 0 {
+		n := 100
+		if n > len(b) {
+			n = len(b)
+		}
+		w, err := entry.Append()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(b[:n])
+		w.Close()
+		b = b[n:]
+	}
+}
+
+func TestCommitBag(t *testing.T) {
+	// make a bag by exporting an item
+	source := items.New(store.NewMemory())
+	iw, err := source.Open("source", "nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{"first file", "<html><body>second</body></html>"} {
+		md5sum := md5.Sum([]byte(content))
+		sha256sum := sha256.Sum256([]byte(content))
+		bid, err := iw.WriteBlob(strings.NewReader(content), int64(len(content)), md5sum[:], sha256sum[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		iw.SetSlot("dir/file"+content[:1], bid)
+	}
+	iw.Close()
+	var buf bytes.Buffer
+	err = source.WriteBag(&buf, "source", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tape := items.NewWithCache(store.NewMemory(), items.NewMemoryCache())
+	uploads := fragment.New(store.NewMemory())
+	cache := blobcache.NewLRU(store.NewMemory(), 400)
+	uploadBag(t, uploads, "bag1", buf.Bytes())
+	tx := &Transaction{
+		ItemID:   "bag1234",
+		BlobMap:  make(map[string]int),
+		Commands: []command{{"bag", "bag1"}, {"note", "from a bag"}},
+	}
+	tx.VerifyFiles(uploads)
+	if len(tx.Err) != 0 {
+		t.Fatal(tx.Err)
+	}
+	tx.Commit(*tape, uploads, cache)
+	if len(tx.Err) != 0 {
+		t.Fatal(tx.Err)
+	}
+	item, err := tape.Item("bag1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for slot, expected := range map[string]string{"dir/filef": "first file", "dir/file<": "<html><body>second</body></html>"} {
+		bid := item.BlobByExtendedSlot(slot)
+		if bid == 0 {
+			t.Errorf("Slot %s is missing", slot)
+			continue
+		}
+		r, _, err := tape.Blob("bag1234", bid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := ioutil.ReadAll(r)
+		r.Close()
+		if string(content) != expected {
+			t.Errorf("Slot %s: received %q, expected %q", slot, content, expected)
+		}
+	}
+	if bid := item.BlobByExtendedSlot("dir/file<"); item.Blobs[bid-1].MimeType != "text/html; charset=utf-8" {
+		t.Errorf("Received mime type %q", item.Blobs[bid-1].MimeType)
+	}
+	// bag-info.txt is kept with the version
+	meta := item.Versions[0].Meta
+	if meta["bag-info:External-Identifier"] != "source" || meta["bag-info:Payload-Oxum"] == "" {
+		t.Errorf("Received version metadata %v", meta)
+	}
+}
+
+func TestVerifyBadBag(t *testing.T) {
+	var table = []struct {
+		name  string
+		files map[string]string
+	}{
+		{"no bagit.txt", map[string]string{
+			"data/a":           "hello",
+			"manifest-md5.txt": "5d41402abc4b2a76b9719d911017c592  data/a\n",
+		}},
+		{"no manifest", map[string]string{
+			"bag/bagit.txt": "BagIt-Version: 1.0\n",
+			"bag/data/a":    "hello",
+		}},
+		{"mismatch", map[string]string{
+			"bagit.txt":        "BagIt-Version: 1.0\n",
+			"data/a":           "hello!",
+			"manifest-md5.txt": "5d41402abc4b2a76b9719d911017c592  data/a\n",
+		}},
+		{"missing payload", map[string]string{
+			"bagit.txt":        "BagIt-Version: 1.0\n",
+			"data/a":           "hello",
+			"manifest-md5.txt": "5d41402abc4b2a76b9719d911017c592  data/a\n0  data/b\n",
+		}},
+		{"no version", map[string]string{
+			"bagit.txt":        "Tag-File-Character-Encoding: UTF-8\n",
+			"data/a":           "hello",
+			"manifest-md5.txt": "5d41402abc4b2a76b9719d911017c592  data/a\n",
+		}},
+		{"bad oxum", map[string]string{
+			"bagit.txt":        "BagIt-Version: 1.0\n",
+			"bag-info.txt":     "Source-Organization: Notre Dame\nPayload-Oxum: 6.1\n",
+			"data/a":           "hello",
+			"manifest-md5.txt": "5d41402abc4b2a76b9719d911017c592  data/a\n",
+		}},
+		{"tag mismatch", map[string]string{
+			"bagit.txt":           "BagIt-Version: 1.0\n",
+			"data/a":              "hello",
+			"manifest-md5.txt":    "5d41402abc4b2a76b9719d911017c592  data/a\n",
+			"tagmanifest-md5.txt": "5d41402abc4b2a76b9719d911017c592  bagit.txt\n",
+		}},
+		{"missing tag file", map[string]string{
+			"bagit.txt":           "BagIt-Version: 1.0\n",
+			"data/a":              "hello",
+			"manifest-md5.txt":    "5d41402abc4b2a76b9719d911017c592  data/a\n",
+			"tagmanifest-md5.txt": "5d41402abc4b2a76b9719d911017c592  bag-info.txt\n",
+		}},
+		{"unlisted payload", map[string]string{
+			"bagit.txt":        "BagIt-Version: 1.0\n",
+			"data/a":           "hello",
+			"data/b":           "extra",
+			"manifest-md5.txt": "5d41402abc4b2a76b9719d911017c592  data/a\n",
+		}},
+	}
+	for _, tab := range table {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		for name, content := range tab.files {
+			w, _ := zw.Create(name)
+			w.Write([]byte(content))
+		}
+		zw.Close()
+		uploads := fragment.New(store.NewMemory())
+		uploadBag(t, uploads, "bad", buf.Bytes())
+		tx := &Transaction{
+			ItemID:   "bad1234",
+			BlobMap:  make(map[string]int),
+			Commands: []command{{"bag", "bad"}},
+		}
+		tx.VerifyFiles(uploads)
+		t.Logf("%s: %v", tab.name, tx.Err)
+		if len(tx.Err) != 1 {
+			t.Errorf("%s: received errors %v, expected one", tab.name, tx.Err)
+		}
+	}
+}
@@ -3,15 +3,20 @@ package transaction
 import (
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"net/url"
 	"strconv"
 	"sync"
 	"time"
 
-	"github.com/ndlib/bendo/blobcache"
+	"github.com/ndlib/bendo"
+	"github.com/ndlib/bendo/cache"
 	"github.com/ndlib/bendo/fragment"
 	"github.com/ndlib/bendo/items"
 	"github.com/ndlib/bendo/store"
+	"github.com/ndlib/bendo/util"
 )
 
 // New creates a new transaction store using the given a store to save all the
@@ -151,6 +156,18 @@ type Transaction struct {
 	ItemID   string              // ID of the item this tx is modifying
 	Commands []command           // commands to run on commit
 	BlobMap  map[string]int      // tracks the blob id we used for uploaded files
+	Bytes    int64               // total size of the uploaded files being added
+	Timing   Timing              // how long each phase of the commit took
+	Version  int                 // the item version made by the commit, 0 if none
+}
+
+// Timing records how long each phase of committing a transaction took. A
+// phase which has not run has a zero duration. Durations are serialized as
+// nanoseconds.
+type Timing struct {
+	Verify time.Duration // checksumming the uploaded files
+	Ingest time.Duration // writing the files into bundles
+	Index  time.Duration // indexing the item into the database
 }
 
 // The Status of a transaction.
@@ -200,11 +217,12 @@ func (tx *Transaction) SetStatus(s Status) {
 // underlying item.
 // Commit a creation/update of an item in s, possibly using files
 // in files, and with the given creator name.
-func (tx *Transaction) Commit(s items.Store, files *fragment.Store, cache blobcache.T) {
+func (tx *Transaction) Commit(s items.Store, files *fragment.Store, cache cache.Cache) {
 	// we hold the lock on tx for the duration of the commit.
 	// That might be for a very long time.
 	tx.M.Lock()
 	defer tx.M.Unlock()
+	start := time.Now()
 	tx.Status = StatusIngest
 	iw, err := s.Open(tx.ItemID, tx.Creator)
 	if err != nil {
@@ -224,46 +242,163 @@ func (tx *Transaction) Commit(s items.Store, files *fragment.Store, cache blobca
 	err = iw.Close()
 	if err != nil {
 		tx.Err = append(tx.Err, err.Error())
+	} else {
+		tx.Version = int(iw.VersionID())
 	}
 	tx.Status = StatusFinished
 	if len(tx.Err) > 0 {
 		tx.Status = StatusError
 	}
+	tx.Timing.Ingest = time.Now().Sub(start)
 	tx.save()
 }
 
 // ReferencedFiles returns a list of all the upload file ids associated with
-// this transaction. That is, all the files referenced by an "add" command.
+// this transaction. That is, all the files referenced by an "add" or a "bag"
+// command.
 func (tx *Transaction) ReferencedFiles() []string {
 	tx.M.RLock()
 	defer tx.M.RUnlock()
 	var result []string
 	for _, cmd := range tx.Commands {
-		if cmd[0] == "add" && len(cmd) == 2 {
+		if (cmd[0] == "add" || cmd[0] == "bag") && len(cmd) == 2 {
 			result = append(result, cmd[1])
 		}
 	}
 	return result
 }
 
+// bagFiles returns the upload file ids referenced by a "bag" command.
+func (tx *Transaction) bagFiles() []string {
+	tx.M.RLock()
+	defer tx.M.RUnlock()
+	var result []string
+	for _, cmd := range tx.Commands {
+		if cmd[0] == "bag" && len(cmd) == 2 {
+			result = append(result, cmd[1])
+		}
+	}
+	return result
+}
+
+// Callbacks returns the URLs given in "callback" commands, which should be
+// told when this transaction finishes.
+func (tx *Transaction) Callbacks() []string {
+	tx.M.RLock()
+	defer tx.M.RUnlock()
+	var result []string
+	for _, cmd := range tx.Commands {
+		if cmd[0] == "callback" && len(cmd) == 2 {
+			result = append(result, cmd[1])
+		}
+	}
+	return result
+}
+
+// MergeDeletes returns the ids of the items given in "merge" commands with
+// the "delete" option. The server deletes them once this transaction has
+// finished successfully.
+func (tx *Transaction) MergeDeletes() []string {
+	tx.M.RLock()
+	defer tx.M.RUnlock()
+	var result []string
+	for _, cmd := range tx.Commands {
+		if cmd[0] == "merge" && len(cmd) == 4 {
+			result = append(result, cmd[1])
+		}
+	}
+	return result
+}
+
+// DeletedBlobs returns the ids of the blobs given in "delete" commands.
+func (tx *Transaction) DeletedBlobs() []items.BlobID {
+	tx.M.RLock()
+	defer tx.M.RUnlock()
+	var result []items.BlobID
+	for _, cmd := range tx.Commands {
+		if cmd[0] == "delete" && len(cmd) >= 2 {
+			id, err := strconv.Atoi(cmd[1])
+			if err == nil {
+				result = append(result, items.BlobID(id))
+			}
+		}
+	}
+	return result
+}
+
 // VerifyFiles verifies the checksums of all the files being added by this
 // transaction.
 // Pass in the fragment store containing the uploaded files. Any negative
-// results are returned in tx.Err.
+// results are returned in tx.Err. The total size of the files and the time
+// taken are recorded in tx.Bytes and tx.Timing.
 func (tx *Transaction) VerifyFiles(files *fragment.Store) {
+	tx.VerifyFilesPool(files, nil)
+}
+
+// VerifyFilesPool is like VerifyFiles, but each file and bag is checked as a
+// job on the given hashing pool, so only as many are hashed at once as the
+// pool allows. A nil pool checks them without any bound.
+func (tx *Transaction) VerifyFilesPool(files *fragment.Store, pool *util.HashPool) {
+	start := time.Now()
+	var nbytes int64
 	for _, fid := range tx.ReferencedFiles() {
 		f := files.Lookup(fid)
 		if f == nil {
 			tx.AppendError("Missing file " + fid)
 			continue
 		}
-		ok, err := f.Verify()
+		nbytes += f.Stat().Size
+		var ok bool
+		err := pool.Do(func() error {
+			var err error
+			ok, err = f.Verify()
+			return err
+		})
 		if err != nil {
 			tx.AppendError("Checking " + fid + ": " + err.Error())
 		} else if !ok {
 			tx.AppendError("Checksum mismatch for " + fid)
 		}
 	}
+	// check the payload of any bags against their manifests now, so a bad
+	// bag fails the transaction before anything is written.
+	for _, fid := range tx.bagFiles() {
+		f := files.Lookup(fid)
+		if f == nil {
+			continue // already reported
+		}
+		var problems []error
+		err := pool.Do(func() error {
+			ra := f.OpenAt()
+			defer ra.Close()
+			b, err := openBag(ra, f.Stat().Size)
+			if err != nil {
+				return err
+			}
+			problems = b.verify()
+			return nil
+		})
+		if err != nil {
+			tx.AppendError("Bag " + fid + ": " + err.Error())
+		}
+		for _, err := range problems {
+			tx.AppendError("Bag " + fid + ": " + err.Error())
+		}
+	}
+	tx.M.Lock()
+	tx.Bytes = nbytes
+	tx.Timing.Verify = time.Now().Sub(start)
+	tx.save()
+	tx.M.Unlock()
+}
+
+// SetIndexTime records how long it took to index the item after the
+// transaction was committed.
+func (tx *Transaction) SetIndexTime(d time.Duration) {
+	tx.M.Lock()
+	defer tx.M.Unlock()
+	tx.Timing.Index = d
+	tx.save()
 }
 
 // AppendError appends the given error string to this transaction.
@@ -284,9 +419,17 @@ func (tx *Transaction) save() {
 
 // [
 //   ["delete", 56],
+//   ["delete", 57, "withdrawn at the donor's request"],
 //   ["slot", "/asdf/45", 4],
 //   ["note", "blah blah"]
+//   ["slotmeta", "/asdf/45", "mtime", "2016-11-17T10:00:00Z"]
 //   ["add", "vh567"]
+//   ["mimetype", "vh567", "application/pdf"]
+//   ["blobmeta", "vh567", "rights", "http://rightsstatements.org/vocab/InC/1.0/"]
+//   ["versionmeta", "batch", "2016-11-17"]
+//   ["callback", "https://example.org/done"]
+//   ["bag", "vh568"]
+//   ["merge", "dup123", "copy", "delete"]
 //   ["sleep"]
 // ]
 type command []string
@@ -295,20 +438,19 @@ type command []string
 // Assumes the write mutex on tx is held on entry. Execute will
 // give up and then reacquire the write mutex on tx during lengthy processing steps.
 // Returns any errors encountered.
-func (c command) Execute(iw *items.Writer, tx *Transaction, cache blobcache.T) error {
+func (c command) Execute(iw *items.Writer, tx *Transaction, cache cache.Cache) error {
 	if !c.WellFormed() {
 		return fmt.Errorf("Command is not well formed")
 	}
 	cmd := []string(c)
 	switch cmd[0] {
 	case "delete":
-		// delete <blob id>, both in store and in cache
+		// delete <blob id> [<reason>], both in store and in cache
 		id, err := strconv.Atoi(cmd[1])
 		if err != nil {
 			return err
 		}
-		// key in blobcache is itemID+blobid
-		cacheKey := fmt.Sprintf("%s+%04d", tx.ItemID, id)
+		cacheKey := bendo.CacheKey(tx.ItemID, items.BlobID(id))
 		err = cache.Delete(cacheKey)
 		if err != nil {
 			// this is just an error deleting the item from the blob cache.
@@ -316,7 +458,11 @@ func (c command) Execute(iw *items.Writer, tx *Transaction, cache blobcache.T) e
 			// transaction.
 			tx.Err = append(tx.Err, "Removing "+cacheKey+": "+err.Error())
 		}
-		iw.DeleteBlob(items.BlobID(id))
+		if len(cmd) == 3 {
+			iw.DeleteBlobReason(items.BlobID(id), cmd[2])
+		} else {
+			iw.DeleteBlob(items.BlobID(id))
+		}
 	case "slot":
 		// slot <label> <blob id/file id>
 		// if the id resolves to a blob we have added
@@ -335,6 +481,9 @@ func (c command) Execute(iw *items.Writer, tx *Transaction, cache blobcache.T) e
 	case "note":
 		// note <text>
 		iw.SetNote(cmd[1])
+	case "slotmeta":
+		// slotmeta <label> <key> <value>
+		iw.SetSlotMeta(cmd[1], cmd[2], cmd[3])
 	case "add":
 		// add <file id>
 		f := tx.files.Lookup(cmd[1])
@@ -354,14 +503,60 @@ func (c command) Execute(iw *items.Writer, tx *Transaction, cache blobcache.T) e
 			return err2
 		}
 		tx.BlobMap[cmd[1]] = int(bid)
-		iw.SetMimeType(bid, fstat.MimeType)
+		mimetype := fstat.MimeType
+		if mimetype == "" {
+			tx.M.Unlock()
+			mimetype = sniffMimeType(f)
+			tx.M.Lock()
+		}
+		iw.SetMimeType(bid, mimetype)
 	case "mimetype":
-		// mimetype <blob id> <new mime type>
-		bid, err := strconv.ParseInt(cmd[1], 10, 64)
+		// mimetype <blob id/file id> <new mime type>
+		// like slot, the id may be a file added in this transaction.
+		id, err := tx.resolveBlob(cmd[1])
+		if err != nil {
+			return err
+		}
+		iw.SetMimeType(id, cmd[2])
+	case "blobmeta":
+		// blobmeta <blob id/file id> <key> <value>
+		id, err := tx.resolveBlob(cmd[1])
+		if err != nil {
+			return err
+		}
+		iw.SetBlobMeta(id, cmd[2], cmd[3])
+	case "versionmeta":
+		// versionmeta <key> <value>
+		iw.SetVersionMeta(cmd[1], cmd[2])
+	case "bag":
+		// bag <file id>
+		f := tx.files.Lookup(cmd[1])
+		if f == nil {
+			return fmt.Errorf("Cannot find %s", cmd[1])
+		}
+		tx.M.Unlock()
+		err := addBag(iw, f)
+		tx.M.Lock()
+		if err != nil {
+			return err
+		}
+	case "merge":
+		// merge <item id> [<directory> [delete]]
+		// copies the blobs and slots of the other item into this one.
+		// the server deletes the other item afterwards, if asked.
+		var dir string
+		if len(cmd) > 2 {
+			dir = cmd[2]
+		}
+		tx.M.Unlock()
+		err := iw.Merge(cmd[1], dir)
+		tx.M.Lock()
 		if err != nil {
-			return fmt.Errorf("Cannot resolve id %s", cmd[2])
+			return err
 		}
-		iw.SetMimeType(items.BlobID(bid), cmd[2])
+	case "callback":
+		// nothing to do. the server posts to the callbacks once the
+		// transaction is finished.
 	case "sleep":
 		// sleep for some length of time. intended to be used for testing.
 		// nothing magic about 1 sec. could be less
@@ -374,6 +569,25 @@ func (c command) Execute(iw *items.Writer, tx *Transaction, cache blobcache.T) e
 	return nil
 }
 
+// sniffMimeType guesses the mime type of an uploaded file from its first
+// 512 bytes. It returns "" if the file is empty or cannot be read.
+func sniffMimeType(f fragment.FileEntry) string {
+	r := f.Open()
+	defer r.Close()
+	return sniffReader(r)
+}
+
+// sniffReader guesses the mime type of the content read from r, as
+// sniffMimeType does.
+func sniffReader(r io.Reader) string {
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(r, buf)
+	if n == 0 || (err != nil && err != io.ErrUnexpectedEOF) {
+		return ""
+	}
+	return http.DetectContentType(buf[:n])
+}
+
 // WellFormed checks this command for well-formed-ness. It returns true if
 // the command is well formed, false otherwise.
 // Wellformedness is a weaker condition than being semantically meaningful.
@@ -386,7 +600,7 @@ func (c command) WellFormed() bool {
 		return false
 	}
 	switch {
-	case cmd[0] == "delete" && len(cmd) == 2:
+	case cmd[0] == "delete" && (len(cmd) == 2 || len(cmd) == 3):
 		_, err := strconv.Atoi(cmd[1])
 		if err == nil {
 			return true
@@ -395,12 +609,45 @@ func (c command) WellFormed() bool {
 		return true
 	case cmd[0] == "note" && len(cmd) == 2:
 		return true
+	case cmd[0] == "slotmeta" && len(cmd) == 4:
+		return true
 	case cmd[0] == "add" && len(cmd) == 2:
 		return true
+	case cmd[0] == "bag" && len(cmd) == 2:
+		return true
 	case cmd[0] == "sleep" && len(cmd) == 1:
 		return true
 	case cmd[0] == "mimetype" && len(cmd) == 3:
 		return true
+	case cmd[0] == "blobmeta" && len(cmd) == 4:
+		return cmd[2] != ""
+	case cmd[0] == "versionmeta" && len(cmd) == 3:
+		return cmd[1] != ""
+	case cmd[0] == "callback" && len(cmd) == 2:
+		return ValidCallbackURL(cmd[1])
+	case cmd[0] == "merge" && len(cmd) >= 2 && len(cmd) <= 4:
+		return cmd[1] != "" && (len(cmd) < 4 || cmd[3] == "delete")
 	}
 	return false
 }
+
+// resolveBlob returns the blob id named by s, which is either a file added
+// earlier in this transaction or the id of a blob already in the item.
+func (tx *Transaction) resolveBlob(s string) (items.BlobID, error) {
+	id, ok := tx.BlobMap[s]
+	if !ok {
+		var err error
+		id, err = strconv.Atoi(s)
+		if err != nil {
+			return 0, fmt.Errorf("Cannot resolve id %s", s)
+		}
+	}
+	return items.BlobID(id), nil
+}
+
+// ValidCallbackURL returns true if s can be used as a callback URL, that is,
+// it is an absolute http or https URL.
+func ValidCallbackURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
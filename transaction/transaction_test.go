@@ -31,3 +31,112 @@ func TestCommitErrors(t *testing.T) {
 		t.Errorf("Expected 1 error, got %d", len(tx.Err))
 	}
 }
+
+func TestCommitMimeType(t *testing.T) {
+	tape := items.NewWithCache(store.NewMemory(), items.NewMemoryCache())
+	uploads := fragment.New(store.NewMemory())
+	cache := blobcache.NewLRU(store.NewMemory(), 400)
+	var files = []struct {
+		id       string
+		content  string
+		mimetype string
+	}{
+		{"page", "<!DOCTYPE html><html><body>hello</body></html>", ""},
+		{"image", "not really a png", "image/png"},
+		{"data", "1,2,3\n", ""},
+		{"empty", "", ""},
+	}
+	for _, f := range files {
+		entry := uploads.New(f.id)
+		w, err := entry.Append()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(f.content))
+		w.Close()
+		entry.SetMimeType(f.mimetype)
+	}
+	tx := &Transaction{
+		ItemID:  "mime1234",
+		BlobMap: make(map[string]int),
+		Commands: []command{
+			command{"add", "page"},
+			command{"add", "image"},
+			command{"add", "data"},
+			command{"add", "empty"},
+			command{"mimetype", "data", "text/csv"},
+			command{"blobmeta", "image", "path", "scans/cover.png"},
+			command{"versionmeta", "batch", "42"},
+		},
+	}
+	tx.Commit(*tape, uploads, cache)
+	if len(tx.Err) != 0 {
+		t.Fatal(tx.Err)
+	}
+	item, err := tape.Item("mime1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected = map[string]string{
+		"page":  "text/html; charset=utf-8",
+		"image": "image/png",
+		"data":  "text/csv",
+		"empty": "",
+	}
+	for id, mimetype := range expected {
+		blob := item.Blobs[tx.BlobMap[id]-1]
+		if blob.MimeType != mimetype {
+			t.Errorf("%s: received %q, expected %q", id, blob.MimeType, mimetype)
+		}
+	}
+	if m := item.Blobs[tx.BlobMap["image"]-1].Meta; m["path"] != "scans/cover.png" {
+		t.Errorf("received blob metadata %v", m)
+	}
+	if m := item.Versions[0].Meta; m["batch"] != "42" {
+		t.Errorf("received version metadata %v", m)
+	}
+}
+
+func TestCommitMerge(t *testing.T) {
+	tape := items.NewWithCache(store.NewMemory(), items.NewMemoryCache())
+	uploads := fragment.New(store.NewMemory())
+	cache := blobcache.NewLRU(store.NewMemory(), 400)
+	entry := uploads.New("file1")
+	w, _ := entry.Append()
+	w.Write([]byte("hello"))
+	w.Close()
+	tx := &Transaction{
+		ItemID:   "dup1234",
+		BlobMap:  make(map[string]int),
+		Commands: []command{{"add", "file1"}, {"slot", "hello.txt", "file1"}},
+	}
+	tx.Commit(*tape, uploads, cache)
+	if len(tx.Err) != 0 {
+		t.Fatal(tx.Err)
+	}
+
+	for _, cmd := range []command{{"merge"}, {"merge", ""}, {"merge", "dup1234", "dir", "keep"}, {"delete", "1", "why", "extra"}, {"blobmeta", "1", "", "x"}, {"versionmeta", "batch"}} {
+		if cmd.WellFormed() {
+			t.Errorf("%v is well formed", cmd)
+		}
+	}
+	tx = &Transaction{
+		ItemID:   "keep1234",
+		BlobMap:  make(map[string]int),
+		Commands: []command{{"merge", "dup1234", "dup", "delete"}},
+	}
+	if md := tx.MergeDeletes(); len(md) != 1 || md[0] != "dup1234" {
+		t.Errorf("Received %v", md)
+	}
+	tx.Commit(*tape, uploads, cache)
+	if len(tx.Err) != 0 {
+		t.Fatal(tx.Err)
+	}
+	item, err := tape.Item("keep1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Versions[0].Slots["dup/hello.txt"] != 1 {
+		t.Errorf("Received slots %v", item.Versions[0].Slots)
+	}
+}
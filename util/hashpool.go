@@ -0,0 +1,70 @@
+package util
+
+import (
+	"expvar"
+	"runtime"
+	"time"
+)
+
+// A HashPool bounds how many checksums are computed at the same time, so
+// that hashing large streams during commit verification and fixity checking
+// does not take every CPU away from handling requests. Each hashing job
+// waits in a queue until one of the pool's workers is free.
+//
+// A nil *HashPool places no bound, and runs every job immediately.
+type HashPool struct {
+	workers chan struct{} // holds a token for each running job
+}
+
+var (
+	xHashQueued = expvar.NewInt("hash.queued") // jobs waiting for a worker
+	xHashActive = expvar.NewInt("hash.active") // jobs running now
+	xHashJobs   = expvar.NewInt("hash.jobs")   // jobs run in total
+	xHashWait   = expvar.NewFloat("hash.wait") // total seconds spent waiting
+)
+
+// NewHashPool returns a HashPool which runs at most n jobs at once. If n is
+// less than 1, it runs one at a time.
+func NewHashPool(n int) *HashPool {
+	if n < 1 {
+		n = 1
+	}
+	return &HashPool{workers: make(chan struct{}, n)}
+}
+
+// HashWorkers returns the number of workers to give a HashPool for the CPU
+// budget given as a fraction of GOMAXPROCS. The result is always at least 1.
+func HashWorkers(budget float64) int {
+	n := int(budget * float64(runtime.GOMAXPROCS(0)))
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// Size returns the number of jobs p runs at once, or 0 if it is unbounded.
+func (p *HashPool) Size() int {
+	if p == nil {
+		return 0
+	}
+	return cap(p.workers)
+}
+
+// Do waits for a free worker and then runs fn, returning its error.
+func (p *HashPool) Do(fn func() error) error {
+	if p == nil {
+		return fn()
+	}
+	start := time.Now()
+	xHashQueued.Add(1)
+	p.workers <- struct{}{}
+	xHashQueued.Add(-1)
+	xHashWait.Add(time.Since(start).Seconds())
+	xHashActive.Add(1)
+	defer func() {
+		xHashActive.Add(-1)
+		xHashJobs.Add(1)
+		<-p.workers
+	}()
+	return fn()
+}
@@ -0,0 +1,65 @@
+package util
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHashPool(t *testing.T) {
+	p := NewHashPool(2)
+	var running, most int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.Do(func() error {
+				n := atomic.AddInt32(&running, 1)
+				for {
+					m := atomic.LoadInt32(&most)
+					if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+						break
+					}
+				}
+				time.Sleep(5 * time.Millisecond)
+				atomic.AddInt32(&running, -1)
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+	if most > 2 {
+		t.Errorf("%d jobs ran at once, expected at most 2", most)
+	}
+	if xHashQueued.Value() != 0 || xHashActive.Value() != 0 {
+		t.Errorf("queued = %d, active = %d, expected 0", xHashQueued.Value(), xHashActive.Value())
+	}
+
+	want := errors.New("bad checksum")
+	if err := p.Do(func() error { return want }); err != want {
+		t.Errorf("Do returned %v, expected %v", err, want)
+	}
+
+	var nilpool *HashPool
+	if err := nilpool.Do(func() error { return want }); err != want {
+		t.Errorf("nil pool: Do returned %v, expected %v", err, want)
+	}
+	if nilpool.Size() != 0 {
+		t.Errorf("nil pool has size %d", nilpool.Size())
+	}
+}
+
+func TestHashWorkers(t *testing.T) {
+	if n := HashWorkers(0); n != 1 {
+		t.Errorf("HashWorkers(0) = %d, expected 1", n)
+	}
+	if n := HashWorkers(1); n < 1 {
+		t.Errorf("HashWorkers(1) = %d, expected at least 1", n)
+	}
+	if n := NewHashPool(0).Size(); n != 1 {
+		t.Errorf("NewHashPool(0).Size() = %d, expected 1", n)
+	}
+}
@@ -4,10 +4,59 @@ import (
 	"bytes"
 	"crypto/md5"
 	"crypto/sha256"
+	"crypto/sha512"
 	"hash"
 	"io"
+	"sort"
+	"sync"
 )
 
+// digests holds the named checksum algorithms which may be computed in
+// addition to MD5 and SHA256. The names are those used for BagIt manifests.
+var (
+	digestsM sync.RWMutex
+	digests  = map[string]func() hash.Hash{
+		"sha512": sha512.New,
+	}
+)
+
+// RegisterDigest makes the named checksum algorithm available to
+// HashWriter.AddDigest, replacing any earlier one with the same name. The
+// name should be lower case, as used in BagIt manifest file names. For
+// example, a BLAKE3 implementation can be added with
+//
+//	util.RegisterDigest("blake3", func() hash.Hash { return blake3.New() })
+func RegisterDigest(name string, fn func() hash.Hash) {
+	digestsM.Lock()
+	digests[name] = fn
+	digestsM.Unlock()
+}
+
+// DigestNames returns the names of the algorithms which have been
+// registered, sorted.
+func DigestNames() []string {
+	digestsM.RLock()
+	defer digestsM.RUnlock()
+	var result []string
+	for name := range digests {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// NewDigest returns a new hash for the named algorithm, or nil if there is
+// no algorithm registered with that name.
+func NewDigest(name string) hash.Hash {
+	digestsM.RLock()
+	fn := digests[name]
+	digestsM.RUnlock()
+	if fn == nil {
+		return nil
+	}
+	return fn()
+}
+
 // VerifyStreamHash checksums the given io.Reader and compares the checksum
 // against the provided md5 and sha256 checksums. It returns true if everything
 // matches, and false otherwise. Pass in an empty slice to not verify a given
@@ -38,6 +87,7 @@ type HashWriter struct {
 	io.Writer // our io.MultiWriter
 	md5       hash.Hash
 	sha256    hash.Hash
+	extra     map[string]hash.Hash // added by AddDigest
 }
 
 // NewHashWriter returns a HashWriter wrapping w.
@@ -70,6 +120,36 @@ func NewHashWriterPlain() *HashWriter {
 	return hw
 }
 
+// AddDigest makes this writer also compute the named checksum, which must
+// have been registered with RegisterDigest. It returns false if there is no
+// such algorithm. It must be called before anything is written.
+func (hw *HashWriter) AddDigest(name string) bool {
+	h := NewDigest(name)
+	if h == nil {
+		return false
+	}
+	if hw.extra == nil {
+		hw.extra = make(map[string]hash.Hash)
+	}
+	hw.extra[name] = h
+	hw.Writer = io.MultiWriter(hw.Writer, h)
+	return true
+}
+
+// Digests returns the checksums added with AddDigest of what has been
+// written so far, keyed by algorithm name. It returns nil if none were
+// added.
+func (hw *HashWriter) Digests() map[string][]byte {
+	if len(hw.extra) == 0 {
+		return nil
+	}
+	result := make(map[string][]byte, len(hw.extra))
+	for name, h := range hw.extra {
+		result[name] = h.Sum(nil)
+	}
+	return result
+}
+
 // CheckMD5 returns the MD5 hash for this writer, and compares it for equality
 // with the goal hash passed in. Returns true if goal matches the MD5 hash,
 // false otherwise. If the goal is empty then it is treated as matching, and
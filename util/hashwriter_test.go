@@ -18,6 +18,25 @@ func TestHashWriter(t *testing.T) {
 	dohashtest(t, hw2, input, goalMD5, nil)
 }
 
+func TestAddDigest(t *testing.T) {
+	var w = new(bytes.Buffer)
+	hw := NewHashWriter(w)
+	if hw.AddDigest("nosuch") {
+		t.Error("AddDigest(nosuch) == true")
+	}
+	if !hw.AddDigest("sha512") {
+		t.Fatal("AddDigest(sha512) == false")
+	}
+	hw.Write([]byte("abc"))
+	if w.String() != "abc" {
+		t.Errorf("Received %q", w.String())
+	}
+	h := hex.EncodeToString(hw.Digests()["sha512"])
+	if h != "ddaf35a193617abacc417349ae20413112e6fa4e89a97ea20a9eeee64b55d39a2192992a274fc1a836ba3c23a3feebbd454d4423643ce80e2a9ac94fa54ca49f" {
+		t.Errorf("Received %s", h)
+	}
+}
+
 func dohashtest(t *testing.T, hw *HashWriter, input string, goalmd5, goalsha256 []byte) {
 	hw.Write([]byte(input))
 	h, ok := hw.CheckMD5(goalmd5)